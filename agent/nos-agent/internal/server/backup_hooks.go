@@ -0,0 +1,217 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Backup hooks quiesce what a snapshot covers: the pre- and post-hooks of
+// backup schedules and the quiesce hooks of app manifests. They stop
+// containers and dump databases, which takes root, so nosd has the agent
+// run them. Schedule hooks are written by an administrator and run with
+// sh; app hooks come from catalogs, so they are limited to docker compose
+// exec, pause and unpause against the app's own project.
+
+const (
+	maxBackupHookTimeout = time.Hour
+	// maxBackupHookOutput is how much of the end of a hook's output is
+	// returned
+	maxBackupHookOutput = 64 << 10
+	// appsRoot holds the apps, each with its compose project in config/
+	appsRoot = "/srv/apps"
+)
+
+var (
+	appIDPattern          = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+	composeServicePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+	composeUserPattern    = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*(:[A-Za-z0-9_][A-Za-z0-9_.-]*)?$`)
+)
+
+type BackupHookRequest struct {
+	Command        string `json:"command"`
+	TimeoutSeconds int    `json:"timeout_seconds"`
+}
+
+// AppHookRequest is one docker compose command of an app's quiesce hook
+type AppHookRequest struct {
+	AppID          string   `json:"app_id"`
+	Action         string   `json:"action"` // exec, pause or unpause
+	Service        string   `json:"service"`
+	User           string   `json:"user"`
+	Workdir        string   `json:"workdir"`
+	Env            []string `json:"env"`
+	Services       []string `json:"services"`
+	Command        []string `json:"command"`
+	TimeoutSeconds int      `json:"timeout_seconds"`
+}
+
+type BackupHookResult struct {
+	Code     int    `json:"code"`
+	Output   string `json:"output"`
+	TimedOut bool   `json:"timed_out"`
+}
+
+func handleBackupHook(w http.ResponseWriter, r *http.Request) {
+	var req BackupHookRequest
+	if !decodeBackupRequest(w, r, &req) {
+		return
+	}
+	if err := validateBackupHook(req); err != nil {
+		writeErr(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(req.TimeoutSeconds)*time.Second)
+	defer cancel()
+	writeJSON(w, http.StatusOK, runBackupHook(ctx, req))
+}
+
+func handleAppHook(w http.ResponseWriter, r *http.Request) {
+	var req AppHookRequest
+	if !decodeBackupRequest(w, r, &req) {
+		return
+	}
+	if err := validateAppHook(req); err != nil {
+		writeErr(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(req.TimeoutSeconds)*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "docker", appHookArgs(req)...)
+	cmd.Dir = filepath.Join(appsRoot, req.AppID, "config")
+	writeJSON(w, http.StatusOK, runHookCommand(ctx, cmd))
+}
+
+func validateBackupHook(req BackupHookRequest) error {
+	if strings.TrimSpace(req.Command) == "" || strings.ContainsRune(req.Command, 0) {
+		return errors.New("command is required")
+	}
+	return validateHookTimeout(req.TimeoutSeconds)
+}
+
+func validateAppHook(req AppHookRequest) error {
+	if !appIDPattern.MatchString(req.AppID) {
+		return errors.New("invalid app_id")
+	}
+	switch req.Action {
+	case "pause", "unpause":
+		if req.Service != "" || req.User != "" || req.Workdir != "" || len(req.Env) > 0 || len(req.Command) > 0 {
+			return fmt.Errorf("%s takes only services", req.Action)
+		}
+		for _, service := range req.Services {
+			if !composeServicePattern.MatchString(service) {
+				return fmt.Errorf("invalid service %q", service)
+			}
+		}
+	case "exec":
+		if len(req.Services) > 0 {
+			return errors.New("exec takes a single service")
+		}
+		if !composeServicePattern.MatchString(req.Service) {
+			return fmt.Errorf("invalid service %q", req.Service)
+		}
+		if req.User != "" && !composeUserPattern.MatchString(req.User) {
+			return fmt.Errorf("invalid user %q", req.User)
+		}
+		if req.Workdir != "" && (!path.IsAbs(req.Workdir) || path.Clean(req.Workdir) != req.Workdir) {
+			return fmt.Errorf("invalid workdir %q", req.Workdir)
+		}
+		for _, kv := range req.Env {
+			if !validHookEnv(kv) {
+				return fmt.Errorf("invalid environment variable %q", kv)
+			}
+		}
+		if len(req.Command) == 0 {
+			return errors.New("command is required")
+		}
+		for _, arg := range req.Command {
+			if strings.ContainsRune(arg, 0) {
+				return errors.New("invalid command")
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported action %q", req.Action)
+	}
+	return validateHookTimeout(req.TimeoutSeconds)
+}
+
+func validateHookTimeout(seconds int) error {
+	if seconds < 1 || time.Duration(seconds)*time.Second > maxBackupHookTimeout {
+		return fmt.Errorf("timeout_seconds must be between 1 and %d", int(maxBackupHookTimeout/time.Second))
+	}
+	return nil
+}
+
+// validHookEnv accepts NAME=value with a shell variable name and a single
+// line value
+func validHookEnv(kv string) bool {
+	name, value, ok := strings.Cut(kv, "=")
+	if !ok || name == "" || strings.ContainsAny(value, "\n\r\x00") {
+		return false
+	}
+	for i, c := range name {
+		if !(c == '_' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || i > 0 && c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// appHookArgs is the docker command line of a validated app hook. The
+// project is always the app's own; the service is placed after every
+// option so the command cannot add options of its own.
+func appHookArgs(req AppHookRequest) []string {
+	args := []string{"compose", "--project-name", "nos-app-" + req.AppID, req.Action}
+	if req.Action != "exec" {
+		return append(args, req.Services...)
+	}
+	args = append(args, "-T")
+	if req.User != "" {
+		args = append(args, "--user", req.User)
+	}
+	if req.Workdir != "" {
+		args = append(args, "--workdir", req.Workdir)
+	}
+	for _, kv := range req.Env {
+		args = append(args, "--env", kv)
+	}
+	args = append(args, req.Service)
+	return append(args, req.Command...)
+}
+
+// runBackupHook runs a schedule hook with sh -c
+func runBackupHook(ctx context.Context, req BackupHookRequest) BackupHookResult {
+	return runHookCommand(ctx, exec.CommandContext(ctx, "/bin/sh", "-c", req.Command))
+}
+
+// runHookCommand runs a hook; a hook still running at the deadline of ctx
+// is killed with the commands it started
+func runHookCommand(ctx context.Context, cmd *exec.Cmd) BackupHookResult {
+	cmd.Env = []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin", "HOME=/root", "LANG=C.UTF-8"}
+	killProcessGroup(cmd)
+	cmd.WaitDelay = 5 * time.Second
+	out, err := cmd.CombinedOutput()
+	if len(out) > maxBackupHookOutput {
+		out = out[len(out)-maxBackupHookOutput:]
+	}
+
+	res := BackupHookResult{Output: string(out)}
+	var exitErr *exec.ExitError
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		res.Code, res.TimedOut = -1, true
+	case errors.As(err, &exitErr):
+		res.Code = exitErr.ExitCode()
+	case err != nil:
+		res.Code = -1
+		res.Output += err.Error()
+	}
+	return res
+}
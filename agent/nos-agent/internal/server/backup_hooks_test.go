@@ -0,0 +1,117 @@
+package server
+
+import (
+	"context"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackupHookValidation(t *testing.T) {
+	ok := BackupHookRequest{Command: "systemctl stop minecraft", TimeoutSeconds: 300}
+	if err := validateBackupHook(ok); err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []func(*BackupHookRequest){
+		func(r *BackupHookRequest) { r.Command = " " },
+		func(r *BackupHookRequest) { r.TimeoutSeconds = 0 },
+		func(r *BackupHookRequest) { r.TimeoutSeconds = 7200 },
+	} {
+		req := ok
+		bad(&req)
+		if err := validateBackupHook(req); err == nil {
+			t.Errorf("accepted %+v", req)
+		}
+	}
+}
+
+func TestAppHookValidation(t *testing.T) {
+	ok := AppHookRequest{
+		AppID:          "nextcloud",
+		Action:         "exec",
+		Service:        "app",
+		User:           "www-data",
+		Workdir:        "/var/www/html",
+		Env:            []string{"OC_PASS=x"},
+		Command:        []string{"php", "occ", "maintenance:mode", "--on"},
+		TimeoutSeconds: 300,
+	}
+	if err := validateAppHook(ok); err != nil {
+		t.Fatal(err)
+	}
+	pause := AppHookRequest{AppID: "immich", Action: "pause", Services: []string{"server", "ml"}, TimeoutSeconds: 300}
+	if err := validateAppHook(pause); err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []func(*AppHookRequest){
+		func(r *AppHookRequest) { r.AppID = "../etc" },
+		func(r *AppHookRequest) { r.AppID = "" },
+		func(r *AppHookRequest) { r.Action = "run" },
+		func(r *AppHookRequest) { r.Action = "up" },
+		func(r *AppHookRequest) { r.Action = "pause" },
+		func(r *AppHookRequest) { r.Service = "--privileged" },
+		func(r *AppHookRequest) { r.Service = "" },
+		func(r *AppHookRequest) { r.Services = []string{"db"} },
+		func(r *AppHookRequest) { r.User = "root --privileged" },
+		func(r *AppHookRequest) { r.Workdir = "tmp" },
+		func(r *AppHookRequest) { r.Workdir = "/tmp/../etc" },
+		func(r *AppHookRequest) { r.Env = []string{"1X=y"} },
+		func(r *AppHookRequest) { r.Env = []string{"X=a\nb"} },
+		func(r *AppHookRequest) { r.Command = nil },
+		func(r *AppHookRequest) { r.TimeoutSeconds = 0 },
+	} {
+		req := ok
+		bad(&req)
+		if err := validateAppHook(req); err == nil {
+			t.Errorf("accepted %+v", req)
+		}
+	}
+	pause.Services = []string{"-d"}
+	if err := validateAppHook(pause); err == nil {
+		t.Errorf("accepted %+v", pause)
+	}
+}
+
+func TestAppHookArgs(t *testing.T) {
+	got := strings.Join(appHookArgs(AppHookRequest{
+		AppID:   "nextcloud",
+		Action:  "exec",
+		Service: "db",
+		User:    "postgres",
+		Env:     []string{"A=b"},
+		Command: []string{"sh", "-c", "pg_dump -U \"$POSTGRES_USER\""},
+	}), " ")
+	want := `compose --project-name nos-app-nextcloud exec -T --user postgres --env A=b db sh -c pg_dump -U "$POSTGRES_USER"`
+	if got != want {
+		t.Errorf("args %s\nwant %s", got, want)
+	}
+	got = strings.Join(appHookArgs(AppHookRequest{AppID: "immich", Action: "unpause"}), " ")
+	if got != "compose --project-name nos-app-immich unpause" {
+		t.Errorf("args %s", got)
+	}
+}
+
+func TestBackupHookTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hooks run with sh")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	res := runBackupHook(ctx, BackupHookRequest{Command: `echo hello; sleep 10`})
+	if !res.TimedOut || res.Code != -1 {
+		t.Fatalf("result %+v", res)
+	}
+	if time.Since(started) > 5*time.Second {
+		t.Fatalf("hook ran for %s", time.Since(started))
+	}
+	if strings.TrimSpace(res.Output) != "hello" {
+		t.Errorf("output %q", res.Output)
+	}
+
+	res = runBackupHook(context.Background(), BackupHookRequest{Command: "echo failing >&2; exit 3"})
+	if res.Code != 3 || res.TimedOut || strings.TrimSpace(res.Output) != "failing" {
+		t.Errorf("result %+v", res)
+	}
+}
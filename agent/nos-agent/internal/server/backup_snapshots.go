@@ -0,0 +1,226 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Backup schedules name subvolumes the way they appear at the top level
+// of the system volume ("@home", "@snapshots/@home/20240102-030405").
+// The agent mounts that top level once and resolves the names below it.
+var (
+	backupRootDevice = "/dev/mapper/nos-root"
+	backupTopLevel   = "/run/nos-agent/btrfs-top"
+	backupTopLevelMu sync.Mutex
+)
+
+type BackupSnapshotRequest struct {
+	Source   string `json:"source"`
+	Path     string `json:"path"`
+	ReadOnly bool   `json:"read_only"`
+}
+
+type BackupSnapshotPathRequest struct {
+	Path string `json:"path"`
+}
+
+// BackupSnapshotInfo is what `btrfs subvolume show` reports for a snapshot
+type BackupSnapshotInfo struct {
+	Path       string    `json:"path"`
+	UUID       string    `json:"uuid"`
+	Generation int64     `json:"generation"`
+	ReadOnly   bool      `json:"read_only"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func handleBackupSnapshot(w http.ResponseWriter, r *http.Request) {
+	var req BackupSnapshotRequest
+	if !decodeBackupRequest(w, r, &req) {
+		return
+	}
+	if !validBackupSnapshotName(req.Path) {
+		writeErr(w, http.StatusBadRequest, "snapshot path must be below @snapshots or .snapshots")
+		return
+	}
+	ctx := r.Context()
+	src, err := resolveBackupPath(ctx, req.Source)
+	if err != nil {
+		writeErr(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	dst, err := resolveBackupPath(ctx, req.Path)
+	if err != nil {
+		writeErr(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		writeErr(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	args := []string{"subvolume", "snapshot"}
+	if req.ReadOnly {
+		args = append(args, "-r")
+	}
+	if _, err := btrfsOutput(ctx, append(args, src, dst)...); err != nil {
+		writeErr(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+}
+
+func handleBackupSnapshotDelete(w http.ResponseWriter, r *http.Request) {
+	var req BackupSnapshotPathRequest
+	if !decodeBackupRequest(w, r, &req) {
+		return
+	}
+	if !validBackupSnapshotName(req.Path) {
+		writeErr(w, http.StatusBadRequest, "snapshot path must be below @snapshots or .snapshots")
+		return
+	}
+	path, err := resolveBackupPath(r.Context(), req.Path)
+	if err != nil {
+		writeErr(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+		return
+	}
+	if _, err := btrfsOutput(r.Context(), "subvolume", "delete", path); err != nil {
+		writeErr(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+}
+
+func handleBackupSnapshotShow(w http.ResponseWriter, r *http.Request) {
+	var req BackupSnapshotPathRequest
+	if !decodeBackupRequest(w, r, &req) {
+		return
+	}
+	path, err := resolveBackupPath(r.Context(), req.Path)
+	if err != nil {
+		writeErr(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	info, err := showSubvolume(r.Context(), path)
+	if err != nil {
+		writeErr(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, BackupSnapshotInfo{
+		Path:       req.Path,
+		UUID:       info.UUID,
+		Generation: info.Generation,
+		ReadOnly:   info.ReadOnly,
+		CreatedAt:  info.CreatedAt,
+	})
+}
+
+func decodeBackupRequest(w http.ResponseWriter, r *http.Request, v any) bool {
+	if r.Method != http.MethodPost {
+		writeErr(w, http.StatusMethodNotAllowed, "method not allowed")
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		writeErr(w, http.StatusNotImplemented, "not supported on windows")
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeErr(w, http.StatusBadRequest, "invalid json")
+		return false
+	}
+	return true
+}
+
+// validBackupSubvolumeName accepts clean names of subvolumes at the top
+// level of the system volume, which start with "@"
+func validBackupSubvolumeName(name string) bool {
+	if name == "" || filepath.IsAbs(name) || filepath.Clean(name) != name || strings.ContainsAny(name, "\t\n\r\x00") {
+		return false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return false
+		}
+	}
+	return strings.HasPrefix(name, "@")
+}
+
+// validBackupSnapshotName accepts the snapshots backups take and delete:
+// @snapshots/<subvolume>/<name> on the system volume, or
+// <dir>/.snapshots/<subvolume>/<name> on pools below /srv or /mnt. Never
+// a snapshot directory itself or a subvolume outside one.
+func validBackupSnapshotName(name string) bool {
+	if filepath.IsAbs(name) {
+		if !isAllowedMountPath(name) || filepath.Clean(name) != name || strings.ContainsAny(name, "\t\n\r\x00") {
+			return false
+		}
+		_, rest, ok := strings.Cut(name, "/.snapshots/")
+		return ok && strings.Count(rest, "/") >= 1
+	}
+	return validBackupSubvolumeName(name) && strings.HasPrefix(name, "@snapshots/") && strings.Count(name, "/") >= 2
+}
+
+// resolveBackupPath turns a subvolume name into a path below the mounted
+// top level. Absolute paths must be below /srv or /mnt.
+func resolveBackupPath(ctx context.Context, name string) (string, error) {
+	if filepath.IsAbs(name) {
+		if !isAllowedMountPath(name) || filepath.Clean(name) != name {
+			return "", fmt.Errorf("path must be a clean path below /srv or /mnt")
+		}
+		return name, nil
+	}
+	if !validBackupSubvolumeName(name) {
+		return "", fmt.Errorf("invalid subvolume name %q", name)
+	}
+	if err := mountBackupTopLevel(ctx); err != nil {
+		return "", err
+	}
+	return filepath.Join(backupTopLevel, name), nil
+}
+
+// mountBackupTopLevel mounts the top level (subvolid 5) of the system
+// volume unless it is already mounted
+func mountBackupTopLevel(ctx context.Context) error {
+	backupTopLevelMu.Lock()
+	defer backupTopLevelMu.Unlock()
+	if isMountPoint(backupTopLevel) {
+		return nil
+	}
+	if err := os.MkdirAll(backupTopLevel, 0o700); err != nil {
+		return err
+	}
+	out, err := exec.CommandContext(ctx, "mount", "-t", "btrfs", "-o", "subvolid=5", backupRootDevice, backupTopLevel).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("mount top level of %s: %v: %s", backupRootDevice, err, truncate(strings.TrimSpace(string(out)), 1024))
+	}
+	return nil
+}
+
+func isMountPoint(path string) bool {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		// Field 5 is the mount point
+		fields := strings.Fields(sc.Text())
+		if len(fields) > 4 && fields[4] == path {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,27 @@
+package server
+
+import (
+	"context"
+	"testing"
+)
+
+func TestBackupSnapshotNames(t *testing.T) {
+	for _, name := range []string{"@snapshots/@home/20240102-030405", "@snapshots/restore-safety/data-20240102-030405", "/srv/backups/.snapshots/web1/20240102-030405"} {
+		if !validBackupSnapshotName(name) {
+			t.Errorf("rejected %s", name)
+		}
+	}
+	for _, name := range []string{"@snapshots", "@snapshots/@home", "@home/x/y", "@snapshots/../@home/x", "/srv/pool/@snapshots/a/b", "@snapshots/a/b/", "/srv/backups/.snapshots/web1", "/etc/.snapshots/a/b", "/srv/x/.snapshots/../../etc/b"} {
+		if validBackupSnapshotName(name) {
+			t.Errorf("accepted %s", name)
+		}
+	}
+	for _, name := range []string{"home", "@home/../..", "/etc/shadow", "/srv/../etc"} {
+		if _, err := resolveBackupPath(context.Background(), name); err == nil {
+			t.Errorf("resolved %s", name)
+		}
+	}
+	if p, err := resolveBackupPath(context.Background(), "/srv/pool/data"); err != nil || p != "/srv/pool/data" {
+		t.Errorf("absolute path: %q, %v", p, err)
+	}
+}
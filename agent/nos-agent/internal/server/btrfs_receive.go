@@ -0,0 +1,323 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LandingRequest prepares a subvolume that receives replication streams
+// from paired NithronOS peers. Everything received below it is accounted
+// to one level-1 qgroup so LimitBytes caps the whole landing area.
+type LandingRequest struct {
+	Path       string `json:"path"`
+	LimitBytes int64  `json:"limit_bytes"` // 0 removes the limit
+}
+
+type LandingResponse struct {
+	OK         bool   `json:"ok"`
+	Path       string `json:"path"`
+	QGroup     string `json:"qgroup"`
+	LimitBytes int64  `json:"limit_bytes"`
+}
+
+// ReceiveResponse describes the subvolume created by a btrfs receive
+type ReceiveResponse struct {
+	Name         string `json:"name"`
+	Path         string `json:"path"`
+	UUID         string `json:"uuid,omitempty"`
+	ReceivedUUID string `json:"received_uuid,omitempty"`
+	Generation   int64  `json:"generation"`
+	Bytes        int64  `json:"bytes"`
+	Warning      string `json:"warning,omitempty"`
+}
+
+type SubvolumeDeleteRequest struct {
+	Path string `json:"path"`
+}
+
+// subvolumeInfo holds the fields of `btrfs subvolume show` we use
+type subvolumeInfo struct {
+	ID           int64
+	UUID         string
+	ReceivedUUID string
+	Generation   int64
+	ReadOnly     bool
+	CreatedAt    time.Time
+}
+
+func handleBtrfsLanding(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeErr(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if runtime.GOOS == "windows" {
+		writeErr(w, http.StatusNotImplemented, "not supported on windows")
+		return
+	}
+	var req LandingRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if !validLandingPath(req.Path) || req.LimitBytes < 0 {
+		writeErr(w, http.StatusBadRequest, "invalid landing path or limit")
+		return
+	}
+	ctx := r.Context()
+
+	if _, err := os.Stat(req.Path); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(req.Path), 0o755); err != nil {
+			writeErr(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if _, err := btrfsOutput(ctx, "subvolume", "create", req.Path); err != nil {
+			writeErr(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	if _, err := btrfsOutput(ctx, "quota", "enable", req.Path); err != nil {
+		writeErr(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	info, err := showSubvolume(ctx, req.Path)
+	if err != nil {
+		writeErr(w, http.StatusBadRequest, "landing path is not a subvolume: "+err.Error())
+		return
+	}
+	qgroup := landingQGroup(info.ID)
+	if _, err := btrfsOutput(ctx, "qgroup", "create", qgroup, req.Path); err != nil && !strings.Contains(strings.ToLower(err.Error()), "exists") {
+		writeErr(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	limit := "none"
+	if req.LimitBytes > 0 {
+		limit = strconv.FormatInt(req.LimitBytes, 10)
+	}
+	if _, err := btrfsOutput(ctx, "qgroup", "limit", limit, qgroup, req.Path); err != nil {
+		writeErr(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, LandingResponse{OK: true, Path: req.Path, QGroup: qgroup, LimitBytes: req.LimitBytes})
+}
+
+// handleBtrfsReceive pipes the request body into `btrfs receive`. The
+// query names the landing subvolume and the directory below it that
+// receives the stream.
+func handleBtrfsReceive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeErr(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if runtime.GOOS == "windows" {
+		writeErr(w, http.StatusNotImplemented, "not supported on windows")
+		return
+	}
+	landing := r.URL.Query().Get("landing")
+	dir := r.URL.Query().Get("dir")
+	if dir == "" {
+		dir = landing
+	}
+	if !validLandingPath(landing) || !withinDir(landing, dir) || dir == landing {
+		writeErr(w, http.StatusBadRequest, "invalid landing or dir")
+		return
+	}
+	ctx := r.Context()
+	landingInfo, err := showSubvolume(ctx, landing)
+	if err != nil {
+		writeErr(w, http.StatusBadRequest, "landing path is not a subvolume: "+err.Error())
+		return
+	}
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		writeErr(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	body := &countingReader{r: r.Body}
+	cmd := exec.CommandContext(ctx, "btrfs", "receive", "-e", dir)
+	cmd.Stdin = body
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		// A partial subvolume is left behind when the stream breaks off
+		if name := parseReceivedName(out.String()); name != "" {
+			_, _ = btrfsOutput(context.Background(), "subvolume", "delete", filepath.Join(dir, name))
+		}
+		writeErr(w, http.StatusInternalServerError, "btrfs receive failed: "+truncate(strings.TrimSpace(out.String()), 4096))
+		return
+	}
+	name := parseReceivedName(out.String())
+	if name == "" {
+		writeErr(w, http.StatusInternalServerError, "btrfs receive did not report a subvolume")
+		return
+	}
+
+	res := ReceiveResponse{Name: name, Path: filepath.Join(dir, name), Bytes: body.n}
+	info, err := showSubvolume(ctx, res.Path)
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	res.UUID = info.UUID
+	res.ReceivedUUID = info.ReceivedUUID
+	res.Generation = info.Generation
+	// New subvolumes get their own qgroup; add it to the landing's so the
+	// limit covers it
+	if _, err := btrfsOutput(ctx, "qgroup", "assign", fmt.Sprintf("0/%d", info.ID), landingQGroup(landingInfo.ID), landing); err != nil {
+		res.Warning = "qgroup assign failed: " + err.Error()
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func handleBtrfsSubvolumeDelete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeErr(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if runtime.GOOS == "windows" {
+		writeErr(w, http.StatusNotImplemented, "not supported on windows")
+		return
+	}
+	var req SubvolumeDeleteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	// Only replicas received into a landing
+	if !validReplicaPath(req.Path) {
+		writeErr(w, http.StatusBadRequest, "invalid path")
+		return
+	}
+	if _, err := os.Stat(req.Path); os.IsNotExist(err) {
+		writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+		return
+	}
+	if _, err := btrfsOutput(r.Context(), "subvolume", "delete", req.Path); err != nil {
+		writeErr(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+}
+
+// landingDirName is the landing subvolume in the root of a pool. Streams
+// are only received, and subvolumes only deleted, below it.
+const landingDirName = ".nos-replica"
+
+// validLandingPath accepts <pool>/.nos-replica for a pool below /srv or /mnt
+func validLandingPath(p string) bool {
+	if !isAllowedMountPath(p) || filepath.Clean(p) != p || filepath.Base(p) != landingDirName {
+		return false
+	}
+	pool := filepath.Dir(p)
+	return strings.Count(pool, "/") >= 2 && !strings.Contains(pool+"/", "/"+landingDirName+"/")
+}
+
+// validReplicaPath accepts the subvolumes nosd receives into a landing,
+// <landing>/<peer>/<subvolume>/<name>
+func validReplicaPath(p string) bool {
+	i := strings.Index(p, "/"+landingDirName+"/")
+	if i < 0 || filepath.Clean(p) != p {
+		return false
+	}
+	landing := p[:i+1+len(landingDirName)]
+	return validLandingPath(landing) && strings.Count(p[len(landing):], "/") >= 3
+}
+
+func withinDir(base, p string) bool {
+	if p == "" || filepath.Clean(p) != p || strings.ContainsAny(p, "\t\n\r\x00") {
+		return false
+	}
+	return p == base || strings.HasPrefix(p, base+"/")
+}
+
+func landingQGroup(subvolID int64) string {
+	return fmt.Sprintf("1/%d", subvolID)
+}
+
+func btrfsOutput(ctx context.Context, args ...string) (string, error) {
+	out, err := exec.CommandContext(ctx, "btrfs", args...).CombinedOutput()
+	if err != nil {
+		return string(out), fmt.Errorf("btrfs %s: %v: %s", strings.Join(args[:min(2, len(args))], " "), err, truncate(strings.TrimSpace(string(out)), 1024))
+	}
+	return string(out), nil
+}
+
+func showSubvolume(ctx context.Context, path string) (subvolumeInfo, error) {
+	out, err := btrfsOutput(ctx, "subvolume", "show", path)
+	if err != nil {
+		return subvolumeInfo{}, err
+	}
+	info := parseSubvolumeShow(out)
+	if info.ID == 0 {
+		return info, fmt.Errorf("no subvolume id in btrfs subvolume show output")
+	}
+	return info, nil
+}
+
+var receivedNameRe = regexp.MustCompile(`(?m)^At (?:subvol|snapshot) (.+)$`)
+
+// parseReceivedName returns the subvolume `btrfs receive` reported creating
+func parseReceivedName(out string) string {
+	m := receivedNameRe.FindAllStringSubmatch(out, -1)
+	if len(m) == 0 {
+		return ""
+	}
+	name := strings.TrimSpace(m[len(m)-1][1])
+	if name == "" || strings.Contains(name, "/") || name == "." || name == ".." {
+		return ""
+	}
+	return name
+}
+
+// parseSubvolumeShow parses `btrfs subvolume show` output
+func parseSubvolumeShow(out string) subvolumeInfo {
+	var info subvolumeInfo
+	for _, line := range strings.Split(out, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if value == "-" {
+			value = ""
+		}
+		switch key {
+		case "UUID":
+			info.UUID = value
+		case "Received UUID":
+			info.ReceivedUUID = value
+		case "Subvolume ID":
+			info.ID, _ = strconv.ParseInt(value, 10, 64)
+		case "Generation":
+			info.Generation, _ = strconv.ParseInt(value, 10, 64)
+		case "Flags":
+			info.ReadOnly = strings.Contains(value, "readonly")
+		case "Creation time":
+			info.CreatedAt, _ = time.Parse("2006-01-02 15:04:05 -0700", value)
+		}
+	}
+	return info
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseReceivedName(t *testing.T) {
+	out := "At subvol 20240102-030405\n"
+	if got := parseReceivedName(out); got != "20240102-030405" {
+		t.Fatalf("got %q", got)
+	}
+	out = "At snapshot 20240103-030405\nwrite data offset=0 length=4096\n"
+	if got := parseReceivedName(out); got != "20240103-030405" {
+		t.Fatalf("got %q", got)
+	}
+	if got := parseReceivedName("At subvol ../escape\n"); got != "" {
+		t.Fatalf("accepted %q", got)
+	}
+	if got := parseReceivedName("ERROR: empty stream is not considered valid\n"); got != "" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestParseSubvolumeShow(t *testing.T) {
+	out := `/srv/pool/peers/nas1/@home/20240102-030405
+	Name: 			20240102-030405
+	UUID: 			5e0f7c1a-5f0e-4b4a-9d65-2d4a1c0b9e11
+	Parent UUID: 		-
+	Received UUID: 		0c1f6f4e-7a3b-4c2e-8d2b-9d4b0e6c3a22
+	Creation time: 		2024-01-02 03:04:06 +0000
+	Subvolume ID: 		261
+	Generation: 		48
+	Gen at creation: 	45
+	Parent ID: 		258
+	Top level ID: 		258
+	Flags: 			readonly
+`
+	info := parseSubvolumeShow(out)
+	if info.ID != 261 || info.Generation != 48 {
+		t.Fatalf("id=%d generation=%d", info.ID, info.Generation)
+	}
+	if info.UUID != "5e0f7c1a-5f0e-4b4a-9d65-2d4a1c0b9e11" || info.ReceivedUUID != "0c1f6f4e-7a3b-4c2e-8d2b-9d4b0e6c3a22" {
+		t.Fatalf("uuid=%q received=%q", info.UUID, info.ReceivedUUID)
+	}
+	if !info.ReadOnly || !info.CreatedAt.Equal(time.Date(2024, 1, 2, 3, 4, 6, 0, time.UTC)) {
+		t.Fatalf("readonly=%v created=%v", info.ReadOnly, info.CreatedAt)
+	}
+	if parseSubvolumeShow("\tReceived UUID: \t-\n").ReceivedUUID != "" {
+		t.Fatal("dash should parse as empty")
+	}
+}
+
+func TestLandingPathValidation(t *testing.T) {
+	for _, p := range []string{"/srv/pool/.nos-replica", "/mnt/backup/.nos-replica"} {
+		if !validLandingPath(p) {
+			t.Errorf("rejected %s", p)
+		}
+	}
+	for _, p := range []string{"/srv/pool/peers", "/srv/.nos-replica", "/srv/pool", "/etc/pool/.nos-replica", "/srv/pool/../.nos-replica",
+		"/srv/pool/.nos-replica/", "/srv/pool/.nos-replica/x/.nos-replica", "relative/.nos-replica"} {
+		if validLandingPath(p) {
+			t.Errorf("accepted %s", p)
+		}
+	}
+	if !withinDir("/srv/pool/.nos-replica", "/srv/pool/.nos-replica/nas1/@home") || withinDir("/srv/pool/.nos-replica", "/srv/pool/.nos-replica2") {
+		t.Error("withinDir")
+	}
+
+	if !validReplicaPath("/srv/pool/.nos-replica/nas1/@home/20240102-030405") {
+		t.Error("rejected a replica")
+	}
+	// Shares, pools and the landing layout itself are never deleted
+	for _, p := range []string{"/srv/pool/shares", "/srv/pool/shares/docs", "/srv/pool/.nos-replica", "/srv/pool/.nos-replica/nas1",
+		"/srv/pool/.nos-replica/nas1/@home", "/srv/pool/.nos-replica/nas1/../../shares/x", "/srv/pool/peers/nas1/@home/snap"} {
+		if validReplicaPath(p) {
+			t.Errorf("accepted %s for deletion", p)
+		}
+	}
+}
+
+func TestBtrfsReceive_Routes(t *testing.T) {
+	mux := buildMux()
+	for _, path := range []string{"/v1/btrfs/landing", "/v1/btrfs/receive", "/v1/btrfs/subvolume/delete"} {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		if rr.Code != http.StatusMethodNotAllowed {
+			t.Fatalf("GET %s expected 405, got %d", path, rr.Code)
+		}
+	}
+	if runtime.GOOS == "windows" {
+		return
+	}
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/v1/btrfs/receive?landing=/srv/pool/.nos-replica&dir=/srv/other", strings.NewReader("stream")))
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("receive outside landing expected 400, got %d", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/v1/btrfs/landing", bytes.NewReader([]byte(`{"path":"/srv"}`))))
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("landing on pool root expected 400, got %d", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/v1/btrfs/subvolume/delete", bytes.NewReader([]byte(`{"path":"/srv/pool"}`))))
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("delete of pool root expected 400, got %d", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/v1/btrfs/subvolume/delete", bytes.NewReader([]byte(`{"path":"/srv/pool/shares"}`))))
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("delete of a share expected 400, got %d", rr.Code)
+	}
+}
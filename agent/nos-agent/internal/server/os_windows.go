@@ -2,7 +2,11 @@
 
 package server
 
+import "os/exec"
+
 func mustBeRoot() error { return nil }
 
 func runtimeChownSupported() bool                 { return false }
 func chownByName(path, owner, group string) error { return nil }
+
+func killProcessGroup(cmd *exec.Cmd) {}
@@ -84,6 +84,14 @@ func buildMux() http.Handler {
 	mux.HandleFunc("/v1/snapshot/prune", handleSnapshotPrune)
 	mux.HandleFunc("/v1/storage/lsblk", handleStorageLsblk)
 	mux.HandleFunc("/v1/smart", handleSmartSummary)
+	mux.HandleFunc("/v1/btrfs/landing", handleBtrfsLanding)
+	mux.HandleFunc("/v1/btrfs/receive", handleBtrfsReceive)
+	mux.HandleFunc("/v1/btrfs/subvolume/delete", handleBtrfsSubvolumeDelete)
+	mux.HandleFunc("/v1/backup/snapshot", handleBackupSnapshot)
+	mux.HandleFunc("/v1/backup/snapshot/delete", handleBackupSnapshotDelete)
+	mux.HandleFunc("/v1/backup/snapshot/show", handleBackupSnapshotShow)
+	mux.HandleFunc("/v1/backup/hook", handleBackupHook)
+	mux.HandleFunc("/v1/backup/app-hook", handleAppHook)
 	// Prometheus metrics on the same unix socket
 	mux.Handle("/metrics", metricsHandler())
 	return mux
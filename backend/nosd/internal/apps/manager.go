@@ -11,6 +11,8 @@ import (
 	"sync"
 	"time"
 
+	"github.com/rs/zerolog"
+
 	"nithronos/backend/nosd/pkg/apps"
 )
 
@@ -20,6 +22,7 @@ type Manager struct {
 	stateStore    *apps.StateStore
 	lifecycleMgr  *apps.LifecycleManager
 	healthMonitor *apps.HealthMonitor
+	updater       *apps.Updater
 	renderer      *apps.TemplateRenderer
 	eventLogger   *EventLogger
 	config        *Config
@@ -35,6 +38,7 @@ type Config struct {
 	TemplatesPath string
 	AgentPath     string
 	CaddyPath     string
+	Logger        zerolog.Logger
 }
 
 // EventLogger implements the apps.EventLogger interface
@@ -164,11 +168,15 @@ func NewManager(config *Config) (*Manager, error) {
 	// Create health monitor
 	healthMonitor := apps.NewHealthMonitor(stateStore, catalogMgr)
 
+	// Create updater
+	updater := apps.NewUpdater(lifecycleMgr, healthMonitor, config.Logger)
+
 	return &Manager{
 		catalogMgr:    catalogMgr,
 		stateStore:    stateStore,
 		lifecycleMgr:  lifecycleMgr,
 		healthMonitor: healthMonitor,
+		updater:       updater,
 		renderer:      renderer,
 		eventLogger:   eventLogger,
 		config:        config,
@@ -188,6 +196,11 @@ func (m *Manager) Start(ctx context.Context) error {
 		return fmt.Errorf("failed to start health monitor: %w", err)
 	}
 
+	// Start update checks and scheduled upgrades
+	if err := m.updater.Start(ctx); err != nil {
+		return fmt.Errorf("failed to start updater: %w", err)
+	}
+
 	// Start periodic catalog sync
 	go m.catalogSyncLoop(ctx)
 
@@ -197,6 +210,7 @@ func (m *Manager) Start(ctx context.Context) error {
 // Stop stops the app manager
 func (m *Manager) Stop() error {
 	m.healthMonitor.Stop()
+	m.updater.Stop()
 	return m.eventLogger.Close()
 }
 
@@ -282,6 +296,44 @@ func (m *Manager) DeleteApp(ctx context.Context, appID string, keepData bool, us
 	return m.lifecycleMgr.DeleteApp(ctx, appID, keepData, userID)
 }
 
+// SetExposure changes how an app's web UI is reached
+func (m *Manager) SetExposure(ctx context.Context, appID string, expose apps.Exposure, userID string) error {
+	return m.lifecycleMgr.SetExposure(ctx, appID, expose, userID)
+}
+
+// UseCertSource makes app sites get certificates from the HTTPS manager
+func (m *Manager) UseCertSource(certs apps.CertSource) {
+	m.lifecycleMgr.UseCertSource(certs)
+}
+
+// OIDCIssuer is the issuer apps are configured with for single sign-on
+func (m *Manager) OIDCIssuer() string {
+	return m.lifecycleMgr.OIDCIssuer()
+}
+
+// UseSSOProvider registers apps that support single sign-on with the
+// OIDC provider
+func (m *Manager) UseSSOProvider(provider apps.SSOProvider) {
+	m.lifecycleMgr.UseSSOProvider(provider)
+}
+
+// UseUpdateNotifier tells notifier about app updates and how automatic
+// upgrades went
+func (m *Manager) UseUpdateNotifier(notifier apps.UpdateNotifier) {
+	m.updater.UseNotifier(notifier)
+}
+
+// SetUpdatePolicy changes what happens when an update for an app is
+// available
+func (m *Manager) SetUpdatePolicy(appID string, policy apps.UpdatePolicy, userID string) error {
+	return m.lifecycleMgr.SetUpdatePolicy(appID, policy, userID)
+}
+
+// CheckUpdates checks every installed app for updates now
+func (m *Manager) CheckUpdates(ctx context.Context) {
+	m.updater.CheckAll(ctx)
+}
+
 // RollbackApp rolls back an app to a snapshot
 func (m *Manager) RollbackApp(ctx context.Context, appID string, snapshotTS string, userID string) error {
 	return m.lifecycleMgr.RollbackApp(ctx, appID, snapshotTS, userID)
@@ -0,0 +1,155 @@
+package apps
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"nithronos/backend/nosd/pkg/apps"
+	"nithronos/backend/nosd/pkg/appsdk"
+	"nithronos/backend/nosd/pkg/backup"
+)
+
+var _ backup.QuiesceSource = (*Manager)(nil)
+
+// Backup schedules name subvolumes of the system volume the way they
+// appear at its top level ("@apps"); the mount table says where they are
+// mounted
+var (
+	systemVolume  = "/dev/mapper/nos-root"
+	mountInfoPath = "/proc/self/mountinfo"
+)
+
+// QuiesceTargets implements backup.QuiesceSource. An app is covered when
+// its data directory lies within one of the subvolumes, given as names on
+// the system volume such as @apps or as absolute paths on pools such as
+// /srv/pool/apps. Only running apps are quiesced; a stopped app's data is
+// already consistent.
+func (m *Manager) QuiesceTargets(subvolumes []string) []backup.AppQuiesce {
+	mounts := readMounts()
+	var targets []backup.AppQuiesce
+	for _, app := range m.stateStore.GetAllApps() {
+		if app.Status != apps.StatusRunning {
+			continue
+		}
+		appDir := filepath.Join(m.config.AppsRoot, app.ID)
+		if !coveredBy(filepath.Join(appDir, "data"), subvolumes, mounts) {
+			continue
+		}
+		manifest := m.appManifest(app.ID)
+		if manifest == nil || manifest.Backup.QuiesceHooks == nil {
+			continue
+		}
+		targets = append(targets, backup.AppQuiesce{
+			AppID: app.ID,
+			Hooks: *manifest.Backup.QuiesceHooks,
+		})
+	}
+	return targets
+}
+
+// appManifest returns the nosapp.yaml of an installed app: the copy in
+// its config directory, written at install, or else the catalog's
+func (m *Manager) appManifest(appID string) *appsdk.Manifest {
+	path := filepath.Join(m.config.AppsRoot, appID, "config", apps.ManifestFile)
+	if _, err := os.Stat(path); err == nil {
+		manifest, err := appsdk.LoadManifest(path)
+		if err == nil {
+			return manifest
+		}
+		m.config.Logger.Warn().Err(err).Str("app", appID).Msg("Ignoring invalid app manifest")
+	}
+	if entry, err := m.catalogMgr.GetEntry(appID); err == nil {
+		return entry.Manifest
+	}
+	return nil
+}
+
+// mountEntry is a line of the mount table
+type mountEntry struct {
+	root   string // the directory of the filesystem that is mounted
+	point  string
+	fstype string
+	source string
+}
+
+// coveredBy reports whether a snapshot of one of the subvolumes holds dir.
+// A subvolume of the system volume holds dir when dir lies on a mount of
+// it, rather than on another subvolume mounted below.
+func coveredBy(dir string, subvolumes []string, mounts []mountEntry) bool {
+	for _, subvol := range subvolumes {
+		if filepath.IsAbs(subvol) {
+			if within(dir, filepath.Clean(subvol)) {
+				return true
+			}
+			continue
+		}
+		m, ok := mountOf(dir, mounts)
+		if ok && m.fstype == "btrfs" && m.source == systemVolume && within(m.root, "/"+filepath.Clean(subvol)) {
+			return true
+		}
+	}
+	return false
+}
+
+func within(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, strings.TrimSuffix(dir, "/")+"/")
+}
+
+// mountOf returns the mount dir lies on
+func mountOf(dir string, mounts []mountEntry) (mountEntry, bool) {
+	var found mountEntry
+	ok := false
+	for _, m := range mounts {
+		if within(dir, m.point) && (!ok || len(m.point) >= len(found.point)) {
+			found, ok = m, true
+		}
+	}
+	return found, ok
+}
+
+// readMounts parses the mount table
+func readMounts() []mountEntry {
+	f, err := os.Open(mountInfoPath)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var mounts []mountEntry
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		// ID parent major:minor root mount-point options [optional...] - type source super-options
+		fields := strings.Fields(sc.Text())
+		for i := 5; i+2 < len(fields); i++ {
+			if fields[i] == "-" {
+				mounts = append(mounts, mountEntry{
+					root:   unescapeMountField(fields[3]),
+					point:  unescapeMountField(fields[4]),
+					fstype: fields[i+1],
+					source: fields[i+2],
+				})
+				break
+			}
+		}
+	}
+	return mounts
+}
+
+// unescapeMountField undoes the octal escapes of spaces and the like in
+// the mount table
+func unescapeMountField(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
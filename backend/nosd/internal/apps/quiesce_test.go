@@ -0,0 +1,41 @@
+package apps
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestQuiesceCoverage(t *testing.T) {
+	mountInfoPath = filepath.Join(t.TempDir(), "mountinfo")
+	t.Cleanup(func() { mountInfoPath = "/proc/self/mountinfo" })
+	if err := os.WriteFile(mountInfoPath, []byte(`26 1 0:24 /@ / rw,relatime shared:1 - btrfs /dev/mapper/nos-root rw,subvol=/@
+27 26 0:24 /@home /home rw,relatime shared:2 - btrfs /dev/mapper/nos-root rw,subvol=/@home
+28 26 0:24 /@apps /srv/apps rw,relatime shared:3 - btrfs /dev/mapper/nos-root rw,subvol=/@apps
+29 26 0:31 / /srv/pool rw,relatime shared:4 - btrfs /dev/sdb rw,subvol=/
+30 26 0:24 /@apps/x /srv/my\040apps rw,relatime shared:5 - btrfs /dev/mapper/nos-root rw,subvol=/@apps/x
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	mounts := readMounts()
+
+	for _, tc := range []struct {
+		dir        string
+		subvolumes []string
+		covered    bool
+	}{
+		{"/srv/apps/nextcloud/data", []string{"@apps"}, true},
+		{"/srv/apps/nextcloud/data", []string{"@home", "/srv/apps"}, true},
+		{"/srv/apps/nextcloud/data", []string{"@apps/"}, true},
+		// A snapshot of @ stops at the subvolume mounted on /srv/apps
+		{"/srv/apps/nextcloud/data", []string{"@"}, false},
+		{"/srv/apps/nextcloud/data", []string{"@home", "@snapshots/@apps/20240102-030405"}, false},
+		{"/srv/pool/apps/immich/data", []string{"/srv/pool"}, true},
+		{"/srv/pool/apps/immich/data", []string{"@"}, false},
+		{"/srv/my apps/a/data", []string{"@apps"}, true},
+	} {
+		if got := coveredBy(tc.dir, tc.subvolumes, mounts); got != tc.covered {
+			t.Errorf("%s covered by %v: %v", tc.dir, tc.subvolumes, got)
+		}
+	}
+}
@@ -10,24 +10,25 @@ import (
 )
 
 type Config struct {
-	Port               int
-	LogLevel           zerolog.Level
-	UsersPath          string
-	SecretPath         string
-	FirstBootPath      string
-	SessionsPath       string
-	RateLimitPath      string
-	SharesPath         string
-	SessionHashKey     []byte
-	SessionBlockKey    []byte
-	EtcDir             string
-	AppsDataDir        string
-	AppsInstallDir     string
-	TrustProxy         bool
-	RateOTPPerMin      int
-	RateLoginPer15m    int
-	RateOTPWindowSec   int
-	RateLoginWindowSec int
+	Port                int
+	LogLevel            zerolog.Level
+	UsersPath           string
+	SecretPath          string
+	FirstBootPath       string
+	SessionsPath        string
+	RateLimitPath       string
+	SharesPath          string
+	SessionHashKey      []byte
+	SessionBlockKey     []byte
+	EtcDir              string
+	AppsDataDir         string
+	AppsInstallDir      string
+	TrustProxy          bool
+	RateOTPPerMin       int
+	RateLoginPer15m     int
+	RateOTPWindowSec    int
+	RateLoginWindowSec  int
+	RateShareLinkPerMin int
 	// new fields
 	Bind                     string
 	CORSOrigin               string
@@ -48,10 +49,11 @@ type fileYAML struct {
 		Origin string `yaml:"origin"`
 	} `yaml:"cors"`
 	Rate struct {
-		OTPPerMin      int `yaml:"otpPerMin"`
-		LoginPer15m    int `yaml:"loginPer15m"`
-		OTPWindowSec   int `yaml:"otpWindowSec"`
-		LoginWindowSec int `yaml:"loginWindowSec"`
+		OTPPerMin       int `yaml:"otpPerMin"`
+		LoginPer15m     int `yaml:"loginPer15m"`
+		OTPWindowSec    int `yaml:"otpWindowSec"`
+		LoginWindowSec  int `yaml:"loginWindowSec"`
+		ShareLinkPerMin int `yaml:"shareLinkPerMin"`
 	} `yaml:"rate"`
 	TrustProxy bool `yaml:"trustProxy"`
 	Sessions   struct {
@@ -89,6 +91,7 @@ func Defaults() Config {
 		RateLoginPer15m:          5,
 		RateOTPWindowSec:         60,
 		RateLoginWindowSec:       900,
+		RateShareLinkPerMin:      60,
 		Bind:                     "127.0.0.1:9000",
 		CORSOrigin:               "http://localhost:5173",
 		SessionAccessTTLSeconds:  int((15 * time.Minute).Seconds()),
@@ -127,6 +130,9 @@ func Load(path string) Config {
 			if fy.Rate.LoginWindowSec > 0 {
 				cfg.RateLoginWindowSec = fy.Rate.LoginWindowSec
 			}
+			if fy.Rate.ShareLinkPerMin > 0 {
+				cfg.RateShareLinkPerMin = fy.Rate.ShareLinkPerMin
+			}
 			if fy.Logging.Level != "" {
 				if l, err := zerolog.ParseLevel(fy.Logging.Level); err == nil {
 					cfg.LogLevel = l
@@ -239,6 +245,11 @@ func applyEnv(cfg Config) Config {
 			cfg.RateLoginWindowSec = n
 		}
 	}
+	if v := os.Getenv("NOS_RATE_SHARELINK_PER_MIN"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			cfg.RateShareLinkPerMin = n
+		}
+	}
 	if v := os.Getenv("NOS_SESSION_ACCESS_TTL"); v != "" {
 		if d, err := time.ParseDuration(v); err == nil {
 			cfg.SessionAccessTTLSeconds = int(d.Seconds())
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"nithronos/backend/nosd/internal/apps"
+	"nithronos/backend/nosd/internal/config"
+	pkgapps "nithronos/backend/nosd/pkg/apps"
+	"nithronos/backend/nosd/pkg/auth"
+)
+
+// The login gate in front of exposed apps. Caddy asks verify about every
+// request; an app on its own subdomain or port can't see the nos_session
+// cookie, so its users are sent through handoff on the main site, which
+// passes a short-lived token to the app host's callback for a cookie of
+// its own.
+const (
+	cookieAppSession = "nos_app_session"
+	cookieAppHandoff = "nos_app_handoff"
+	appSessionTTL    = 8 * time.Hour
+	appHandoffTTL    = time.Minute
+)
+
+// sessionUser finds the NithronOS user of a request on the main site. It
+// takes the sessions requireAuth does; a refresh cookie alone is not
+// signed in, and the user logs in again.
+func sessionUser(r *http.Request, cfg config.Config, codec *auth.SessionCodec) (string, bool) {
+	uid, _, ok := sessionLogin(r, cfg, codec)
+	return uid, ok
+}
+
+// sessionLogin is sessionUser that also says when the user logged in,
+// zero for a session from before sessions recorded it
+func sessionLogin(r *http.Request, cfg config.Config, codec *auth.SessionCodec) (string, time.Time, bool) {
+	if uid, ok := decodeSessionUID(r, cfg); ok {
+		return uid, decodeAuthTime(r, cfg, cookieSession), true
+	}
+	if s, ok := codec.DecodeFromRequest(r); ok && s.UserID != "" {
+		return s.UserID, s.IssuedAt, true
+	}
+	return "", time.Time{}, false
+}
+
+// decodeAppToken checks a handoff token or app session for host
+func decodeAppToken(cfg config.Config, name, value, host string) (string, bool) {
+	var m map[string]any
+	if err := decodeOpaque(cfg, name, value, &m); err != nil {
+		return "", false
+	}
+	exp, ok := asInt64(m["exp"])
+	if !ok || time.Now().UTC().Unix() > exp {
+		return "", false
+	}
+	uid, _ := m["uid"].(string)
+	tokenHost, _ := m["host"].(string)
+	if uid == "" || !strings.EqualFold(tokenHost, host) {
+		return "", false
+	}
+	return uid, true
+}
+
+// handleAppAuthVerify answers Caddy's forward_auth: 200 with the user for
+// a signed-in request, else a redirect to sign in
+func handleAppAuthVerify(cfg config.Config, codec *auth.SessionCodec) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host := r.Header.Get("X-Forwarded-Host")
+		uid, ok := sessionUser(r, cfg, codec)
+		if !ok {
+			if ck, err := r.Cookie(cookieAppSession); err == nil {
+				uid, ok = decodeAppToken(cfg, cookieAppSession, ck.Value, host)
+			}
+		}
+		if ok {
+			w.Header().Set("X-Nos-User", uid)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		method := r.Header.Get("X-Forwarded-Method")
+		if method != "" && method != http.MethodGet && method != http.MethodHead {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		uri := r.Header.Get("X-Forwarded-Uri")
+		if !strings.HasPrefix(uri, "/") {
+			uri = "/"
+		}
+		portal := r.Header.Get("X-Nos-Portal")
+		if portal == "" {
+			// Path mode: the app shares the main site's cookies
+			http.Redirect(w, r, "/login?next="+url.QueryEscape(uri), http.StatusFound)
+			return
+		}
+		rd := "https://" + host + uri
+		http.Redirect(w, r, strings.TrimSuffix(portal, "/")+"/api/v1/apps/auth/handoff?rd="+url.QueryEscape(rd), http.StatusFound)
+	}
+}
+
+// handleAppAuthHandoff runs on the main site: it sends a signed-in user
+// back to the app they came from with a token for its callback
+func handleAppAuthHandoff(cfg config.Config, codec *auth.SessionCodec, appManager *apps.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rd, err := url.Parse(r.URL.Query().Get("rd"))
+		if err != nil || rd.Scheme != "https" || rd.Host == "" {
+			http.Error(w, "invalid redirect", http.StatusBadRequest)
+			return
+		}
+		// Only hosts of apps behind the login get a token
+		app := pkgapps.ExposedApp(appManager.GetInstalledApps(), rd.Host)
+		if app == nil || !app.Expose.RequireLogin {
+			http.Error(w, "invalid redirect", http.StatusBadRequest)
+			return
+		}
+
+		uid, ok := sessionUser(r, cfg, codec)
+		if !ok {
+			http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+			return
+		}
+		token, err := encodeOpaque(cfg, cookieAppHandoff, map[string]any{
+			"uid":  uid,
+			"host": rd.Host,
+			"exp":  time.Now().UTC().Add(appHandoffTTL).Unix(),
+		})
+		if err != nil {
+			http.Error(w, "failed to sign in", http.StatusInternalServerError)
+			return
+		}
+		back := url.Values{"token": {token}, "rd": {rd.RequestURI()}}
+		http.Redirect(w, r, "https://"+rd.Host+"/.nos-auth?"+back.Encode(), http.StatusFound)
+	}
+}
+
+// handleAppAuthCallback runs on the app's host, where Caddy routes
+// /.nos-auth: it trades a handoff token for an app session cookie
+func handleAppAuthCallback(cfg config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		uid, ok := decodeAppToken(cfg, cookieAppHandoff, r.URL.Query().Get("token"), r.Host)
+		if !ok {
+			http.Error(w, "invalid or expired sign-in", http.StatusUnauthorized)
+			return
+		}
+		value, err := encodeOpaque(cfg, cookieAppSession, map[string]any{
+			"uid":  uid,
+			"host": r.Host,
+			"exp":  time.Now().UTC().Add(appSessionTTL).Unix(),
+		})
+		if err != nil {
+			http.Error(w, "failed to sign in", http.StatusInternalServerError)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: cookieAppSession, Value: value, Path: "/", HttpOnly: true, Secure: true, SameSite: http.SameSiteLaxMode, Expires: time.Now().Add(appSessionTTL)})
+
+		rd := r.URL.Query().Get("rd")
+		if !strings.HasPrefix(rd, "/") || strings.HasPrefix(rd, "//") || strings.HasPrefix(rd, "/\\") {
+			rd = "/"
+		}
+		http.Redirect(w, r, rd, http.StatusFound)
+	}
+}
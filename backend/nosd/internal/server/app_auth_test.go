@@ -0,0 +1,147 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"nithronos/backend/nosd/internal/config"
+	"nithronos/backend/nosd/pkg/auth"
+)
+
+func appAuthConfig(t *testing.T) (config.Config, *auth.SessionCodec) {
+	t.Helper()
+	cfg := config.Defaults()
+	cfg.SecretPath = filepath.Join(t.TempDir(), "secret.key")
+	cfg.SessionHashKey = []byte("0123456789abcdef0123456789abcdef")
+	return cfg, auth.NewSessionCodec(cfg.SessionHashKey, nil)
+}
+
+func TestAppAuthVerifyRedirects(t *testing.T) {
+	cfg, codec := appAuthConfig(t)
+	verify := handleAppAuthVerify(cfg, codec)
+
+	// Path mode: back to the main site's login
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/apps/auth/verify", nil)
+	r.Header.Set("X-Forwarded-Host", "nas.lan")
+	r.Header.Set("X-Forwarded-Uri", "/apps/notes/x?y=1")
+	w := httptest.NewRecorder()
+	verify(w, r)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/login?next="+url.QueryEscape("/apps/notes/x?y=1") {
+		t.Fatalf("path mode: %d %q", w.Code, w.Header().Get("Location"))
+	}
+
+	// Another host: through the handoff on the portal
+	r.Header.Set("X-Forwarded-Host", "notes.nas.lan")
+	r.Header.Set("X-Nos-Portal", "https://nas.lan")
+	w = httptest.NewRecorder()
+	verify(w, r)
+	want := "https://nas.lan/api/v1/apps/auth/handoff?rd=" + url.QueryEscape("https://notes.nas.lan/apps/notes/x?y=1")
+	if w.Code != http.StatusFound || w.Header().Get("Location") != want {
+		t.Fatalf("subdomain: %d %q", w.Code, w.Header().Get("Location"))
+	}
+
+	// Nothing to redirect for writes
+	r.Header.Set("X-Forwarded-Method", http.MethodPost)
+	w = httptest.NewRecorder()
+	verify(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("POST: %d", w.Code)
+	}
+}
+
+func TestAppAuthCallbackSession(t *testing.T) {
+	cfg, codec := appAuthConfig(t)
+	token, err := encodeOpaque(cfg, cookieAppHandoff, map[string]any{
+		"uid":  "u1",
+		"host": "notes.nas.lan",
+		"exp":  time.Now().UTC().Add(time.Minute).Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	callback := handleAppAuthCallback(cfg)
+
+	// A token is only good on the host it was made for
+	r := httptest.NewRequest(http.MethodGet, "https://wiki.nas.lan/.nos-auth?token="+url.QueryEscape(token), nil)
+	w := httptest.NewRecorder()
+	callback(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("other host: %d", w.Code)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "https://notes.nas.lan/.nos-auth?token="+url.QueryEscape(token)+"&rd="+url.QueryEscape("//evil.example"), nil)
+	w = httptest.NewRecorder()
+	callback(w, r)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/" {
+		t.Fatalf("callback: %d %q", w.Code, w.Header().Get("Location"))
+	}
+	var session *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == cookieAppSession {
+			session = c
+		}
+	}
+	if session == nil {
+		t.Fatal("no app session cookie")
+	}
+
+	verify := handleAppAuthVerify(cfg, codec)
+	for host, ok := range map[string]bool{"notes.nas.lan": true, "wiki.nas.lan": false} {
+		r = httptest.NewRequest(http.MethodGet, "/api/v1/apps/auth/verify", nil)
+		r.Header.Set("X-Forwarded-Host", host)
+		r.Header.Set("X-Nos-Portal", "https://nas.lan")
+		r.AddCookie(session)
+		w = httptest.NewRecorder()
+		verify(w, r)
+		if got := w.Code == http.StatusOK && w.Header().Get("X-Nos-User") == "u1"; got != ok {
+			t.Errorf("%s: %d %q", host, w.Code, w.Header().Get("X-Nos-User"))
+		}
+		if !ok && !strings.Contains(w.Header().Get("Location"), "/handoff?") {
+			t.Errorf("%s: not sent to the handoff", host)
+		}
+	}
+}
+
+func TestAppAuthNeedsSession(t *testing.T) {
+	cfg, codec := appAuthConfig(t)
+	cookie := func(name string, payload map[string]any) *http.Cookie {
+		value, err := encodeOpaque(cfg, name, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &http.Cookie{Name: name, Value: value}
+	}
+	exp := time.Now().UTC().Add(time.Hour).Unix()
+	verify := func(cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/apps/auth/verify", nil)
+		r.Header.Set("X-Forwarded-Host", "nas.lan")
+		r.Header.Set("X-Forwarded-Uri", "/apps/notes/")
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		handleAppAuthVerify(cfg, codec)(w, r)
+		return w
+	}
+
+	if w := verify(cookie(cookieSession, map[string]any{"uid": "u1", "exp": exp})); w.Code != http.StatusOK || w.Header().Get("X-Nos-User") != "u1" {
+		t.Fatalf("session: %d %q", w.Code, w.Header().Get("X-Nos-User"))
+	}
+	for name, cookies := range map[string][]*http.Cookie{
+		"refresh only": {cookie(cookieRefresh, map[string]any{"uid": "u1", "exp": exp})},
+		"expired session": {
+			cookie(cookieSession, map[string]any{"uid": "u1", "exp": time.Now().UTC().Add(-time.Minute).Unix()}),
+			cookie(cookieRefresh, map[string]any{"uid": "u1", "exp": exp}),
+		},
+		"refresh as session": {{Name: cookieSession, Value: cookie(cookieRefresh, map[string]any{"uid": "u1", "exp": exp}).Value}},
+	} {
+		if w := verify(cookies...); w.Code != http.StatusFound || !strings.HasPrefix(w.Header().Get("Location"), "/login?") {
+			t.Errorf("%s: %d %q", name, w.Code, w.Header().Get("Location"))
+		}
+	}
+}
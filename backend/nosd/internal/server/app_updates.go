@@ -0,0 +1,111 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+
+	"nithronos/backend/nosd/internal/apps"
+	"nithronos/backend/nosd/internal/notifications"
+	pkgapps "nithronos/backend/nosd/pkg/apps"
+	"nithronos/backend/nosd/pkg/httpx"
+)
+
+// appUpdateNotifier tells administrators about app updates and how
+// automatic upgrades went
+type appUpdateNotifier struct {
+	notifications *notifications.Manager
+}
+
+// UpdateAvailable implements pkgapps.UpdateNotifier
+func (n *appUpdateNotifier) UpdateAvailable(app *pkgapps.InstalledApp, update *pkgapps.UpdateStatus) {
+	message := fmt.Sprintf("%s has new images.", app.Name)
+	if update.Version != "" {
+		message = fmt.Sprintf("%s %s is available; %s is installed.", app.Name, update.Version, app.Version)
+	}
+	_ = n.notifications.Send(&notifications.Notification{
+		Type:     "info",
+		Category: "apps",
+		Title:    "App update available",
+		Message:  message,
+		Details: map[string]interface{}{
+			"app_id": app.ID,
+			"update": update,
+		},
+		Actions: []notifications.Action{{Label: "View app", URL: "/apps/" + app.ID, Type: "link"}},
+	})
+}
+
+// UpgradeFinished implements pkgapps.UpdateNotifier
+func (n *appUpdateNotifier) UpgradeFinished(app *pkgapps.InstalledApp, attempt *pkgapps.UpgradeAttempt) {
+	notif := &notifications.Notification{
+		Category: "apps",
+		Details: map[string]interface{}{
+			"app_id":  app.ID,
+			"attempt": attempt,
+		},
+		Actions: []notifications.Action{{Label: "View app", URL: "/apps/" + app.ID, Type: "link"}},
+	}
+	switch attempt.Result {
+	case pkgapps.UpgradeSucceeded:
+		notif.Type = "success"
+		notif.Title = "App upgraded"
+		notif.Message = fmt.Sprintf("%s was upgraded to %s in its maintenance window.", app.Name, attempt.ToVersion)
+	case pkgapps.UpgradeRolledBack:
+		notif.Type = "error"
+		notif.Title = "App upgrade rolled back"
+		notif.Message = fmt.Sprintf("%s was rolled back to %s: %s. The update is held until you retry it.", app.Name, attempt.FromVersion, attempt.Message)
+	default:
+		notif.Type = "error"
+		notif.Title = "App upgrade failed"
+		notif.Message = fmt.Sprintf("Upgrading %s to %s failed: %s", app.Name, attempt.ToVersion, attempt.Message)
+	}
+	_ = n.notifications.Send(notif)
+}
+
+// handleSetAppUpdatePolicy changes what happens when an update for an
+// app is available
+func handleSetAppUpdatePolicy(appManager *apps.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		appID := chi.URLParam(r, "id")
+
+		var req pkgapps.UpdatePolicy
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpx.WriteError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+
+		if err := appManager.SetUpdatePolicy(appID, req, getUserIDFromContext(r)); err != nil {
+			if strings.Contains(err.Error(), "not found") {
+				httpx.WriteError(w, http.StatusNotFound, "App not found")
+			} else if strings.Contains(err.Error(), "validation failed") {
+				httpx.WriteError(w, http.StatusBadRequest, err.Error())
+			} else {
+				httpx.WriteError(w, http.StatusInternalServerError, "Failed to update app update policy")
+			}
+			return
+		}
+
+		app, _ := appManager.GetApp(appID)
+		writeJSON(w, app)
+	}
+}
+
+// handleCheckAppUpdates checks every installed app for updates now
+func handleCheckAppUpdates(appManager *apps.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		appManager.CheckUpdates(r.Context())
+
+		updates := map[string]*pkgapps.UpdateStatus{}
+		for _, app := range appManager.GetInstalledApps() {
+			updates[app.ID] = app.Update
+		}
+		writeJSON(w, map[string]interface{}{
+			"message": "Update check completed",
+			"updates": updates,
+		})
+	}
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
@@ -78,7 +79,9 @@ func handleInstallApp(appManager *apps.Manager) http.HandlerFunc {
 
 		// Install app
 		if err := appManager.InstallApp(r.Context(), req, userID); err != nil {
-			if strings.Contains(err.Error(), "already installed") {
+			if errors.Is(err, pkgapps.ErrPermissionsNotAccepted) {
+				httpx.WriteError(w, http.StatusForbidden, err.Error())
+			} else if strings.Contains(err.Error(), "already installed") {
 				httpx.WriteError(w, http.StatusConflict, "App already installed")
 			} else if strings.Contains(err.Error(), "not found in catalog") {
 				httpx.WriteError(w, http.StatusNotFound, "App not found in catalog")
@@ -117,7 +120,9 @@ func handleUpgradeApp(appManager *apps.Manager) http.HandlerFunc {
 
 		// Upgrade app
 		if err := appManager.UpgradeApp(r.Context(), appID, req, userID); err != nil {
-			if strings.Contains(err.Error(), "not found") {
+			if errors.Is(err, pkgapps.ErrPermissionsNotAccepted) {
+				httpx.WriteError(w, http.StatusForbidden, err.Error())
+			} else if strings.Contains(err.Error(), "not found") {
 				httpx.WriteError(w, http.StatusNotFound, "App not found")
 			} else if strings.Contains(err.Error(), "validation failed") {
 				httpx.WriteError(w, http.StatusBadRequest, err.Error())
@@ -136,6 +141,33 @@ func handleUpgradeApp(appManager *apps.Manager) http.HandlerFunc {
 	}
 }
 
+// handleSetAppExposure changes how an app's web UI is reached
+func handleSetAppExposure(appManager *apps.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		appID := chi.URLParam(r, "id")
+
+		var req pkgapps.Exposure
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpx.WriteError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+
+		if err := appManager.SetExposure(r.Context(), appID, req, getUserIDFromContext(r)); err != nil {
+			if strings.Contains(err.Error(), "not found") {
+				httpx.WriteError(w, http.StatusNotFound, "App not found")
+			} else if strings.Contains(err.Error(), "validation failed") {
+				httpx.WriteError(w, http.StatusBadRequest, err.Error())
+			} else {
+				httpx.WriteError(w, http.StatusInternalServerError, "Failed to update app exposure")
+			}
+			return
+		}
+
+		app, _ := appManager.GetApp(appID)
+		writeJSON(w, app)
+	}
+}
+
 // handleStartApp starts an app
 func handleStartApp(appManager *apps.Manager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -370,8 +402,16 @@ func handleSyncCatalogs(appManager *apps.Manager) http.HandlerFunc {
 			return
 		}
 
+		// Sources that failed, e.g. on a bad signature, are reported
+		// alongside the ones that synced
+		var sources []pkgapps.SourceStatus
+		if catalog, err := appManager.GetCatalog(); err == nil {
+			sources = catalog.Sources
+		}
+
 		writeJSON(w, map[string]interface{}{
 			"message": "Catalogs synced successfully",
+			"sources": sources,
 		})
 	}
 }
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"nithronos/backend/nosd/pkg/agentclient"
+	"nithronos/backend/nosd/pkg/appsdk"
+	"nithronos/backend/nosd/pkg/backup"
+)
+
+// backupAgentTimeout bounds one snapshot operation on the agent
+const backupAgentTimeout = 2 * time.Minute
+
+// backupAgent takes and deletes backup snapshots through nos-agent
+type backupAgent struct {
+	client *agentclient.Client
+}
+
+// CreateSnapshot implements backup.AgentClient
+func (a *backupAgent) CreateSnapshot(subvolume string, path string, readOnly bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), backupAgentTimeout)
+	defer cancel()
+	return a.client.SnapshotSubvolume(ctx, subvolume, path, readOnly)
+}
+
+// DeleteSnapshot implements backup.AgentClient
+func (a *backupAgent) DeleteSnapshot(path string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), backupAgentTimeout)
+	defer cancel()
+	return a.client.DeleteSnapshot(ctx, path)
+}
+
+// GetSnapshotInfo implements backup.AgentClient
+func (a *backupAgent) GetSnapshotInfo(path string) (*backup.SnapshotInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), backupAgentTimeout)
+	defer cancel()
+	info, err := a.client.ShowSubvolume(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	return &backup.SnapshotInfo{
+		Path:      path,
+		UUID:      info.UUID,
+		ReadOnly:  info.ReadOnly,
+		CreatedAt: info.CreatedAt,
+	}, nil
+}
+
+// ExecuteHook implements backup.AgentClient. The agent kills the hook at
+// the deadline of ctx; the request itself gets a little longer to return
+// what the hook printed.
+func (a *backupAgent) ExecuteHook(ctx context.Context, command string) ([]byte, error) {
+	return runAgentHook(ctx, func(reqCtx context.Context, timeout time.Duration) (*agentclient.BackupHookResult, error) {
+		return a.client.RunBackupHook(reqCtx, command, timeout)
+	})
+}
+
+// ExecuteAppHook implements backup.AgentClient
+func (a *backupAgent) ExecuteAppHook(ctx context.Context, appID string, cmd appsdk.ComposeCommand) ([]byte, error) {
+	req := agentclient.AppHookRequest{
+		AppID:    appID,
+		Action:   cmd.Action,
+		Service:  cmd.Service,
+		User:     cmd.User,
+		Workdir:  cmd.Workdir,
+		Env:      cmd.Env,
+		Services: cmd.Services,
+		Command:  cmd.Command,
+	}
+	return runAgentHook(ctx, func(reqCtx context.Context, timeout time.Duration) (*agentclient.BackupHookResult, error) {
+		return a.client.RunAppHook(reqCtx, req, timeout)
+	})
+}
+
+// runAgentHook runs a hook on the agent with the time left before the
+// deadline of ctx and turns how it ended into an error
+func runAgentHook(ctx context.Context, run func(context.Context, time.Duration) (*agentclient.BackupHookResult, error)) ([]byte, error) {
+	timeout := backup.DefaultHookTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	reqCtx, cancel := context.WithTimeout(context.Background(), timeout+30*time.Second)
+	defer cancel()
+	res, err := run(reqCtx, timeout)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case res.TimedOut:
+		return []byte(res.Output), errors.New("timed out")
+	case res.Code != 0:
+		return []byte(res.Output), fmt.Errorf("exit status %d", res.Code)
+	}
+	return []byte(res.Output), nil
+}
@@ -2,9 +2,12 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/rs/zerolog"
@@ -17,6 +20,8 @@ type BackupHandler struct {
 	scheduler  *backup.Scheduler
 	replicator *backup.Replicator
 	restorer   *backup.Restorer
+	receiver   *backup.Receiver
+	puller     *backup.Puller
 }
 
 // NewBackupHandler creates a new backup handler
@@ -59,6 +64,50 @@ func (h *BackupHandler) Routes() chi.Router {
 		r.Delete("/{id}", h.DeleteDestination)
 		r.Post("/{id}/test", h.TestDestination)
 		r.Post("/{id}/key", h.StoreSSHKey)
+		
+		r.Post("/{id}/credentials", h.StoreS3Credentials)
+		
+		// Repository and S3 destinations
+		r.Post("/{id}/password", h.StoreRepoPassword)
+		r.Post("/{id}/check", h.CheckRepository)
+		r.Post("/{id}/prune", h.PruneDestination)
+		r.Get("/{id}/snapshots", h.ListDestinationSnapshots)
+		r.Delete("/{id}/snapshots/{snapshot_id}", h.DeleteDestinationSnapshot)
+		r.Get("/{id}/snapshots/{snapshot_id}/files", h.ListRepoFiles)
+		r.Get("/{id}/snapshots/{snapshot_id}/download", h.DownloadRepoFile)
+		
+		// NithronOS peer destinations
+		r.Post("/{id}/pair", h.PairDestination)
+		r.Get("/{id}/inventory", h.GetDestinationInventory)
+		
+		// Snapshot chains of btrfs destinations
+		r.Get("/{id}/replicated", h.ListReplicatedSnapshots)
+		r.Post("/{id}/resync", h.ResyncDestination)
+		
+		// Verification and restore drills
+		r.Post("/{id}/verify", h.VerifyDestination)
+		r.Get("/{id}/health", h.GetDestinationHealth)
+	})
+	
+	// NithronOS peers replicating to this box
+	r.Route("/peers", func(r chi.Router) {
+		r.Get("/", h.ListPeers)
+		r.Post("/pairing-code", h.CreatePairingCode)
+		r.Get("/{id}", h.GetPeer)
+		r.Delete("/{id}", h.RemovePeer)
+		r.Delete("/{id}/replicas/{snapshot_id}", h.DeleteReplica)
+	})
+	
+	// Client machines pulled into the NAS
+	r.Route("/sources", func(r chi.Router) {
+		r.Get("/", h.ListSources)
+		r.Post("/", h.CreateSource)
+		r.Get("/{id}", h.GetSource)
+		r.Put("/{id}", h.UpdateSource)
+		r.Delete("/{id}", h.DeleteSource)
+		r.Post("/{id}/key", h.StoreSourceKey)
+		r.Post("/{id}/test", h.TestSource)
+		r.Post("/{id}/run", h.RunSource)
 	})
 	
 	// Replication
@@ -69,6 +118,12 @@ func (h *BackupHandler) Routes() chi.Router {
 		r.Post("/plan", h.CreateRestorePlan)
 		r.Post("/apply", h.ApplyRestore)
 		r.Get("/points", h.ListRestorePoints)
+		
+		// Backup catalog
+		r.Get("/points/{type}/{id}/files", h.BrowseRestorePoint)
+		r.Post("/points/{type}/{id}/index", h.IndexRestorePoint)
+		r.Get("/search", h.SearchCatalog)
+		r.Post("/files", h.RestoreFiles)
 	})
 	
 	// Jobs
@@ -351,6 +406,82 @@ func (h *BackupHandler) StartReplication(w http.ResponseWriter, r *http.Request)
 	respondJSON(w, http.StatusAccepted, job)
 }
 
+// ListReplicatedSnapshots lists the local snapshots a destination holds
+func (h *BackupHandler) ListReplicatedSnapshots(w http.ResponseWriter, r *http.Request) {
+	snapshots, err := h.replicator.ReplicatedSnapshots(chi.URLParam(r, "id"))
+	if err != nil {
+		respondError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"snapshots": snapshots,
+	})
+}
+
+// ResyncDestination rebuilds the snapshot chain of a destination; an
+// empty subvolume resyncs all of them
+func (h *BackupHandler) ResyncDestination(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Subvolume string `json:"subvolume"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+	}
+	
+	job, err := h.replicator.Resync(chi.URLParam(r, "id"), req.Subvolume)
+	if err != nil {
+		status := http.StatusBadRequest
+		if strings.Contains(err.Error(), "not found") {
+			status = http.StatusNotFound
+		}
+		respondError(w, status, err.Error())
+		return
+	}
+	
+	respondJSON(w, http.StatusAccepted, job)
+}
+
+func (h *BackupHandler) VerifyDestination(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Mode string `json:"mode"` // "sample", "full" or "drill"
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+	}
+	
+	job, err := h.replicator.Verify(chi.URLParam(r, "id"), req.Mode)
+	if err != nil {
+		status := http.StatusBadRequest
+		switch {
+		case strings.Contains(err.Error(), "not found"):
+			status = http.StatusNotFound
+		case strings.Contains(err.Error(), "already being verified"):
+			status = http.StatusConflict
+		}
+		respondError(w, status, err.Error())
+		return
+	}
+	
+	respondJSON(w, http.StatusAccepted, job)
+}
+
+func (h *BackupHandler) GetDestinationHealth(w http.ResponseWriter, r *http.Request) {
+	health, err := h.replicator.DestinationHealth(chi.URLParam(r, "id"))
+	if err != nil {
+		respondError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	
+	respondJSON(w, http.StatusOK, health)
+}
+
 // Restore handlers
 
 func (h *BackupHandler) CreateRestorePlan(w http.ResponseWriter, r *http.Request) {
@@ -422,6 +553,69 @@ func (h *BackupHandler) ListRestorePoints(w http.ResponseWriter, r *http.Request
 	})
 }
 
+func restorePointRef(r *http.Request) backup.PointRef {
+	return backup.PointRef{
+		Type:          chi.URLParam(r, "type"),
+		ID:            chi.URLParam(r, "id"),
+		DestinationID: r.URL.Query().Get("destination_id"),
+	}
+}
+
+func (h *BackupHandler) BrowseRestorePoint(w http.ResponseWriter, r *http.Request) {
+	dir := r.URL.Query().Get("path")
+	entries, err := h.restorer.BrowseRestorePoint(r.Context(), restorePointRef(r), dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) || strings.Contains(err.Error(), "not found") {
+			respondError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"path":    dir,
+		"entries": entries,
+	})
+}
+
+func (h *BackupHandler) IndexRestorePoint(w http.ResponseWriter, r *http.Request) {
+	job, err := h.restorer.IndexRestorePoint(restorePointRef(r))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	
+	respondJSON(w, http.StatusAccepted, job)
+}
+
+func (h *BackupHandler) SearchCatalog(w http.ResponseWriter, r *http.Request) {
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	result, err := h.restorer.SearchCatalog(r.URL.Query().Get("q"), limit)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	
+	respondJSON(w, http.StatusOK, result)
+}
+
+func (h *BackupHandler) RestoreFiles(w http.ResponseWriter, r *http.Request) {
+	var req backup.FileRestoreRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	
+	job, err := h.restorer.RestoreFiles(req)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	
+	respondJSON(w, http.StatusAccepted, job)
+}
+
 // Job handlers
 
 func (h *BackupHandler) ListJobs(w http.ResponseWriter, r *http.Request) {
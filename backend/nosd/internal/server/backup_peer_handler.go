@@ -0,0 +1,270 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+
+	"nithronos/backend/nosd/pkg/backup"
+)
+
+// NithronOS peer replication handlers. The admin handlers manage pairing
+// on both sides; PeerRoutes serves the boxes that replicate here.
+
+// UseReceiver lets this box receive replication streams from paired peers
+func (h *BackupHandler) UseReceiver(receiver *backup.Receiver) {
+	h.receiver = receiver
+}
+
+// PeerRoutes returns the endpoints paired NithronOS boxes call. They are
+// mounted outside session auth: pairing is authorized by a one-time code,
+// everything else by the peer token issued when pairing.
+func (h *BackupHandler) PeerRoutes() chi.Router {
+	r := chi.NewRouter()
+	r.Post("/pair", h.PeerPair)
+	r.Get("/inventory", h.PeerInventory)
+	r.Post("/receive", h.PeerReceive)
+	return r
+}
+
+func (h *BackupHandler) CreatePairingCode(w http.ResponseWriter, r *http.Request) {
+	if !h.receiverEnabled(w) {
+		return
+	}
+
+	var req struct {
+		PoolPath   string `json:"pool_path"`
+		QuotaBytes int64  `json:"quota_bytes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	code, err := h.receiver.CreatePairingCode(req.PoolPath, req.QuotaBytes)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, code)
+}
+
+func (h *BackupHandler) ListPeers(w http.ResponseWriter, r *http.Request) {
+	if !h.receiverEnabled(w) {
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"peers": h.receiver.ListPeers(),
+	})
+}
+
+func (h *BackupHandler) GetPeer(w http.ResponseWriter, r *http.Request) {
+	if !h.receiverEnabled(w) {
+		return
+	}
+
+	inv, err := h.receiver.Inventory(chi.URLParam(r, "id"))
+	if err != nil {
+		respondError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, inv)
+}
+
+// RemovePeer unpairs a peer; ?delete_replicas=true also deletes what it sent
+func (h *BackupHandler) RemovePeer(w http.ResponseWriter, r *http.Request) {
+	if !h.receiverEnabled(w) {
+		return
+	}
+
+	deleteReplicas, _ := strconv.ParseBool(r.URL.Query().Get("delete_replicas"))
+	if err := h.receiver.RemovePeer(r.Context(), chi.URLParam(r, "id"), deleteReplicas); err != nil {
+		respondError(w, repoErrorStatus(err), err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{"status": "removed"})
+}
+
+func (h *BackupHandler) DeleteReplica(w http.ResponseWriter, r *http.Request) {
+	if !h.receiverEnabled(w) {
+		return
+	}
+
+	if err := h.receiver.DeleteReplica(r.Context(), chi.URLParam(r, "id"), chi.URLParam(r, "snapshot_id")); err != nil {
+		respondError(w, repoErrorStatus(err), err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+}
+
+// PairDestination redeems a pairing code and certificate fingerprint
+// shown by the receiving box
+func (h *BackupHandler) PairDestination(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	var req struct {
+		Code        string `json:"code"`
+		Fingerprint string `json:"fingerprint"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if err := h.replicator.PairDestination(r.Context(), id, req.Code, req.Fingerprint); err != nil {
+		h.logger.Error().Err(err).Msg("Failed to pair destination")
+		respondError(w, peerDestinationErrorStatus(err), err.Error())
+		return
+	}
+
+	dest, _ := h.replicator.GetDestination(id)
+	respondJSON(w, http.StatusOK, dest)
+}
+
+// GetDestinationInventory shows what a NithronOS peer holds for this box
+func (h *BackupHandler) GetDestinationInventory(w http.ResponseWriter, r *http.Request) {
+	inv, err := h.replicator.PeerInventory(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		respondError(w, peerDestinationErrorStatus(err), err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, inv)
+}
+
+// Peer endpoints
+
+func (h *BackupHandler) PeerPair(w http.ResponseWriter, r *http.Request) {
+	if !h.receiverEnabled(w) {
+		return
+	}
+
+	var req struct {
+		Code string `json:"code"`
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	peer, token, err := h.receiver.Pair(r.Context(), req.Code, req.Name)
+	if err != nil {
+		h.logger.Warn().Err(err).Str("ip", r.RemoteAddr).Msg("Peer pairing failed")
+		respondError(w, peerErrorStatus(err), err.Error())
+		return
+	}
+
+	hostname, _ := os.Hostname()
+	respondJSON(w, http.StatusOK, map[string]string{
+		"peer_id": peer.ID,
+		"token":   token,
+		"name":    hostname,
+	})
+}
+
+func (h *BackupHandler) PeerInventory(w http.ResponseWriter, r *http.Request) {
+	peer, ok := h.authenticatePeer(w, r)
+	if !ok {
+		return
+	}
+
+	inv, err := h.receiver.Inventory(peer.ID)
+	if err != nil {
+		respondError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	// The sender has no use for where things are stored here
+	inv.LandingPath = ""
+	for _, replica := range inv.Replicas {
+		replica.Path = ""
+	}
+
+	respondJSON(w, http.StatusOK, inv)
+}
+
+// PeerReceive takes a btrfs send stream as the request body; the query
+// parameter meta describes it
+func (h *BackupHandler) PeerReceive(w http.ResponseWriter, r *http.Request) {
+	peer, ok := h.authenticatePeer(w, r)
+	if !ok {
+		return
+	}
+
+	var meta backup.ReplicaMeta
+	if err := json.Unmarshal([]byte(r.URL.Query().Get("meta")), &meta); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid meta parameter")
+		return
+	}
+
+	replica, err := h.receiver.Receive(r.Context(), peer, meta, r.Body)
+	if err != nil {
+		h.logger.Error().Err(err).Str("peer", peer.ID).Str("snapshot", meta.SnapshotID).Msg("Failed to receive replica")
+		respondError(w, peerErrorStatus(err), err.Error())
+		return
+	}
+	replica.Path = ""
+
+	respondJSON(w, http.StatusOK, replica)
+}
+
+func (h *BackupHandler) authenticatePeer(w http.ResponseWriter, r *http.Request) (*backup.Peer, bool) {
+	if !h.receiverEnabled(w) {
+		return nil, false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "Peer token required")
+		return nil, false
+	}
+	peer, err := h.receiver.Authenticate(token)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, err.Error())
+		return nil, false
+	}
+	return peer, true
+}
+
+func (h *BackupHandler) receiverEnabled(w http.ResponseWriter) bool {
+	if h.receiver == nil {
+		respondError(w, http.StatusNotFound, "Receiving from peers is not enabled")
+		return false
+	}
+	return true
+}
+
+// peerErrorStatus maps pairing and receive errors to HTTP statuses
+func peerErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, backup.ErrInvalidPairingCode), errors.Is(err, backup.ErrPeerUnauthorized):
+		return http.StatusUnauthorized
+	case errors.Is(err, backup.ErrReplicaExists), errors.Is(err, backup.ErrPeerBusy):
+		return http.StatusConflict
+	case errors.Is(err, backup.ErrPeerQuotaExceeded):
+		return http.StatusInsufficientStorage
+	default:
+		return repoErrorStatus(err)
+	}
+}
+
+// peerDestinationErrorStatus maps errors of calls to a peer. A peer
+// rejecting our token is not a 401 of this session.
+func peerDestinationErrorStatus(err error) int {
+	if errors.Is(err, backup.ErrPeerUnauthorized) || strings.Contains(err.Error(), "is required") ||
+		strings.Contains(err.Error(), "fingerprint must be") {
+		return http.StatusBadRequest
+	}
+	if status := repoErrorStatus(err); status != http.StatusInternalServerError {
+		return status
+	}
+	return http.StatusBadGateway
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog"
+
+	"nithronos/backend/nosd/pkg/agentclient"
+	"nithronos/backend/nosd/pkg/backup"
+)
+
+type stubPeerAgent struct{}
+
+func (stubPeerAgent) EnsureLanding(ctx context.Context, path string, limitBytes int64) error {
+	return nil
+}
+
+func (stubPeerAgent) Receive(ctx context.Context, landing string, dir string, stream io.Reader) (*agentclient.ReceivedSubvolume, error) {
+	n, err := io.Copy(io.Discard, stream)
+	return &agentclient.ReceivedSubvolume{Name: "snap", Path: filepath.Join(dir, "snap"), Generation: 7, Bytes: n}, err
+}
+
+func (stubPeerAgent) DeleteSubvolume(ctx context.Context, path string) error { return nil }
+
+func TestBackupPeerPairing(t *testing.T) {
+	dir := t.TempDir()
+	newHandler := func(name string) (*BackupHandler, *backup.Replicator) {
+		replicator := backup.NewReplicator(zerolog.Nop(), filepath.Join(dir, name, "destinations.json"), filepath.Join(dir, name, "keys"), backup.NewJobManager(zerolog.Nop()))
+		if err := replicator.Start(); err != nil {
+			t.Fatal(err)
+		}
+		return NewBackupHandler(zerolog.Nop(), nil, replicator, nil), replicator
+	}
+	mount := func(h *BackupHandler) http.Handler {
+		r := chi.NewRouter()
+		r.Mount("/api/v1/backup", h.Routes())
+		r.Mount("/api/v1/backup/peer", h.PeerRoutes())
+		return r
+	}
+
+	receiver, _ := newHandler("receiver")
+	rc := backup.NewReceiver(zerolog.Nop(), filepath.Join(dir, "receiver", "peers.json"), stubPeerAgent{})
+	receiver.UseReceiver(rc)
+	receiverRouter := mount(receiver)
+	srv := httptest.NewTLSServer(receiverRouter)
+	defer srv.Close()
+	certFile := filepath.Join(dir, "cert.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rc.UseCertificate(certFile)
+
+	sender, replicator := newHandler("sender")
+	senderRouter := mount(sender)
+	do := func(router http.Handler, method, path string, body any) *httptest.ResponseRecorder {
+		var buf bytes.Buffer
+		if body != nil {
+			_ = json.NewEncoder(&buf).Encode(body)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(method, path, &buf))
+		return rec
+	}
+
+	// The peer endpoints want a token
+	if rec := do(receiverRouter, http.MethodGet, "/api/v1/backup/peer/inventory", nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("inventory without token: %d", rec.Code)
+	}
+	// Boxes that don't receive have no peer endpoints
+	if rec := do(senderRouter, http.MethodPost, "/api/v1/backup/peers/pairing-code", map[string]any{"pool_path": "/srv/p"}); rec.Code != http.StatusNotFound {
+		t.Fatalf("pairing code on a sender: %d", rec.Code)
+	}
+
+	rec := do(receiverRouter, http.MethodPost, "/api/v1/backup/peers/pairing-code", map[string]any{"pool_path": "/srv/p", "quota_bytes": 1 << 30})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("pairing code: %d %s", rec.Code, rec.Body)
+	}
+	var code backup.PairingCode
+	_ = json.Unmarshal(rec.Body.Bytes(), &code)
+
+	dest := &backup.Destination{Name: "nas2", Type: "nos", Enabled: true, Endpoint: srv.URL}
+	if err := replicator.CreateDestination(dest); err != nil {
+		t.Fatal(err)
+	}
+	if rec := do(senderRouter, http.MethodPost, "/api/v1/backup/destinations/"+dest.ID+"/pair", map[string]string{"code": "WRONG-CODE0"}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("wrong code: %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(senderRouter, http.MethodPost, "/api/v1/backup/destinations/"+dest.ID+"/pair", map[string]string{"code": code.Code, "fingerprint": code.Fingerprint}); rec.Code != http.StatusOK {
+		t.Fatalf("pair: %d %s", rec.Code, rec.Body)
+	}
+
+	rec = do(senderRouter, http.MethodGet, "/api/v1/backup/destinations/"+dest.ID+"/inventory", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("inventory: %d %s", rec.Code, rec.Body)
+	}
+	var inv backup.PeerInventory
+	_ = json.Unmarshal(rec.Body.Bytes(), &inv)
+	if inv.PeerID != dest.PeerID || inv.QuotaBytes != 1<<30 || inv.LandingPath != "" {
+		t.Errorf("sender sees %+v", inv)
+	}
+
+	rec = do(receiverRouter, http.MethodGet, "/api/v1/backup/peers", nil)
+	var peers struct {
+		Peers []backup.PeerInventory `json:"peers"`
+	}
+	_ = json.Unmarshal(rec.Body.Bytes(), &peers)
+	if len(peers.Peers) != 1 || peers.Peers[0].PeerID != dest.PeerID {
+		t.Fatalf("receiver sees %s", rec.Body)
+	}
+}
@@ -0,0 +1,245 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+
+	"nithronos/backend/nosd/pkg/backup"
+	"nithronos/backend/nosd/pkg/backup/repo"
+	"nithronos/backend/nosd/pkg/backup/s3"
+)
+
+// Repository and S3 destination handlers
+
+func (h *BackupHandler) StoreRepoPassword(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	var req struct {
+		Password string `json:"password"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if req.Password == "" {
+		respondError(w, http.StatusBadRequest, "Repository password is required")
+		return
+	}
+
+	if err := h.replicator.StoreRepoPassword(id, req.Password); err != nil {
+		h.logger.Error().Err(err).Msg("Failed to store repository password")
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{"status": "stored"})
+}
+
+func (h *BackupHandler) CheckRepository(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	var req struct {
+		ReadData bool `json:"read_data"`
+	}
+	if r.ContentLength > 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+	}
+
+	job, err := h.replicator.CheckRepository(id, req.ReadData)
+	if err != nil {
+		respondError(w, repoErrorStatus(err), err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusAccepted, job)
+}
+
+func (h *BackupHandler) StoreS3Credentials(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	var req struct {
+		AccessKeyID     string `json:"access_key_id"`
+		SecretAccessKey string `json:"secret_access_key"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if req.AccessKeyID == "" || req.SecretAccessKey == "" {
+		respondError(w, http.StatusBadRequest, "access_key_id and secret_access_key are required")
+		return
+	}
+
+	if err := h.replicator.StoreS3Credentials(id, req.AccessKeyID, req.SecretAccessKey); err != nil {
+		h.logger.Error().Err(err).Msg("Failed to store S3 credentials")
+		respondError(w, repoErrorStatus(err), err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{"status": "stored"})
+}
+
+// PruneDestination applies retention to a repository or S3 destination
+func (h *BackupHandler) PruneDestination(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	dest, err := h.replicator.GetDestination(id)
+	if err != nil {
+		respondError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	var job *backup.BackupJob
+	if dest.Type == "s3" {
+		job, err = h.replicator.PruneS3(id)
+	} else {
+		job, err = h.replicator.PruneRepository(id)
+	}
+	if err != nil {
+		respondError(w, repoErrorStatus(err), err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusAccepted, job)
+}
+
+// ListDestinationSnapshots lists repository snapshots or S3 backup sets
+func (h *BackupHandler) ListDestinationSnapshots(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	dest, err := h.replicator.GetDestination(id)
+	if err != nil {
+		respondError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	var snapshots interface{}
+	switch dest.Type {
+	case "s3":
+		snapshots, err = h.replicator.S3BackupSets(r.Context(), id)
+	case "nos":
+		var inv *backup.PeerInventory
+		if inv, err = h.replicator.PeerInventory(r.Context(), id); err == nil {
+			snapshots = inv.Replicas
+		}
+	default:
+		snapshots, err = h.replicator.RepositorySnapshots(r.Context(), id)
+	}
+	if err != nil {
+		h.logger.Error().Err(err).Msg("Failed to list destination snapshots")
+		respondError(w, repoErrorStatus(err), err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"snapshots": snapshots,
+	})
+}
+
+func (h *BackupHandler) DeleteDestinationSnapshot(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	snapshotID := chi.URLParam(r, "snapshot_id")
+
+	dest, err := h.replicator.GetDestination(id)
+	if err != nil {
+		respondError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	if dest.Type == "s3" {
+		err = h.replicator.DeleteS3BackupSet(r.Context(), id, snapshotID)
+	} else {
+		err = h.replicator.ForgetRepositorySnapshot(r.Context(), id, snapshotID)
+	}
+	if err != nil {
+		respondError(w, repoErrorStatus(err), err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+}
+
+func (h *BackupHandler) ListRepoFiles(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	snapshotID := chi.URLParam(r, "snapshot_id")
+
+	nodes, err := h.replicator.ListRepository(r.Context(), id, snapshotID, r.URL.Query().Get("path"))
+	if err != nil {
+		respondError(w, repoErrorStatus(err), err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"files": nodes,
+	})
+}
+
+// DownloadRepoFile streams one file out of a repository snapshot, with
+// range support
+func (h *BackupHandler) DownloadRepoFile(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	snapshotID := chi.URLParam(r, "snapshot_id")
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Query().Get("path")), "/")
+	if name == "" {
+		respondError(w, http.StatusBadRequest, "path is required")
+		return
+	}
+
+	fsys, _, err := h.replicator.RepositoryFS(r.Context(), id, snapshotID)
+	if err != nil {
+		respondError(w, repoErrorStatus(err), err.Error())
+		return
+	}
+	f, err := fsys.Open(name)
+	if err != nil {
+		respondError(w, repoErrorStatus(err), err.Error())
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	content, ok := f.(io.ReadSeeker)
+	if !ok || !info.Mode().IsRegular() {
+		respondError(w, http.StatusBadRequest, "Not a regular file")
+		return
+	}
+
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(name)}))
+	http.ServeContent(w, r, path.Base(name), info.ModTime(), content)
+}
+
+// repoErrorStatus maps repository and S3 errors to HTTP statuses
+func repoErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, repo.ErrSnapshotNotFound), errors.Is(err, repo.ErrNotInitialized), errors.Is(err, fs.ErrNotExist), errors.Is(err, s3.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, repo.ErrLocked):
+		return http.StatusConflict
+	case strings.Contains(err.Error(), "not found"):
+		return http.StatusNotFound
+	case strings.Contains(err.Error(), "is not of type"), strings.Contains(err.Error(), "is the parent of"),
+		strings.Contains(err.Error(), "no retention policy"):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/rs/zerolog"
+
+	"nithronos/backend/nosd/internal/apps"
+	"nithronos/backend/nosd/internal/notifications"
+	"nithronos/backend/nosd/pkg/agentclient"
+	"nithronos/backend/nosd/pkg/backup"
+	"nithronos/backend/nosd/pkg/jobs"
+)
+
+// backupCertFile is the certificate Caddy serves, and so the one paired
+// peers pin
+const backupCertFile = "/etc/nithronos/tls/cert.pem"
+
+// newBackupHandler starts the backup scheduler, replicator, restorer,
+// receiver and puller keeping their state in stateDir. Snapshots quiesce
+// the installed apps they cover; backup jobs run on jobEngine.
+func newBackupHandler(logger zerolog.Logger, stateDir string, agent *agentclient.Client, notifier *notifications.Manager, appsManager *apps.Manager, jobEngine *jobs.Engine) *BackupHandler {
+	dir := filepath.Join(stateDir, "backup")
+	keysDir := filepath.Join(dir, "keys")
+
+	scheduler := backup.NewScheduler(logger, filepath.Join(dir, "schedules.json"), &backupAgent{client: agent})
+	scheduler.UseJobEngine(jobEngine)
+	if appsManager != nil {
+		scheduler.UseQuiesceSource(appsManager)
+	}
+	replicator := backup.NewReplicator(logger, filepath.Join(dir, "destinations.json"), keysDir, scheduler.GetJobManager())
+	replicator.UseScheduler(scheduler)
+
+	restorer := backup.NewRestorer(logger, &backupAgent{client: agent}, scheduler.GetJobManager(), scheduler, replicator)
+	restorer.UseCatalog(backup.NewCatalog(filepath.Join(dir, "catalog")))
+
+	receiver := backup.NewReceiver(logger, filepath.Join(dir, "peers.json"), agent)
+	receiver.UseCertificate(backupCertFile)
+	puller := backup.NewPuller(logger, filepath.Join(dir, "sources.json"), keysDir, scheduler)
+	restorer.UsePuller(puller)
+
+	if notifier != nil {
+		n := &backupNotifier{notifications: notifier}
+		scheduler.UseNotifier(n)
+		replicator.UseNotifier(n)
+	}
+
+	if err := scheduler.Start(context.Background()); err != nil {
+		logger.Error().Err(err).Msg("Failed to start backup scheduler")
+	}
+	if err := replicator.Start(); err != nil {
+		logger.Error().Err(err).Msg("Failed to start backup replicator")
+	}
+	if err := receiver.Start(); err != nil {
+		logger.Error().Err(err).Msg("Failed to load backup peers")
+	}
+	if err := puller.Start(); err != nil {
+		logger.Error().Err(err).Msg("Failed to start backup puller")
+	}
+
+	h := NewBackupHandler(logger, scheduler, replicator, restorer)
+	h.UseReceiver(receiver)
+	h.UsePuller(puller)
+	return h
+}
+
+// backupNotifier tells administrators about failed backups and
+// verifications
+type backupNotifier struct {
+	notifications *notifications.Manager
+}
+
+// BackupFailed implements backup.FailureNotifier
+func (n *backupNotifier) BackupFailed(job *backup.BackupJob, schedule *backup.Schedule, message string) {
+	_ = n.notifications.Send(&notifications.Notification{
+		Type:     "error",
+		Category: "backup",
+		Title:    "Backup failed",
+		Message:  fmt.Sprintf("Backup %s failed: %s", schedule.Name, message),
+		Details: map[string]interface{}{
+			"job_id":      job.ID,
+			"schedule_id": schedule.ID,
+		},
+		Actions: []notifications.Action{{Label: "View backups", URL: "/backup/schedules", Type: "link"}},
+	})
+}
+
+// VerifyFailed implements backup.VerifyNotifier
+func (n *backupNotifier) VerifyFailed(dest *backup.Destination, job *backup.BackupJob, message string) {
+	_ = n.notifications.Send(&notifications.Notification{
+		Type:     "error",
+		Category: "backup",
+		Title:    "Backup verification failed",
+		Message:  fmt.Sprintf("Verifying the backups on %s failed: %s", dest.Name, message),
+		Details: map[string]interface{}{
+			"job_id":         job.ID,
+			"destination_id": dest.ID,
+		},
+		Actions: []notifications.Action{{Label: "View backups", URL: "/backup/schedules", Type: "link"}},
+	})
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+
+	"nithronos/backend/nosd/pkg/backup"
+)
+
+// Handlers of the client machines this box pulls backups of
+
+// UsePuller enables pull backups of client machines
+func (h *BackupHandler) UsePuller(puller *backup.Puller) {
+	h.puller = puller
+}
+
+func (h *BackupHandler) pullerEnabled(w http.ResponseWriter) bool {
+	if h.puller == nil {
+		respondError(w, http.StatusNotFound, "Pull backups are not enabled")
+		return false
+	}
+	return true
+}
+
+// sourceErrorStatus maps source errors to HTTP statuses
+func sourceErrorStatus(err error) int {
+	switch {
+	case strings.Contains(err.Error(), "not found"):
+		return http.StatusNotFound
+	case strings.Contains(err.Error(), "being pulled"):
+		return http.StatusConflict
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+func (h *BackupHandler) ListSources(w http.ResponseWriter, r *http.Request) {
+	if !h.pullerEnabled(w) {
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"sources": h.puller.ListSources(),
+	})
+}
+
+func (h *BackupHandler) CreateSource(w http.ResponseWriter, r *http.Request) {
+	if !h.pullerEnabled(w) {
+		return
+	}
+	var src backup.Source
+	if err := json.NewDecoder(r.Body).Decode(&src); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if err := h.puller.CreateSource(&src); err != nil {
+		h.logger.Error().Err(err).Msg("Failed to create source")
+		respondError(w, sourceErrorStatus(err), err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, src)
+}
+
+func (h *BackupHandler) GetSource(w http.ResponseWriter, r *http.Request) {
+	if !h.pullerEnabled(w) {
+		return
+	}
+	src, err := h.puller.GetSource(chi.URLParam(r, "id"))
+	if err != nil {
+		respondError(w, http.StatusNotFound, "Source not found")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, src)
+}
+
+func (h *BackupHandler) UpdateSource(w http.ResponseWriter, r *http.Request) {
+	if !h.pullerEnabled(w) {
+		return
+	}
+	var src backup.Source
+	if err := json.NewDecoder(r.Body).Decode(&src); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if err := h.puller.UpdateSource(chi.URLParam(r, "id"), &src); err != nil {
+		h.logger.Error().Err(err).Msg("Failed to update source")
+		respondError(w, sourceErrorStatus(err), err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, src)
+}
+
+func (h *BackupHandler) DeleteSource(w http.ResponseWriter, r *http.Request) {
+	if !h.pullerEnabled(w) {
+		return
+	}
+	if err := h.puller.DeleteSource(chi.URLParam(r, "id")); err != nil {
+		h.logger.Error().Err(err).Msg("Failed to delete source")
+		respondError(w, sourceErrorStatus(err), err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+}
+
+func (h *BackupHandler) StoreSourceKey(w http.ResponseWriter, r *http.Request) {
+	if !h.pullerEnabled(w) {
+		return
+	}
+	var req struct {
+		Key string `json:"key"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if req.Key == "" {
+		respondError(w, http.StatusBadRequest, "SSH key is required")
+		return
+	}
+
+	if err := h.puller.StoreSSHKey(chi.URLParam(r, "id"), req.Key); err != nil {
+		h.logger.Error().Err(err).Msg("Failed to store SSH key")
+		respondError(w, sourceErrorStatus(err), err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{"status": "stored"})
+}
+
+func (h *BackupHandler) TestSource(w http.ResponseWriter, r *http.Request) {
+	if !h.pullerEnabled(w) {
+		return
+	}
+	if err := h.puller.TestSource(chi.URLParam(r, "id")); err != nil {
+		h.logger.Error().Err(err).Msg("Source test failed")
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
+
+func (h *BackupHandler) RunSource(w http.ResponseWriter, r *http.Request) {
+	if !h.pullerEnabled(w) {
+		return
+	}
+	job, err := h.puller.RunSource(chi.URLParam(r, "id"))
+	if err != nil {
+		respondError(w, sourceErrorStatus(err), err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusAccepted, job)
+}
@@ -10,6 +10,7 @@ import (
 	"nithronos/backend/nosd/internal/config"
 	"nithronos/backend/nosd/pkg/agentclient"
 	"nithronos/backend/nosd/pkg/httpx"
+	"nithronos/backend/nosd/pkg/jobs"
 )
 
 // handleBalanceStatus returns the status of a BTRFS balance operation
@@ -49,7 +50,7 @@ func handleBalanceStatus(cfg config.Config) http.HandlerFunc {
 }
 
 // handleBalanceStart initiates a BTRFS balance operation
-func handleBalanceStart(cfg config.Config) http.HandlerFunc {
+func handleBalanceStart(cfg config.Config, engine *jobs.Engine) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var body struct {
 			PoolID    string `json:"pool_id"`
@@ -67,13 +68,13 @@ func handleBalanceStart(cfg config.Config) http.HandlerFunc {
 		}
 		
 		// Create a job for this operation
-		job := CreateJob("balance", fmt.Sprintf("Starting balance on %s", mountPath), map[string]any{
+		job := CreateJob(engine, "balance", fmt.Sprintf("Starting balance on %s", mountPath), map[string]any{
 			"pool_id": body.PoolID,
 			"mount_path": mountPath,
 		})
 		
 		// TODO: Start balance via agent
-		StartJob(job.ID)
+		StartJob(engine, job.ID)
 		
 		writeJSON(w, map[string]any{
 			"status":  "started",
@@ -18,11 +18,12 @@ const (
 	cookieCSRF    = "nos_csrf"
 )
 
-// issueSessionCookies sets nos_session (15m) and optionally rotates/sets nos_refresh (7d)
-func issueSessionCookies(w http.ResponseWriter, cfg config.Config, uid string, keepRefresh bool) error {
+// issueSessionCookies sets nos_session (15m) and optionally rotates/sets nos_refresh (7d).
+// authTime is when the user logged in; refreshed sessions carry it on.
+func issueSessionCookies(w http.ResponseWriter, cfg config.Config, uid string, keepRefresh bool, authTime time.Time) error {
 	now := time.Now().UTC()
 	// session token
-	sess := map[string]any{"uid": uid, "exp": now.Add(15 * time.Minute).Unix()}
+	sess := map[string]any{"uid": uid, "exp": now.Add(15 * time.Minute).Unix(), "auth_time": authTime.Unix()}
 	sVal, err := encodeOpaque(cfg, cookieSession, sess)
 	if err != nil {
 		return err
@@ -30,7 +31,7 @@ func issueSessionCookies(w http.ResponseWriter, cfg config.Config, uid string, k
 	http.SetCookie(w, &http.Cookie{Name: cookieSession, Value: sVal, Path: "/", HttpOnly: true, Secure: true, SameSite: http.SameSiteLaxMode, Expires: now.Add(15 * time.Minute)})
 	// refresh
 	if keepRefresh {
-		ref := map[string]any{"uid": uid, "exp": now.Add(7 * 24 * time.Hour).Unix()}
+		ref := map[string]any{"uid": uid, "exp": now.Add(7 * 24 * time.Hour).Unix(), "auth_time": authTime.Unix()}
 		rVal, err := encodeOpaque(cfg, cookieRefresh, ref)
 		if err != nil {
 			return err
@@ -87,22 +88,40 @@ func decodeRefreshUID(r *http.Request, cfg config.Config) (string, bool) {
 	return "", false
 }
 
+// decodeAuthTime returns when the user logged in, as the nos_session or
+// nos_refresh cookie name carries it; zero for a cookie that doesn't say.
+// It doesn't check the cookie's expiry.
+func decodeAuthTime(r *http.Request, cfg config.Config, name string) time.Time {
+	ck, err := r.Cookie(name)
+	if err != nil {
+		return time.Time{}
+	}
+	var m map[string]any
+	if err := decodeOpaque(cfg, name, ck.Value, &m); err != nil {
+		return time.Time{}
+	}
+	if at, ok := asInt64(m["auth_time"]); ok && at > 0 {
+		return time.Unix(at, 0)
+	}
+	return time.Time{}
+}
+
 func issueCSRFCookie(w http.ResponseWriter) {
 	b := securecookie.GenerateRandomKey(32)
 	http.SetCookie(w, &http.Cookie{Name: cookieCSRF, Value: encodeBase64(b), Path: "/", Secure: true, SameSite: http.SameSiteLaxMode, Expires: time.Now().Add(24 * time.Hour)})
 }
 
 // issueSessionCookiesSID sets nos_session with server-side sid binding
-func issueSessionCookiesSID(w http.ResponseWriter, cfg config.Config, uid, sid string, keepRefresh bool) error {
+func issueSessionCookiesSID(w http.ResponseWriter, cfg config.Config, uid, sid string, keepRefresh bool, authTime time.Time) error {
 	now := time.Now().UTC()
-	sess := map[string]any{"uid": uid, "sid": sid, "exp": now.Add(15 * time.Minute).Unix()}
+	sess := map[string]any{"uid": uid, "sid": sid, "exp": now.Add(15 * time.Minute).Unix(), "auth_time": authTime.Unix()}
 	sVal, err := encodeOpaque(cfg, cookieSession, sess)
 	if err != nil {
 		return err
 	}
 	http.SetCookie(w, &http.Cookie{Name: cookieSession, Value: sVal, Path: "/", HttpOnly: true, Secure: true, SameSite: http.SameSiteLaxMode, Expires: now.Add(15 * time.Minute)})
 	if keepRefresh {
-		ref := map[string]any{"uid": uid, "exp": now.Add(7 * 24 * time.Hour).Unix()}
+		ref := map[string]any{"uid": uid, "exp": now.Add(7 * 24 * time.Hour).Unix(), "auth_time": authTime.Unix()}
 		rVal, err := encodeOpaque(cfg, cookieRefresh, ref)
 		if err != nil {
 			return err
@@ -1,24 +1,29 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"path/filepath"
-	"runtime"
-	"sort"
+	"strconv"
 	"time"
 
 	"github.com/go-chi/chi/v5"
-	"nithronos/backend/nosd/internal/config"
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog"
 	"nithronos/backend/nosd/pkg/httpx"
+	"nithronos/backend/nosd/pkg/jobs"
 )
 
-// Job represents a background job
+// Job is the API view of a background job
 type Job struct {
 	ID          string    `json:"id"`
 	Type        string    `json:"type"` // scrub, balance, snapshot, backup, etc.
-	Status      string    `json:"status"` // pending, running, completed, failed, cancelled
+	Status      string    `json:"status"` // pending, running, completed, failed, cancelled, interrupted
 	Progress    float64   `json:"progress,omitempty"` // 0-100
 	StartTime   time.Time `json:"start_time"`
 	EndTime     *time.Time `json:"end_time,omitempty"`
@@ -26,281 +31,361 @@ type Job struct {
 	Message     string    `json:"message,omitempty"`
 	Error       string    `json:"error,omitempty"`
 	Details     map[string]any `json:"details,omitempty"`
+	Resource    string    `json:"resource,omitempty"`
+	ParentID    string    `json:"parent_id,omitempty"`
+	ChildIDs    []string  `json:"child_ids,omitempty"`
+	Resumable   bool      `json:"resumable,omitempty"`
+	ResumedBy   string    `json:"resumed_by,omitempty"`
+	Payload     json.RawMessage `json:"payload,omitempty"`
 }
 
-// JobsStore manages job history
-type JobsStore struct {
-	path string
-	jobs []Job
+func jobsDir() string {
+	base := os.Getenv("NOS_STATE_DIR")
+	if base == "" {
+		base = "/var/lib/nos"
+	}
+	return filepath.Join(base, "jobs")
 }
 
-var jobsStore *JobsStore
+// newJobEngine starts the job engine of the state directory, bringing in
+// the history of the stores it replaced. Jobs cut off by a restart are
+// marked interrupted.
+func newJobEngine(logger zerolog.Logger) *jobs.Engine {
+	e := jobs.New(logger, jobsDir())
+	if err := e.Start(); err != nil {
+		logger.Warn().Err(err).Str("dir", jobsDir()).Msg("job history unavailable")
+	}
+	migrateJobHistory(logger, e)
+	return e
+}
 
-// InitJobsStore initializes the jobs store
-func InitJobsStore(cfg config.Config) {
-	jobsPath := filepath.Join("/var/lib/nos", "jobs.json")
-	if runtime.GOOS == "windows" {
-		jobsPath = filepath.Join(`C:\ProgramData\NithronOS`, "jobs.json")
+// jobView converts an engine job to its API view
+func jobView(j *jobs.Job) Job {
+	view := Job{
+		ID:        j.ID,
+		Type:      j.Type,
+		Status:    string(j.State),
+		Progress:  j.Progress,
+		StartTime: j.CreatedAt,
+		EndTime:   j.FinishedAt,
+		Message:   j.Message,
+		Error:     j.Error,
+		Details:   j.Details,
+		Resource:  j.Resource,
+		ParentID:  j.ParentID,
+		ChildIDs:  j.ChildIDs,
+		Resumable: j.Resumable,
+		ResumedBy: j.ResumedBy,
+		Payload:   j.Payload,
 	}
-	
-	jobsStore = &JobsStore{
-		path: jobsPath,
-		jobs: []Job{},
+	switch j.State {
+	case jobs.StateSucceeded:
+		view.Status = "completed"
+	case jobs.StateCanceled:
+		view.Status = "cancelled"
 	}
-	
-	// Load existing jobs
-	if data, err := os.ReadFile(jobsPath); err == nil {
-		_ = json.Unmarshal(data, &jobsStore.jobs)
+	if j.StartedAt != nil {
+		view.StartTime = *j.StartedAt
+	}
+	if j.FinishedAt != nil {
+		view.Duration = int64(j.FinishedAt.Sub(view.StartTime).Seconds())
 	}
+	return view
 }
 
-// AddJob adds a new job to the store
-func (s *JobsStore) AddJob(job Job) {
-	if s == nil {
-		return
-	}
-	
-	s.jobs = append(s.jobs, job)
-	
-	// Keep only the last 100 jobs
-	if len(s.jobs) > 100 {
-		s.jobs = s.jobs[len(s.jobs)-100:]
-	}
-	
-	// Save to disk (best effort)
-	if data, err := json.MarshalIndent(s.jobs, "", "  "); err == nil {
-		_ = os.WriteFile(s.path, data, 0644)
+func jobViews(list []*jobs.Job) []Job {
+	out := make([]Job, 0, len(list))
+	for _, j := range list {
+		out = append(out, jobView(j))
 	}
+	return out
 }
 
-// GetRecentJobs returns the most recent jobs
-func (s *JobsStore) GetRecentJobs(limit int) []Job {
-	if s == nil || len(s.jobs) == 0 {
-		return []Job{}
+// queryLimit reads ?limit=, capped at 100
+func queryLimit(r *http.Request, def int) int {
+	if l := r.URL.Query().Get("limit"); l != "" {
+		if parsed, err := parseInt(l); err == nil && parsed > 0 && parsed <= 100 {
+			return parsed
+		}
 	}
-	
-	// Sort by start time descending
-	sorted := make([]Job, len(s.jobs))
-	copy(sorted, s.jobs)
-	sort.Slice(sorted, func(i, j int) bool {
-		return sorted[i].StartTime.After(sorted[j].StartTime)
-	})
-	
-	if limit > 0 && limit < len(sorted) {
-		return sorted[:limit]
+	return def
+}
+
+// handleJobsList returns jobs filtered by type, state, parent and resource
+func handleJobsList(engine *jobs.Engine) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		list := engine.List(jobs.Filter{
+			Type:     q.Get("type"),
+			State:    jobs.State(q.Get("state")),
+			ParentID: q.Get("parent"),
+			Resource: q.Get("resource"),
+			Limit:    queryLimit(r, 50),
+		})
+		writeJSON(w, jobViews(list))
 	}
-	return sorted
 }
 
-// GetJob returns a specific job by ID
-func (s *JobsStore) GetJob(id string) (*Job, bool) {
-	if s == nil {
-		return nil, false
+// handleJobsRecent returns recent jobs
+func handleJobsRecent(engine *jobs.Engine) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, jobViews(engine.List(jobs.Filter{Limit: queryLimit(r, 20)})))
 	}
-	
-	for _, job := range s.jobs {
-		if job.ID == id {
-			return &job, true
+}
+
+// handleJobGet returns a specific job by ID
+func handleJobGet(engine *jobs.Engine) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		jobID := chi.URLParam(r, "id")
+		if jobID == "" {
+			httpx.WriteTypedError(w, http.StatusBadRequest, "job.id.required", "Job ID is required", 0)
+			return
 		}
+		
+		job, found := engine.Get(jobID)
+		if !found {
+			httpx.WriteTypedError(w, http.StatusNotFound, "job.not_found", "Job not found", 0)
+			return
+		}
+		writeJSON(w, jobView(job))
 	}
-	return nil, false
 }
 
-// UpdateJob updates an existing job
-func (s *JobsStore) UpdateJob(id string, updates func(*Job)) {
-	if s == nil {
-		return
+// handleJobLogs returns a page of a job's structured log
+func handleJobLogs(engine *jobs.Engine) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "id")
+		if _, ok := engine.Get(id); !ok {
+			httpx.WriteTypedError(w, http.StatusNotFound, "job.not_found", "Job not found", 0)
+			return
+		}
+		cursor, max := 0, 1000
+		if i, err := strconv.Atoi(r.URL.Query().Get("cursor")); err == nil && i >= 0 {
+			cursor = i
+		}
+		if i, err := strconv.Atoi(r.URL.Query().Get("max")); err == nil && i > 0 && i <= 5000 {
+			max = i
+		}
+		entries, next := engine.Logs(id, cursor, max)
+		writeJSON(w, map[string]any{"entries": entries, "next_cursor": next})
 	}
-	
-	for i := range s.jobs {
-		if s.jobs[i].ID == id {
-			updates(&s.jobs[i])
-			
-			// Save to disk (best effort)
-			if data, err := json.MarshalIndent(s.jobs, "", "  "); err == nil {
-				_ = os.WriteFile(s.path, data, 0644)
+}
+
+// handleJobCancel cancels a job and its children
+func handleJobCancel(engine *jobs.Engine) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "id")
+		if err := engine.Cancel(id); err != nil {
+			if errors.Is(err, jobs.ErrNotFound) {
+				httpx.WriteTypedError(w, http.StatusNotFound, "job.not_found", "Job not found", 0)
+				return
 			}
-			break
+			httpx.WriteTypedError(w, http.StatusInternalServerError, "job.cancel_failed", err.Error(), 0)
+			return
 		}
+		job, _ := engine.Get(id)
+		writeJSON(w, jobView(job))
 	}
 }
 
-// handleJobsRecent returns recent jobs
-func handleJobsRecent(cfg config.Config) http.HandlerFunc {
+// handleJobStream streams a job's changes and log as server-sent events
+// until it finishes
+func handleJobStream(engine *jobs.Engine) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		limit := 20
-		if l := r.URL.Query().Get("limit"); l != "" {
-			if parsed, err := parseInt(l); err == nil && parsed > 0 && parsed <= 100 {
-				limit = parsed
+		streamJob(w, r, engine, chi.URLParam(r, "id"), func(w io.Writer, ev jobs.Event) {
+			var data []byte
+			if ev.Type == "log" {
+				data, _ = json.Marshal(ev.Log)
+			} else {
+				data, _ = json.Marshal(jobView(ev.Job))
 			}
-		}
-		
-		jobs := []Job{}
-		
-		if jobsStore != nil {
-			jobs = jobsStore.GetRecentJobs(limit)
-		}
-		
-		// If no jobs in store, return some example jobs
-		if len(jobs) == 0 {
-			now := time.Now()
-			jobs = []Job{
-				{
-					ID:        generateUUID(),
-					Type:      "pool.create",
-					Status:    "completed",
-					Progress:  100,
-					StartTime: now.Add(-2 * time.Hour),
-					EndTime:   &[]time.Time{now.Add(-1 * time.Hour)}[0],
-					Duration:  3600,
-					Message:   "Pool created successfully",
-					Details: map[string]any{
-						"pool_name": "main",
-						"devices":   []string{"/dev/sda", "/dev/sdb"},
-						"raid":      "raid1",
-					},
-				},
-				{
-					ID:        generateUUID(),
-					Type:      "scrub",
-					Status:    "running",
-					Progress:  45.5,
-					StartTime: now.Add(-30 * time.Minute),
-					Message:   "Scrubbing pool 'main'",
-					Details: map[string]any{
-						"pool_id":       "pool-123",
-						"data_scrubbed": "45.2 GiB",
-						"errors_found":  0,
-					},
-				},
-				{
-					ID:        generateUUID(),
-					Type:      "snapshot",
-					Status:    "completed",
-					Progress:  100,
-					StartTime: now.Add(-1 * time.Hour),
-					EndTime:   &[]time.Time{now.Add(-59 * time.Minute)}[0],
-					Duration:  60,
-					Message:   "Snapshot created",
-					Details: map[string]any{
-						"snapshot_id": "snap-20240101-120000",
-						"pool_id":     "pool-123",
-					},
-				},
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+		})
+	}
+}
+
+// streamJob replays a job and its log through write, then follows it
+// until it finishes or the client goes away
+func streamJob(w http.ResponseWriter, r *http.Request, e *jobs.Engine, id string, write func(w io.Writer, ev jobs.Event)) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	// Subscribe before the replay so nothing falls in between
+	events, unsubscribe := e.Subscribe(id)
+	defer unsubscribe()
+	job, found := e.Get(id)
+	if !found {
+		httpx.WriteTypedError(w, http.StatusNotFound, "job.not_found", "Job not found", 0)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	
+	write(w, jobs.Event{Type: "job", JobID: id, Job: job})
+	entries, cursor := e.Logs(id, 0, 0)
+	for i := range entries {
+		write(w, jobs.Event{Type: "log", JobID: id, Log: &entries[i]})
+	}
+	flusher.Flush()
+	if job.State.Done() {
+		return
+	}
+	
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			_, _ = w.Write([]byte(": keepalive\n\n"))
+			flusher.Flush()
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			if ev.Type == "log" && ev.Log.Seq < cursor {
+				continue
+			}
+			write(w, ev)
+			flusher.Flush()
+			if ev.Type == "job" && ev.Job.State.Done() {
+				return
 			}
 		}
-		
-		writeJSON(w, jobs)
 	}
 }
 
-// handleJobGet returns a specific job by ID
-func handleJobGet(cfg config.Config) http.HandlerFunc {
+var jobsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// handleJobsSocket streams job events over a WebSocket: every job's, or
+// with ?id= one job's, starting with its current state and log
+func handleJobsSocket(engine *jobs.Engine) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		jobID := chi.URLParam(r, "id")
-		if jobID == "" {
-			httpx.WriteTypedError(w, http.StatusBadRequest, "job.id.required", "Job ID is required", 0)
+		serveJobsSocket(w, r, engine)
+	}
+}
+
+func serveJobsSocket(w http.ResponseWriter, r *http.Request, e *jobs.Engine) {
+	id := r.URL.Query().Get("id")
+	if id != "" {
+		if _, ok := e.Get(id); !ok {
+			httpx.WriteTypedError(w, http.StatusNotFound, "job.not_found", "Job not found", 0)
 			return
 		}
-		
-		if jobsStore != nil {
-			if job, found := jobsStore.GetJob(jobID); found {
-				writeJSON(w, job)
+	}
+	conn, err := jobsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	
+	events, unsubscribe := e.Subscribe(id)
+	defer unsubscribe()
+	
+	// The client only ever closes; reading notices that
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
 				return
 			}
 		}
-		
-		// If not found, return a mock job for demo
-		if jobID == "example" {
-			now := time.Now()
-			job := Job{
-				ID:        jobID,
-				Type:      "balance",
-				Status:    "running",
-				Progress:  67.8,
-				StartTime: now.Add(-45 * time.Minute),
-				Message:   "Balancing pool 'main'",
-				Details: map[string]any{
-					"pool_id":    "pool-123",
-					"left":       "12.3 GiB",
-					"total":      "38.1 GiB",
-					"mount_path": "/mnt/pool",
-				},
+	}()
+	
+	send := func(ev jobs.Event) bool {
+		_ = conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		return conn.WriteJSON(ev) == nil
+	}
+	cursor := 0
+	if id != "" {
+		job, _ := e.Get(id)
+		if !send(jobs.Event{Type: "job", JobID: id, Job: job}) {
+			return
+		}
+		var entries []jobs.LogEntry
+		entries, cursor = e.Logs(id, 0, 0)
+		for i := range entries {
+			if !send(jobs.Event{Type: "log", JobID: id, Log: &entries[i]}) {
+				return
 			}
-			writeJSON(w, job)
+		}
+	}
+	
+	ping := time.NewTicker(30 * time.Second)
+	defer ping.Stop()
+	for {
+		select {
+		case <-ctx.Done():
 			return
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+				return
+			}
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			if ev.Type == "log" && ev.Log.Seq < cursor {
+				continue
+			}
+			if !send(ev) {
+				return
+			}
 		}
-		
-		httpx.WriteTypedError(w, http.StatusNotFound, "job.not_found", "Job not found", 0)
 	}
 }
 
 // CreateJob creates a new job and adds it to the store
-func CreateJob(jobType, message string, details map[string]any) *Job {
-	job := Job{
-		ID:        generateUUID(),
-		Type:      jobType,
-		Status:    "pending",
-		StartTime: time.Now(),
-		Message:   message,
-		Details:   details,
-	}
-	
-	if jobsStore != nil {
-		jobsStore.AddJob(job)
+func CreateJob(engine *jobs.Engine, jobType, message string, details map[string]any) *Job {
+	job, err := engine.Create(&jobs.Job{
+		Type:    jobType,
+		Message: message,
+		Details: details,
+	})
+	if err != nil {
+		return &Job{ID: generateUUID(), Type: jobType, Status: string(jobs.StatePending), StartTime: time.Now(), Message: message, Details: details}
 	}
-	
-	return &job
+	view := jobView(job)
+	return &view
 }
 
 // StartJob marks a job as running
-func StartJob(jobID string) {
-	if jobsStore != nil {
-		jobsStore.UpdateJob(jobID, func(j *Job) {
-			j.Status = "running"
-			j.StartTime = time.Now()
-		})
-	}
+func StartJob(engine *jobs.Engine, jobID string) {
+	_, _ = engine.Update(jobID, func(j *jobs.Job) {
+		j.State = jobs.StateRunning
+	})
 }
 
 // UpdateJobProgress updates job progress
-func UpdateJobProgress(jobID string, progress float64, message string) {
-	if jobsStore != nil {
-		jobsStore.UpdateJob(jobID, func(j *Job) {
-			j.Progress = progress
-			if message != "" {
-				j.Message = message
-			}
-		})
-	}
+func UpdateJobProgress(engine *jobs.Engine, jobID string, progress float64, message string) {
+	engine.Progress(jobID, progress, message)
 }
 
 // CompleteJob marks a job as completed
-func CompleteJob(jobID string, message string) {
-	if jobsStore != nil {
-		now := time.Now()
-		jobsStore.UpdateJob(jobID, func(j *Job) {
-			j.Status = "completed"
-			j.Progress = 100
-			j.EndTime = &now
-			j.Duration = int64(now.Sub(j.StartTime).Seconds())
-			if message != "" {
-				j.Message = message
-			}
-		})
-	}
+func CompleteJob(engine *jobs.Engine, jobID string, message string) {
+	_, _ = engine.Update(jobID, func(j *jobs.Job) {
+		j.State = jobs.StateSucceeded
+		j.Progress = 100
+		if message != "" {
+			j.Message = message
+		}
+	})
 }
 
 // FailJob marks a job as failed
-func FailJob(jobID string, errorMsg string) {
-	if jobsStore != nil {
-		now := time.Now()
-		jobsStore.UpdateJob(jobID, func(j *Job) {
-			j.Status = "failed"
-			j.EndTime = &now
-			j.Duration = int64(now.Sub(j.StartTime).Seconds())
-			j.Error = errorMsg
-		})
-	}
+func FailJob(engine *jobs.Engine, jobID string, errorMsg string) {
+	_, _ = engine.Update(jobID, func(j *jobs.Job) {
+		j.State = jobs.StateFailed
+		j.Error = errorMsg
+	})
 }
-
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"nithronos/backend/nosd/internal/fsatomic"
+	"nithronos/backend/nosd/internal/pools"
+	"nithronos/backend/nosd/pkg/jobs"
+)
+
+// Before the job engine, job history lived in jobs.json and pool
+// transactions in pools/tx. migrateJobHistory brings both into the engine
+// once and renames them with a .migrated suffix.
+func migrateJobHistory(logger zerolog.Logger, engine *jobs.Engine) {
+	stateDir := filepath.Dir(jobsDir())
+
+	legacyJobs := filepath.Join(stateDir, "jobs.json")
+	if runtime.GOOS == "windows" {
+		legacyJobs = filepath.Join(`C:\ProgramData\NithronOS`, "jobs.json")
+	}
+	if n, err := migrateLegacyJobs(engine, legacyJobs); err != nil {
+		logger.Warn().Err(err).Str("path", legacyJobs).Msg("Failed to migrate job history")
+	} else if n >= 0 {
+		logger.Info().Int("count", n).Str("path", legacyJobs).Msg("Migrated job history")
+	}
+
+	txDir := filepath.Join(stateDir, "pools", "tx")
+	if n, err := migratePoolTxs(engine, txDir); err != nil {
+		logger.Warn().Err(err).Str("path", txDir).Msg("Failed to migrate pool transactions")
+	} else if n >= 0 {
+		logger.Info().Int("count", n).Str("path", txDir).Msg("Migrated pool transactions")
+	}
+}
+
+// migrateLegacyJobs imports the jobs of a jobs.json file. It returns -1
+// when there is nothing to migrate.
+func migrateLegacyJobs(engine *jobs.Engine, path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return -1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var legacy []Job
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, old := range legacy {
+		if old.ID == "" || old.Type == "" {
+			continue
+		}
+		if _, ok := engine.Get(old.ID); ok {
+			continue
+		}
+		job := &jobs.Job{
+			ID:         old.ID,
+			Type:       old.Type,
+			State:      legacyJobState(old.Status),
+			Progress:   old.Progress,
+			Message:    old.Message,
+			Error:      old.Error,
+			Details:    old.Details,
+			CreatedAt:  old.StartTime,
+			StartedAt:  &old.StartTime,
+			FinishedAt: old.EndTime,
+		}
+		if job.State == jobs.StateInterrupted {
+			job.Error = "interrupted by restart"
+		}
+		if job.FinishedAt == nil {
+			job.FinishedAt = &old.StartTime
+		}
+		if _, err := engine.Create(job); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, os.Rename(path, path+".migrated")
+}
+
+// legacyJobState maps the statuses of jobs.json to job states; jobs that
+// hadn't finished never will
+func legacyJobState(status string) jobs.State {
+	switch status {
+	case "completed":
+		return jobs.StateSucceeded
+	case "failed":
+		return jobs.StateFailed
+	case "cancelled":
+		return jobs.StateCanceled
+	default:
+		return jobs.StateInterrupted
+	}
+}
+
+// migratePoolTxs imports the transactions and step logs of a pools/tx
+// directory. It returns -1 when there is nothing to migrate.
+func migratePoolTxs(engine *jobs.Engine, dir string) (int, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return 0, err
+	}
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return -1, nil
+	}
+	n := 0
+	for _, path := range paths {
+		var tx pools.Tx
+		if ok, err := fsatomic.LoadJSON(path, &tx); !ok || err != nil || tx.ID == "" {
+			continue
+		}
+		if _, ok := engine.Get(tx.ID); ok {
+			continue
+		}
+		if _, err := engine.Create(&jobs.Job{ID: tx.ID, Type: poolTxJobType, CreatedAt: tx.StartedAt}); err != nil {
+			return n, err
+		}
+		for _, entry := range readLegacyTxLog(strings.TrimSuffix(path, ".json") + ".log") {
+			engine.Log(tx.ID, entry)
+		}
+		_, _ = engine.Update(tx.ID, func(job *jobs.Job) {
+			syncTx(job, tx)
+			if !job.State.Done() {
+				job.State = jobs.StateInterrupted
+				job.Error = "interrupted by restart"
+			}
+		})
+		n++
+	}
+	return n, os.Rename(dir, dir+".migrated")
+}
+
+// readLegacyTxLog reads the JSON lines of a pool transaction log
+func readLegacyTxLog(path string) []jobs.LogEntry {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var entries []jobs.LogEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var rec struct {
+			TS     string `json:"ts"`
+			Level  string `json:"level"`
+			StepID string `json:"stepId"`
+			Msg    string `json:"msg"`
+		}
+		if json.Unmarshal(scanner.Bytes(), &rec) != nil {
+			continue
+		}
+		ts, _ := time.Parse(time.RFC3339, rec.TS)
+		entries = append(entries, jobs.LogEntry{Time: ts, Level: rec.Level, Step: rec.StepID, Message: rec.Msg})
+	}
+	return entries
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"nithronos/backend/nosd/pkg/jobs"
+)
+
+func TestMigrateJobHistory(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("NOS_STATE_DIR", dir)
+	writeFile := func(path, data string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Within the retention, so the engine keeps them
+	ts := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	writeFile(filepath.Join(dir, "jobs.json"), `[
+  {"id": "j1", "type": "balance", "status": "completed", "start_time": "`+ts+`", "end_time": "`+ts+`", "message": "done"},
+  {"id": "j2", "type": "scrub", "status": "running", "start_time": "`+ts+`"}
+]`)
+	writeFile(filepath.Join(dir, "pools", "tx", "tx1.json"), `{"id": "tx1", "startedAt": "`+ts+`", "finishedAt": "`+ts+`", "ok": true,
+  "steps": [{"id": "s1", "name": "mkfs", "cmd": "mkfs.btrfs /dev/sdb", "status": "ok"}]}`)
+	writeFile(filepath.Join(dir, "pools", "tx", "tx1.log"), `{"ts":"`+ts+`","level":"info","stepId":"s1","msg":"starting"}
+{"ts":"`+ts+`","level":"info","stepId":"s1","msg":"ok"}
+`)
+
+	engine := newJobEngine(zerolog.Nop())
+	defer engine.Stop()
+
+	if job, ok := engine.Get("j1"); !ok || job.State != jobs.StateSucceeded || job.Message != "done" || job.FinishedAt == nil {
+		t.Fatalf("j1 %+v", job)
+	}
+	if job, ok := engine.Get("j2"); !ok || job.State != jobs.StateInterrupted {
+		t.Fatalf("j2 %+v", job)
+	}
+	tx, ok := loadPoolTx(engine, "tx1")
+	if !ok || !tx.OK || len(tx.Steps) != 1 {
+		t.Fatalf("tx1 %+v", tx)
+	}
+	if lines, next := readLogTail(engine, "tx1", 0, 10); len(lines) != 2 || next != 2 {
+		t.Fatalf("tx1 log %v, cursor %d", lines, next)
+	}
+	for _, old := range []string{"jobs.json", filepath.Join("pools", "tx")} {
+		if _, err := os.Stat(filepath.Join(dir, old+".migrated")); err != nil {
+			t.Errorf("%s not renamed: %v", old, err)
+		}
+	}
+
+	// The history survives the next start without the old files
+	engine.Stop()
+	restarted := newJobEngine(zerolog.Nop())
+	defer restarted.Stop()
+	if _, ok := restarted.Get("tx1"); !ok {
+		t.Error("migrated transaction lost on restart")
+	}
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"nithronos/backend/nosd/internal/config"
+	pkgapps "nithronos/backend/nosd/pkg/apps"
+	"nithronos/backend/nosd/pkg/auth"
+	"nithronos/backend/nosd/pkg/httpx"
+	"nithronos/backend/nosd/pkg/oidc"
+)
+
+// The OpenID Connect provider for installed apps. Users sign in to an app
+// through their NithronOS session, so its login, 2FA included, is the
+// only one they see.
+
+// writeOIDCError answers the token and userinfo endpoints' errors the
+// OAuth way
+func writeOIDCError(w http.ResponseWriter, err error) {
+	var oe *oidc.Error
+	if !errors.As(err, &oe) {
+		httpx.WriteError(w, http.StatusInternalServerError, "server_error")
+		return
+	}
+	status := http.StatusBadRequest
+	switch oe.Code {
+	case "invalid_client":
+		status = http.StatusUnauthorized
+		w.Header().Set("WWW-Authenticate", `Basic realm="nosd"`)
+	case "invalid_token":
+		status = http.StatusUnauthorized
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(oe)
+}
+
+// The issuer comes from configuration, the HTTPS domain apps are given
+// it under, never from the request's Host header
+func handleOIDCDiscovery(provider *oidc.Provider, issuer func() string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, provider.Discovery(issuer()))
+	}
+}
+
+func handleOIDCJWKS(provider *oidc.Provider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		jwks, err := provider.JWKS()
+		if err != nil {
+			httpx.WriteError(w, http.StatusInternalServerError, "Failed to load signing key")
+			return
+		}
+		writeJSON(w, jwks)
+	}
+}
+
+// handleOIDCAuthorize sends a signed-in user back to the app with a code,
+// and anyone else to the login page first
+func handleOIDCAuthorize(cfg config.Config, codec *auth.SessionCodec, provider *oidc.Provider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		req := oidc.AuthRequest{
+			ClientID:            r.Form.Get("client_id"),
+			RedirectURI:         r.Form.Get("redirect_uri"),
+			ResponseType:        r.Form.Get("response_type"),
+			Scope:               r.Form.Get("scope"),
+			Nonce:               r.Form.Get("nonce"),
+			CodeChallenge:       r.Form.Get("code_challenge"),
+			CodeChallengeMethod: r.Form.Get("code_challenge_method"),
+		}
+		// Never redirect to a URI the client didn't register
+		if err := provider.CheckRedirect(req.ClientID, req.RedirectURI); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		back := func(params url.Values) {
+			target, _ := url.Parse(req.RedirectURI)
+			q := target.Query()
+			for k, v := range params {
+				q[k] = v
+			}
+			if state := r.Form.Get("state"); state != "" {
+				q.Set("state", state)
+			}
+			target.RawQuery = q.Encode()
+			http.Redirect(w, r, target.String(), http.StatusFound)
+		}
+
+		// A session that doesn't say when the user logged in, or is older
+		// than max_age allows, logs in again
+		uid, authTime, ok := sessionLogin(r, cfg, codec)
+		if ok && (authTime.IsZero() || tooOld(authTime, r.Form.Get("max_age"))) {
+			ok = false
+		}
+		if !ok {
+			if r.Form.Get("prompt") == "none" {
+				back(url.Values{"error": {"login_required"}})
+				return
+			}
+			next := pkgapps.OIDCPath + "/authorize?" + r.Form.Encode()
+			http.Redirect(w, r, "/login?next="+url.QueryEscape(next), http.StatusFound)
+			return
+		}
+
+		code, err := provider.Authorize(req, uid, authTime)
+		if err != nil {
+			var oe *oidc.Error
+			if !errors.As(err, &oe) {
+				oe = &oidc.Error{Code: "server_error"}
+			}
+			params := url.Values{"error": {oe.Code}}
+			if oe.Description != "" {
+				params.Set("error_description", oe.Description)
+			}
+			back(params)
+			return
+		}
+		back(url.Values{"code": {code}})
+	}
+}
+
+// tooOld reports whether a login at authTime is older than the max_age
+// a client asked for, in seconds
+func tooOld(authTime time.Time, maxAge string) bool {
+	if maxAge == "" {
+		return false
+	}
+	seconds, err := strconv.ParseInt(maxAge, 10, 64)
+	if err != nil || seconds < 0 {
+		return false
+	}
+	return time.Since(authTime) > time.Duration(seconds)*time.Second
+}
+
+// handleOIDCToken redeems codes; clients authenticate with HTTP Basic or
+// form fields
+func handleOIDCToken(provider *oidc.Provider, issuer func() string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			writeOIDCError(w, &oidc.Error{Code: "invalid_request"})
+			return
+		}
+		req := oidc.TokenRequest{
+			GrantType:    r.PostForm.Get("grant_type"),
+			ClientID:     r.PostForm.Get("client_id"),
+			ClientSecret: r.PostForm.Get("client_secret"),
+			Code:         r.PostForm.Get("code"),
+			RedirectURI:  r.PostForm.Get("redirect_uri"),
+			CodeVerifier: r.PostForm.Get("code_verifier"),
+		}
+		if id, secret, ok := r.BasicAuth(); ok {
+			// RFC 6749 form-encodes the credentials before Basic
+			req.ClientID, _ = url.QueryUnescape(id)
+			req.ClientSecret, _ = url.QueryUnescape(secret)
+		}
+
+		resp, err := provider.Exchange(req, issuer())
+		if err != nil {
+			writeOIDCError(w, err)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, resp)
+	}
+}
+
+func handleOIDCUserInfo(provider *oidc.Provider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			writeOIDCError(w, &oidc.Error{Code: "invalid_token"})
+			return
+		}
+		claims, err := provider.UserInfo(strings.TrimSpace(token))
+		if err != nil {
+			writeOIDCError(w, err)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, claims)
+	}
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"nithronos/backend/nosd/pkg/oidc"
+)
+
+func TestOIDCAuthorize(t *testing.T) {
+	cfg, codec := appAuthConfig(t)
+	provider, err := oidc.NewProvider(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	redirect := "https://notes.nas.lan/cb"
+	clientID, secret, err := provider.RegisterClient("notes", "Notes", []string{redirect}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorize := handleOIDCAuthorize(cfg, codec, provider)
+	query := url.Values{
+		"client_id":     {clientID},
+		"redirect_uri":  {redirect},
+		"response_type": {"code"},
+		"scope":         {"openid"},
+		"state":         {"xyz"},
+	}
+	get := func(q url.Values, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "https://nas.lan/api/v1/oidc/authorize?"+q.Encode(), nil)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		authorize(w, r)
+		return w
+	}
+
+	bad := url.Values{}
+	for k, v := range query {
+		bad[k] = v
+	}
+	bad.Set("redirect_uri", "https://evil.example/cb")
+	if w := get(bad, nil); w.Code != http.StatusBadRequest {
+		t.Fatalf("unregistered redirect: %d", w.Code)
+	}
+
+	w := get(query, nil)
+	if loc := w.Header().Get("Location"); w.Code != http.StatusFound || !strings.HasPrefix(loc, "/login?next="+url.QueryEscape("/api/v1/oidc/authorize?")) {
+		t.Fatalf("signed out: %d %q", w.Code, loc)
+	}
+
+	query.Set("prompt", "none")
+	w = get(query, nil)
+	if loc := w.Header().Get("Location"); !strings.HasPrefix(loc, redirect+"?") || !strings.Contains(loc, "error=login_required") || !strings.Contains(loc, "state=xyz") {
+		t.Fatalf("prompt=none: %q", loc)
+	}
+
+	loggedIn := time.Now().Add(-10 * time.Minute)
+	sw := httptest.NewRecorder()
+	if err := issueSessionCookies(sw, cfg, "u1", false, loggedIn); err != nil {
+		t.Fatal(err)
+	}
+	cookies := sw.Result().Cookies()
+	w = get(query, cookies)
+	loc, _ := url.Parse(w.Header().Get("Location"))
+	if w.Code != http.StatusFound || loc.Host != "notes.nas.lan" || loc.Query().Get("code") == "" || loc.Query().Get("state") != "xyz" {
+		t.Fatalf("signed in: %d %q", w.Code, w.Header().Get("Location"))
+	}
+
+	// The issuer is configured; a forged Host doesn't change it
+	issuer := func() string { return "https://nas.lan/api/v1/oidc" }
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {clientID},
+		"client_secret": {secret},
+		"code":          {loc.Query().Get("code")},
+		"redirect_uri":  {redirect},
+	}
+	r := httptest.NewRequest(http.MethodPost, "http://evil.example/api/v1/oidc/token", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("X-Forwarded-Proto", "http")
+	w = httptest.NewRecorder()
+	handleOIDCToken(provider, issuer)(w, r)
+	var resp oidc.TokenResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.IDToken == "" {
+		t.Fatalf("token: %d %s", w.Code, w.Body.String())
+	}
+	parts := strings.Split(resp.IDToken, ".")
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var claims struct {
+		Iss      string `json:"iss"`
+		AuthTime int64  `json:"auth_time"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims.Iss != issuer() || claims.AuthTime != loggedIn.Unix() {
+		t.Fatalf("id token iss %q auth_time %d, want %q %d", claims.Iss, claims.AuthTime, issuer(), loggedIn.Unix())
+	}
+
+	w = httptest.NewRecorder()
+	handleOIDCDiscovery(provider, issuer)(w, httptest.NewRequest(http.MethodGet, "http://evil.example/api/v1/oidc/.well-known/openid-configuration", nil))
+	if !strings.Contains(w.Body.String(), `"issuer":"https://nas.lan/api/v1/oidc"`) {
+		t.Fatalf("discovery: %s", w.Body.String())
+	}
+
+	// A login older than max_age has to be repeated
+	query.Set("max_age", "60")
+	w = get(query, cookies)
+	if loc := w.Header().Get("Location"); !strings.Contains(loc, "error=login_required") {
+		t.Fatalf("max_age=60: %q", loc)
+	}
+	query.Set("max_age", "3600")
+	w = get(query, cookies)
+	if loc, _ := url.Parse(w.Header().Get("Location")); loc.Query().Get("code") == "" {
+		t.Fatalf("max_age=3600: %q", w.Header().Get("Location"))
+	}
+}
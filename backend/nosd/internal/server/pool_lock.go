@@ -2,72 +2,42 @@ package server
 
 import (
 	"os"
-	"path/filepath"
-	"sync"
-)
 
-var (
-	poolLockMu   sync.Mutex
-	poolHeldByTx = map[string]string{} // poolId -> txId
+	"nithronos/backend/nosd/internal/pools"
+	"nithronos/backend/nosd/pkg/jobs"
 )
 
-func poolLockPath(id string) string {
-	base := os.Getenv("NOS_STATE_DIR")
-	if base == "" {
-		base = "/var/lib/nos"
-	}
-	return filepath.Join(base, "locks", "pool."+sanitizeID(id)+".lock")
-}
-
-func sanitizeID(id string) string {
-	out := make([]rune, 0, len(id))
-	for _, r := range id {
-		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_' || r == '.' {
-			out = append(out, r)
-		}
-	}
-	if len(out) == 0 {
-		return "unknown"
-	}
-	return string(out)
-}
+// Pools are job engine resources: one transaction at a time per pool, and
+// the transaction's job releases the pool when it finishes.
+func poolResource(poolID string) string { return "pool:" + poolID }
 
 // tryAcquirePoolLock marks pool as busy with txId. Returns false if already held.
-func tryAcquirePoolLock(poolID, txId string) bool {
+func tryAcquirePoolLock(engine *jobs.Engine, poolID, txId string) bool {
 	if os.Getenv("NOS_TEST_SKIP_POOL_LOCK") == "1" {
 		return true
 	}
-	poolLockMu.Lock()
-	defer poolLockMu.Unlock()
-	if _, ok := poolHeldByTx[poolID]; ok {
+	if _, ok := engine.TryAcquire(poolResource(poolID), txId); !ok {
 		return false
 	}
-	// best-effort create marker file
-	_ = os.MkdirAll(filepath.Dir(poolLockPath(poolID)), 0o755)
-	f, _ := os.OpenFile(poolLockPath(poolID), os.O_CREATE|os.O_WRONLY, 0o644)
-	if f != nil {
-		_, _ = f.WriteString(txId)
-		_ = f.Close()
-	}
-	poolHeldByTx[poolID] = txId
+	// Finishing the tx's job releases the pool
+	_, _ = engine.Update(txId, func(job *jobs.Job) { job.Resource = poolResource(poolID) })
 	return true
 }
 
-func releasePoolLock(poolID string) {
-	if os.Getenv("NOS_TEST_SKIP_POOL_LOCK") == "1" {
-		return
+// claimPool takes the pool for a new transaction and records it; a busy
+// pool leaves no record behind
+func claimPool(engine *jobs.Engine, poolID string, tx pools.Tx) bool {
+	if !tryAcquirePoolLock(engine, poolID, tx.ID) {
+		return false
 	}
-	poolLockMu.Lock()
-	defer poolLockMu.Unlock()
-	delete(poolHeldByTx, poolID)
-	_ = os.Remove(poolLockPath(poolID))
+	_ = saveTx(engine, tx)
+	_ = tryAcquirePoolLock(engine, poolID, tx.ID)
+	return true
 }
 
-func currentPoolTx(poolID string) string {
+func currentPoolTx(engine *jobs.Engine, poolID string) string {
 	if os.Getenv("NOS_TEST_SKIP_POOL_LOCK") == "1" {
 		return ""
 	}
-	poolLockMu.Lock()
-	defer poolLockMu.Unlock()
-	return poolHeldByTx[poolID]
+	return engine.Holder(poolResource(poolID))
 }
@@ -14,6 +14,7 @@ import (
 	"nithronos/backend/nosd/internal/pools"
 	"nithronos/backend/nosd/pkg/agentclient"
 	"nithronos/backend/nosd/pkg/httpx"
+	"nithronos/backend/nosd/pkg/jobs"
 )
 
 type applyCreateRequest struct {
@@ -22,7 +23,7 @@ type applyCreateRequest struct {
 	Confirm string           `json:"confirm"`
 }
 
-func handleApplyCreate(cfg config.Config) http.HandlerFunc {
+func handleApplyCreate(cfg config.Config, engine *jobs.Engine) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req applyCreateRequest
 		_ = json.NewDecoder(r.Body).Decode(&req)
@@ -36,7 +37,7 @@ func handleApplyCreate(cfg config.Config) http.HandlerFunc {
 		}
 		// Busy check: use a stable create key
 		poolID := "create"
-		if cur := currentPoolTx(poolID); cur != "" {
+		if cur := currentPoolTx(engine, poolID); cur != "" {
 			httpx.WriteError(w, http.StatusConflict, `{"error":{"code":"pool.busy","txId":"`+cur+`"}}`)
 			return
 		}
@@ -45,13 +46,12 @@ func handleApplyCreate(cfg config.Config) http.HandlerFunc {
 		for _, st := range req.Plan.Steps {
 			tx.Steps = append(tx.Steps, pools.TxStep{ID: st.ID, Name: st.Description, Cmd: st.Command, Destructive: st.Destructive, Status: "pending"})
 		}
-		_ = saveTx(tx)
-		if !tryAcquirePoolLock(poolID, tx.ID) {
-			httpx.WriteError(w, http.StatusConflict, `{"error":{"code":"pool.busy","txId":"`+currentPoolTx(poolID)+`"}}`)
+		if !claimPool(engine, poolID, tx) {
+			httpx.WriteError(w, http.StatusConflict, `{"error":{"code":"pool.busy","txId":"`+currentPoolTx(engine, poolID)+`"}}`)
 			return
 		}
 		// Execute asynchronously
-		go executePlan(tx.ID, req, cfg)
+		go executePlan(engine, tx.ID, req, cfg)
 		writeJSON(w, map[string]any{"ok": true, "tx_id": tx.ID})
 	}
 }
@@ -72,16 +72,24 @@ var agentStepRunner = func(cmd string, args []string) (code int, stdout string)
 	return resp.Results[0].Code, resp.Results[0].Stdout
 }
 
-func executePlan(txID string, req applyCreateRequest, cfg config.Config) {
-	// load current tx
-	var tx pools.Tx
-	_, _ = fsatomic.LoadJSON(txPath(txID), &tx)
+func executePlan(engine *jobs.Engine, txID string, req applyCreateRequest, cfg config.Config) {
+	// load current tx; canceling its job stops before the next step
+	tx, _ := loadPoolTx(engine, txID)
+	ctx := engine.Context(txID)
 	for i, st := range tx.Steps {
+		if ctx.Err() != nil {
+			done := time.Now().UTC()
+			tx.Error = "canceled"
+			tx.FinishedAt = &done
+			_ = saveTx(engine, tx)
+			appendTxLog(engine, tx.ID, "warn", st.ID, "canceled before this step")
+			return
+		}
 		now := time.Now().UTC()
 		tx.Steps[i].Status = "running"
 		tx.Steps[i].StartedAt = &now
-		_ = saveTx(tx)
-		appendTxLog(tx.ID, "info", st.ID, "starting")
+		_ = saveTx(engine, tx)
+		appendTxLog(engine, tx.ID, "info", st.ID, "starting")
 		parts := strings.Fields(st.Cmd)
 		code, out := agentStepRunner(parts[0], parts[1:])
 		if code != 0 {
@@ -90,8 +98,9 @@ func executePlan(txID string, req applyCreateRequest, cfg config.Config) {
 			done := time.Now().UTC()
 			tx.Steps[i].Status = "error"
 			tx.Steps[i].FinishedAt = &done
-			_ = saveTx(tx)
-			appendTxLog(tx.ID, "error", st.ID, tx.Error)
+			tx.FinishedAt = &done
+			_ = saveTx(engine, tx)
+			appendTxLog(engine, tx.ID, "error", st.ID, tx.Error)
 			// rollback fstab edits if any
 			client := agentclient.New("/run/nos-agent.sock")
 			for _, ln := range req.Fstab {
@@ -112,8 +121,8 @@ func executePlan(txID string, req applyCreateRequest, cfg config.Config) {
 		done := time.Now().UTC()
 		tx.Steps[i].Status = "ok"
 		tx.Steps[i].FinishedAt = &done
-		_ = saveTx(tx)
-		appendTxLog(tx.ID, "info", st.ID, strings.TrimSpace(out))
+		_ = saveTx(engine, tx)
+		appendTxLog(engine, tx.ID, "info", st.ID, strings.TrimSpace(out))
 	}
 	// Ensure fstab lines
 	client := agentclient.New("/run/nos-agent.sock")
@@ -124,7 +133,7 @@ func executePlan(txID string, req applyCreateRequest, cfg config.Config) {
 	now := time.Now().UTC()
 	tx.OK = true
 	tx.FinishedAt = &now
-	_ = saveTx(tx)
+	_ = saveTx(engine, tx)
 	// Persist pool record (best-effort minimal)
 	type PoolRecord struct {
 		Name, Mount  string
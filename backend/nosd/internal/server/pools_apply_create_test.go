@@ -10,6 +10,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/rs/zerolog"
+
 	"nithronos/backend/nosd/internal/config"
 	"nithronos/backend/nosd/internal/pools"
 )
@@ -49,6 +51,8 @@ func TestExecutePlanWritesTxAndLogs(t *testing.T) {
 	// isolate state directory
 	dir := t.TempDir()
 	t.Setenv("NOS_STATE_DIR", dir)
+	engine := newJobEngine(zerolog.Nop())
+	defer engine.Stop()
 
 	// mock runner: fail the step with command 'echo two'
 	old := agentStepRunner
@@ -62,16 +66,16 @@ func TestExecutePlanWritesTxAndLogs(t *testing.T) {
 
 	txid := "tx-test"
 	tx := pools.Tx{ID: txid, StartedAt: time.Now().UTC(), Steps: []pools.TxStep{{ID: "s1", Name: "one", Cmd: "echo one", Status: "pending"}, {ID: "s2", Name: "two", Cmd: "echo two", Status: "pending"}, {ID: "s3", Name: "three", Cmd: "echo three", Status: "pending"}}}
-	if err := saveTx(tx); err != nil {
+	if err := saveTx(engine, tx); err != nil {
 		t.Fatalf("saveTx: %v", err)
 	}
 
 	// run
-	executePlan(txid, applyCreateRequest{Plan: pools.CreatePlan{Steps: []pools.PlanStep{{ID: "s1", Description: "one", Command: "echo one"}, {ID: "s2", Description: "two", Command: "echo two"}, {ID: "s3", Description: "three", Command: "echo three"}}}}, config.Defaults())
+	executePlan(engine, txid, applyCreateRequest{Plan: pools.CreatePlan{Steps: []pools.PlanStep{{ID: "s1", Description: "one", Command: "echo one"}, {ID: "s2", Description: "two", Command: "echo two"}, {ID: "s3", Description: "three", Command: "echo three"}}}}, config.Defaults())
 
 	// assert tx updated
-	var got pools.Tx
-	if ok, _ := loadTx(txid, &got); !ok {
+	got, ok := loadPoolTx(engine, txid)
+	if !ok {
 		t.Fatalf("tx not found")
 	}
 	if got.OK {
@@ -85,18 +89,8 @@ func TestExecutePlanWritesTxAndLogs(t *testing.T) {
 	}
 
 	// log file has content
-	b, err := os.ReadFile(filepath.Join(dir, "pools", "tx", txid+".log"))
+	b, err := os.ReadFile(filepath.Join(dir, "jobs", txid+".log"))
 	if err != nil || len(b) == 0 {
 		t.Fatalf("log missing or empty: %v", err)
 	}
 }
-
-// helpers
-func loadTx(id string, v any) (bool, error) {
-	path := txPath(id)
-	b, err := os.ReadFile(path)
-	if err != nil {
-		return false, err
-	}
-	return json.Unmarshal(b, v) == nil, nil
-}
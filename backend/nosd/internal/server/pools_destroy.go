@@ -14,6 +14,7 @@ import (
 	"nithronos/backend/nosd/internal/fsatomic"
 	"nithronos/backend/nosd/internal/pools"
 	"nithronos/backend/nosd/pkg/httpx"
+	"nithronos/backend/nosd/pkg/jobs"
 
 	"github.com/go-chi/chi/v5"
 )
@@ -76,7 +77,7 @@ func checkMountClean(mount string) error {
 	return nil
 }
 
-func handleApplyDestroy(cfg config.Config) http.HandlerFunc {
+func handleApplyDestroy(cfg config.Config, engine *jobs.Engine) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		id := chi.URLParam(r, "id")
 		mount := id
@@ -89,7 +90,7 @@ func handleApplyDestroy(cfg config.Config) http.HandlerFunc {
 			httpx.WriteError(w, http.StatusPreconditionRequired, "confirm=DESTROY required")
 			return
 		}
-		if cur := currentPoolTx(mount); cur != "" {
+		if cur := currentPoolTx(engine, mount); cur != "" {
 			httpx.WriteError(w, http.StatusConflict, `{"error":{"code":"pool.busy","txId":"`+cur+`"}}`)
 			return
 		}
@@ -99,9 +100,8 @@ func handleApplyDestroy(cfg config.Config) http.HandlerFunc {
 		}
 		// Create tx and execute cleanup steps
 		tx := pools.Tx{ID: generateUUID(), StartedAt: time.Now().UTC()}
-		_ = saveTx(tx)
-		if !tryAcquirePoolLock(mount, tx.ID) {
-			httpx.WriteError(w, http.StatusConflict, `{"error":{"code":"pool.busy","txId":"`+currentPoolTx(mount)+`"}}`)
+		if !claimPool(engine, mount, tx) {
+			httpx.WriteError(w, http.StatusConflict, `{"error":{"code":"pool.busy","txId":"`+currentPoolTx(engine, mount)+`"}}`)
 			return
 		}
 		// fstab and crypttab paths
@@ -112,11 +112,11 @@ func handleApplyDestroy(cfg config.Config) http.HandlerFunc {
 		// remove crypttab lines heuristically containing mount
 		_ = removeLinesContaining(r.Context(), crypttabPath, mount)
 		// attempt to unmount (best-effort via /proc/self/mounts knowledge not needed)
-		// mark success
+		// mark success; finishing the tx releases the pool
 		now := time.Now().UTC()
 		tx.OK = true
 		tx.FinishedAt = &now
-		_ = saveTx(tx)
+		_ = saveTx(engine, tx)
 		// remove pool from pools.json
 		_ = fsatomic.WithLock(poolsStorePath(cfg), func() error {
 			var st poolOptionsStore
@@ -130,7 +130,6 @@ func handleApplyDestroy(cfg config.Config) http.HandlerFunc {
 			st.Records = out
 			return savePoolOptions(cfg, st)
 		})
-		releasePoolLock(mount)
 		writeJSON(w, map[string]any{"ok": true, "tx_id": tx.ID})
 	}
 }
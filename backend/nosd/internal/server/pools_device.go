@@ -18,6 +18,7 @@ import (
 	btrfsplan "nithronos/backend/nosd/internal/storage/btrfs"
 	"nithronos/backend/nosd/pkg/agentclient"
 	"nithronos/backend/nosd/pkg/httpx"
+	"nithronos/backend/nosd/pkg/jobs"
 )
 
 var agentSocketPath = "/run/nos-agent.sock"
@@ -113,7 +114,7 @@ func handlePlanDevice(cfg config.Config) http.HandlerFunc {
 }
 
 // POST /api/v1/pools/{id}/apply-device
-func handleApplyDevice(cfg config.Config) http.HandlerFunc {
+func handleApplyDevice(cfg config.Config, engine *jobs.Engine) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		id := chi.URLParam(r, "id")
 		if strings.TrimSpace(id) == "" {
@@ -121,7 +122,7 @@ func handleApplyDevice(cfg config.Config) http.HandlerFunc {
 			return
 		}
 		// Pool busy check
-		if cur := currentPoolTx(id); cur != "" {
+		if cur := currentPoolTx(engine, id); cur != "" {
 			httpx.WriteError(w, http.StatusConflict, `{"error":{"code":"pool.busy","txId":"`+cur+`"}}`)
 			return
 		}
@@ -176,10 +177,9 @@ func handleApplyDevice(cfg config.Config) http.HandlerFunc {
 		for _, st := range body.Steps {
 			tx.Steps = append(tx.Steps, pools.TxStep{ID: st.ID, Name: st.Description, Cmd: st.Command, Destructive: strings.Contains(st.Command, " device "), Status: "pending"})
 		}
-		_ = saveTx(tx)
 		// Acquire per-pool lock; if fails, report busy
-		if !tryAcquirePoolLock(id, tx.ID) {
-			httpx.WriteError(w, http.StatusConflict, `{"error":{"code":"pool.busy","txId":"`+currentPoolTx(id)+`"}}`)
+		if !claimPool(engine, id, tx) {
+			httpx.WriteError(w, http.StatusConflict, `{"error":{"code":"pool.busy","txId":"`+currentPoolTx(engine, id)+`"}}`)
 			return
 		}
 		// Metrics + log started
@@ -190,14 +190,23 @@ func handleApplyDevice(cfg config.Config) http.HandlerFunc {
 		// Execute asynchronously
 		go func(txID string) {
 			fn := func() error {
-				var cur pools.Tx
-				_, _ = fsatomic.LoadJSON(txPath(txID), &cur)
+				cur, _ := loadPoolTx(engine, txID)
+				ctx := engine.Context(txID)
 				client := makeAgentClient()
 				for i, st := range cur.Steps {
+					// Canceling the tx's job stops before the next step
+					if ctx.Err() != nil {
+						done := time.Now().UTC()
+						cur.Error = "canceled"
+						cur.FinishedAt = &done
+						_ = saveTx(engine, cur)
+						appendTxLog(engine, cur.ID, "warn", st.ID, "canceled before this step")
+						return nil
+					}
 					now := time.Now().UTC()
 					cur.Steps[i].Status = "running"
 					cur.Steps[i].StartedAt = &now
-					_ = saveTx(cur)
+					_ = saveTx(engine, cur)
 					parts := strings.Fields(st.Cmd)
 					var resp struct {
 						Results []struct {
@@ -222,15 +231,15 @@ func handleApplyDevice(cfg config.Config) http.HandlerFunc {
 						cur.Steps[i].Status = "error"
 						cur.Steps[i].FinishedAt = &done
 						cur.FinishedAt = &done
-						_ = saveTx(cur)
-						appendTxLog(cur.ID, "error", st.ID, out)
+						_ = saveTx(engine, cur)
+						appendTxLog(engine, cur.ID, "error", st.ID, out)
 						return nil
 					}
 					done := time.Now().UTC()
 					cur.Steps[i].Status = "ok"
 					cur.Steps[i].FinishedAt = &done
-					_ = saveTx(cur)
-					appendTxLog(cur.ID, "info", st.ID, out)
+					_ = saveTx(engine, cur)
+					appendTxLog(engine, cur.ID, "info", st.ID, out)
 					// Poll structured status endpoints instead of parsing /v1/run output
 					if mount == "" {
 						mount = strings.TrimSpace(strings.Split(st.Cmd, " ")[len(strings.Split(st.Cmd, " "))-1])
@@ -239,7 +248,7 @@ func handleApplyDevice(cfg config.Config) http.HandlerFunc {
 						if os.Getenv("NOS_TEST_FAST_POLL") == "1" {
 							entry := map[string]any{"event": "balance", "percent": 100}
 							b, _ := json.Marshal(entry)
-							appendTxLog(cur.ID, "info", st.ID, string(b))
+							appendTxLog(engine, cur.ID, "info", st.ID, string(b))
 							setBalancePercent(-1)
 							clearBtrfsBalanceProgress()
 						} else {
@@ -254,7 +263,7 @@ func handleApplyDevice(cfg config.Config) http.HandlerFunc {
 										entry["total"] = *bs.Total
 									}
 									b, _ := json.Marshal(entry)
-									appendTxLog(cur.ID, "info", st.ID, string(b))
+									appendTxLog(engine, cur.ID, "info", st.ID, string(b))
 									setBalancePercent(bs.Percent)
 									setBtrfsBalanceProgress(bs.Percent)
 									if !bs.Running || bs.Percent >= 100 {
@@ -271,7 +280,7 @@ func handleApplyDevice(cfg config.Config) http.HandlerFunc {
 						if os.Getenv("NOS_TEST_FAST_POLL") == "1" {
 							entry := map[string]any{"event": "replace", "percent": 100}
 							b, _ := json.Marshal(entry)
-							appendTxLog(cur.ID, "info", st.ID, string(b))
+							appendTxLog(engine, cur.ID, "info", st.ID, string(b))
 							setReplacePercent(-1)
 						} else {
 							for j := 0; j < 10; j++ {
@@ -285,7 +294,7 @@ func handleApplyDevice(cfg config.Config) http.HandlerFunc {
 										entry["total"] = *rs.Total
 									}
 									b, _ := json.Marshal(entry)
-									appendTxLog(cur.ID, "info", st.ID, string(b))
+									appendTxLog(engine, cur.ID, "info", st.ID, string(b))
 									setReplacePercent(rs.Percent)
 									if !rs.Running || rs.Percent >= 100 {
 										setReplacePercent(-1)
@@ -300,7 +309,7 @@ func handleApplyDevice(cfg config.Config) http.HandlerFunc {
 				cur.OK = true
 				now := time.Now().UTC()
 				cur.FinishedAt = &now
-				_ = saveTx(cur)
+				_ = saveTx(engine, cur)
 				// Post-success: best-effort refresh device list for this pool
 				if mount != "" {
 					devList, _ := disks.Collect(context.TODO())
@@ -335,18 +344,8 @@ func handleApplyDevice(cfg config.Config) http.HandlerFunc {
 			observeBtrfsTxDuration(start)
 			Logger(cfg).Info().Str("event", "pool.device."+action+".finished").Str("txId", tx.ID).Strs("devices", extractDevices(body.Steps)).Msg("")
 		}(tx.ID)
+		// The pool is released when the tx finishes
 		writeJSON(w, map[string]any{"ok": true, "tx_id": tx.ID})
-		// Release lock when tx finishes
-		go func(poolID, txID string) {
-			for {
-				var cur pools.Tx
-				if ok, _ := fsatomic.LoadJSON(txPath(txID), &cur); ok && cur.FinishedAt != nil {
-					break
-				}
-				time.Sleep(500 * time.Millisecond)
-			}
-			releasePoolLock(poolID)
-		}(id, tx.ID)
 	}
 }
 
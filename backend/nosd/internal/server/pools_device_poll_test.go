@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
@@ -11,7 +12,6 @@ import (
 	"time"
 
 	"nithronos/backend/nosd/internal/config"
-	"nithronos/backend/nosd/internal/fsatomic"
 	"nithronos/backend/nosd/internal/pools"
 	"nithronos/backend/nosd/pkg/agentclient"
 )
@@ -97,8 +97,7 @@ func TestApplyDevice_BalanceRunningToDone(t *testing.T) {
 		if time.Now().After(deadline) {
 			t.Fatal("timeout waiting for tx finish")
 		}
-		var cur pools.Tx
-		_, _ = fsatomic.LoadJSON(txPath(txID), &cur)
+		cur := routerTx(r, txID)
 		// Consider done if marked OK or last step is ok (avoid rare FinishedAt race in CI)
 		if cur.OK || (len(cur.Steps) > 0 && cur.Steps[len(cur.Steps)-1].Status == "ok") {
 			break
@@ -107,7 +106,7 @@ func TestApplyDevice_BalanceRunningToDone(t *testing.T) {
 	}
 
 	// tx log exists
-	if _, err := os.Stat(filepath.Join(os.Getenv("NOS_STATE_DIR"), "pools", "tx", txID+".log")); err != nil {
+	if _, err := os.Stat(filepath.Join(os.Getenv("NOS_STATE_DIR"), "jobs", txID+".log")); err != nil {
 		t.Fatalf("missing tx log: %v", err)
 	}
 }
@@ -156,8 +155,7 @@ func TestApplyDevice_StepErrorStops(t *testing.T) {
 		if time.Now().After(deadline) {
 			t.Fatal("timeout waiting for tx error")
 		}
-		var cur pools.Tx
-		_, _ = fsatomic.LoadJSON(txPath(txID), &cur)
+		cur := routerTx(r, txID)
 		// detect any step error to avoid flakiness on index assumptions
 		stepErr := false
 		for _, s := range cur.Steps {
@@ -175,3 +173,13 @@ func TestApplyDevice_StepErrorStops(t *testing.T) {
 		time.Sleep(5 * time.Millisecond)
 	}
 }
+
+// routerTx reads a pool transaction through the API
+func routerTx(r http.Handler, id string) pools.Tx {
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/pools/tx/"+id+"/status", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	var tx pools.Tx
+	_ = json.Unmarshal(w.Body.Bytes(), &tx)
+	return tx
+}
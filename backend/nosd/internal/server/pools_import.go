@@ -14,6 +14,7 @@ import (
 	"nithronos/backend/nosd/internal/fsatomic"
 	"nithronos/backend/nosd/pkg/agentclient"
 	"nithronos/backend/nosd/pkg/httpx"
+	"nithronos/backend/nosd/pkg/jobs"
 )
 
 type discoveredPool struct {
@@ -95,7 +96,7 @@ func parseBtrfsShow(s string) []discoveredPool {
 }
 
 // POST /api/v1/pools/import
-func handlePoolsImport(cfg config.Config) http.HandlerFunc {
+func handlePoolsImport(cfg config.Config, engine *jobs.Engine) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var body struct {
 			UUID         string `json:"uuid"`
@@ -125,7 +126,7 @@ func handlePoolsImport(cfg config.Config) http.HandlerFunc {
 			return
 		}
 		// Busy check: use UUID as pool ID key
-		if cur := currentPoolTx(body.UUID); cur != "" {
+		if cur := currentPoolTx(engine, body.UUID); cur != "" {
 			httpx.WriteError(w, http.StatusConflict, `{"error":{"code":"pool.busy","txId":"`+cur+`"}}`)
 			return
 		}
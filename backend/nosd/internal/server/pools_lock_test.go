@@ -12,9 +12,6 @@ import (
 )
 
 func TestApplyDevice_ParallelOneBusy(t *testing.T) {
-	// Ensure no prior lock
-	releasePoolLock("p1")
-
 	r := NewRouter(config.FromEnv())
 	body := map[string]any{
 		"steps":   []map[string]string{{"id": "s1", "description": "add", "command": "btrfs device add /dev/sdb /mnt/p1"}},
@@ -6,30 +6,33 @@ import (
 
 	"nithronos/backend/nosd/pkg/agentclient"
 	"nithronos/backend/nosd/pkg/httpx"
+	"nithronos/backend/nosd/pkg/jobs"
 )
 
 // POST /api/v1/pools/scrub/start { mount }
-func handleScrubStart(w http.ResponseWriter, r *http.Request) {
-	var body struct {
-		Mount string `json:"mount"`
+func handleScrubStart(engine *jobs.Engine) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Mount string `json:"mount"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		if body.Mount == "" {
+			httpx.WriteError(w, http.StatusBadRequest, "mount required")
+			return
+		}
+		// Busy: use mount as lock key
+		if cur := currentPoolTx(engine, body.Mount); cur != "" {
+			httpx.WriteError(w, http.StatusConflict, `{"error":{"code":"pool.busy","txId":"`+cur+`"}}`)
+			return
+		}
+		client := agentclient.New("/run/nos-agent.sock")
+		var out map[string]any
+		if err := client.PostJSON(r.Context(), "/v1/btrfs/scrub/start", body, &out); err != nil {
+			httpx.WriteError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, out)
 	}
-	_ = json.NewDecoder(r.Body).Decode(&body)
-	if body.Mount == "" {
-		httpx.WriteError(w, http.StatusBadRequest, "mount required")
-		return
-	}
-	// Busy: use mount as lock key
-	if cur := currentPoolTx(body.Mount); cur != "" {
-		httpx.WriteError(w, http.StatusConflict, `{"error":{"code":"pool.busy","txId":"`+cur+`"}}`)
-		return
-	}
-	client := agentclient.New("/run/nos-agent.sock")
-	var out map[string]any
-	if err := client.PostJSON(r.Context(), "/v1/btrfs/scrub/start", body, &out); err != nil {
-		httpx.WriteError(w, http.StatusInternalServerError, err.Error())
-		return
-	}
-	writeJSON(w, out)
 }
 
 // GET /api/v1/pools/scrub/status?mount=...
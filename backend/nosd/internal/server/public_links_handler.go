@@ -0,0 +1,577 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog"
+
+	"nithronos/backend/nosd/internal/config"
+	"nithronos/backend/nosd/internal/ratelimit"
+	"nithronos/backend/nosd/internal/shares"
+	"nithronos/backend/nosd/pkg/auth"
+	"nithronos/backend/nosd/pkg/httpx"
+	nosync "nithronos/backend/nosd/pkg/sync"
+)
+
+const (
+	// cookieShareLink holds the grant of an unlocked password link
+	cookieShareLink = "nos_link"
+	// maxFileDropSize bounds a file drop request on shares without a size limit
+	maxFileDropSize = 10 << 30
+	// maxFileDropFiles bounds the files of one file drop request
+	maxFileDropFiles = 100
+	// Password attempts per visitor and link
+	linkPasswordAttempts = 10
+	linkPasswordWindow   = 15 * time.Minute
+)
+
+// PublicLinkHandler serves public share links at /s/{token} to visitors
+// without an account. Every request is rate limited per address and
+// recorded in the audit log.
+type PublicLinkHandler struct {
+	links      *nosync.ShareLinkStore
+	shareStore *shares.Store
+	webdav     *WebDAVHandler
+	audit      *auth.AuditLogger
+	limiter    *ratelimit.Store
+	cfg        config.Config
+	logger     zerolog.Logger
+}
+
+// NewPublicLinkHandler creates the public share link handler. Files are
+// read and written through the WebDAV view of shares, so links work on
+// shares encrypted at rest and drops are journaled and synced.
+func NewPublicLinkHandler(cfg config.Config, syncHandler *SyncHandler, webdav *WebDAVHandler, limiter *ratelimit.Store, logger zerolog.Logger) *PublicLinkHandler {
+	return &PublicLinkHandler{
+		links:      syncHandler.links,
+		shareStore: syncHandler.shareStore,
+		webdav:     webdav,
+		audit:      syncHandler.audit,
+		limiter:    limiter,
+		cfg:        cfg,
+		logger:     logger.With().Str("component", "sharelinks").Logger(),
+	}
+}
+
+// Routes returns the chi router for public share link endpoints
+func (h *PublicLinkHandler) Routes() chi.Router {
+	r := chi.NewRouter()
+	r.Use(publicLinkHeaders)
+
+	r.Get("/{token}", h.Info)
+	r.Post("/{token}/unlock", h.Unlock)
+	r.Get("/{token}/files", h.ListFiles)
+	r.Get("/{token}/download", h.Download)
+	r.Post("/{token}/upload", h.Upload)
+
+	return r
+}
+
+// publicLinkHeaders keeps link responses out of caches, search engines and
+// referrers
+func publicLinkHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// linkRequest is a visitor request on a resolved link
+type linkRequest struct {
+	link  *nosync.ShareLink
+	share shares.Share
+	ip    string
+}
+
+// denied records a refused request and writes the error
+func (h *PublicLinkHandler) denied(w http.ResponseWriter, r *http.Request, ip string, link *nosync.ShareLink, status int, code, msg, reason string, retryAfter int) {
+	auditLink(h.audit, r, ip, "", link, auth.AuditShareLinkDenied, false, msg, map[string]interface{}{
+		"reason": reason,
+		"route":  chi.RouteContext(r.Context()).RoutePattern(),
+	})
+	httpx.WriteTypedError(w, status, code, msg, retryAfter)
+}
+
+// resolve rate limits the visitor and looks up the link in the URL. Unless
+// open is set, password links must have been unlocked.
+func (h *PublicLinkHandler) resolve(w http.ResponseWriter, r *http.Request, open bool) (*linkRequest, bool) {
+	ip := clientIP(r, h.cfg)
+	link, err := h.links.Resolve(chi.URLParam(r, "token"))
+
+	if ok, _, reset := h.limiter.Allow("sharelink:ip:"+ip, h.cfg.RateShareLinkPerMin, time.Minute); !ok {
+		h.denied(w, r, ip, link, http.StatusTooManyRequests, "rate.limited", "Too many requests. Try later.", "rate_limited", int(time.Until(reset).Seconds()))
+		return nil, false
+	}
+	switch {
+	case errors.Is(err, nosync.ErrLinkNotFound):
+		h.denied(w, r, ip, nil, http.StatusNotFound, "sharelink.not_found", "Link not found", "not_found", 0)
+		return nil, false
+	case errors.Is(err, nosync.ErrLinkExpired):
+		h.denied(w, r, ip, link, http.StatusGone, "sharelink.expired", "This link has expired", "expired", 0)
+		return nil, false
+	case errors.Is(err, nosync.ErrLinkExhausted):
+		h.denied(w, r, ip, link, http.StatusGone, "sharelink.exhausted", "This link has reached its download limit", "exhausted", 0)
+		return nil, false
+	case err != nil:
+		httpx.WriteTypedError(w, http.StatusInternalServerError, "sharelink.failed", err.Error(), 0)
+		return nil, false
+	}
+
+	share, ok := h.shareStore.GetByID(link.ShareID)
+	if !ok || share.E2E {
+		h.denied(w, r, ip, link, http.StatusNotFound, "sharelink.not_found", "Link not found", "share_unavailable", 0)
+		return nil, false
+	}
+	if !open && !h.unlocked(w, r, ip, link) {
+		return nil, false
+	}
+	return &linkRequest{link: link, share: share, ip: ip}, true
+}
+
+// unlocked checks the visitor's grant cookie, or a password sent in the
+// X-Link-Password header by scripted clients
+func (h *PublicLinkHandler) unlocked(w http.ResponseWriter, r *http.Request, ip string, link *nosync.ShareLink) bool {
+	if !link.HasPassword {
+		return true
+	}
+	if c, err := r.Cookie(cookieShareLink); err == nil && h.links.Unlocked(link.ID, c.Value) {
+		return true
+	}
+	if pw := r.Header.Get("X-Link-Password"); pw != "" {
+		_, ok := h.checkPassword(w, r, ip, link, pw)
+		return ok
+	}
+	h.denied(w, r, ip, link, http.StatusUnauthorized, "sharelink.password_required", "This link is password protected", "password_required", 0)
+	return false
+}
+
+// checkPassword unlocks a link, limiting guesses per visitor and link
+func (h *PublicLinkHandler) checkPassword(w http.ResponseWriter, r *http.Request, ip string, link *nosync.ShareLink, password string) (string, bool) {
+	if ok, _, reset := h.limiter.Allow("sharelink:pw:"+ip+":"+link.ID, linkPasswordAttempts, linkPasswordWindow); !ok {
+		h.denied(w, r, ip, link, http.StatusTooManyRequests, "rate.limited", "Too many attempts. Try later.", "password_rate_limited", int(time.Until(reset).Seconds()))
+		return "", false
+	}
+	grant, err := h.links.Unlock(link.ID, password)
+	if err != nil {
+		h.denied(w, r, ip, link, http.StatusUnauthorized, "sharelink.password_invalid", "Wrong password", "password_invalid", 0)
+		return "", false
+	}
+	auditLink(h.audit, r, ip, "", link, auth.AuditShareLinkUnlock, true, "Share link unlocked", nil)
+	return grant, true
+}
+
+// target resolves a path below the link to a share-relative path. File
+// links only reach their file.
+func (lr *linkRequest) target(p string) (string, bool) {
+	sub := strings.TrimPrefix(path.Clean("/"+p), "/")
+	if sub == "" {
+		return lr.link.Path, true
+	}
+	if !lr.link.IsDir {
+		return "", false
+	}
+	for _, part := range strings.Split(sub, "/") {
+		if strings.HasPrefix(part, ".nos-") {
+			return "", false
+		}
+	}
+	return path.Join(lr.link.Path, sub), true
+}
+
+// name is what visitors see the link as
+func (lr *linkRequest) name() string {
+	if lr.link.Path == "" {
+		return lr.share.Name
+	}
+	return path.Base(lr.link.Path)
+}
+
+// writeFileError maps share file system errors to responses
+func (h *PublicLinkHandler) writeFileError(w http.ResponseWriter, err error) {
+	switch {
+	case os.IsNotExist(err):
+		httpx.WriteTypedError(w, http.StatusNotFound, "sharelink.path_not_found", "File not found", 0)
+	case errors.Is(err, errEncryptionLocked):
+		httpx.WriteTypedError(w, http.StatusServiceUnavailable, "sync.encryption_locked", "This link is not available right now", 0)
+	default:
+		h.logger.Error().Err(err).Msg("Share link file access failed")
+		httpx.WriteTypedError(w, http.StatusInternalServerError, "sharelink.failed", "File access failed", 0)
+	}
+}
+
+// Info handles GET /s/{token}
+func (h *PublicLinkHandler) Info(w http.ResponseWriter, r *http.Request) {
+	lr, ok := h.resolve(w, r, true)
+	if !ok {
+		return
+	}
+	h.links.Touch(lr.link.ID)
+	auditLink(h.audit, r, lr.ip, "", lr.link, auth.AuditShareLinkView, true, "Share link viewed", nil)
+
+	resp := map[string]interface{}{
+		"name":         lr.name(),
+		"is_dir":       lr.link.IsDir,
+		"file_drop":    lr.link.FileDrop,
+		"has_password": lr.link.HasPassword,
+		"expires_at":   lr.link.ExpiresAt,
+	}
+	if lr.link.MaxDownloads > 0 {
+		resp["downloads_left"] = lr.link.MaxDownloads - lr.link.Downloads
+	}
+	writeJSON(w, resp)
+}
+
+// Unlock handles POST /s/{token}/unlock
+func (h *PublicLinkHandler) Unlock(w http.ResponseWriter, r *http.Request) {
+	lr, ok := h.resolve(w, r, true)
+	if !ok {
+		return
+	}
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req); err != nil || req.Password == "" {
+		httpx.WriteTypedError(w, http.StatusBadRequest, "input.invalid", "Password is required", 0)
+		return
+	}
+	if !lr.link.HasPassword {
+		writeJSON(w, map[string]bool{"unlocked": true})
+		return
+	}
+	grant, ok := h.checkPassword(w, r, lr.ip, lr.link, req.Password)
+	if !ok {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     cookieShareLink,
+		Value:    grant,
+		Path:     "/s/" + lr.link.Token,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(nosync.ShareLinkGrantTTL.Seconds()),
+	})
+	writeJSON(w, map[string]bool{"unlocked": true})
+}
+
+// linkEntry is a file or folder in a shared folder
+type linkEntry struct {
+	Name    string    `json:"name"`
+	Path    string    `json:"path"` // relative to the link
+	IsDir   bool      `json:"is_dir"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// ListFiles handles GET /s/{token}/files
+func (h *PublicLinkHandler) ListFiles(w http.ResponseWriter, r *http.Request) {
+	lr, ok := h.resolve(w, r, false)
+	if !ok {
+		return
+	}
+	if !lr.link.IsDir || lr.link.FileDrop {
+		h.denied(w, r, lr.ip, lr.link, http.StatusForbidden, "sharelink.forbidden", "This link does not allow browsing", "not_browsable", 0)
+		return
+	}
+	sub := strings.TrimPrefix(path.Clean("/"+r.URL.Query().Get("path")), "/")
+	relPath, ok := lr.target(sub)
+	if !ok {
+		h.denied(w, r, lr.ip, lr.link, http.StatusNotFound, "sharelink.path_not_found", "File not found", "outside_link", 0)
+		return
+	}
+
+	f, err := h.webdav.fileSystem(lr.share).OpenFile(r.Context(), "/"+relPath, os.O_RDONLY, 0)
+	if err != nil {
+		h.writeFileError(w, err)
+		return
+	}
+	defer f.Close()
+	infos, err := f.Readdir(-1)
+	if err != nil {
+		httpx.WriteTypedError(w, http.StatusBadRequest, "sharelink.not_dir", "Not a folder", 0)
+		return
+	}
+
+	entries := make([]linkEntry, 0, len(infos))
+	for _, fi := range infos {
+		if strings.HasPrefix(fi.Name(), ".nos-") || !(fi.IsDir() || fi.Mode().IsRegular()) {
+			continue
+		}
+		entries = append(entries, linkEntry{
+			Name:    fi.Name(),
+			Path:    path.Join(sub, fi.Name()),
+			IsDir:   fi.IsDir(),
+			Size:    fi.Size(),
+			ModTime: fi.ModTime(),
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].IsDir != entries[j].IsDir {
+			return entries[i].IsDir
+		}
+		return strings.ToLower(entries[i].Name) < strings.ToLower(entries[j].Name)
+	})
+
+	h.links.Touch(lr.link.ID)
+	auditLink(h.audit, r, lr.ip, "", lr.link, auth.AuditShareLinkView, true, "Share link folder listed", map[string]interface{}{"path": sub})
+	writeJSON(w, map[string]interface{}{
+		"path":    sub,
+		"entries": entries,
+		"count":   len(entries),
+	})
+}
+
+// Download handles GET /s/{token}/download. Only requests that receive
+// the end of the file count against the download limit, so a download
+// resumed in pieces is counted once.
+func (h *PublicLinkHandler) Download(w http.ResponseWriter, r *http.Request) {
+	lr, ok := h.resolve(w, r, false)
+	if !ok {
+		return
+	}
+	if lr.link.FileDrop {
+		h.denied(w, r, lr.ip, lr.link, http.StatusForbidden, "sharelink.forbidden", "This link only accepts uploads", "upload_only", 0)
+		return
+	}
+	sub := r.URL.Query().Get("path")
+	relPath, ok := lr.target(sub)
+	if !ok {
+		h.denied(w, r, lr.ip, lr.link, http.StatusNotFound, "sharelink.path_not_found", "File not found", "outside_link", 0)
+		return
+	}
+
+	f, err := h.webdav.fileSystem(lr.share).OpenFile(r.Context(), "/"+relPath, os.O_RDONLY, 0)
+	if err != nil {
+		h.writeFileError(w, err)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		h.writeFileError(w, err)
+		return
+	}
+	if !info.Mode().IsRegular() {
+		httpx.WriteTypedError(w, http.StatusBadRequest, "sharelink.is_dir", "Folders cannot be downloaded", 0)
+		return
+	}
+
+	rng := r.Header.Get("Range")
+	counted := downloadCounted(r, info.Size())
+	if counted {
+		if _, err := h.links.CountDownload(lr.link.ID); err != nil {
+			if errors.Is(err, nosync.ErrLinkExhausted) || errors.Is(err, nosync.ErrLinkExpired) {
+				h.denied(w, r, lr.ip, lr.link, http.StatusGone, "sharelink.exhausted", "This link has reached its download limit", "exhausted", 0)
+				return
+			}
+			h.writeFileError(w, err)
+			return
+		}
+	} else {
+		h.links.Touch(lr.link.ID)
+	}
+	auditLink(h.audit, r, lr.ip, "", lr.link, auth.AuditShareLinkDownload, true, "Share link file downloaded", map[string]interface{}{
+		"path":    relPath,
+		"size":    info.Size(),
+		"range":   rng,
+		"counted": counted,
+	})
+
+	// Shared content must not run as part of this origin
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(relPath)}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	http.ServeContent(w, r, path.Base(relPath), info.ModTime(), f)
+}
+
+// downloadCounted reports whether a download receives the last byte of a
+// file of the given size. Requests http.ServeContent answers with the
+// whole file, such as those with If-Range or overlapping ranges, and
+// ranges it can't parse always count.
+func downloadCounted(r *http.Request, size int64) bool {
+	rng := r.Header.Get("Range")
+	if rng == "" || r.Header.Get("If-Range") != "" || size == 0 {
+		return true
+	}
+	specs, ok := strings.CutPrefix(rng, "bytes=")
+	if !ok {
+		return true
+	}
+	var total int64
+	end := false
+	for _, spec := range strings.Split(specs, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		first, last, ok := strings.Cut(spec, "-")
+		if !ok {
+			return true
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+		start, stop := int64(0), size-1
+		if first == "" {
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return true
+			}
+			start = size - min(n, size)
+		} else {
+			n, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || n < 0 {
+				return true
+			}
+			if n >= size {
+				continue // unsatisfiable, not served
+			}
+			start = n
+			if last != "" {
+				e, err := strconv.ParseInt(last, 10, 64)
+				if err != nil || e < n {
+					return true
+				}
+				stop = min(e, size-1)
+			}
+		}
+		end = end || stop == size-1
+		total += stop - start + 1
+	}
+	return end || total > size
+}
+
+// Upload handles POST /s/{token}/upload for file drop links. Files keep
+// their names where possible; existing files are never replaced.
+func (h *PublicLinkHandler) Upload(w http.ResponseWriter, r *http.Request) {
+	lr, ok := h.resolve(w, r, false)
+	if !ok {
+		return
+	}
+	if !lr.link.FileDrop || lr.share.RO {
+		h.denied(w, r, lr.ip, lr.link, http.StatusForbidden, "sharelink.forbidden", "This link does not accept uploads", "not_file_drop", 0)
+		return
+	}
+	limit := int64(maxFileDropSize)
+	if lr.share.SyncMaxSize > 0 && lr.share.SyncMaxSize < limit {
+		limit = lr.share.SyncMaxSize
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		httpx.WriteTypedError(w, http.StatusBadRequest, "input.invalid", "Expected a multipart upload", 0)
+		return
+	}
+
+	sfs := h.webdav.fileSystem(lr.share)
+	type dropped struct {
+		Name string `json:"name"`
+		Size int64  `json:"size"`
+	}
+	files := []dropped{}
+	for len(files) < maxFileDropFiles {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			h.writeUploadError(w, err)
+			return
+		}
+		if part.FileName() == "" {
+			part.Close()
+			continue
+		}
+		name, ok := dropName(part.FileName())
+		if !ok {
+			part.Close()
+			httpx.WriteTypedError(w, http.StatusBadRequest, "input.invalid", "Invalid file name", 0)
+			return
+		}
+
+		relPath, f, err := h.createDropFile(r, sfs, lr.link.Path, name)
+		if err != nil {
+			part.Close()
+			h.writeFileError(w, err)
+			return
+		}
+		size, err := io.Copy(f, part)
+		part.Close()
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			// Drop the partial file; nothing else was replaced
+			_ = sfs.discard(r.Context(), "/"+relPath)
+			h.writeUploadError(w, err)
+			return
+		}
+
+		h.links.CountUpload(lr.link.ID)
+		auditLink(h.audit, r, lr.ip, "", lr.link, auth.AuditShareLinkUpload, true, "File dropped through share link", map[string]interface{}{
+			"path": relPath,
+			"size": size,
+		})
+		files = append(files, dropped{Name: path.Base(relPath), Size: size})
+	}
+	if len(files) == 0 {
+		httpx.WriteTypedError(w, http.StatusBadRequest, "input.invalid", "No files in upload", 0)
+		return
+	}
+	respondJSON(w, http.StatusCreated, map[string]interface{}{
+		"files": files,
+		"count": len(files),
+	})
+}
+
+// createDropFile creates a new file for a drop, numbering the name if a
+// file of that name exists
+func (h *PublicLinkHandler) createDropFile(r *http.Request, sfs *shareFileSystem, dir, name string) (string, io.WriteCloser, error) {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 0; i < 100; i++ {
+		candidate := name
+		if i > 0 {
+			candidate = fmt.Sprintf("%s (%d)%s", base, i, ext)
+		}
+		relPath := path.Join(dir, candidate)
+		f, err := sfs.OpenFile(r.Context(), "/"+relPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if os.IsExist(err) {
+			continue
+		}
+		return relPath, f, err
+	}
+	return "", nil, os.ErrExist
+}
+
+// writeUploadError maps errors reading a file drop to responses
+func (h *PublicLinkHandler) writeUploadError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		httpx.WriteTypedError(w, http.StatusRequestEntityTooLarge, "sharelink.too_large", "Upload is too large", 0)
+		return
+	}
+	h.writeFileError(w, err)
+}
+
+// dropName returns the plain name of an uploaded file. Hidden names are
+// refused so drops cannot plant dotfiles or server staging files.
+func dropName(fileName string) (string, bool) {
+	name := path.Base(strings.ReplaceAll(fileName, "\\", "/"))
+	if name == "" || name == "." || name == "/" || strings.HasPrefix(name, ".") || len(name) > 255 {
+		return "", false
+	}
+	return name, true
+}
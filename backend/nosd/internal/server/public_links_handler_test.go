@@ -0,0 +1,174 @@
+package server
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+
+	"nithronos/backend/nosd/internal/config"
+	"nithronos/backend/nosd/internal/ratelimit"
+	"nithronos/backend/nosd/internal/shares"
+	nosync "nithronos/backend/nosd/pkg/sync"
+)
+
+func TestDownloadCounted(t *testing.T) {
+	for _, tc := range []struct {
+		rng, ifRange string
+		counted      bool
+	}{
+		{"", "", true},
+		{"bytes=0-", "", true},
+		{"bytes=0-98", "", false},
+		{"bytes=0-99", "", true},
+		{"bytes=50-", "", true},
+		{"bytes=50-99", "", true},
+		{"bytes=50-500", "", true},
+		{"bytes=-10", "", true},
+		{"bytes=0-49,50-98", "", false},
+		{"bytes=0-98,0-98", "", true}, // overlapping: ServeContent sends it all
+		{"bytes=100-", "", false},     // unsatisfiable
+		{"bytes=0-9", "Mon, 02 Jan 2006 15:04:05 GMT", true},
+		{"bytes=x-y", "", true},
+		{"items=0-9", "", true},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tc.rng != "" {
+			req.Header.Set("Range", tc.rng)
+		}
+		if tc.ifRange != "" {
+			req.Header.Set("If-Range", tc.ifRange)
+		}
+		if got := downloadCounted(req, 100); got != tc.counted {
+			t.Errorf("Range %q If-Range %q: counted %v", tc.rng, tc.ifRange, got)
+		}
+	}
+}
+
+func TestPublicShareLinks(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "share")
+	if err := os.MkdirAll(filepath.Join(base, "inbox"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(base, "report.txt"), []byte("quarterly numbers"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	store := shares.NewStore(filepath.Join(dir, "shares.json"))
+	if err := store.Add(shares.Share{ID: "s1", Name: "docs", Path: base}); err != nil {
+		t.Fatal(err)
+	}
+	links, err := nosync.NewShareLinkStore(filepath.Join(dir, "links"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	webdav := NewWebDAVHandler(store, nil, nil, zerolog.Nop())
+	cfg := config.Defaults()
+	cfg.RateShareLinkPerMin = 100
+	h := &PublicLinkHandler{
+		links:      links,
+		shareStore: store,
+		webdav:     webdav,
+		limiter:    ratelimit.New(filepath.Join(dir, "ratelimit.json")),
+		cfg:        cfg,
+		logger:     zerolog.Nop(),
+	}
+	router := h.Routes()
+	do := func(req *http.Request) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// A password protected file link that allows one download
+	file, err := links.Create(nosync.ShareLink{ShareID: "s1", Path: "report.txt", MaxDownloads: 1}, "open sesame")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := do(httptest.NewRequest(http.MethodGet, "/"+file.Token+"/download", nil)); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("locked download = %d", rec.Code)
+	}
+	rec := do(httptest.NewRequest(http.MethodPost, "/"+file.Token+"/unlock", strings.NewReader(`{"password":"open sesame"}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unlock = %d: %s", rec.Code, rec.Body.String())
+	}
+	cookie := rec.Result().Cookies()[0]
+
+	req := httptest.NewRequest(http.MethodGet, "/"+file.Token+"/download", nil)
+	req.AddCookie(cookie)
+	rec = do(req)
+	if rec.Code != http.StatusOK || rec.Body.String() != "quarterly numbers" {
+		t.Fatalf("download = %d: %q", rec.Code, rec.Body.String())
+	}
+	if !strings.HasPrefix(rec.Header().Get("Content-Disposition"), "attachment") {
+		t.Errorf("download is not an attachment: %q", rec.Header().Get("Content-Disposition"))
+	}
+	req = httptest.NewRequest(http.MethodGet, "/"+file.Token+"/download", nil)
+	req.AddCookie(cookie)
+	if rec := do(req); rec.Code != http.StatusGone {
+		t.Fatalf("download past the limit = %d", rec.Code)
+	}
+
+	// A download resumed in pieces counts once, when it gets the last byte
+	ranged, err := links.Create(nosync.ShareLink{ShareID: "s1", Path: "report.txt", MaxDownloads: 1}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range []struct {
+		rng  string
+		code int
+	}{
+		{"bytes=0-8", http.StatusPartialContent},
+		{"bytes=0-8", http.StatusPartialContent},
+		{"bytes=9-", http.StatusPartialContent},
+		{"bytes=9-", http.StatusGone},
+		{"bytes=-1", http.StatusGone},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/"+ranged.Token+"/download", nil)
+		req.Header.Set("Range", step.rng)
+		if rec := do(req); rec.Code != step.code {
+			t.Fatalf("%s = %d, want %d", step.rng, rec.Code, step.code)
+		}
+	}
+
+	// A file drop accepts files without revealing the folder
+	drop, err := links.Create(nosync.ShareLink{ShareID: "s1", Path: "inbox", IsDir: true, FileDrop: true}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload := func(name string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, _ := mw.CreateFormFile("file", name)
+		fw.Write([]byte("dropped " + name))
+		mw.Close()
+		req := httptest.NewRequest(http.MethodPost, "/"+drop.Token+"/upload", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		return do(req)
+	}
+	for i := 0; i < 2; i++ {
+		if rec := upload("scan.pdf"); rec.Code != http.StatusCreated {
+			t.Fatalf("upload = %d: %s", rec.Code, rec.Body.String())
+		}
+	}
+	for _, name := range []string{"scan.pdf", "scan (1).pdf"} {
+		if _, err := os.Stat(filepath.Join(base, "inbox", name)); err != nil {
+			t.Errorf("dropped file %s: %v", name, err)
+		}
+	}
+	if rec := upload("../.bashrc"); rec.Code != http.StatusBadRequest {
+		t.Errorf("hidden file upload = %d", rec.Code)
+	}
+	if rec := do(httptest.NewRequest(http.MethodGet, "/"+drop.Token+"/files", nil)); rec.Code != http.StatusForbidden {
+		t.Errorf("file drop listing = %d", rec.Code)
+	}
+	if rec := do(httptest.NewRequest(http.MethodGet, "/not-a-token", nil)); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown token = %d", rec.Code)
+	}
+}
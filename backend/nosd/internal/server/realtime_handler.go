@@ -3,33 +3,61 @@ package server
 import (
 	"encoding/json"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
 	"github.com/rs/zerolog"
 
 	"nithronos/backend/nosd/pkg/sync/realtime"
 )
 
+// shareNotifyDelay coalesces bursts of journal writes into one notification
+const shareNotifyDelay = 250 * time.Millisecond
+
 // RealtimeHandler handles real-time WebSocket connections
 type RealtimeHandler struct {
-	connMgr *realtime.ConnectionManager
-	logger  zerolog.Logger
+	connMgr    *realtime.ConnectionManager
+	logger     zerolog.Logger
+	deviceAuth func(http.Handler) http.Handler
+
+	notifyMu      sync.Mutex
+	pendingNotify map[string]string // share ID -> latest cursor
 }
 
 // NewRealtimeHandler creates a new realtime handler
 func NewRealtimeHandler(logger zerolog.Logger) *RealtimeHandler {
 	return &RealtimeHandler{
-		connMgr: realtime.NewConnectionManager(logger),
-		logger:  logger.With().Str("component", "realtime-handler").Logger(),
+		connMgr:       realtime.NewConnectionManager(logger),
+		logger:        logger.With().Str("component", "realtime-handler").Logger(),
+		pendingNotify: make(map[string]string),
 	}
 }
 
+// UseDeviceAuth authenticates WebSocket connections with sync device tokens
+// and only lets devices subscribe to share channels they can access.
+func (h *RealtimeHandler) UseDeviceAuth(mw func(http.Handler) http.Handler, canAccessShare func(userID, shareID string) bool) {
+	h.deviceAuth = mw
+	h.connMgr.GetHandler().SetChannelAuthorizer(func(client *realtime.Client, channel string) bool {
+		if shareID, ok := strings.CutPrefix(channel, "share:"); ok {
+			return canAccessShare(client.UserID, shareID)
+		}
+		return true
+	})
+}
+
 // Routes returns the chi router for realtime endpoints
 func (h *RealtimeHandler) Routes() chi.Router {
 	r := chi.NewRouter()
 
 	// WebSocket endpoint
-	r.Get("/ws", h.HandleWebSocket)
+	if h.deviceAuth != nil {
+		r.With(h.deviceAuth).Get("/ws", h.HandleWebSocket)
+	} else {
+		r.Get("/ws", h.HandleWebSocket)
+	}
 
 	// REST endpoints for realtime info
 	r.Get("/stats", h.GetStats)
@@ -84,7 +112,7 @@ func (h *RealtimeHandler) GetFileLocks(w http.ResponseWriter, r *http.Request) {
 
 // NotifyFileChange sends a file change notification to subscribers
 func (h *RealtimeHandler) NotifyFileChange(shareID, path string, changeType string, payload interface{}) {
-	channel := "share:" + shareID
+	channel := realtime.ShareChannel(shareID)
 
 	payloadBytes, _ := json.Marshal(map[string]interface{}{
 		"share_id":    shareID,
@@ -102,6 +130,34 @@ func (h *RealtimeHandler) NotifyFileChange(shareID, path string, changeType stri
 	h.connMgr.GetHub().Broadcast(msg)
 }
 
+// NotifyShareChanged announces a new journal cursor on the share's channel so
+// sync clients can fetch changes immediately instead of waiting for a poll.
+func (h *RealtimeHandler) NotifyShareChanged(shareID, cursor string) {
+	h.notifyMu.Lock()
+	defer h.notifyMu.Unlock()
+
+	_, scheduled := h.pendingNotify[shareID]
+	h.pendingNotify[shareID] = cursor
+	if scheduled {
+		return
+	}
+	time.AfterFunc(shareNotifyDelay, func() {
+		h.notifyMu.Lock()
+		cursor := h.pendingNotify[shareID]
+		delete(h.pendingNotify, shareID)
+		h.notifyMu.Unlock()
+
+		payload, _ := json.Marshal(realtime.ShareChangedPayload{ShareID: shareID, Cursor: cursor})
+		h.connMgr.GetHub().Broadcast(&realtime.Message{
+			ID:        uuid.New().String(),
+			Type:      realtime.MsgTypeShareChanged,
+			Channel:   realtime.ShareChannel(shareID),
+			Timestamp: time.Now(),
+			Payload:   payload,
+		})
+	})
+}
+
 // Shutdown gracefully shuts down the realtime handler
 func (h *RealtimeHandler) Shutdown() {
 	h.connMgr.GetHub().Stop()
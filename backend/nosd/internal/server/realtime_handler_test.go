@@ -0,0 +1,59 @@
+package server
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"nithronos/backend/nosd/pkg/sync/realtime"
+)
+
+func TestNotifyShareChangedCoalesces(t *testing.T) {
+	h := NewRealtimeHandler(zerolog.Nop())
+	defer h.Shutdown()
+	hub := h.connMgr.GetHub()
+
+	client := &realtime.Client{
+		ID:            "c1",
+		UserID:        "u1",
+		DeviceID:      "d1",
+		Subscriptions: map[string]bool{},
+		Send:          make(chan *realtime.Message, 16),
+	}
+	hub.RegisterClient(client)
+	deadline := time.Now().Add(2 * time.Second)
+	for hub.Subscribe(client.ID, realtime.ShareChannel("s1")) != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("client was never registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	h.NotifyShareChanged("s1", "e.1")
+	h.NotifyShareChanged("s1", "e.2")
+	h.NotifyShareChanged("s1", "e.3")
+
+	select {
+	case msg := <-client.Send:
+		if msg.Type != realtime.MsgTypeShareChanged || msg.Channel != "share:s1" {
+			t.Fatalf("unexpected message: %+v", msg)
+		}
+		var p realtime.ShareChangedPayload
+		if err := json.Unmarshal(msg.Payload, &p); err != nil {
+			t.Fatal(err)
+		}
+		if p.ShareID != "s1" || p.Cursor != "e.3" {
+			t.Errorf("payload = %+v, want latest cursor e.3", p)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no share.changed message")
+	}
+
+	select {
+	case msg := <-client.Send:
+		t.Errorf("burst was not coalesced, got extra %+v", msg)
+	case <-time.After(2 * shareNotifyDelay):
+	}
+}
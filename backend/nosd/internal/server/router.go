@@ -33,10 +33,12 @@ import (
 	"nithronos/backend/nosd/internal/shares"
 	"nithronos/backend/nosd/internal/sessions"
 	"nithronos/backend/nosd/pkg/agentclient"
+	pkgapps "nithronos/backend/nosd/pkg/apps"
 	"nithronos/backend/nosd/pkg/auth"
 
 	// "nithronos/backend/nosd/pkg/firewall"
 	"nithronos/backend/nosd/pkg/httpx"
+	"nithronos/backend/nosd/pkg/oidc"
 	poolroots "nithronos/backend/nosd/pkg/pools"
 
 	// "nithronos/backend/nosd/pkg/shares" // TODO: Restore when integrating old shares
@@ -181,7 +183,7 @@ func NewRouter(cfg config.Config) http.Handler {
 	store, _ := auth.NewStore(cfg.UsersPath)
 	users, _ := userstore.New(cfg.UsersPath)
 	codec := auth.NewSessionCodec(cfg.SessionHashKey, cfg.SessionBlockKey)
-	InitJobsStore(cfg)
+	jobEngine := newJobEngine(*Logger(cfg))
 
 	// Initialize shares handler
 	agentClient := agentclient.New(cfg.AgentSocket())
@@ -191,11 +193,6 @@ func NewRouter(cfg config.Config) http.Handler {
 		log.Error().Err(err).Msg("Failed to initialize shares handler")
 	}
 
-	// Initialize backup handler (using existing implementation)
-	// The existing backup handler requires scheduler, replicator, and restorer
-	// For now, we'll skip initializing it as it needs more complex setup
-	var backupHandler *BackupHandler
-
 	// Initialize notifications manager
 	notificationsPath := filepath.Join(filepath.Dir(cfg.UsersPath), "notifications")
 	notificationManager, err := notifications.NewManager(notificationsPath)
@@ -213,11 +210,36 @@ func NewRouter(cfg config.Config) http.Handler {
 		TemplatesPath: "/usr/share/nithronos/apps",
 		AgentPath:     cfg.AgentSocket(),
 		CaddyPath:     "/etc/caddy/Caddyfile.d",
+		Logger:        *Logger(cfg),
 	}
 	if v := os.Getenv("NOS_APPS_STATE"); v != "" {
 		appManagerConfig.StateFile = v
 	}
 	appsManager, _ := apps.NewManager(appManagerConfig)
+	if appsManager != nil && notificationManager != nil {
+		appsManager.UseUpdateNotifier(&appUpdateNotifier{notifications: notificationManager})
+	}
+
+	// Backup scheduling, replication, restores and paired peers
+	backupHandler := newBackupHandler(*Logger(cfg), filepath.Dir(cfg.UsersPath), agentClient, notificationManager, appsManager, jobEngine)
+
+	// OpenID Connect provider for single sign-on into installed apps
+	oidcProvider, err := oidc.NewProvider(filepath.Join(filepath.Dir(cfg.UsersPath), "oidc"), func(uid string) (map[string]any, error) {
+		u, err := users.FindByID(uid)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]any{
+			"preferred_username": u.Username,
+			"name":               u.Username,
+			"groups":             u.Roles,
+		}, nil
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to initialize OIDC provider")
+	} else if appsManager != nil {
+		appsManager.UseSSOProvider(oidcProvider)
+	}
 	// Disk-backed session and ratelimit stores
 	sessStore := sessions.New(cfg.SessionsPath)
 	rlStore := ratelimit.New(cfg.RateLimitPath)
@@ -721,7 +743,8 @@ func NewRouter(cfg config.Config) http.Handler {
 		u.FailedAttempts = 0
 		u.LockedUntil = ""
 		_ = users.UpsertUser(u)
-		if err := issueSessionCookies(w, cfg, u.ID, body.RememberMe); err != nil {
+		loggedIn := time.Now()
+		if err := issueSessionCookies(w, cfg, u.ID, body.RememberMe, loggedIn); err != nil {
 			httpx.WriteError(w, http.StatusInternalServerError, "session error")
 			return
 		}
@@ -731,7 +754,7 @@ func NewRouter(cfg config.Config) http.Handler {
 		ua := r.Header.Get("User-Agent")
 		ip = clientIP(r, cfg)
 		rec, _ := mgr.Create(u.ID, ua, ip, 15*time.Minute)
-		_ = issueSessionCookiesSID(w, cfg, u.ID, rec.SID, body.RememberMe)
+		_ = issueSessionCookiesSID(w, cfg, u.ID, rec.SID, body.RememberMe, loggedIn)
 		issueCSRFCookie(w)
 		writeJSON(w, map[string]any{"ok": true})
 	})
@@ -749,7 +772,7 @@ func NewRouter(cfg config.Config) http.Handler {
 				return
 			}
 			_ = sessStore.Upsert(sessions.Session{ID: generateUUID(), UserID: uid, Roles: []string{"refresh"}, ExpiresAt: time.Now().Add(7 * 24 * time.Hour).UTC().Format(time.RFC3339)})
-			if err := issueSessionCookies(w, cfg, uid, true); err == nil {
+			if err := issueSessionCookies(w, cfg, uid, true, decodeAuthTime(r, cfg, cookieRefresh)); err == nil {
 				w.Header().Set("X-Refresh-ID", newID)
 				writeJSON(w, map[string]any{"ok": true})
 				return
@@ -791,6 +814,30 @@ func NewRouter(cfg config.Config) http.Handler {
 		w.WriteHeader(http.StatusUnauthorized)
 	})
 
+	// Login gate for apps exposed through the proxy; Caddy calls verify
+	// and sends users through handoff and callback
+	r.Get("/api/v1/apps/auth/verify", handleAppAuthVerify(cfg, codec))
+	r.Get("/api/v1/apps/auth/callback", handleAppAuthCallback(cfg))
+	if appsManager != nil {
+		r.Get("/api/v1/apps/auth/handoff", handleAppAuthHandoff(cfg, codec, appsManager))
+	}
+
+	// OpenID Connect provider; the issuer is /api/v1/oidc on the HTTPS
+	// domain, as apps are told
+	if oidcProvider != nil {
+		oidcIssuer := func() string { return "https://" + pkgapps.DefaultAppDomain + pkgapps.OIDCPath }
+		if appsManager != nil {
+			oidcIssuer = appsManager.OIDCIssuer
+		}
+		r.Get("/api/v1/oidc/.well-known/openid-configuration", handleOIDCDiscovery(oidcProvider, oidcIssuer))
+		r.Get("/api/v1/oidc/jwks", handleOIDCJWKS(oidcProvider))
+		r.Get("/api/v1/oidc/authorize", handleOIDCAuthorize(cfg, codec, oidcProvider))
+		r.Post("/api/v1/oidc/authorize", handleOIDCAuthorize(cfg, codec, oidcProvider))
+		r.Post("/api/v1/oidc/token", handleOIDCToken(oidcProvider, oidcIssuer))
+		r.Get("/api/v1/oidc/userinfo", handleOIDCUserInfo(oidcProvider))
+		r.Post("/api/v1/oidc/userinfo", handleOIDCUserInfo(oidcProvider))
+	}
+
 	// Protected API group (auth required)
 	r.Group(func(pr chi.Router) {
 		pr.Use(func(next http.Handler) http.Handler { return requireAuth(next, codec, cfg) })
@@ -887,7 +934,7 @@ func NewRouter(cfg config.Config) http.Handler {
 
 	r.Post("/api/v1/auth/refresh", func(w http.ResponseWriter, r *http.Request) {
 		if uid, ok := decodeRefreshUID(r, cfg); ok {
-			if err := issueSessionCookies(w, cfg, uid, true); err == nil {
+			if err := issueSessionCookies(w, cfg, uid, true, decodeAuthTime(r, cfg, cookieRefresh)); err == nil {
 				writeJSON(w, map[string]any{"ok": true})
 				return
 			}
@@ -941,6 +988,9 @@ func NewRouter(cfg config.Config) http.Handler {
 		writeJSON(w, map[string]any{"ok": true})
 	})
 
+	// Replication from paired NithronOS boxes, authenticated by peer tokens
+	r.Mount("/api/v1/backup/peer", backupHandler.PeerRoutes())
+
 	// Protected routes
 	r.Group(func(pr chi.Router) {
 		pr.Use(func(next http.Handler) http.Handler { return withUser(next, codec) })
@@ -1137,7 +1187,7 @@ func NewRouter(cfg config.Config) http.Handler {
 		})
 		pr.With(adminRequired).Post("/api/v1/scrub/start", func(w http.ResponseWriter, r *http.Request) {
 			// Delegate to pools scrub start
-			handleScrubStart(w, r)
+			handleScrubStart(jobEngine)(w, r)
 		})
 		pr.With(adminRequired).Post("/api/v1/scrub/cancel", func(w http.ResponseWriter, r *http.Request) {
 			// TODO: Implement scrub cancel
@@ -1146,7 +1196,7 @@ func NewRouter(cfg config.Config) http.Handler {
 
 		// Balance endpoints
 		pr.Get("/api/v1/balance/status", handleBalanceStatus(cfg))
-		pr.With(adminRequired).Post("/api/v1/balance/start", handleBalanceStart(cfg))
+		pr.With(adminRequired).Post("/api/v1/balance/start", handleBalanceStart(cfg, jobEngine))
 		pr.With(adminRequired).Post("/api/v1/balance/cancel", handleBalanceCancel(cfg))
 
 		// SMART endpoints
@@ -1158,8 +1208,13 @@ func NewRouter(cfg config.Config) http.Handler {
 		pr.With(adminRequired).Post("/api/v1/smart/test/{device}", handleSmartTestDevice(cfg))
 
 		// Jobs endpoints
-		pr.Get("/api/v1/jobs/recent", handleJobsRecent(cfg))
-		pr.Get("/api/v1/jobs/{id}", handleJobGet(cfg))
+		pr.Get("/api/v1/jobs", handleJobsList(jobEngine))
+		pr.Get("/api/v1/jobs/recent", handleJobsRecent(jobEngine))
+		pr.Get("/api/v1/jobs/ws", handleJobsSocket(jobEngine))
+		pr.Get("/api/v1/jobs/{id}", handleJobGet(jobEngine))
+		pr.Get("/api/v1/jobs/{id}/logs", handleJobLogs(jobEngine))
+		pr.Get("/api/v1/jobs/{id}/stream", handleJobStream(jobEngine))
+		pr.With(adminRequired).Post("/api/v1/jobs/{id}/cancel", handleJobCancel(jobEngine))
 
 		// Devices endpoint expected by frontend
 		pr.Get("/api/v1/devices", func(w http.ResponseWriter, r *http.Request) {
@@ -1167,15 +1222,15 @@ func NewRouter(cfg config.Config) http.Handler {
 			handleListDevices(w, r)
 		})
 		pr.With(adminRequired).Post("/api/v1/health/scan", handleHealthScan(cfg))
-		pr.With(adminRequired).Post("/api/v1/pools/apply-create", handleApplyCreate(cfg))
+		pr.With(adminRequired).Post("/api/v1/pools/apply-create", handleApplyCreate(cfg, jobEngine))
 		pr.With(adminRequired).Get("/api/v1/pools/discover", handlePoolsDiscover)
-		pr.With(adminRequired).Post("/api/v1/pools/import", handlePoolsImport(cfg))
+		pr.With(adminRequired).Post("/api/v1/pools/import", handlePoolsImport(cfg, jobEngine))
 		// Device operations (plan/apply)
 		pr.With(adminRequired).Post("/api/v1/pools/{id}/plan-device", handlePlanDevice(cfg))
-		pr.With(adminRequired).Post("/api/v1/pools/{id}/apply-device", handleApplyDevice(cfg))
+		pr.With(adminRequired).Post("/api/v1/pools/{id}/apply-device", handleApplyDevice(cfg, jobEngine))
 		pr.With(adminRequired).Post("/api/v1/pools/{id}/plan-destroy", handlePlanDestroy(cfg))
-		pr.With(adminRequired).Post("/api/v1/pools/{id}/apply-destroy", handleApplyDestroy(cfg))
-		pr.With(adminRequired).Post("/api/v1/pools/scrub/start", handleScrubStart)
+		pr.With(adminRequired).Post("/api/v1/pools/{id}/apply-destroy", handleApplyDestroy(cfg, jobEngine))
+		pr.With(adminRequired).Post("/api/v1/pools/scrub/start", handleScrubStart(jobEngine))
 		pr.With(adminRequired).Get("/api/v1/pools/scrub/status", handleScrubStatus)
 		pr.Get("/api/v1/pools/{id}", handlePoolDetail)
 		// Mount options (canonical + compatibility with FE path)
@@ -1189,8 +1244,8 @@ func NewRouter(cfg config.Config) http.Handler {
 		pr.With(adminRequired).Post("/api/v1/schedules", handleSchedulesPost(cfg))
 		pr.Get("/api/v1/pools/tx/{id}/status", func(w http.ResponseWriter, r *http.Request) {
 			id := chi.URLParam(r, "id")
-			var tx pools.Tx
-			if ok, _ := fsatomic.LoadJSON(txPath(id), &tx); !ok {
+			tx, ok := loadPoolTx(jobEngine, id)
+			if !ok {
 				httpx.WriteError(w, http.StatusNotFound, "not found")
 				return
 			}
@@ -1207,10 +1262,10 @@ func NewRouter(cfg config.Config) http.Handler {
 			if i, err := strconv.Atoi(maxStr); err == nil && i > 0 && i <= 5000 {
 				max = i
 			}
-			lines, next := readLogTail(id, cursor, max)
+			lines, next := readLogTail(jobEngine, id, cursor, max)
 			writeJSON(w, map[string]any{"lines": lines, "nextCursor": next})
 		})
-		pr.Get("/api/v1/pools/tx/{id}/stream", handleTxStream)
+		pr.Get("/api/v1/pools/tx/{id}/stream", handleTxStream(jobEngine))
 
 		pr.With(adminRequired).Post("/api/v1/pools/create", func(w http.ResponseWriter, r *http.Request) {
 			if r.Header.Get("Confirm") != "yes" {
@@ -1352,6 +1407,8 @@ func NewRouter(cfg config.Config) http.Handler {
 			// App lifecycle operations (admin only)
 			pr.With(adminRequired).Post("/api/v1/apps/install", handleInstallApp(appsManager))
 			pr.With(adminRequired).Post("/api/v1/apps/{id}/upgrade", handleUpgradeApp(appsManager))
+			pr.With(adminRequired).Put("/api/v1/apps/{id}/expose", handleSetAppExposure(appsManager))
+			pr.With(adminRequired).Put("/api/v1/apps/{id}/update-policy", handleSetAppUpdatePolicy(appsManager))
 			pr.With(adminRequired).Post("/api/v1/apps/{id}/start", handleStartApp(appsManager))
 			pr.With(adminRequired).Post("/api/v1/apps/{id}/stop", handleStopApp(appsManager))
 			pr.With(adminRequired).Post("/api/v1/apps/{id}/restart", handleRestartApp(appsManager))
@@ -1361,6 +1418,7 @@ func NewRouter(cfg config.Config) http.Handler {
 
 			// Admin operations
 			pr.With(adminRequired).Post("/api/v1/apps/catalog/sync", handleSyncCatalogs(appsManager))
+			pr.With(adminRequired).Post("/api/v1/apps/updates/check", handleCheckAppUpdates(appsManager))
 		} else {
 			// Fallback: provide minimal implementations so FE endpoints exist
 			pr.Get("/api/v1/apps/catalog", func(w http.ResponseWriter, r *http.Request) {
@@ -1372,6 +1430,9 @@ func NewRouter(cfg config.Config) http.Handler {
 			pr.Get("/api/v1/apps/{id}", func(w http.ResponseWriter, r *http.Request) {
 				httpx.WriteError(w, http.StatusNotFound, "App not found")
 			})
+			pr.With(adminRequired).Post("/api/v1/apps/install", func(w http.ResponseWriter, r *http.Request) {
+				httpx.WriteError(w, http.StatusServiceUnavailable, "App manager unavailable")
+			})
 		}
 
 		// Health endpoints
@@ -1402,40 +1463,63 @@ func NewRouter(cfg config.Config) http.Handler {
 		// Jobs endpoints are already defined above
 
 		// Backup endpoints
-		if backupHandler != nil {
-			pr.Mount("/api/v1/backup", backupHandler.Routes())
-		}
+		pr.Mount("/api/v1/backup", backupHandler.Routes())
 
 		// Sync endpoints (for NithronSync clients)
 		syncSharesStorePath := filepath.Join(filepath.Dir(cfg.UsersPath), "shares.json")
 		syncSharesStore := shares.NewStore(syncSharesStorePath)
 		syncHandler, syncErr := NewSyncHandler(cfg, syncSharesStore, *Logger(cfg))
+		var webdavHandler *WebDAVHandler
 		if syncErr != nil {
 			Logger(cfg).Error().Err(syncErr).Msg("Failed to create sync handler")
 		} else {
 			// Mount sync API routes
 			pr.Mount("/api/v1/sync", syncHandler.Routes())
+			pr.With(adminRequired).Mount("/api/v1/sync/admin", syncHandler.AdminRoutes())
 			
 			// Mount WebDAV endpoint for file access
-			webdavHandler := NewWebDAVHandler(syncSharesStore, syncHandler.DeviceManager(), *Logger(cfg))
+			webdavHandler = NewWebDAVHandler(syncSharesStore, syncHandler.DeviceManager(), syncHandler.Journals(), *Logger(cfg))
+			webdavHandler.UseVersions(syncHandler.Versions())
+			webdavHandler.UseTrash(syncHandler.Trash())
 			r.Mount("/dav", webdavHandler)
+			if notificationManager != nil {
+				syncHandler.UseNotifications(notificationManager)
+			}
+
+			// Public share links for people without an account, audited
+			// in the same log as account changes
+			syncHandler.UseAudit(auth.NewAuditLogger(*Logger(cfg), filepath.Join(filepath.Dir(cfg.UsersPath), "audit")))
+			r.Mount("/s", NewPublicLinkHandler(cfg, syncHandler, webdavHandler, rlStore, *Logger(cfg)).Routes())
 			
 			Logger(cfg).Info().Msg("NithronSync API initialized")
 		}
 
 		// Phase 4: Real-time collaboration
 		realtimeHandler := NewRealtimeHandler(*Logger(cfg))
+		if syncErr == nil {
+			// Sync clients connect with device tokens and are told about
+			// journal changes on their shares' channels
+			realtimeHandler.UseDeviceAuth(syncHandler.DeviceTokenAuthMiddleware, syncHandler.CanAccessShare)
+			syncHandler.Journals().OnRecord(realtimeHandler.NotifyShareChanged)
+		}
 		pr.Mount("/api/v1/sync/realtime", realtimeHandler.Routes())
 		Logger(cfg).Info().Msg("Real-time collaboration API initialized")
 
 		// Phase 4: End-to-end encryption
-		encryptionHandler, encErr := NewEncryptionHandler(cfg, *Logger(cfg))
+		encryptionHandler, encErr := NewEncryptionHandler(cfg, syncSharesStore, *Logger(cfg), jobEngine)
 		if encErr != nil {
 			Logger(cfg).Error().Err(encErr).Msg("Failed to create encryption handler")
 		} else {
 			pr.Mount("/api/v1/sync/encryption", encryptionHandler.Routes())
 			Logger(cfg).Info().Msg("Encryption API initialized")
 		}
+		if encErr == nil && syncErr == nil {
+			// Encrypted shares are stored encrypted at rest and decrypted on
+			// the fly for WebDAV and change tracking
+			webdavHandler.UseEncryption(encryptionHandler)
+			syncHandler.UseEncryption(encryptionHandler)
+			syncHandler.ChangeTracker().SetContentDecoder(encryptionHandler.ContentDecoder())
+		}
 
 		// Phase 4: Offline-first sync
 		offlineHandler, offErr := NewOfflineHandler(cfg, *Logger(cfg))
@@ -1469,6 +1553,9 @@ func NewRouter(cfg config.Config) http.Handler {
 		} else {
 			pr.Mount("/api/v1/net", netHandler.Routes())
 			pr.Mount("/api/v1/auth", netHandler.AuthRoutes())
+			if appsManager != nil {
+				appsManager.UseCertSource(netHandler.httpsMgr)
+			}
 		}
 
 		// Updates endpoints (M5)
@@ -1521,30 +1608,8 @@ func NewRouter(cfg config.Config) http.Handler {
 			}
 		})
 
-		pr.With(adminRequired).Post("/api/v1/apps/install", func(w http.ResponseWriter, r *http.Request) {
-			var body struct {
-				ID     string
-				Config map[string]any
-			}
-			_ = json.NewDecoder(r.Body).Decode(&body)
-			if body.ID == "" {
-				httpx.WriteError(w, http.StatusBadRequest, "id required")
-				return
-			}
-			dir := filepath.Join(cfg.AppsInstallDir, body.ID)
-			_ = os.MkdirAll(dir, 0o755)
-			compose := apps.ComposeTemplate(body.ID)
-			if err := os.WriteFile(filepath.Join(dir, "docker-compose.yml"), []byte(compose), 0o644); err != nil {
-				httpx.WriteError(w, http.StatusInternalServerError, err.Error())
-				return
-			}
-			unit := apps.UnitTemplate(body.ID, dir)
-			client := agentclient.New("/run/nos-agent.sock")
-			_ = client.PostJSON(r.Context(), "/v1/systemd/install-app", map[string]any{"id": body.ID, "unit_text": unit}, nil)
-			_ = client.PostJSON(r.Context(), "/v1/app/compose-up", map[string]any{"id": body.ID, "dir": dir}, nil)
-			writeJSON(w, map[string]any{"ok": true})
-		})
-
+		// Removes apps installed before the app manager; new installs go
+		// through /api/v1/apps/install and DELETE /api/v1/apps/{id}
 		pr.With(adminRequired).Post("/api/v1/apps/uninstall", func(w http.ResponseWriter, r *http.Request) {
 			var body struct {
 				ID    string
@@ -31,6 +31,10 @@ func Test_AllRoutesUnderV1OrAllowlist(t *testing.T) {
 		if len(route) >= 8 && route[:8] == "/api/v1/" {
 			return nil
 		}
+		// Public share links are opened by people without an account
+		if strings.HasPrefix(route, "/s/") {
+			return nil
+		}
 		// Permit local-only debug/pprof tree
 		if len(route) >= 12 && route[:12] == "/debug/pprof" {
 			return nil
@@ -10,6 +10,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 
@@ -118,19 +119,23 @@ func handleSupportBundle(cfg config.Config) http.HandlerFunc {
 			}
 		}
 
-		// Pool transactions (last N=10)
-		txDir := filepath.Join("/var/lib/nos", "pools", "tx")
-		if entries, err := os.ReadDir(txDir); err == nil {
-			files := make([]string, 0, len(entries))
-			for _, e := range entries {
-				files = append(files, e.Name())
+		// Jobs (last N=20), with their logs; pool transactions are jobs too
+		if paths, err := filepath.Glob(filepath.Join(jobsDir(), "*.json")); err == nil {
+			modTimes := make(map[string]time.Time, len(paths))
+			for _, p := range paths {
+				if fi, err := os.Stat(p); err == nil {
+					modTimes[p] = fi.ModTime()
+				}
 			}
+			sort.Slice(paths, func(i, j int) bool { return modTimes[paths[i]].Before(modTimes[paths[j]]) })
 			start := 0
-			if len(files) > 10 {
-				start = len(files) - 10
+			if len(paths) > 20 {
+				start = len(paths) - 20
 			}
-			for _, name := range files[start:] {
-				writeTarFileIfExists(tw, filepath.Join(txDir, name), filepath.Join("pools/tx", name))
+			for _, p := range paths[start:] {
+				id := strings.TrimSuffix(filepath.Base(p), ".json")
+				writeTarFileIfExists(tw, p, filepath.Join("jobs", id+".json"))
+				writeTarFileIfExists(tw, filepath.Join(jobsDir(), id+".log"), filepath.Join("jobs", id+".log"))
 			}
 		}
 	}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+
+	"nithronos/backend/nosd/internal/shares"
+	"nithronos/backend/nosd/pkg/httpx"
+	nosync "nithronos/backend/nosd/pkg/sync"
+)
+
+// assembleTempPrefix marks files being assembled from a manifest. Change
+// detection ignores them.
+const assembleTempPrefix = ".nos-assemble-"
+
+// maxManifestChunks bounds the chunks of one manifest (64 GiB at the
+// smallest chunk size)
+const maxManifestChunks = 1 << 22
+
+// chunkShare returns a share the device's user may write chunks to
+func (h *SyncHandler) chunkShare(w http.ResponseWriter, r *http.Request, shareID string) (shares.Share, bool) {
+	share, ok := h.shareStore.GetByID(shareID)
+	if !ok {
+		httpx.WriteTypedError(w, http.StatusNotFound, "share.not_found", "Share not found", 0)
+		return shares.Share{}, false
+	}
+	if !shareAccessible(share, r.Header.Get("X-Device-User-ID")) {
+		httpx.WriteTypedError(w, http.StatusForbidden, "auth.forbidden", "Not authorized", 0)
+		return shares.Share{}, false
+	}
+	if !h.chunksAllowed(share) {
+		httpx.WriteTypedError(w, http.StatusConflict, "sync.share_encrypted", "Chunked uploads are not available for encrypted shares", 0)
+		return shares.Share{}, false
+	}
+	return share, true
+}
+
+// chunksAllowed reports whether a share's files hold the bytes clients sync.
+// Shares encrypted at rest (or being converted) store different bytes.
+func (h *SyncHandler) chunksAllowed(share shares.Share) bool {
+	return !share.Encrypted && (h.encryption == nil || !h.encryption.isConverting(share.ID))
+}
+
+// chunkSources limits chunk reuse to shares the user can read
+func (h *SyncHandler) chunkSources(userID string) func(shareID string) bool {
+	return func(shareID string) bool {
+		share, ok := h.shareStore.GetByID(shareID)
+		return ok && shareAccessible(share, userID) && h.chunksAllowed(share)
+	}
+}
+
+// shareRelPath cleans a client path and checks it stays inside the share
+// and out of the directories the server keeps for itself
+func shareRelPath(p string) (string, bool) {
+	rel := strings.TrimPrefix(filepath.ToSlash(filepath.Clean("/"+p)), "/")
+	return rel, rel != "" && rel != "." && !nosync.IsServerPath(rel)
+}
+
+// MissingChunks handles POST /sync/chunks/missing
+func (h *SyncHandler) MissingChunks(w http.ResponseWriter, r *http.Request) {
+	var req nosync.MissingChunksRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpx.WriteTypedError(w, http.StatusBadRequest, "input.invalid", "Invalid request body", 0)
+		return
+	}
+	if _, ok := h.chunkShare(w, r, req.ShareID); !ok {
+		return
+	}
+	if len(req.Hashes) > maxManifestChunks {
+		httpx.WriteTypedError(w, http.StatusBadRequest, "input.invalid", "Too many hashes", 0)
+		return
+	}
+
+	userID := r.Header.Get("X-Device-User-ID")
+	writeJSON(w, map[string]interface{}{
+		"missing": h.chunkStore.Missing(userID, h.chunkSources(userID), req.Hashes),
+	})
+}
+
+// UploadChunk handles PUT /sync/chunks/{hash}
+func (h *SyncHandler) UploadChunk(w http.ResponseWriter, r *http.Request) {
+	hash := strings.ToLower(chi.URLParam(r, "hash"))
+	_, maxSize := nosync.ChunkBounds(nosync.MaxChunkAvgSize)
+
+	err := h.chunkStore.PutChunk(r.Header.Get("X-Device-User-ID"), hash, r.Body, maxSize)
+	switch {
+	case errors.Is(err, nosync.ErrChunkHashMismatch):
+		httpx.WriteTypedError(w, http.StatusBadRequest, "sync.chunk_hash_mismatch", err.Error(), 0)
+	case errors.Is(err, nosync.ErrChunkTooLarge):
+		httpx.WriteTypedError(w, http.StatusRequestEntityTooLarge, "sync.chunk_too_large", err.Error(), 0)
+	case err != nil:
+		h.logger.Error().Err(err).Str("hash", hash).Msg("Failed to store chunk")
+		httpx.WriteTypedError(w, http.StatusInternalServerError, "sync.chunk_failed", err.Error(), 0)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// CommitManifest handles POST /sync/files/{share_id}/manifest. The file is
+// assembled from chunks already on the server, checked against the manifest
+// hash and moved into place.
+func (h *SyncHandler) CommitManifest(w http.ResponseWriter, r *http.Request) {
+	share, ok := h.chunkShare(w, r, chi.URLParam(r, "share_id"))
+	if !ok {
+		return
+	}
+	deviceID := r.Header.Get("X-Device-ID")
+	userID := r.Header.Get("X-Device-User-ID")
+
+	var m nosync.FileManifest
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		httpx.WriteTypedError(w, http.StatusBadRequest, "input.invalid", "Invalid request body", 0)
+		return
+	}
+	relPath, ok := shareRelPath(m.Path)
+	if !ok {
+		httpx.WriteTypedError(w, http.StatusBadRequest, "input.invalid", "path is required", 0)
+		return
+	}
+	if len(m.Chunks) > maxManifestChunks {
+		httpx.WriteTypedError(w, http.StatusBadRequest, "input.invalid", "Too many chunks", 0)
+		return
+	}
+	var total int64
+	for _, c := range m.Chunks {
+		total += c.Size
+	}
+	if total != m.Size {
+		httpx.WriteTypedError(w, http.StatusBadRequest, "input.invalid", "Chunk sizes do not add up to the file size", 0)
+		return
+	}
+
+	fullPath := filepath.Join(share.Path, filepath.FromSlash(relPath))
+	if info, err := os.Stat(fullPath); err == nil && info.IsDir() {
+		httpx.WriteTypedError(w, http.StatusConflict, "sync.path_is_directory", "Path is a directory", 0)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0o755); err != nil {
+		httpx.WriteTypedError(w, http.StatusInternalServerError, "sync.manifest_failed", err.Error(), 0)
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(fullPath), assembleTempPrefix+"*")
+	if err != nil {
+		httpx.WriteTypedError(w, http.StatusInternalServerError, "sync.manifest_failed", err.Error(), 0)
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	sum := sha256.New()
+	missing, err := h.chunkStore.Assemble(userID, h.chunkSources(userID), m.Chunks, io.MultiWriter(tmp, sum))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		h.logger.Error().Err(err).Str("path", relPath).Msg("Failed to assemble file")
+		httpx.WriteTypedError(w, http.StatusInternalServerError, "sync.manifest_failed", err.Error(), 0)
+		return
+	}
+	if len(missing) > 0 {
+		httpx.WriteErrorWithDetails(w, http.StatusConflict, "sync.chunks_missing", "Chunks must be uploaded first", map[string]any{
+			"missing": missing,
+		})
+		return
+	}
+	if m.Hash != "" && !strings.EqualFold(hex.EncodeToString(sum.Sum(nil)), m.Hash) {
+		httpx.WriteTypedError(w, http.StatusUnprocessableEntity, "sync.hash_mismatch", "Assembled file does not match the manifest hash", 0)
+		return
+	}
+
+	if m.MTime != nil {
+		os.Chtimes(tmp.Name(), *m.MTime, *m.MTime)
+	}
+	h.keepVersion(share.ID, relPath, deviceID)
+	if err := os.Rename(tmp.Name(), fullPath); err != nil {
+		httpx.WriteTypedError(w, http.StatusInternalServerError, "sync.manifest_failed", err.Error(), 0)
+		return
+	}
+
+	if err := h.journals.RecordPath(share.ID, share.Path, deviceID, relPath); err != nil {
+		h.logger.Warn().Err(err).Str("share_id", share.ID).Msg("Failed to journal manifest upload")
+	}
+	if info, err := os.Stat(fullPath); err == nil {
+		blocks := make([]nosync.BlockHash, len(m.Chunks))
+		var offset int64
+		for i, c := range m.Chunks {
+			blocks[i] = nosync.BlockHash{Offset: offset, Size: c.Size, Hash: strings.ToLower(c.Hash)}
+			offset += c.Size
+		}
+		if err := h.chunkStore.IndexFile(share.ID, relPath, info, blocks); err != nil {
+			h.logger.Warn().Err(err).Msg("Failed to index chunks")
+		}
+	}
+
+	h.logger.Debug().
+		Str("share_id", share.ID).
+		Str("path", relPath).
+		Int("chunks", len(m.Chunks)).
+		Msg("File assembled from manifest")
+	writeJSON(w, map[string]interface{}{
+		"path": relPath,
+		"size": m.Size,
+		"hash": hex.EncodeToString(sum.Sum(nil)),
+	})
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+
+	"github.com/go-chi/chi/v5"
+
+	"nithronos/backend/nosd/internal/shares"
+	"nithronos/backend/nosd/pkg/httpx"
+	nosync "nithronos/backend/nosd/pkg/sync"
+)
+
+// e2eDevice is an active device's public key as sent to clients
+type e2eDevice struct {
+	DeviceID    string `json:"device_id"`
+	UserID      string `json:"user_id"`
+	PublicKey   []byte `json:"public_key"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// e2eKeyVersion is one key version wrapped for the requesting device
+type e2eKeyVersion struct {
+	Version int                     `json:"version"`
+	Wrap    *nosync.WrappedShareKey `json:"wrap"`
+}
+
+// EnrollE2EDevice handles PUT /sync/e2e/device-key
+func (h *SyncHandler) EnrollE2EDevice(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.Header.Get("X-Device-ID")
+	userID := r.Header.Get("X-Device-User-ID")
+
+	var req struct {
+		PublicKey []byte `json:"public_key"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpx.WriteTypedError(w, http.StatusBadRequest, "input.invalid", "Invalid request body", 0)
+		return
+	}
+
+	dk, err := h.e2eStore.EnrollDevice(deviceID, userID, req.PublicKey)
+	if err != nil {
+		if errors.Is(err, nosync.ErrE2EInvalidKey) {
+			httpx.WriteTypedError(w, http.StatusBadRequest, "sync.e2e_invalid_key", err.Error(), 0)
+			return
+		}
+		httpx.WriteTypedError(w, http.StatusInternalServerError, "sync.e2e_enroll_failed", err.Error(), 0)
+		return
+	}
+
+	h.logger.Info().Str("device_id", deviceID).Str("fingerprint", dk.Fingerprint).Msg("Device enrolled for E2E encryption")
+	writeJSON(w, dk)
+}
+
+// GetE2EShareKeys handles GET /sync/e2e/shares/{share_id}/keys. It returns
+// the share key versions wrapped for the calling device, the devices that
+// may read the share and which key versions each of them still lacks.
+func (h *SyncHandler) GetE2EShareKeys(w http.ResponseWriter, r *http.Request) {
+	share, ok := h.e2eShare(w, r)
+	if !ok {
+		return
+	}
+	deviceID := r.Header.Get("X-Device-ID")
+
+	active := h.e2eActiveDevices(share)
+	sk := h.e2eStore.ShareKeys(share.ID)
+
+	resp := map[string]interface{}{
+		"share_id":         share.ID,
+		"current_version":  0,
+		"rotation_pending": false,
+		"keys":             []e2eKeyVersion{},
+		"devices":          active,
+		"missing":          map[string][]int{},
+	}
+	if sk != nil {
+		keys := []e2eKeyVersion{}
+		for v, wraps := range sk.Versions {
+			if wrap := wraps[deviceID]; wrap != nil {
+				keys = append(keys, e2eKeyVersion{Version: v, Wrap: wrap})
+			}
+		}
+		sort.Slice(keys, func(i, j int) bool { return keys[i].Version < keys[j].Version })
+
+		// Devices that cannot read every version yet; a holder grants them
+		isActive := make(map[string]bool, len(active))
+		missing := map[string][]int{}
+		for _, d := range active {
+			isActive[d.DeviceID] = true
+			for v := 1; v <= sk.CurrentVersion; v++ {
+				if sk.Versions[v] != nil && sk.Versions[v][d.DeviceID] == nil {
+					missing[d.DeviceID] = append(missing[d.DeviceID], v)
+				}
+			}
+		}
+		// A holder that lost access (revoked, expired, removed from the
+		// share) still knows the current key, so it has to be replaced
+		pending := sk.RotationPending
+		for id := range sk.Versions[sk.CurrentVersion] {
+			if !isActive[id] {
+				pending = true
+			}
+		}
+
+		resp["current_version"] = sk.CurrentVersion
+		resp["rotation_pending"] = pending
+		resp["keys"] = keys
+		resp["missing"] = missing
+	}
+
+	writeJSON(w, resp)
+}
+
+// PutE2EShareKeys handles PUT /sync/e2e/shares/{share_id}/keys. Uploading
+// version current+1 rotates the share key (or initialises it) and must cover
+// every active device; uploading an existing version grants it to devices
+// that lack it.
+func (h *SyncHandler) PutE2EShareKeys(w http.ResponseWriter, r *http.Request) {
+	share, ok := h.e2eShare(w, r)
+	if !ok {
+		return
+	}
+	deviceID := r.Header.Get("X-Device-ID")
+
+	var req struct {
+		Version int                                `json:"version"`
+		Wraps   map[string]*nosync.WrappedShareKey `json:"wraps"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpx.WriteTypedError(w, http.StatusBadRequest, "input.invalid", "Invalid request body", 0)
+		return
+	}
+
+	active := h.e2eActiveDevices(share)
+	ids := make([]string, len(active))
+	for i, d := range active {
+		ids[i] = d.DeviceID
+	}
+
+	if err := h.e2eStore.PutWraps(share.ID, deviceID, req.Version, req.Wraps, ids); err != nil {
+		switch {
+		case errors.Is(err, nosync.ErrE2ENotEnrolled):
+			httpx.WriteTypedError(w, http.StatusPreconditionFailed, "sync.e2e_not_enrolled", err.Error(), 0)
+		case errors.Is(err, nosync.ErrE2ENotKeyHolder):
+			httpx.WriteTypedError(w, http.StatusForbidden, "sync.e2e_not_key_holder", err.Error(), 0)
+		case errors.Is(err, nosync.ErrE2EVersionConflict):
+			httpx.WriteTypedError(w, http.StatusConflict, "sync.e2e_version_conflict", err.Error(), 0)
+		case errors.Is(err, nosync.ErrE2EMissingWraps):
+			httpx.WriteTypedError(w, http.StatusBadRequest, "sync.e2e_missing_wraps", err.Error(), 0)
+		default:
+			httpx.WriteTypedError(w, http.StatusInternalServerError, "sync.e2e_save_failed", err.Error(), 0)
+		}
+		return
+	}
+
+	h.logger.Info().Str("share_id", share.ID).Str("device_id", deviceID).Int("version", req.Version).Msg("E2E share keys updated")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// e2eShare resolves the end-to-end encrypted share of a request
+func (h *SyncHandler) e2eShare(w http.ResponseWriter, r *http.Request) (shares.Share, bool) {
+	share, ok := h.shareStore.GetByID(chi.URLParam(r, "share_id"))
+	if !ok {
+		httpx.WriteTypedError(w, http.StatusNotFound, "share.not_found", "Share not found", 0)
+		return shares.Share{}, false
+	}
+	if !shareAccessible(share, r.Header.Get("X-Device-User-ID")) {
+		httpx.WriteTypedError(w, http.StatusForbidden, "auth.forbidden", "Not authorized", 0)
+		return shares.Share{}, false
+	}
+	if !share.E2E {
+		httpx.WriteTypedError(w, http.StatusConflict, "sync.e2e_disabled", "Share is not end-to-end encrypted", 0)
+		return shares.Share{}, false
+	}
+	return share, true
+}
+
+// e2eActiveDevices returns the enrolled devices that may currently read a share
+func (h *SyncHandler) e2eActiveDevices(share shares.Share) []e2eDevice {
+	active := []e2eDevice{}
+	for _, dk := range h.e2eStore.ListDeviceKeys() {
+		device, ok := h.syncStore.GetDevice(dk.DeviceID)
+		if !ok || device.RevokedAt != nil || !shareAccessible(share, device.UserID) {
+			continue
+		}
+		active = append(active, e2eDevice{
+			DeviceID:    dk.DeviceID,
+			UserID:      device.UserID,
+			PublicKey:   dk.PublicKey,
+			Fingerprint: dk.Fingerprint,
+		})
+	}
+	return active
+}
@@ -2,8 +2,11 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -12,6 +15,7 @@ import (
 
 	"nithronos/backend/nosd/internal/config"
 	"nithronos/backend/nosd/internal/shares"
+	"nithronos/backend/nosd/pkg/auth"
 	"nithronos/backend/nosd/pkg/httpx"
 	nosync "nithronos/backend/nosd/pkg/sync"
 )
@@ -20,12 +24,21 @@ import (
 type SyncHandler struct {
 	deviceMgr         *nosync.DeviceManager
 	changeTracker     *nosync.ChangeTracker
+	journals          *nosync.JournalManager
 	deltaSync         *nosync.DeltaSync
 	shareStore        *shares.Store
 	syncStore         *nosync.Store
 	conflictStore     *nosync.ConflictStore
 	activityStore     *nosync.ActivityStore
 	collaborationStore *nosync.CollaborationStore
+	e2eStore          *nosync.E2EStore
+	chunkStore        *nosync.ChunkStore
+	uploads           *nosync.UploadManager
+	versions          *nosync.VersionStore
+	trash             *nosync.TrashStore
+	links             *nosync.ShareLinkStore
+	encryption        *EncryptionHandler
+	audit             *auth.AuditLogger
 	logger            zerolog.Logger
 	cfg               config.Config
 }
@@ -39,11 +52,18 @@ func NewSyncHandler(cfg config.Config, shareStore *shares.Store, logger zerolog.
 		return nil, err
 	}
 
-	// Initialize device manager
+	// Initialize device manager (with the mass-delete breaker)
+	deviceConfig := nosync.DefaultDeviceManagerConfig()
+	if v, err := strconv.Atoi(os.Getenv("NOS_SYNC_MAX_DELETES")); err == nil {
+		deviceConfig.MaxDeletes = v
+	}
+	if v, err := time.ParseDuration(os.Getenv("NOS_SYNC_DELETE_WINDOW")); err == nil && v > 0 {
+		deviceConfig.DeleteWindow = v
+	}
 	deviceMgr := nosync.NewDeviceManager(
 		syncStore,
 		logger,
-		nosync.DefaultDeviceManagerConfig(),
+		deviceConfig,
 	)
 
 	// Initialize change tracker
@@ -52,6 +72,22 @@ func NewSyncHandler(cfg config.Config, shareStore *shares.Store, logger zerolog.
 		nosync.DefaultChangeTrackerConfig(),
 	)
 
+	// Initialize change journals (one per share, fed by inotify or btrfs
+	// snapshot diffs, plus WebDAV)
+	journalConfig := nosync.DefaultJournalManagerConfig()
+	if v := os.Getenv("NOS_SYNC_CHANGE_SOURCE"); v != "" {
+		journalConfig.ChangeSource = v
+	}
+	journals, err := nosync.NewJournalManager(
+		filepath.Join(syncBasePath, "journal"),
+		changeTracker,
+		logger,
+		journalConfig,
+	)
+	if err != nil {
+		return nil, err
+	}
+
 	// Initialize delta sync
 	deltaSync := nosync.NewDeltaSync(nosync.DefaultBlockSize)
 
@@ -73,18 +109,75 @@ func NewSyncHandler(cfg config.Config, shareStore *shares.Store, logger zerolog.
 		return nil, err
 	}
 
-	return &SyncHandler{
+	// Initialize end-to-end key store
+	e2eStore, err := nosync.NewE2EStore(syncBasePath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Initialize chunk store (block-level dedup for delta uploads)
+	shareRoot := func(shareID string) (string, bool) {
+		share, ok := shareStore.GetByID(shareID)
+		return share.Path, ok
+	}
+	chunkStore, err := nosync.NewChunkStore(filepath.Join(syncBasePath, "chunks"), shareRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	// Initialize resumable upload sessions
+	uploads, err := nosync.NewUploadManager(filepath.Join(syncBasePath, "uploads"), shareRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	// Initialize version history (previous versions of overwritten files)
+	versions, err := nosync.NewVersionStore(filepath.Join(syncBasePath, "versions"), shareRoot, func(shareID string) nosync.VersionPolicy {
+		share, _ := shareStore.GetByID(shareID)
+		return versionPolicy(share)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Initialize share trash (deleted files kept for restore)
+	trash, err := nosync.NewTrashStore(filepath.Join(syncBasePath, "trash"), shareRoot, func(shareID string) nosync.TrashPolicy {
+		share, _ := shareStore.GetByID(shareID)
+		return trashPolicy(share)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Initialize public share links
+	links, err := nosync.NewShareLinkStore(filepath.Join(syncBasePath, "links"))
+	if err != nil {
+		return nil, err
+	}
+
+	h := &SyncHandler{
 		deviceMgr:          deviceMgr,
 		changeTracker:      changeTracker,
+		journals:           journals,
 		deltaSync:          deltaSync,
 		shareStore:         shareStore,
 		syncStore:          syncStore,
 		conflictStore:      conflictStore,
 		activityStore:      activityStore,
 		collaborationStore: collaborationStore,
+		e2eStore:           e2eStore,
+		chunkStore:         chunkStore,
+		uploads:            uploads,
+		versions:           versions,
+		trash:              trash,
+		links:              links,
 		logger:             logger.With().Str("component", "sync-handler").Logger(),
 		cfg:                cfg,
-	}, nil
+	}
+	uploads.BeforeReplace(func(s *nosync.UploadSession) {
+		h.keepVersion(s.ShareID, s.Path, s.DeviceID)
+	})
+	return h, nil
 }
 
 // Routes returns the chi router for sync endpoints
@@ -115,6 +208,29 @@ func (h *SyncHandler) Routes() chi.Router {
 		pr.Get("/files/{share_id}/metadata", h.GetFileMetadata)
 		pr.Post("/files/{share_id}/metadata", h.GetFilesMetadata)
 		pr.Post("/files/{share_id}/hash", h.GetBlockHashes)
+		pr.With(h.deviceActive).Post("/files/{share_id}/manifest", h.CommitManifest)
+
+		// Version history
+		pr.Get("/files/{share_id}/versions", h.ListVersions)
+		pr.Get("/files/{share_id}/versions/{version_id}", h.GetVersion)
+		pr.Get("/files/{share_id}/versions/{version_id}/download", h.DownloadVersion)
+		pr.With(h.deviceActive).Post("/files/{share_id}/versions/{version_id}/restore", h.RestoreVersion)
+
+		// Trash (purging is left to administrators)
+		pr.Get("/files/{share_id}/trash", h.ListTrash)
+		pr.With(h.deviceActive).Post("/files/{share_id}/trash/{item_id}/restore", h.RestoreTrash)
+
+		// Chunk store (delta uploads)
+		pr.Post("/chunks/missing", h.MissingChunks)
+		pr.With(h.deviceActive).Put("/chunks/{hash}", h.UploadChunk)
+
+		// Resumable uploads
+		pr.Get("/uploads", h.ListUploads)
+		pr.With(h.deviceActive).Post("/uploads", h.CreateUpload)
+		pr.Get("/uploads/{upload_id}", h.GetUpload)
+		pr.With(h.deviceActive).Put("/uploads/{upload_id}", h.WriteUpload)
+		pr.With(h.deviceActive).Post("/uploads/{upload_id}/finalize", h.FinalizeUpload)
+		pr.Delete("/uploads/{upload_id}", h.AbortUpload)
 
 		// Sync state
 		pr.Get("/state/{share_id}", h.GetSyncState)
@@ -144,6 +260,18 @@ func (h *SyncHandler) Routes() chi.Router {
 		pr.Post("/invites", h.CreateInvite)
 		pr.Put("/invites/{invite_id}/accept", h.AcceptInvite)
 		pr.Put("/invites/{invite_id}/decline", h.DeclineInvite)
+
+		// End-to-end encrypted shares
+		pr.Put("/e2e/device-key", h.EnrollE2EDevice)
+		pr.Get("/e2e/shares/{share_id}/keys", h.GetE2EShareKeys)
+		pr.Put("/e2e/shares/{share_id}/keys", h.PutE2EShareKeys)
+
+		// Public share links
+		pr.Get("/links", h.ListShareLinks)
+		pr.Post("/links", h.CreateShareLink)
+		pr.Get("/links/{link_id}", h.GetShareLink)
+		pr.Delete("/links/{link_id}", h.DeleteShareLink)
+		pr.Get("/links/{link_id}/access", h.GetShareLinkAccess)
 	})
 
 	return r
@@ -303,6 +431,13 @@ func (h *SyncHandler) RevokeDevice(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Its wrapped share keys go with it; the shares get a fresh key
+	if affected, err := h.e2eStore.RevokeDevice(deviceID); err != nil {
+		h.logger.Warn().Err(err).Str("device_id", deviceID).Msg("Failed to drop E2E keys of revoked device")
+	} else if len(affected) > 0 {
+		h.logger.Info().Str("device_id", deviceID).Strs("shares", affected).Msg("E2E share keys marked for rotation")
+	}
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -339,15 +474,7 @@ func (h *SyncHandler) ListSyncShares(w http.ResponseWriter, r *http.Request) {
 	var syncShares []nosync.SyncShare
 
 	for _, share := range allShares {
-		// Check if user has access (simplified - in production check ACLs)
-		accessible := false
-		for _, u := range share.Users {
-			if u == userID {
-				accessible = true
-				break
-			}
-		}
-		if !accessible && len(share.Users) > 0 {
+		if !shareAccessible(share, userID) {
 			continue
 		}
 
@@ -361,6 +488,7 @@ func (h *SyncHandler) ListSyncShares(w http.ResponseWriter, r *http.Request) {
 			SyncEnabled: true, // All shares are sync-enabled for now
 			TotalSize:   totalSize,
 			FileCount:   totalFiles,
+			E2E:         share.E2E,
 		})
 	}
 
@@ -370,6 +498,25 @@ func (h *SyncHandler) ListSyncShares(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// CanAccessShare reports whether a user may sync a share
+func (h *SyncHandler) CanAccessShare(userID, shareID string) bool {
+	share, ok := h.shareStore.GetByID(shareID)
+	return ok && shareAccessible(share, userID)
+}
+
+// shareAccessible checks share membership (simplified - in production check ACLs)
+func shareAccessible(share shares.Share, userID string) bool {
+	if len(share.Users) == 0 {
+		return true
+	}
+	for _, u := range share.Users {
+		if u == userID {
+			return true
+		}
+	}
+	return false
+}
+
 // GetSyncConfig handles GET /sync/config
 func (h *SyncHandler) GetSyncConfig(w http.ResponseWriter, r *http.Request) {
 	deviceID := r.Header.Get("X-Device-ID")
@@ -431,8 +578,12 @@ func (h *SyncHandler) GetChanges(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	response, err := h.changeTracker.GetChanges(share.Path, cursor, limit)
+	response, err := h.journals.GetChanges(share.ID, share.Path, cursor, limit)
 	if err != nil {
+		if errors.Is(err, nosync.ErrCursorExpired) {
+			httpx.WriteTypedError(w, http.StatusGone, "sync.cursor_expired", "Cursor expired, resync from an empty cursor", 0)
+			return
+		}
 		h.logger.Error().Err(err).Str("share_id", shareID).Msg("Failed to get changes")
 		httpx.WriteTypedError(w, http.StatusInternalServerError, "sync.changes_failed", err.Error(), 0)
 		return
@@ -520,14 +671,37 @@ func (h *SyncHandler) GetBlockHashes(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Blocks on disk are ciphertext; clients transfer whole files instead
+	if share.Encrypted {
+		httpx.WriteTypedError(w, http.StatusConflict, "sync.share_encrypted", "Block hashes are not available for encrypted shares", 0)
+		return
+	}
+
 	fullPath := filepath.Join(share.Path, req.Path)
-	response, err := h.deltaSync.ComputeBlockHashes(fullPath)
+	var response *nosync.BlockHashResponse
+	var err error
+	if req.Mode == nosync.ChunkModeCDC {
+		response, err = h.deltaSync.ComputeChunkHashes(fullPath, req.BlockSize)
+	} else {
+		response, err = h.deltaSync.ComputeBlockHashes(fullPath)
+	}
 	if err != nil {
 		h.logger.Error().Err(err).Str("path", req.Path).Msg("Failed to compute block hashes")
 		httpx.WriteTypedError(w, http.StatusInternalServerError, "sync.hash_failed", err.Error(), 0)
 		return
 	}
 
+	// Chunks of hashed files can be reused by manifest uploads
+	if response.Mode == nosync.ChunkModeCDC && h.chunksAllowed(share) {
+		if relPath, ok := shareRelPath(req.Path); ok {
+			if info, err := os.Stat(fullPath); err == nil && info.Size() == response.Size {
+				if err := h.chunkStore.IndexFile(share.ID, relPath, info, response.Blocks); err != nil {
+					h.logger.Warn().Err(err).Msg("Failed to index chunks")
+				}
+			}
+		}
+	}
+
 	response.Path = req.Path // Return relative path
 	writeJSON(w, response)
 }
@@ -582,6 +756,22 @@ func (h *SyncHandler) Stats() map[string]interface{} {
 	return h.deviceMgr.Stats()
 }
 
+// ChangeTracker returns the change tracker
+func (h *SyncHandler) ChangeTracker() *nosync.ChangeTracker {
+	return h.changeTracker
+}
+
+// Journals returns the change journal manager for use by other handlers
+func (h *SyncHandler) Journals() *nosync.JournalManager {
+	return h.journals
+}
+
+// UseEncryption lets chunked uploads tell which shares are being converted
+// to or from encryption at rest
+func (h *SyncHandler) UseEncryption(e *EncryptionHandler) {
+	h.encryption = e
+}
+
 // DeviceManager returns the device manager for use by other handlers
 func (h *SyncHandler) DeviceManager() *nosync.DeviceManager {
 	return h.deviceMgr
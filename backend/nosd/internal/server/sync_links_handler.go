@@ -0,0 +1,300 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"nithronos/backend/nosd/pkg/auth"
+	"nithronos/backend/nosd/pkg/httpx"
+	nosync "nithronos/backend/nosd/pkg/sync"
+)
+
+// maxLinkPassword bounds share link passwords
+const maxLinkPassword = 256
+
+// UseAudit records share link activity in the audit log
+func (h *SyncHandler) UseAudit(a *auth.AuditLogger) {
+	h.audit = a
+}
+
+// Links returns the store of public share links
+func (h *SyncHandler) Links() *nosync.ShareLinkStore {
+	return h.links
+}
+
+// shareLinkResponse is a share link as its owner sees it
+type shareLinkResponse struct {
+	*nosync.ShareLink
+	URL string `json:"url"`
+}
+
+func linkResponse(l *nosync.ShareLink) shareLinkResponse {
+	return shareLinkResponse{ShareLink: l, URL: "/s/" + l.Token}
+}
+
+func linkResponses(list []*nosync.ShareLink) []shareLinkResponse {
+	out := make([]shareLinkResponse, len(list))
+	for i, l := range list {
+		out[i] = linkResponse(l)
+	}
+	return out
+}
+
+// auditLink records share link activity. Owners act as users; visitors are
+// only known by their address.
+func auditLink(al *auth.AuditLogger, r *http.Request, ip, userID string, link *nosync.ShareLink, code string, success bool, message string, details map[string]interface{}) {
+	if al == nil {
+		return
+	}
+	event := &auth.AuditEvent{
+		UserID:    userID,
+		IP:        ip,
+		UserAgent: r.UserAgent(),
+		Code:      code,
+		Category:  "sharelink",
+		Severity:  "info",
+		Success:   success,
+		Message:   message,
+		Details:   details,
+	}
+	if !success {
+		event.Severity = "warning"
+	}
+	if link != nil {
+		event.Target = link.ID
+		if event.Details == nil {
+			event.Details = map[string]interface{}{}
+		}
+		event.Details["share_id"] = link.ShareID
+		event.Details["link_path"] = link.Path
+	}
+	al.LogEvent(event)
+}
+
+// linkRelPath cleans a share-relative path for a link; "" is the share root
+func linkRelPath(p string) (string, bool) {
+	rel := strings.TrimPrefix(filepath.ToSlash(filepath.Clean("/"+p)), "/")
+	return rel, !nosync.IsServerPath(rel)
+}
+
+// createShareLinkRequest is the body of POST /sync/links
+type createShareLinkRequest struct {
+	ShareID      string     `json:"share_id"`
+	Path         string     `json:"path"`
+	Password     string     `json:"password,omitempty"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	MaxDownloads int        `json:"max_downloads,omitempty"`
+	FileDrop     bool       `json:"file_drop,omitempty"`
+}
+
+// ownLink returns a link created by the device's user
+func (h *SyncHandler) ownLink(w http.ResponseWriter, r *http.Request) (*nosync.ShareLink, bool) {
+	l, err := h.links.Get(chi.URLParam(r, "link_id"))
+	if err != nil || l.CreatedBy != r.Header.Get("X-Device-User-ID") {
+		httpx.WriteTypedError(w, http.StatusNotFound, "sharelink.not_found", "Share link not found", 0)
+		return nil, false
+	}
+	return l, true
+}
+
+// ListShareLinks handles GET /sync/links
+func (h *SyncHandler) ListShareLinks(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-Device-User-ID")
+	shareID := r.URL.Query().Get("share_id")
+	links := h.links.List(func(l *nosync.ShareLink) bool {
+		return l.CreatedBy == userID && (shareID == "" || l.ShareID == shareID)
+	})
+	writeJSON(w, map[string]interface{}{
+		"links": linkResponses(links),
+		"count": len(links),
+	})
+}
+
+// CreateShareLink handles POST /sync/links
+func (h *SyncHandler) CreateShareLink(w http.ResponseWriter, r *http.Request) {
+	var req createShareLinkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpx.WriteTypedError(w, http.StatusBadRequest, "input.invalid", "Invalid request body", 0)
+		return
+	}
+	userID := r.Header.Get("X-Device-User-ID")
+
+	share, ok := h.shareStore.GetByID(req.ShareID)
+	if !ok {
+		httpx.WriteTypedError(w, http.StatusNotFound, "share.not_found", "Share not found", 0)
+		return
+	}
+	if !shareAccessible(share, userID) {
+		httpx.WriteTypedError(w, http.StatusForbidden, "auth.forbidden", "Not authorized", 0)
+		return
+	}
+	if share.E2E {
+		httpx.WriteTypedError(w, http.StatusConflict, "sync.share_e2e", "Files of end-to-end encrypted shares cannot be shared by link", 0)
+		return
+	}
+	relPath, ok := linkRelPath(req.Path)
+	if !ok {
+		httpx.WriteTypedError(w, http.StatusBadRequest, "input.invalid", "Invalid path", 0)
+		return
+	}
+	info, err := os.Stat(filepath.Join(share.Path, filepath.FromSlash(relPath)))
+	if err != nil {
+		httpx.WriteTypedError(w, http.StatusNotFound, "sync.path_not_found", "Path not found in share", 0)
+		return
+	}
+	switch {
+	case len(req.Password) > maxLinkPassword:
+		httpx.WriteTypedError(w, http.StatusBadRequest, "input.invalid", "Password is too long", 0)
+		return
+	case req.MaxDownloads < 0:
+		httpx.WriteTypedError(w, http.StatusBadRequest, "input.invalid", "max_downloads must not be negative", 0)
+		return
+	case req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()):
+		httpx.WriteTypedError(w, http.StatusBadRequest, "input.invalid", "expires_at must be in the future", 0)
+		return
+	}
+	if req.FileDrop {
+		if !info.IsDir() {
+			httpx.WriteTypedError(w, http.StatusBadRequest, "input.invalid", "File drops need a folder", 0)
+			return
+		}
+		if share.RO {
+			httpx.WriteTypedError(w, http.StatusForbidden, "share.read_only", "Share is read-only", 0)
+			return
+		}
+		req.MaxDownloads = 0
+	}
+
+	link, err := h.links.Create(nosync.ShareLink{
+		ShareID:      share.ID,
+		Path:         relPath,
+		IsDir:        info.IsDir(),
+		FileDrop:     req.FileDrop,
+		ExpiresAt:    req.ExpiresAt,
+		MaxDownloads: req.MaxDownloads,
+		CreatedBy:    userID,
+		DeviceID:     r.Header.Get("X-Device-ID"),
+	}, req.Password)
+	if err != nil {
+		h.logger.Error().Err(err).Msg("Failed to create share link")
+		httpx.WriteTypedError(w, http.StatusInternalServerError, "sharelink.create_failed", err.Error(), 0)
+		return
+	}
+	auditLink(h.audit, r, clientIP(r, h.cfg), userID, link, auth.AuditShareLinkCreate, true, "Share link created", map[string]interface{}{
+		"file_drop":     link.FileDrop,
+		"protected":     link.HasPassword,
+		"max_downloads": link.MaxDownloads,
+	})
+
+	h.logger.Info().
+		Str("link_id", link.ID).
+		Str("share_id", link.ShareID).
+		Str("path", link.Path).
+		Bool("file_drop", link.FileDrop).
+		Msg("Share link created")
+	respondJSON(w, http.StatusCreated, linkResponse(link))
+}
+
+// GetShareLink handles GET /sync/links/{link_id}
+func (h *SyncHandler) GetShareLink(w http.ResponseWriter, r *http.Request) {
+	link, ok := h.ownLink(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, linkResponse(link))
+}
+
+// DeleteShareLink handles DELETE /sync/links/{link_id}
+func (h *SyncHandler) DeleteShareLink(w http.ResponseWriter, r *http.Request) {
+	link, ok := h.ownLink(w, r)
+	if !ok {
+		return
+	}
+	h.deleteLink(w, r, link)
+}
+
+// deleteLink revokes a link
+func (h *SyncHandler) deleteLink(w http.ResponseWriter, r *http.Request, link *nosync.ShareLink) {
+	if err := h.links.Delete(link.ID); err != nil {
+		if errors.Is(err, nosync.ErrLinkNotFound) {
+			httpx.WriteTypedError(w, http.StatusNotFound, "sharelink.not_found", "Share link not found", 0)
+			return
+		}
+		httpx.WriteTypedError(w, http.StatusInternalServerError, "sharelink.delete_failed", err.Error(), 0)
+		return
+	}
+	userID := r.Header.Get("X-Device-User-ID")
+	if userID == "" {
+		userID = r.Header.Get("X-UID")
+	}
+	auditLink(h.audit, r, clientIP(r, h.cfg), userID, link, auth.AuditShareLinkDelete, true, "Share link deleted", nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetShareLinkAccess handles GET /sync/links/{link_id}/access
+func (h *SyncHandler) GetShareLinkAccess(w http.ResponseWriter, r *http.Request) {
+	link, ok := h.ownLink(w, r)
+	if !ok {
+		return
+	}
+	limit := 100
+	if v, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && v > 0 && v <= 1000 {
+		limit = v
+	}
+
+	events := []auth.AuditEvent{}
+	if h.audit != nil {
+		all, _, err := h.audit.Query(auth.AuditLogQuery{
+			Category: "sharelink",
+			Target:   link.ID,
+			From:     link.CreatedAt.Add(-time.Minute),
+			To:       time.Now().Add(time.Minute),
+		})
+		if err != nil {
+			httpx.WriteTypedError(w, http.StatusInternalServerError, "audit.query_failed", err.Error(), 0)
+			return
+		}
+		sort.Slice(all, func(i, j int) bool { return all[i].Timestamp.After(all[j].Timestamp) })
+		if len(all) > limit {
+			all = all[:limit]
+		}
+		events = all
+	}
+	writeJSON(w, map[string]interface{}{
+		"link_id": link.ID,
+		"events":  events,
+		"count":   len(events),
+	})
+}
+
+// AdminListShareLinks handles GET /sync/admin/links
+func (h *SyncHandler) AdminListShareLinks(w http.ResponseWriter, r *http.Request) {
+	shareID := r.URL.Query().Get("share_id")
+	userID := r.URL.Query().Get("user_id")
+	links := h.links.List(func(l *nosync.ShareLink) bool {
+		return (shareID == "" || l.ShareID == shareID) && (userID == "" || l.CreatedBy == userID)
+	})
+	writeJSON(w, map[string]interface{}{
+		"links": linkResponses(links),
+		"count": len(links),
+	})
+}
+
+// AdminDeleteShareLink handles DELETE /sync/admin/links/{link_id}
+func (h *SyncHandler) AdminDeleteShareLink(w http.ResponseWriter, r *http.Request) {
+	link, err := h.links.Get(chi.URLParam(r, "link_id"))
+	if err != nil {
+		httpx.WriteTypedError(w, http.StatusNotFound, "sharelink.not_found", "Share link not found", 0)
+		return
+	}
+	h.deleteLink(w, r, link)
+}
@@ -0,0 +1,320 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"nithronos/backend/nosd/internal/notifications"
+	"nithronos/backend/nosd/internal/shares"
+	"nithronos/backend/nosd/pkg/httpx"
+	nosync "nithronos/backend/nosd/pkg/sync"
+)
+
+// trashPolicy returns the trash setting of a share
+func trashPolicy(share shares.Share) nosync.TrashPolicy {
+	if share.Trash == nil {
+		return nosync.DefaultTrashPolicy()
+	}
+	return nosync.TrashPolicy{
+		Enabled:   share.Trash.Enabled,
+		Retention: time.Duration(share.Trash.RetentionDays) * 24 * time.Hour,
+	}
+}
+
+// trashResponse is the trash setting of a share as the API reports it
+func trashResponse(share shares.Share) shares.Trash {
+	p := trashPolicy(share)
+	return shares.Trash{
+		Enabled:       p.Enabled,
+		RetentionDays: int(p.Retention / (24 * time.Hour)),
+	}
+}
+
+// Trash returns the store of deleted share files
+func (h *SyncHandler) Trash() *nosync.TrashStore {
+	return h.trash
+}
+
+// UseNotifications tells administrators when the mass-delete breaker
+// pauses a device
+func (h *SyncHandler) UseNotifications(m *notifications.Manager) {
+	h.deviceMgr.OnPause(func(device *nosync.DeviceToken) {
+		_ = m.Send(&notifications.Notification{
+			Type:     "warning",
+			Category: "security",
+			Title:    "Sync device paused",
+			Message:  "Device " + device.DeviceName + " " + device.Paused.Reason + ". Its changes are on hold until an administrator resumes it; deleted files are in the share trash.",
+			Details: map[string]interface{}{
+				"device_id": device.ID,
+				"user_id":   device.UserID,
+				"deletes":   device.Paused.Deletes,
+			},
+		})
+	})
+}
+
+// deviceActive refuses changes from devices paused by the mass-delete
+// breaker
+func (h *SyncHandler) deviceActive(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if pause := h.deviceMgr.PauseOf(r.Header.Get("X-Device-ID")); pause != nil {
+			httpx.WriteErrorWithDetails(w, http.StatusLocked, "sync.device_paused",
+				"Device is paused: "+pause.Reason+"; an administrator must resume it",
+				map[string]interface{}{"paused": pause})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeTrashError maps trash store errors to responses
+func (h *SyncHandler) writeTrashError(w http.ResponseWriter, err error) {
+	if errors.Is(err, nosync.ErrTrashItemNotFound) {
+		httpx.WriteTypedError(w, http.StatusNotFound, "sync.trash_not_found", "Trash item not found", 0)
+		return
+	}
+	h.logger.Error().Err(err).Msg("Trash operation failed")
+	httpx.WriteTypedError(w, http.StatusInternalServerError, "sync.trash_failed", err.Error(), 0)
+}
+
+// listTrash writes the trash of a share
+func (h *SyncHandler) listTrash(w http.ResponseWriter, share shares.Share) {
+	items := h.trash.List(share.ID)
+	writeJSON(w, map[string]interface{}{
+		"items": items,
+		"count": len(items),
+		"trash": trashResponse(share),
+	})
+}
+
+// restoreTrash restores an item and journals it, so devices download it
+// again
+func (h *SyncHandler) restoreTrash(w http.ResponseWriter, r *http.Request, share shares.Share, deviceID string) {
+	item, restored, err := h.trash.Restore(share.ID, chi.URLParam(r, "item_id"))
+	if err != nil {
+		h.writeTrashError(w, err)
+		return
+	}
+	if err := h.journals.RecordTree(share.ID, share.Path, deviceID, restored); err != nil {
+		h.logger.Warn().Err(err).Str("share_id", share.ID).Msg("Failed to journal restored trash item")
+	}
+
+	h.logger.Info().
+		Str("share_id", share.ID).
+		Str("path", restored).
+		Str("item_id", item.ID).
+		Msg("Trash item restored")
+	writeJSON(w, map[string]interface{}{
+		"item":          item,
+		"restored_path": restored,
+	})
+}
+
+// ListTrash handles GET /sync/files/{share_id}/trash
+func (h *SyncHandler) ListTrash(w http.ResponseWriter, r *http.Request) {
+	share, ok := h.versionShare(w, r)
+	if !ok {
+		return
+	}
+	h.listTrash(w, share)
+}
+
+// RestoreTrash handles POST /sync/files/{share_id}/trash/{item_id}/restore
+func (h *SyncHandler) RestoreTrash(w http.ResponseWriter, r *http.Request) {
+	share, ok := h.versionShare(w, r)
+	if !ok {
+		return
+	}
+	if share.RO {
+		httpx.WriteTypedError(w, http.StatusForbidden, "share.read_only", "Share is read-only", 0)
+		return
+	}
+	h.restoreTrash(w, r, share, r.Header.Get("X-Device-ID"))
+}
+
+// adminShare returns the share named in the URL
+func (h *SyncHandler) adminShare(w http.ResponseWriter, r *http.Request) (shares.Share, bool) {
+	share, ok := h.shareStore.GetByID(chi.URLParam(r, "share_id"))
+	if !ok {
+		httpx.WriteTypedError(w, http.StatusNotFound, "share.not_found", "Share not found", 0)
+	}
+	return share, ok
+}
+
+// GetShareTrashPolicy handles GET /sync/admin/shares/{share_id}/trash-policy
+func (h *SyncHandler) GetShareTrashPolicy(w http.ResponseWriter, r *http.Request) {
+	share, ok := h.adminShare(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, trashResponse(share))
+}
+
+// UpdateShareTrashPolicy handles PUT /sync/admin/shares/{share_id}/trash-policy
+func (h *SyncHandler) UpdateShareTrashPolicy(w http.ResponseWriter, r *http.Request) {
+	share, ok := h.adminShare(w, r)
+	if !ok {
+		return
+	}
+	var req shares.Trash
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpx.WriteTypedError(w, http.StatusBadRequest, "input.invalid", "Invalid request body", 0)
+		return
+	}
+	if req.RetentionDays < 0 || req.RetentionDays > maxVersioningDays {
+		httpx.WriteTypedError(w, http.StatusBadRequest, "input.invalid", "retention_days must be between 0 and 3650", 0)
+		return
+	}
+
+	share.Trash = &req
+	if err := h.shareStore.Update(share); err != nil {
+		httpx.WriteTypedError(w, http.StatusInternalServerError, "share.update_failed", err.Error(), 0)
+		return
+	}
+	// Apply a shorter retention to what is already in the trash
+	if err := h.trash.Expire(); err != nil {
+		h.logger.Warn().Err(err).Msg("Failed to expire trash")
+	}
+
+	h.logger.Info().
+		Str("share_id", share.ID).
+		Bool("enabled", req.Enabled).
+		Int("retention_days", req.RetentionDays).
+		Msg("Share trash policy updated")
+	writeJSON(w, trashResponse(share))
+}
+
+// AdminListTrash handles GET /sync/admin/shares/{share_id}/trash
+func (h *SyncHandler) AdminListTrash(w http.ResponseWriter, r *http.Request) {
+	share, ok := h.adminShare(w, r)
+	if !ok {
+		return
+	}
+	h.listTrash(w, share)
+}
+
+// AdminRestoreTrash handles POST /sync/admin/shares/{share_id}/trash/{item_id}/restore
+func (h *SyncHandler) AdminRestoreTrash(w http.ResponseWriter, r *http.Request) {
+	share, ok := h.adminShare(w, r)
+	if !ok {
+		return
+	}
+	h.restoreTrash(w, r, share, "")
+}
+
+// AdminPurgeTrash handles DELETE /sync/admin/shares/{share_id}/trash/{item_id}
+func (h *SyncHandler) AdminPurgeTrash(w http.ResponseWriter, r *http.Request) {
+	share, ok := h.adminShare(w, r)
+	if !ok {
+		return
+	}
+	if err := h.trash.Purge(share.ID, chi.URLParam(r, "item_id")); err != nil {
+		h.writeTrashError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AdminEmptyTrash handles DELETE /sync/admin/shares/{share_id}/trash
+func (h *SyncHandler) AdminEmptyTrash(w http.ResponseWriter, r *http.Request) {
+	share, ok := h.adminShare(w, r)
+	if !ok {
+		return
+	}
+	n, err := h.trash.Empty(share.ID)
+	if err != nil {
+		h.writeTrashError(w, err)
+		return
+	}
+	h.logger.Info().Str("share_id", share.ID).Int("items", n).Msg("Share trash emptied")
+	writeJSON(w, map[string]int{"purged": n})
+}
+
+// AdminExpireTrash handles POST /sync/admin/trash/expire
+func (h *SyncHandler) AdminExpireTrash(w http.ResponseWriter, r *http.Request) {
+	if err := h.trash.Expire(); err != nil {
+		h.writeTrashError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// pausedDevice is a paused device as administrators see it
+type pausedDevice struct {
+	nosync.DeviceTokenPublic
+	UserID string `json:"user_id"`
+}
+
+// AdminListPausedDevices handles GET /sync/admin/devices/paused
+func (h *SyncHandler) AdminListPausedDevices(w http.ResponseWriter, r *http.Request) {
+	devices := h.deviceMgr.PausedDevices()
+	out := make([]pausedDevice, len(devices))
+	for i, d := range devices {
+		out[i] = pausedDevice{DeviceTokenPublic: d.ToPublic(), UserID: d.UserID}
+	}
+	writeJSON(w, map[string]interface{}{
+		"devices": out,
+		"count":   len(out),
+	})
+}
+
+// AdminResumeDevice handles POST /sync/admin/devices/{device_id}/resume. The
+// admin either confirms the deletes or, with restore set, puts back what the
+// device deleted within the breaker window before resuming it.
+func (h *SyncHandler) AdminResumeDevice(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Restore bool `json:"restore"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpx.WriteTypedError(w, http.StatusBadRequest, "input.invalid", "Invalid request body", 0)
+			return
+		}
+	}
+	deviceID := chi.URLParam(r, "device_id")
+	pause := h.deviceMgr.PauseOf(deviceID)
+	if pause == nil {
+		httpx.WriteTypedError(w, http.StatusNotFound, "sync.device_not_paused", "Device is not paused", 0)
+		return
+	}
+
+	restored := 0
+	if req.Restore {
+		since := pause.PausedAt.Add(-time.Duration(pause.WindowSeconds) * time.Second)
+		for _, share := range h.shareStore.List() {
+			for _, item := range h.trash.List(share.ID) {
+				if item.DeviceID != deviceID || item.DeletedAt.Before(since) {
+					continue
+				}
+				_, path, err := h.trash.Restore(share.ID, item.ID)
+				if err != nil {
+					h.logger.Warn().Err(err).Str("item_id", item.ID).Msg("Failed to restore trash item")
+					continue
+				}
+				if err := h.journals.RecordTree(share.ID, share.Path, "", path); err != nil {
+					h.logger.Warn().Err(err).Str("share_id", share.ID).Msg("Failed to journal restored trash item")
+				}
+				restored++
+			}
+		}
+	}
+
+	device, err := h.deviceMgr.ResumeDevice(deviceID)
+	if err != nil {
+		httpx.WriteTypedError(w, http.StatusNotFound, "sync.device_not_paused", err.Error(), 0)
+		return
+	}
+	h.logger.Info().
+		Str("device_id", deviceID).
+		Bool("restore", req.Restore).
+		Int("restored", restored).
+		Msg("Sync device resumed")
+	writeJSON(w, map[string]interface{}{
+		"device":   pausedDevice{DeviceTokenPublic: device.ToPublic(), UserID: device.UserID},
+		"restored": restored,
+	})
+}
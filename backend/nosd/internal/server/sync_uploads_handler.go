@@ -0,0 +1,199 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"nithronos/backend/nosd/pkg/httpx"
+	nosync "nithronos/backend/nosd/pkg/sync"
+)
+
+// maxUploadRequestSize bounds the data of one upload chunk request
+const maxUploadRequestSize = 64 << 20
+
+// uploadOffsetHeader carries the offset of an upload chunk (as in tus)
+const uploadOffsetHeader = "Upload-Offset"
+
+// validSHA256 reports whether s is a hex SHA-256
+func validSHA256(s string) bool {
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == sha256.Size
+}
+
+// writeUploadError maps upload manager errors to responses
+func (h *SyncHandler) writeUploadError(w http.ResponseWriter, s *nosync.UploadSession, err error) {
+	switch {
+	case errors.Is(err, nosync.ErrUploadNotFound):
+		httpx.WriteTypedError(w, http.StatusNotFound, "sync.upload_not_found", "Upload session not found", 0)
+	case errors.Is(err, nosync.ErrUploadOffsetMismatch), errors.Is(err, nosync.ErrUploadIncomplete):
+		code := "sync.upload_offset_mismatch"
+		if errors.Is(err, nosync.ErrUploadIncomplete) {
+			code = "sync.upload_incomplete"
+		}
+		if s == nil {
+			s = &nosync.UploadSession{}
+		}
+		w.Header().Set(uploadOffsetHeader, strconv.FormatInt(s.Offset, 10))
+		httpx.WriteErrorWithDetails(w, http.StatusConflict, code, err.Error(), map[string]any{
+			"offset": s.Offset,
+		})
+	case errors.Is(err, nosync.ErrUploadBusy):
+		httpx.WriteTypedError(w, http.StatusConflict, "sync.upload_busy", err.Error(), 0)
+	case errors.Is(err, nosync.ErrUploadTooLarge):
+		if s != nil {
+			w.Header().Set(uploadOffsetHeader, strconv.FormatInt(s.Offset, 10))
+		}
+		httpx.WriteTypedError(w, http.StatusRequestEntityTooLarge, "sync.upload_too_large", err.Error(), 0)
+	case errors.Is(err, nosync.ErrUploadHashMismatch):
+		httpx.WriteTypedError(w, http.StatusUnprocessableEntity, "sync.hash_mismatch", err.Error(), 0)
+	default:
+		h.logger.Error().Err(err).Msg("Upload failed")
+		httpx.WriteTypedError(w, http.StatusInternalServerError, "sync.upload_failed", err.Error(), 0)
+	}
+}
+
+// CreateUpload handles POST /sync/uploads
+func (h *SyncHandler) CreateUpload(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ShareID string     `json:"share_id"`
+		Path    string     `json:"path"`
+		Size    int64      `json:"size"`
+		Hash    string     `json:"hash"`
+		MTime   *time.Time `json:"mtime"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpx.WriteTypedError(w, http.StatusBadRequest, "input.invalid", "Invalid request body", 0)
+		return
+	}
+	relPath, ok := shareRelPath(req.Path)
+	if !ok || req.Size < 0 {
+		httpx.WriteTypedError(w, http.StatusBadRequest, "input.invalid", "path and a non-negative size are required", 0)
+		return
+	}
+	if req.Hash != "" && !validSHA256(req.Hash) {
+		httpx.WriteTypedError(w, http.StatusBadRequest, "input.invalid", "hash must be a hex SHA-256", 0)
+		return
+	}
+	share, ok := h.chunkShare(w, r, req.ShareID)
+	if !ok {
+		return
+	}
+
+	session, err := h.uploads.Create(&nosync.UploadSession{
+		ShareID:  share.ID,
+		DeviceID: r.Header.Get("X-Device-ID"),
+		UserID:   r.Header.Get("X-Device-User-ID"),
+		Path:     relPath,
+		Size:     req.Size,
+		Hash:     req.Hash,
+		MTime:    req.MTime,
+	})
+	if err != nil {
+		h.writeUploadError(w, nil, err)
+		return
+	}
+	w.Header().Set("Location", "/api/v1/sync/uploads/"+session.ID)
+	w.Header().Set(uploadOffsetHeader, "0")
+	respondJSON(w, http.StatusCreated, session)
+}
+
+// ListUploads handles GET /sync/uploads
+func (h *SyncHandler) ListUploads(w http.ResponseWriter, r *http.Request) {
+	sessions := h.uploads.List(r.Header.Get("X-Device-ID"))
+	writeJSON(w, map[string]interface{}{
+		"uploads": sessions,
+		"count":   len(sessions),
+	})
+}
+
+// GetUpload handles GET /sync/uploads/{upload_id}
+func (h *SyncHandler) GetUpload(w http.ResponseWriter, r *http.Request) {
+	session, err := h.uploads.Get(chi.URLParam(r, "upload_id"), r.Header.Get("X-Device-ID"))
+	if err != nil {
+		h.writeUploadError(w, nil, err)
+		return
+	}
+	w.Header().Set(uploadOffsetHeader, strconv.FormatInt(session.Offset, 10))
+	writeJSON(w, session)
+}
+
+// uploadSession loads a session and re-checks the device may still write
+// to its share
+func (h *SyncHandler) uploadSession(w http.ResponseWriter, r *http.Request) (*nosync.UploadSession, bool) {
+	session, err := h.uploads.Get(chi.URLParam(r, "upload_id"), r.Header.Get("X-Device-ID"))
+	if err != nil {
+		h.writeUploadError(w, nil, err)
+		return nil, false
+	}
+	if _, ok := h.chunkShare(w, r, session.ShareID); !ok {
+		return nil, false
+	}
+	return session, true
+}
+
+// WriteUpload handles PUT /sync/uploads/{upload_id}. The Upload-Offset
+// header must equal the session's offset; the body is appended there.
+func (h *SyncHandler) WriteUpload(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.uploadSession(w, r)
+	if !ok {
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get(uploadOffsetHeader), 10, 64)
+	if err != nil || offset < 0 {
+		httpx.WriteTypedError(w, http.StatusBadRequest, "input.invalid", "Upload-Offset header is required", 0)
+		return
+	}
+
+	session, err = h.uploads.Write(session.ID, session.DeviceID, offset, r.Body, maxUploadRequestSize)
+	if err != nil {
+		h.writeUploadError(w, session, err)
+		return
+	}
+	w.Header().Set(uploadOffsetHeader, strconv.FormatInt(session.Offset, 10))
+	writeJSON(w, session)
+}
+
+// FinalizeUpload handles POST /sync/uploads/{upload_id}/finalize
+func (h *SyncHandler) FinalizeUpload(w http.ResponseWriter, r *http.Request) {
+	session, ok := h.uploadSession(w, r)
+	if !ok {
+		return
+	}
+	share, _ := h.shareStore.GetByID(session.ShareID)
+
+	session, err := h.uploads.Finalize(session.ID, session.DeviceID)
+	if err != nil {
+		h.writeUploadError(w, session, err)
+		return
+	}
+
+	if err := h.journals.RecordPath(share.ID, share.Path, session.DeviceID, session.Path); err != nil {
+		h.logger.Warn().Err(err).Str("share_id", share.ID).Msg("Failed to journal finalized upload")
+	}
+	if err := h.chunkStore.ForgetFile(share.ID, session.Path); err != nil {
+		h.logger.Warn().Err(err).Msg("Failed to update chunk index")
+	}
+
+	h.logger.Debug().
+		Str("share_id", share.ID).
+		Str("path", session.Path).
+		Int64("size", session.Size).
+		Msg("Resumable upload finalized")
+	writeJSON(w, session)
+}
+
+// AbortUpload handles DELETE /sync/uploads/{upload_id}
+func (h *SyncHandler) AbortUpload(w http.ResponseWriter, r *http.Request) {
+	if err := h.uploads.Abort(chi.URLParam(r, "upload_id"), r.Header.Get("X-Device-ID")); err != nil {
+		h.writeUploadError(w, nil, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
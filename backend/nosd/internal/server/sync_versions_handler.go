@@ -0,0 +1,317 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"nithronos/backend/nosd/internal/shares"
+	"nithronos/backend/nosd/pkg/httpx"
+	nosync "nithronos/backend/nosd/pkg/sync"
+)
+
+// maxVersioningDays bounds the configurable version age (ten years)
+const maxVersioningDays = 3650
+
+// versionPolicy returns the version retention of a share
+func versionPolicy(share shares.Share) nosync.VersionPolicy {
+	if share.Versioning == nil {
+		return nosync.DefaultVersionPolicy()
+	}
+	return nosync.VersionPolicy{
+		Enabled:     share.Versioning.Enabled,
+		MaxVersions: share.Versioning.MaxVersions,
+		MaxAge:      time.Duration(share.Versioning.MaxAgeDays) * 24 * time.Hour,
+	}
+}
+
+// versioningResponse is the retention of a share as the API reports it
+func versioningResponse(share shares.Share) shares.Versioning {
+	p := versionPolicy(share)
+	return shares.Versioning{
+		Enabled:     p.Enabled,
+		MaxVersions: p.MaxVersions,
+		MaxAgeDays:  int(p.MaxAge / (24 * time.Hour)),
+	}
+}
+
+// Versions returns the store of previous file versions
+func (h *SyncHandler) Versions() *nosync.VersionStore {
+	return h.versions
+}
+
+// keepVersion keeps the current content of a file that is about to be
+// replaced. Failing to keep it does not block the write.
+func (h *SyncHandler) keepVersion(shareID, relPath, deviceID string) {
+	if _, err := h.versions.Capture(shareID, relPath, deviceID, nosync.VersionReasonOverwrite); err != nil {
+		h.logger.Warn().Err(err).Str("share_id", shareID).Str("path", relPath).Msg("Failed to keep previous version")
+	}
+}
+
+// AdminRoutes returns the chi router for sync administration endpoints
+func (h *SyncHandler) AdminRoutes() chi.Router {
+	r := chi.NewRouter()
+
+	// Version history
+	r.Get("/shares/{share_id}/versioning", h.GetShareVersioning)
+	r.Put("/shares/{share_id}/versioning", h.UpdateShareVersioning)
+	r.Get("/shares/{share_id}/versions", h.AdminListVersions)
+	r.Post("/shares/{share_id}/versions/{version_id}/restore", h.AdminRestoreVersion)
+
+	// Trash
+	r.Get("/shares/{share_id}/trash-policy", h.GetShareTrashPolicy)
+	r.Put("/shares/{share_id}/trash-policy", h.UpdateShareTrashPolicy)
+	r.Get("/shares/{share_id}/trash", h.AdminListTrash)
+	r.Delete("/shares/{share_id}/trash", h.AdminEmptyTrash)
+	r.Post("/shares/{share_id}/trash/{item_id}/restore", h.AdminRestoreTrash)
+	r.Delete("/shares/{share_id}/trash/{item_id}", h.AdminPurgeTrash)
+	r.Post("/trash/expire", h.AdminExpireTrash)
+
+	// Mass-delete breaker
+	r.Get("/devices/paused", h.AdminListPausedDevices)
+	r.Post("/devices/{device_id}/resume", h.AdminResumeDevice)
+
+	// Public share links
+	r.Get("/links", h.AdminListShareLinks)
+	r.Delete("/links/{link_id}", h.AdminDeleteShareLink)
+
+	return r
+}
+
+// versionShare returns a share the device's user may access
+func (h *SyncHandler) versionShare(w http.ResponseWriter, r *http.Request) (shares.Share, bool) {
+	share, ok := h.shareStore.GetByID(chi.URLParam(r, "share_id"))
+	if !ok {
+		httpx.WriteTypedError(w, http.StatusNotFound, "share.not_found", "Share not found", 0)
+		return shares.Share{}, false
+	}
+	if !shareAccessible(share, r.Header.Get("X-Device-User-ID")) {
+		httpx.WriteTypedError(w, http.StatusForbidden, "auth.forbidden", "Not authorized", 0)
+		return shares.Share{}, false
+	}
+	return share, true
+}
+
+// decodedAtRest reports whether a share's files may be stored encrypted at
+// rest and must be decrypted for clients
+func (h *SyncHandler) decodedAtRest(share shares.Share) bool {
+	return h.encryption != nil && !h.chunksAllowed(share)
+}
+
+// logicalVersion reports a version with the size clients see
+func (h *SyncHandler) logicalVersion(share shares.Share, v *nosync.StoredVersion) *nosync.StoredVersion {
+	if !h.decodedAtRest(share) {
+		return v
+	}
+	_, f, err := h.versions.Open(share.ID, v.ID)
+	if err != nil {
+		return v
+	}
+	defer f.Close()
+	if size, err := h.encryption.ContentDecoder().Size(f, v.Size); err == nil {
+		v.Size = size
+	}
+	return v
+}
+
+// writeVersionError maps version store errors to responses
+func (h *SyncHandler) writeVersionError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, nosync.ErrVersionNotFound):
+		httpx.WriteTypedError(w, http.StatusNotFound, "sync.version_not_found", "Version not found", 0)
+	case errors.Is(err, errEncryptionLocked):
+		httpx.WriteTypedError(w, http.StatusLocked, "sync.encryption_locked", err.Error(), 0)
+	default:
+		h.logger.Error().Err(err).Msg("Version operation failed")
+		httpx.WriteTypedError(w, http.StatusInternalServerError, "sync.version_failed", err.Error(), 0)
+	}
+}
+
+// listVersions writes the versions of the file named by the path query
+func (h *SyncHandler) listVersions(w http.ResponseWriter, r *http.Request, share shares.Share) {
+	relPath, ok := shareRelPath(r.URL.Query().Get("path"))
+	if !ok {
+		httpx.WriteTypedError(w, http.StatusBadRequest, "input.invalid", "path is required", 0)
+		return
+	}
+	versions := h.versions.List(share.ID, relPath)
+	for _, v := range versions {
+		h.logicalVersion(share, v)
+	}
+	writeJSON(w, map[string]interface{}{
+		"path":       relPath,
+		"versions":   versions,
+		"count":      len(versions),
+		"versioning": versioningResponse(share),
+	})
+}
+
+// restoreVersion restores a version and journals the change
+func (h *SyncHandler) restoreVersion(w http.ResponseWriter, r *http.Request, share shares.Share, deviceID string) {
+	v, err := h.versions.Restore(share.ID, chi.URLParam(r, "version_id"), deviceID)
+	if err != nil {
+		h.writeVersionError(w, err)
+		return
+	}
+	if err := h.journals.RecordPath(share.ID, share.Path, deviceID, v.Path); err != nil {
+		h.logger.Warn().Err(err).Str("share_id", share.ID).Msg("Failed to journal restored version")
+	}
+	if err := h.chunkStore.ForgetFile(share.ID, v.Path); err != nil {
+		h.logger.Warn().Err(err).Msg("Failed to update chunk index")
+	}
+
+	h.logger.Info().
+		Str("share_id", share.ID).
+		Str("path", v.Path).
+		Str("version_id", v.ID).
+		Msg("File version restored")
+	writeJSON(w, h.logicalVersion(share, v))
+}
+
+// ListVersions handles GET /sync/files/{share_id}/versions
+func (h *SyncHandler) ListVersions(w http.ResponseWriter, r *http.Request) {
+	share, ok := h.versionShare(w, r)
+	if !ok {
+		return
+	}
+	h.listVersions(w, r, share)
+}
+
+// GetVersion handles GET /sync/files/{share_id}/versions/{version_id}
+func (h *SyncHandler) GetVersion(w http.ResponseWriter, r *http.Request) {
+	share, ok := h.versionShare(w, r)
+	if !ok {
+		return
+	}
+	v, err := h.versions.Get(share.ID, chi.URLParam(r, "version_id"))
+	if err != nil {
+		h.writeVersionError(w, err)
+		return
+	}
+	writeJSON(w, h.logicalVersion(share, v))
+}
+
+// DownloadVersion handles GET /sync/files/{share_id}/versions/{version_id}/download
+func (h *SyncHandler) DownloadVersion(w http.ResponseWriter, r *http.Request) {
+	share, ok := h.versionShare(w, r)
+	if !ok {
+		return
+	}
+	v, f, err := h.versions.Open(share.ID, chi.URLParam(r, "version_id"))
+	if err != nil {
+		h.writeVersionError(w, err)
+		return
+	}
+	defer f.Close()
+
+	var body io.Reader = f
+	size := v.Size
+	if h.decodedAtRest(share) {
+		dec := h.encryption.ContentDecoder()
+		if size, err = dec.Size(f, v.Size); err == nil {
+			body, err = dec.Reader(f, v.Size)
+		}
+		if err != nil {
+			h.writeVersionError(w, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(v.Path)}))
+	w.Header().Set("Last-Modified", v.ModTime.UTC().Format(http.TimeFormat))
+	if _, err := io.Copy(w, body); err != nil {
+		h.logger.Debug().Err(err).Str("version_id", v.ID).Msg("Version download interrupted")
+	}
+}
+
+// RestoreVersion handles POST /sync/files/{share_id}/versions/{version_id}/restore
+func (h *SyncHandler) RestoreVersion(w http.ResponseWriter, r *http.Request) {
+	share, ok := h.versionShare(w, r)
+	if !ok {
+		return
+	}
+	if share.RO {
+		httpx.WriteTypedError(w, http.StatusForbidden, "share.read_only", "Share is read-only", 0)
+		return
+	}
+	h.restoreVersion(w, r, share, r.Header.Get("X-Device-ID"))
+}
+
+// GetShareVersioning handles GET /sync/admin/shares/{share_id}/versioning
+func (h *SyncHandler) GetShareVersioning(w http.ResponseWriter, r *http.Request) {
+	share, ok := h.shareStore.GetByID(chi.URLParam(r, "share_id"))
+	if !ok {
+		httpx.WriteTypedError(w, http.StatusNotFound, "share.not_found", "Share not found", 0)
+		return
+	}
+	writeJSON(w, versioningResponse(share))
+}
+
+// UpdateShareVersioning handles PUT /sync/admin/shares/{share_id}/versioning
+func (h *SyncHandler) UpdateShareVersioning(w http.ResponseWriter, r *http.Request) {
+	share, ok := h.shareStore.GetByID(chi.URLParam(r, "share_id"))
+	if !ok {
+		httpx.WriteTypedError(w, http.StatusNotFound, "share.not_found", "Share not found", 0)
+		return
+	}
+	var req shares.Versioning
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpx.WriteTypedError(w, http.StatusBadRequest, "input.invalid", "Invalid request body", 0)
+		return
+	}
+	if req.MaxVersions < 0 || req.MaxAgeDays < 0 || req.MaxAgeDays > maxVersioningDays {
+		httpx.WriteTypedError(w, http.StatusBadRequest, "input.invalid", "max_versions and max_age_days must be between 0 and their limits", 0)
+		return
+	}
+	if req.Enabled && req.MaxVersions == 0 && req.MaxAgeDays == 0 {
+		httpx.WriteTypedError(w, http.StatusBadRequest, "input.invalid", "Set max_versions or max_age_days to bound version history", 0)
+		return
+	}
+
+	share.Versioning = &req
+	if err := h.shareStore.Update(share); err != nil {
+		httpx.WriteTypedError(w, http.StatusInternalServerError, "share.update_failed", err.Error(), 0)
+		return
+	}
+	// Apply tighter limits to the versions already kept
+	if err := h.versions.Prune(); err != nil {
+		h.logger.Warn().Err(err).Msg("Failed to prune versions")
+	}
+
+	h.logger.Info().
+		Str("share_id", share.ID).
+		Bool("enabled", req.Enabled).
+		Int("max_versions", req.MaxVersions).
+		Int("max_age_days", req.MaxAgeDays).
+		Msg("Share versioning updated")
+	writeJSON(w, versioningResponse(share))
+}
+
+// AdminListVersions handles GET /sync/admin/shares/{share_id}/versions
+func (h *SyncHandler) AdminListVersions(w http.ResponseWriter, r *http.Request) {
+	share, ok := h.shareStore.GetByID(chi.URLParam(r, "share_id"))
+	if !ok {
+		httpx.WriteTypedError(w, http.StatusNotFound, "share.not_found", "Share not found", 0)
+		return
+	}
+	h.listVersions(w, r, share)
+}
+
+// AdminRestoreVersion handles POST /sync/admin/shares/{share_id}/versions/{version_id}/restore
+func (h *SyncHandler) AdminRestoreVersion(w http.ResponseWriter, r *http.Request) {
+	share, ok := h.shareStore.GetByID(chi.URLParam(r, "share_id"))
+	if !ok {
+		httpx.WriteTypedError(w, http.StatusNotFound, "share.not_found", "Share not found", 0)
+		return
+	}
+	h.restoreVersion(w, r, share, "")
+}
@@ -1,62 +1,83 @@
 package server
 
 import (
-	"bufio"
-	"context"
 	"encoding/json"
-	"fmt"
-	"os"
-	"path/filepath"
 	"time"
 
-	"nithronos/backend/nosd/internal/fsatomic"
 	"nithronos/backend/nosd/internal/pools"
+	"nithronos/backend/nosd/pkg/jobs"
 )
 
-func txDir() string {
-	base := os.Getenv("NOS_STATE_DIR")
-	if base == "" {
-		base = "/var/lib/nos"
+// Pool transactions are "pool.tx" jobs: the pools.Tx is the job's payload
+// and the step log is the job's log.
+const poolTxJobType = "pool.tx"
+
+func saveTx(engine *jobs.Engine, t pools.Tx) error {
+	if _, ok := engine.Get(t.ID); !ok {
+		if _, err := engine.Create(&jobs.Job{ID: t.ID, Type: poolTxJobType, CreatedAt: t.StartedAt}); err != nil {
+			return err
+		}
 	}
-	return filepath.Join(base, "pools", "tx")
+	_, err := engine.Update(t.ID, func(job *jobs.Job) { syncTx(job, t) })
+	return err
 }
 
-func txPath(id string) string    { return filepath.Join(txDir(), id+".json") }
-func txLogPath(id string) string { return filepath.Join(txDir(), id+".log") }
-
-func saveTx(t pools.Tx) error {
-	_ = os.MkdirAll(txDir(), 0o755)
-	return fsatomic.SaveJSON(context.TODO(), txPath(t.ID), t, 0o600)
+// syncTx derives the job's state and progress from the transaction
+func syncTx(job *jobs.Job, t pools.Tx) {
+	_ = job.SetPayload(t)
+	job.Error = t.Error
+	done := 0
+	for _, st := range t.Steps {
+		if st.Status == "ok" {
+			done++
+		}
+		if st.Status == "running" {
+			job.Message = st.Name
+		}
+	}
+	if len(t.Steps) > 0 {
+		job.Progress = float64(done) * 100 / float64(len(t.Steps))
+	}
+	if job.State.Done() {
+		return
+	}
+	switch {
+	case t.FinishedAt != nil && t.OK:
+		job.State = jobs.StateSucceeded
+		job.Progress = 100
+	case t.FinishedAt != nil:
+		job.State = jobs.StateFailed
+	case done > 0 || job.Message != "":
+		job.State = jobs.StateRunning
+	}
 }
 
-func appendTxLog(id string, level, stepID, msg string) {
-	_ = os.MkdirAll(txDir(), 0o755)
-	f, err := os.OpenFile(txLogPath(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
-	if err != nil {
-		return
+func loadPoolTx(engine *jobs.Engine, id string) (pools.Tx, bool) {
+	var tx pools.Tx
+	job, ok := engine.Get(id)
+	if !ok || job.Type != poolTxJobType || job.Decode(&tx) != nil {
+		return tx, false
 	}
-	defer f.Close()
-	rec := map[string]any{"ts": time.Now().UTC().Format(time.RFC3339), "level": level, "stepId": stepID, "msg": msg}
+	return tx, true
+}
+
+func appendTxLog(engine *jobs.Engine, id string, level, stepID, msg string) {
+	engine.Log(id, jobs.LogEntry{Level: level, Step: stepID, Message: msg})
+}
+
+// txLogLine renders a log entry the way the pool transaction log has
+// always looked
+func txLogLine(entry jobs.LogEntry) string {
+	rec := map[string]any{"ts": entry.Time.UTC().Format(time.RFC3339), "level": entry.Level, "stepId": entry.Step, "msg": entry.Message}
 	b, _ := json.Marshal(rec)
-	fmt.Fprintln(f, string(b))
+	return string(b)
 }
 
-func readLogTail(id string, cursor, max int) (lines []string, next int) {
-	f, err := os.Open(txLogPath(id))
-	if err != nil {
-		return []string{}, cursor
-	}
-	defer f.Close()
-	r := bufio.NewScanner(f)
-	idx := 0
-	for r.Scan() {
-		if idx >= cursor {
-			lines = append(lines, r.Text())
-			if len(lines) >= max {
-				break
-			}
-		}
-		idx++
+func readLogTail(engine *jobs.Engine, id string, cursor, max int) (lines []string, next int) {
+	entries, next := engine.Logs(id, cursor, max)
+	lines = []string{}
+	for _, entry := range entries {
+		lines = append(lines, txLogLine(entry))
 	}
-	return lines, idx
+	return lines, next
 }
@@ -1,67 +1,21 @@
 package server
 
 import (
-	"bufio"
+	"io"
 	"net/http"
-	"os"
-	"time"
 
 	"github.com/go-chi/chi/v5"
+	"nithronos/backend/nosd/pkg/jobs"
 )
 
-func handleTxStream(w http.ResponseWriter, r *http.Request) {
-	id := chi.URLParam(r, "id")
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	// start by sending current log from cursor 0
-	f, err := os.Open(txLogPath(id))
-	if err == nil {
-		scan := bufio.NewScanner(f)
-		for scan.Scan() {
-			ln := scan.Text()
-			_, _ = w.Write([]byte("event: log\n"))
-			_, _ = w.Write([]byte("data: " + ln + "\n\n"))
-		}
-		_ = f.Close()
-		flusher.Flush()
-	}
-	// keepalive and tail new lines for up to ~5m
-	deadline := time.Now().Add(5 * time.Minute)
-	lastSize := int64(0)
-	_ = func() error {
-		if st, err := os.Stat(txLogPath(id)); err == nil {
-			lastSize = st.Size()
-		}
-		return nil
-	}()
-	for time.Now().Before(deadline) {
-		// keepalive comment
-		_, _ = w.Write([]byte(": keepalive\n\n"))
-		flusher.Flush()
-		time.Sleep(1 * time.Second)
-		// check for appended data
-		st, err := os.Stat(txLogPath(id))
-		if err == nil && st.Size() > lastSize {
-			f, err := os.Open(txLogPath(id))
-			if err == nil {
-				if _, err := f.Seek(lastSize, 0); err == nil {
-					scan := bufio.NewScanner(f)
-					for scan.Scan() {
-						ln := scan.Text()
-						_, _ = w.Write([]byte("event: log\n"))
-						_, _ = w.Write([]byte("data: " + ln + "\n\n"))
-					}
-				}
-				lastSize = st.Size()
-				_ = f.Close()
-				flusher.Flush()
+func handleTxStream(engine *jobs.Engine) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		streamJob(w, r, engine, chi.URLParam(r, "id"), func(w io.Writer, ev jobs.Event) {
+			if ev.Type != "log" {
+				return
 			}
-		}
+			_, _ = w.Write([]byte("event: log\n"))
+			_, _ = w.Write([]byte("data: " + txLogLine(*ev.Log) + "\n\n"))
+		})
 	}
 }
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/net/webdav"
+
+	"nithronos/backend/nosd/pkg/sync/crypto"
+)
+
+// errEncryptedWrite is returned for in-place writes to an encrypted file;
+// encrypted files can only be replaced as a whole
+var errEncryptedWrite = errors.New("encrypted files must be rewritten as a whole")
+
+// openEncryptedFile wraps a file of an encrypted share so WebDAV sees its
+// plaintext. New and truncated files are encrypted as they are written when
+// encrypt is set; files that are still plaintext (a share being converted)
+// pass through.
+func openEncryptedFile(f *os.File, enc *crypto.FileEncryptor, shareID string, flag int, encrypt bool) (webdav.File, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return &encryptedDir{File: f}, nil
+	}
+
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	if writable && encrypt && (flag&os.O_TRUNC != 0 || info.Size() == 0) {
+		ew, err := enc.NewEncryptWriter(shareID, f)
+		if err != nil {
+			return nil, err
+		}
+		return &encryptingFile{f: f, w: ew}, nil
+	}
+
+	if !crypto.IsEncryptedStream(f) {
+		return f, nil
+	}
+	dr, err := enc.NewDecryptReader(f, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	return &decryptingFile{f: f, r: dr}, nil
+}
+
+// plaintextInfo reports the plaintext size of an encrypted file
+func plaintextInfo(path string, info fs.FileInfo) fs.FileInfo {
+	if !info.Mode().IsRegular() || info.Size() < crypto.StreamHeaderSize {
+		return info
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return info
+	}
+	defer f.Close()
+	if !crypto.IsEncryptedStream(f) {
+		return info
+	}
+	size, err := crypto.PlaintextSize(info.Size())
+	if err != nil {
+		return info
+	}
+	return sizedFileInfo{FileInfo: info, size: size}
+}
+
+// sizedFileInfo overrides the size of a FileInfo
+type sizedFileInfo struct {
+	fs.FileInfo
+	size int64
+}
+
+func (fi sizedFileInfo) Size() int64 { return fi.size }
+
+// decryptingFile serves the plaintext of an encrypted file. The os.File is
+// deliberately not embedded so io.Copy cannot reach its WriteTo/ReadFrom.
+type decryptingFile struct {
+	f *os.File
+	r *crypto.DecryptReader
+}
+
+func (df *decryptingFile) Read(p []byte) (int, error) { return df.r.Read(p) }
+
+func (df *decryptingFile) Seek(offset int64, whence int) (int64, error) {
+	return df.r.Seek(offset, whence)
+}
+
+func (df *decryptingFile) Write(p []byte) (int, error) { return 0, errEncryptedWrite }
+
+func (df *decryptingFile) Readdir(count int) ([]fs.FileInfo, error) {
+	return nil, os.ErrInvalid
+}
+
+func (df *decryptingFile) Stat() (fs.FileInfo, error) {
+	info, err := df.f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return sizedFileInfo{FileInfo: info, size: df.r.Size()}, nil
+}
+
+func (df *decryptingFile) Close() error { return df.f.Close() }
+
+// encryptingFile encrypts everything written to a new file
+type encryptingFile struct {
+	f     *os.File
+	w     *crypto.EncryptWriter
+	mtime time.Time // modification time reported by Stat
+}
+
+func (ef *encryptingFile) Write(p []byte) (int, error) { return ef.w.Write(p) }
+
+func (ef *encryptingFile) Read(p []byte) (int, error) { return 0, os.ErrInvalid }
+
+func (ef *encryptingFile) Seek(offset int64, whence int) (int64, error) {
+	if offset == 0 && whence == io.SeekCurrent {
+		return ef.w.Written(), nil
+	}
+	return 0, errEncryptedWrite
+}
+
+func (ef *encryptingFile) Readdir(count int) ([]fs.FileInfo, error) {
+	return nil, os.ErrInvalid
+}
+
+// Stat reports the plaintext written so far. WebDAV derives the ETag of a
+// PUT from it before Close, so the modification time seen here is restored
+// after the final chunk is written.
+func (ef *encryptingFile) Stat() (fs.FileInfo, error) {
+	info, err := ef.f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	ef.mtime = info.ModTime()
+	return sizedFileInfo{FileInfo: info, size: ef.w.Written()}, nil
+}
+
+func (ef *encryptingFile) Close() error {
+	err := ef.w.Close()
+	if err == nil && !ef.mtime.IsZero() {
+		err = os.Chtimes(ef.f.Name(), ef.mtime, ef.mtime)
+	}
+	if cerr := ef.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// encryptedDir lists the plaintext sizes of encrypted files
+type encryptedDir struct {
+	*os.File
+}
+
+func (d *encryptedDir) Readdir(count int) ([]fs.FileInfo, error) {
+	infos, err := d.File.Readdir(count)
+	for i, info := range infos {
+		infos[i] = plaintextInfo(filepath.Join(d.Name(), info.Name()), info)
+	}
+	return infos, err
+}
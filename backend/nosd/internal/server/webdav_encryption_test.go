@@ -0,0 +1,89 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/net/webdav"
+
+	"nithronos/backend/nosd/pkg/sync/crypto"
+)
+
+func TestWebDAVEncryptedShare(t *testing.T) {
+	km, err := crypto.NewKeyManager(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := km.InitializeMasterKey("correct horse battery"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := km.GenerateShareKey("s1"); err != nil {
+		t.Fatal(err)
+	}
+	enc := crypto.NewFileEncryptor(km, crypto.AlgorithmXChaCha20Poly)
+
+	base := t.TempDir()
+	handler := &webdav.Handler{
+		FileSystem: &shareFileSystem{
+			basePath: base,
+			shareID:  "s1",
+			crypto: func(string) (*crypto.FileEncryptor, bool, bool) {
+				return enc, true, true
+			},
+			logger: zerolog.Nop(),
+		},
+		LockSystem: webdav.NewMemLS(),
+	}
+
+	plain := make([]byte, 3*crypto.StreamChunkSize+1234)
+	rand.Read(plain)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/doc.bin", bytes.NewReader(plain)))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("PUT = %d: %s", rec.Code, rec.Body.String())
+	}
+
+	onDisk, err := os.ReadFile(filepath.Join(base, "doc.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !crypto.IsEncryptedStream(bytes.NewReader(onDisk)) || bytes.Contains(onDisk, plain[:64]) {
+		t.Fatal("file is not encrypted at rest")
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/doc.bin", nil))
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), plain) {
+		t.Fatalf("GET = %d, %d bytes", rec.Code, rec.Body.Len())
+	}
+
+	// A range across a chunk boundary
+	req := httptest.NewRequest(http.MethodGet, "/doc.bin", nil)
+	req.Header.Set("Range", "bytes=65000-66000")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusPartialContent {
+		t.Fatalf("range GET = %d", rec.Code)
+	}
+	body, _ := io.ReadAll(rec.Body)
+	if !bytes.Equal(body, plain[65000:66001]) {
+		t.Errorf("range returned wrong bytes (%d)", len(body))
+	}
+
+	// PROPFIND reports the plaintext size
+	fi, err := handler.FileSystem.Stat(req.Context(), "/doc.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != int64(len(plain)) {
+		t.Errorf("Stat size = %d, want %d", fi.Size(), len(plain))
+	}
+}
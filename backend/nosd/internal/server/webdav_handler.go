@@ -7,6 +7,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -14,26 +15,67 @@ import (
 
 	"nithronos/backend/nosd/internal/shares"
 	nosync "nithronos/backend/nosd/pkg/sync"
+	"nithronos/backend/nosd/pkg/sync/crypto"
 )
 
 // WebDAVHandler provides WebDAV access to sync-enabled shares
 type WebDAVHandler struct {
 	shareStore *shares.Store
 	deviceMgr  *nosync.DeviceManager
+	journals   *nosync.JournalManager
+	encryption *EncryptionHandler
+	versions   *nosync.VersionStore
+	trash      *nosync.TrashStore
 	logger     zerolog.Logger
+	mu         sync.Mutex
 	handlers   map[string]*webdav.Handler // shareID -> handler
 }
 
+// webdavDeviceKey carries the authenticated device ID into FileSystem calls
+type webdavDeviceKey struct{}
+
 // NewWebDAVHandler creates a new WebDAV handler
-func NewWebDAVHandler(shareStore *shares.Store, deviceMgr *nosync.DeviceManager, logger zerolog.Logger) *WebDAVHandler {
+func NewWebDAVHandler(shareStore *shares.Store, deviceMgr *nosync.DeviceManager, journals *nosync.JournalManager, logger zerolog.Logger) *WebDAVHandler {
 	return &WebDAVHandler{
 		shareStore: shareStore,
 		deviceMgr:  deviceMgr,
+		journals:   journals,
 		logger:     logger.With().Str("component", "webdav").Logger(),
 		handlers:   make(map[string]*webdav.Handler),
 	}
 }
 
+// UseEncryption stores files of encrypted shares encrypted at rest, using the
+// encryption handler's keys
+func (h *WebDAVHandler) UseEncryption(e *EncryptionHandler) {
+	h.encryption = e
+}
+
+// UseVersions keeps the previous version of files that WebDAV overwrites
+func (h *WebDAVHandler) UseVersions(v *nosync.VersionStore) {
+	h.versions = v
+}
+
+// UseTrash moves files that WebDAV deletes into the share's trash
+func (h *WebDAVHandler) UseTrash(t *nosync.TrashStore) {
+	h.trash = t
+}
+
+// shareCrypto returns the encryptor for a share and whether its files may be
+// encrypted (decode) or must be written encrypted (encrypt). The encryptor
+// is nil while encryption is locked.
+func (h *WebDAVHandler) shareCrypto(shareID string) (enc *crypto.FileEncryptor, decode, encrypt bool) {
+	share, ok := h.shareStore.GetByID(shareID)
+	if !ok {
+		return nil, false, false
+	}
+	if h.encryption == nil {
+		return nil, share.Encrypted, share.Encrypted
+	}
+	decode, encrypt = h.encryption.shareCrypto(share)
+	return h.encryption.GetEncryptor(), decode, encrypt
+}
+
 // ServeHTTP implements http.Handler
 func (h *WebDAVHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Extract share ID from path: /dav/{share_id}/...
@@ -106,12 +148,25 @@ func (h *WebDAVHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Devices paused by the mass-delete breaker may only read
+	if pause := h.deviceMgr.PauseOf(device.ID); pause != nil && !webdavReadOnly(r.Method) {
+		http.Error(w, "Device is paused: "+pause.Reason+"; an administrator must resume it", http.StatusLocked)
+		return
+	}
+
+	// Encrypted shares are unreadable until encryption is unlocked
+	if enc, decode, _ := h.shareCrypto(shareID); decode && enc == nil {
+		http.Error(w, "Share is encrypted and encryption is locked", http.StatusServiceUnavailable)
+		return
+	}
+
 	// Get or create handler for this share
+	h.mu.Lock()
 	handler, ok := h.handlers[shareID]
 	if !ok {
 		handler = &webdav.Handler{
-			Prefix:     "/dav/" + shareID,
-			FileSystem: &shareFileSystem{basePath: share.Path},
+			Prefix: "/dav/" + shareID,
+			FileSystem: h.fileSystem(share),
 			LockSystem: webdav.NewMemLS(),
 			Logger: func(r *http.Request, err error) {
 				if err != nil {
@@ -130,14 +185,87 @@ func (h *WebDAVHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 		h.handlers[shareID] = handler
 	}
+	h.mu.Unlock()
 
 	// Serve WebDAV request
+	r = r.WithContext(context.WithValue(r.Context(), webdavDeviceKey{}, device.ID))
 	handler.ServeHTTP(w, r)
 }
 
+// fileSystem returns the view of a share that WebDAV serves: files are
+// decrypted and encrypted on the fly, changes journaled and overwritten
+// content kept as versions
+func (h *WebDAVHandler) fileSystem(share shares.Share) *shareFileSystem {
+	return &shareFileSystem{
+		basePath: share.Path,
+		shareID:  share.ID,
+		journals: h.journals,
+		versions: h.versions,
+		trash:    h.trash,
+		crypto:   h.shareCrypto,
+		deleted:  h.recordDeletes,
+		logger:   h.logger,
+	}
+}
+
+// recordDeletes feeds the mass-delete breaker
+func (h *WebDAVHandler) recordDeletes(deviceID string, files int) {
+	if h.deviceMgr != nil {
+		h.deviceMgr.RecordDeletes(deviceID, files)
+	}
+}
+
+// webdavReadOnly reports whether a WebDAV method leaves files unchanged
+func webdavReadOnly(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND":
+		return true
+	}
+	return false
+}
+
 // shareFileSystem implements webdav.FileSystem for a share
 type shareFileSystem struct {
 	basePath string
+	shareID  string
+	journals *nosync.JournalManager
+	versions *nosync.VersionStore
+	trash    *nosync.TrashStore
+	crypto   func(shareID string) (enc *crypto.FileEncryptor, decode, encrypt bool)
+	deleted  func(deviceID string, files int)
+	logger   zerolog.Logger
+}
+
+// deviceID returns the sync device performing the request, if known
+func (sfs *shareFileSystem) deviceID(ctx context.Context) string {
+	id, _ := ctx.Value(webdavDeviceKey{}).(string)
+	return id
+}
+
+// journal records a change made through WebDAV in the share's change journal
+func (sfs *shareFileSystem) journal(record func() error) {
+	if sfs.journals == nil {
+		return
+	}
+	if err := record(); err != nil {
+		sfs.logger.Warn().Err(err).Str("share_id", sfs.shareID).Msg("Failed to journal WebDAV change")
+	}
+}
+
+// relPath returns the share-relative path of a WebDAV name
+func (sfs *shareFileSystem) relPath(name string) string {
+	return strings.TrimPrefix(filepath.ToSlash(filepath.Clean("/"+name)), "/")
+}
+
+// keepVersion keeps the current content of a file before it is replaced
+func (sfs *shareFileSystem) keepVersion(ctx context.Context, name string) {
+	if sfs.versions == nil {
+		return
+	}
+	relPath := sfs.relPath(name)
+	if _, err := sfs.versions.Capture(sfs.shareID, relPath, sfs.deviceID(ctx), nosync.VersionReasonOverwrite); err != nil {
+		sfs.logger.Warn().Err(err).Str("share_id", sfs.shareID).Str("path", relPath).Msg("Failed to keep previous version")
+	}
 }
 
 func (sfs *shareFileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
@@ -145,7 +273,13 @@ func (sfs *shareFileSystem) Mkdir(ctx context.Context, name string, perm os.File
 	if !sfs.isValidPath(fullPath) {
 		return os.ErrPermission
 	}
-	return os.Mkdir(fullPath, perm)
+	if err := os.Mkdir(fullPath, perm); err != nil {
+		return err
+	}
+	sfs.journal(func() error {
+		return sfs.journals.RecordPath(sfs.shareID, sfs.basePath, sfs.deviceID(ctx), name)
+	})
+	return nil
 }
 
 func (sfs *shareFileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
@@ -153,7 +287,49 @@ func (sfs *shareFileSystem) OpenFile(ctx context.Context, name string, flag int,
 	if !sfs.isValidPath(fullPath) {
 		return nil, os.ErrPermission
 	}
-	return os.OpenFile(fullPath, flag, perm)
+	// Check the key before O_TRUNC can destroy anything
+	enc, decode, encrypt := sfs.crypto(sfs.shareID)
+	if (decode || encrypt) && enc == nil {
+		return nil, errEncryptionLocked
+	}
+	if flag&os.O_TRUNC != 0 {
+		sfs.keepVersion(ctx, name)
+	}
+	f, err := os.OpenFile(fullPath, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	var file webdav.File = f
+	if decode || encrypt {
+		if file, err = openEncryptedFile(f, enc, sfs.shareID, flag, encrypt); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) == 0 {
+		return file, nil
+	}
+	deviceID := sfs.deviceID(ctx)
+	return &journaledFile{File: file, onClose: func() {
+		sfs.journal(func() error {
+			return sfs.journals.RecordPath(sfs.shareID, sfs.basePath, deviceID, name)
+		})
+	}}, nil
+}
+
+// journaledFile records the file in the change journal once a write handle is closed
+type journaledFile struct {
+	webdav.File
+	onClose func()
+}
+
+// Close closes the file and journals the written content
+func (f *journaledFile) Close() error {
+	err := f.File.Close()
+	if err == nil && f.onClose != nil {
+		f.onClose()
+	}
+	return err
 }
 
 func (sfs *shareFileSystem) RemoveAll(ctx context.Context, name string) error {
@@ -165,7 +341,43 @@ func (sfs *shareFileSystem) RemoveAll(ctx context.Context, name string) error {
 	if fullPath == sfs.basePath || fullPath == sfs.basePath+"/" {
 		return os.ErrPermission
 	}
-	return os.RemoveAll(fullPath)
+	deviceID := sfs.deviceID(ctx)
+	var files int
+	if sfs.trash != nil && sfs.trash.Enabled(sfs.shareID) {
+		item, err := sfs.trash.Trash(sfs.shareID, sfs.relPath(name), deviceID)
+		if err != nil {
+			return err
+		}
+		files = item.Files
+	} else {
+		files, _ = nosync.CountTree(fullPath)
+		if err := os.RemoveAll(fullPath); err != nil {
+			return err
+		}
+	}
+	sfs.journal(func() error {
+		return sfs.journals.RecordRemoval(sfs.shareID, sfs.basePath, deviceID, name)
+	})
+	if sfs.deleted != nil {
+		sfs.deleted(deviceID, files)
+	}
+	return nil
+}
+
+// discard permanently removes a file the server wrote itself, such as a
+// partial upload; it bypasses the trash
+func (sfs *shareFileSystem) discard(ctx context.Context, name string) error {
+	fullPath := filepath.Join(sfs.basePath, name)
+	if !sfs.isValidPath(fullPath) {
+		return os.ErrPermission
+	}
+	if err := os.Remove(fullPath); err != nil {
+		return err
+	}
+	sfs.journal(func() error {
+		return sfs.journals.RecordRemoval(sfs.shareID, sfs.basePath, sfs.deviceID(ctx), name)
+	})
+	return nil
 }
 
 func (sfs *shareFileSystem) Rename(ctx context.Context, oldName, newName string) error {
@@ -174,7 +386,14 @@ func (sfs *shareFileSystem) Rename(ctx context.Context, oldName, newName string)
 	if !sfs.isValidPath(oldPath) || !sfs.isValidPath(newPath) {
 		return os.ErrPermission
 	}
-	return os.Rename(oldPath, newPath)
+	sfs.keepVersion(ctx, newName)
+	if err := os.Rename(oldPath, newPath); err != nil {
+		return err
+	}
+	sfs.journal(func() error {
+		return sfs.journals.RecordRename(sfs.shareID, sfs.basePath, sfs.deviceID(ctx), oldName, newName)
+	})
+	return nil
 }
 
 func (sfs *shareFileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
@@ -182,7 +401,14 @@ func (sfs *shareFileSystem) Stat(ctx context.Context, name string) (os.FileInfo,
 	if !sfs.isValidPath(fullPath) {
 		return nil, os.ErrPermission
 	}
-	return os.Stat(fullPath)
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	if _, decode, _ := sfs.crypto(sfs.shareID); decode {
+		return plaintextInfo(fullPath, info), nil
+	}
+	return info, nil
 }
 
 func (sfs *shareFileSystem) isValidPath(path string) bool {
@@ -195,7 +421,12 @@ func (sfs *shareFileSystem) isValidPath(path string) bool {
 	if err != nil {
 		return false
 	}
-	return strings.HasPrefix(absPath, absBase)
+	if !strings.HasPrefix(absPath, absBase) {
+		return false
+	}
+	// Versions and trash are only reachable through their APIs
+	rel, err := filepath.Rel(absBase, absPath)
+	return err == nil && !nosync.IsServerPath(rel)
 }
 
 // WebDAVInfo provides information about the WebDAV endpoint
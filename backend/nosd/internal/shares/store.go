@@ -21,6 +21,23 @@ type Share struct {
 	SyncMaxSize     int64    `json:"sync_max_size,omitempty"`     // Max sync size in bytes (0 = unlimited)
 	SyncExclude     []string `json:"sync_exclude,omitempty"`      // Glob patterns to exclude from sync
 	SyncAllowedUsers []string `json:"sync_allowed_users,omitempty"` // Users allowed to sync (empty = all share users)
+	Encrypted       bool     `json:"encrypted,omitempty"`          // Files are stored encrypted at rest
+	E2E             bool     `json:"e2e,omitempty"`                // Files are encrypted by sync clients; the server holds only ciphertext
+	Versioning      *Versioning `json:"versioning,omitempty"`      // File version retention (nil = defaults)
+	Trash           *Trash      `json:"trash,omitempty"`           // Server-side trash for deletes (nil = defaults)
+}
+
+// Versioning configures the previous versions kept of a sync share's files
+type Versioning struct {
+	Enabled     bool `json:"enabled"`
+	MaxVersions int  `json:"max_versions"` // Versions kept per file (0 = no count limit)
+	MaxAgeDays  int  `json:"max_age_days"` // Days a version is kept (0 = no age limit)
+}
+
+// Trash configures the server-side trash of a sync share
+type Trash struct {
+	Enabled       bool `json:"enabled"`
+	RetentionDays int  `json:"retention_days"` // Days deleted files are kept (0 = until purged)
 }
 
 type Store struct {
@@ -84,6 +101,28 @@ func (s *Store) GetByID(id string) (Share, bool) {
 	return Share{}, false
 }
 
+func (s *Store) Update(sh Share) error {
+	s.mu.Lock()
+	found := false
+	for i := range s.list {
+		if s.list[i].ID == sh.ID {
+			s.list[i] = sh
+			found = true
+			break
+		}
+	}
+	if !found {
+		s.mu.Unlock()
+		return fs.ErrNotExist
+	}
+	data := make([]Share, len(s.list))
+	copy(data, s.list)
+	s.mu.Unlock()
+	return fsatomic.WithLock(s.path, func() error {
+		return fsatomic.SaveJSON(context.TODO(), s.path, data, fs.FileMode(0o600))
+	})
+}
+
 func (s *Store) Delete(id string) error {
 	s.mu.Lock()
 	out := s.list[:0]
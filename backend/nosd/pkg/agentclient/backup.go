@@ -0,0 +1,90 @@
+package agentclient
+
+import (
+	"context"
+	"time"
+)
+
+// Backup snapshot types. Paths are subvolume names at the top level of
+// the system volume ("@home", "@snapshots/@home/20240102-030405") or
+// absolute paths below /srv or /mnt.
+
+// SubvolumeInfo is what `btrfs subvolume show` reports for a snapshot
+type SubvolumeInfo struct {
+	Path       string    `json:"path"`
+	UUID       string    `json:"uuid"`
+	Generation int64     `json:"generation"`
+	ReadOnly   bool      `json:"read_only"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// SnapshotSubvolume snapshots source to path, which must be below
+// @snapshots
+func (c *Client) SnapshotSubvolume(ctx context.Context, source string, path string, readOnly bool) error {
+	return c.PostJSON(ctx, "/v1/backup/snapshot", map[string]any{"source": source, "path": path, "read_only": readOnly}, nil)
+}
+
+// DeleteSnapshot deletes a snapshot below @snapshots
+func (c *Client) DeleteSnapshot(ctx context.Context, path string) error {
+	return c.PostJSON(ctx, "/v1/backup/snapshot/delete", map[string]any{"path": path}, nil)
+}
+
+// ShowSubvolume describes the subvolume at path
+func (c *Client) ShowSubvolume(ctx context.Context, path string) (*SubvolumeInfo, error) {
+	var out SubvolumeInfo
+	if err := c.PostJSON(ctx, "/v1/backup/snapshot/show", map[string]any{"path": path}, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// BackupHookResult is how a backup hook run by the agent ended
+type BackupHookResult struct {
+	Code     int    `json:"code"`
+	Output   string `json:"output"`
+	TimedOut bool   `json:"timed_out"`
+}
+
+// RunBackupHook runs a backup schedule's pre- or post-hook with sh -c,
+// killing it after timeout
+func (c *Client) RunBackupHook(ctx context.Context, command string, timeout time.Duration) (*BackupHookResult, error) {
+	var out BackupHookResult
+	body := map[string]any{"command": command, "timeout_seconds": timeoutSeconds(timeout)}
+	if err := c.PostJSON(ctx, "/v1/backup/hook", body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// AppHookRequest is one docker compose command of an app's quiesce hook.
+// The agent runs it against the nos-app-<id> project of the app, without
+// a shell.
+type AppHookRequest struct {
+	AppID    string   `json:"app_id"`
+	Action   string   `json:"action"` // exec, pause or unpause
+	Service  string   `json:"service,omitempty"`
+	User     string   `json:"user,omitempty"`
+	Workdir  string   `json:"workdir,omitempty"`
+	Env      []string `json:"env,omitempty"`
+	Services []string `json:"services,omitempty"`
+	Command  []string `json:"command,omitempty"`
+}
+
+// RunAppHook runs a command of an app's quiesce hook, killing it after
+// timeout
+func (c *Client) RunAppHook(ctx context.Context, req AppHookRequest, timeout time.Duration) (*BackupHookResult, error) {
+	var out BackupHookResult
+	body := struct {
+		AppHookRequest
+		TimeoutSeconds int `json:"timeout_seconds"`
+	}{req, timeoutSeconds(timeout)}
+	if err := c.PostJSON(ctx, "/v1/backup/app-hook", body, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// timeoutSeconds rounds a hook timeout up to whole seconds
+func timeoutSeconds(timeout time.Duration) int {
+	return int((timeout + time.Second - 1) / time.Second)
+}
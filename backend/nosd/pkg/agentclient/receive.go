@@ -0,0 +1,60 @@
+package agentclient
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// Replication receive types
+
+// ReceivedSubvolume describes a subvolume created by btrfs receive
+type ReceivedSubvolume struct {
+	Name         string `json:"name"`
+	Path         string `json:"path"`
+	UUID         string `json:"uuid,omitempty"`
+	ReceivedUUID string `json:"received_uuid,omitempty"`
+	Generation   int64  `json:"generation"`
+	Bytes        int64  `json:"bytes"`
+	Warning      string `json:"warning,omitempty"`
+}
+
+// EnsureLanding creates the landing subvolume for replication streams if
+// needed and caps everything received into it at limitBytes (0 = no limit)
+func (c *Client) EnsureLanding(ctx context.Context, path string, limitBytes int64) error {
+	return c.PostJSON(ctx, "/v1/btrfs/landing", map[string]any{"path": path, "limit_bytes": limitBytes}, nil)
+}
+
+// Receive streams a btrfs send stream into dir, which must be landing or
+// below it
+func (c *Client) Receive(ctx context.Context, landing string, dir string, stream io.Reader) (*ReceivedSubvolume, error) {
+	q := url.Values{}
+	q.Set("landing", landing)
+	q.Set("dir", dir)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://unix/v1/btrfs/receive?"+q.Encode(), stream)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	res, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		b, _ := io.ReadAll(res.Body)
+		return nil, &HTTPError{Status: res.StatusCode, Body: string(b)}
+	}
+	var out ReceivedSubvolume
+	if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// DeleteSubvolume deletes a subvolume below a landing area
+func (c *Client) DeleteSubvolume(ctx context.Context, path string) error {
+	return c.PostJSON(ctx, "/v1/btrfs/subvolume/delete", map[string]string{"path": path}, nil)
+}
@@ -13,6 +13,8 @@ import (
 	"time"
 
 	"gopkg.in/yaml.v3"
+
+	"nithronos/backend/nosd/pkg/appsdk"
 )
 
 // CatalogManager manages app catalogs (built-in and remote)
@@ -22,6 +24,7 @@ type CatalogManager struct {
 	sourcesPath string
 	httpClient  *http.Client
 	mu          sync.RWMutex
+	syncMu      sync.Mutex // one sync at a time
 	cache       *Catalog
 	sources     []CatalogSource
 	lastSync    time.Time
@@ -64,10 +67,81 @@ func (cm *CatalogManager) LoadBuiltinCatalog() (*Catalog, error) {
 
 	catalog.Source = "builtin"
 	catalog.UpdatedAt = time.Now()
+	attachManifests(&catalog, cm.builtinPath)
 
 	return &catalog, nil
 }
 
+// attachManifests applies each template's nosapp.yaml to its entry and
+// adds the apps whose template directory has a manifest but which
+// catalog.yaml doesn't list, so an app can ship as just a directory.
+// An entry with a broken manifest is left out rather than installed
+// without it. root is the catalog's directory.
+func attachManifests(catalog *Catalog, root string) {
+	listed := map[string]bool{}
+	entries := make([]CatalogEntry, 0, len(catalog.Entries))
+	for _, entry := range catalog.Entries {
+		if entry.Compose != "" {
+			dir := filepath.ToSlash(filepath.Dir(entry.Compose))
+			listed[dir] = true
+			manifest, err := loadTemplateManifest(filepath.Join(root, dir))
+			if err == nil && manifest != nil {
+				err = applyManifest(&entry, manifest, dir)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: skipping app %s: %v\n", entry.ID, err)
+				continue
+			}
+		}
+		listed[entry.ID] = true
+		entries = append(entries, entry)
+	}
+
+	paths, _ := filepath.Glob(filepath.Join(root, "templates", "*", ManifestFile))
+	for _, path := range paths {
+		rel, err := filepath.Rel(root, filepath.Dir(path))
+		if err != nil || listed[filepath.ToSlash(rel)] {
+			continue
+		}
+		dir := filepath.ToSlash(rel)
+		var entry CatalogEntry
+		manifest, err := appsdk.LoadManifest(path)
+		if err == nil {
+			err = applyManifest(&entry, manifest, dir)
+		}
+		if err == nil && listed[entry.ID] {
+			err = fmt.Errorf("app %s is already in the catalog", entry.ID)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: skipping app in %s: %v\n", dir, err)
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(filepath.Dir(path), "schema.json")); err == nil {
+			entry.Schema = dir + "/schema.json"
+		}
+		listed[entry.ID] = true
+		entries = append(entries, entry)
+	}
+
+	catalog.Entries = entries
+}
+
+// applyEmbeddedManifests applies the manifests a remote catalog carries
+// inline, dropping entries whose manifest is invalid
+func applyEmbeddedManifests(source string, entries []CatalogEntry) []CatalogEntry {
+	out := make([]CatalogEntry, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Manifest != nil {
+			if err := applyManifest(&entry, entry.Manifest, ""); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: skipping app %s from %s: %v\n", entry.ID, source, err)
+				continue
+			}
+		}
+		out = append(out, entry)
+	}
+	return out
+}
+
 // LoadSources loads catalog sources from configuration
 func (cm *CatalogManager) LoadSources() error {
 	cm.mu.Lock()
@@ -110,10 +184,16 @@ func (cm *CatalogManager) LoadSources() error {
 	return nil
 }
 
-// SyncRemoteCatalogs fetches and verifies remote catalogs
+// SyncRemoteCatalogs fetches and verifies remote catalogs. The fetches
+// run without cm.mu, so the current catalog stays readable meanwhile;
+// only installing the new git checkouts and swapping the cache take it.
 func (cm *CatalogManager) SyncRemoteCatalogs() error {
-	cm.mu.Lock()
-	defer cm.mu.Unlock()
+	cm.syncMu.Lock()
+	defer cm.syncMu.Unlock()
+
+	cm.mu.RLock()
+	sources := append([]CatalogSource(nil), cm.sources...)
+	cm.mu.RUnlock()
 
 	mergedCatalog := &Catalog{
 		Version:   "1.0",
@@ -121,37 +201,58 @@ func (cm *CatalogManager) SyncRemoteCatalogs() error {
 		UpdatedAt: time.Now(),
 	}
 
-	// Start with built-in catalog
 	builtin, err := cm.LoadBuiltinCatalog()
 	if err != nil {
 		return fmt.Errorf("failed to load builtin catalog: %w", err)
 	}
-	mergedCatalog.Entries = append(mergedCatalog.Entries, builtin.Entries...)
 
-	// Fetch each remote source
-	for _, source := range cm.sources {
+	// Fetch each remote source; one that fails is reported and skipped
+	type fetched struct {
+		status   SourceStatus
+		entries  []CatalogEntry
+		checkout *gitCheckout
+	}
+	var results []fetched
+	for _, source := range sources {
 		if !source.Enabled {
 			continue
 		}
 
-		catalog, err := cm.fetchRemoteCatalog(source)
+		status := SourceStatus{Name: source.Name, Type: source.Type, URL: source.URL, SyncedAt: time.Now()}
+		catalog, revision, checkout, err := cm.fetchRemoteCatalog(source)
 		if err != nil {
-			// Log error but continue with other sources
 			fmt.Fprintf(os.Stderr, "Failed to fetch catalog from %s: %v\n", source.Name, err)
+			status.Error = err.Error()
+			results = append(results, fetched{status: status})
 			continue
 		}
+		if checkout != nil {
+			defer checkout.discard()
+		}
+		status.Revision = revision
+		results = append(results, fetched{
+			status:   status,
+			entries:  applyEmbeddedManifests(source.Name, catalog.Entries),
+			checkout: checkout,
+		})
+	}
 
-		// Verify if SHA256 is provided
-		if source.SHA256 != "" {
-			if err := cm.verifyCatalogHash(catalog, source.SHA256); err != nil {
-				fmt.Fprintf(os.Stderr, "Catalog verification failed for %s: %v\n", source.Name, err)
-				continue
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	for _, r := range results {
+		if r.checkout != nil {
+			if err := r.checkout.install(); err != nil {
+				r.status.Error = err.Error()
+				r.entries = nil
 			}
 		}
-
-		// Merge entries (later sources can override earlier ones)
-		mergedCatalog.Entries = mergeCatalogEntries(mergedCatalog.Entries, catalog.Entries)
+		// Later sources override earlier ones
+		mergedCatalog.Entries = mergeCatalogEntries(mergedCatalog.Entries, r.entries)
+		r.status.Entries = len(r.entries)
+		mergedCatalog.Sources = append(mergedCatalog.Sources, r.status)
 	}
+	// but none overrides a builtin app
+	mergedCatalog.Entries = mergeCatalogEntries(mergedCatalog.Entries, builtin.Entries)
 
 	// Save to cache
 	if err := cm.saveCache(mergedCatalog); err != nil {
@@ -164,34 +265,58 @@ func (cm *CatalogManager) SyncRemoteCatalogs() error {
 	return nil
 }
 
-// fetchRemoteCatalog fetches a catalog from a remote source
-func (cm *CatalogManager) fetchRemoteCatalog(source CatalogSource) (*Catalog, error) {
+// fetchRemoteCatalog fetches a catalog from a remote source and verifies
+// its signature, returning the revision it got: a git commit or the
+// SHA-256 of an HTTP catalog. A git source also returns the checkout its
+// entries point at, to be installed.
+func (cm *CatalogManager) fetchRemoteCatalog(source CatalogSource) (*Catalog, string, *gitCheckout, error) {
+	if len(source.TrustedKeys) == 0 {
+		return nil, "", nil, fmt.Errorf("source has no trusted_keys; unsigned catalogs are not accepted")
+	}
 	switch source.Type {
 	case "http", "https":
-		return cm.fetchHTTPCatalog(source.URL)
+		catalog, revision, err := cm.fetchHTTPCatalog(source)
+		return catalog, revision, nil, err
 	case "git":
-		// TODO: Implement git support
-		return nil, fmt.Errorf("git sources not yet implemented")
+		return cm.fetchGitCatalog(source)
 	default:
-		return nil, fmt.Errorf("unsupported source type: %s", source.Type)
+		return nil, "", nil, fmt.Errorf("unsupported source type: %s", source.Type)
 	}
 }
 
-// fetchHTTPCatalog fetches a catalog via HTTP
-func (cm *CatalogManager) fetchHTTPCatalog(url string) (*Catalog, error) {
-	resp, err := cm.httpClient.Get(url)
+// fetchHTTPCatalog fetches a catalog via HTTP along with its detached
+// signature, from the source's signature URL or else the catalog URL
+// plus .minisig or .sig
+func (cm *CatalogManager) fetchHTTPCatalog(source CatalogSource) (*Catalog, string, error) {
+	data, err := cm.httpGet(source.URL)
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch catalog: %w", err)
+		return nil, "", fmt.Errorf("failed to fetch catalog: %w", err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	sigURLs := []string{source.Signature}
+	if source.Signature == "" {
+		sigURLs = nil
+		for _, suffix := range signatureSuffixes {
+			sigURLs = append(sigURLs, source.URL+suffix)
+		}
+	}
+	var sig []byte
+	for _, u := range sigURLs {
+		if sig, err = cm.httpGet(u); err == nil {
+			break
+		}
+	}
+	if sig == nil {
+		return nil, "", fmt.Errorf("catalog is unsigned: failed to fetch signature: %w", err)
+	}
+	if err := verifySignature(data, sig, source.TrustedKeys); err != nil {
+		return nil, "", fmt.Errorf("catalog signature: %w", err)
 	}
 
-	data, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read response: %w", err)
+	hash := sha256.Sum256(data)
+	revision := hex.EncodeToString(hash[:])
+	if source.SHA256 != "" && source.SHA256 != revision {
+		return nil, "", fmt.Errorf("hash mismatch: expected %s, got %s", source.SHA256, revision)
 	}
 
 	var catalog Catalog
@@ -199,29 +324,38 @@ func (cm *CatalogManager) fetchHTTPCatalog(url string) (*Catalog, error) {
 	// Try JSON first, then YAML
 	if err := json.Unmarshal(data, &catalog); err != nil {
 		if err := yaml.Unmarshal(data, &catalog); err != nil {
-			return nil, fmt.Errorf("failed to parse catalog: %w", err)
+			return nil, "", fmt.Errorf("failed to parse catalog: %w", err)
+		}
+	}
+
+	// Templates of an HTTP catalog come from the builtin catalog
+	for _, entry := range catalog.Entries {
+		if !filepath.IsLocal(entry.Compose) || (entry.Schema != "" && !filepath.IsLocal(entry.Schema)) {
+			return nil, "", fmt.Errorf("app %s: template paths must be relative", entry.ID)
 		}
 	}
 
 	catalog.UpdatedAt = time.Now()
-	return &catalog, nil
+	return &catalog, revision, nil
 }
 
-// verifyCatalogHash verifies the SHA256 hash of a catalog
-func (cm *CatalogManager) verifyCatalogHash(catalog *Catalog, expectedHash string) error {
-	data, err := json.Marshal(catalog)
+// httpGet fetches a URL, failing on any status but 200
+func (cm *CatalogManager) httpGet(url string) ([]byte, error) {
+	resp, err := cm.httpClient.Get(url)
 	if err != nil {
-		return fmt.Errorf("failed to marshal catalog: %w", err)
+		return nil, err
 	}
+	defer resp.Body.Close()
 
-	hash := sha256.Sum256(data)
-	actualHash := hex.EncodeToString(hash[:])
-
-	if actualHash != expectedHash {
-		return fmt.Errorf("hash mismatch: expected %s, got %s", expectedHash, actualHash)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
 	}
 
-	return nil
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	return data, nil
 }
 
 // saveCache saves the merged catalog to cache file
@@ -0,0 +1,271 @@
+package apps
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ChecksumsFile lists the SHA-256 of every file in a git catalog, in
+// sha256sum format
+const ChecksumsFile = "SHA256SUMS"
+
+// SignatureNotesRef holds the signatures of git catalogs: a git note on
+// each signed commit with a detached signature of its payload (see
+// signedPayload). A signature in the tree couldn't cover the commit.
+const SignatureNotesRef = "refs/notes/nos-catalog"
+
+// Signature files looked for next to a signed file when the source
+// doesn't name one
+var signatureSuffixes = []string{".minisig", ".sig"}
+
+var sourceDirPattern = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// gitTimeout bounds one clone or fetch
+const gitTimeout = 2 * time.Minute
+
+// gitCheckout is a verified clone waiting to replace the checkout of its
+// source
+type gitCheckout struct {
+	tmp string
+	dir string
+}
+
+// install moves the clone in place of the source's checkout
+func (c *gitCheckout) install() error {
+	return replaceDir(c.tmp, c.dir)
+}
+
+// discard removes the clone if it wasn't installed
+func (c *gitCheckout) discard() {
+	os.RemoveAll(c.tmp)
+}
+
+// fetchGitCatalog clones the source's branch or tag into a temporary
+// directory, verifies the signature of the commit and the checksums of
+// the checkout and loads its catalog.yaml. The entries point at their
+// templates in the source's directory under the cache directory, which
+// the returned checkout replaces once installed.
+func (cm *CatalogManager) fetchGitCatalog(source CatalogSource) (*Catalog, string, *gitCheckout, error) {
+	if strings.HasPrefix(source.URL, "-") || source.URL == "" {
+		return nil, "", nil, fmt.Errorf("invalid git url %q", source.URL)
+	}
+	ref := source.Tag
+	if ref == "" {
+		ref = source.Branch
+	}
+	if strings.HasPrefix(ref, "-") {
+		return nil, "", nil, fmt.Errorf("invalid ref %q", ref)
+	}
+	cacheDir := filepath.Dir(cm.cachePath)
+	dir := filepath.Join(cacheDir, "sources", sourceDirPattern.ReplaceAllString(source.Name, "_"))
+	tmpRoot := filepath.Join(cacheDir, "sources.tmp")
+	if err := os.MkdirAll(tmpRoot, 0700); err != nil {
+		return nil, "", nil, err
+	}
+	tmp, err := os.MkdirTemp(tmpRoot, filepath.Base(dir)+"-*")
+	if err != nil {
+		return nil, "", nil, err
+	}
+	checkout := &gitCheckout{tmp: tmp, dir: dir}
+	catalog, commit, err := loadGitCatalog(tmp, source, ref)
+	if err != nil {
+		checkout.discard()
+		return nil, "", nil, err
+	}
+	for i := range catalog.Entries {
+		entry := &catalog.Entries[i]
+		entry.Compose = filepath.Join(dir, filepath.FromSlash(entry.Compose))
+		if entry.Schema != "" {
+			entry.Schema = filepath.Join(dir, filepath.FromSlash(entry.Schema))
+		}
+	}
+	catalog.UpdatedAt = time.Now()
+	return catalog, commit, checkout, nil
+}
+
+// loadGitCatalog clones and verifies a source into the empty directory
+// tmp and loads its catalog, with template paths relative to it
+func loadGitCatalog(tmp string, source CatalogSource, ref string) (*Catalog, string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), gitTimeout)
+	defer cancel()
+	commit, err := cloneGit(ctx, tmp, source.URL, ref)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := verifyCheckout(ctx, tmp, commit, source); err != nil {
+		return nil, "", err
+	}
+
+	data, err := os.ReadFile(filepath.Join(tmp, "catalog.yaml"))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read catalog: %w", err)
+	}
+	var catalog Catalog
+	if err := yaml.Unmarshal(data, &catalog); err != nil {
+		return nil, "", fmt.Errorf("failed to parse catalog: %w", err)
+	}
+	for i := range catalog.Entries {
+		entry := &catalog.Entries[i]
+		if !filepath.IsLocal(entry.Compose) || (entry.Schema != "" && !filepath.IsLocal(entry.Schema)) {
+			return nil, "", fmt.Errorf("app %s: template paths must be relative", entry.ID)
+		}
+	}
+	attachManifests(&catalog, tmp)
+	return &catalog, commit, nil
+}
+
+// cloneGit makes the empty directory dir a shallow clone of ref (a branch
+// or tag, or the remote's HEAD when empty) with the signature notes, and
+// returns the commit it checked out
+func cloneGit(ctx context.Context, dir, url, ref string) (string, error) {
+	args := []string{"clone", "--quiet", "--depth", "1"}
+	if ref != "" {
+		args = append(args, "--branch", ref)
+	}
+	if _, err := git(ctx, "", append(args, "--", url, dir)...); err != nil {
+		return "", err
+	}
+	if _, err := git(ctx, dir, "fetch", "--quiet", "--depth", "1", "origin", "+"+SignatureNotesRef+":"+SignatureNotesRef); err != nil {
+		return "", fmt.Errorf("catalog is unsigned: no %s: %w", SignatureNotesRef, err)
+	}
+	return git(ctx, dir, "rev-parse", "HEAD")
+}
+
+// replaceDir moves the directory tmp to dir, replacing what was there
+func replaceDir(tmp, dir string) error {
+	if err := os.MkdirAll(filepath.Dir(dir), 0700); err != nil {
+		return err
+	}
+	old := tmp + ".old"
+	if err := os.Rename(dir, old); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		os.Rename(old, dir)
+		return err
+	}
+	return os.RemoveAll(old)
+}
+
+// git runs a git command in dir and returns its trimmed output
+func git(ctx context.Context, dir string, args ...string) (string, error) {
+	if dir != "" {
+		args = append([]string{"-C", dir}, args...)
+	}
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %s", args[0], strings.TrimSpace(stderr.String()+" "+err.Error()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// signedPayload is what the signature of a git catalog covers: the
+// commit, so an old signature can't vouch for another commit, and the
+// checksums of its files
+func signedPayload(commit string, sums []byte) []byte {
+	return append([]byte("commit "+commit+"\n"), sums...)
+}
+
+// verifyCheckout checks the signature note of the commit and that the
+// checkout holds exactly the files the checksums list, with those
+// contents
+func verifyCheckout(ctx context.Context, dir, commit string, source CatalogSource) error {
+	sums, err := os.ReadFile(filepath.Join(dir, ChecksumsFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("catalog is unsigned: %s is missing", ChecksumsFile)
+		}
+		return err
+	}
+	sig, err := git(ctx, dir, "notes", "--ref", SignatureNotesRef, "show", commit)
+	if err != nil {
+		return fmt.Errorf("catalog is unsigned: commit %s has no note in %s", commit, SignatureNotesRef)
+	}
+	if err := verifySignature(signedPayload(commit, sums), []byte(sig+"\n"), source.TrustedKeys); err != nil {
+		return fmt.Errorf("catalog signature: %w", err)
+	}
+
+	want, err := parseChecksums(sums)
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			if rel == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if rel == ChecksumsFile {
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return fmt.Errorf("catalog holds %s, which is not a regular file", rel)
+		}
+		sum, ok := want[rel]
+		if !ok {
+			return fmt.Errorf("catalog holds %s, which %s doesn't list", rel, ChecksumsFile)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if got := sha256.Sum256(data); hex.EncodeToString(got[:]) != sum {
+			return fmt.Errorf("checksum mismatch for %s", rel)
+		}
+		seen[rel] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for rel := range want {
+		if !seen[rel] {
+			return fmt.Errorf("%s lists %s, which is missing", ChecksumsFile, rel)
+		}
+	}
+	return nil
+}
+
+// parseChecksums reads sha256sum output into a map of path to digest
+func parseChecksums(data []byte) (map[string]string, error) {
+	sums := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		sum, path, ok := strings.Cut(line, " ")
+		path = strings.TrimPrefix(strings.TrimPrefix(path, " "), "*")
+		path = strings.TrimPrefix(path, "./")
+		if !ok || len(sum) != 64 || !filepath.IsLocal(path) {
+			return nil, fmt.Errorf("malformed %s line: %q", ChecksumsFile, line)
+		}
+		sums[filepath.ToSlash(filepath.Clean(path))] = strings.ToLower(sum)
+	}
+	return sums, scanner.Err()
+}
@@ -0,0 +1,396 @@
+package apps
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type minisigner struct {
+	id   []byte
+	priv ed25519.PrivateKey
+}
+
+func newMinisigner(t *testing.T) *minisigner {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &minisigner{id: id, priv: priv}
+}
+
+func (m *minisigner) publicKey() string {
+	raw := append(append([]byte("Ed"), m.id...), m.priv.Public().(ed25519.PublicKey)...)
+	return "untrusted comment: minisign public key\n" + base64.StdEncoding.EncodeToString(raw) + "\n"
+}
+
+func (m *minisigner) sign(data []byte) []byte {
+	sig := ed25519.Sign(m.priv, data)
+	trusted := "timestamp:1700000000"
+	global := ed25519.Sign(m.priv, append(append([]byte{}, sig...), trusted...))
+	return []byte(fmt.Sprintf("untrusted comment: signature\n%s\ntrusted comment: %s\n%s\n",
+		base64.StdEncoding.EncodeToString(append(append([]byte("Ed"), m.id...), sig...)),
+		trusted, base64.StdEncoding.EncodeToString(global)))
+}
+
+// sshSign makes what ssh-keygen -Y sign -n namespace would
+func sshSign(t *testing.T, priv ed25519.PrivateKey, namespace string, data []byte) []byte {
+	t.Helper()
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(data)
+	signed := append([]byte("SSHSIG"), ssh.Marshal(struct {
+		Namespace, Reserved, Hash string
+		Digest                    []byte
+	}{namespace, "", "sha256", digest[:]})...)
+	sig, err := signer.Sign(rand.Reader, signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := append([]byte("SSHSIG"), ssh.Marshal(struct {
+		Version                   uint32
+		PublicKey                 []byte
+		Namespace, Reserved, Hash string
+		Signature                 []byte
+	}{1, signer.PublicKey().Marshal(), namespace, "", "sha256", ssh.Marshal(sig)})...)
+	return pem.EncodeToMemory(&pem.Block{Type: "SSH SIGNATURE", Bytes: blob})
+}
+
+func TestVerifySignature(t *testing.T) {
+	data := []byte("catalog")
+	signer := newMinisigner(t)
+	other := newMinisigner(t)
+	_, sshKey, _ := ed25519.GenerateKey(rand.Reader)
+	sshPub, _ := ssh.NewPublicKey(sshKey.Public())
+	authorized := string(ssh.MarshalAuthorizedKey(sshPub))
+
+	if err := verifySignature(data, signer.sign(data), []string{other.publicKey(), signer.publicKey()}); err != nil {
+		t.Errorf("minisign: %v", err)
+	}
+	if err := verifySignature(data, sshSign(t, sshKey, SSHSignatureNamespace, data), []string{signer.publicKey(), authorized}); err != nil {
+		t.Errorf("ssh: %v", err)
+	}
+
+	for name, tc := range map[string]struct {
+		sig  []byte
+		keys []string
+	}{
+		"wrong key":       {signer.sign(data), []string{other.publicKey()}},
+		"tampered data":   {signer.sign([]byte("catalog!")), []string{signer.publicKey()}},
+		"no keys":         {signer.sign(data), nil},
+		"ssh wrong key":   {sshSign(t, sshKey, SSHSignatureNamespace, data), []string{signer.publicKey()}},
+		"ssh namespace":   {sshSign(t, sshKey, "file", data), []string{authorized}},
+		"not a signature": {[]byte("hello"), []string{signer.publicKey()}},
+	} {
+		if err := verifySignature(data, tc.sig, tc.keys); err == nil {
+			t.Errorf("%s: verified", name)
+		}
+	}
+}
+
+// catalogRepo is a git catalog source: a work tree pushed to a local
+// bare repository
+type catalogRepo struct {
+	t    *testing.T
+	work string
+	bare string
+}
+
+func runGit(t *testing.T, dir string, args ...string) {
+	t.Helper()
+	cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com", "-c", "init.defaultBranch=main"}, args...)...)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git %v: %v\n%s", args, err, out)
+	}
+}
+
+func newCatalogRepo(t *testing.T) *catalogRepo {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	r := &catalogRepo{t: t, work: t.TempDir(), bare: filepath.Join(t.TempDir(), "catalog.git")}
+	runGit(t, "", "init", "--quiet", "--bare", r.bare)
+	runGit(t, r.work, "init", "--quiet")
+	runGit(t, r.work, "remote", "add", "origin", r.bare)
+	writeFile(t, filepath.Join(r.work, "catalog.yaml"), `version: "1.0"
+entries:
+  - id: wiki
+    name: Wiki
+    version: "1.0"
+    compose: templates/wiki/compose.yaml
+`)
+	writeFile(t, filepath.Join(r.work, "templates/wiki/compose.yaml"), "services:\n  app:\n    image: wiki:${WIKI_VERSION:-1}\n")
+	return r
+}
+
+// writeSums writes SHA256SUMS for the work tree
+func (r *catalogRepo) writeSums() {
+	var lines []string
+	filepath.Walk(r.work, func(path string, fi os.FileInfo, err error) error {
+		rel, _ := filepath.Rel(r.work, path)
+		if fi.IsDir() {
+			if rel == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if rel == ChecksumsFile {
+			return nil
+		}
+		data, _ := os.ReadFile(path)
+		sum := sha256.Sum256(data)
+		lines = append(lines, hex.EncodeToString(sum[:])+"  "+filepath.ToSlash(rel))
+		return nil
+	})
+	sort.Strings(lines)
+	writeFile(r.t, filepath.Join(r.work, ChecksumsFile), strings.Join(lines, "\n")+"\n")
+}
+
+// commit commits the work tree and returns the commit
+func (r *catalogRepo) commit() string {
+	runGit(r.t, r.work, "add", "-A")
+	runGit(r.t, r.work, "commit", "--quiet", "-m", "update")
+	out, err := exec.Command("git", "-C", r.work, "rev-parse", "HEAD").Output()
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// sign attaches a signature of the commit and the SHA256SUMS of the work
+// tree as a note, the way a catalog maintainer would
+func (r *catalogRepo) sign(commit string, sig func([]byte) []byte) {
+	sums, err := os.ReadFile(filepath.Join(r.work, ChecksumsFile))
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	sigFile := filepath.Join(r.t.TempDir(), "sig")
+	writeFile(r.t, sigFile, string(sig(signedPayload(commit, sums))))
+	runGit(r.t, r.work, "notes", "--ref", SignatureNotesRef, "add", "-f", "-F", sigFile, commit)
+}
+
+func (r *catalogRepo) push(tag string) {
+	runGit(r.t, r.work, "push", "--quiet", "origin", "HEAD:main")
+	if exec.Command("git", "-C", r.work, "show-ref", "--quiet", SignatureNotesRef).Run() == nil {
+		runGit(r.t, r.work, "push", "--quiet", "--force", "origin", SignatureNotesRef)
+	}
+	if tag != "" {
+		runGit(r.t, r.work, "tag", tag)
+		runGit(r.t, r.work, "push", "--quiet", "origin", tag)
+	}
+}
+
+func newSourceCatalog(t *testing.T, source string) *CatalogManager {
+	t.Helper()
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "catalog.yaml"), "version: \"1.0\"\nentries: []\n")
+	writeFile(t, filepath.Join(root, "sources.d", "community.yaml"), source)
+	cm := NewCatalogManager(root, filepath.Join(t.TempDir(), "cache", "catalog.json"), filepath.Join(root, "sources.d"))
+	if err := cm.LoadSources(); err != nil {
+		t.Fatal(err)
+	}
+	return cm
+}
+
+func syncSource(t *testing.T, cm *CatalogManager) SourceStatus {
+	t.Helper()
+	if err := cm.SyncRemoteCatalogs(); err != nil {
+		t.Fatal(err)
+	}
+	catalog, err := cm.GetCatalog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(catalog.Sources) != 1 {
+		t.Fatalf("sources %+v", catalog.Sources)
+	}
+	return catalog.Sources[0]
+}
+
+func TestGitCatalogSource(t *testing.T) {
+	repo := newCatalogRepo(t)
+	signer := newMinisigner(t)
+	repo.writeSums()
+	signed := repo.commit()
+	repo.sign(signed, signer.sign)
+	repo.push("v1")
+
+	cm := newSourceCatalog(t, fmt.Sprintf(`name: community
+type: git
+url: %s
+tag: v1
+trusted_keys:
+  - %q
+enabled: true
+`, repo.bare, signer.publicKey()))
+
+	status := syncSource(t, cm)
+	if status.Error != "" || status.Entries != 1 || status.Revision != signed {
+		t.Fatalf("status %+v", status)
+	}
+	entry, err := cm.GetEntry("wiki")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := NewTemplateRenderer(cm.builtinPath).RenderComposeFile(entry, map[string]interface{}{"WIKI_VERSION": "2"})
+	if err != nil || !strings.Contains(string(out), "image: wiki:2") {
+		t.Fatalf("render %s: %v", out, err)
+	}
+
+	// A template changed after signing is rejected on the next fetch and
+	// leaves the verified checkout in place
+	writeFile(t, filepath.Join(repo.work, "templates/wiki/compose.yaml"), "services:\n  app:\n    image: evil\n")
+	repo.sign(repo.commit(), signer.sign)
+	repo.push("v2")
+	cm.sources[0].Tag = "v2"
+	status = syncSource(t, cm)
+	if !strings.Contains(status.Error, "checksum mismatch for templates/wiki/compose.yaml") {
+		t.Fatalf("tampered template: %+v", status)
+	}
+	if _, err := cm.GetEntry("wiki"); err == nil {
+		t.Error("tampered catalog merged")
+	}
+	if data, _ := os.ReadFile(entry.Compose); strings.Contains(string(data), "evil") {
+		t.Error("tampered template replaced the verified checkout")
+	}
+
+	// The signature of another commit doesn't vouch for this one, even
+	// with matching checksums
+	repo.writeSums()
+	moved := repo.commit()
+	runGit(t, repo.work, "notes", "--ref", SignatureNotesRef, "copy", signed, moved)
+	repo.push("v3")
+	cm.sources[0].Tag = "v3"
+	if status = syncSource(t, cm); !strings.Contains(status.Error, ErrBadSignature.Error()) {
+		t.Fatalf("moved signature: %+v", status)
+	}
+
+	// Re-signed, it's accepted, now with an SSH signature
+	_, sshKey, _ := ed25519.GenerateKey(rand.Reader)
+	sshPub, _ := ssh.NewPublicKey(sshKey.Public())
+	repo.sign(moved, func(data []byte) []byte { return sshSign(t, sshKey, SSHSignatureNamespace, data) })
+	repo.push("")
+	cm.sources[0].Tag = ""
+	cm.sources[0].Branch = "main"
+	cm.sources[0].TrustedKeys = []string{string(ssh.MarshalAuthorizedKey(sshPub))}
+	if status = syncSource(t, cm); status.Error != "" || status.Revision != moved {
+		t.Fatalf("re-signed: %+v", status)
+	}
+
+	// The same catalog under a key the source doesn't trust
+	cm.sources[0].TrustedKeys = []string{signer.publicKey()}
+	if status = syncSource(t, cm); !strings.Contains(status.Error, ErrBadSignature.Error()) {
+		t.Fatalf("untrusted key: %+v", status)
+	}
+}
+
+func TestUnsignedGitCatalogRejected(t *testing.T) {
+	repo := newCatalogRepo(t)
+	repo.writeSums()
+	repo.commit()
+	repo.push("")
+	signer := newMinisigner(t)
+
+	cm := newSourceCatalog(t, fmt.Sprintf("name: community\ntype: git\nurl: %s\ntrusted_keys: [%q]\nenabled: true\n", repo.bare, signer.publicKey()))
+	if status := syncSource(t, cm); !strings.Contains(status.Error, "unsigned") {
+		t.Fatalf("unsigned: %+v", status)
+	}
+
+	// A signed checkout with a file the checksums don't list
+	writeFile(t, filepath.Join(repo.work, "templates/extra/compose.yaml"), "services: {}\n")
+	repo.sign(repo.commit(), signer.sign)
+	repo.push("")
+	if status := syncSource(t, cm); !strings.Contains(status.Error, "templates/extra/compose.yaml") {
+		t.Fatalf("unlisted file: %+v", status)
+	}
+
+	cm.sources[0].TrustedKeys = nil
+	if status := syncSource(t, cm); !strings.Contains(status.Error, "trusted_keys") {
+		t.Fatalf("no keys: %+v", status)
+	}
+}
+
+func TestHTTPCatalogSignature(t *testing.T) {
+	signer := newMinisigner(t)
+	body := []byte(`{"version":"1.0","entries":[{"id":"wiki","name":"Wiki","version":"1","compose":"templates/wiki/compose.yaml"}]}`)
+	sig := signer.sign(body)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/catalog.json":
+			w.Write(body)
+		case "/catalog.json.minisig":
+			w.Write(sig)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	cm := newSourceCatalog(t, fmt.Sprintf("name: community\ntype: https\nurl: %s/catalog.json\ntrusted_keys: [%q]\nenabled: true\n", srv.URL, signer.publicKey()))
+	if status := syncSource(t, cm); status.Error != "" || status.Entries != 1 {
+		t.Fatalf("signed: %+v", status)
+	}
+
+	body = []byte(`{"version":"1.0","entries":[{"id":"wiki","name":"Wiki","version":"1","compose":"/etc/passwd"}]}`)
+	if status := syncSource(t, cm); !strings.Contains(status.Error, ErrBadSignature.Error()) {
+		t.Fatalf("tampered: %+v", status)
+	}
+	if _, err := cm.GetEntry("wiki"); err == nil {
+		t.Error("tampered catalog merged")
+	}
+}
+
+func TestRemoteCatalogCannotOverrideBuiltin(t *testing.T) {
+	signer := newMinisigner(t)
+	body := []byte(`{"version":"1.0","entries":[` +
+		`{"id":"notes","name":"Evil notes","version":"9","compose":"templates/evil/compose.yaml"},` +
+		`{"id":"wiki","name":"Wiki","version":"1","compose":"templates/wiki/compose.yaml"}]}`)
+	sig := signer.sign(body)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/catalog.json":
+			w.Write(body)
+		case "/catalog.json.minisig":
+			w.Write(sig)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	cm := newManifestCatalog(t)
+	writeFile(t, filepath.Join(cm.sourcesPath, "community.yaml"), fmt.Sprintf("name: community\ntype: https\nurl: %s/catalog.json\ntrusted_keys: [%q]\nenabled: true\n", srv.URL, signer.publicKey()))
+	if err := cm.LoadSources(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cm.SyncRemoteCatalogs(); err != nil {
+		t.Fatal(err)
+	}
+	if entry, err := cm.GetEntry("notes"); err != nil || entry.Name != "Notes" || entry.Version != "2.1" {
+		t.Fatalf("builtin notes replaced: %+v %v", entry, err)
+	}
+	if _, err := cm.GetEntry("wiki"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -4,11 +4,15 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"os/exec"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	"nithronos/backend/nosd/pkg/appsdk"
 )
 
 // HealthMonitor monitors app health status
@@ -22,6 +26,14 @@ type HealthMonitor struct {
 	running     bool
 	stopCh      chan struct{}
 	healthCache map[string]HealthStatus
+	checks      map[string]*checkState // manifest checks by app ID and index
+}
+
+// checkState tracks one manifest health check across monitor rounds
+type checkState struct {
+	last     time.Time
+	failures int
+	err      error
 }
 
 // NewHealthMonitor creates a new health monitor
@@ -35,6 +47,7 @@ func NewHealthMonitor(stateStore *StateStore, catalogMgr *CatalogManager) *Healt
 		},
 		interval:    10 * time.Second,
 		healthCache: make(map[string]HealthStatus),
+		checks:      make(map[string]*checkState),
 		stopCh:      make(chan struct{}),
 	}
 }
@@ -150,8 +163,13 @@ func (hm *HealthMonitor) checkAppHealth(ctx context.Context, app InstalledApp) {
 		return
 	}
 
-	// Perform HTTP health check if configured
-	if entry.Health.Type == "http" && entry.Health.URL != "" {
+	// Run the manifest's checks, or the catalog's HTTP check
+	if entry.Manifest != nil && len(entry.Manifest.Runtime.HealthChecks) > 0 {
+		if msg := hm.checkManifestHealth(ctx, app.ID, entry.Manifest.Runtime.HealthChecks, containerHealth); msg != "" {
+			allHealthy = false
+			health.Message = msg
+		}
+	} else if entry.Health.Type == "http" && entry.Health.URL != "" {
 		httpHealthy := hm.checkHTTPHealth(ctx, app.ID, entry.Health)
 		if !httpHealthy {
 			allHealthy = false
@@ -210,7 +228,7 @@ func (hm *HealthMonitor) getContainerHealth(ctx context.Context, appID string) (
 // checkHTTPHealth performs HTTP health check
 func (hm *HealthMonitor) checkHTTPHealth(ctx context.Context, appID string, config HealthConfig) bool {
 	// Replace container name in URL with actual container name
-	url := strings.ReplaceAll(config.URL, "${CONTAINER}", fmt.Sprintf("nos-app-%s-%s-1", appID, config.Container))
+	url := strings.ReplaceAll(config.URL, "${CONTAINER}", containerName(appID, config.Container))
 
 	// Create request with context
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
@@ -229,6 +247,108 @@ func (hm *HealthMonitor) checkHTTPHealth(ctx context.Context, appID string, conf
 	return resp.StatusCode >= 200 && resp.StatusCode < 300
 }
 
+// checkManifestHealth runs an app's manifest health checks and returns
+// what is failing, or "" when all pass. A check runs at most once per its
+// interval and counts as failing once it has failed retries times in a row.
+func (hm *HealthMonitor) checkManifestHealth(ctx context.Context, appID string, checks []appsdk.HealthCheck, containers []ContainerHealth) string {
+	var failing []string
+	for i, hc := range checks {
+		key := appID + "/" + strconv.Itoa(i)
+		hm.mu.Lock()
+		state := hm.checks[key]
+		if state == nil {
+			state = &checkState{}
+			hm.checks[key] = state
+		}
+		due := time.Since(state.last) >= time.Duration(hc.Interval)*time.Second
+		hm.mu.Unlock()
+
+		if due {
+			err := hm.runHealthCheck(ctx, appID, hc, containers)
+			hm.mu.Lock()
+			state.last = time.Now()
+			state.err = err
+			if err != nil {
+				state.failures++
+			} else {
+				state.failures = 0
+			}
+			hm.mu.Unlock()
+		}
+
+		hm.mu.RLock()
+		failures, err := state.failures, state.err
+		hm.mu.RUnlock()
+		if err != nil && failures >= max(1, hc.Retries) {
+			failing = append(failing, fmt.Sprintf("%s check failed: %v", hc.Type, err))
+		}
+	}
+	return strings.Join(failing, "; ")
+}
+
+// runHealthCheck runs one manifest health check
+func (hm *HealthMonitor) runHealthCheck(ctx context.Context, appID string, hc appsdk.HealthCheck, containers []ContainerHealth) error {
+	timeout := 5 * time.Second
+	if hc.Timeout > 0 {
+		timeout = time.Duration(hc.Timeout) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	switch hc.Type {
+	case "container":
+		name := containerName(appID, hc.Container)
+		for _, c := range containers {
+			if c.Name != name && c.Name != hc.Container {
+				continue
+			}
+			if c.Status != "running" {
+				return fmt.Errorf("%s is %s", hc.Container, c.Status)
+			}
+			if c.Health != "" && c.Health != "healthy" {
+				return fmt.Errorf("%s is %s", hc.Container, c.Health)
+			}
+			return nil
+		}
+		return fmt.Errorf("%s is not running", hc.Container)
+
+	case "http":
+		url := strings.ReplaceAll(hc.URL, "${CONTAINER}", containerName(appID, hc.Container))
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := hm.httpClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return fmt.Errorf("%s returned %d", url, resp.StatusCode)
+		}
+		return nil
+
+	case "tcp":
+		// Without a container the port is one published on the host
+		host := "127.0.0.1"
+		if hc.Container != "" {
+			host = containerName(appID, hc.Container)
+		}
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(hc.Port)))
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	return fmt.Errorf("unknown check type %s", hc.Type)
+}
+
+// containerName is the name compose gives the first container of a service
+func containerName(appID, service string) string {
+	return fmt.Sprintf("nos-app-%s-%s-1", appID, service)
+}
+
 // updateHealth updates health status in cache and state
 func (hm *HealthMonitor) updateHealth(appID string, health HealthStatus) {
 	hm.mu.Lock()
@@ -23,6 +23,8 @@ type LifecycleManager struct {
 	helperPath   string
 	snapshotPath string
 	caddyPath    string
+	certs        CertSource
+	sso          SSOProvider
 	eventLogger  EventLogger
 }
 
@@ -53,8 +55,20 @@ func NewLifecycleManager(
 	}
 }
 
+// UseCertSource makes app sites get their certificates the way the
+// HTTPS manager says
+func (lm *LifecycleManager) UseCertSource(certs CertSource) {
+	lm.certs = certs
+}
+
+// UseSSOProvider registers apps that support it as OpenID Connect
+// clients of provider
+func (lm *LifecycleManager) UseSSOProvider(provider SSOProvider) {
+	lm.sso = provider
+}
+
 // InstallApp installs a new application
-func (lm *LifecycleManager) InstallApp(ctx context.Context, req InstallRequest, userID string) error {
+func (lm *LifecycleManager) InstallApp(ctx context.Context, req InstallRequest, userID string) (err error) {
 	// Get catalog entry
 	entry, err := lm.catalogMgr.GetEntry(req.ID)
 	if err != nil {
@@ -66,15 +80,34 @@ func (lm *LifecycleManager) InstallApp(ctx context.Context, req InstallRequest,
 		return fmt.Errorf("app already installed: %s", req.ID)
 	}
 
+	// The admin must have accepted everything the manifest asks for
+	if err := checkPermissions(entry, req.AcceptedPermissions); err != nil {
+		return err
+	}
+
 	// Validate parameters
 	if err := lm.renderer.ValidateParams(entry, req.Params); err != nil {
 		return fmt.Errorf("parameter validation failed: %w", err)
 	}
 
+	// Map the declared mounts to host paths
+	mounts, err := mountPaths(entry.Manifest, lm.appsRoot, req.ID, req.Mounts)
+	if err != nil {
+		return fmt.Errorf("mount validation failed: %w", err)
+	}
+
+	// Work out how the web UI is reached
+	expose, err := lm.resolveExposure(req.ID, entry, req.Expose)
+	if err != nil {
+		return fmt.Errorf("exposure validation failed: %w", err)
+	}
+
 	// Log installation start event
 	lm.logEvent("app.install.start", req.ID, userID, map[string]interface{}{
-		"version": entry.Version,
-		"params":  req.Params,
+		"version":     entry.Version,
+		"params":      req.Params,
+		"mounts":      mounts,
+		"permissions": permissionIDs(entry.Permissions),
 	})
 
 	// Create app directories
@@ -90,9 +123,13 @@ func (lm *LifecycleManager) InstallApp(ctx context.Context, req InstallRequest,
 	if err := lm.ensureDataSubvolume(req.ID); err != nil {
 		return fmt.Errorf("failed to create data directory: %w", err)
 	}
+	if err := ensureMountDirs(appDir, mounts); err != nil {
+		os.RemoveAll(appDir)
+		return fmt.Errorf("failed to create mount directories: %w", err)
+	}
 
 	// Render compose file
-	composeContent, err := lm.renderer.RenderComposeFile(entry, req.Params)
+	composeContent, err := lm.renderer.RenderComposeFile(entry, withMounts(req.Params, mounts))
 	if err != nil {
 		os.RemoveAll(appDir)
 		return fmt.Errorf("failed to render compose file: %w", err)
@@ -104,8 +141,23 @@ func (lm *LifecycleManager) InstallApp(ctx context.Context, req InstallRequest,
 		return fmt.Errorf("failed to write compose file: %w", err)
 	}
 
+	// An app that signs users in with NithronOS gets its OIDC client
+	// in the env file
+	ssoClientID, envParams, err := lm.registerSSO(req.ID, entry, expose, req.Params)
+	if err != nil {
+		os.RemoveAll(appDir)
+		return fmt.Errorf("failed to register OIDC client: %w", err)
+	}
+	if ssoClientID != "" {
+		defer func() {
+			if err != nil {
+				lm.removeSSO(req.ID)
+			}
+		}()
+	}
+
 	// Render environment file
-	envContent, err := lm.renderer.RenderEnvFile(req.Params)
+	envContent, err := lm.renderer.RenderEnvFile(envParams)
 	if err != nil {
 		os.RemoveAll(appDir)
 		return fmt.Errorf("failed to render env file: %w", err)
@@ -117,6 +169,14 @@ func (lm *LifecycleManager) InstallApp(ctx context.Context, req InstallRequest,
 		return fmt.Errorf("failed to write env file: %w", err)
 	}
 
+	// Keep the manifest with the app; backups read its quiesce hooks
+	if entry.Manifest != nil {
+		if err := entry.Manifest.SaveManifest(filepath.Join(configDir, ManifestFile)); err != nil {
+			os.RemoveAll(appDir)
+			return err
+		}
+	}
+
 	// Set ownership
 	if err := lm.setAppOwnership(appDir); err != nil {
 		os.RemoveAll(appDir)
@@ -137,9 +197,9 @@ func (lm *LifecycleManager) InstallApp(ctx context.Context, req InstallRequest,
 		return fmt.Errorf("failed to start app: %w", err)
 	}
 
-	// Setup reverse proxy if ports are exposed
-	if len(entry.Defaults.Ports) > 0 {
-		if err := lm.setupReverseProxy(req.ID, entry.Defaults.Ports); err != nil {
+	// Setup reverse proxy if the web UI is exposed
+	if expose != nil {
+		if err := lm.setupReverseProxy(req.ID, entry, expose); err != nil {
 			// Log warning but continue
 			fmt.Fprintf(os.Stderr, "Warning: failed to setup reverse proxy: %v\n", err)
 		}
@@ -153,12 +213,16 @@ func (lm *LifecycleManager) InstallApp(ctx context.Context, req InstallRequest,
 		Status:  StatusRunning,
 		Params:  req.Params,
 		Ports:   entry.Defaults.Ports,
-		URLs:    lm.generateAppURLs(req.ID, entry.Defaults.Ports),
+		URLs:    lm.generateAppURLs(req.ID, entry, expose),
 		Health: HealthStatus{
 			Status:    "unknown",
 			CheckedAt: time.Now(),
 		},
-		Snapshots: []AppSnapshot{},
+		Snapshots:   []AppSnapshot{},
+		Mounts:      mounts,
+		Permissions: permissionIDs(entry.Permissions),
+		Expose:      exposureOrNone(expose),
+		SSOClientID: ssoClientID,
 	}
 
 	if snapshotID != "" {
@@ -208,6 +272,17 @@ func (lm *LifecycleManager) UpgradeApp(ctx context.Context, appID string, req Up
 		return fmt.Errorf("app not found in catalog: %w", err)
 	}
 
+	// Permissions the new version adds need accepting again
+	if err := checkPermissions(entry, app.Permissions, req.AcceptedPermissions); err != nil {
+		return err
+	}
+
+	// Mounts keep their paths; mounts the new version adds need one
+	mounts, err := mountPaths(entry.Manifest, lm.appsRoot, appID, givenMounts(entry.Manifest, filepath.Join(lm.appsRoot, appID), app.Mounts))
+	if err != nil {
+		return fmt.Errorf("mount validation failed: %w", err)
+	}
+
 	// Log upgrade start event
 	lm.logEvent("app.upgrade.start", appID, userID, map[string]interface{}{
 		"from_version": app.Version,
@@ -219,6 +294,16 @@ func (lm *LifecycleManager) UpgradeApp(ctx context.Context, appID string, req Up
 	if err != nil {
 		return fmt.Errorf("failed to create pre-upgrade snapshot: %w", err)
 	}
+	snapshot := AppSnapshot{
+		ID:        snapshotID,
+		Timestamp: time.Now(),
+		Name:      "pre-upgrade",
+		Path:      filepath.Join(lm.appsRoot, ".snapshots", appID, snapshotID),
+	}
+	app.Snapshots = append(app.Snapshots, snapshot)
+	if err := lm.stateStore.AddSnapshot(appID, snapshot); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to record snapshot: %v\n", err)
+	}
 
 	// Update app state to upgrading
 	if err := lm.stateStore.UpdateAppStatus(appID, StatusUpgrading); err != nil {
@@ -243,7 +328,13 @@ func (lm *LifecycleManager) UpgradeApp(ctx context.Context, appID string, req Up
 
 	// Render new compose file
 	configDir := filepath.Join(lm.appsRoot, appID, "config")
-	composeContent, err := lm.renderer.RenderComposeFile(entry, params)
+	if err := ensureMountDirs(filepath.Join(lm.appsRoot, appID), mounts); err != nil {
+		if err := lm.stateStore.UpdateAppStatus(appID, StatusError); err != nil {
+			fmt.Printf("Failed to update app status: %v\n", err)
+		}
+		return fmt.Errorf("failed to create mount directories: %w", err)
+	}
+	composeContent, err := lm.renderer.RenderComposeFile(entry, withMounts(params, mounts))
 	if err != nil {
 		if err := lm.stateStore.UpdateAppStatus(appID, StatusError); err != nil {
 			fmt.Printf("Failed to update app status: %v\n", err)
@@ -316,10 +407,36 @@ func (lm *LifecycleManager) UpgradeApp(ctx context.Context, appID string, req Up
 		return fmt.Errorf("app unhealthy after upgrade, rolled back")
 	}
 
+	// The new manifest replaces the old one
+	manifestPath := filepath.Join(configDir, ManifestFile)
+	if entry.Manifest != nil {
+		if err := entry.Manifest.SaveManifest(manifestPath); err != nil {
+			fmt.Printf("Failed to save manifest: %v\n", err)
+		}
+	} else {
+		os.Remove(manifestPath)
+	}
+
+	// The new version may serve its web UI elsewhere
+	expose, err := lm.resolveExposure(appID, entry, app.Expose)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: app %s is no longer exposed: %v\n", appID, err)
+	}
+	if err := lm.setupReverseProxy(appID, entry, expose); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to setup reverse proxy: %v\n", err)
+	}
+
 	// Update app state
 	app.Version = req.Version
 	app.Params = params
 	app.Status = StatusRunning
+	app.Mounts = mounts
+	app.Permissions = permissionIDs(entry.Permissions)
+	app.Expose = exposureOrNone(expose)
+	app.URLs = lm.generateAppURLs(appID, entry, expose)
+	// The next update check finds what is left to update
+	app.Update = nil
+	lm.updateSSO(app, entry, expose)
 	if err := lm.stateStore.UpdateApp(*app); err != nil {
 		return fmt.Errorf("failed to update app state: %w", err)
 	}
@@ -394,12 +511,13 @@ func (lm *LifecycleManager) DeleteApp(ctx context.Context, appID string, keepDat
 	}
 
 	// Remove Caddy configuration
-	caddyPath := filepath.Join(lm.caddyPath, fmt.Sprintf("app-%s.caddy", appID))
-	os.Remove(caddyPath)
-	if err := lm.reloadCaddy(); err != nil {
+	if err := lm.setupReverseProxy(appID, nil, nil); err != nil {
 		fmt.Printf("Failed to reload Caddy after app removal: %v\n", err)
 	}
 
+	// Its OIDC client goes with it
+	lm.removeSSO(appID)
+
 	// Remove app directory if not keeping data
 	if !keepData {
 		appDir := filepath.Join(lm.appsRoot, appID)
@@ -510,40 +628,21 @@ func (lm *LifecycleManager) setAppOwnership(appDir string) error {
 	return cmd.Run()
 }
 
-func (lm *LifecycleManager) setupReverseProxy(appID string, ports []PortMapping) error {
-	// Generate Caddy snippet
-	snippet, err := lm.renderer.RenderCaddySnippet(appID, ports)
-	if err != nil {
-		return err
-	}
-
-	if snippet == nil {
-		return nil // No proxy needed
-	}
-
-	// Write to Caddyfile.d
-	snippetPath := filepath.Join(lm.caddyPath, fmt.Sprintf("app-%s.caddy", appID))
-	if err := os.WriteFile(snippetPath, snippet, 0644); err != nil {
-		return fmt.Errorf("failed to write Caddy snippet: %w", err)
-	}
-
-	// Reload Caddy
-	return lm.reloadCaddy()
-}
-
 func (lm *LifecycleManager) reloadCaddy() error {
 	cmd := exec.Command("systemctl", "reload", "caddy")
 	return cmd.Run()
 }
 
-func (lm *LifecycleManager) generateAppURLs(appID string, ports []PortMapping) []string {
+func (lm *LifecycleManager) generateAppURLs(appID string, entry *CatalogEntry, expose *Exposure) []string {
 	urls := []string{}
 
-	// Add path-based URL
-	urls = append(urls, fmt.Sprintf("/apps/%s/", appID))
+	// Add the proxied web UI
+	if expose != nil {
+		urls = append(urls, lm.exposureURL(appID, entry, expose))
+	}
 
 	// Add port-based URLs if any
-	for _, port := range ports {
+	for _, port := range entry.Defaults.Ports {
 		if port.Protocol == "tcp" {
 			urls = append(urls, fmt.Sprintf("http://localhost:%d", port.Host))
 		}
@@ -0,0 +1,382 @@
+package apps
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"nithronos/backend/nosd/pkg/appsdk"
+)
+
+// ManifestFile is the name of an app's manifest, next to its compose template
+const ManifestFile = "nosapp.yaml"
+
+// ErrPermissionsNotAccepted is returned when an install or upgrade lacks
+// the admin's consent to a permission the app's manifest asks for
+var ErrPermissionsNotAccepted = errors.New("permissions not accepted")
+
+var mountNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+var (
+	webPathPattern    = regexp.MustCompile(`^(/[A-Za-z0-9._~-]+)+/?$`)
+	headerNamePattern = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+)
+
+// Host paths an app may never mount, on top of other apps' directories
+var forbiddenMountRoots = []string{"/boot", "/dev", "/etc", "/proc", "/root", "/run", "/sys", "/usr", "/var/lib/nos"}
+
+// applyManifest fills entry in from the app's manifest, which wins over
+// what catalog.yaml says. dir is the template directory relative to the
+// catalog root; the manifest's compose path is relative to it. An entry
+// embedded in a remote catalog passes "" and keeps its compose path.
+func applyManifest(entry *CatalogEntry, m *appsdk.Manifest, dir string) error {
+	if err := m.Validate(); err != nil {
+		return err
+	}
+	if entry.ID != "" && entry.ID != m.Meta.ID {
+		return fmt.Errorf("manifest is for %s, not %s", m.Meta.ID, entry.ID)
+	}
+	resources, err := manifestResources(m.Runtime.Resources)
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for _, mount := range m.Runtime.Mounts {
+		if !mountNamePattern.MatchString(mount.Name) {
+			return fmt.Errorf("invalid mount name: %q", mount.Name)
+		}
+		if seen[mount.Name] {
+			return fmt.Errorf("duplicate mount: %s", mount.Name)
+		}
+		seen[mount.Name] = true
+		if !strings.HasPrefix(mount.Path, "/") {
+			return fmt.Errorf("mount %s: container path must be absolute", mount.Name)
+		}
+	}
+
+	// The web UI's settings end up in the Caddyfile
+	if w := m.WebUI; w != nil {
+		if w.Path != "" && (!strings.HasPrefix(w.Path, "/apps/") || !webPathPattern.MatchString(w.Path) || strings.Contains(w.Path, "/.")) {
+			return fmt.Errorf("webui.path must be a path under /apps/: %s", w.Path)
+		}
+		if w.Service != "" && !mountNamePattern.MatchString(w.Service) {
+			return fmt.Errorf("invalid webui.service: %q", w.Service)
+		}
+		for name, value := range w.Headers {
+			if !headerNamePattern.MatchString(name) || strings.ContainsAny(value, "\r\n") {
+				return fmt.Errorf("invalid webui header: %q", name)
+			}
+		}
+	}
+
+	entry.ID = m.Meta.ID
+	entry.Name = m.Meta.Name
+	entry.Version = m.Meta.Version
+	if m.Meta.Description != "" {
+		entry.Description = m.Meta.Description
+	}
+	if len(m.Meta.Categories) > 0 {
+		entry.Categories = m.Meta.Categories
+	}
+	if m.Meta.Icon != "" {
+		entry.Icon = m.Meta.Icon
+	}
+	if dir != "" {
+		entry.Compose = filepath.ToSlash(filepath.Join(dir, m.Runtime.DockerComposePath))
+	} else if entry.Compose == "" {
+		entry.Compose = m.Runtime.DockerComposePath
+	}
+
+	if resources.CPULimit != "" {
+		entry.Defaults.Resources.CPULimit = resources.CPULimit
+	}
+	if resources.MemoryLimit != "" {
+		entry.Defaults.Resources.MemoryLimit = resources.MemoryLimit
+	}
+	if resources.CPURequest != "" {
+		entry.Defaults.Resources.CPURequest = resources.CPURequest
+	}
+	if resources.MemRequest != "" {
+		entry.Defaults.Resources.MemRequest = resources.MemRequest
+	}
+
+	// The manifest doesn't say which host port to publish on, so a
+	// catalog's mappings are kept when it has them
+	if len(entry.Defaults.Ports) == 0 {
+		for _, p := range m.Runtime.Ports {
+			protocol := p.Protocol
+			if protocol == "" {
+				protocol = "tcp"
+			}
+			entry.Defaults.Ports = append(entry.Defaults.Ports, PortMapping{Host: p.Port, Container: p.Port, Protocol: protocol})
+		}
+	}
+
+	// HealthConfig only holds one check; the monitor runs all of them
+	for _, hc := range m.Runtime.HealthChecks {
+		if hc.Type == "tcp" {
+			continue
+		}
+		entry.Health = HealthConfig{
+			Type:           hc.Type,
+			Container:      hc.Container,
+			URL:            hc.URL,
+			IntervalSec:    hc.Interval,
+			TimeoutSec:     hc.Timeout,
+			UnhealthyAfter: hc.Retries,
+		}
+		break
+	}
+
+	entry.NeedsPrivileged = entry.NeedsPrivileged || m.Permissions.Privileged
+	entry.Manifest = m
+	entry.Permissions = manifestPermissions(m)
+	return nil
+}
+
+// loadTemplateManifest loads nosapp.yaml from a template directory,
+// returning nil if there is none
+func loadTemplateManifest(dir string) (*appsdk.Manifest, error) {
+	path := filepath.Join(dir, ManifestFile)
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return appsdk.LoadManifest(path)
+}
+
+// manifestPermissions lists what the admin is asked to accept
+func manifestPermissions(m *appsdk.Manifest) []Permission {
+	var perms []Permission
+	if m.Permissions.Privileged {
+		perms = append(perms, Permission{ID: "privileged", Description: "Run containers in privileged mode with full access to the host"})
+	}
+	if m.Permissions.HostNetwork {
+		perms = append(perms, Permission{ID: "host_network", Description: "Use the host's network stack"})
+	}
+	if m.Permissions.HostPID {
+		perms = append(perms, Permission{ID: "host_pid", Description: "See and signal every process on the host"})
+	}
+	for _, c := range m.Permissions.Capabilities {
+		perms = append(perms, Permission{ID: "cap:" + c, Description: "Linux capability " + c})
+	}
+	for _, s := range m.Permissions.APIScopes {
+		perms = append(perms, Permission{ID: "api:" + s, Description: "Call the NithronOS API with scope " + s})
+	}
+	for _, op := range m.Permissions.AgentOps {
+		perms = append(perms, Permission{ID: "agent:" + op, Description: "Run the agent operation " + op})
+	}
+	if m.OIDC != nil {
+		desc := "Sign users in with their NithronOS account"
+		if len(m.OIDC.Scopes) > 0 {
+			desc += ", seeing their " + strings.Join(m.OIDC.Scopes, ", ")
+		}
+		perms = append(perms, Permission{ID: "sso", Description: desc})
+	}
+	return perms
+}
+
+// checkPermissions fails unless every permission of the entry is in one
+// of the accepted lists
+func checkPermissions(entry *CatalogEntry, accepted ...[]string) error {
+	ok := map[string]bool{}
+	for _, list := range accepted {
+		for _, id := range list {
+			ok[id] = true
+		}
+	}
+	var missing []string
+	for _, p := range entry.Permissions {
+		if !ok[p.ID] {
+			missing = append(missing, p.ID)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: %s", ErrPermissionsNotAccepted, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func permissionIDs(perms []Permission) []string {
+	ids := make([]string, 0, len(perms))
+	for _, p := range perms {
+		ids = append(ids, p.ID)
+	}
+	return ids
+}
+
+// MountVar is the compose variable that holds a mount's host path, e.g.
+// ${MOUNT_MEDIA} for a mount named "media"
+func MountVar(name string) string {
+	return "MOUNT_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// mountPaths maps the manifest's mounts to host paths. Persistent mounts
+// live under the app's data subvolume, so snapshots, rollbacks and
+// backups cover them; the others go to its cache directory unless the
+// admin gives a host path, which required ones must have.
+func mountPaths(m *appsdk.Manifest, appsRoot, appID string, given map[string]string) (map[string]string, error) {
+	var declared []appsdk.Mount
+	if m != nil {
+		declared = m.Runtime.Mounts
+	}
+	appDir := filepath.Join(appsRoot, appID)
+	paths := make(map[string]string, len(declared))
+	for _, mount := range declared {
+		host := given[mount.Name]
+		switch {
+		case mount.Persistent:
+			if host != "" {
+				return nil, fmt.Errorf("mount %s holds app data and can't be placed elsewhere", mount.Name)
+			}
+			host = filepath.Join(appDir, "data", mount.Name)
+		case host != "":
+			if err := checkHostMount(host, appsRoot); err != nil {
+				return nil, fmt.Errorf("mount %s: %w", mount.Name, err)
+			}
+		case mount.Required:
+			return nil, fmt.Errorf("mount %s needs a host path", mount.Name)
+		default:
+			host = filepath.Join(appDir, "cache", mount.Name)
+		}
+		paths[mount.Name] = host
+	}
+	for name := range given {
+		if _, ok := paths[name]; !ok {
+			return nil, fmt.Errorf("unknown mount: %s", name)
+		}
+	}
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	return paths, nil
+}
+
+// givenMounts picks out the host paths the admin chose for an installed
+// app's mounts that the manifest still declares, for mapping them again
+func givenMounts(m *appsdk.Manifest, appDir string, current map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	given := map[string]string{}
+	for _, mount := range m.Runtime.Mounts {
+		if host := current[mount.Name]; host != "" && !mount.Persistent && !within(host, appDir) {
+			given[mount.Name] = host
+		}
+	}
+	return given
+}
+
+// checkHostMount vets a host directory the admin chose for a mount
+func checkHostMount(path, appsRoot string) error {
+	if !filepath.IsAbs(path) || filepath.Clean(path) != path {
+		return fmt.Errorf("%s is not a clean absolute path", path)
+	}
+	if path == "/" || within(path, appsRoot) {
+		return fmt.Errorf("%s can't be mounted", path)
+	}
+	for _, root := range forbiddenMountRoots {
+		if within(path, root) {
+			return fmt.Errorf("%s can't be mounted", path)
+		}
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", path)
+	}
+	return nil
+}
+
+func within(path, root string) bool {
+	return path == root || strings.HasPrefix(path, strings.TrimSuffix(root, "/")+"/")
+}
+
+// ensureMountDirs creates the app-owned mount directories
+func ensureMountDirs(appDir string, mounts map[string]string) error {
+	for _, host := range mounts {
+		if !within(host, appDir) {
+			continue
+		}
+		if err := os.MkdirAll(host, 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withMounts adds the mount variables to the render params
+func withMounts(params map[string]interface{}, mounts map[string]string) map[string]interface{} {
+	if len(mounts) == 0 {
+		return params
+	}
+	merged := make(map[string]interface{}, len(params)+len(mounts))
+	for k, v := range params {
+		merged[k] = v
+	}
+	for name, host := range mounts {
+		merged[MountVar(name)] = host
+	}
+	return merged
+}
+
+// manifestResources converts the manifest's Kubernetes style quantities
+// ("500m" CPU, "512Mi" memory) to what compose accepts
+func manifestResources(r appsdk.ResourceLimits) (ResourceLimits, error) {
+	var out ResourceLimits
+	var err error
+	if out.CPULimit, err = composeCPUs(r.CPU.Limit); err != nil {
+		return out, err
+	}
+	if out.CPURequest, err = composeCPUs(r.CPU.Request); err != nil {
+		return out, err
+	}
+	if out.MemoryLimit, err = composeMemory(r.Memory.Limit); err != nil {
+		return out, err
+	}
+	if out.MemRequest, err = composeMemory(r.Memory.Request); err != nil {
+		return out, err
+	}
+	return out, nil
+}
+
+func composeCPUs(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	if milli, ok := strings.CutSuffix(s, "m"); ok {
+		n, err := strconv.Atoi(milli)
+		if err != nil || n <= 0 {
+			return "", fmt.Errorf("invalid cpu quantity: %s", s)
+		}
+		return strconv.FormatFloat(float64(n)/1000, 'f', -1, 64), nil
+	}
+	if n, err := strconv.ParseFloat(s, 64); err != nil || n <= 0 {
+		return "", fmt.Errorf("invalid cpu quantity: %s", s)
+	}
+	return s, nil
+}
+
+var memoryPattern = regexp.MustCompile(`^([0-9]+)([KMGT]i?|[kmgt]b?|[KMGT]B)?$`)
+
+func composeMemory(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	m := memoryPattern.FindStringSubmatch(s)
+	if m == nil || m[1] == "0" {
+		return "", fmt.Errorf("invalid memory quantity: %s", s)
+	}
+	// Docker's units are binary, so Mi and M both become m
+	unit := strings.ToLower(m[2])
+	unit = strings.TrimRight(unit, "ib")
+	return m[1] + unit, nil
+}
@@ -0,0 +1,368 @@
+package apps
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+
+	"nithronos/backend/nosd/pkg/appsdk"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newManifestCatalog lays out a builtin catalog with one app listed in
+// catalog.yaml and one that ships only a template directory
+func newManifestCatalog(t *testing.T) *CatalogManager {
+	t.Helper()
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "catalog.yaml"), `version: "1.0"
+entries:
+  - id: notes
+    name: Notes (catalog)
+    version: "1.0"
+    compose: templates/notes/compose.yaml
+    defaults:
+      env:
+        NOTES_TITLE: Notes
+      ports:
+        - host: 8090
+          container: 80
+          protocol: tcp
+  - id: plain
+    name: Plain
+    version: "1"
+    compose: templates/plain/compose.yaml
+`)
+	writeFile(t, filepath.Join(root, "templates/notes/nosapp.yaml"), `meta:
+  name: Notes
+  id: notes
+  version: "2.1"
+  description: Shared notes
+runtime:
+  docker_compose_path: compose.yaml
+  env_schema:
+    type: object
+    required: [NOTES_TITLE, NOTES_SECRET]
+    properties:
+      NOTES_SECRET:
+        type: string
+        minLength: 8
+  mounts:
+    - name: db
+      path: /var/lib/notes
+      persistent: true
+    - name: media
+      path: /media
+      required: true
+  health_checks:
+    - type: container
+      container: app
+  resources:
+    cpu:
+      limit: 1500m
+    memory:
+      limit: 1Gi
+      request: 256Mi
+permissions:
+  capabilities: [NET_ADMIN]
+  api_scopes: [shares.read]
+`)
+	writeFile(t, filepath.Join(root, "templates/notes/compose.yaml"), `services:
+  app:
+    image: notes:${NOTES_VERSION:-2}
+    cap_add: [NET_ADMIN]
+    volumes:
+      - ${MOUNT_DB}:/var/lib/notes
+      - ${MOUNT_MEDIA}:/media:ro
+    deploy:
+      resources:
+        limits:
+          cpus: "8"
+`)
+	writeFile(t, filepath.Join(root, "templates/plain/compose.yaml"), "services:\n  app:\n    image: plain\n")
+	writeFile(t, filepath.Join(root, "templates/thirdparty/nosapp.yaml"), `meta:
+  name: Third Party
+  id: thirdparty
+  version: "0.3"
+runtime:
+  docker_compose_path: docker-compose.yml
+  ports:
+    - port: 9000
+permissions:
+  host_network: true
+`)
+	writeFile(t, filepath.Join(root, "templates/thirdparty/schema.json"), `{"type":"object"}`)
+	writeFile(t, filepath.Join(root, "templates/broken/nosapp.yaml"), "meta:\n  id: broken\n")
+	return NewCatalogManager(root, filepath.Join(t.TempDir(), "cache.json"), filepath.Join(root, "sources"))
+}
+
+func TestCatalogLoadsManifests(t *testing.T) {
+	cm := newManifestCatalog(t)
+	catalog, err := cm.LoadBuiltinCatalog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(catalog.Entries) != 3 {
+		t.Fatalf("entries %+v", catalog.Entries)
+	}
+
+	notes, err := cm.GetEntry("notes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if notes.Manifest == nil || notes.Name != "Notes" || notes.Version != "2.1" || notes.Compose != "templates/notes/compose.yaml" {
+		t.Fatalf("notes %+v", notes)
+	}
+	if r := notes.Defaults.Resources; r.CPULimit != "1.5" || r.MemoryLimit != "1g" || r.MemRequest != "256m" {
+		t.Errorf("resources %+v", r)
+	}
+	if len(notes.Defaults.Ports) != 1 || notes.Defaults.Ports[0].Host != 8090 {
+		t.Errorf("catalog ports replaced: %+v", notes.Defaults.Ports)
+	}
+	if got := permissionIDs(notes.Permissions); strings.Join(got, ",") != "cap:NET_ADMIN,api:shares.read" {
+		t.Errorf("permissions %v", got)
+	}
+
+	third, err := cm.GetEntry("thirdparty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third.Compose != "templates/thirdparty/docker-compose.yml" || third.Schema != "templates/thirdparty/schema.json" {
+		t.Fatalf("manifest-only app %+v", third)
+	}
+	if len(third.Defaults.Ports) != 1 || third.Defaults.Ports[0].Container != 9000 || third.Defaults.Ports[0].Protocol != "tcp" {
+		t.Errorf("ports %+v", third.Defaults.Ports)
+	}
+	if plain, _ := cm.GetEntry("plain"); plain == nil || plain.Manifest != nil {
+		t.Errorf("plain %+v", plain)
+	}
+}
+
+func TestRenderEnforcesManifest(t *testing.T) {
+	cm := newManifestCatalog(t)
+	tr := NewTemplateRenderer(cm.builtinPath)
+	entry, _ := cm.GetEntry("notes")
+
+	if err := tr.ValidateParams(entry, map[string]interface{}{"NOTES_SECRET": "short"}); err == nil {
+		t.Error("env schema not enforced")
+	}
+	// NOTES_TITLE comes from the catalog defaults
+	if err := tr.ValidateParams(entry, map[string]interface{}{"NOTES_SECRET": "long enough"}); err != nil {
+		t.Fatal(err)
+	}
+
+	mounts, err := mountPaths(entry.Manifest, "/srv/apps", "notes", map[string]string{"media": t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := tr.RenderComposeFile(entry, withMounts(nil, mounts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var compose struct {
+		Services map[string]struct {
+			Volumes []string
+			Deploy  struct {
+				Resources struct {
+					Limits       map[string]string
+					Reservations map[string]string
+				}
+			}
+		}
+	}
+	if err := yaml.Unmarshal(out, &compose); err != nil {
+		t.Fatal(err)
+	}
+	app := compose.Services["app"]
+	if app.Volumes[0] != "/srv/apps/notes/data/db:/var/lib/notes" || app.Volumes[1] != mounts["media"]+":/media:ro" {
+		t.Errorf("volumes %v", app.Volumes)
+	}
+	if app.Deploy.Resources.Limits["cpus"] != "1.5" || app.Deploy.Resources.Limits["memory"] != "1g" || app.Deploy.Resources.Reservations["memory"] != "256m" {
+		t.Errorf("resources %+v", app.Deploy.Resources)
+	}
+
+	// Privileges the manifest doesn't declare are refused
+	entry.Manifest.Permissions.Capabilities = nil
+	if _, err := tr.RenderComposeFile(entry, withMounts(nil, mounts)); err == nil || !strings.Contains(err.Error(), "NET_ADMIN") {
+		t.Errorf("undeclared capability: %v", err)
+	}
+	entry.Manifest.Runtime.Mounts = append(entry.Manifest.Runtime.Mounts, appsdk.Mount{Name: "logs", Path: "/logs"})
+	if _, err := tr.RenderComposeFile(entry, nil); err == nil || !strings.Contains(err.Error(), "MOUNT_LOGS") {
+		t.Errorf("unused mount: %v", err)
+	}
+}
+
+func TestRenderRefusesHostAccess(t *testing.T) {
+	cm := newManifestCatalog(t)
+	tr := NewTemplateRenderer(cm.builtinPath)
+	entry, _ := cm.GetEntry("notes")
+	mounts, err := mountPaths(entry.Manifest, "/srv/apps", "notes", map[string]string{"media": t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	composePath := filepath.Join(cm.builtinPath, "templates/notes/compose.yaml")
+	render := func(service string) error {
+		writeFile(t, composePath, `services:
+  app:
+    image: notes
+    cap_add: [NET_ADMIN]
+    volumes:
+      - ${MOUNT_DB}:/var/lib/notes
+      - ${MOUNT_MEDIA}:/media:ro
+`+service)
+		_, err := tr.RenderComposeFile(entry, withMounts(nil, mounts))
+		return err
+	}
+
+	for _, ok := range []string{
+		"      - ./data/cache:/cache\n",
+		"      - ../data/db/sub:/sub\n",
+		"      - ${MOUNT_MEDIA}/albums:/albums\n",
+		"      - cache:/cache\n      - /tmp/anonymous\n",
+		"      - type: volume\n        source: cache\n        target: /cache\n",
+		"    security_opt: [no-new-privileges:true, seccomp=default.json]\n",
+	} {
+		if err := render(ok); err != nil {
+			t.Errorf("%q: %v", ok, err)
+		}
+	}
+
+	for _, tc := range []struct{ service, want string }{
+		{"      - /:/host\n", "/ is not one of the app's mounts"},
+		{"      - /var/run/docker.sock:/var/run/docker.sock\n", "docker.sock is not one of"},
+		{"      - /etc:/host/etc:ro\n", "/etc is not one of"},
+		{"      - /srv/apps/other/data:/other\n", "not one of"},
+		{"      - ${MOUNT_MEDIA}/../..:/up\n", "not one of"},
+		{"      - ../../other:/other\n", "leaves the app's directory"},
+		{"      - ~/.ssh:/ssh\n", "not one of"},
+		{"      - type: bind\n        source: /etc\n        target: /etc\n", "/etc is not one of"},
+		{"    devices: [/dev/sda]\n", "maps host devices"},
+		{"    device_cgroup_rules: ['b 8:* rmw']\n", "allows host devices"},
+		{"    ipc: host\n", "host ipc namespace"},
+		{"    userns_mode: host\n", "host userns namespace"},
+		{"    cgroup: host\n", "host cgroup namespace"},
+		{"    security_opt: [apparmor=unconfined]\n", "apparmor=unconfined"},
+		{"    security_opt: ['seccomp:unconfined']\n", "seccomp:unconfined"},
+		{"    security_opt: ['label:disable']\n", "label:disable"},
+		{"volumes:\n  host:\n    driver_opts: {type: none, o: bind, device: /etc}\n", "volume host: /etc is not one of"},
+	} {
+		if err := render(tc.service); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%q: %v, want %q", tc.service, err, tc.want)
+		}
+	}
+
+	// A privileged app, which the admin accepted as such, may use devices
+	// and drop its profiles, but still only bind its own paths
+	entry.Manifest.Permissions.Privileged = true
+	if err := render("    devices: [/dev/dri]\n    ipc: host\n    security_opt: [apparmor=unconfined]\n"); err != nil {
+		t.Errorf("privileged: %v", err)
+	}
+	if err := render("      - /:/host\n"); err == nil {
+		t.Error("privileged app bound /")
+	}
+}
+
+func TestMountPaths(t *testing.T) {
+	m := &appsdk.Manifest{Runtime: appsdk.RuntimeConfig{Mounts: []appsdk.Mount{
+		{Name: "data", Path: "/data", Persistent: true},
+		{Name: "media", Path: "/media", Required: true},
+		{Name: "scratch", Path: "/tmp/scratch"},
+	}}}
+	media := t.TempDir()
+	paths, err := mountPaths(m, "/srv/apps", "notes", map[string]string{"media": media})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if paths["data"] != "/srv/apps/notes/data/data" || paths["media"] != media || paths["scratch"] != "/srv/apps/notes/cache/scratch" {
+		t.Fatalf("paths %v", paths)
+	}
+	// An upgrade keeps the admin's choices only
+	if given := givenMounts(m, "/srv/apps/notes", paths); len(given) != 1 || given["media"] != media {
+		t.Fatalf("given %v", given)
+	}
+
+	for name, given := range map[string]map[string]string{
+		"missing required": {},
+		"placed app data":  {"media": media, "data": media},
+		"system directory": {"media": "/etc"},
+		"other app":        {"media": "/srv/apps/other"},
+		"relative":         {"media": "media"},
+		"unknown mount":    {"media": media, "music": media},
+	} {
+		if _, err := mountPaths(m, "/srv/apps", "notes", given); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestInstallNeedsAcceptedPermissions(t *testing.T) {
+	cm := newManifestCatalog(t)
+	store, err := NewStateStore(filepath.Join(t.TempDir(), "apps.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lm := NewLifecycleManager(cm, store, NewTemplateRenderer(cm.builtinPath), t.TempDir(), "", nil)
+
+	err = lm.InstallApp(context.Background(), InstallRequest{ID: "notes", AcceptedPermissions: []string{"api:shares.read"}}, "admin")
+	if !errors.Is(err, ErrPermissionsNotAccepted) || !strings.Contains(err.Error(), "cap:NET_ADMIN") {
+		t.Fatalf("install without consent: %v", err)
+	}
+}
+
+func TestManifestHealthChecks(t *testing.T) {
+	hm := NewHealthMonitor(nil, nil)
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	containers := []ContainerHealth{{Name: "nos-app-notes-app-1", Status: "running", Health: "healthy"}}
+	checks := []appsdk.HealthCheck{
+		{Type: "container", Container: "app"},
+		{Type: "http", URL: srv.URL, Retries: 2},
+	}
+	ctx := context.Background()
+	if msg := hm.checkManifestHealth(ctx, "notes", checks, containers); msg != "" {
+		t.Fatalf("healthy app: %s", msg)
+	}
+
+	// One failure is tolerated under two retries
+	status = http.StatusServiceUnavailable
+	if msg := hm.checkManifestHealth(ctx, "notes", checks, containers); msg != "" {
+		t.Fatalf("first failure reported: %s", msg)
+	}
+	if msg := hm.checkManifestHealth(ctx, "notes", checks, containers); !strings.Contains(msg, "http check failed") {
+		t.Fatalf("second failure: %q", msg)
+	}
+
+	containers[0].Health = "unhealthy"
+	closed := []appsdk.HealthCheck{{Type: "container", Container: "app"}, {Type: "tcp", Port: port}}
+	msg := hm.checkManifestHealth(ctx, "other", closed, containers)
+	if !strings.Contains(msg, "container check failed") || !strings.Contains(msg, "tcp check failed") || !strings.Contains(msg, strconv.Itoa(port)) {
+		t.Fatalf("failing checks: %q", msg)
+	}
+}
@@ -0,0 +1,341 @@
+package apps
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DefaultAppDomain is what app subdomains go under when HTTPS has no
+// domain configured
+const DefaultAppDomain = "nas.lan"
+
+// CertSource tells the proxy how app sites get their certificates; the
+// HTTPS manager is one
+type CertSource interface {
+	// SiteTLS returns the Caddy tls directive for a site besides the main
+	// one, empty for automatic HTTPS, and the server's domain if it has one
+	SiteTLS() (directive, domain string)
+}
+
+var hostPattern = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]*[a-z0-9])?\.)+[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// Ports taken by the proxy and nosd itself
+var reservedPorts = map[int]bool{80: true, 443: true, 9000: true}
+
+// ProxyConfig is what RenderCaddySnippet routes to an app
+type ProxyConfig struct {
+	Exposure
+	// Upstream is the container and port serving the web UI
+	Upstream string
+	// Path is the URL prefix in path mode and StripPath whether the app
+	// sees requests without it
+	Path      string
+	StripPath bool
+	// Headers are extra request headers the manifest asks for
+	Headers map[string]string
+	// Address and TLS make the site block in subdomain and port mode
+	Address string
+	TLS     string
+	// Portal is the main site's origin, where the login gate sends users
+	// of an app on another host to pick up their session
+	Portal string
+}
+
+// webTarget finds the service and container port serving the entry's web
+// UI: the manifest's webui, else its port marked webui, else a guess
+// among the catalog's ports
+func webTarget(entry *CatalogEntry) (service string, port int, ok bool) {
+	if m := entry.Manifest; m != nil {
+		if m.WebUI != nil {
+			service = m.WebUI.Service
+			if service == "" {
+				service = "app"
+			}
+			return service, m.WebUI.Port, true
+		}
+		for _, p := range m.Runtime.Ports {
+			if p.WebUI {
+				return "app", p.Port, true
+			}
+		}
+	}
+
+	for _, p := range entry.Defaults.Ports {
+		if p.Protocol == "udp" {
+			continue
+		}
+		if p.Container == 80 || p.Container == 8080 || p.Container == 3000 {
+			return "app", p.Container, true
+		}
+		if port == 0 {
+			port = p.Container
+		}
+	}
+	return "app", port, port != 0
+}
+
+// defaultExposure is how an app is exposed unless the admin chooses:
+// under /apps/<id>/ unless the manifest asks otherwise, behind the login
+// when its UI inherits NithronOS auth
+func defaultExposure(entry *CatalogEntry) *Exposure {
+	if _, _, ok := webTarget(entry); !ok {
+		return nil
+	}
+	exp := &Exposure{Mode: ExposePath}
+	if m := entry.Manifest; m != nil && m.WebUI != nil {
+		if m.WebUI.Expose != "" {
+			exp.Mode = m.WebUI.Expose
+		}
+		exp.RequireLogin = m.WebUI.AuthMode == "inherit"
+	}
+	return exp
+}
+
+// resolveExposure fills in and checks how an app is to be exposed,
+// keeping clear of the hosts and ports other apps use. It returns nil
+// when the app isn't exposed.
+func (lm *LifecycleManager) resolveExposure(appID string, entry *CatalogEntry, req *Exposure) (*Exposure, error) {
+	exp := defaultExposure(entry)
+	if req != nil {
+		if req.Mode == ExposeNone {
+			return nil, nil
+		}
+		if exp == nil {
+			return nil, fmt.Errorf("app %s has no web UI to expose", appID)
+		}
+		c := *req
+		exp = &c
+	}
+	if exp == nil {
+		return nil, nil
+	}
+
+	switch exp.Mode {
+	case ExposePath:
+		exp.Domain, exp.Port = "", 0
+	case ExposeSubdomain:
+		exp.Port = 0
+		if exp.Domain == "" {
+			exp.Domain = appID + "." + lm.baseDomain()
+		}
+		exp.Domain = strings.ToLower(strings.TrimSuffix(exp.Domain, "."))
+		if !hostPattern.MatchString(exp.Domain) {
+			return nil, fmt.Errorf("invalid domain: %s", exp.Domain)
+		}
+		if exp.Domain == lm.baseDomain() {
+			return nil, fmt.Errorf("%s is the NithronOS web UI's domain", exp.Domain)
+		}
+	case ExposePort:
+		exp.Domain = ""
+		if exp.Port < 1024 || exp.Port > 65535 || reservedPorts[exp.Port] {
+			return nil, fmt.Errorf("invalid port: %d", exp.Port)
+		}
+		for _, p := range entry.Defaults.Ports {
+			if p.Host == exp.Port {
+				return nil, fmt.Errorf("port %d is published by the app itself", exp.Port)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("invalid exposure mode: %s", exp.Mode)
+	}
+
+	for _, other := range lm.stateStore.GetAllApps() {
+		if other.ID == appID {
+			continue
+		}
+		if o := other.Expose; o != nil && o.Mode == exp.Mode && exp.Mode != ExposePath &&
+			o.Domain == exp.Domain && o.Port == exp.Port {
+			return nil, fmt.Errorf("%s is already used by app %s", exposureHost(exp, ""), other.ID)
+		}
+		if exp.Mode == ExposePort {
+			for _, p := range other.Ports {
+				if p.Host == exp.Port {
+					return nil, fmt.Errorf("port %d is already used by app %s", exp.Port, other.ID)
+				}
+			}
+		}
+	}
+	return exp, nil
+}
+
+// exposureOrNone records that an app isn't exposed, so it stays that way
+func exposureOrNone(exp *Exposure) *Exposure {
+	if exp == nil {
+		return &Exposure{Mode: ExposeNone}
+	}
+	return exp
+}
+
+// SetExposure changes how an installed app's web UI is reached
+func (lm *LifecycleManager) SetExposure(ctx context.Context, appID string, req Exposure, userID string) error {
+	app, err := lm.stateStore.GetApp(appID)
+	if err != nil {
+		return fmt.Errorf("app not found: %w", err)
+	}
+	entry, err := lm.catalogMgr.GetEntry(appID)
+	if err != nil {
+		return fmt.Errorf("app not found in catalog: %w", err)
+	}
+	expose, err := lm.resolveExposure(appID, entry, &req)
+	if err != nil {
+		return fmt.Errorf("exposure validation failed: %w", err)
+	}
+	if err := lm.setupReverseProxy(appID, entry, expose); err != nil {
+		return fmt.Errorf("failed to setup reverse proxy: %w", err)
+	}
+
+	app.Expose = exposureOrNone(expose)
+	app.URLs = lm.generateAppURLs(appID, entry, expose)
+	lm.updateSSO(app, entry, expose)
+	if err := lm.stateStore.UpdateApp(*app); err != nil {
+		return fmt.Errorf("failed to update app state: %w", err)
+	}
+
+	lm.logEvent("app.expose", appID, userID, map[string]interface{}{
+		"expose": app.Expose,
+	})
+	return nil
+}
+
+// proxyConfig works out the routing of an exposed app
+func (lm *LifecycleManager) proxyConfig(appID string, entry *CatalogEntry, exp *Exposure) ProxyConfig {
+	service, port, _ := webTarget(entry)
+	tls, domain := lm.siteTLS()
+	pc := ProxyConfig{
+		Exposure:  *exp,
+		Upstream:  containerName(appID, service) + ":" + strconv.Itoa(port),
+		Path:      "/apps/" + appID,
+		StripPath: true,
+		TLS:       tls,
+	}
+	if m := entry.Manifest; m != nil && m.WebUI != nil {
+		if m.WebUI.Path != "" {
+			pc.Path = strings.TrimSuffix(m.WebUI.Path, "/")
+		}
+		pc.StripPath = m.WebUI.StripPath
+		pc.Headers = m.WebUI.Headers
+	}
+
+	switch exp.Mode {
+	case ExposeSubdomain:
+		pc.Address = exp.Domain
+		pc.Portal = "https://" + lm.baseDomain()
+	case ExposePort:
+		pc.Address = ":" + strconv.Itoa(exp.Port)
+		if domain != "" {
+			pc.Address = domain + pc.Address
+		}
+		// The same host on the standard port
+		pc.Portal = "https://{host}"
+	}
+	return pc
+}
+
+func (lm *LifecycleManager) siteTLS() (string, string) {
+	if lm.certs == nil {
+		return "tls internal", ""
+	}
+	return lm.certs.SiteTLS()
+}
+
+func (lm *LifecycleManager) baseDomain() string {
+	if _, domain := lm.siteTLS(); domain != "" {
+		return domain
+	}
+	return DefaultAppDomain
+}
+
+// exposureURL is where an exposed app is reached
+func (lm *LifecycleManager) exposureURL(appID string, entry *CatalogEntry, exp *Exposure) string {
+	if exp.Mode == ExposePath {
+		return lm.proxyConfig(appID, entry, exp).Path + "/"
+	}
+	return "https://" + exposureHost(exp, lm.baseDomain()) + "/"
+}
+
+// exposureHost is the host an app in subdomain or port mode is served on
+func exposureHost(exp *Exposure, domain string) string {
+	if exp.Mode == ExposePort {
+		return domain + ":" + strconv.Itoa(exp.Port)
+	}
+	return exp.Domain
+}
+
+// ExposedApp finds the installed app served on host, a subdomain or a
+// port of the server, for the login gate
+func ExposedApp(apps []InstalledApp, host string) *InstalledApp {
+	name, port, err := net.SplitHostPort(host)
+	if err != nil {
+		name, port = host, ""
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for i := range apps {
+		exp := apps[i].Expose
+		if exp == nil {
+			continue
+		}
+		switch exp.Mode {
+		case ExposeSubdomain:
+			if exp.Domain == name && (port == "" || port == "443") {
+				return &apps[i]
+			}
+		case ExposePort:
+			if port == strconv.Itoa(exp.Port) {
+				return &apps[i]
+			}
+		}
+	}
+	return nil
+}
+
+// setupReverseProxy writes the app's Caddy snippet, or removes it when
+// the app isn't exposed, and reloads Caddy. Path routes go inside the
+// main site; subdomain and port routes are sites of their own.
+func (lm *LifecycleManager) setupReverseProxy(appID string, entry *CatalogEntry, exp *Exposure) error {
+	name := fmt.Sprintf("app-%s.caddy", appID)
+	routePath := filepath.Join(lm.caddyPath, name)
+	sitePath := filepath.Join(lm.sitesPath(), name)
+
+	var snippet []byte
+	if exp != nil {
+		var err error
+		snippet, err = lm.renderer.RenderCaddySnippet(appID, lm.proxyConfig(appID, entry, exp))
+		if err != nil {
+			return err
+		}
+	}
+
+	target, stale := routePath, sitePath
+	if exp != nil && exp.Mode != ExposePath {
+		target, stale = sitePath, routePath
+	}
+	if err := os.Remove(stale); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if snippet == nil {
+		if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(target, snippet, 0644); err != nil {
+			return fmt.Errorf("failed to write Caddy snippet: %w", err)
+		}
+	}
+
+	return lm.reloadCaddy()
+}
+
+// sitesPath holds the snippets imported at the top level of the
+// Caddyfile, next to the route snippets imported into the main site
+func (lm *LifecycleManager) sitesPath() string {
+	return filepath.Join(filepath.Dir(lm.caddyPath), "sites.d")
+}
@@ -0,0 +1,218 @@
+package apps
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"nithronos/backend/nosd/pkg/appsdk"
+)
+
+type fakeCerts struct{ tls, domain string }
+
+func (c fakeCerts) SiteTLS() (string, string) { return c.tls, c.domain }
+
+func newProxyLifecycle(t *testing.T) *LifecycleManager {
+	t.Helper()
+	cm := newManifestCatalog(t)
+	store, err := NewStateStore(filepath.Join(t.TempDir(), "apps.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lm := NewLifecycleManager(cm, store, NewTemplateRenderer(cm.builtinPath), t.TempDir(), "", nil)
+	lm.caddyPath = filepath.Join(t.TempDir(), "Caddyfile.d")
+	return lm
+}
+
+func TestResolveExposure(t *testing.T) {
+	lm := newProxyLifecycle(t)
+	notes, err := lm.catalogMgr.GetEntry("notes")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp, err := lm.resolveExposure("notes", notes, nil)
+	if err != nil || exp == nil || exp.Mode != ExposePath {
+		t.Fatalf("default exposure: %+v, %v", exp, err)
+	}
+	exp, err = lm.resolveExposure("notes", notes, &Exposure{Mode: ExposeSubdomain})
+	if err != nil || exp.Domain != "notes."+DefaultAppDomain {
+		t.Fatalf("default subdomain: %+v, %v", exp, err)
+	}
+	lm.UseCertSource(fakeCerts{domain: "box.example.com"})
+	exp, err = lm.resolveExposure("notes", notes, &Exposure{Mode: ExposeSubdomain})
+	if err != nil || exp.Domain != "notes.box.example.com" {
+		t.Fatalf("subdomain of the server's domain: %+v, %v", exp, err)
+	}
+	if exp, err := lm.resolveExposure("notes", notes, &Exposure{Mode: ExposeNone}); exp != nil || err != nil {
+		t.Fatalf("none: %+v, %v", exp, err)
+	}
+
+	plain, err := lm.catalogMgr.GetEntry("plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp, err := lm.resolveExposure("plain", plain, nil); exp != nil || err != nil {
+		t.Fatalf("app without a web UI: %+v, %v", exp, err)
+	}
+
+	if err := lm.stateStore.AddApp(InstalledApp{
+		ID:     "wiki",
+		Ports:  []PortMapping{{Host: 8200, Container: 80, Protocol: "tcp"}},
+		Expose: &Exposure{Mode: ExposeSubdomain, Domain: "wiki.box.example.com"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for name, req := range map[string]Exposure{
+		"main domain":     {Mode: ExposeSubdomain, Domain: "box.example.com"},
+		"bad domain":      {Mode: ExposeSubdomain, Domain: "-x_y.example.com"},
+		"taken domain":    {Mode: ExposeSubdomain, Domain: "WIKI.box.example.com."},
+		"privileged port": {Mode: ExposePort, Port: 81},
+		"reserved port":   {Mode: ExposePort, Port: 9000},
+		"own port":        {Mode: ExposePort, Port: 8090},
+		"taken port":      {Mode: ExposePort, Port: 8200},
+		"bad mode":        {Mode: "tunnel"},
+	} {
+		if _, err := lm.resolveExposure("notes", notes, &req); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+	if _, err := lm.resolveExposure("plain", plain, &Exposure{Mode: ExposePath}); err == nil {
+		t.Error("exposed an app without a web UI")
+	}
+}
+
+func TestManifestWebTarget(t *testing.T) {
+	entry := &CatalogEntry{
+		ID:       "board",
+		Defaults: AppDefaults{Ports: []PortMapping{{Host: 8080, Container: 8080, Protocol: "tcp"}}},
+		Manifest: &appsdk.Manifest{WebUI: &appsdk.WebUIConfig{
+			Port:      3001,
+			Service:   "web",
+			Expose:    ExposeSubdomain,
+			AuthMode:  "inherit",
+			StripPath: false,
+			Headers:   map[string]string{"X-Board-Mode": `proxied "nos"`},
+		}},
+	}
+	if service, port, ok := webTarget(entry); !ok || service != "web" || port != 3001 {
+		t.Fatalf("webTarget = %s, %d, %v", service, port, ok)
+	}
+	exp := defaultExposure(entry)
+	if exp.Mode != ExposeSubdomain || !exp.RequireLogin {
+		t.Fatalf("defaultExposure = %+v", exp)
+	}
+
+	lm := newProxyLifecycle(t)
+	exp, err := lm.resolveExposure("board", entry, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc := lm.proxyConfig("board", entry, exp)
+	if pc.Upstream != "nos-app-board-web-1:3001" || pc.Address != "board."+DefaultAppDomain || pc.Portal != "https://"+DefaultAppDomain {
+		t.Fatalf("proxyConfig = %+v", pc)
+	}
+}
+
+func TestRenderCaddySnippet(t *testing.T) {
+	tr := NewTemplateRenderer(t.TempDir())
+	base := ProxyConfig{Upstream: "nos-app-notes-app-1:80", Path: "/apps/notes", StripPath: true, TLS: "tls internal"}
+
+	for _, tc := range []struct {
+		name    string
+		exp     Exposure
+		address string
+		portal  string
+		want    []string
+		exclude []string
+	}{
+		{
+			name: "path",
+			exp:  Exposure{Mode: ExposePath},
+			want: []string{"handle_path /apps/notes/* {", "reverse_proxy nos-app-notes-app-1:80 {",
+				`header_up Cookie "nos_[^=;]*=[^;]*;? *" ""`, "header_up -X-Nos-User"},
+			exclude: []string{"forward_auth", "tls internal"},
+		},
+		{
+			name: "path behind login",
+			exp:  Exposure{Mode: ExposePath, RequireLogin: true},
+			want: []string{"request_header -X-Nos-User\n\t\tforward_auth 127.0.0.1:9000", "uri /api/v1/apps/auth/verify",
+				`header_up Cookie "nos_`},
+			exclude: []string{"X-Nos-Portal", "/.nos-auth", "header_up -X-Nos-User"},
+		},
+		{
+			name:    "subdomain",
+			exp:     Exposure{Mode: ExposeSubdomain, Domain: "notes.nas.lan", RequireLogin: true},
+			address: "notes.nas.lan",
+			portal:  "https://nas.lan",
+			want: []string{"notes.nas.lan {", "\ttls internal", "handle /.nos-auth {",
+				"header_up X-Nos-Portal https://nas.lan", "reverse_proxy nos-app-notes-app-1:80 {"},
+			exclude: []string{"handle_path"},
+		},
+		{
+			name:    "port",
+			exp:     Exposure{Mode: ExposePort, Port: 8443},
+			address: ":8443",
+			portal:  "https://{host}",
+			want:    []string{":8443 {", "\ttls internal", "\thandle {", `header_up Cookie "nos_`, "header_up -X-Nos-User"},
+			exclude: []string{"forward_auth", "/.nos-auth"},
+		},
+	} {
+		pc := base
+		pc.Exposure = tc.exp
+		pc.Address = tc.address
+		pc.Portal = tc.portal
+		out, err := tr.RenderCaddySnippet("notes", pc)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		for _, s := range tc.want {
+			if !strings.Contains(string(out), s) {
+				t.Errorf("%s: missing %q in:\n%s", tc.name, s, out)
+			}
+		}
+		for _, s := range tc.exclude {
+			if strings.Contains(string(out), s) {
+				t.Errorf("%s: unexpected %q in:\n%s", tc.name, s, out)
+			}
+		}
+	}
+
+	pc := base
+	pc.Exposure = Exposure{Mode: ExposePath}
+	pc.Headers = map[string]string{"X-Mode": `a "b"`}
+	out, err := tr.RenderCaddySnippet("notes", pc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), `header_up X-Mode "a \"b\""`) {
+		t.Errorf("header not quoted:\n%s", out)
+	}
+}
+
+func TestExposedApp(t *testing.T) {
+	installed := []InstalledApp{
+		{ID: "plain"},
+		{ID: "notes", Expose: &Exposure{Mode: ExposePath}},
+		{ID: "wiki", Expose: &Exposure{Mode: ExposeSubdomain, Domain: "wiki.nas.lan"}},
+		{ID: "board", Expose: &Exposure{Mode: ExposePort, Port: 8443}},
+	}
+	for host, want := range map[string]string{
+		"wiki.nas.lan":     "wiki",
+		"WIKI.nas.lan.":    "wiki",
+		"wiki.nas.lan:443": "wiki",
+		"wiki.nas.lan:444": "",
+		"nas.lan:8443":     "board",
+		"10.0.0.2:8443":    "board",
+		"nas.lan":          "",
+		"notes.nas.lan":    "",
+	} {
+		got := ""
+		if app := ExposedApp(installed, host); app != nil {
+			got = app.ID
+		}
+		if got != want {
+			t.Errorf("ExposedApp(%q) = %q, want %q", host, got, want)
+		}
+	}
+}
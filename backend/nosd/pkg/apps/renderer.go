@@ -7,6 +7,7 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"text/template"
 
@@ -29,12 +30,21 @@ func NewTemplateRenderer(templateDir string) *TemplateRenderer {
 // RenderComposeFile renders a compose template with given parameters
 func (tr *TemplateRenderer) RenderComposeFile(entry *CatalogEntry, params map[string]interface{}) ([]byte, error) {
 	// Load compose template
-	composePath := filepath.Join(tr.templateDir, entry.Compose)
+	composePath := tr.templatePath(entry.Compose)
 	templateContent, err := os.ReadFile(composePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read compose template: %w", err)
 	}
 
+	// Every declared mount must reach a container
+	if entry.Manifest != nil {
+		for _, mount := range entry.Manifest.Runtime.Mounts {
+			if !strings.Contains(string(templateContent), "${"+MountVar(mount.Name)) {
+				return nil, fmt.Errorf("compose template doesn't use mount %s (${%s})", mount.Name, MountVar(mount.Name))
+			}
+		}
+	}
+
 	// Merge params with defaults
 	mergedParams := tr.mergeParams(entry.Defaults, params)
 
@@ -50,21 +60,52 @@ func (tr *TemplateRenderer) RenderComposeFile(entry *CatalogEntry, params map[st
 		return nil, fmt.Errorf("rendered compose file is invalid YAML: %w", err)
 	}
 
+	// Hold the services to what the manifest declares
+	if entry.Manifest != nil {
+		var mounts []string
+		for _, mount := range entry.Manifest.Runtime.Mounts {
+			if host := env[MountVar(mount.Name)]; host != "" {
+				mounts = append(mounts, host)
+			}
+		}
+		rendered, err = tr.enforceManifest(rendered, entry, mounts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// Apply security defaults
 	rendered = tr.applySecurityDefaults(rendered, entry.NeedsPrivileged)
 
 	return []byte(rendered), nil
 }
 
-// ValidateParams validates parameters against JSON schema
+// ValidateParams validates parameters against the entry's JSON schema
+// file and against the env schema in its manifest. The env schema sees
+// the parameters merged over the catalog's env defaults, which is the
+// environment the app actually gets.
 func (tr *TemplateRenderer) ValidateParams(entry *CatalogEntry, params map[string]interface{}) error {
+	if entry.Manifest != nil && entry.Manifest.Runtime.EnvSchema != nil {
+		env := make(map[string]interface{})
+		for k, v := range entry.Defaults.Env {
+			env[k] = v
+		}
+		for k, v := range params {
+			env[k] = v
+		}
+		schemaLoader := gojsonschema.NewGoLoader(entry.Manifest.Runtime.EnvSchema)
+		if err := validateAgainst(schemaLoader, env); err != nil {
+			return err
+		}
+	}
+
 	if entry.Schema == "" {
 		// No schema, params are optional
 		return nil
 	}
 
 	// Load schema
-	schemaPath := filepath.Join(tr.templateDir, entry.Schema)
+	schemaPath := tr.templatePath(entry.Schema)
 	schemaData, err := os.ReadFile(schemaPath)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -74,9 +115,11 @@ func (tr *TemplateRenderer) ValidateParams(entry *CatalogEntry, params map[strin
 		return fmt.Errorf("failed to read schema: %w", err)
 	}
 
-	// Parse schema
-	schemaLoader := gojsonschema.NewBytesLoader(schemaData)
+	return validateAgainst(gojsonschema.NewBytesLoader(schemaData), params)
+}
 
+// validateAgainst validates params against a JSON schema
+func validateAgainst(schemaLoader gojsonschema.JSONLoader, params map[string]interface{}) error {
 	// Convert params to JSON for validation
 	paramsJSON, err := json.Marshal(params)
 	if err != nil {
@@ -303,6 +346,187 @@ func (tr *TemplateRenderer) applySecurityDefaults(content string, needsPrivilege
 	return string(result)
 }
 
+// enforceManifest refuses services that take privileges the manifest
+// doesn't ask for and sets its resource limits on every service. Host
+// paths may only be bound from mounts, the host paths the manifest's
+// mounts were mapped to, or from the app's own directory.
+func (tr *TemplateRenderer) enforceManifest(content string, entry *CatalogEntry, mounts []string) (string, error) {
+	var compose map[string]interface{}
+	if err := yaml.Unmarshal([]byte(content), &compose); err != nil {
+		return "", fmt.Errorf("rendered compose file is invalid YAML: %w", err)
+	}
+	services, _ := compose["services"].(map[string]interface{})
+	volumes, _ := compose["volumes"].(map[string]interface{})
+	for name, volume := range volumes {
+		vol, _ := volume.(map[string]interface{})
+		opts, _ := vol["driver_opts"].(map[string]interface{})
+		if device, _ := opts["device"].(string); strings.HasPrefix(device, "/") {
+			if err := checkBindSource(device, mounts); err != nil {
+				return "", fmt.Errorf("volume %s: %w", name, err)
+			}
+		}
+	}
+	perms := entry.Manifest.Permissions
+	caps := map[string]bool{}
+	for _, c := range perms.Capabilities {
+		caps[strings.ToUpper(strings.TrimPrefix(c, "CAP_"))] = true
+	}
+
+	for name, service := range services {
+		svc, ok := service.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if privileged, _ := svc["privileged"].(bool); privileged && !perms.Privileged {
+			return "", fmt.Errorf("service %s runs privileged but the manifest doesn't ask for it", name)
+		}
+		if svc["network_mode"] == "host" && !perms.HostNetwork {
+			return "", fmt.Errorf("service %s uses the host network but the manifest doesn't ask for it", name)
+		}
+		if svc["pid"] == "host" && !perms.HostPID {
+			return "", fmt.Errorf("service %s uses the host PID namespace but the manifest doesn't ask for it", name)
+		}
+		capAdd, _ := svc["cap_add"].([]interface{})
+		for _, c := range capAdd {
+			capName, _ := c.(string)
+			if !caps[strings.ToUpper(strings.TrimPrefix(capName, "CAP_"))] {
+				return "", fmt.Errorf("service %s adds capability %v but the manifest doesn't ask for it", name, c)
+			}
+		}
+		if err := checkServiceVolumes(svc, mounts); err != nil {
+			return "", fmt.Errorf("service %s: %w", name, err)
+		}
+		// These reach past the container as far as privileged does, so
+		// they need the same consent
+		if !perms.Privileged {
+			if err := checkHostAccess(svc); err != nil {
+				return "", fmt.Errorf("service %s %s but the manifest doesn't ask for privileged", name, err)
+			}
+		}
+
+		// The manifest's limits replace whatever the template sets
+		res := entry.Defaults.Resources
+		limits := map[string]interface{}{}
+		reservations := map[string]interface{}{}
+		if res.CPULimit != "" {
+			limits["cpus"] = res.CPULimit
+		}
+		if res.MemoryLimit != "" {
+			limits["memory"] = res.MemoryLimit
+		}
+		if res.CPURequest != "" {
+			reservations["cpus"] = res.CPURequest
+		}
+		if res.MemRequest != "" {
+			reservations["memory"] = res.MemRequest
+		}
+		if len(limits) == 0 && len(reservations) == 0 {
+			continue
+		}
+		deploy, _ := svc["deploy"].(map[string]interface{})
+		if deploy == nil {
+			deploy = map[string]interface{}{}
+		}
+		resources, _ := deploy["resources"].(map[string]interface{})
+		if resources == nil {
+			resources = map[string]interface{}{}
+		}
+		if len(limits) > 0 {
+			resources["limits"] = limits
+		}
+		if len(reservations) > 0 {
+			resources["reservations"] = reservations
+		}
+		deploy["resources"] = resources
+		svc["deploy"] = deploy
+	}
+
+	result, err := yaml.Marshal(compose)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal compose file: %w", err)
+	}
+	return string(result), nil
+}
+
+// checkServiceVolumes vets the host paths a service binds, in the short
+// "source:target[:mode]" and the long syntax
+func checkServiceVolumes(svc map[string]interface{}, mounts []string) error {
+	volumes, _ := svc["volumes"].([]interface{})
+	for _, v := range volumes {
+		var source string
+		switch vol := v.(type) {
+		case string:
+			if src, _, ok := strings.Cut(vol, ":"); ok {
+				source = src
+			}
+		case map[string]interface{}:
+			if vol["type"] == "bind" {
+				source, _ = vol["source"].(string)
+				if source == "" {
+					return fmt.Errorf("bind mount without a source")
+				}
+			}
+		}
+		// Anything else names a volume
+		if source == "" || !strings.ContainsAny(source[:1], "/.~") {
+			continue
+		}
+		if err := checkBindSource(source, mounts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkBindSource accepts a host path that is one of the mapped mounts or
+// lies within one, or a relative path that stays in the app's directory.
+// Relative paths resolve against the compose file, which lives in the
+// app's config directory.
+func checkBindSource(source string, mounts []string) error {
+	if strings.HasPrefix(source, ".") {
+		if within(filepath.Join("/app/config", source), "/app") {
+			return nil
+		}
+		return fmt.Errorf("%s leaves the app's directory", source)
+	}
+	if filepath.IsAbs(source) {
+		source = filepath.Clean(source)
+		for _, mount := range mounts {
+			if within(source, mount) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%s is not one of the app's mounts", source)
+}
+
+// checkHostAccess says how a service gets at the host beyond its
+// namespaces, if it does: devices, the host's IPC, user or cgroup
+// namespace, or security profiles turned off
+func checkHostAccess(svc map[string]interface{}) error {
+	if devices, _ := svc["devices"].([]interface{}); len(devices) > 0 {
+		return fmt.Errorf("maps host devices")
+	}
+	if rules, _ := svc["device_cgroup_rules"].([]interface{}); len(rules) > 0 {
+		return fmt.Errorf("allows host devices")
+	}
+	for _, key := range []string{"ipc", "userns_mode", "cgroup"} {
+		if svc[key] == "host" {
+			return fmt.Errorf("uses the host %s namespace", strings.TrimSuffix(key, "_mode"))
+		}
+	}
+	secOpts, _ := svc["security_opt"].([]interface{})
+	for _, o := range secOpts {
+		opt, _ := o.(string)
+		opt = strings.ReplaceAll(opt, ":", "=")
+		_, value, _ := strings.Cut(opt, "=")
+		if value == "unconfined" || opt == "label=disable" {
+			return fmt.Errorf("sets security_opt %s", o)
+		}
+	}
+	return nil
+}
+
 // RenderEnvFile creates an environment file for the app
 func (tr *TemplateRenderer) RenderEnvFile(params map[string]interface{}) ([]byte, error) {
 	env := tr.paramsToEnv(params)
@@ -319,55 +543,87 @@ func (tr *TemplateRenderer) RenderEnvFile(params map[string]interface{}) ([]byte
 	return buffer.Bytes(), nil
 }
 
-// RenderCaddySnippet creates a Caddy configuration snippet for the app
-func (tr *TemplateRenderer) RenderCaddySnippet(appID string, ports []PortMapping) ([]byte, error) {
-	if len(ports) == 0 {
-		return nil, nil // No ports to proxy
-	}
-
-	// Use the first HTTP port
-	var proxyPort int
-	for _, p := range ports {
-		if p.Container == 80 || p.Container == 8080 || p.Container == 3000 {
-			proxyPort = p.Container
-			break
+// RenderCaddySnippet creates a Caddy configuration snippet for the app:
+// a route inside the main site in path mode, otherwise a site of its own.
+// With RequireLogin, nosd checks every request for a NithronOS session.
+// Apps share the NAS's host in path and port mode, so the nos_* cookies
+// are stripped before they reach them, as is any X-Nos-User the client
+// sent.
+func (tr *TemplateRenderer) RenderCaddySnippet(appID string, pc ProxyConfig) ([]byte, error) {
+	tmpl := `{{ define "proxy" }}
+	route {
+		request_header -X-Nos-User
+{{- if .RequireLogin }}
+		forward_auth 127.0.0.1:9000 {
+			uri /api/v1/apps/auth/verify
+			copy_headers X-Nos-User
+			header_up X-Forwarded-Uri {http.request.orig_uri}
+{{- if .Portal }}
+			header_up X-Nos-Portal {{ .Portal }}
+{{- end }}
+		}
+{{- end }}
+		reverse_proxy {{ .Upstream }} {
+			flush_interval -1
+			header_up X-Real-IP {remote_host}
+			header_up X-Forwarded-For {remote_host}
+			header_up X-Forwarded-Proto {scheme}
+			header_up Cookie "nos_[^=;]*=[^;]*;? *" ""
+{{- if not .RequireLogin }}
+			header_up -X-Nos-User
+{{- end }}
+{{- range $name, $value := .Headers }}
+			header_up {{ $name }} {{ quote $value }}
+{{- end }}
 		}
 	}
-
-	// If no standard HTTP port, use the first one
-	if proxyPort == 0 && len(ports) > 0 {
-		proxyPort = ports[0].Container
+{{- end -}}
+# App: {{ .AppID }}
+{{- if eq .Mode "path" }}
+{{ if .StripPath }}handle_path{{ else }}handle{{ end }} {{ .Path }}/* {
+{{- template "proxy" . }}
+}
+{{- else }}
+{{ .Address }} {
+{{- if .TLS }}
+	{{ .TLS }}
+{{- end }}
+{{- if .RequireLogin }}
+	handle /.nos-auth {
+		rewrite * /api/v1/apps/auth/callback?{query}
+		reverse_proxy 127.0.0.1:9000
 	}
-
-	if proxyPort == 0 {
-		return nil, nil
-	}
-
-	// Create Caddy snippet
-	tmpl := `# App: {{ .AppID }}
-handle_path /apps/{{ .AppID }}/* {
-	reverse_proxy nos-app-{{ .AppID }}-app-1:{{ .Port }} {
-		flush_interval -1
-		header_up X-Real-IP {remote_host}
-		header_up X-Forwarded-For {remote_host}
-		header_up X-Forwarded-Proto {scheme}
+{{- end }}
+	handle {
+{{- template "proxy" . }}
 	}
 }
+{{- end }}
 `
 
-	t, err := template.New("caddy").Parse(tmpl)
+	t, err := template.New("caddy").Funcs(template.FuncMap{"quote": strconv.Quote}).Parse(tmpl)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse template: %w", err)
 	}
 
 	var buffer bytes.Buffer
-	err = t.Execute(&buffer, map[string]interface{}{
-		"AppID": appID,
-		"Port":  proxyPort,
-	})
+	err = t.Execute(&buffer, struct {
+		ProxyConfig
+		AppID string
+	}{pc, appID})
 	if err != nil {
 		return nil, fmt.Errorf("failed to render template: %w", err)
 	}
+	buffer.WriteString("\n")
 
 	return buffer.Bytes(), nil
 }
+
+// templatePath resolves a template file of an entry; entries from a git
+// catalog source carry absolute paths into its checkout
+func (tr *TemplateRenderer) templatePath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(tr.templateDir, path)
+}
@@ -0,0 +1,176 @@
+package apps
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHSignatureNamespace is the namespace catalog SSH signatures must be
+// made in: ssh-keygen -Y sign -n nos-catalog
+const SSHSignatureNamespace = "nos-catalog"
+
+// ErrBadSignature is returned when a catalog's signature doesn't verify
+// against any of its source's trusted keys
+var ErrBadSignature = errors.New("signature doesn't verify against the trusted keys")
+
+// verifySignature checks a detached minisign or SSH signature of data
+// against the trusted keys, each a minisign public key or an OpenSSH
+// authorized_keys line
+func verifySignature(data, sig []byte, trustedKeys []string) error {
+	if len(trustedKeys) == 0 {
+		return fmt.Errorf("no trusted keys configured")
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(sig), []byte("-----BEGIN SSH SIGNATURE-----")) {
+		return verifySSHSignature(data, sig, trustedKeys)
+	}
+	return verifyMinisign(data, sig, trustedKeys)
+}
+
+// minisignKey is a minisign public key: "Ed", an 8 byte key ID and the
+// Ed25519 key
+type minisignKey struct {
+	id  []byte
+	key ed25519.PublicKey
+}
+
+// parseMinisignKey accepts the base64 key or the whole .pub file
+func parseMinisignKey(s string) (*minisignKey, error) {
+	var line string
+	for _, l := range strings.Split(strings.TrimSpace(s), "\n") {
+		if l = strings.TrimSpace(l); l != "" && !strings.HasPrefix(l, "untrusted comment:") {
+			line = l
+		}
+	}
+	raw, err := base64.StdEncoding.DecodeString(line)
+	if err != nil || len(raw) != 42 || string(raw[:2]) != "Ed" {
+		return nil, fmt.Errorf("invalid minisign public key")
+	}
+	return &minisignKey{id: raw[2:10], key: ed25519.PublicKey(raw[10:])}, nil
+}
+
+// verifyMinisign checks a minisign signature file: an untrusted comment,
+// the signature, a trusted comment and the global signature over the
+// signature and the trusted comment
+func verifyMinisign(data, sig []byte, trustedKeys []string) error {
+	lines := strings.Split(strings.ReplaceAll(strings.TrimSpace(string(sig)), "\r\n", "\n"), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[0], "untrusted comment:") || !strings.HasPrefix(lines[2], "trusted comment: ") {
+		return fmt.Errorf("malformed minisign signature")
+	}
+	raw, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(raw) != 74 {
+		return fmt.Errorf("malformed minisign signature")
+	}
+	global, err := base64.StdEncoding.DecodeString(lines[3])
+	if err != nil || len(global) != ed25519.SignatureSize {
+		return fmt.Errorf("malformed minisign signature")
+	}
+
+	// "ED" signatures are over the BLAKE2b-512 hash of the file
+	message := data
+	switch string(raw[:2]) {
+	case "Ed":
+	case "ED":
+		sum := blake2b.Sum512(data)
+		message = sum[:]
+	default:
+		return fmt.Errorf("unsupported minisign algorithm %q", raw[:2])
+	}
+	keyID, signature := raw[2:10], raw[10:]
+	trusted := []byte(strings.TrimPrefix(lines[2], "trusted comment: "))
+
+	for _, s := range trustedKeys {
+		if isSSHKey(s) {
+			continue
+		}
+		key, err := parseMinisignKey(s)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(key.id, keyID) {
+			continue
+		}
+		if ed25519.Verify(key.key, message, signature) && ed25519.Verify(key.key, append(append([]byte{}, signature...), trusted...), global) {
+			return nil
+		}
+	}
+	return ErrBadSignature
+}
+
+// verifySSHSignature checks an armored SSHSIG signature, as made by
+// ssh-keygen -Y sign, in SSHSignatureNamespace
+func verifySSHSignature(data, sig []byte, trustedKeys []string) error {
+	block, _ := pem.Decode(sig)
+	if block == nil || block.Type != "SSH SIGNATURE" || !bytes.HasPrefix(block.Bytes, []byte("SSHSIG")) {
+		return fmt.Errorf("malformed SSH signature")
+	}
+	var blob struct {
+		Version       uint32
+		PublicKey     []byte
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Signature     []byte
+	}
+	if err := ssh.Unmarshal(block.Bytes[6:], &blob); err != nil || blob.Version != 1 {
+		return fmt.Errorf("malformed SSH signature")
+	}
+	if blob.Namespace != SSHSignatureNamespace {
+		return fmt.Errorf("SSH signature is for namespace %q, not %q", blob.Namespace, SSHSignatureNamespace)
+	}
+	var digest []byte
+	switch blob.HashAlgorithm {
+	case "sha256":
+		sum := sha256.Sum256(data)
+		digest = sum[:]
+	case "sha512":
+		sum := sha512.Sum512(data)
+		digest = sum[:]
+	default:
+		return fmt.Errorf("unsupported SSH signature hash %q", blob.HashAlgorithm)
+	}
+	var signature ssh.Signature
+	if err := ssh.Unmarshal(blob.Signature, &signature); err != nil {
+		return fmt.Errorf("malformed SSH signature")
+	}
+	pub, err := ssh.ParsePublicKey(blob.PublicKey)
+	if err != nil {
+		return fmt.Errorf("malformed SSH signature: %w", err)
+	}
+
+	signed := append([]byte("SSHSIG"), ssh.Marshal(struct {
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Digest        []byte
+	}{blob.Namespace, blob.Reserved, blob.HashAlgorithm, digest})...)
+
+	for _, s := range trustedKeys {
+		if !isSSHKey(s) {
+			continue
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s))
+		if err != nil {
+			return fmt.Errorf("invalid trusted SSH key: %w", err)
+		}
+		if bytes.Equal(key.Marshal(), pub.Marshal()) && pub.Verify(signed, &signature) == nil {
+			return nil
+		}
+	}
+	return ErrBadSignature
+}
+
+// isSSHKey tells an authorized_keys line from a minisign key
+func isSSHKey(s string) bool {
+	s = strings.TrimSpace(s)
+	return strings.HasPrefix(s, "ssh-") || strings.HasPrefix(s, "ecdsa-") || strings.HasPrefix(s, "sk-")
+}
@@ -0,0 +1,95 @@
+package apps
+
+import (
+	"fmt"
+	"os"
+)
+
+// OIDCPath is where nosd's OpenID Connect provider is served on the main
+// site; it is the issuer under the site's origin
+const OIDCPath = "/api/v1/oidc"
+
+// Variables of the .env file an app gets its OIDC client in
+const (
+	OIDCIssuerVar       = "NOS_OIDC_ISSUER"
+	OIDCClientIDVar     = "NOS_OIDC_CLIENT_ID"
+	OIDCClientSecretVar = "NOS_OIDC_CLIENT_SECRET"
+	OIDCRedirectURIVar  = "NOS_OIDC_REDIRECT_URI"
+)
+
+// SSOProvider registers apps as OpenID Connect clients; nosd's OIDC
+// provider is one
+type SSOProvider interface {
+	// RegisterClient registers an app, replacing any client it had
+	RegisterClient(appID, name string, redirectURIs, scopes []string) (clientID, secret string, err error)
+	// SetRedirectURIs changes where an app's client may be sent back to
+	SetRedirectURIs(appID string, redirectURIs []string) error
+	// RemoveClient unregisters an app
+	RemoveClient(appID string) error
+}
+
+// redirectURIs are the manifest's callback paths under the app's URL
+func (lm *LifecycleManager) redirectURIs(appID string, entry *CatalogEntry, exp *Exposure) []string {
+	base := "https://" + exposureHost(exp, lm.baseDomain())
+	if exp.Mode == ExposePath {
+		base = "https://" + lm.baseDomain() + lm.proxyConfig(appID, entry, exp).Path
+	}
+	uris := make([]string, 0, len(entry.Manifest.OIDC.RedirectPaths))
+	for _, p := range entry.Manifest.OIDC.RedirectPaths {
+		uris = append(uris, base+p)
+	}
+	return uris
+}
+
+// registerSSO registers the app's OIDC client when its manifest asks for
+// one, returning the client ID and the env params with its credentials
+func (lm *LifecycleManager) registerSSO(appID string, entry *CatalogEntry, exp *Exposure, params map[string]interface{}) (string, map[string]interface{}, error) {
+	if lm.sso == nil || entry.Manifest == nil || entry.Manifest.OIDC == nil {
+		return "", params, nil
+	}
+	if exp == nil {
+		fmt.Fprintf(os.Stderr, "Warning: app %s isn't exposed, so it can't use single sign-on\n", appID)
+		return "", params, nil
+	}
+
+	uris := lm.redirectURIs(appID, entry, exp)
+	clientID, secret, err := lm.sso.RegisterClient(appID, entry.Name, uris, entry.Manifest.OIDC.Scopes)
+	if err != nil {
+		return "", nil, err
+	}
+	merged := make(map[string]interface{}, len(params)+4)
+	for k, v := range params {
+		merged[k] = v
+	}
+	merged[OIDCIssuerVar] = lm.OIDCIssuer()
+	merged[OIDCClientIDVar] = clientID
+	merged[OIDCClientSecretVar] = secret
+	merged[OIDCRedirectURIVar] = uris[0]
+	return clientID, merged, nil
+}
+
+// updateSSO points the app's OIDC client at where the app is now served
+func (lm *LifecycleManager) updateSSO(app *InstalledApp, entry *CatalogEntry, exp *Exposure) {
+	if lm.sso == nil || app.SSOClientID == "" || exp == nil || entry.Manifest == nil || entry.Manifest.OIDC == nil {
+		return
+	}
+	if err := lm.sso.SetRedirectURIs(app.ID, lm.redirectURIs(app.ID, entry, exp)); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to update OIDC client of %s: %v\n", app.ID, err)
+	}
+}
+
+// removeSSO unregisters the app's OIDC client, if it has one
+func (lm *LifecycleManager) removeSSO(appID string) {
+	if lm.sso == nil {
+		return
+	}
+	if err := lm.sso.RemoveClient(appID); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to remove OIDC client of %s: %v\n", appID, err)
+	}
+}
+
+// OIDCIssuer is the issuer of the OIDC provider under the configured
+// HTTPS domain, as apps are given it
+func (lm *LifecycleManager) OIDCIssuer() string {
+	return "https://" + lm.baseDomain() + OIDCPath
+}
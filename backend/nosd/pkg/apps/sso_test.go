@@ -0,0 +1,80 @@
+package apps
+
+import (
+	"slices"
+	"testing"
+
+	"nithronos/backend/nosd/pkg/appsdk"
+)
+
+type fakeSSO struct {
+	uris    map[string][]string
+	removed []string
+}
+
+func (f *fakeSSO) RegisterClient(appID, name string, redirectURIs, scopes []string) (string, string, error) {
+	f.uris[appID] = redirectURIs
+	return "app-" + appID, "s3cret", nil
+}
+
+func (f *fakeSSO) SetRedirectURIs(appID string, redirectURIs []string) error {
+	f.uris[appID] = redirectURIs
+	return nil
+}
+
+func (f *fakeSSO) RemoveClient(appID string) error {
+	f.removed = append(f.removed, appID)
+	return nil
+}
+
+func TestRegisterSSO(t *testing.T) {
+	lm := newProxyLifecycle(t)
+	sso := &fakeSSO{uris: map[string][]string{}}
+	lm.UseSSOProvider(sso)
+	entry := &CatalogEntry{
+		ID:   "photos",
+		Name: "Photos",
+		Manifest: &appsdk.Manifest{
+			WebUI: &appsdk.WebUIConfig{Port: 3001, Path: "/apps/photos"},
+			OIDC:  &appsdk.OIDCConfig{RedirectPaths: []string{"/auth/login", "/api/oauth/mobile"}, Scopes: []string{"profile"}},
+		},
+	}
+	params := map[string]interface{}{"PHOTOS_TITLE": "Photos"}
+
+	clientID, env, err := lm.registerSSO("photos", entry, &Exposure{Mode: ExposePath}, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clientID != "app-photos" || env[OIDCClientIDVar] != clientID || env[OIDCClientSecretVar] != "s3cret" ||
+		env[OIDCIssuerVar] != "https://"+DefaultAppDomain+OIDCPath || env["PHOTOS_TITLE"] != "Photos" {
+		t.Fatalf("env %v", env)
+	}
+	if _, ok := params[OIDCClientSecretVar]; ok {
+		t.Fatal("secret leaked into the app's params")
+	}
+	want := []string{"https://nas.lan/apps/photos/auth/login", "https://nas.lan/apps/photos/api/oauth/mobile"}
+	if !slices.Equal(sso.uris["photos"], want) || env[OIDCRedirectURIVar] != want[0] {
+		t.Fatalf("redirect URIs %v", sso.uris["photos"])
+	}
+
+	// Moving the app moves its callbacks
+	app := &InstalledApp{ID: "photos", SSOClientID: clientID}
+	lm.updateSSO(app, entry, &Exposure{Mode: ExposeSubdomain, Domain: "photos.nas.lan"})
+	if sso.uris["photos"][0] != "https://photos.nas.lan/auth/login" {
+		t.Fatalf("redirect URIs %v", sso.uris["photos"])
+	}
+	lm.updateSSO(app, entry, &Exposure{Mode: ExposePort, Port: 8443})
+	if sso.uris["photos"][0] != "https://nas.lan:8443/auth/login" {
+		t.Fatalf("redirect URIs %v", sso.uris["photos"])
+	}
+
+	// Nothing to register without a web UI to come back to
+	if clientID, _, err := lm.registerSSO("photos", entry, nil, params); clientID != "" || err != nil {
+		t.Fatalf("unexposed app: %q, %v", clientID, err)
+	}
+
+	perms := manifestPermissions(entry.Manifest)
+	if len(perms) != 1 || perms[0].ID != "sso" {
+		t.Fatalf("permissions %v", perms)
+	}
+}
@@ -210,6 +210,27 @@ func (ss *StateStore) UpdateAppHealth(id string, health HealthStatus) error {
 	return ss.save()
 }
 
+// UpdateAppUpdate records what an update check found for an app
+func (ss *StateStore) UpdateAppUpdate(id string, update *UpdateStatus) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	found := false
+	for i, app := range ss.state.Apps {
+		if app.ID == id {
+			ss.state.Apps[i].Update = update
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("app not found: %s", id)
+	}
+
+	return ss.save()
+}
+
 // AddSnapshot adds a snapshot to an app
 func (ss *StateStore) AddSnapshot(id string, snapshot AppSnapshot) error {
 	ss.mu.Lock()
@@ -3,6 +3,8 @@ package apps
 import (
 	"encoding/json"
 	"time"
+
+	"nithronos/backend/nosd/pkg/appsdk"
 )
 
 // CatalogEntry represents an app in the catalog
@@ -19,6 +21,18 @@ type CatalogEntry struct {
 	Health          HealthConfig `json:"health" yaml:"health"`
 	NeedsPrivileged bool         `json:"needs_privileged" yaml:"needs_privileged"`
 	Notes           string       `json:"notes,omitempty" yaml:"notes,omitempty"`
+
+	// Manifest is the app's nosapp.yaml, when it ships one. The fields
+	// above are filled in from it and it is enforced at install.
+	Manifest *appsdk.Manifest `json:"manifest,omitempty" yaml:"manifest,omitempty"`
+	// Permissions the admin must accept to install the app
+	Permissions []Permission `json:"permissions,omitempty" yaml:"-"`
+}
+
+// Permission is one privilege an app asks for at install time
+type Permission struct {
+	ID          string `json:"id"` // e.g. "privileged", "cap:NET_ADMIN", "api:shares.read"
+	Description string `json:"description"`
 }
 
 // AppDefaults contains default configuration for an app
@@ -43,6 +57,25 @@ type PortMapping struct {
 	Protocol  string `json:"protocol" yaml:"protocol"` // tcp or udp
 }
 
+// Ways an app's web UI is exposed through the reverse proxy
+const (
+	ExposePath      = "path"      // https://<nas>/apps/<id>/
+	ExposeSubdomain = "subdomain" // https://<id>.<domain>/ or a custom domain
+	ExposePort      = "port"      // https://<nas>:<port>/
+	ExposeNone      = "none"
+)
+
+// Exposure says how an app's web UI is reached
+type Exposure struct {
+	Mode string `json:"mode"`
+	// Domain is the app's host name in subdomain mode
+	Domain string `json:"domain,omitempty"`
+	// Port is the port the proxy listens on in port mode
+	Port int `json:"port,omitempty"`
+	// RequireLogin puts a NithronOS login in front of the app
+	RequireLogin bool `json:"require_login"`
+}
+
 // ResourceLimits defines resource constraints for an app
 type ResourceLimits struct {
 	CPULimit    string `json:"cpu_limit,omitempty" yaml:"cpu_limit,omitempty"`       // e.g., "2.0"
@@ -68,6 +101,18 @@ type Catalog struct {
 	Entries   []CatalogEntry `json:"entries" yaml:"entries"`
 	Source    string         `json:"source,omitempty" yaml:"source,omitempty"`
 	UpdatedAt time.Time      `json:"updated_at" yaml:"updated_at"`
+	Sources   []SourceStatus `json:"sources,omitempty" yaml:"-"`
+}
+
+// SourceStatus reports how a remote source fared in the last sync
+type SourceStatus struct {
+	Name     string    `json:"name"`
+	Type     string    `json:"type"`
+	URL      string    `json:"url"`
+	Revision string    `json:"revision,omitempty"`
+	Entries  int       `json:"entries"`
+	SyncedAt time.Time `json:"synced_at"`
+	Error    string    `json:"error,omitempty"`
 }
 
 // InstalledApp represents an installed application
@@ -83,6 +128,80 @@ type InstalledApp struct {
 	InstalledAt time.Time              `json:"installed_at"`
 	UpdatedAt   time.Time              `json:"updated_at"`
 	Snapshots   []AppSnapshot          `json:"snapshots"`
+
+	// Mounts maps each mount declared in the manifest to its host path
+	Mounts map[string]string `json:"mounts,omitempty"`
+	// Permissions the admin accepted for this app
+	Permissions []string `json:"permissions,omitempty"`
+	// Expose is how the app's web UI is reached; nil for apps installed
+	// before it could be chosen, which get the default
+	Expose *Exposure `json:"expose,omitempty"`
+	// SSOClientID is the app's OpenID Connect client, when it signs users
+	// in with NithronOS
+	SSOClientID string `json:"sso_client_id,omitempty"`
+	// UpdatePolicy says what to do with updates; nil means notify
+	UpdatePolicy *UpdatePolicy `json:"update_policy,omitempty"`
+	// Update is what the last update check found
+	Update *UpdateStatus `json:"update,omitempty"`
+}
+
+// What happens when an update for an app is available
+const (
+	UpdateNotify = "notify" // tell the admin, who upgrades by hand
+	UpdateAuto   = "auto"   // upgrade in the maintenance window
+	UpdatePin    = "pin"    // stay on the installed version
+)
+
+// UpdatePolicy is an app's update policy
+type UpdatePolicy struct {
+	Mode string `json:"mode"`
+	// Window is the daily maintenance window of auto upgrades, as
+	// "HH:MM-HH:MM" local time; it may wrap past midnight
+	Window string `json:"window,omitempty"`
+	// GraceMinutes is how long the app must stay healthy after an auto
+	// upgrade for it to be kept
+	GraceMinutes int `json:"grace_minutes,omitempty"`
+}
+
+// UpdateStatus is what an update check found for an app
+type UpdateStatus struct {
+	CheckedAt time.Time `json:"checked_at"`
+	// Version is the catalog's version when it is newer than the app's
+	Version string `json:"version,omitempty"`
+	// Images lists the images with a newer digest in their registry
+	Images []ImageUpdate `json:"images,omitempty"`
+	Error  string        `json:"error,omitempty"`
+	// Notified is set once the admin was told about this update
+	Notified bool `json:"notified,omitempty"`
+	// Held is set when an auto upgrade to this update failed; it isn't
+	// tried again until a newer update shows up
+	Held bool `json:"held,omitempty"`
+	// LastUpgrade is the outcome of the last auto upgrade
+	LastUpgrade *UpgradeAttempt `json:"last_upgrade,omitempty"`
+}
+
+// ImageUpdate is an image whose tag points at a new digest
+type ImageUpdate struct {
+	Image     string `json:"image"`
+	Current   string `json:"current"`
+	Available string `json:"available"`
+}
+
+// Outcomes of an auto upgrade
+const (
+	UpgradeSucceeded  = "upgraded"
+	UpgradeFailed     = "failed"      // UpgradeApp failed and undid itself
+	UpgradeRolledBack = "rolled_back" // unhealthy in the grace period
+)
+
+// UpgradeAttempt records an auto upgrade
+type UpgradeAttempt struct {
+	At          time.Time `json:"at"`
+	FromVersion string    `json:"from_version"`
+	ToVersion   string    `json:"to_version"`
+	Result      string    `json:"result"`
+	Message     string    `json:"message,omitempty"`
+	Snapshot    string    `json:"snapshot,omitempty"`
 }
 
 // AppStatus represents the current status of an app
@@ -128,12 +247,21 @@ type InstallRequest struct {
 	ID      string                 `json:"id" validate:"required,alphanum"`
 	Version string                 `json:"version,omitempty"`
 	Params  map[string]interface{} `json:"params,omitempty"`
+	// Mounts gives host paths for the manifest's non-persistent mounts
+	Mounts map[string]string `json:"mounts,omitempty"`
+	// AcceptedPermissions lists the IDs of the permissions the admin accepted
+	AcceptedPermissions []string `json:"accepted_permissions,omitempty"`
+	// Expose overrides how the web UI is reached; the manifest's choice
+	// is used when empty
+	Expose *Exposure `json:"expose,omitempty"`
 }
 
 // UpgradeRequest represents a request to upgrade an app
 type UpgradeRequest struct {
 	Version string                 `json:"version" validate:"required"`
 	Params  map[string]interface{} `json:"params,omitempty"`
+	// AcceptedPermissions lists permissions the new version adds
+	AcceptedPermissions []string `json:"accepted_permissions,omitempty"`
 }
 
 // RollbackRequest represents a request to rollback an app
@@ -153,15 +281,20 @@ type AppState struct {
 	UpdatedAt time.Time      `json:"updated_at"`
 }
 
-// CatalogSource represents a remote catalog source
+// CatalogSource represents a remote catalog source. Its catalog must
+// carry a detached signature by one of the trusted keys: next to an http
+// catalog, or in a git note on the commit of a git catalog.
 type CatalogSource struct {
 	Name      string `yaml:"name"`
 	Type      string `yaml:"type"` // "git" or "http"
 	URL       string `yaml:"url"`
 	Branch    string `yaml:"branch,omitempty"`
+	Tag       string `yaml:"tag,omitempty"` // git only, wins over branch
 	SHA256    string `yaml:"sha256,omitempty"`
-	Signature string `yaml:"signature,omitempty"`
-	Enabled   bool   `yaml:"enabled"`
+	Signature string `yaml:"signature,omitempty"` // signature URL of an http catalog
+	// Minisign public keys or OpenSSH authorized_keys lines
+	TrustedKeys []string `yaml:"trusted_keys"`
+	Enabled     bool     `yaml:"enabled"`
 }
 
 // Event represents an app lifecycle event
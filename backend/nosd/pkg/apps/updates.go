@@ -0,0 +1,736 @@
+package apps
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v3"
+)
+
+// Update checks and automatic upgrades. The updater compares installed
+// apps with the catalog and their images with their registries, tells
+// the admin what is new and upgrades the apps whose policy says so in
+// their maintenance window. An app that turns unhealthy within the grace
+// period after its upgrade is rolled back to the pre-upgrade snapshot and
+// the images it ran before.
+
+// Defaults of an update policy
+const (
+	DefaultUpdateWindow = "03:00-05:00"
+	DefaultUpdateGrace  = 10 * time.Minute
+)
+
+// updaterUser is who automatic upgrades are logged as
+const updaterUser = "system:updater"
+
+// UpdateNotifier is told about new updates and how auto upgrades went
+type UpdateNotifier interface {
+	UpdateAvailable(app *InstalledApp, update *UpdateStatus)
+	UpgradeFinished(app *InstalledApp, attempt *UpgradeAttempt)
+}
+
+// ImageInspector looks up the digests of image tags
+type ImageInspector interface {
+	// LocalDigest is the registry digest of the pulled image, or ""
+	// for an image that wasn't pulled from a registry
+	LocalDigest(ctx context.Context, image string) (string, error)
+	// RemoteDigest is the digest the tag points at in its registry
+	RemoteDigest(ctx context.Context, image string) (string, error)
+	// Retag points the tag back at the pulled image with digest
+	Retag(ctx context.Context, image, digest string) error
+}
+
+// AppHealth reports the health of apps; the health monitor does
+type AppHealth interface {
+	ForceCheck(ctx context.Context, appID string) error
+	GetHealth(appID string) (HealthStatus, bool)
+}
+
+// Updater checks installed apps for updates and carries out their
+// update policies
+type Updater struct {
+	lm       *LifecycleManager
+	health   AppHealth
+	images   ImageInspector
+	notifier UpdateNotifier
+	logger   zerolog.Logger
+	interval time.Duration // between update checks
+	tick     time.Duration // between looks at the maintenance windows
+	poll     time.Duration // between health checks in the grace period
+	now      func() time.Time
+
+	// Upgrade through the lifecycle manager; tests replace them
+	upgrade func(ctx context.Context, appID string, req UpgradeRequest, userID string) error
+	revert  func(ctx context.Context, prev *InstalledApp, files upgradeFiles, snapshotID string) error
+
+	checkMu   sync.Mutex
+	lastCheck time.Time
+	mu        sync.Mutex
+	running   bool
+	stopCh    chan struct{}
+}
+
+// NewUpdater creates an updater that upgrades through lm and judges the
+// upgraded apps by health
+func NewUpdater(lm *LifecycleManager, health AppHealth, logger zerolog.Logger) *Updater {
+	u := &Updater{
+		lm:       lm,
+		health:   health,
+		images:   dockerImages{},
+		logger:   logger.With().Str("component", "app-updater").Logger(),
+		interval: 6 * time.Hour,
+		tick:     time.Minute,
+		poll:     15 * time.Second,
+		now:      time.Now,
+		upgrade:  lm.UpgradeApp,
+		stopCh:   make(chan struct{}),
+	}
+	u.revert = u.revertUpgrade
+	return u
+}
+
+// UseNotifier tells notifier about updates and auto upgrades
+func (u *Updater) UseNotifier(notifier UpdateNotifier) {
+	u.notifier = notifier
+}
+
+// Start begins checking for updates
+func (u *Updater) Start(ctx context.Context) error {
+	u.mu.Lock()
+	if u.running {
+		u.mu.Unlock()
+		return fmt.Errorf("updater already running")
+	}
+	u.running = true
+	u.mu.Unlock()
+
+	go u.loop(ctx)
+	return nil
+}
+
+// Stop stops checking for updates
+func (u *Updater) Stop() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.running {
+		close(u.stopCh)
+		u.running = false
+	}
+}
+
+func (u *Updater) loop(ctx context.Context) {
+	ticker := time.NewTicker(u.tick)
+	defer ticker.Stop()
+
+	for {
+		u.run(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-u.stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// run checks for updates when a check is due, then upgrades the apps
+// whose maintenance window is open
+func (u *Updater) run(ctx context.Context) {
+	u.checkMu.Lock()
+	due := u.now().Sub(u.lastCheck) >= u.interval
+	u.checkMu.Unlock()
+	if due {
+		u.CheckAll(ctx)
+	}
+
+	for _, app := range u.lm.stateStore.GetAllApps() {
+		if ctx.Err() != nil {
+			return
+		}
+		if u.due(&app) {
+			u.autoUpgrade(ctx, &app)
+		}
+	}
+}
+
+// CheckAll checks every installed app for updates
+func (u *Updater) CheckAll(ctx context.Context) {
+	u.checkMu.Lock()
+	defer u.checkMu.Unlock()
+
+	for _, app := range u.lm.stateStore.GetAllApps() {
+		if ctx.Err() != nil {
+			return
+		}
+		u.checkApp(ctx, &app)
+	}
+	u.lastCheck = u.now()
+}
+
+// checkApp records what is new for app and tells the admin about it
+func (u *Updater) checkApp(ctx context.Context, app *InstalledApp) {
+	status := u.check(ctx, app)
+	if prev := app.Update; prev != nil {
+		status.LastUpgrade = prev.LastUpgrade
+		if prev.key() == status.key() {
+			status.Notified, status.Held = prev.Notified, prev.Held
+		}
+	}
+
+	if status.Available() && !status.Notified && effectivePolicy(app).Mode == UpdateNotify && u.notifier != nil {
+		u.notifier.UpdateAvailable(app, status)
+		status.Notified = true
+	}
+	if err := u.lm.stateStore.UpdateAppUpdate(app.ID, status); err != nil {
+		u.logger.Warn().Err(err).Str("app", app.ID).Msg("Failed to record update check")
+	}
+}
+
+// check compares the app with the catalog and its images with their
+// registries
+func (u *Updater) check(ctx context.Context, app *InstalledApp) *UpdateStatus {
+	status := &UpdateStatus{CheckedAt: u.now()}
+	fail := func(err error) {
+		if status.Error == "" {
+			status.Error = err.Error()
+		}
+	}
+
+	if entry, err := u.lm.catalogMgr.GetEntry(app.ID); err != nil {
+		fail(fmt.Errorf("app not found in catalog: %w", err))
+	} else if newerVersion(entry.Version, app.Version) {
+		status.Version = entry.Version
+	}
+
+	images, err := composeImages(filepath.Join(u.lm.appsRoot, app.ID, "config", "docker-compose.yml"))
+	if err != nil {
+		fail(err)
+	}
+	for _, image := range images {
+		current, err := u.images.LocalDigest(ctx, image)
+		if err != nil {
+			fail(err)
+			continue
+		}
+		if current == "" {
+			continue
+		}
+		available, err := u.images.RemoteDigest(ctx, image)
+		if err != nil {
+			fail(err)
+			continue
+		}
+		if available != current {
+			status.Images = append(status.Images, ImageUpdate{Image: image, Current: current, Available: available})
+		}
+	}
+	return status
+}
+
+// due reports whether app is to be upgraded now
+func (u *Updater) due(app *InstalledApp) bool {
+	policy := effectivePolicy(app)
+	if policy.Mode != UpdateAuto || app.Status != StatusRunning || !app.Update.Available() || app.Update.Held {
+		return false
+	}
+	open, err := inWindow(policy.Window, u.now())
+	return err == nil && open
+}
+
+// autoUpgrade upgrades app, watches it through the grace period and
+// rolls it back if it turns unhealthy
+func (u *Updater) autoUpgrade(ctx context.Context, app *InstalledApp) {
+	prev := *app
+	prev.Params = maps.Clone(app.Params)
+	target := app.Version
+	if app.Update.Version != "" {
+		target = app.Update.Version
+	}
+	attempt := &UpgradeAttempt{At: u.now(), FromVersion: app.Version, ToVersion: target}
+
+	files, err := u.lm.saveUpgradeFiles(app.ID)
+	var digests map[string]string
+	if err == nil {
+		digests, err = u.imageDigests(ctx, app.ID)
+	}
+	if err == nil {
+		err = u.upgrade(ctx, app.ID, UpgradeRequest{Version: target}, updaterUser)
+	}
+	if err != nil {
+		// UpgradeApp undoes what it did when it fails
+		attempt.Result, attempt.Message = UpgradeFailed, err.Error()
+		u.finish(ctx, &prev, attempt)
+		return
+	}
+
+	attempt.Snapshot = u.preUpgradeSnapshot(app.ID, attempt.At)
+	reason := u.watch(ctx, app.ID, effectivePolicy(app).grace())
+	if reason == "" {
+		attempt.Result = UpgradeSucceeded
+		if ctx.Err() != nil {
+			attempt.Message = "not watched through the grace period"
+		}
+		u.finish(ctx, &prev, attempt)
+		return
+	}
+
+	attempt.Result, attempt.Message = UpgradeRolledBack, reason
+	// The tags have to point at the old images before the app restarts
+	if err := u.restoreImages(ctx, digests); err != nil {
+		attempt.Message += "; failed to restore images: " + err.Error()
+	}
+	if err := u.revert(ctx, &prev, files, attempt.Snapshot); err != nil {
+		attempt.Message += "; rollback failed: " + err.Error()
+	}
+	u.finish(ctx, &prev, attempt)
+}
+
+// imageDigests records which pulled image each of the app's tags points
+// at. An upgrade that only pulls new images leaves the compose file as it
+// was, so restoring it alone would restart the app on the new images.
+func (u *Updater) imageDigests(ctx context.Context, appID string) (map[string]string, error) {
+	images, err := composeImages(filepath.Join(u.lm.appsRoot, appID, "config", "docker-compose.yml"))
+	if err != nil {
+		return nil, err
+	}
+	digests := map[string]string{}
+	for _, image := range images {
+		digest, err := u.images.LocalDigest(ctx, image)
+		if err != nil {
+			return nil, err
+		}
+		// Images built locally aren't pulled by an upgrade either
+		if digest != "" {
+			digests[image] = digest
+		}
+	}
+	return digests, nil
+}
+
+// restoreImages points the tags back at the images recorded before the
+// upgrade
+func (u *Updater) restoreImages(ctx context.Context, digests map[string]string) error {
+	images := make([]string, 0, len(digests))
+	for image := range digests {
+		images = append(images, image)
+	}
+	sort.Strings(images)
+
+	var failed []string
+	for _, image := range images {
+		if err := u.images.Retag(ctx, image, digests[image]); err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// preUpgradeSnapshot is the snapshot UpgradeApp took, if it took one
+func (u *Updater) preUpgradeSnapshot(appID string, since time.Time) string {
+	app, err := u.lm.stateStore.GetApp(appID)
+	if err != nil {
+		return ""
+	}
+	for i := len(app.Snapshots) - 1; i >= 0; i-- {
+		s := app.Snapshots[i]
+		if s.Name == "pre-upgrade" && !s.Timestamp.Before(since) {
+			return s.ID
+		}
+	}
+	return ""
+}
+
+// watch follows the app's health through the grace period, returning why
+// it is unhealthy, or "" when it stayed healthy
+func (u *Updater) watch(ctx context.Context, appID string, grace time.Duration) string {
+	deadline := u.now().Add(grace)
+	for {
+		if err := u.health.ForceCheck(ctx, appID); err == nil {
+			if health, ok := u.health.GetHealth(appID); ok && health.Status == "unhealthy" {
+				if health.Message != "" {
+					return "unhealthy after upgrade: " + health.Message
+				}
+				return "unhealthy after upgrade"
+			}
+		}
+		if !u.now().Before(deadline) {
+			return ""
+		}
+
+		select {
+		case <-ctx.Done():
+			return ""
+		case <-time.After(u.poll):
+		}
+	}
+}
+
+// finish records how an auto upgrade went and tells the admin
+func (u *Updater) finish(ctx context.Context, prev *InstalledApp, attempt *UpgradeAttempt) {
+	u.lm.logEvent("app.upgrade.auto", prev.ID, updaterUser, attempt)
+
+	app, err := u.lm.stateStore.GetApp(prev.ID)
+	if err != nil {
+		return
+	}
+	status := u.check(ctx, app)
+	status.LastUpgrade = attempt
+	// Don't try the same update again, even when the upgrade went
+	// through but the check still finds it
+	if attempt.Result != UpgradeSucceeded || status.key() == prev.Update.key() {
+		status.Held = true
+	}
+	if err := u.lm.stateStore.UpdateAppUpdate(app.ID, status); err != nil {
+		u.logger.Warn().Err(err).Str("app", app.ID).Msg("Failed to record upgrade")
+	}
+	app.Update = status
+
+	if u.notifier != nil {
+		u.notifier.UpgradeFinished(app, attempt)
+	}
+}
+
+// SetUpdatePolicy changes what happens when an update for an app is
+// available
+func (lm *LifecycleManager) SetUpdatePolicy(appID string, policy UpdatePolicy, userID string) error {
+	if err := policy.validate(); err != nil {
+		return fmt.Errorf("policy validation failed: %w", err)
+	}
+	app, err := lm.stateStore.GetApp(appID)
+	if err != nil {
+		return fmt.Errorf("app not found: %w", err)
+	}
+
+	app.UpdatePolicy = &policy
+	// Saving the policy gives a held update another go
+	if app.Update != nil {
+		update := *app.Update
+		update.Held = false
+		app.Update = &update
+	}
+	if err := lm.stateStore.UpdateApp(*app); err != nil {
+		return fmt.Errorf("failed to update app state: %w", err)
+	}
+
+	lm.logEvent("app.update_policy", appID, userID, map[string]interface{}{
+		"policy": policy,
+	})
+	return nil
+}
+
+// upgradeFiles holds the files an upgrade rewrites by path; nil marks a
+// file that didn't exist
+type upgradeFiles map[string]*savedFile
+
+type savedFile struct {
+	data []byte
+	mode os.FileMode
+}
+
+// saveUpgradeFiles reads the files an upgrade rewrites, so a rollback can
+// put them back
+func (lm *LifecycleManager) saveUpgradeFiles(appID string) (upgradeFiles, error) {
+	configDir := filepath.Join(lm.appsRoot, appID, "config")
+	name := fmt.Sprintf("app-%s.caddy", appID)
+
+	files := upgradeFiles{}
+	for _, path := range []string{
+		filepath.Join(configDir, "docker-compose.yml"),
+		filepath.Join(configDir, ManifestFile),
+		filepath.Join(lm.caddyPath, name),
+		filepath.Join(lm.sitesPath(), name),
+	} {
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			files[path] = nil
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to save %s: %w", path, err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to save %s: %w", path, err)
+		}
+		files[path] = &savedFile{data: data, mode: info.Mode().Perm()}
+	}
+	return files, nil
+}
+
+// restore puts the files back as they were saved
+func (files upgradeFiles) restore() error {
+	for path, f := range files {
+		if f == nil {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, f.data, f.mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// revertUpgrade puts an upgraded app back the way it was: its files, its
+// state and, from the pre-upgrade snapshot, its data
+func (u *Updater) revertUpgrade(ctx context.Context, prev *InstalledApp, files upgradeFiles, snapshotID string) error {
+	lm := u.lm
+	if err := files.restore(); err != nil {
+		return fmt.Errorf("failed to restore app files: %w", err)
+	}
+	if err := lm.reloadCaddy(); err != nil {
+		u.logger.Warn().Err(err).Str("app", prev.ID).Msg("Failed to reload Caddy")
+	}
+
+	app, err := lm.stateStore.GetApp(prev.ID)
+	if err != nil {
+		return fmt.Errorf("app not found: %w", err)
+	}
+	app.Version = prev.Version
+	app.Params = prev.Params
+	app.Mounts = prev.Mounts
+	app.Permissions = prev.Permissions
+	app.Expose = prev.Expose
+	app.URLs = prev.URLs
+	if err := lm.stateStore.UpdateApp(*app); err != nil {
+		return fmt.Errorf("failed to update app state: %w", err)
+	}
+
+	// Without a snapshot there was no data to take one of
+	if snapshotID == "" {
+		return lm.RestartApp(ctx, prev.ID, updaterUser)
+	}
+	return lm.RollbackApp(ctx, prev.ID, snapshotID, updaterUser)
+}
+
+// Available reports whether there is anything to update
+func (s *UpdateStatus) Available() bool {
+	return s != nil && (s.Version != "" || len(s.Images) > 0)
+}
+
+// key identifies an update, so it is announced and tried once
+func (s *UpdateStatus) key() string {
+	if s == nil {
+		return ""
+	}
+	parts := []string{s.Version}
+	for _, img := range s.Images {
+		parts = append(parts, img.Image+"@"+img.Available)
+	}
+	return strings.Join(parts, " ")
+}
+
+// effectivePolicy is the app's update policy with the defaults filled in
+func effectivePolicy(app *InstalledApp) UpdatePolicy {
+	policy := UpdatePolicy{Mode: UpdateNotify}
+	if app.UpdatePolicy != nil {
+		policy = *app.UpdatePolicy
+	}
+	if policy.Window == "" {
+		policy.Window = DefaultUpdateWindow
+	}
+	return policy
+}
+
+func (p UpdatePolicy) grace() time.Duration {
+	if p.GraceMinutes > 0 {
+		return time.Duration(p.GraceMinutes) * time.Minute
+	}
+	return DefaultUpdateGrace
+}
+
+func (p UpdatePolicy) validate() error {
+	switch p.Mode {
+	case UpdateNotify, UpdateAuto, UpdatePin:
+	default:
+		return fmt.Errorf("unknown update mode %q", p.Mode)
+	}
+	if p.Window != "" {
+		if _, _, err := parseWindow(p.Window); err != nil {
+			return err
+		}
+	}
+	if p.GraceMinutes < 0 || p.GraceMinutes > 24*60 {
+		return fmt.Errorf("grace period must be 0 to 1440 minutes")
+	}
+	return nil
+}
+
+// parseWindow parses an "HH:MM-HH:MM" window into minutes of the day
+func parseWindow(window string) (start, end int, err error) {
+	from, to, ok := strings.Cut(window, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("window %q isn't HH:MM-HH:MM", window)
+	}
+	if start, err = minuteOfDay(from); err != nil {
+		return 0, 0, err
+	}
+	if end, err = minuteOfDay(to); err != nil {
+		return 0, 0, err
+	}
+	if start == end {
+		return 0, 0, fmt.Errorf("window %q is empty", window)
+	}
+	return start, end, nil
+}
+
+func minuteOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// inWindow reports whether t falls in the window
+func inWindow(window string, t time.Time) (bool, error) {
+	start, end, err := parseWindow(window)
+	if err != nil {
+		return false, err
+	}
+	m := t.Hour()*60 + t.Minute()
+	if start < end {
+		return m >= start && m < end, nil
+	}
+	return m >= start || m < end, nil
+}
+
+// newerVersion reports whether the catalog's version is newer than the
+// installed one. Dotted numbers compare by number; anything else, like
+// "latest", is newer when it differs.
+func newerVersion(available, installed string) bool {
+	if available == "" || available == installed {
+		return false
+	}
+	a, okA := versionNumbers(available)
+	b, okB := versionNumbers(installed)
+	if !okA || !okB {
+		return true
+	}
+	for i := 0; i < max(len(a), len(b)); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			return x > y
+		}
+	}
+	return false
+}
+
+func versionNumbers(v string) ([]int, bool) {
+	parts := strings.Split(strings.TrimPrefix(v, "v"), ".")
+	nums := make([]int, len(parts))
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, false
+		}
+		nums[i] = n
+	}
+	return nums, true
+}
+
+// composeImages lists the images of a compose file's services, leaving
+// out those pinned by digest, which never change
+func composeImages(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read compose file: %w", err)
+	}
+	var compose struct {
+		Services map[string]struct {
+			Image string `yaml:"image"`
+		} `yaml:"services"`
+	}
+	if err := yaml.Unmarshal(data, &compose); err != nil {
+		return nil, fmt.Errorf("failed to parse compose file: %w", err)
+	}
+
+	seen := map[string]bool{}
+	var images []string
+	for _, svc := range compose.Services {
+		if svc.Image == "" || strings.Contains(svc.Image, "@") || seen[svc.Image] {
+			continue
+		}
+		seen[svc.Image] = true
+		images = append(images, svc.Image)
+	}
+	sort.Strings(images)
+	return images, nil
+}
+
+// dockerImages inspects images with the docker CLI
+type dockerImages struct{}
+
+func (dockerImages) LocalDigest(ctx context.Context, image string) (string, error) {
+	output, err := exec.CommandContext(ctx, "docker", "image", "inspect", "--format", "{{json .RepoDigests}}", image).Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect image %s: %w", image, err)
+	}
+	var digests []string
+	if err := json.Unmarshal(output, &digests); err != nil {
+		return "", fmt.Errorf("failed to parse digests of %s: %w", image, err)
+	}
+	for _, d := range digests {
+		if _, digest, ok := strings.Cut(d, "@"); ok {
+			return digest, nil
+		}
+	}
+	return "", nil
+}
+
+func (dockerImages) Retag(ctx context.Context, image, digest string) error {
+	source := imageRepository(image) + "@" + digest
+	if output, err := exec.CommandContext(ctx, "docker", "tag", source, image).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to tag %s as %s: %v: %s", source, image, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func (dockerImages) RemoteDigest(ctx context.Context, image string) (string, error) {
+	output, err := exec.CommandContext(ctx, "docker", "buildx", "imagetools", "inspect", "--format", "{{json .Manifest}}", image).Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to look up image %s in its registry: %w", image, err)
+	}
+	var manifest struct {
+		Digest string `json:"digest"`
+	}
+	if err := json.Unmarshal(output, &manifest); err != nil || manifest.Digest == "" {
+		return "", fmt.Errorf("failed to parse manifest of %s", image)
+	}
+	return manifest.Digest, nil
+}
+
+// imageRepository is image without its tag
+func imageRepository(image string) string {
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[:i]
+	}
+	return image
+}
@@ -0,0 +1,254 @@
+package apps
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+type fakeImages struct {
+	local, remote map[string]string
+}
+
+func (f *fakeImages) LocalDigest(ctx context.Context, image string) (string, error) {
+	return f.local[image], nil
+}
+
+func (f *fakeImages) RemoteDigest(ctx context.Context, image string) (string, error) {
+	d, ok := f.remote[image]
+	if !ok {
+		return "", errors.New("registry unreachable")
+	}
+	return d, nil
+}
+
+func (f *fakeImages) Retag(ctx context.Context, image, digest string) error {
+	f.local[image] = digest
+	return nil
+}
+
+type fakeHealth struct {
+	status string
+	checks int
+	clock  *time.Time
+}
+
+func (f *fakeHealth) ForceCheck(ctx context.Context, appID string) error {
+	f.checks++
+	*f.clock = f.clock.Add(time.Minute)
+	return nil
+}
+
+func (f *fakeHealth) GetHealth(appID string) (HealthStatus, bool) {
+	return HealthStatus{Status: f.status, Message: "container exited"}, true
+}
+
+type fakeUpdateNotifier struct {
+	available []string
+	finished  []*UpgradeAttempt
+}
+
+func (f *fakeUpdateNotifier) UpdateAvailable(app *InstalledApp, update *UpdateStatus) {
+	f.available = append(f.available, app.ID)
+}
+
+func (f *fakeUpdateNotifier) UpgradeFinished(app *InstalledApp, attempt *UpgradeAttempt) {
+	f.finished = append(f.finished, attempt)
+}
+
+// newTestUpdater has "notes" 1.0 installed against the catalog's 2.1,
+// running one image with a newer digest in the registry
+func newTestUpdater(t *testing.T) (*Updater, *fakeHealth, *fakeUpdateNotifier) {
+	t.Helper()
+	lm := newProxyLifecycle(t)
+	writeFile(t, filepath.Join(lm.appsRoot, "notes", "config", "docker-compose.yml"), `services:
+  app:
+    image: nginx:1.27
+  db:
+    image: postgres@sha256:0123
+`)
+	if err := lm.stateStore.AddApp(InstalledApp{ID: "notes", Name: "Notes", Version: "1.0", Status: StatusRunning}); err != nil {
+		t.Fatal(err)
+	}
+
+	clock := time.Date(2026, 10, 16, 3, 30, 0, 0, time.Local)
+	health := &fakeHealth{status: "healthy", clock: &clock}
+	notifier := &fakeUpdateNotifier{}
+	u := NewUpdater(lm, health, zerolog.Nop())
+	u.UseNotifier(notifier)
+	u.images = &fakeImages{
+		local:  map[string]string{"nginx:1.27": "sha256:old"},
+		remote: map[string]string{"nginx:1.27": "sha256:new"},
+	}
+	u.now = func() time.Time { return clock }
+	u.poll = 0
+	return u, health, notifier
+}
+
+func TestUpdateCheck(t *testing.T) {
+	u, _, notifier := newTestUpdater(t)
+	ctx := context.Background()
+
+	u.CheckAll(ctx)
+	app, _ := u.lm.stateStore.GetApp("notes")
+	if !app.Update.Available() || app.Update.Version != "2.1" || len(app.Update.Images) != 1 ||
+		app.Update.Images[0].Available != "sha256:new" || app.Update.Error != "" {
+		t.Fatalf("update %+v", app.Update)
+	}
+	// Each update is announced once
+	u.CheckAll(ctx)
+	if len(notifier.available) != 1 {
+		t.Fatalf("notified %d times", len(notifier.available))
+	}
+
+	// Pinned apps are checked, but not announced or upgraded
+	if err := u.lm.SetUpdatePolicy("notes", UpdatePolicy{Mode: UpdatePin}, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	u.images.(*fakeImages).remote["nginx:1.27"] = "sha256:newer"
+	u.CheckAll(ctx)
+	if app, _ := u.lm.stateStore.GetApp("notes"); len(notifier.available) != 1 || app.Update.Notified || u.due(app) {
+		t.Fatalf("pinned app notified or due: %+v", app.Update)
+	}
+
+	for _, bad := range []UpdatePolicy{{Mode: "sometimes"}, {Mode: UpdateAuto, Window: "3am"}, {Mode: UpdateAuto, GraceMinutes: -1}} {
+		if err := u.lm.SetUpdatePolicy("notes", bad, "admin"); err == nil {
+			t.Errorf("policy %+v accepted", bad)
+		}
+	}
+}
+
+func TestAutoUpgradeRollsBack(t *testing.T) {
+	u, health, notifier := newTestUpdater(t)
+	ctx := context.Background()
+	lm := u.lm
+	compose := filepath.Join(lm.appsRoot, "notes", "config", "docker-compose.yml")
+	site := filepath.Join(lm.sitesPath(), "app-notes.caddy")
+
+	images := u.images.(*fakeImages)
+	var upgraded, reverted int
+	var restartedOn string
+	u.upgrade = func(ctx context.Context, appID string, req UpgradeRequest, userID string) error {
+		upgraded++
+		// Pulling moves the tag to the new image
+		images.local["nginx:1.27"] = "sha256:new"
+		writeFile(t, compose, "services: {}\n")
+		writeFile(t, site, "notes.nas.lan {}\n")
+		app, _ := lm.stateStore.GetApp(appID)
+		app.Version = req.Version
+		app.Update = nil
+		app.Snapshots = append(app.Snapshots, AppSnapshot{ID: "20261016-033000-pre-upgrade", Name: "pre-upgrade", Timestamp: u.now()})
+		return lm.stateStore.UpdateApp(*app)
+	}
+	u.revert = func(ctx context.Context, prev *InstalledApp, files upgradeFiles, snapshotID string) error {
+		reverted++
+		restartedOn = images.local["nginx:1.27"]
+		if snapshotID != "20261016-033000-pre-upgrade" {
+			t.Errorf("rolled back to %q", snapshotID)
+		}
+		if err := files.restore(); err != nil {
+			return err
+		}
+		app, _ := lm.stateStore.GetApp(prev.ID)
+		app.Version = prev.Version
+		return lm.stateStore.UpdateApp(*app)
+	}
+
+	if err := lm.SetUpdatePolicy("notes", UpdatePolicy{Mode: UpdateAuto, Window: "02:00-04:00", GraceMinutes: 5}, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	health.status = "unhealthy"
+	u.run(ctx)
+
+	app, _ := lm.stateStore.GetApp("notes")
+	if upgraded != 1 || reverted != 1 || app.Version != "1.0" {
+		t.Fatalf("upgraded %d, reverted %d, version %s", upgraded, reverted, app.Version)
+	}
+	// The compose file names the same tag before and after, so the app
+	// only runs the old image again if the tag points back at it
+	if restartedOn != "sha256:old" {
+		t.Fatalf("app restarted on %q after rollback", restartedOn)
+	}
+	if data, _ := os.ReadFile(compose); string(data) == "services: {}\n" {
+		t.Fatal("compose file not restored")
+	}
+	if _, err := os.Stat(site); !os.IsNotExist(err) {
+		t.Fatal("site added by the upgrade not removed")
+	}
+	last := app.Update.LastUpgrade
+	if last == nil || last.Result != UpgradeRolledBack || last.ToVersion != "2.1" || !app.Update.Held ||
+		len(notifier.finished) != 1 || notifier.finished[0] != last {
+		t.Fatalf("update %+v, attempt %+v", app.Update, last)
+	}
+
+	// A held update isn't tried again, not even after the next check
+	u.lastCheck = time.Time{}
+	u.run(ctx)
+	if upgraded != 1 {
+		t.Fatal("held update retried")
+	}
+
+	// Saving the policy retries it; healthy through the grace period, it sticks
+	if err := lm.SetUpdatePolicy("notes", UpdatePolicy{Mode: UpdateAuto, Window: "02:00-04:00", GraceMinutes: 5}, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	health.status, health.checks = "healthy", 0
+	u.run(ctx)
+	app, _ = lm.stateStore.GetApp("notes")
+	if upgraded != 2 || reverted != 1 || app.Version != "2.1" || app.Update.LastUpgrade.Result != UpgradeSucceeded {
+		t.Fatalf("upgraded %d, reverted %d, update %+v", upgraded, reverted, app.Update)
+	}
+	if images.local["nginx:1.27"] != "sha256:new" {
+		t.Fatalf("running %q after a successful upgrade", images.local["nginx:1.27"])
+	}
+	if health.checks < 5 {
+		t.Fatalf("health checked %d times in the grace period", health.checks)
+	}
+}
+
+func TestUpdateWindow(t *testing.T) {
+	at := func(hhmm string) time.Time {
+		tm, _ := time.Parse("15:04", hhmm)
+		return tm
+	}
+	for _, tc := range []struct {
+		window, at string
+		open       bool
+	}{
+		{"03:00-05:00", "03:00", true},
+		{"03:00-05:00", "05:00", false},
+		{"03:00-05:00", "12:00", false},
+		{"23:00-01:30", "23:59", true},
+		{"23:00-01:30", "01:00", true},
+		{"23:00-01:30", "02:00", false},
+	} {
+		open, err := inWindow(tc.window, at(tc.at))
+		if err != nil || open != tc.open {
+			t.Errorf("%s at %s: %v, %v", tc.window, tc.at, open, err)
+		}
+	}
+	if _, err := inWindow("04:00-04:00", at("04:00")); err == nil {
+		t.Error("empty window accepted")
+	}
+
+	for _, tc := range []struct {
+		available, installed string
+		newer                bool
+	}{
+		{"2.1", "1.0", true},
+		{"1.10", "1.9", true},
+		{"1.9", "1.10", false},
+		{"v2.0", "2", false},
+		{"latest", "1.0", true},
+		{"1.0", "1.0", false},
+	} {
+		if got := newerVersion(tc.available, tc.installed); got != tc.newer {
+			t.Errorf("newerVersion(%q, %q) = %v", tc.available, tc.installed, got)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"gopkg.in/yaml.v3"
 )
@@ -24,6 +25,9 @@ type Manifest struct {
 	
 	// WebUI defines web UI configuration
 	WebUI *WebUIConfig `yaml:"webui,omitempty" json:"webui,omitempty"`
+	
+	// OIDC declares that the app signs users in with NithronOS
+	OIDC *OIDCConfig `yaml:"oidc,omitempty" json:"oidc,omitempty"`
 }
 
 // AppMeta contains app metadata
@@ -155,7 +159,8 @@ type BackupConfig struct {
 	BackupSize string `yaml:"backup_size,omitempty" json:"backup_size,omitempty"` // e.g., "100MB", "5GB"
 }
 
-// QuiesceHooks defines hooks for quiescing the app
+// QuiesceHooks defines hooks for quiescing the app. Hooks are docker
+// compose commands run against the app's project; see ParseQuiesceHook.
 type QuiesceHooks struct {
 	PreBackup  string `yaml:"pre_backup,omitempty" json:"pre_backup,omitempty"`   // Command to run before backup
 	PostBackup string `yaml:"post_backup,omitempty" json:"post_backup,omitempty"` // Command to run after backup
@@ -170,6 +175,13 @@ type WebUIConfig struct {
 	// Port defines the internal port to proxy to
 	Port int `yaml:"port" json:"port"`
 	
+	// Service is the compose service serving the UI (default "app")
+	Service string `yaml:"service,omitempty" json:"service,omitempty"`
+	
+	// Expose is how the UI is reached by default: path, subdomain or port.
+	// Apps that break under a path prefix should ask for subdomain.
+	Expose string `yaml:"expose,omitempty" json:"expose,omitempty"`
+	
 	// AuthMode defines authentication mode
 	AuthMode string `yaml:"auth_mode,omitempty" json:"auth_mode,omitempty"` // none, inherit, custom
 	
@@ -180,6 +192,16 @@ type WebUIConfig struct {
 	Headers map[string]string `yaml:"headers,omitempty" json:"headers,omitempty"`
 }
 
+// OIDCConfig defines the app's OpenID Connect client. NithronOS registers
+// it at install and passes its credentials in the app's .env file.
+type OIDCConfig struct {
+	// RedirectPaths are the app's callback paths, under its URL
+	RedirectPaths []string `yaml:"redirect_paths" json:"redirect_paths"` // e.g., "/auth/callback"
+	
+	// Scopes are the scopes the app may ask for besides openid
+	Scopes []string `yaml:"scopes,omitempty" json:"scopes,omitempty"` // profile, email, groups
+}
+
 // Hooks defines lifecycle hooks
 type Hooks struct {
 	PreInstall   *Hook `yaml:"pre_install,omitempty" json:"pre_install,omitempty"`
@@ -293,8 +315,14 @@ func (m *Manifest) Validate() error {
 	
 	// Validate WebUI if present
 	if m.WebUI != nil {
-		if m.WebUI.Path == "" {
-			return fmt.Errorf("webui.path is required")
+		switch m.WebUI.Expose {
+		case "", "path":
+			if m.WebUI.Path == "" {
+				return fmt.Errorf("webui.path is required")
+			}
+		case "subdomain", "port":
+		default:
+			return fmt.Errorf("invalid webui.expose: %s", m.WebUI.Expose)
 		}
 		if m.WebUI.Port <= 0 || m.WebUI.Port > 65535 {
 			return fmt.Errorf("invalid webui.port: %d", m.WebUI.Port)
@@ -307,6 +335,38 @@ func (m *Manifest) Validate() error {
 		}
 	}
 	
+	// Validate quiesce hooks if present
+	if hooks := m.Backup.QuiesceHooks; hooks != nil {
+		for _, hook := range []string{hooks.PreBackup, hooks.PostBackup} {
+			if hook == "" {
+				continue
+			}
+			if _, err := ParseQuiesceHook(hook); err != nil {
+				return fmt.Errorf("invalid quiesce hook: %w", err)
+			}
+		}
+		if hooks.Timeout < 0 {
+			return fmt.Errorf("invalid quiesce hook timeout: %d", hooks.Timeout)
+		}
+	}
+
+	// Validate OIDC if present
+	if m.OIDC != nil {
+		if len(m.OIDC.RedirectPaths) == 0 {
+			return fmt.Errorf("oidc.redirect_paths is required")
+		}
+		for _, p := range m.OIDC.RedirectPaths {
+			if !strings.HasPrefix(p, "/") || strings.HasPrefix(p, "//") {
+				return fmt.Errorf("invalid oidc redirect path: %s", p)
+			}
+		}
+		for _, scope := range m.OIDC.Scopes {
+			if scope != "openid" && scope != "profile" && scope != "email" && scope != "groups" {
+				return fmt.Errorf("invalid oidc scope: %s", scope)
+			}
+		}
+	}
+	
 	return nil
 }
 
@@ -0,0 +1,207 @@
+package appsdk
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Quiesce hooks come from app catalogs, so they never reach a shell on
+// the host. A hook is one or more docker compose commands joined by &&,
+// and each runs against the app's own compose project:
+//
+//	docker compose exec [-T] [-u USER] [-w DIR] [-e NAME=VALUE] SERVICE COMMAND...
+//	docker compose pause [SERVICE...]
+//	docker compose unpause [SERVICE...]
+//
+// Words may be quoted as in sh. A shell is still available inside a
+// container with exec SERVICE sh -c '...'.
+
+// ComposeCommand is one step of a quiesce hook
+type ComposeCommand struct {
+	Action   string   `json:"action"` // exec, pause or unpause
+	Service  string   `json:"service,omitempty"`
+	User     string   `json:"user,omitempty"`
+	Workdir  string   `json:"workdir,omitempty"`
+	Env      []string `json:"env,omitempty"`
+	Services []string `json:"services,omitempty"`
+	Command  []string `json:"command,omitempty"`
+}
+
+var (
+	composeServicePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+	composeUserPattern    = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*(:[A-Za-z0-9_][A-Za-z0-9_.-]*)?$`)
+	envNamePattern        = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// ParseQuiesceHook parses a quiesce hook into the compose commands it runs
+func ParseQuiesceHook(hook string) ([]ComposeCommand, error) {
+	commands, err := splitHookWords(hook)
+	if err != nil {
+		return nil, err
+	}
+	var out []ComposeCommand
+	for _, words := range commands {
+		cmd, err := parseComposeCommand(words)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, cmd)
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("empty hook")
+	}
+	return out, nil
+}
+
+func parseComposeCommand(words []string) (ComposeCommand, error) {
+	if len(words) < 3 || words[0] != "docker" || words[1] != "compose" {
+		return ComposeCommand{}, fmt.Errorf("hook commands must be docker compose exec, pause or unpause: %q", strings.Join(words, " "))
+	}
+	cmd := ComposeCommand{Action: words[2]}
+	args := words[3:]
+	switch cmd.Action {
+	case "pause", "unpause":
+		for _, service := range args {
+			if !composeServicePattern.MatchString(service) {
+				return ComposeCommand{}, fmt.Errorf("invalid service %q", service)
+			}
+		}
+		cmd.Services = args
+		return cmd, nil
+	case "exec":
+	default:
+		return ComposeCommand{}, fmt.Errorf("unsupported docker compose command %q", cmd.Action)
+	}
+
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		flag, value, hasValue := strings.Cut(args[0], "=")
+		args = args[1:]
+		if flag == "-T" || flag == "--no-TTY" {
+			if hasValue {
+				return ComposeCommand{}, fmt.Errorf("invalid flag %q", flag+"="+value)
+			}
+			continue
+		}
+		if !hasValue {
+			if len(args) == 0 {
+				return ComposeCommand{}, fmt.Errorf("flag %s needs a value", flag)
+			}
+			value, args = args[0], args[1:]
+		}
+		switch flag {
+		case "-u", "--user":
+			if !composeUserPattern.MatchString(value) {
+				return ComposeCommand{}, fmt.Errorf("invalid user %q", value)
+			}
+			cmd.User = value
+		case "-w", "--workdir":
+			if !path.IsAbs(value) || path.Clean(value) != value {
+				return ComposeCommand{}, fmt.Errorf("invalid workdir %q", value)
+			}
+			cmd.Workdir = value
+		case "-e", "--env":
+			if !ValidHookEnv(value) {
+				return ComposeCommand{}, fmt.Errorf("invalid environment variable %q", value)
+			}
+			cmd.Env = append(cmd.Env, value)
+		default:
+			return ComposeCommand{}, fmt.Errorf("unsupported docker compose exec flag %q", flag)
+		}
+	}
+	if len(args) < 2 {
+		return ComposeCommand{}, fmt.Errorf("docker compose exec needs a service and a command")
+	}
+	if !composeServicePattern.MatchString(args[0]) {
+		return ComposeCommand{}, fmt.Errorf("invalid service %q", args[0])
+	}
+	cmd.Service, cmd.Command = args[0], args[1:]
+	return cmd, nil
+}
+
+// ValidHookEnv accepts NAME=value with a shell variable name and a
+// single line value
+func ValidHookEnv(kv string) bool {
+	name, value, ok := strings.Cut(kv, "=")
+	return ok && envNamePattern.MatchString(name) && !strings.ContainsAny(value, "\n\r\x00")
+}
+
+// splitHookWords splits a hook into the words of each command the way sh
+// would, refusing anything that needs a shell to mean what it says:
+// expansions, redirections, pipes and any separator but &&
+func splitHookWords(hook string) ([][]string, error) {
+	var (
+		commands [][]string
+		words    []string
+		word     strings.Builder
+		inWord   bool
+	)
+	endWord := func() {
+		if inWord {
+			words = append(words, word.String())
+			word.Reset()
+			inWord = false
+		}
+	}
+	for i := 0; i < len(hook); i++ {
+		c := hook[i]
+		switch {
+		case c == ' ' || c == '\t':
+			endWord()
+		case c == '\'':
+			end := strings.IndexByte(hook[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quote")
+			}
+			word.WriteString(hook[i+1 : i+1+end])
+			inWord = true
+			i += end + 1
+		case c == '"':
+			i++
+			for ; i < len(hook) && hook[i] != '"'; i++ {
+				switch hook[i] {
+				case '$', '`':
+					return nil, fmt.Errorf("hooks cannot expand %q", hook[i])
+				case '\\':
+					if i+1 < len(hook) && strings.IndexByte("\"\\$`", hook[i+1]) >= 0 {
+						i++
+					}
+				}
+				word.WriteByte(hook[i])
+			}
+			if i == len(hook) {
+				return nil, fmt.Errorf("unterminated quote")
+			}
+			inWord = true
+		case c == '\\':
+			if i+1 == len(hook) || hook[i+1] == '\n' {
+				return nil, fmt.Errorf("hooks are a single line")
+			}
+			i++
+			word.WriteByte(hook[i])
+			inWord = true
+		case c == '&' && i+1 < len(hook) && hook[i+1] == '&':
+			endWord()
+			if len(words) == 0 {
+				return nil, fmt.Errorf("empty command before &&")
+			}
+			commands = append(commands, words)
+			words = nil
+			i++
+		case strings.IndexByte(";|&<>()$`#*?[]{}~\n\r\x00", c) >= 0:
+			return nil, fmt.Errorf("hooks do not run in a shell; %q must be quoted", c)
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	endWord()
+	if len(words) == 0 && len(commands) > 0 {
+		return nil, fmt.Errorf("empty command after &&")
+	}
+	if len(words) > 0 {
+		commands = append(commands, words)
+	}
+	return commands, nil
+}
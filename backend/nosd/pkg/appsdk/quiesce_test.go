@@ -0,0 +1,58 @@
+package appsdk
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseQuiesceHook(t *testing.T) {
+	got, err := ParseQuiesceHook(`docker compose exec -T -u www-data app php occ maintenance:mode --on && ` +
+		`docker compose exec -T --env=PGOPTIONS=-c\ x -w /tmp db sh -c 'pg_dump -U "$POSTGRES_USER"' && ` +
+		`docker compose pause worker "redis"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ComposeCommand{
+		{Action: "exec", Service: "app", User: "www-data", Command: []string{"php", "occ", "maintenance:mode", "--on"}},
+		{Action: "exec", Service: "db", Workdir: "/tmp", Env: []string{"PGOPTIONS=-c x"}, Command: []string{"sh", "-c", `pg_dump -U "$POSTGRES_USER"`}},
+		{Action: "pause", Services: []string{"worker", "redis"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("parsed %+v\nwant %+v", got, want)
+	}
+
+	if got, err := ParseQuiesceHook("docker compose unpause"); err != nil || len(got) != 1 || got[0].Action != "unpause" {
+		t.Fatalf("unpause: %+v %v", got, err)
+	}
+}
+
+func TestParseQuiesceHookRefusesShell(t *testing.T) {
+	for _, hook := range []string{
+		"",
+		"rm -rf /",
+		"docker run --privileged -v /:/host alpine",
+		"docker compose up -d",
+		"docker compose exec app",
+		"docker compose exec --privileged app sh",
+		"docker compose exec -u root:0; id app sh",
+		"docker compose exec app sh; id",
+		"docker compose exec app sh | sh",
+		"docker compose exec app sh > /etc/passwd",
+		"docker compose exec app echo $(id)",
+		"docker compose exec app echo `id`",
+		`docker compose exec app echo "$HOME"`,
+		"docker compose exec app sh &",
+		"docker compose pause && ",
+		"&& docker compose pause",
+		"docker compose pause ../x",
+		"docker compose exec -w tmp app sh",
+		"docker compose exec -e 1X=y app sh",
+		"docker compose exec app 'sh",
+		"docker compose exec app sh\ndocker compose pause",
+		"docker compose exec app ls *",
+	} {
+		if cmds, err := ParseQuiesceHook(hook); err == nil {
+			t.Errorf("accepted %q as %+v", hook, cmds)
+		}
+	}
+}
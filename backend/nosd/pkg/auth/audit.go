@@ -25,8 +25,23 @@ type AuditLogger struct {
 	currentDate string
 }
 
-// NewAuditLogger creates a new audit logger
+// Loggers sharing a directory would interleave writes to the same daily
+// files and each cache different recent events, so there is one per
+// directory
+var (
+	auditLoggers   = map[string]*AuditLogger{}
+	auditLoggersMu sync.Mutex
+)
+
+// NewAuditLogger returns the audit logger writing to dataPath, creating it
+// the first time
 func NewAuditLogger(logger zerolog.Logger, dataPath string) *AuditLogger {
+	auditLoggersMu.Lock()
+	defer auditLoggersMu.Unlock()
+	if al, ok := auditLoggers[filepath.Clean(dataPath)]; ok {
+		return al
+	}
+	
 	al := &AuditLogger{
 		logger:   logger.With().Str("component", "audit").Logger(),
 		dataPath: dataPath,
@@ -42,6 +57,7 @@ func NewAuditLogger(logger zerolog.Logger, dataPath string) *AuditLogger {
 	// Start rotation routine
 	go al.rotationRoutine()
 	
+	auditLoggers[filepath.Clean(dataPath)] = al
 	return al
 }
 
@@ -360,6 +376,11 @@ func (al *AuditLogger) matchesQuery(event AuditEvent, query AuditLogQuery) bool
 		return false
 	}
 	
+	// Target filter
+	if query.Target != "" && event.Target != query.Target {
+		return false
+	}
+	
 	// Time filter
 	if !query.From.IsZero() && event.Timestamp.Before(query.From) {
 		return false
@@ -373,9 +394,11 @@ func (al *AuditLogger) matchesQuery(event AuditEvent, query AuditLogQuery) bool
 
 func (al *AuditLogger) getAllEvents(from, to time.Time) []AuditEvent {
 	events := []AuditEvent{}
+	seen := map[string]bool{}
 	
 	// Add events from memory
 	for _, event := range al.events {
+		seen[event.ID] = true
 		if (from.IsZero() || event.Timestamp.After(from)) &&
 		   (to.IsZero() || event.Timestamp.Before(to)) {
 			events = append(events, event)
@@ -404,6 +427,10 @@ func (al *AuditLogger) getAllEvents(from, to time.Time) []AuditEvent {
 			
 			fileEvents := al.loadEventsFromFile(file)
 			for _, event := range fileEvents {
+				// Recent events are also held in memory
+				if seen[event.ID] {
+					continue
+				}
 				if (from.IsZero() || event.Timestamp.After(from)) &&
 				   (to.IsZero() || event.Timestamp.Before(to)) {
 					events = append(events, event)
@@ -105,7 +105,7 @@ type AuditEvent struct {
 	
 	// Event
 	Code        string                 `json:"code"` // e.g., "auth.login"
-	Category    string                 `json:"category"` // auth, user, password, session, acl
+	Category    string                 `json:"category"` // auth, user, password, session, acl, sharelink
 	Severity    string                 `json:"severity"` // info, warning, critical
 	Success     bool                   `json:"success"`
 	
@@ -224,6 +224,7 @@ type AuditLogQuery struct {
 	IP       string    `json:"ip,omitempty"`
 	Code     string    `json:"code,omitempty"`
 	Category string    `json:"category,omitempty"`
+	Target   string    `json:"target,omitempty"`
 	From     time.Time `json:"from,omitempty"`
 	To       time.Time `json:"to,omitempty"`
 	Limit    int       `json:"limit,omitempty"`
@@ -267,6 +268,15 @@ const (
 	AuditACLDenied          = "acl.denied"
 	AuditACLGrant           = "acl.grant"
 	AuditACLRevoke          = "acl.revoke"
+	
+	// Public share link events
+	AuditShareLinkCreate    = "sharelink.create"
+	AuditShareLinkDelete    = "sharelink.delete"
+	AuditShareLinkView      = "sharelink.view"
+	AuditShareLinkUnlock    = "sharelink.unlock"
+	AuditShareLinkDownload  = "sharelink.download"
+	AuditShareLinkUpload    = "sharelink.upload"
+	AuditShareLinkDenied    = "sharelink.denied"
 )
 
 // GetRolePermissions returns permissions for a role
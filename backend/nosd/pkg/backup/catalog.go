@@ -0,0 +1,418 @@
+package backup
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Backup catalog. Every restore point that can be opened as a file system
+// (local snapshots and repository snapshots) gets an index of its paths,
+// sizes and modification times. The index is built the first time the point
+// is browsed, or explicitly, and kept as gzipped JSON in the catalog
+// directory so searches don't have to open the points again.
+
+// PointRef identifies a restore point
+type PointRef struct {
+	Type          string `json:"type"` // "local" or "repo"
+	ID            string `json:"id"`
+	DestinationID string `json:"destination_id,omitempty"` // for repository points
+}
+
+// CatalogEntry is a file or directory of a restore point
+type CatalogEntry struct {
+	Path    string    `json:"path"` // slash separated, relative to the point's root
+	Type    string    `json:"type"` // "file", "dir", "symlink" or "other"
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+}
+
+// CatalogIndex is the index of one restore point
+type CatalogIndex struct {
+	Point     PointRef       `json:"point"`
+	Subvolume string         `json:"subvolume"`
+	Timestamp time.Time      `json:"timestamp"`
+	IndexedAt time.Time      `json:"indexed_at"`
+	Files     int            `json:"files"`
+	Bytes     int64          `json:"bytes"`
+	Entries   []CatalogEntry `json:"entries"`
+}
+
+// CatalogMatch is a search hit
+type CatalogMatch struct {
+	Point     PointRef     `json:"point"`
+	Subvolume string       `json:"subvolume"`
+	Timestamp time.Time    `json:"timestamp"`
+	Entry     CatalogEntry `json:"entry"`
+}
+
+// CatalogSearchResult holds the hits of a search, newest restore point
+// first
+type CatalogSearchResult struct {
+	Matches   []CatalogMatch `json:"matches"`
+	Truncated bool           `json:"truncated"`
+	// Points is the number of indexed restore points searched
+	Points int `json:"points"`
+}
+
+// Catalog stores restore point indexes
+type Catalog struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// NewCatalog creates a catalog keeping its indexes in dir
+func NewCatalog(dir string) *Catalog {
+	return &Catalog{dir: dir}
+}
+
+// UseCatalog enables browsing and searching restore points
+func (r *Restorer) UseCatalog(catalog *Catalog) {
+	r.catalog = catalog
+}
+
+func (c *Catalog) file(ref PointRef) string {
+	name := ref.Type + "-" + ref.ID
+	if ref.DestinationID != "" {
+		name = ref.Type + "-" + ref.DestinationID + "-" + ref.ID
+	}
+	return filepath.Join(c.dir, strings.NewReplacer("/", "_", "\\", "_").Replace(name)+".json.gz")
+}
+
+func (c *Catalog) load(ref PointRef) (*CatalogIndex, error) {
+	return c.loadFile(c.file(ref))
+}
+
+func (c *Catalog) loadFile(name string) (*CatalogIndex, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	var index CatalogIndex
+	if err := json.NewDecoder(zr).Decode(&index); err != nil {
+		return nil, err
+	}
+	return &index, nil
+}
+
+func (c *Catalog) save(index *CatalogIndex) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return err
+	}
+	name := c.file(index.Point)
+	tmp := name + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(f)
+	err = json.NewEncoder(zw).Encode(index)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+func (c *Catalog) remove(ref PointRef) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_ = os.Remove(c.file(ref))
+}
+
+// children lists the entries directly inside dir
+func (index *CatalogIndex) children(dir string) ([]CatalogEntry, error) {
+	if dir != "." {
+		i := sort.Search(len(index.Entries), func(i int) bool { return index.Entries[i].Path >= dir })
+		if i == len(index.Entries) || index.Entries[i].Path != dir {
+			return nil, fmt.Errorf("path not found: %s", dir)
+		}
+		if index.Entries[i].Type != "dir" {
+			return nil, fmt.Errorf("not a directory: %s", dir)
+		}
+	}
+	entries := []CatalogEntry{}
+	for _, entry := range index.Entries {
+		if path.Dir(entry.Path) == dir {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// pointFS opens a restore point as a read-only file system. root is the
+// directory the file system is served from when it is on local disk.
+func (r *Restorer) pointFS(ctx context.Context, ref PointRef, jobID string) (fsys fs.FS, root string, meta *CatalogIndex, closer func(), err error) {
+	switch ref.Type {
+	case "local":
+		snap, err := r.scheduler.GetSnapshot(ref.ID)
+		if err != nil {
+			return nil, "", nil, nil, err
+		}
+		mountPoint, unmount, err := r.mountSnapshot(jobID, snap.Path)
+		if err != nil {
+			return nil, "", nil, nil, err
+		}
+		return os.DirFS(mountPoint), mountPoint, &CatalogIndex{Point: ref, Subvolume: snap.Subvolume, Timestamp: snap.CreatedAt}, unmount, nil
+
+	case "repo":
+		if ref.DestinationID == "" {
+			return nil, "", nil, nil, fmt.Errorf("destination_id is required for repository restore points")
+		}
+		fsys, snap, err := r.replicator.RepositoryFS(ctx, ref.DestinationID, ref.ID)
+		if err != nil {
+			return nil, "", nil, nil, err
+		}
+		return fsys, "", &CatalogIndex{Point: ref, Subvolume: snap.Source, Timestamp: snap.Time}, func() {}, nil
+
+	default:
+		// btrfs streams have to be received before anything inside them
+		// can be read
+		return nil, "", nil, nil, fmt.Errorf("restore points of type %s can't be browsed, restore the snapshot instead", ref.Type)
+	}
+}
+
+// buildIndex walks a restore point and stores its index
+func (r *Restorer) buildIndex(ctx context.Context, ref PointRef, jobID string, warn func(path string, err error)) (*CatalogIndex, error) {
+	if r.catalog == nil {
+		return nil, fmt.Errorf("backup catalog is not enabled")
+	}
+	fsys, _, index, closer, err := r.pointFS(ctx, ref, jobID)
+	if err != nil {
+		return nil, err
+	}
+	defer closer()
+
+	index.Entries = []CatalogEntry{}
+	err = fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			if name == "." {
+				return err
+			}
+			warn(name, err)
+			if d != nil && d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if name == "." {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			warn(name, err)
+			return nil
+		}
+		entry := CatalogEntry{Path: name, Type: entryType(info.Mode()), ModTime: info.ModTime()}
+		if entry.Type == "file" {
+			entry.Size = info.Size()
+			index.Files++
+			index.Bytes += entry.Size
+		}
+		index.Entries = append(index.Entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// WalkDir visits in lexical order per directory; children needs the
+	// entries sorted by full path
+	sort.Slice(index.Entries, func(i, j int) bool { return index.Entries[i].Path < index.Entries[j].Path })
+	index.IndexedAt = time.Now()
+
+	if err := r.catalog.save(index); err != nil {
+		return nil, fmt.Errorf("failed to save catalog: %w", err)
+	}
+	return index, nil
+}
+
+// catalogIndex returns the index of a restore point, building it if needed
+func (r *Restorer) catalogIndex(ctx context.Context, ref PointRef) (*CatalogIndex, error) {
+	if r.catalog == nil {
+		return nil, fmt.Errorf("backup catalog is not enabled")
+	}
+	if index, err := r.catalog.load(ref); err == nil {
+		return index, nil
+	}
+	return r.buildIndex(ctx, ref, uuid.New().String(), func(string, error) {})
+}
+
+// IndexRestorePoint (re)builds the catalog index of a restore point in the
+// background
+func (r *Restorer) IndexRestorePoint(ref PointRef) (*BackupJob, error) {
+	if r.catalog == nil {
+		return nil, fmt.Errorf("backup catalog is not enabled")
+	}
+	if ref.Type != "local" && ref.Type != "repo" {
+		return nil, fmt.Errorf("restore points of type %s can't be indexed", ref.Type)
+	}
+
+	job := &BackupJob{
+		ID:            uuid.New().String(),
+		Type:          "index",
+		State:         JobStateRunning,
+		SourceType:    ref.Type,
+		SnapshotID:    ref.ID,
+		DestinationID: ref.DestinationID,
+		StartedAt:     time.Now(),
+	}
+	r.jobManager.AddJob(job)
+
+	go func() {
+		index, err := r.buildIndex(context.Background(), ref, job.ID, func(path string, err error) {
+			r.jobManager.AddLogEntry(job.ID, "warn", fmt.Sprintf("Skipped %s: %v", path, err))
+		})
+		now := time.Now()
+		job.FinishedAt = &now
+		if err != nil {
+			job.State = JobStateFailed
+			job.Error = err.Error()
+			r.jobManager.AddLogEntry(job.ID, "error", job.Error)
+			r.jobManager.UpdateJob(job)
+			return
+		}
+		job.State = JobStateSucceeded
+		job.Progress = 100
+		r.jobManager.AddLogEntry(job.ID, "info", fmt.Sprintf("Indexed %d entries, %d files, %d bytes", len(index.Entries), index.Files, index.Bytes))
+		r.jobManager.UpdateJob(job)
+	}()
+	return job, nil
+}
+
+// BrowseRestorePoint lists a directory of a restore point. The point is
+// indexed on first use.
+func (r *Restorer) BrowseRestorePoint(ctx context.Context, ref PointRef, dir string) ([]CatalogEntry, error) {
+	dir, err := cleanRestorePath(dir)
+	if err != nil {
+		return nil, err
+	}
+	index, err := r.catalogIndex(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	return index.children(dir)
+}
+
+// SearchCatalog finds files and directories whose name contains query
+// across all indexed restore points; a query with wildcards is matched as
+// a glob against the name. Local snapshots deleted since they were indexed
+// are dropped from the catalog.
+func (r *Restorer) SearchCatalog(query string, limit int) (*CatalogSearchResult, error) {
+	if r.catalog == nil {
+		return nil, fmt.Errorf("backup catalog is not enabled")
+	}
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return nil, fmt.Errorf("search query is required")
+	}
+	if limit <= 0 {
+		limit = 100
+	}
+	glob := strings.ContainsAny(query, "*?[")
+	if glob {
+		if _, err := path.Match(query, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern: %w", err)
+		}
+	}
+	lower := strings.ToLower(query)
+
+	files, _ := filepath.Glob(filepath.Join(r.catalog.dir, "*.json.gz"))
+	var indexes []*CatalogIndex
+	for _, name := range files {
+		index, err := r.catalog.loadFile(name)
+		if err != nil {
+			r.logger.Warn().Err(err).Str("file", name).Msg("Failed to load catalog index")
+			continue
+		}
+		if index.Point.Type == "local" {
+			if _, err := r.scheduler.GetSnapshot(index.Point.ID); err != nil {
+				r.catalog.remove(index.Point)
+				continue
+			}
+		}
+		indexes = append(indexes, index)
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i].Timestamp.After(indexes[j].Timestamp) })
+
+	result := &CatalogSearchResult{Matches: []CatalogMatch{}, Points: len(indexes)}
+	for _, index := range indexes {
+		for _, entry := range index.Entries {
+			name := path.Base(entry.Path)
+			var ok bool
+			if glob {
+				ok, _ = path.Match(query, name)
+			} else {
+				ok = strings.Contains(strings.ToLower(name), lower)
+			}
+			if !ok {
+				continue
+			}
+			if len(result.Matches) == limit {
+				result.Truncated = true
+				return result, nil
+			}
+			result.Matches = append(result.Matches, CatalogMatch{
+				Point:     index.Point,
+				Subvolume: index.Subvolume,
+				Timestamp: index.Timestamp,
+				Entry:     entry,
+			})
+		}
+	}
+	return result, nil
+}
+
+func entryType(mode fs.FileMode) string {
+	switch {
+	case mode.IsRegular():
+		return "file"
+	case mode.IsDir():
+		return "dir"
+	case mode&fs.ModeSymlink != 0:
+		return "symlink"
+	default:
+		return "other"
+	}
+}
+
+// cleanRestorePath turns a path inside a restore point into the slash
+// separated, relative form the catalog uses
+func cleanRestorePath(p string) (string, error) {
+	p = path.Clean("/" + strings.ReplaceAll(p, "\\", "/"))
+	p = strings.TrimPrefix(p, "/")
+	if p == "" {
+		p = "."
+	}
+	if !fs.ValidPath(p) {
+		return "", fmt.Errorf("invalid path: %s", p)
+	}
+	return p, nil
+}
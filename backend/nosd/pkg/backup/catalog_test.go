@@ -0,0 +1,225 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"nithronos/backend/nosd/pkg/backup/repo"
+)
+
+// newCatalogRestorer returns a restorer whose local snapshot "snap" of the
+// subvolume target mounts as a small tree
+func newCatalogRestorer(t *testing.T, target string) (*Restorer, *Scheduler) {
+	t.Helper()
+	src := t.TempDir()
+	for name, content := range map[string]string{
+		"docs/report.pdf":   "quarterly numbers",
+		"docs/notes.txt":    "remember the milk",
+		"photos/2024/a.jpg": "jpeg",
+	} {
+		p := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("docs", filepath.Join(src, "latest")); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	s := NewScheduler(zerolog.Nop(), filepath.Join(dir, "schedules.json"), &fakeSnapshotAgent{})
+	s.snapshots[target] = []*Snapshot{{ID: "snap", Subvolume: target, Path: "@snapshots/data/snap", CreatedAt: time.Now()}}
+	jm := NewJobManager(zerolog.Nop())
+	rp := NewReplicator(zerolog.Nop(), filepath.Join(dir, "destinations.json"), filepath.Join(dir, "keys"), jm)
+	if err := rp.Start(); err != nil {
+		t.Fatal(err)
+	}
+	r := NewRestorer(zerolog.Nop(), &fakeSnapshotAgent{}, jm, s, rp)
+	r.UseCatalog(NewCatalog(filepath.Join(dir, "catalog")))
+	r.mount = func(jobID string, snapshotPath string) (string, func(), error) {
+		return src, func() {}, nil
+	}
+	return r, s
+}
+
+func entryPaths(entries []CatalogEntry) string {
+	var paths []string
+	for _, e := range entries {
+		paths = append(paths, e.Path)
+	}
+	return strings.Join(paths, ",")
+}
+
+func TestCatalogBrowseAndSearch(t *testing.T) {
+	r, s := newCatalogRestorer(t, "/srv/data")
+	ctx := context.Background()
+	point := PointRef{Type: "local", ID: "snap"}
+
+	entries, err := r.BrowseRestorePoint(ctx, point, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := entryPaths(entries); got != "docs,latest,photos" {
+		t.Fatalf("root %s", got)
+	}
+	entries, _ = r.BrowseRestorePoint(ctx, point, "docs")
+	if got := entryPaths(entries); got != "docs/notes.txt,docs/report.pdf" {
+		t.Fatalf("docs %s", got)
+	}
+	if entries[1].Size != int64(len("quarterly numbers")) || entries[1].Type != "file" {
+		t.Errorf("report %+v", entries[1])
+	}
+	if _, err := r.BrowseRestorePoint(ctx, point, "docs/report.pdf"); err == nil {
+		t.Error("browsed into a file")
+	}
+	if _, err := r.BrowseRestorePoint(ctx, point, "../etc"); err == nil {
+		t.Error("browsed a missing directory")
+	}
+	if _, err := r.BrowseRestorePoint(ctx, PointRef{Type: "s3", ID: "x"}, "/"); err == nil {
+		t.Error("browsed a btrfs stream")
+	}
+
+	result, err := r.SearchCatalog("REPORT", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Matches) != 1 || result.Matches[0].Entry.Path != "docs/report.pdf" || result.Matches[0].Point != point {
+		t.Fatalf("matches %+v", result.Matches)
+	}
+	result, _ = r.SearchCatalog("*.jpg", 0)
+	if len(result.Matches) != 1 || result.Matches[0].Entry.Path != "photos/2024/a.jpg" {
+		t.Fatalf("glob matches %+v", result.Matches)
+	}
+	result, _ = r.SearchCatalog("o", 1)
+	if len(result.Matches) != 1 || !result.Truncated {
+		t.Fatalf("limited search %+v", result)
+	}
+
+	// A deleted snapshot leaves the catalog
+	s.snapshots = map[string][]*Snapshot{}
+	result, _ = r.SearchCatalog("report", 0)
+	if len(result.Matches) != 0 || result.Points != 0 {
+		t.Fatalf("matches after delete %+v", result)
+	}
+}
+
+func TestRestoreFilesConflicts(t *testing.T) {
+	target := t.TempDir()
+	r, _ := newCatalogRestorer(t, target)
+	ctx := context.Background()
+	report := filepath.Join(target, "docs", "report.pdf")
+
+	restore := func(conflict string, paths ...string) *FileRestoreStats {
+		t.Helper()
+		job := &BackupJob{ID: "restore-" + conflict, Type: "restore"}
+		r.jobManager.AddJob(job)
+		stats, err := r.restoreFiles(ctx, job, FileRestoreRequest{Point: PointRef{Type: "local", ID: "snap"}, Conflict: conflict}, paths)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.RestorePath != target {
+			t.Errorf("restored to %q, want the original location", job.RestorePath)
+		}
+		return stats
+	}
+	read := func(p string) string {
+		data, _ := os.ReadFile(p)
+		return string(data)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(report), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(report, []byte("edited"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := restore(ConflictSkip, "docs")
+	if stats.Restored != 1 || stats.Skipped != 1 || read(report) != "edited" {
+		t.Fatalf("skip %+v, report %q", stats, read(report))
+	}
+	if read(filepath.Join(target, "docs", "notes.txt")) != "remember the milk" {
+		t.Fatal("notes.txt not restored")
+	}
+
+	stats = restore(ConflictRename, "docs/report.pdf")
+	if stats.Renamed != 1 || read(report) != "edited" || read(filepath.Join(target, "docs", "report.restored.pdf")) != "quarterly numbers" {
+		t.Fatalf("rename %+v", stats)
+	}
+	restore(ConflictRename, "docs/report.pdf")
+	if read(filepath.Join(target, "docs", "report.restored-2.pdf")) != "quarterly numbers" {
+		t.Fatal("second rename did not pick a new name")
+	}
+
+	stats = restore(ConflictOverwrite, "docs/report.pdf", "photos", "latest")
+	if stats.Restored != 3 || read(report) != "quarterly numbers" || read(filepath.Join(target, "photos", "2024", "a.jpg")) != "jpeg" {
+		t.Fatalf("overwrite %+v, report %q", stats, read(report))
+	}
+	if link, err := os.Readlink(filepath.Join(target, "latest")); err != nil || link != "docs" {
+		t.Fatalf("symlink %q: %v", link, err)
+	}
+
+	if _, err := r.RestoreFiles(FileRestoreRequest{Point: PointRef{Type: "local", ID: "snap"}, Paths: []string{"docs"}, Conflict: "merge"}); err == nil {
+		t.Error("accepted an unknown conflict policy")
+	}
+	if _, err := r.RestoreFiles(FileRestoreRequest{Point: PointRef{Type: "local", ID: "snap"}, Paths: []string{"docs"}, TargetPath: "relative"}); err == nil {
+		t.Error("accepted a relative target")
+	}
+}
+
+func TestRestoreFilesFromRepository(t *testing.T) {
+	r, _ := newCatalogRestorer(t, "/srv/data")
+	ctx := context.Background()
+
+	dest := &Destination{Name: "repo", Type: "repo", Enabled: true, Path: filepath.Join(t.TempDir(), "repo")}
+	if err := r.replicator.CreateDestination(dest); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.replicator.StoreRepoPassword(dest.ID, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	rp, err := r.replicator.openRepository(ctx, dest, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, _, _ := r.mount("", "")
+	snap, err := rp.Backup(ctx, src, repo.BackupOptions{Source: "@home"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	point := PointRef{Type: "repo", ID: snap.ID, DestinationID: dest.ID}
+	entries, err := r.BrowseRestorePoint(ctx, point, "photos/2024")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := entryPaths(entries); got != "photos/2024/a.jpg" {
+		t.Fatalf("entries %s", got)
+	}
+
+	target := t.TempDir()
+	job := &BackupJob{ID: "repo-restore", Type: "restore"}
+	r.jobManager.AddJob(job)
+	stats, err := r.restoreFiles(ctx, job, FileRestoreRequest{Point: point, TargetPath: target, Conflict: ConflictSkip}, []string{"docs", "latest"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Restored != 3 || stats.Bytes != int64(len("quarterly numbers")+len("remember the milk")) {
+		t.Fatalf("stats %+v", stats)
+	}
+	if link, _ := os.Readlink(filepath.Join(target, "latest")); link != "docs" {
+		t.Fatalf("symlink %q", link)
+	}
+	if job.Progress != 99 {
+		t.Errorf("progress %d", job.Progress)
+	}
+}
@@ -0,0 +1,377 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Replication chains. The replicator records which local snapshots each
+// destination holds. Replications without an explicit base continue from
+// the newest of them, and local retention keeps that snapshot so the next
+// send can be incremental. Destinations that receive btrfs streams are
+// checked by received UUID before a base is picked, so snapshots deleted
+// remotely are not used as a parent.
+
+// ReplicatedSnapshot is a local snapshot that exists on a destination
+type ReplicatedSnapshot struct {
+	SnapshotID   string    `json:"snapshot_id"`
+	Subvolume    string    `json:"subvolume"`
+	UUID         string    `json:"uuid,omitempty"` // the received UUID of the remote copy
+	Name         string    `json:"name,omitempty"` // name of the copy on local and SSH destinations
+	CreatedAt    time.Time `json:"created_at"`
+	ReplicatedAt time.Time `json:"replicated_at"`
+}
+
+// SnapshotGuard names snapshots local retention must keep
+type SnapshotGuard interface {
+	// ProtectedSnapshots maps snapshot IDs to the reason they are kept
+	ProtectedSnapshots() map[string]string
+}
+
+// incrementalDestination reports whether a destination type receives
+// btrfs streams that can be incremental
+func incrementalDestination(destType string) bool {
+	switch destType {
+	case "ssh", "local", "s3", "nos":
+		return true
+	}
+	return false
+}
+
+// ReplicatedSnapshots returns what a destination holds, newest first
+func (r *Replicator) ReplicatedSnapshots(destID string) ([]*ReplicatedSnapshot, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if _, ok := r.destinations[destID]; !ok {
+		return nil, fmt.Errorf("destination not found: %s", destID)
+	}
+	result := make([]*ReplicatedSnapshot, 0, len(r.replicated[destID]))
+	for _, rs := range r.replicated[destID] {
+		copied := *rs
+		result = append(result, &copied)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].CreatedAt.After(result[j].CreatedAt) })
+	return result, nil
+}
+
+// ProtectedSnapshots returns the last common snapshot of every
+// destination and subvolume
+func (r *Replicator) ProtectedSnapshots() map[string]string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	protected := make(map[string]string)
+	for destID, snapshots := range r.replicated {
+		dest, ok := r.destinations[destID]
+		if !ok || !incrementalDestination(dest.Type) {
+			continue
+		}
+		for _, rs := range latestPerSubvolume(snapshots) {
+			protected[rs.SnapshotID] = fmt.Sprintf("last common snapshot with destination %s", dest.Name)
+		}
+	}
+	return protected
+}
+
+// Resync rebuilds the chain of a destination after it broke, e.g. because
+// snapshots were deleted on either side. It forgets what was recorded,
+// records the local snapshots the destination still holds and sends a full
+// stream of the newest snapshot of every subvolume that has none left. An
+// empty subvolume resyncs all subvolumes replicated so far.
+func (r *Replicator) Resync(destID string, subvolume string) (*BackupJob, error) {
+	r.mu.RLock()
+	dest, ok := r.destinations[destID]
+	var subvolumes []string
+	seen := make(map[string]bool)
+	for _, rs := range r.replicated[destID] {
+		if !seen[rs.Subvolume] && (subvolume == "" || rs.Subvolume == subvolume) {
+			seen[rs.Subvolume] = true
+			subvolumes = append(subvolumes, rs.Subvolume)
+		}
+	}
+	r.mu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("destination not found: %s", destID)
+	}
+	if !incrementalDestination(dest.Type) {
+		return nil, fmt.Errorf("destination type %s does not keep a snapshot chain", dest.Type)
+	}
+	if r.scheduler == nil {
+		return nil, fmt.Errorf("no local snapshots available")
+	}
+	if subvolume != "" && !seen[subvolume] {
+		subvolumes = append(subvolumes, subvolume)
+	}
+	if len(subvolumes) == 0 {
+		return nil, fmt.Errorf("nothing has been replicated to this destination")
+	}
+	sort.Strings(subvolumes)
+
+	return r.startDestinationJob(dest, "resync", func(ctx context.Context, job *BackupJob) error {
+		return r.resync(ctx, job, dest, subvolumes)
+	}), nil
+}
+
+func (r *Replicator) resync(ctx context.Context, job *BackupJob, dest *Destination, subvolumes []string) error {
+	present, err := r.remotePresence(ctx, dest)
+	if err != nil {
+		return fmt.Errorf("failed to list snapshots on %s: %w", dest.Name, err)
+	}
+
+	local := make(map[string][]*Snapshot)
+	for _, snap := range r.scheduler.ListSnapshots() {
+		local[snap.Subvolume] = append(local[snap.Subvolume], snap)
+	}
+
+	r.mu.Lock()
+	kept := r.replicated[dest.ID][:0]
+	for _, rs := range r.replicated[dest.ID] {
+		if !containsString(subvolumes, rs.Subvolume) {
+			kept = append(kept, rs)
+		}
+	}
+	r.replicated[dest.ID] = kept
+	r.mu.Unlock()
+
+	for _, subvol := range subvolumes {
+		// ListSnapshots is newest first
+		snapshots := local[subvol]
+		if len(snapshots) == 0 {
+			r.jobManager.AddLogEntry(job.ID, "warn", fmt.Sprintf("No local snapshots of %s", subvol))
+			continue
+		}
+		found := 0
+		if present != nil {
+			for _, snap := range snapshots {
+				if present(snap.ID, r.scheduler.snapshotUUID(snap)) {
+					r.recordReplicated(dest.ID, snap)
+					found++
+				}
+			}
+		}
+		if found > 0 {
+			r.jobManager.AddLogEntry(job.ID, "info", fmt.Sprintf("%s holds %d snapshots of %s", dest.Name, found, subvol))
+			continue
+		}
+
+		newest := snapshots[0]
+		r.jobManager.AddLogEntry(job.ID, "info", fmt.Sprintf("Sending a full stream of %s (%s)", subvol, newest.ID))
+		job.SnapshotID = newest.ID
+		if err := r.replicateSnapshot(job, dest, newest, newest.Path, ""); err != nil {
+			return fmt.Errorf("full send of %s failed: %w", subvol, err)
+		}
+		r.recordReplicated(dest.ID, newest)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.saveStateLocked()
+}
+
+// selectBase picks the newest snapshot older than snapshot that both the
+// destination and this box still have
+func (r *Replicator) selectBase(job *BackupJob, dest *Destination, snapshot *Snapshot) string {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := r.reconcile(ctx, dest); err != nil {
+		r.jobManager.AddLogEntry(job.ID, "warn", fmt.Sprintf("Could not check snapshots on %s: %v", dest.Name, err))
+	}
+
+	candidates, _ := r.ReplicatedSnapshots(dest.ID)
+	for _, rs := range candidates {
+		if rs.Subvolume != snapshot.Subvolume || rs.SnapshotID == snapshot.ID || !rs.CreatedAt.Before(snapshot.CreatedAt) {
+			continue
+		}
+		if _, err := r.scheduler.GetSnapshot(rs.SnapshotID); err != nil {
+			continue
+		}
+		r.jobManager.AddLogEntry(job.ID, "info", fmt.Sprintf("Sending incremental to %s, the last common snapshot", rs.SnapshotID))
+		return rs.SnapshotID
+	}
+	r.jobManager.AddLogEntry(job.ID, "info", fmt.Sprintf("No common snapshot of %s with %s, sending a full stream", snapshot.Subvolume, dest.Name))
+	return ""
+}
+
+// reconcile forgets recorded snapshots the destination no longer holds
+func (r *Replicator) reconcile(ctx context.Context, dest *Destination) error {
+	present, err := r.remotePresence(ctx, dest)
+	if err != nil || present == nil {
+		return err
+	}
+
+	// Snapshots recorded before their UUIDs were known get them from
+	// the local snapshot, where it still exists
+	uuids := make(map[string]string)
+	if r.scheduler != nil {
+		recorded, _ := r.ReplicatedSnapshots(dest.ID)
+		for _, rs := range recorded {
+			if rs.UUID != "" {
+				continue
+			}
+			if snap, err := r.scheduler.GetSnapshot(rs.SnapshotID); err == nil {
+				uuids[rs.SnapshotID] = r.scheduler.snapshotUUID(snap)
+			}
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	recorded := r.replicated[dest.ID]
+	kept := recorded[:0]
+	for _, rs := range recorded {
+		if rs.UUID == "" {
+			rs.UUID = uuids[rs.SnapshotID]
+		}
+		if present(rs.SnapshotID, rs.UUID) {
+			kept = append(kept, rs)
+		} else {
+			r.logger.Info().Str("destination", dest.ID).Str("snapshot", rs.SnapshotID).Msg("Snapshot is gone from destination")
+		}
+	}
+	if len(kept) == len(recorded) && len(uuids) == 0 {
+		return nil
+	}
+	r.replicated[dest.ID] = kept
+	return r.saveStateLocked()
+}
+
+// remotePresence returns a check for whether the destination holds a
+// snapshot, given its ID and btrfs UUID. btrfs destinations are matched by
+// received UUID, so a snapshot whose UUID is unknown is never found on
+// one. It returns nil if the destination can't be inspected.
+func (r *Replicator) remotePresence(ctx context.Context, dest *Destination) (func(id, uuid string) bool, error) {
+	switch dest.Type {
+	case "nos":
+		inv, err := r.peerInventory(ctx, dest)
+		if err != nil {
+			return nil, err
+		}
+		ids := make(map[string]bool)
+		uuids := make(map[string]bool)
+		for _, replica := range inv.Replicas {
+			ids[replica.SnapshotID] = true
+			if replica.ReceivedUUID != "" {
+				uuids[replica.ReceivedUUID] = true
+			}
+		}
+		return func(id, uuid string) bool { return ids[id] || (uuid != "" && uuids[uuid]) }, nil
+	case "s3":
+		client, err := r.s3Client(dest)
+		if err != nil {
+			return nil, err
+		}
+		sets, _, err := listS3Sets(ctx, client, dest)
+		if err != nil {
+			return nil, err
+		}
+		ids := make(map[string]bool)
+		for _, set := range sets {
+			ids[set.SnapshotID] = true
+		}
+		return func(id, _ string) bool { return ids[id] }, nil
+	case "local", "ssh":
+		var cmd *exec.Cmd
+		if dest.Type == "local" {
+			cmd = exec.CommandContext(ctx, "btrfs", "subvolume", "list", "-R", dest.Path)
+		} else {
+			cmd = exec.CommandContext(ctx, "ssh", r.sshArgs(dest, fmt.Sprintf("btrfs subvolume list -R %s", dest.Path))...)
+		}
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("btrfs subvolume list failed: %w", err)
+		}
+		return receivedUUIDPresence(parseReceivedUUIDs(string(out))), nil
+	}
+	return nil, nil
+}
+
+func (r *Replicator) recordReplicated(destID string, snapshot *Snapshot) {
+	var uuid string
+	if r.scheduler != nil {
+		uuid = r.scheduler.snapshotUUID(snapshot)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.destinations[destID]; !ok {
+		return
+	}
+	for _, rs := range r.replicated[destID] {
+		if rs.SnapshotID == snapshot.ID {
+			rs.ReplicatedAt = time.Now()
+			return
+		}
+	}
+	r.replicated[destID] = append(r.replicated[destID], &ReplicatedSnapshot{
+		SnapshotID:   snapshot.ID,
+		Subvolume:    snapshot.Subvolume,
+		UUID:         uuid,
+		Name:         filepath.Base(snapshot.Path),
+		CreatedAt:    snapshot.CreatedAt,
+		ReplicatedAt: time.Now(),
+	})
+	if err := r.saveStateLocked(); err != nil {
+		r.logger.Error().Err(err).Msg("Failed to save replication state")
+	}
+}
+
+// snapshotPath returns the path of a local snapshot
+func (r *Replicator) snapshotPath(snapshotID string) (string, error) {
+	if r.scheduler == nil {
+		return "", fmt.Errorf("no local snapshots available")
+	}
+	snap, err := r.scheduler.GetSnapshot(snapshotID)
+	if err != nil {
+		return "", err
+	}
+	return snap.Path, nil
+}
+
+func latestPerSubvolume(snapshots []*ReplicatedSnapshot) map[string]*ReplicatedSnapshot {
+	latest := make(map[string]*ReplicatedSnapshot)
+	for _, rs := range snapshots {
+		if cur, ok := latest[rs.Subvolume]; !ok || rs.CreatedAt.After(cur.CreatedAt) {
+			latest[rs.Subvolume] = rs
+		}
+	}
+	return latest
+}
+
+// receivedUUIDPresence matches snapshots by the received UUIDs of their
+// copies; a snapshot without a known UUID can't be told apart from any
+// other, so it doesn't count as present
+func receivedUUIDPresence(uuids map[string]bool) func(id, uuid string) bool {
+	return func(_, uuid string) bool { return uuid != "" && uuids[uuid] }
+}
+
+// parseReceivedUUIDs collects the received UUIDs from
+// `btrfs subvolume list -R` output
+func parseReceivedUUIDs(out string) map[string]bool {
+	uuids := make(map[string]bool)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		for i := 0; i+1 < len(fields); i++ {
+			if fields[i] == "received_uuid" && fields[i+1] != "-" {
+				uuids[fields[i+1]] = true
+			}
+		}
+	}
+	return uuids
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
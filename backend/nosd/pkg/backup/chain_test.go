@@ -0,0 +1,206 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"nithronos/backend/nosd/pkg/appsdk"
+)
+
+// fakeSnapshotAgent records the snapshots the scheduler deletes
+type fakeSnapshotAgent struct {
+	mu        sync.Mutex
+	deleted   []string
+	createErr error
+	uuids     map[string]string // by path, as btrfs subvolume show reports them
+}
+
+func (a *fakeSnapshotAgent) CreateSnapshot(subvolume string, path string, readOnly bool) error {
+	return a.createErr
+}
+
+func (a *fakeSnapshotAgent) DeleteSnapshot(path string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.deleted = append(a.deleted, path)
+	return nil
+}
+
+func (a *fakeSnapshotAgent) GetSnapshotInfo(path string) (*SnapshotInfo, error) {
+	return &SnapshotInfo{Path: path, UUID: a.uuids[path]}, nil
+}
+
+func (a *fakeSnapshotAgent) ExecuteHook(ctx context.Context, command string) ([]byte, error) {
+	return nil, nil
+}
+
+func (a *fakeSnapshotAgent) ExecuteAppHook(ctx context.Context, appID string, cmd appsdk.ComposeCommand) ([]byte, error) {
+	return nil, nil
+}
+
+// newChainScheduler returns a scheduler holding daily snapshots s2 (oldest),
+// s1 and s0 of @home
+func newChainScheduler(t *testing.T, r *Replicator) (*Scheduler, *fakeSnapshotAgent) {
+	t.Helper()
+	agent := &fakeSnapshotAgent{}
+	s := NewScheduler(zerolog.Nop(), t.TempDir()+"/schedules.json", agent)
+	now := time.Now()
+	for i := 2; i >= 0; i-- {
+		id := fmt.Sprintf("s%d", i)
+		s.snapshots["@home"] = append(s.snapshots["@home"], &Snapshot{
+			ID:         id,
+			Subvolume:  "@home",
+			Path:       "/mnt/pool/.snapshots/home/" + id,
+			UUID:       "uuid-" + id,
+			CreatedAt:  now.Add(-time.Duration(i) * 24 * time.Hour),
+			ScheduleID: "daily",
+		})
+	}
+	r.UseScheduler(s)
+	return s, agent
+}
+
+func newChainJob(r *Replicator, dest *Destination) *BackupJob {
+	job := &BackupJob{ID: "job-" + dest.ID, Type: "replicate", DestinationID: dest.ID}
+	r.jobManager.AddJob(job)
+	return job
+}
+
+func TestReplicationChainSelectsBase(t *testing.T) {
+	r, dest, rc, _ := newPeerPair(t, 0)
+	s, _ := newChainScheduler(t, r)
+	ctx := context.Background()
+	job := newChainJob(r, dest)
+
+	s0, _ := s.GetSnapshot("s0")
+	if base := r.selectBase(job, dest, s0); base != "" {
+		t.Fatalf("base %q before anything was replicated", base)
+	}
+
+	for _, id := range []string{"s2", "s1"} {
+		snap, _ := s.GetSnapshot(id)
+		if _, err := r.sendToPeer(ctx, dest, ReplicaMeta{SnapshotID: id, Subvolume: "@home", CreatedAt: snap.CreatedAt}, strings.NewReader(id)); err != nil {
+			t.Fatal(err)
+		}
+		r.recordReplicated(dest.ID, snap)
+	}
+	if base := r.selectBase(job, dest, s0); base != "s1" {
+		t.Fatalf("base %q, want s1", base)
+	}
+	s1, _ := s.GetSnapshot("s1")
+	if base := r.selectBase(job, dest, s1); base != "s2" {
+		t.Fatalf("base of s1 is %q, want s2", base)
+	}
+
+	// A snapshot deleted on the destination is no longer a parent
+	if err := rc.DeleteReplica(ctx, dest.PeerID, "s1"); err != nil {
+		t.Fatal(err)
+	}
+	if base := r.selectBase(job, dest, s0); base != "s2" {
+		t.Fatalf("base %q after s1 was deleted remotely, want s2", base)
+	}
+	replicated, _ := r.ReplicatedSnapshots(dest.ID)
+	if len(replicated) != 1 || replicated[0].SnapshotID != "s2" {
+		t.Fatalf("replicated %+v", replicated)
+	}
+
+	// The chain survives a restart
+	r2 := NewReplicator(zerolog.Nop(), r.stateFile, r.keysDir, NewJobManager(zerolog.Nop()))
+	if err := r2.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if replicated, _ := r2.ReplicatedSnapshots(dest.ID); len(replicated) != 1 {
+		t.Fatalf("reloaded %+v", replicated)
+	}
+}
+
+func TestRetentionKeepsLastCommonSnapshot(t *testing.T) {
+	r, dest, _, _ := newPeerPair(t, 0)
+	s, agent := newChainScheduler(t, r)
+
+	s2, _ := s.GetSnapshot("s2")
+	r.recordReplicated(dest.ID, s2)
+
+	s.applyRetention(&Schedule{ID: "daily", Subvolumes: []string{"@home"}, Retention: RetentionPolicy{Days: 1}})
+
+	if len(agent.deleted) != 1 || !strings.HasSuffix(agent.deleted[0], "/s1") {
+		t.Fatalf("deleted %v, want only s1", agent.deleted)
+	}
+	if _, err := s.GetSnapshot("s2"); err != nil {
+		t.Fatal("the last common snapshot was pruned")
+	}
+
+	// Without the destination nothing is protected
+	if err := r.DeleteDestination(dest.ID); err != nil {
+		t.Fatal(err)
+	}
+	s.applyRetention(&Schedule{ID: "daily", Subvolumes: []string{"@home"}, Retention: RetentionPolicy{Days: 1}})
+	if _, err := s.GetSnapshot("s2"); err == nil {
+		t.Fatal("s2 kept after its destination was deleted")
+	}
+}
+
+func TestResyncRecordsRemoteSnapshots(t *testing.T) {
+	r, dest, _, _ := newPeerPair(t, 0)
+	s, _ := newChainScheduler(t, r)
+	ctx := context.Background()
+
+	// The destination holds s2 although nothing was recorded
+	s2, _ := s.GetSnapshot("s2")
+	if _, err := r.sendToPeer(ctx, dest, ReplicaMeta{SnapshotID: "s2", Subvolume: "@home", CreatedAt: s2.CreatedAt}, strings.NewReader("s2")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Resync(dest.ID, ""); err == nil {
+		t.Fatal("resync without a subvolume or history was accepted")
+	}
+
+	job := newChainJob(r, dest)
+	if err := r.resync(ctx, job, dest, []string{"@home"}); err != nil {
+		t.Fatal(err)
+	}
+	replicated, _ := r.ReplicatedSnapshots(dest.ID)
+	if len(replicated) != 1 || replicated[0].SnapshotID != "s2" {
+		t.Fatalf("replicated %+v", replicated)
+	}
+	if protected := r.ProtectedSnapshots(); protected["s2"] == "" || len(protected) != 1 {
+		t.Fatalf("protected %v", protected)
+	}
+}
+
+func TestSnapshotUUIDs(t *testing.T) {
+	r, dest, _, _ := newPeerPair(t, 0)
+	s, agent := newChainScheduler(t, r)
+
+	// A snapshot taken while its UUID couldn't be read gets it later
+	s1, _ := s.GetSnapshot("s1")
+	s1.UUID = ""
+	agent.uuids = map[string]string{s1.Path: "uuid-s1"}
+	r.recordReplicated(dest.ID, s1)
+	replicated, _ := r.ReplicatedSnapshots(dest.ID)
+	if len(replicated) != 1 || replicated[0].UUID != "uuid-s1" || s1.UUID != "uuid-s1" {
+		t.Fatalf("replicated %+v, snapshot UUID %q", replicated, s1.UUID)
+	}
+
+	// Copies of a snapshot whose UUID is unknown can't be recognized
+	present := receivedUUIDPresence(map[string]bool{"uuid-s1": true})
+	if !present("s1", "uuid-s1") || present("s0", "") || present("s2", "uuid-s2") {
+		t.Fatal("unknown or missing UUIDs counted as present")
+	}
+}
+
+func TestParseReceivedUUIDs(t *testing.T) {
+	out := `ID 257 gen 12 top level 5 received_uuid - path home
+ID 258 gen 14 top level 5 received_uuid 6c1f0e6a-2b59-4c4e-9f0e-1d1b7e3a8c11 path backups/home-1
+ID 259 gen 15 top level 5 received_uuid 0b0c2d55-8e2e-4bd5-a7a8-5d8a3b0b4f21 path backups/home-2
+`
+	uuids := parseReceivedUUIDs(out)
+	if len(uuids) != 2 || !uuids["6c1f0e6a-2b59-4c4e-9f0e-1d1b7e3a8c11"] || uuids["-"] {
+		t.Fatalf("parsed %v", uuids)
+	}
+}
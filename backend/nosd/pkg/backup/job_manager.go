@@ -1,45 +1,146 @@
 package backup
 
 import (
+	"context"
 	"sync"
 	"time"
 
 	"github.com/rs/zerolog"
+
+	"nithronos/backend/nosd/pkg/jobs"
 )
 
-// JobManager manages backup jobs
+// backupJobPrefix prefixes the engine type of every backup job
+const backupJobPrefix = "backup."
+
+// JobManager manages backup jobs. Every job is mirrored into a job engine
+// as a "backup.<type>" job carrying the BackupJob as its payload; with a
+// persistent engine the history survives restarts.
 type JobManager struct {
 	logger zerolog.Logger
+	engine *jobs.Engine
 	jobs   map[string]*BackupJob
 	mu     sync.RWMutex
 }
 
-// NewJobManager creates a new job manager
+// NewJobManager creates a new job manager keeping its jobs in memory
 func NewJobManager(logger zerolog.Logger) *JobManager {
 	return &JobManager{
 		logger: logger.With().Str("component", "job-manager").Logger(),
+		engine: jobs.New(logger, ""),
 		jobs:   make(map[string]*BackupJob),
 	}
 }
 
+// UseEngine moves the jobs into engine and loads the backup jobs it
+// already holds. Jobs interrupted by a restart come back in the
+// interrupted state.
+func (jm *JobManager) UseEngine(engine *jobs.Engine) {
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+	
+	jm.engine = engine
+	for _, stored := range engine.List(jobs.Filter{Type: backupJobPrefix}) {
+		var job BackupJob
+		if err := stored.Decode(&job); err != nil || job.ID == "" {
+			continue
+		}
+		job.State = JobState(stored.State)
+		if stored.State == jobs.StateInterrupted && job.Error == "" {
+			job.Error = stored.Error
+		}
+		if stored.FinishedAt != nil && job.FinishedAt == nil {
+			job.FinishedAt = stored.FinishedAt
+		}
+		entries, _ := engine.Logs(job.ID, 0, 0)
+		if len(entries) > 100 {
+			entries = entries[len(entries)-100:]
+		}
+		for _, entry := range entries {
+			job.LogEntries = append(job.LogEntries, LogEntry{Timestamp: entry.Time, Level: entry.Level, Message: entry.Message})
+		}
+		jm.jobs[job.ID] = &job
+	}
+	for _, job := range jm.jobs {
+		if _, ok := engine.Get(job.ID); !ok {
+			jm.createLocked(job)
+		}
+	}
+}
+
+// Engine returns the job engine backing the manager
+func (jm *JobManager) Engine() *jobs.Engine {
+	jm.mu.RLock()
+	defer jm.mu.RUnlock()
+	
+	return jm.engine
+}
+
 // AddJob adds a new job
 func (jm *JobManager) AddJob(job *BackupJob) {
 	jm.mu.Lock()
 	defer jm.mu.Unlock()
 	
 	jm.jobs[job.ID] = job
+	jm.createLocked(job)
 	jm.logger.Info().
 		Str("id", job.ID).
 		Str("type", job.Type).
 		Msg("Job added")
 }
 
+func (jm *JobManager) createLocked(job *BackupJob) {
+	mirror := &jobs.Job{
+		ID:        job.ID,
+		Type:      backupJobPrefix + job.Type,
+		Resumable: job.Type == "pull",
+	}
+	syncJob(mirror, job)
+	if _, err := jm.engine.Create(mirror); err != nil {
+		jm.logger.Warn().Err(err).Str("id", job.ID).Msg("Failed to record job")
+	}
+}
+
 // UpdateJob updates an existing job
 func (jm *JobManager) UpdateJob(job *BackupJob) {
 	jm.mu.Lock()
 	defer jm.mu.Unlock()
 	
 	jm.jobs[job.ID] = job
+	jm.syncLocked(job)
+}
+
+func (jm *JobManager) syncLocked(job *BackupJob) {
+	_, _ = jm.engine.Update(job.ID, func(mirror *jobs.Job) { syncJob(mirror, job) })
+}
+
+// syncJob copies a backup job into its engine mirror
+func syncJob(mirror *jobs.Job, job *BackupJob) {
+	// A job canceled through the engine stays canceled
+	if mirror.State == jobs.StateCanceled {
+		job.State = JobStateCanceled
+	}
+	mirror.State = jobs.State(job.State)
+	if mirror.State == "" {
+		mirror.State = jobs.StatePending
+	}
+	mirror.Progress = float64(job.Progress)
+	mirror.Error = job.Error
+	mirror.ParentID = job.ParentID
+	mirror.ChildIDs = append([]string(nil), job.ChildIDs...)
+	if !job.StartedAt.IsZero() {
+		started := job.StartedAt
+		mirror.StartedAt = &started
+		if mirror.CreatedAt.IsZero() {
+			mirror.CreatedAt = started
+		}
+	}
+	mirror.FinishedAt = job.FinishedAt
+	
+	// Logs are kept by the engine, not in the payload
+	payload := *job
+	payload.LogEntries = nil
+	_ = mirror.SetPayload(payload)
 }
 
 // GetJob returns a job by ID
@@ -51,6 +152,50 @@ func (jm *JobManager) GetJob(id string) (*BackupJob, bool) {
 	return job, ok
 }
 
+// JobState returns the state of a job. Canceling changes it under the
+// manager's lock, so runners read it here rather than from their job.
+func (jm *JobManager) JobState(id string) JobState {
+	jm.mu.RLock()
+	defer jm.mu.RUnlock()
+	
+	if job, ok := jm.jobs[id]; ok {
+		return job.State
+	}
+	return ""
+}
+
+// FinishJob ends a job with a final state unless it was canceled. It
+// reports whether the job was finished.
+func (jm *JobManager) FinishJob(id string, state JobState, errMsg string) bool {
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+	
+	job, ok := jm.jobs[id]
+	if !ok || job.State == JobStateCanceled {
+		return false
+	}
+	now := time.Now()
+	job.State = state
+	job.Error = errMsg
+	job.FinishedAt = &now
+	if state == JobStateSucceeded {
+		job.Progress = 100
+	}
+	jm.syncLocked(job)
+	return true
+}
+
+// AddChild records a step of a pipeline job
+func (jm *JobManager) AddChild(parentID string, childID string) {
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+	
+	if parent, ok := jm.jobs[parentID]; ok {
+		parent.ChildIDs = append(parent.ChildIDs, childID)
+		jm.syncLocked(parent)
+	}
+}
+
 // ListJobs returns all jobs
 func (jm *JobManager) ListJobs() []*BackupJob {
 	jm.mu.RLock()
@@ -102,14 +247,27 @@ func (jm *JobManager) CancelJob(id string) error {
 		return nil
 	}
 	
+	jm.cancelLocked(job)
+	
+	// Canceling a backup pipeline cancels its running steps
+	for _, childID := range job.ChildIDs {
+		if child, ok := jm.jobs[childID]; ok {
+			jm.cancelLocked(child)
+		}
+	}
+	
+	// The engine cancels the contexts the jobs run under
+	return jm.engine.Cancel(id)
+}
+
+func (jm *JobManager) cancelLocked(job *BackupJob) {
 	if job.State == JobStateRunning || job.State == JobStatePending {
 		job.State = JobStateCanceled
 		now := time.Now()
 		job.FinishedAt = &now
-		jm.logger.Info().Str("id", id).Msg("Job canceled")
+		jm.syncLocked(job)
+		jm.logger.Info().Str("id", job.ID).Msg("Job canceled")
 	}
-	
-	return nil
 }
 
 // CleanupOldJobs removes completed jobs older than the specified duration
@@ -122,13 +280,14 @@ func (jm *JobManager) CleanupOldJobs(maxAge time.Duration) int {
 	
 	for id, job := range jm.jobs {
 		// Only clean up completed jobs
-		if job.State != JobStateSucceeded && job.State != JobStateFailed && job.State != JobStateCanceled {
+		if job.State != JobStateSucceeded && job.State != JobStateFailed && job.State != JobStateCanceled && job.State != JobStateInterrupted {
 			continue
 		}
 		
 		// Check age
 		if job.FinishedAt != nil && now.Sub(*job.FinishedAt) > maxAge {
 			delete(jm.jobs, id)
+			_ = jm.engine.Remove(id)
 			deleted++
 		}
 	}
@@ -162,6 +321,13 @@ func (jm *JobManager) AddLogEntry(jobID string, level string, message string) {
 	if len(job.LogEntries) > 100 {
 		job.LogEntries = job.LogEntries[len(job.LogEntries)-100:]
 	}
+	
+	jm.engine.Log(jobID, jobs.LogEntry{Time: entry.Timestamp, Level: level, Message: message})
+}
+
+// JobContext returns a context that is canceled once the job is
+func (jm *JobManager) JobContext(jobID string) (context.Context, context.CancelFunc) {
+	return context.WithCancel(jm.Engine().Context(jobID))
 }
 
 // UpdateProgress updates job progress
@@ -177,4 +343,5 @@ func (jm *JobManager) UpdateProgress(jobID string, progress int, bytesTotal, byt
 	job.Progress = progress
 	job.BytesTotal = bytesTotal
 	job.BytesDone = bytesDone
+	jm.engine.Progress(jobID, float64(progress), "")
 }
@@ -0,0 +1,629 @@
+package backup
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+
+	"nithronos/backend/nosd/pkg/agentclient"
+)
+
+// Receiving side of NithronOS-to-NithronOS replication. A receiver hands
+// out one-time pairing codes; a sender redeems one for a token and then
+// streams btrfs sends to the receive endpoint, which nos-agent pipes into
+// `btrfs receive` below a quota-limited landing subvolume.
+
+// PeerLandingDir is the landing subvolume in the root of a pool. nos-agent
+// only receives into and deletes subvolumes below it.
+const PeerLandingDir = ".nos-replica"
+
+const (
+	pairingCodeTTL      = 15 * time.Minute
+	pairingCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	// After this many wrong codes every outstanding code is revoked
+	maxPairingFailures = 5
+)
+
+var (
+	ErrInvalidPairingCode = errors.New("invalid or expired pairing code")
+	ErrPeerUnauthorized   = errors.New("unknown peer or invalid token")
+	ErrPeerQuotaExceeded  = errors.New("peer landing quota exceeded")
+	ErrReplicaExists      = errors.New("replica already received")
+	ErrPeerBusy           = errors.New("a stream for this subvolume is already being received")
+)
+
+// PeerAgent performs the privileged parts of receiving replication streams
+type PeerAgent interface {
+	EnsureLanding(ctx context.Context, path string, limitBytes int64) error
+	Receive(ctx context.Context, landing string, dir string, stream io.Reader) (*agentclient.ReceivedSubvolume, error)
+	DeleteSubvolume(ctx context.Context, path string) error
+}
+
+// Peer is a NithronOS box paired to replicate to this one
+type Peer struct {
+	ID          string                     `json:"id"`
+	Name        string                     `json:"name"`
+	TokenHash   string                     `json:"token_hash"`
+	LandingPath string                     `json:"landing_path"`
+	QuotaBytes  int64                      `json:"quota_bytes"`
+	Retention   map[string]RetentionPolicy `json:"retention,omitempty"` // per subvolume, mirrored from the sender
+	PairedAt    time.Time                  `json:"paired_at"`
+	LastSeen    *time.Time                 `json:"last_seen,omitempty"`
+}
+
+// Replica is a snapshot received from a peer
+type Replica struct {
+	PeerID       string    `json:"peer_id"`
+	SnapshotID   string    `json:"snapshot_id"`
+	Subvolume    string    `json:"subvolume"`
+	Parent       string    `json:"parent,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	ReceivedAt   time.Time `json:"received_at"`
+	Path         string    `json:"path"`
+	UUID         string    `json:"uuid,omitempty"`
+	ReceivedUUID string    `json:"received_uuid,omitempty"`
+	Generation   int64     `json:"generation"`
+	Size         int64     `json:"size"`
+}
+
+// ReplicaMeta describes an incoming stream. Senders pass their retention
+// policy with every transfer so the receiver can mirror it.
+type ReplicaMeta struct {
+	SnapshotID string           `json:"snapshot_id"`
+	Subvolume  string           `json:"subvolume"`
+	Parent     string           `json:"parent,omitempty"`
+	CreatedAt  time.Time        `json:"created_at"`
+	Retention  *RetentionPolicy `json:"retention,omitempty"`
+}
+
+// PeerInventory is what a receiver holds for one peer, newest replica first
+type PeerInventory struct {
+	PeerID         string                     `json:"peer_id"`
+	Name           string                     `json:"name"`
+	LandingPath    string                     `json:"landing_path,omitempty"`
+	QuotaBytes     int64                      `json:"quota_bytes"`
+	UsedBytes      int64                      `json:"used_bytes"`
+	Retention      map[string]RetentionPolicy `json:"retention,omitempty"`
+	PairedAt       time.Time                  `json:"paired_at"`
+	LastSeen       *time.Time                 `json:"last_seen,omitempty"`
+	LastReceivedAt *time.Time                 `json:"last_received_at,omitempty"`
+	LastGeneration int64                      `json:"last_generation"`
+	Replicas       []*Replica                 `json:"replicas"`
+}
+
+// PairingCode lets one sender pair with this box. Fingerprint is the
+// SHA-256 of this box's TLS certificate; the sender enters it along with
+// the code so it knows it is talking to this box.
+type PairingCode struct {
+	Code        string    `json:"code"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	LandingPath string    `json:"landing_path"`
+	QuotaBytes  int64     `json:"quota_bytes"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// Receiver accepts replication streams from paired peers
+type Receiver struct {
+	logger    zerolog.Logger
+	stateFile string
+	agent     PeerAgent
+	certFile  string
+	mu        sync.RWMutex
+	peers     map[string]*Peer
+	replicas  []*Replica
+	codes     map[string]*PairingCode
+	failures  int
+	receiving map[string]bool
+}
+
+type receiverState struct {
+	Peers    []*Peer    `json:"peers"`
+	Replicas []*Replica `json:"replicas"`
+}
+
+// NewReceiver creates a receiver that stores peers and replicas in stateFile
+func NewReceiver(logger zerolog.Logger, stateFile string, agent PeerAgent) *Receiver {
+	return &Receiver{
+		logger:    logger.With().Str("component", "backup-receiver").Logger(),
+		stateFile: stateFile,
+		agent:     agent,
+		peers:     make(map[string]*Peer),
+		codes:     make(map[string]*PairingCode),
+		receiving: make(map[string]bool),
+	}
+}
+
+// UseCertificate shows the fingerprint of the PEM certificate in certFile,
+// the one peers see when they connect, next to every pairing code
+func (rc *Receiver) UseCertificate(certFile string) {
+	rc.certFile = certFile
+}
+
+// Start loads the peers and replicas
+func (rc *Receiver) Start() error {
+	data, err := os.ReadFile(rc.stateFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var state receiverState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	for _, peer := range state.Peers {
+		rc.peers[peer.ID] = peer
+	}
+	rc.replicas = state.Replicas
+	return nil
+}
+
+// CreatePairingCode returns a code a sender can redeem once within 15
+// minutes. Streams from that sender land below the PeerLandingDir of
+// poolPath, which is limited to quotaBytes (0 = unlimited).
+func (rc *Receiver) CreatePairingCode(poolPath string, quotaBytes int64) (*PairingCode, error) {
+	if !filepath.IsAbs(poolPath) || filepath.Clean(poolPath) != poolPath || poolPath == "/" {
+		return nil, fmt.Errorf("pool path must be a clean absolute path")
+	}
+	landingPath := filepath.Join(poolPath, PeerLandingDir)
+	if quotaBytes < 0 {
+		return nil, fmt.Errorf("quota must not be negative")
+	}
+
+	raw := make([]byte, 10)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	code := make([]byte, len(raw))
+	for i, b := range raw {
+		code[i] = pairingCodeAlphabet[int(b)%len(pairingCodeAlphabet)]
+	}
+
+	fingerprint := ""
+	if rc.certFile != "" {
+		fp, err := certFileFingerprint(rc.certFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read TLS certificate: %w", err)
+		}
+		fingerprint = fp
+	}
+
+	pc := &PairingCode{
+		Code:        string(code[:5]) + "-" + string(code[5:]),
+		Fingerprint: fingerprint,
+		LandingPath: landingPath,
+		QuotaBytes:  quotaBytes,
+		ExpiresAt:   time.Now().Add(pairingCodeTTL),
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	for c, existing := range rc.codes {
+		if time.Now().After(existing.ExpiresAt) {
+			delete(rc.codes, c)
+		}
+	}
+	rc.codes[string(code)] = pc
+	rc.failures = 0
+	return pc, nil
+}
+
+// Pair redeems a pairing code for the sender called name. It returns the
+// new peer and the token the sender authenticates with from now on; only
+// a hash of the token is kept.
+func (rc *Receiver) Pair(ctx context.Context, code string, name string) (*Peer, string, error) {
+	code = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+
+	rc.mu.Lock()
+	pc, ok := rc.codes[code]
+	if ok {
+		delete(rc.codes, code)
+	}
+	if !ok || time.Now().After(pc.ExpiresAt) {
+		if !ok {
+			rc.failures++
+			if rc.failures >= maxPairingFailures {
+				rc.codes = make(map[string]*PairingCode)
+				rc.logger.Warn().Msg("Too many invalid pairing codes, revoked all outstanding codes")
+			}
+		}
+		rc.mu.Unlock()
+		return nil, "", ErrInvalidPairingCode
+	}
+	rc.mu.Unlock()
+
+	if err := rc.agent.EnsureLanding(ctx, pc.LandingPath, pc.QuotaBytes); err != nil {
+		return nil, "", fmt.Errorf("failed to prepare landing subvolume: %w", err)
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(secret)
+	if name == "" {
+		name = "NithronOS"
+	}
+	peer := &Peer{
+		ID:          uuid.New().String(),
+		Name:        name,
+		TokenHash:   hashPeerToken(token),
+		LandingPath: pc.LandingPath,
+		QuotaBytes:  pc.QuotaBytes,
+		Retention:   make(map[string]RetentionPolicy),
+		PairedAt:    time.Now(),
+	}
+
+	rc.mu.Lock()
+	rc.peers[peer.ID] = peer
+	err := rc.saveStateLocked()
+	rc.mu.Unlock()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to save state: %w", err)
+	}
+
+	rc.logger.Info().Str("peer", peer.ID).Str("name", name).Msg("Paired replication peer")
+	return peer, peer.ID + "." + token, nil
+}
+
+// Authenticate returns the peer a token was issued to
+func (rc *Receiver) Authenticate(token string) (*Peer, error) {
+	id, secret, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, ErrPeerUnauthorized
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	peer, ok := rc.peers[id]
+	if !ok || subtle.ConstantTimeCompare([]byte(peer.TokenHash), []byte(hashPeerToken(secret))) != 1 {
+		return nil, ErrPeerUnauthorized
+	}
+	now := time.Now()
+	peer.LastSeen = &now
+	return peer, nil
+}
+
+// Receive stores one send stream from peer as a replica and applies the
+// peer's mirrored retention to that subvolume
+func (rc *Receiver) Receive(ctx context.Context, peer *Peer, meta ReplicaMeta, stream io.Reader) (*Replica, error) {
+	if !validReplicaName(meta.SnapshotID) || meta.Subvolume == "" {
+		return nil, fmt.Errorf("snapshot ID and subvolume are required")
+	}
+	if meta.CreatedAt.IsZero() {
+		meta.CreatedAt = time.Now()
+	}
+	key := peer.ID + "/" + meta.Subvolume
+
+	rc.mu.Lock()
+	if rc.receiving[key] {
+		rc.mu.Unlock()
+		return nil, ErrPeerBusy
+	}
+	for _, replica := range rc.replicas {
+		if replica.PeerID == peer.ID && replica.SnapshotID == meta.SnapshotID {
+			rc.mu.Unlock()
+			return nil, ErrReplicaExists
+		}
+	}
+	remaining := int64(-1)
+	if peer.QuotaBytes > 0 {
+		remaining = peer.QuotaBytes - rc.landingUsageLocked(peer.LandingPath)
+		if remaining <= 0 {
+			rc.mu.Unlock()
+			return nil, ErrPeerQuotaExceeded
+		}
+	}
+	rc.receiving[key] = true
+	rc.mu.Unlock()
+	defer func() {
+		rc.mu.Lock()
+		delete(rc.receiving, key)
+		rc.mu.Unlock()
+	}()
+
+	// The qgroup limit is what really caps the landing area; counting the
+	// stream gives a clear error before the filesystem refuses writes
+	limited := &quotaReader{r: stream, remaining: remaining}
+	dir := filepath.Join(peer.LandingPath, peer.ID, replicaDirName(meta.Subvolume))
+	res, err := rc.agent.Receive(ctx, peer.LandingPath, dir, limited)
+	if limited.exceeded {
+		return nil, ErrPeerQuotaExceeded
+	}
+	if err != nil {
+		return nil, fmt.Errorf("btrfs receive failed: %w", err)
+	}
+	if res.Warning != "" {
+		rc.logger.Warn().Str("peer", peer.ID).Str("path", res.Path).Msg(res.Warning)
+	}
+
+	replica := &Replica{
+		PeerID:       peer.ID,
+		SnapshotID:   meta.SnapshotID,
+		Subvolume:    meta.Subvolume,
+		Parent:       meta.Parent,
+		CreatedAt:    meta.CreatedAt,
+		ReceivedAt:   time.Now(),
+		Path:         res.Path,
+		UUID:         res.UUID,
+		ReceivedUUID: res.ReceivedUUID,
+		Generation:   res.Generation,
+		Size:         res.Bytes,
+	}
+
+	rc.mu.Lock()
+	rc.replicas = append(rc.replicas, replica)
+	if meta.Retention != nil {
+		if peer.Retention == nil {
+			peer.Retention = make(map[string]RetentionPolicy)
+		}
+		peer.Retention[meta.Subvolume] = *meta.Retention
+	}
+	err = rc.saveStateLocked()
+	rc.mu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to save state: %w", err)
+	}
+	rc.logger.Info().Str("peer", peer.ID).Str("snapshot", meta.SnapshotID).Int64("bytes", res.Bytes).Msg("Received replica")
+
+	// The replica is stored even if retention fails
+	if err := rc.expireReplicas(ctx, peer, meta.Subvolume); err != nil {
+		rc.logger.Error().Err(err).Str("peer", peer.ID).Msg("Replica retention failed")
+	}
+	return replica, nil
+}
+
+// Inventory returns what this box holds for a peer
+func (rc *Receiver) Inventory(peerID string) (*PeerInventory, error) {
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+	peer, ok := rc.peers[peerID]
+	if !ok {
+		return nil, fmt.Errorf("peer not found: %s", peerID)
+	}
+	return rc.inventoryLocked(peer), nil
+}
+
+// ListPeers returns the inventory of every paired peer
+func (rc *Receiver) ListPeers() []*PeerInventory {
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+	result := make([]*PeerInventory, 0, len(rc.peers))
+	for _, peer := range rc.peers {
+		result = append(result, rc.inventoryLocked(peer))
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].PairedAt.Before(result[j].PairedAt) })
+	return result
+}
+
+// DeleteReplica deletes one received snapshot
+func (rc *Receiver) DeleteReplica(ctx context.Context, peerID string, snapshotID string) error {
+	rc.mu.RLock()
+	var replica *Replica
+	for _, rep := range rc.replicas {
+		if rep.PeerID == peerID && rep.SnapshotID == snapshotID {
+			replica = rep
+		}
+	}
+	rc.mu.RUnlock()
+	if replica == nil {
+		return fmt.Errorf("replica not found: %s", snapshotID)
+	}
+	return rc.deleteReplicas(ctx, []*Replica{replica})
+}
+
+// RemovePeer unpairs a peer. Its replicas are deleted only if asked to.
+func (rc *Receiver) RemovePeer(ctx context.Context, peerID string, deleteReplicas bool) error {
+	rc.mu.RLock()
+	_, ok := rc.peers[peerID]
+	var replicas []*Replica
+	for _, rep := range rc.replicas {
+		if rep.PeerID == peerID {
+			replicas = append(replicas, rep)
+		}
+	}
+	rc.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("peer not found: %s", peerID)
+	}
+
+	if deleteReplicas {
+		if err := rc.deleteReplicas(ctx, replicas); err != nil {
+			return err
+		}
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	delete(rc.peers, peerID)
+	kept := rc.replicas[:0]
+	for _, rep := range rc.replicas {
+		if rep.PeerID != peerID {
+			kept = append(kept, rep)
+		}
+	}
+	rc.replicas = kept
+	rc.logger.Info().Str("peer", peerID).Bool("replicas_deleted", deleteReplicas).Msg("Removed replication peer")
+	return rc.saveStateLocked()
+}
+
+// expireReplicas applies the retention the sender mirrored for a
+// subvolume. Received subvolumes are complete on their own, so unlike
+// stored streams nothing has to be kept for its children.
+func (rc *Receiver) expireReplicas(ctx context.Context, peer *Peer, subvolume string) error {
+	rc.mu.RLock()
+	retention, ok := peer.Retention[subvolume]
+	var snapshots []*Snapshot
+	byID := make(map[string]*Replica)
+	for _, rep := range rc.replicas {
+		if rep.PeerID == peer.ID && rep.Subvolume == subvolume {
+			byID[rep.SnapshotID] = rep
+			snapshots = append(snapshots, &Snapshot{ID: rep.SnapshotID, Subvolume: subvolume, CreatedAt: rep.CreatedAt})
+		}
+	}
+	rc.mu.RUnlock()
+	if !ok || retention == (RetentionPolicy{}) {
+		return nil
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].CreatedAt.After(snapshots[j].CreatedAt) })
+	keep := make(map[string]bool)
+	for _, snap := range selectGFSSnapshots(snapshots, retention) {
+		keep[snap.ID] = true
+	}
+	var expired []*Replica
+	for id, rep := range byID {
+		if !keep[id] {
+			expired = append(expired, rep)
+		}
+	}
+	return rc.deleteReplicas(ctx, expired)
+}
+
+func (rc *Receiver) deleteReplicas(ctx context.Context, replicas []*Replica) error {
+	if len(replicas) == 0 {
+		return nil
+	}
+	var firstErr error
+	deleted := make(map[*Replica]bool)
+	for _, rep := range replicas {
+		if err := rc.agent.DeleteSubvolume(ctx, rep.Path); err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to delete replica %s: %w", rep.SnapshotID, err)
+			}
+			continue
+		}
+		deleted[rep] = true
+		rc.logger.Info().Str("peer", rep.PeerID).Str("snapshot", rep.SnapshotID).Msg("Deleted replica")
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	kept := rc.replicas[:0]
+	for _, rep := range rc.replicas {
+		if !deleted[rep] {
+			kept = append(kept, rep)
+		}
+	}
+	rc.replicas = kept
+	if err := rc.saveStateLocked(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
+func (rc *Receiver) inventoryLocked(peer *Peer) *PeerInventory {
+	inv := &PeerInventory{
+		PeerID:      peer.ID,
+		Name:        peer.Name,
+		LandingPath: peer.LandingPath,
+		QuotaBytes:  peer.QuotaBytes,
+		PairedAt:    peer.PairedAt,
+		LastSeen:    peer.LastSeen,
+		Retention:   peer.Retention,
+		Replicas:    []*Replica{},
+	}
+	for _, rep := range rc.replicas {
+		if rep.PeerID != peer.ID {
+			continue
+		}
+		r := *rep
+		inv.Replicas = append(inv.Replicas, &r)
+		inv.UsedBytes += rep.Size
+		if inv.LastReceivedAt == nil || rep.ReceivedAt.After(*inv.LastReceivedAt) {
+			at := rep.ReceivedAt
+			inv.LastReceivedAt = &at
+			inv.LastGeneration = rep.Generation
+		}
+	}
+	sort.Slice(inv.Replicas, func(i, j int) bool { return inv.Replicas[i].CreatedAt.After(inv.Replicas[j].CreatedAt) })
+	return inv
+}
+
+// landingUsageLocked sums the replicas of every peer sharing a landing
+func (rc *Receiver) landingUsageLocked(landing string) int64 {
+	var used int64
+	for _, rep := range rc.replicas {
+		if peer, ok := rc.peers[rep.PeerID]; ok && peer.LandingPath == landing {
+			used += rep.Size
+		}
+	}
+	return used
+}
+
+func (rc *Receiver) saveStateLocked() error {
+	state := receiverState{Peers: make([]*Peer, 0, len(rc.peers)), Replicas: rc.replicas}
+	for _, peer := range rc.peers {
+		state.Peers = append(state.Peers, peer)
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(rc.stateFile), 0700); err != nil {
+		return err
+	}
+	tmp := rc.stateFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, rc.stateFile)
+}
+
+func hashPeerToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func validReplicaName(s string) bool {
+	return s != "" && s != "." && s != ".." && !strings.ContainsAny(s, "/\\\x00\n\r")
+}
+
+// replicaDirName maps a subvolume name like "@home" or "srv/data" to one
+// directory level
+func replicaDirName(subvolume string) string {
+	name := strings.Trim(strings.ReplaceAll(subvolume, "/", "_"), ".")
+	if name == "" {
+		name = "_"
+	}
+	return name
+}
+
+// quotaReader fails the stream once it grows past the remaining quota;
+// a negative remaining means unlimited
+type quotaReader struct {
+	r         io.Reader
+	remaining int64
+	exceeded  bool
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	n, err := q.r.Read(p)
+	if q.remaining >= 0 {
+		q.remaining -= int64(n)
+		if q.remaining < 0 {
+			q.exceeded = true
+			return n, ErrPeerQuotaExceeded
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,348 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"nithronos/backend/nosd/pkg/backup/s3"
+)
+
+// NithronOS peer destinations ("nos") send btrfs streams to another
+// NithronOS box. The destination is paired once with a code shown by the
+// receiver; the token it hands out is kept in the keys directory and the
+// receiver's TLS certificate is pinned.
+
+// PeerAPIPrefix is where a receiver serves the peer endpoints
+const PeerAPIPrefix = "/api/v1/backup/peer"
+
+// PairDestination redeems a pairing code shown by the receiving box.
+// fingerprint is the certificate fingerprint shown next to the code; the
+// receiver's certificate must match it, or the destination's
+// PeerFingerprint when none is given, and is pinned from then on. Pairing
+// without a fingerprint is refused.
+func (r *Replicator) PairDestination(ctx context.Context, destID string, code string, fingerprint string) error {
+	dest, err := r.destinationOfType(destID, "nos")
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(code) == "" {
+		return fmt.Errorf("pairing code is required")
+	}
+	pin := dest.PeerFingerprint
+	if fingerprint != "" {
+		if pin, err = normalizeFingerprint(fingerprint); err != nil {
+			return err
+		}
+	}
+	if !strings.HasPrefix(dest.Endpoint, "https://") {
+		return fmt.Errorf("peer URL must be an https URL")
+	}
+	if pin == "" {
+		return fmt.Errorf("the receiver's certificate fingerprint is required, it is shown next to the pairing code")
+	}
+
+	name, _ := os.Hostname()
+	body, _ := json.Marshal(map[string]string{"code": code, "name": name})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(dest.Endpoint, "/")+PeerAPIPrefix+"/pair", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := peerHTTPClient(pin).Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach peer: %w", err)
+	}
+	defer res.Body.Close()
+	if err := peerResponseError(res); err != nil {
+		return err
+	}
+	var out struct {
+		PeerID string `json:"peer_id"`
+		Token  string `json:"token"`
+		Name   string `json:"name"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&out); err != nil || out.Token == "" {
+		return fmt.Errorf("invalid pairing response from peer")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	dest.CredentialsRef = fmt.Sprintf("%s.peer", dest.ID)
+	if err := os.WriteFile(filepath.Join(r.keysDir, dest.CredentialsRef), []byte(out.Token), 0600); err != nil {
+		return fmt.Errorf("failed to write peer token: %w", err)
+	}
+	dest.PeerID = out.PeerID
+	dest.PeerName = out.Name
+	dest.PeerFingerprint = pin
+	dest.UpdatedAt = time.Now()
+
+	r.logger.Info().Str("destination", dest.ID).Str("peer", out.PeerID).Msg("Paired with NithronOS peer")
+	return r.saveStateLocked()
+}
+
+// PeerInventory returns what the receiving box holds for this box
+func (r *Replicator) PeerInventory(ctx context.Context, destID string) (*PeerInventory, error) {
+	dest, err := r.destinationOfType(destID, "nos")
+	if err != nil {
+		return nil, err
+	}
+	return r.peerInventory(ctx, dest)
+}
+
+func (r *Replicator) peerInventory(ctx context.Context, dest *Destination) (*PeerInventory, error) {
+	res, err := r.peerRequest(ctx, dest, http.MethodGet, "/inventory", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var inv PeerInventory
+	if err := json.NewDecoder(res.Body).Decode(&inv); err != nil {
+		return nil, fmt.Errorf("invalid inventory from peer: %w", err)
+	}
+	return &inv, nil
+}
+
+func (r *Replicator) testPeerDestination(dest *Destination) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, err := r.peerInventory(ctx, dest)
+	return err
+}
+
+func (r *Replicator) replicatePeer(job *BackupJob, dest *Destination, snapshot *Snapshot, baseSnapshotID string) error {
+	if snapshot == nil {
+		return fmt.Errorf("snapshot not found: %s", job.SnapshotID)
+	}
+
+	ctx, cancel := r.jobContext(job.ID)
+	defer cancel()
+
+	inv, err := r.peerInventory(ctx, dest)
+	if err != nil {
+		return err
+	}
+
+	// An incremental stream can only be received next to its parent
+	sendArgs := []string{"send"}
+	parent := ""
+	if baseSnapshotID != "" && r.scheduler != nil {
+		if base, err := r.scheduler.GetSnapshot(baseSnapshotID); err == nil {
+			for _, replica := range inv.Replicas {
+				if replica.SnapshotID == base.ID {
+					sendArgs = append(sendArgs, "-p", base.Path)
+					parent = base.ID
+					break
+				}
+			}
+		}
+	}
+	if baseSnapshotID != "" && parent == "" {
+		r.jobManager.AddLogEntry(job.ID, "warn", fmt.Sprintf("Parent %s is not on %s, sending a full stream", baseSnapshotID, dest.Name))
+	}
+	job.Incremental = parent != ""
+	job.BaseSnapshot = parent
+	sendArgs = append(sendArgs, snapshot.Path)
+
+	meta := ReplicaMeta{
+		SnapshotID: snapshot.ID,
+		Subvolume:  snapshot.Subvolume,
+		Parent:     parent,
+		CreatedAt:  snapshot.CreatedAt,
+		Retention:  r.peerRetention(dest, snapshot),
+	}
+
+	sendCmd := exec.CommandContext(ctx, "btrfs", sendArgs...)
+	var stderr bytes.Buffer
+	sendCmd.Stderr = &stderr
+	stdout, err := sendCmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to create pipe: %w", err)
+	}
+	if err := sendCmd.Start(); err != nil {
+		return fmt.Errorf("failed to start btrfs send: %w", err)
+	}
+
+	src := s3.Throttle(ctx, stdout, int64(dest.BandwidthLimit)*1024)
+	src = &progressReader{r: src, report: func(n int64) {
+		progress := 0
+		if snapshot.SizeBytes > 0 {
+			progress = int(min(n*100/snapshot.SizeBytes, 99))
+		}
+		r.jobManager.UpdateProgress(job.ID, progress, snapshot.SizeBytes, n)
+	}}
+	replica, sendErr := r.sendToPeer(ctx, dest, meta, src)
+	if sendErr != nil {
+		_ = sendCmd.Process.Kill()
+	}
+	waitErr := sendCmd.Wait()
+	if sendErr != nil {
+		return fmt.Errorf("transfer to peer failed: %w", sendErr)
+	}
+	if waitErr != nil {
+		return fmt.Errorf("btrfs send failed: %w: %s", waitErr, strings.TrimSpace(stderr.String()))
+	}
+
+	r.jobManager.AddLogEntry(job.ID, "info", fmt.Sprintf("Sent %d bytes to %s, received as generation %d", replica.Size, dest.Name, replica.Generation))
+	return nil
+}
+
+// sendToPeer streams one btrfs send stream to the receiver
+func (r *Replicator) sendToPeer(ctx context.Context, dest *Destination, meta ReplicaMeta, stream io.Reader) (*Replica, error) {
+	encoded, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	q := url.Values{}
+	q.Set("meta", string(encoded))
+	res, err := r.peerRequest(ctx, dest, http.MethodPost, "/receive?"+q.Encode(), stream, map[string]string{"Content-Type": "application/octet-stream"})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var replica Replica
+	if err := json.NewDecoder(res.Body).Decode(&replica); err != nil {
+		return nil, fmt.Errorf("invalid receive response from peer: %w", err)
+	}
+	return &replica, nil
+}
+
+// peerRetention is the policy mirrored to the receiver: the
+// destination's own, or else the one of the schedule that took the
+// snapshot
+func (r *Replicator) peerRetention(dest *Destination, snapshot *Snapshot) *RetentionPolicy {
+	if dest.Retention != nil {
+		retention := *dest.Retention
+		return &retention
+	}
+	if r.scheduler != nil && snapshot.ScheduleID != "" {
+		if schedule, err := r.scheduler.GetSchedule(snapshot.ScheduleID); err == nil {
+			retention := schedule.Retention
+			return &retention
+		}
+	}
+	return nil
+}
+
+func (r *Replicator) peerRequest(ctx context.Context, dest *Destination, method string, path string, body io.Reader, headers map[string]string) (*http.Response, error) {
+	if dest.CredentialsRef == "" {
+		return nil, fmt.Errorf("destination is not paired")
+	}
+	if !strings.HasPrefix(dest.Endpoint, "https://") {
+		return nil, fmt.Errorf("peer URL must be an https URL")
+	}
+	if dest.PeerFingerprint == "" {
+		return nil, fmt.Errorf("peer certificate is not pinned, pair the destination again")
+	}
+	token, err := os.ReadFile(filepath.Join(r.keysDir, dest.CredentialsRef))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read peer token: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(dest.Endpoint, "/")+PeerAPIPrefix+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	res, err := peerHTTPClient(dest.PeerFingerprint).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := peerResponseError(res); err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+	return res, nil
+}
+
+// peerHTTPClient trusts the certificate with the given fingerprint instead
+// of a CA, since NithronOS boxes usually have self-signed certificates.
+// Without a fingerprint no certificate is trusted.
+func peerHTTPClient(fingerprint string) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("peer sent no certificate")
+			}
+			if fingerprint == "" {
+				return fmt.Errorf("no certificate fingerprint is pinned for the peer")
+			}
+			if certFingerprint(rawCerts[0]) != fingerprint {
+				return fmt.Errorf("peer certificate does not match the pinned fingerprint")
+			}
+			return nil
+		},
+	}
+	return &http.Client{Transport: transport}
+}
+
+func peerResponseError(res *http.Response) error {
+	if res.StatusCode < 300 {
+		return nil
+	}
+	var body struct {
+		Error string `json:"error"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+	msg := strings.TrimSpace(string(data))
+	if json.Unmarshal(data, &body) == nil && body.Error != "" {
+		msg = body.Error
+	}
+	if res.StatusCode == http.StatusUnauthorized {
+		return fmt.Errorf("%w: %s", ErrPeerUnauthorized, msg)
+	}
+	return fmt.Errorf("peer returned %d: %s", res.StatusCode, msg)
+}
+
+// certFingerprint is the hex SHA-256 of a DER certificate
+func certFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// certFileFingerprint is the fingerprint of the first certificate in a
+// PEM file
+func certFileFingerprint(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return "", fmt.Errorf("no certificate in %s", path)
+		}
+		if block.Type == "CERTIFICATE" {
+			return certFingerprint(block.Bytes), nil
+		}
+	}
+}
+
+// normalizeFingerprint accepts a SHA-256 fingerprint in hex, with or
+// without colons, in either case
+func normalizeFingerprint(fingerprint string) (string, error) {
+	fp := strings.ToLower(strings.NewReplacer(":", "", " ", "").Replace(fingerprint))
+	if raw, err := hex.DecodeString(fp); err != nil || len(raw) != sha256.Size {
+		return "", fmt.Errorf("certificate fingerprint must be a hex SHA-256")
+	}
+	return fp, nil
+}
@@ -0,0 +1,279 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"nithronos/backend/nosd/pkg/agentclient"
+)
+
+// fakePeerAgent stands in for nos-agent's receive endpoints
+type fakePeerAgent struct {
+	mu         sync.Mutex
+	landings   map[string]int64
+	received   map[string][]byte
+	deleted    []string
+	generation int64
+}
+
+func newFakePeerAgent() *fakePeerAgent {
+	return &fakePeerAgent{landings: map[string]int64{}, received: map[string][]byte{}}
+}
+
+func (a *fakePeerAgent) EnsureLanding(ctx context.Context, path string, limitBytes int64) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.landings[path] = limitBytes
+	return nil
+}
+
+func (a *fakePeerAgent) Receive(ctx context.Context, landing string, dir string, stream io.Reader) (*agentclient.ReceivedSubvolume, error) {
+	data, err := io.ReadAll(stream)
+	if err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.generation++
+	name := fmt.Sprintf("snap-%d", a.generation)
+	path := filepath.Join(dir, name)
+	a.received[path] = data
+	return &agentclient.ReceivedSubvolume{Name: name, Path: path, UUID: "uuid-" + name, ReceivedUUID: "sent-" + name, Generation: a.generation, Bytes: int64(len(data))}, nil
+}
+
+func (a *fakePeerAgent) DeleteSubvolume(ctx context.Context, path string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.received, path)
+	a.deleted = append(a.deleted, path)
+	return nil
+}
+
+// peerTestServer serves a receiver's peer endpoints the way nosd does
+func peerTestServer(rc *Receiver) http.Handler {
+	mux := http.NewServeMux()
+	fail := func(w http.ResponseWriter, status int, err error) {
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+	}
+	auth := func(w http.ResponseWriter, r *http.Request) *Peer {
+		peer, err := rc.Authenticate(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		if err != nil {
+			fail(w, http.StatusUnauthorized, err)
+		}
+		return peer
+	}
+	mux.HandleFunc(PeerAPIPrefix+"/pair", func(w http.ResponseWriter, r *http.Request) {
+		var req struct{ Code, Name string }
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		peer, token, err := rc.Pair(r.Context(), req.Code, req.Name)
+		if err != nil {
+			fail(w, http.StatusUnauthorized, err)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"peer_id": peer.ID, "token": token, "name": "receiver"})
+	})
+	mux.HandleFunc(PeerAPIPrefix+"/inventory", func(w http.ResponseWriter, r *http.Request) {
+		if peer := auth(w, r); peer != nil {
+			inv, _ := rc.Inventory(peer.ID)
+			_ = json.NewEncoder(w).Encode(inv)
+		}
+	})
+	mux.HandleFunc(PeerAPIPrefix+"/receive", func(w http.ResponseWriter, r *http.Request) {
+		peer := auth(w, r)
+		if peer == nil {
+			return
+		}
+		var meta ReplicaMeta
+		_ = json.Unmarshal([]byte(r.URL.Query().Get("meta")), &meta)
+		replica, err := rc.Receive(r.Context(), peer, meta, r.Body)
+		if err != nil {
+			fail(w, http.StatusInternalServerError, err)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(replica)
+	})
+	return mux
+}
+
+func newPeerPair(t *testing.T, quota int64) (*Replicator, *Destination, *Receiver, *fakePeerAgent) {
+	t.Helper()
+	agent := newFakePeerAgent()
+	rc := NewReceiver(zerolog.Nop(), filepath.Join(t.TempDir(), "peers.json"), agent)
+	if err := rc.Start(); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewTLSServer(peerTestServer(rc))
+	t.Cleanup(srv.Close)
+	certFile := filepath.Join(t.TempDir(), "cert.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rc.UseCertificate(certFile)
+
+	dir := t.TempDir()
+	r := NewReplicator(zerolog.Nop(), filepath.Join(dir, "destinations.json"), filepath.Join(dir, "keys"), NewJobManager(zerolog.Nop()))
+	if err := r.Start(); err != nil {
+		t.Fatal(err)
+	}
+	dest := &Destination{Name: "nas2", Type: "nos", Enabled: true, Endpoint: srv.URL}
+	if err := r.CreateDestination(dest); err != nil {
+		t.Fatal(err)
+	}
+
+	code, err := rc.CreatePairingCode("/srv/pool", quota)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.PairDestination(context.Background(), dest.ID, strings.ToLower(code.Code), strings.ToUpper(code.Fingerprint)); err != nil {
+		t.Fatal(err)
+	}
+	return r, dest, rc, agent
+}
+
+func TestPeerPairingIsOneTime(t *testing.T) {
+	r, dest, rc, agent := newPeerPair(t, 1<<20)
+
+	if dest.PeerID == "" || dest.PeerFingerprint == "" || dest.CredentialsRef == "" {
+		t.Fatalf("pairing not recorded: %+v", dest)
+	}
+	if agent.landings["/srv/pool/.nos-replica"] != 1<<20 {
+		t.Errorf("landing not prepared with quota: %v", agent.landings)
+	}
+	if err := r.TestDestination(dest.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Codes can't be redeemed twice, and guessing revokes outstanding ones
+	code, _ := rc.CreatePairingCode("/srv/pool", 0)
+	if _, _, err := rc.Pair(context.Background(), code.Code, "x"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := rc.Pair(context.Background(), code.Code, "x"); !errors.Is(err, ErrInvalidPairingCode) {
+		t.Fatalf("second use: %v", err)
+	}
+	code, _ = rc.CreatePairingCode("/srv/pool", 0)
+	for i := 0; i < maxPairingFailures; i++ {
+		_, _, _ = rc.Pair(context.Background(), "WRONG-CODE"+fmt.Sprint(i), "x")
+	}
+	if _, _, err := rc.Pair(context.Background(), code.Code, "x"); !errors.Is(err, ErrInvalidPairingCode) {
+		t.Fatalf("code survived guessing: %v", err)
+	}
+
+	if _, err := rc.Authenticate(dest.PeerID + ".wrong"); !errors.Is(err, ErrPeerUnauthorized) {
+		t.Fatalf("wrong token accepted: %v", err)
+	}
+
+	// A changed certificate is refused
+	pinned := dest.PeerFingerprint
+	dest.PeerFingerprint = strings.Repeat("0", 64)
+	if err := r.TestDestination(dest.ID); err == nil {
+		t.Fatal("certificate pin not enforced")
+	}
+
+	// Tokens and streams never travel in cleartext
+	plain := &Destination{Name: "nas4", Type: "nos", Enabled: true, Endpoint: "http://nas4"}
+	if err := r.CreateDestination(plain); err == nil {
+		t.Fatal("accepted an http peer")
+	}
+
+	// Pairing needs the fingerprint shown with the code, and it must match
+	other := &Destination{Name: "nas3", Type: "nos", Enabled: true, Endpoint: dest.Endpoint}
+	if err := r.CreateDestination(other); err != nil {
+		t.Fatal(err)
+	}
+	code, _ = rc.CreatePairingCode("/srv/pool", 0)
+	if err := r.PairDestination(context.Background(), other.ID, code.Code, ""); err == nil {
+		t.Fatal("paired without a fingerprint")
+	}
+	if err := r.PairDestination(context.Background(), other.ID, code.Code, strings.Repeat("ab", 32)); err == nil {
+		t.Fatal("paired with a certificate that doesn't match the fingerprint")
+	}
+	if other.CredentialsRef != "" || code.Fingerprint != pinned {
+		t.Fatalf("destination %+v, fingerprint %s", other, code.Fingerprint)
+	}
+}
+
+func TestPeerReceiveMirrorsRetention(t *testing.T) {
+	r, dest, rc, agent := newPeerPair(t, 0)
+	ctx := context.Background()
+
+	// Five daily snapshots of @home, oldest first, under a two-day policy
+	now := time.Now()
+	for i := 4; i >= 0; i-- {
+		meta := ReplicaMeta{
+			SnapshotID: fmt.Sprintf("d%d", i),
+			Subvolume:  "@home",
+			CreatedAt:  now.Add(-time.Duration(i) * 24 * time.Hour),
+			Retention:  &RetentionPolicy{Days: 2},
+		}
+		replica, err := r.sendToPeer(ctx, dest, meta, strings.NewReader("stream "+meta.SnapshotID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(replica.Path, "/srv/pool/.nos-replica/"+dest.PeerID+"/@home/") {
+			t.Errorf("received into %s", replica.Path)
+		}
+	}
+
+	if _, err := r.sendToPeer(ctx, dest, ReplicaMeta{SnapshotID: "d0", Subvolume: "@home"}, strings.NewReader("again")); err == nil {
+		t.Error("the same snapshot was received twice")
+	}
+
+	inv, err := r.PeerInventory(ctx, dest.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kept []string
+	for _, replica := range inv.Replicas {
+		kept = append(kept, replica.SnapshotID)
+	}
+	if strings.Join(kept, ",") != "d0,d1" {
+		t.Errorf("kept %v, want d0,d1", kept)
+	}
+	if inv.LastGeneration != 5 || inv.LastReceivedAt == nil {
+		t.Errorf("last generation %d", inv.LastGeneration)
+	}
+	if len(agent.deleted) != 3 || len(agent.received) != 2 {
+		t.Errorf("deleted %v, %d left", agent.deleted, len(agent.received))
+	}
+
+	// The receiver keeps its state across restarts
+	rc2 := NewReceiver(zerolog.Nop(), rc.stateFile, agent)
+	if err := rc2.Start(); err != nil {
+		t.Fatal(err)
+	}
+	peers := rc2.ListPeers()
+	if len(peers) != 1 || len(peers[0].Replicas) != 2 || peers[0].Retention["@home"].Days != 2 {
+		t.Fatalf("reloaded %+v", peers)
+	}
+}
+
+func TestPeerReceiveQuota(t *testing.T) {
+	r, dest, _, agent := newPeerPair(t, 10)
+	ctx := context.Background()
+
+	if _, err := r.sendToPeer(ctx, dest, ReplicaMeta{SnapshotID: "big", Subvolume: "@home"}, strings.NewReader("more than ten bytes")); err == nil {
+		t.Fatal("stream over quota was accepted")
+	}
+	if _, err := r.sendToPeer(ctx, dest, ReplicaMeta{SnapshotID: "small", Subvolume: "@home"}, strings.NewReader("ok")); err != nil {
+		t.Fatal(err)
+	}
+	if len(agent.received) != 1 {
+		t.Errorf("%d subvolumes received", len(agent.received))
+	}
+}
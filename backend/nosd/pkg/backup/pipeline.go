@@ -0,0 +1,157 @@
+package backup
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Backup pipelines. A schedule with targets replicates the snapshots of
+// every run to its destinations. The run is tracked as a "backup" job
+// whose children are the snapshot job and one replicate job per target
+// and snapshot; the parent fails if any child does.
+
+// FailureNotifier is told about scheduled backups that failed
+type FailureNotifier interface {
+	BackupFailed(job *BackupJob, schedule *Schedule, message string)
+}
+
+// startPipeline registers the parent job of a scheduled run
+func (s *Scheduler) startPipeline(schedule *Schedule, snapshotJob *BackupJob) *BackupJob {
+	parent := &BackupJob{
+		ID:         uuid.New().String(),
+		Type:       "backup",
+		State:      JobStateRunning,
+		ScheduleID: schedule.ID,
+		Subvolumes: schedule.Subvolumes,
+		ChildIDs:   []string{snapshotJob.ID},
+		StartedAt:  time.Now(),
+	}
+	snapshotJob.ParentID = parent.ID
+	s.jobManager.AddJob(parent)
+	return parent
+}
+
+// runPipeline replicates the snapshots of a finished snapshot job to the
+// targets of its schedule, one at a time
+func (s *Scheduler) runPipeline(parent *BackupJob, snapshotJob *BackupJob, schedule *Schedule, snapshots []*Snapshot) {
+	var failures []string
+	if s.jobManager.JobState(snapshotJob.ID) != JobStateSucceeded {
+		failures = append(failures, fmt.Sprintf("snapshot: %s", snapshotJob.Error))
+	} else {
+		steps := 1 + len(schedule.Targets)*len(snapshots)
+		done := 1
+		for _, target := range schedule.Targets {
+			for _, snapshot := range snapshots {
+				if s.jobManager.JobState(parent.ID) == JobStateCanceled {
+					s.jobManager.AddLogEntry(parent.ID, "warn", "Backup canceled")
+					return
+				}
+				child := s.replicator.replicateTarget(parent.ID, target, snapshot)
+				s.jobManager.AddChild(parent.ID, child.ID)
+				if s.jobManager.JobState(child.ID) != JobStateSucceeded {
+					failures = append(failures, fmt.Sprintf("%s (%s): %s", s.replicator.destinationName(target.DestinationID), snapshot.Subvolume, child.Error))
+				}
+				done++
+				s.jobManager.UpdateProgress(parent.ID, done*100/steps, 0, 0)
+			}
+		}
+	}
+
+	if len(failures) > 0 {
+		errMsg := strings.Join(failures, "; ")
+		if s.jobManager.FinishJob(parent.ID, JobStateFailed, errMsg) {
+			s.jobManager.AddLogEntry(parent.ID, "error", errMsg)
+			s.notifyFailure(parent, schedule, errMsg)
+		}
+		return
+	}
+	if s.jobManager.FinishJob(parent.ID, JobStateSucceeded, "") {
+		s.jobManager.AddLogEntry(parent.ID, "info", fmt.Sprintf("Replicated %d snapshots to %d destinations", len(snapshots), len(schedule.Targets)))
+	}
+}
+
+func (s *Scheduler) notifyFailure(job *BackupJob, schedule *Schedule, message string) {
+	s.logger.Error().Str("job", job.ID).Str("schedule", schedule.Name).Str("error", message).Msg("Scheduled backup failed")
+	if s.notifier != nil {
+		s.notifier.BackupFailed(job, schedule, message)
+	}
+}
+
+// validateTargets checks the destinations of a schedule; the caller holds
+// s.mu
+func (s *Scheduler) validateTargets(targets []ScheduleTarget) error {
+	seen := make(map[string]bool)
+	for _, target := range targets {
+		if target.DestinationID == "" {
+			return fmt.Errorf("target destination is required")
+		}
+		if seen[target.DestinationID] {
+			return fmt.Errorf("destination %s is targeted twice", target.DestinationID)
+		}
+		seen[target.DestinationID] = true
+		if target.Retention != nil && target.Retention.MinKeep < 0 {
+			return fmt.Errorf("min_keep cannot be negative")
+		}
+		if s.replicator == nil {
+			continue
+		}
+		dest, err := s.replicator.GetDestination(target.DestinationID)
+		if err != nil {
+			return err
+		}
+		if target.Retention != nil && dest.Type != "repo" && dest.Type != "s3" && dest.Type != "nos" {
+			return fmt.Errorf("destination %s of type %s has no remote retention", dest.Name, dest.Type)
+		}
+	}
+	return nil
+}
+
+// replicateTarget replicates one snapshot of a pipeline and waits for it
+func (r *Replicator) replicateTarget(parentID string, target ScheduleTarget, snapshot *Snapshot) *BackupJob {
+	job := &BackupJob{
+		ID:            uuid.New().String(),
+		Type:          "replicate",
+		State:         JobStatePending,
+		ParentID:      parentID,
+		DestinationID: target.DestinationID,
+		SnapshotID:    snapshot.ID,
+		StartedAt:     time.Now(),
+	}
+	r.jobManager.AddJob(job)
+
+	r.mu.RLock()
+	dest, ok := r.destinations[target.DestinationID]
+	r.mu.RUnlock()
+	if !ok || !dest.Enabled {
+		now := time.Now()
+		job.State = JobStateFailed
+		job.Error = fmt.Sprintf("destination not found: %s", target.DestinationID)
+		if ok {
+			job.Error = "destination is disabled"
+		}
+		job.FinishedAt = &now
+		r.jobManager.UpdateJob(job)
+		return job
+	}
+
+	// The target's retention replaces the destination's for this run
+	if target.Retention != nil {
+		copied := *dest
+		retention := *target.Retention
+		copied.Retention = &retention
+		dest = &copied
+	}
+
+	r.runReplication(job, dest, snapshot.ID, "")
+	return job
+}
+
+func (r *Replicator) destinationName(destID string) string {
+	if dest, err := r.GetDestination(destID); err == nil {
+		return dest.Name
+	}
+	return destID
+}
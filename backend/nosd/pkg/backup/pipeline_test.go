@@ -0,0 +1,113 @@
+package backup
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+type recordingNotifier struct {
+	jobs     []*BackupJob
+	messages []string
+}
+
+func (n *recordingNotifier) BackupFailed(job *BackupJob, schedule *Schedule, message string) {
+	n.jobs = append(n.jobs, job)
+	n.messages = append(n.messages, message)
+}
+
+func TestSchedulePipeline(t *testing.T) {
+	r, dest, _, _ := newPeerPair(t, 0)
+	s, _ := newChainScheduler(t, r)
+	notifier := &recordingNotifier{}
+	s.UseNotifier(notifier)
+
+	schedule := &Schedule{
+		Name:       "nightly",
+		Subvolumes: []string{"@home"},
+		Frequency:  ScheduleFrequency{Type: "daily", Hour: 2},
+		Retention:  RetentionPolicy{MinKeep: 3},
+		Targets:    []ScheduleTarget{{DestinationID: dest.ID, Retention: &RetentionPolicy{Days: 7}}},
+	}
+	if err := s.CreateSchedule(schedule); err != nil {
+		t.Fatal(err)
+	}
+
+	// There is no btrfs here, so the snapshot is taken but can't be sent
+	s.runScheduledBackup(schedule.ID)
+
+	var parent *BackupJob
+	for _, job := range s.GetJobManager().ListJobs() {
+		if job.Type == "backup" {
+			parent = job
+		}
+	}
+	if parent == nil {
+		t.Fatal("no backup job")
+	}
+	if parent.State != JobStateFailed || !strings.Contains(parent.Error, "nas2 (@home)") {
+		t.Fatalf("backup job %s: %s", parent.State, parent.Error)
+	}
+	if len(parent.ChildIDs) != 2 {
+		t.Fatalf("children %v", parent.ChildIDs)
+	}
+	snapshotJob, _ := s.GetJobManager().GetJob(parent.ChildIDs[0])
+	if snapshotJob.Type != "snapshot" || snapshotJob.State != JobStateSucceeded || snapshotJob.ParentID != parent.ID {
+		t.Errorf("snapshot step %+v", snapshotJob)
+	}
+	replicateJob, _ := r.jobManager.GetJob(parent.ChildIDs[1])
+	if replicateJob.Type != "replicate" || replicateJob.DestinationID != dest.ID || replicateJob.ParentID != parent.ID {
+		t.Errorf("replicate step %+v", replicateJob)
+	}
+	if len(notifier.jobs) != 1 || notifier.jobs[0] != parent {
+		t.Fatalf("notified %d times", len(notifier.jobs))
+	}
+}
+
+func TestScheduleFailureNotifiesWithoutTargets(t *testing.T) {
+	r, _, _, _ := newPeerPair(t, 0)
+	s, agent := newChainScheduler(t, r)
+	notifier := &recordingNotifier{}
+	s.UseNotifier(notifier)
+	agent.createErr = errors.New("no space left on device")
+
+	schedule := &Schedule{Name: "hourly", Subvolumes: []string{"@home"}, Frequency: ScheduleFrequency{Type: "hourly"}}
+	if err := s.CreateSchedule(schedule); err != nil {
+		t.Fatal(err)
+	}
+	s.runScheduledBackup(schedule.ID)
+
+	if len(notifier.messages) != 1 || !strings.Contains(notifier.messages[0], "no space left") {
+		t.Fatalf("notified %v", notifier.messages)
+	}
+	if notifier.jobs[0].Type != "snapshot" {
+		t.Errorf("notified about a %s job", notifier.jobs[0].Type)
+	}
+}
+
+func TestScheduleTargetValidation(t *testing.T) {
+	r, dest, _, _ := newPeerPair(t, 0)
+	s, _ := newChainScheduler(t, r)
+	ssh := &Destination{Name: "offsite", Type: "ssh", Enabled: true, Host: "backup.example.com", User: "nos", Path: "/backups"}
+	if err := r.CreateDestination(ssh); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, targets := range map[string][]ScheduleTarget{
+		"unknown destination": {{DestinationID: "missing"}},
+		"duplicate target":    {{DestinationID: dest.ID}, {DestinationID: dest.ID}},
+		"retention on ssh":    {{DestinationID: ssh.ID, Retention: &RetentionPolicy{Days: 3}}},
+		"negative min_keep":   {{DestinationID: dest.ID, Retention: &RetentionPolicy{MinKeep: -1}}},
+		"missing destination": {{}},
+	} {
+		schedule := &Schedule{Name: name, Subvolumes: []string{"@home"}, Frequency: ScheduleFrequency{Type: "hourly"}, Targets: targets}
+		if err := s.CreateSchedule(schedule); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+
+	schedule := &Schedule{Name: "ok", Subvolumes: []string{"@home"}, Frequency: ScheduleFrequency{Type: "hourly"}, Targets: []ScheduleTarget{{DestinationID: ssh.ID}, {DestinationID: dest.ID}}}
+	if err := s.CreateSchedule(schedule); err != nil {
+		t.Fatal(err)
+	}
+}
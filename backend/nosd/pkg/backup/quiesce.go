@@ -0,0 +1,198 @@
+package backup
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"nithronos/backend/nosd/pkg/appsdk"
+)
+
+// Application-consistent snapshots. Before the snapshots of a job are
+// taken the scheduler runs the pre-hooks of its schedule and the
+// pre_backup quiesce hook of every app whose data the snapshots cover;
+// the matching post hooks run once the snapshots exist, in reverse order,
+// whether or not the job succeeded.
+
+// DefaultHookTimeout bounds a hook whose manifest sets no timeout
+const DefaultHookTimeout = 5 * time.Minute
+
+// maxHookOutputLines is how much of a hook's output lands in the job log
+const maxHookOutputLines = 20
+
+// AppQuiesce is an installed app whose data a snapshot covers
+type AppQuiesce struct {
+	AppID string
+	Hooks appsdk.QuiesceHooks
+}
+
+// QuiesceSource finds the apps whose data lies within the given subvolumes
+type QuiesceSource interface {
+	QuiesceTargets(subvolumes []string) []AppQuiesce
+}
+
+// UseQuiesceSource makes snapshots quiesce the apps they cover
+func (s *Scheduler) UseQuiesceSource(source QuiesceSource) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.quiesceSource = source
+}
+
+// hookStep is one unit that is quiesced before and resumed after the
+// snapshots: the schedule's own hooks or an app
+type hookStep struct {
+	name string
+	// appID is set for an app, whose hooks only run docker compose
+	// commands against its own project
+	appID   string
+	pre     []string
+	post    []string
+	timeout time.Duration
+}
+
+// quiesce runs the pre hooks of a snapshot job. The returned function runs
+// the post hooks of every step whose pre hooks were started, including a
+// step that failed part way; it is safe to call more than once.
+func (s *Scheduler) quiesce(job *BackupJob, subvolumes []string, schedule *Schedule) (func(), error) {
+	steps := s.hookSteps(subvolumes, schedule)
+	var started []hookStep
+	var once sync.Once
+	resume := func() {
+		once.Do(func() {
+			for i := len(started) - 1; i >= 0; i-- {
+				step := started[i]
+				for _, hook := range step.post {
+					if err := s.runHook(job, step, "post", hook); err != nil {
+						// Don't fail the job, but make sure nobody misses an app left paused
+						s.logger.Error().Err(err).Str("hook", hook).Str("step", step.name).Msg("Post-hook failed")
+					}
+				}
+			}
+		})
+	}
+
+	for _, step := range steps {
+		started = append(started, step)
+		for _, hook := range step.pre {
+			if err := s.runHook(job, step, "pre", hook); err != nil {
+				resume()
+				return resume, fmt.Errorf("%s pre-hook failed: %w", step.name, err)
+			}
+		}
+	}
+	return resume, nil
+}
+
+// hookSteps lists the schedule's hooks first, then the apps in the order
+// the source returns them
+func (s *Scheduler) hookSteps(subvolumes []string, schedule *Schedule) []hookStep {
+	var steps []hookStep
+	if schedule != nil && (len(schedule.PreHooks) > 0 || len(schedule.PostHooks) > 0) {
+		steps = append(steps, hookStep{
+			name:    "schedule",
+			pre:     schedule.PreHooks,
+			post:    schedule.PostHooks,
+			timeout: DefaultHookTimeout,
+		})
+	}
+
+	s.mu.RLock()
+	source := s.quiesceSource
+	s.mu.RUnlock()
+	if source == nil {
+		return steps
+	}
+	seen := make(map[string]bool)
+	for _, app := range source.QuiesceTargets(subvolumes) {
+		if seen[app.AppID] || (app.Hooks.PreBackup == "" && app.Hooks.PostBackup == "") {
+			continue
+		}
+		seen[app.AppID] = true
+		step := hookStep{
+			name:    "app " + app.AppID,
+			appID:   app.AppID,
+			timeout: DefaultHookTimeout,
+		}
+		if app.Hooks.PreBackup != "" {
+			step.pre = []string{app.Hooks.PreBackup}
+		}
+		if app.Hooks.PostBackup != "" {
+			step.post = []string{app.Hooks.PostBackup}
+		}
+		if app.Hooks.Timeout > 0 {
+			step.timeout = time.Duration(app.Hooks.Timeout) * time.Second
+		}
+		steps = append(steps, step)
+	}
+	return steps
+}
+
+// runHook runs one hook of a step and copies its output to the job log
+func (s *Scheduler) runHook(job *BackupJob, step hookStep, phase string, hook string) error {
+	s.logger.Info().Str("hook", hook).Str("step", step.name).Msgf("Running %s-hook", phase)
+	s.jobManager.AddLogEntry(job.ID, "info", fmt.Sprintf("Running %s %s-hook: %s", step.name, phase, hook))
+
+	// Hooks stop containers and dump databases as root, so the agent
+	// runs them
+	ctx, cancel := context.WithTimeout(context.Background(), step.timeout)
+	defer cancel()
+	started := time.Now()
+	var out []byte
+	var err error
+	if step.appID != "" {
+		out, err = s.runAppHook(ctx, step.appID, hook)
+	} else {
+		out, err = s.agentClient.ExecuteHook(ctx, hook)
+	}
+
+	level := "info"
+	if err != nil {
+		level = "error"
+	}
+	s.logHookOutput(job, step, phase, out, level)
+	if err != nil {
+		s.jobManager.AddLogEntry(job.ID, "error", fmt.Sprintf("%s %s-hook failed after %s: %v", step.name, phase, time.Since(started).Round(time.Millisecond), err))
+		return err
+	}
+	return nil
+}
+
+// runAppHook runs the compose commands of an app's quiesce hook in turn,
+// stopping at the first that fails. App hooks come from catalogs, so they
+// never run in a shell on the host.
+func (s *Scheduler) runAppHook(ctx context.Context, appID string, hook string) ([]byte, error) {
+	commands, err := appsdk.ParseQuiesceHook(hook)
+	if err != nil {
+		return nil, err
+	}
+	var output []byte
+	for _, cmd := range commands {
+		out, err := s.agentClient.ExecuteAppHook(ctx, appID, cmd)
+		output = append(output, out...)
+		if err != nil {
+			return output, err
+		}
+	}
+	return output, nil
+}
+
+// logHookOutput adds the last lines of a hook's output to the job log
+func (s *Scheduler) logHookOutput(job *BackupJob, step hookStep, phase string, out []byte, level string) {
+	var lines []string
+	scanner := bufio.NewScanner(strings.NewReader(string(out)))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if skipped := len(lines) - maxHookOutputLines; skipped > 0 {
+		s.jobManager.AddLogEntry(job.ID, level, fmt.Sprintf("[%s %s] ... %d lines omitted", step.name, phase, skipped))
+		lines = lines[skipped:]
+	}
+	for _, line := range lines {
+		s.jobManager.AddLogEntry(job.ID, level, fmt.Sprintf("[%s %s] %s", step.name, phase, line))
+	}
+}
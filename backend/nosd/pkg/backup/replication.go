@@ -2,6 +2,7 @@ package backup
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -23,6 +24,13 @@ type Replicator struct {
 	keysDir      string
 	mu           sync.RWMutex
 	jobManager   *JobManager
+	scheduler    *Scheduler
+	replicated   map[string][]*ReplicatedSnapshot // by destination ID
+	notifier     VerifyNotifier
+	stop         chan struct{}
+	stopOnce     sync.Once
+	// mount mounts a local snapshot for restore drills; tests replace it
+	mount        func(jobID string, snapshotPath string) (string, func(), error)
 }
 
 // NewReplicator creates a new replicator
@@ -30,12 +38,24 @@ func NewReplicator(logger zerolog.Logger, stateFile string, keysDir string, jobM
 	return &Replicator{
 		logger:       logger.With().Str("component", "replicator").Logger(),
 		destinations: make(map[string]*Destination),
+		replicated:   make(map[string][]*ReplicatedSnapshot),
 		stateFile:    stateFile,
 		keysDir:      keysDir,
 		jobManager:   jobManager,
+		stop:         make(chan struct{}),
 	}
 }
 
+// UseScheduler lets replication jobs look up the local snapshots they
+// send; retention of the scheduler then keeps the last snapshot each
+// destination has in common with this box, and schedules with targets
+// replicate through this replicator
+func (r *Replicator) UseScheduler(scheduler *Scheduler) {
+	r.scheduler = scheduler
+	scheduler.UseSnapshotGuard(r)
+	scheduler.replicator = r
+}
+
 // Start initializes the replicator
 func (r *Replicator) Start() error {
 	// Create keys directory if it doesn't exist
@@ -48,11 +68,15 @@ func (r *Replicator) Start() error {
 		r.logger.Warn().Err(err).Msg("Failed to load replicator state")
 	}
 	
+	// Run scheduled verifications
+	go r.verifyLoop()
+	
 	return nil
 }
 
 // Stop shuts down the replicator
 func (r *Replicator) Stop() error {
+	r.stopOnce.Do(func() { close(r.stop) })
 	return r.saveState()
 }
 
@@ -80,6 +104,9 @@ func (r *Replicator) CreateDestination(dest *Destination) error {
 	if dest.Type == "ssh" && dest.Port == 0 {
 		dest.Port = 22
 	}
+	if dest.Type == "s3" && dest.Region == "" {
+		dest.Region = "us-east-1"
+	}
 	if dest.RetryCount == 0 {
 		dest.RetryCount = 3
 	}
@@ -91,7 +118,7 @@ func (r *Replicator) CreateDestination(dest *Destination) error {
 	r.destinations[dest.ID] = dest
 	
 	// Save state
-	if err := r.saveState(); err != nil {
+	if err := r.saveStateLocked(); err != nil {
 		return fmt.Errorf("failed to save state: %w", err)
 	}
 	
@@ -113,6 +140,19 @@ func (r *Replicator) UpdateDestination(id string, update *Destination) error {
 	update.ID = existing.ID
 	update.CreatedAt = existing.CreatedAt
 	update.UpdatedAt = time.Now()
+	if update.PasswordRef == "" {
+		update.PasswordRef = existing.PasswordRef
+	}
+	if update.CredentialsRef == "" {
+		update.CredentialsRef = existing.CredentialsRef
+	}
+	update.RepoID = existing.RepoID
+	update.PeerID = existing.PeerID
+	update.PeerName = existing.PeerName
+	if update.PeerFingerprint == "" {
+		update.PeerFingerprint = existing.PeerFingerprint
+	}
+	update.Health = existing.Health
 	
 	// Validate
 	if err := r.validateDestination(update); err != nil {
@@ -123,7 +163,7 @@ func (r *Replicator) UpdateDestination(id string, update *Destination) error {
 	r.destinations[id] = update
 	
 	// Save state
-	if err := r.saveState(); err != nil {
+	if err := r.saveStateLocked(); err != nil {
 		return fmt.Errorf("failed to save state: %w", err)
 	}
 	
@@ -149,11 +189,26 @@ func (r *Replicator) DeleteDestination(id string) error {
 		}
 	}
 	
+	// Delete the repository password; the repository itself is kept
+	if dest.PasswordRef != "" {
+		if err := os.Remove(filepath.Join(r.keysDir, dest.PasswordRef)); err != nil && !os.IsNotExist(err) {
+			r.logger.Warn().Err(err).Str("destination", id).Msg("Failed to delete repository password")
+		}
+	}
+	
+	// Delete the S3 secret key or peer token; the stored data is kept
+	if dest.CredentialsRef != "" {
+		if err := os.Remove(filepath.Join(r.keysDir, dest.CredentialsRef)); err != nil && !os.IsNotExist(err) {
+			r.logger.Warn().Err(err).Str("destination", id).Msg("Failed to delete destination credentials")
+		}
+	}
+	
 	// Delete destination
 	delete(r.destinations, id)
+	delete(r.replicated, id)
 	
 	// Save state
-	if err := r.saveState(); err != nil {
+	if err := r.saveStateLocked(); err != nil {
 		return fmt.Errorf("failed to save state: %w", err)
 	}
 	
@@ -205,6 +260,12 @@ func (r *Replicator) TestDestination(id string) error {
 		err = r.testRcloneDestination(dest)
 	case "local":
 		err = r.testLocalDestination(dest)
+	case "repo":
+		err = r.testRepoDestination(dest)
+	case "s3":
+		err = r.testS3Destination(dest)
+	case "nos":
+		err = r.testPeerDestination(dest)
 	default:
 		err = fmt.Errorf("unsupported destination type: %s", dest.Type)
 	}
@@ -262,6 +323,64 @@ func (r *Replicator) Replicate(destID string, snapshotID string, baseSnapshotID
 
 // Private methods
 
+func (r *Replicator) destinationOfType(destID string, destType string) (*Destination, error) {
+	r.mu.RLock()
+	dest, ok := r.destinations[destID]
+	r.mu.RUnlock()
+	
+	if !ok {
+		return nil, fmt.Errorf("destination not found: %s", destID)
+	}
+	if dest.Type != destType {
+		return nil, fmt.Errorf("destination is not of type %s", destType)
+	}
+	return dest, nil
+}
+
+// startDestinationJob runs a maintenance job against a destination
+func (r *Replicator) startDestinationJob(dest *Destination, jobType string, run func(ctx context.Context, job *BackupJob) error) *BackupJob {
+	job := &BackupJob{
+		ID:            uuid.New().String(),
+		Type:          jobType,
+		State:         JobStatePending,
+		DestinationID: dest.ID,
+		StartedAt:     time.Now(),
+	}
+	r.jobManager.AddJob(job)
+	
+	go func() {
+		job.State = JobStateRunning
+		r.jobManager.UpdateJob(job)
+		
+		ctx, cancel := r.jobContext(job.ID)
+		defer cancel()
+		err := run(ctx, job)
+		
+		now := time.Now()
+		job.FinishedAt = &now
+		switch {
+		case err != nil && job.State == JobStateCanceled:
+			r.jobManager.AddLogEntry(job.ID, "warn", "Job canceled")
+		case err != nil:
+			job.State = JobStateFailed
+			job.Error = err.Error()
+			r.jobManager.AddLogEntry(job.ID, "error", err.Error())
+			r.logger.Error().Err(err).Str("job", job.ID).Str("type", jobType).Msg("Destination job failed")
+		default:
+			job.State = JobStateSucceeded
+			job.Progress = 100
+		}
+		r.jobManager.UpdateJob(job)
+	}()
+	
+	return job
+}
+
+// jobContext returns a context that is canceled once the job is
+func (r *Replicator) jobContext(jobID string) (context.Context, context.CancelFunc) {
+	return r.jobManager.JobContext(jobID)
+}
+
 func (r *Replicator) validateDestination(dest *Destination) error {
 	if dest.Name == "" {
 		return fmt.Errorf("destination name is required")
@@ -289,11 +408,34 @@ func (r *Replicator) validateDestination(dest *Destination) error {
 		if dest.Path == "" {
 			return fmt.Errorf("local path is required")
 		}
+	case "repo":
+		if dest.Path == "" && (dest.RemoteName == "" || dest.RemotePath == "") {
+			return fmt.Errorf("repository path or rclone remote is required")
+		}
+	case "s3":
+		if dest.Bucket == "" {
+			return fmt.Errorf("S3 bucket is required")
+		}
+		if dest.Endpoint != "" && !strings.HasPrefix(dest.Endpoint, "https://") && !strings.HasPrefix(dest.Endpoint, "http://") {
+			return fmt.Errorf("S3 endpoint must be an http or https URL")
+		}
+	case "nos":
+		// The pairing token and the streams must not travel in cleartext
+		if !strings.HasPrefix(dest.Endpoint, "https://") {
+			return fmt.Errorf("peer URL must be an https URL")
+		}
+		if dest.PeerFingerprint != "" {
+			fp, err := normalizeFingerprint(dest.PeerFingerprint)
+			if err != nil {
+				return err
+			}
+			dest.PeerFingerprint = fp
+		}
 	default:
 		return fmt.Errorf("invalid destination type: %s", dest.Type)
 	}
 	
-	return nil
+	return validateVerifyPolicy(dest)
 }
 
 func (r *Replicator) testSSHDestination(dest *Destination) error {
@@ -379,27 +521,44 @@ func (r *Replicator) runReplication(job *BackupJob, dest *Destination, snapshotI
 	// Log start
 	r.jobManager.AddLogEntry(job.ID, "info", fmt.Sprintf("Starting replication to %s", dest.Name))
 	
-	// TODO: Get snapshot details from snapshot manager
-	// For now, use placeholder paths
-	snapshotPath := fmt.Sprintf("@snapshots/test/%s", snapshotID)
-	
+	var snapshot *Snapshot
 	var err error
-	switch dest.Type {
-	case "ssh":
-		err = r.replicateSSH(job, dest, snapshotPath, baseSnapshotID)
-	case "rclone":
-		err = r.replicateRclone(job, dest, snapshotPath)
-	case "local":
-		err = r.replicateLocal(job, dest, snapshotPath, baseSnapshotID)
-	default:
-		err = fmt.Errorf("unsupported destination type: %s", dest.Type)
+	if r.scheduler == nil {
+		err = fmt.Errorf("no local snapshots available")
+	} else {
+		snapshot, err = r.scheduler.GetSnapshot(snapshotID)
+	}
+	if err != nil {
+		now := time.Now()
+		job.FinishedAt = &now
+		job.State = JobStateFailed
+		job.Error = err.Error()
+		r.jobManager.AddLogEntry(job.ID, "error", fmt.Sprintf("Replication failed: %v", err))
+		r.jobManager.UpdateJob(job)
+		return
+	}
+	snapshotPath := snapshot.Path
+	
+	// Without an explicit base, continue the chain the destination holds
+	if baseSnapshotID == "" && incrementalDestination(dest.Type) {
+		baseSnapshotID = r.selectBase(job, dest, snapshot)
+		job.Incremental = baseSnapshotID != ""
+		job.BaseSnapshot = baseSnapshotID
+	}
+	
+	err = r.replicateSnapshot(job, dest, snapshot, snapshotPath, baseSnapshotID)
+	if err == nil {
+		r.recordReplicated(dest.ID, snapshot)
 	}
 	
 	// Update job state
 	now := time.Now()
 	job.FinishedAt = &now
 	
-	if err != nil {
+	if err != nil && job.State == JobStateCanceled {
+		r.jobManager.AddLogEntry(job.ID, "warn", "Replication canceled")
+		r.logger.Info().Str("job", job.ID).Msg("Replication canceled")
+	} else if err != nil {
 		job.State = JobStateFailed
 		job.Error = err.Error()
 		r.jobManager.AddLogEntry(job.ID, "error", fmt.Sprintf("Replication failed: %v", err))
@@ -414,13 +573,36 @@ func (r *Replicator) runReplication(job *BackupJob, dest *Destination, snapshotI
 	r.jobManager.UpdateJob(job)
 }
 
+// replicateSnapshot sends one snapshot with the method of the destination
+func (r *Replicator) replicateSnapshot(job *BackupJob, dest *Destination, snapshot *Snapshot, snapshotPath string, baseSnapshotID string) error {
+	switch dest.Type {
+	case "ssh":
+		return r.replicateSSH(job, dest, snapshotPath, baseSnapshotID)
+	case "rclone":
+		return r.replicateRclone(job, dest, snapshotPath)
+	case "local":
+		return r.replicateLocal(job, dest, snapshotPath, baseSnapshotID)
+	case "repo":
+		return r.replicateRepo(job, dest, snapshot)
+	case "s3":
+		return r.replicateS3(job, dest, snapshot, baseSnapshotID)
+	case "nos":
+		return r.replicatePeer(job, dest, snapshot, baseSnapshotID)
+	default:
+		return fmt.Errorf("unsupported destination type: %s", dest.Type)
+	}
+}
+
 func (r *Replicator) replicateSSH(job *BackupJob, dest *Destination, snapshotPath string, baseSnapshotID string) error {
 	// Build btrfs send command
 	sendArgs := []string{"send"}
 	
 	// Add parent for incremental
 	if baseSnapshotID != "" {
-		parentPath := fmt.Sprintf("@snapshots/test/%s", baseSnapshotID)
+		parentPath, err := r.snapshotPath(baseSnapshotID)
+		if err != nil {
+			return fmt.Errorf("base snapshot: %w", err)
+		}
 		sendArgs = append(sendArgs, "-p", parentPath)
 	}
 	
@@ -528,19 +710,11 @@ func (r *Replicator) replicateRclone(job *BackupJob, dest *Destination, snapshot
 		return fmt.Errorf("rclone not found: %w", err)
 	}
 	
-	// Create temporary mount point
-	mountPoint := fmt.Sprintf("/tmp/backup-mount-%s", job.ID)
-	if err := os.MkdirAll(mountPoint, 0755); err != nil {
-		return fmt.Errorf("failed to create mount point: %w", err)
-	}
-	defer os.RemoveAll(mountPoint)
-	
-	// Mount snapshot read-only
-	mountCmd := exec.Command("mount", "-o", "ro,subvol="+snapshotPath, "/dev/mapper/nos-root", mountPoint)
-	if err := mountCmd.Run(); err != nil {
-		return fmt.Errorf("failed to mount snapshot: %w", err)
+	mountPoint, unmount, err := mountSnapshot(job.ID, snapshotPath)
+	if err != nil {
+		return err
 	}
-	defer func() { _ = exec.Command("umount", mountPoint).Run() }()
+	defer unmount()
 	
 	// Build rclone command
 	rcloneArgs := []string{
@@ -595,13 +769,37 @@ func (r *Replicator) replicateRclone(job *BackupJob, dest *Destination, snapshot
 	return nil
 }
 
+// mountSnapshot mounts a snapshot read-only under a temporary mount point
+func mountSnapshot(jobID string, snapshotPath string) (string, func(), error) {
+	// Create temporary mount point
+	mountPoint := fmt.Sprintf("/tmp/backup-mount-%s", jobID)
+	if err := os.MkdirAll(mountPoint, 0755); err != nil {
+		return "", nil, fmt.Errorf("failed to create mount point: %w", err)
+	}
+	
+	// Mount snapshot read-only
+	mountCmd := exec.Command("mount", "-o", "ro,subvol="+snapshotPath, "/dev/mapper/nos-root", mountPoint)
+	if err := mountCmd.Run(); err != nil {
+		os.RemoveAll(mountPoint)
+		return "", nil, fmt.Errorf("failed to mount snapshot: %w", err)
+	}
+	
+	return mountPoint, func() {
+		_ = exec.Command("umount", mountPoint).Run()
+		os.RemoveAll(mountPoint)
+	}, nil
+}
+
 func (r *Replicator) replicateLocal(job *BackupJob, dest *Destination, snapshotPath string, baseSnapshotID string) error {
 	// For local replication, use btrfs send/receive to local path
 	sendArgs := []string{"send"}
 	
 	// Add parent for incremental
 	if baseSnapshotID != "" {
-		parentPath := fmt.Sprintf("@snapshots/test/%s", baseSnapshotID)
+		parentPath, err := r.snapshotPath(baseSnapshotID)
+		if err != nil {
+			return fmt.Errorf("base snapshot: %w", err)
+		}
 		sendArgs = append(sendArgs, "-p", parentPath)
 	}
 	
@@ -656,7 +854,8 @@ func (r *Replicator) loadState() error {
 	}
 	
 	var state struct {
-		Destinations map[string]*Destination `json:"destinations"`
+		Destinations map[string]*Destination          `json:"destinations"`
+		Replicated   map[string][]*ReplicatedSnapshot `json:"replicated"`
 	}
 	
 	if err := json.Unmarshal(data, &state); err != nil {
@@ -664,22 +863,33 @@ func (r *Replicator) loadState() error {
 	}
 	
 	r.destinations = state.Destinations
+	r.replicated = state.Replicated
 	
 	if r.destinations == nil {
 		r.destinations = make(map[string]*Destination)
 	}
+	if r.replicated == nil {
+		r.replicated = make(map[string][]*ReplicatedSnapshot)
+	}
 	
 	return nil
 }
 
 func (r *Replicator) saveState() error {
 	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.saveStateLocked()
+}
+
+// saveStateLocked writes the state; the caller holds r.mu
+func (r *Replicator) saveStateLocked() error {
 	state := struct {
-		Destinations map[string]*Destination `json:"destinations"`
+		Destinations map[string]*Destination          `json:"destinations"`
+		Replicated   map[string][]*ReplicatedSnapshot `json:"replicated,omitempty"`
 	}{
 		Destinations: r.destinations,
+		Replicated:   r.replicated,
 	}
-	r.mu.RUnlock()
 	
 	data, err := json.MarshalIndent(state, "", "  ")
 	if err != nil {
@@ -722,5 +932,5 @@ func (r *Replicator) StoreSSHKey(destID string, keyContent string) error {
 	}
 	
 	// Save state
-	return r.saveState()
+	return r.saveStateLocked()
 }
@@ -0,0 +1,211 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Backend stores the files of a repository. Names are slash-separated paths
+// relative to the repository root, such as "data/3f/3fa4...". Files are
+// written once and never modified, so backends need no partial writes.
+type Backend interface {
+	// Save writes a file, replacing any previous content
+	Save(ctx context.Context, name string, data []byte) error
+	// Load reads a whole file. Missing files return an error matching
+	// fs.ErrNotExist.
+	Load(ctx context.Context, name string) ([]byte, error)
+	// LoadRange reads length bytes at offset of a file
+	LoadRange(ctx context.Context, name string, offset, length int64) ([]byte, error)
+	// List returns the names of all files below dir
+	List(ctx context.Context, dir string) ([]string, error)
+	// Remove deletes a file; removing a missing file is not an error
+	Remove(ctx context.Context, name string) error
+}
+
+// LocalBackend keeps a repository in a local directory, such as a USB disk
+// or a mounted network share
+type LocalBackend struct {
+	root string
+}
+
+// NewLocalBackend returns a backend rooted at dir
+func NewLocalBackend(dir string) *LocalBackend {
+	return &LocalBackend{root: dir}
+}
+
+func (b *LocalBackend) path(name string) string {
+	return filepath.Join(b.root, filepath.FromSlash(name))
+}
+
+// Save writes the file through a temporary file so readers never see a
+// partial one
+func (b *LocalBackend) Save(ctx context.Context, name string, data []byte) error {
+	p := b.path(name)
+	if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+// Load reads a whole file
+func (b *LocalBackend) Load(ctx context.Context, name string) ([]byte, error) {
+	return os.ReadFile(b.path(name))
+}
+
+// LoadRange reads part of a file
+func (b *LocalBackend) LoadRange(ctx context.Context, name string, offset, length int64) ([]byte, error) {
+	f, err := os.Open(b.path(name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	buf := make([]byte, length)
+	if _, err := f.ReadAt(buf, offset); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	return buf, nil
+}
+
+// List returns the files below dir, skipping temporary files
+func (b *LocalBackend) List(ctx context.Context, dir string) ([]string, error) {
+	var names []string
+	err := filepath.WalkDir(b.path(dir), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".tmp-") {
+			return nil
+		}
+		rel, err := filepath.Rel(b.root, p)
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(rel))
+		return nil
+	})
+	return names, err
+}
+
+// Remove deletes a file
+func (b *LocalBackend) Remove(ctx context.Context, name string) error {
+	if err := os.Remove(b.path(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// RcloneBackend keeps a repository on any remote rclone is configured for,
+// which covers the common object stores
+type RcloneBackend struct {
+	remote         string // "name:path"
+	bandwidthLimit int    // KB/s, 0 for none
+}
+
+// NewRcloneBackend returns a backend for path on an rclone remote.
+// bandwidthLimit caps transfers in KB/s.
+func NewRcloneBackend(remoteName, remotePath string, bandwidthLimit int) *RcloneBackend {
+	return &RcloneBackend{
+		remote:         remoteName + ":" + strings.TrimSuffix(remotePath, "/"),
+		bandwidthLimit: bandwidthLimit,
+	}
+}
+
+func (b *RcloneBackend) run(ctx context.Context, stdin io.Reader, args ...string) ([]byte, error) {
+	if b.bandwidthLimit > 0 {
+		args = append(args, "--bwlimit", fmt.Sprintf("%dk", b.bandwidthLimit))
+	}
+	cmd := exec.CommandContext(ctx, "rclone", args...)
+	cmd.Stdin = stdin
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if strings.Contains(msg, "not found") {
+			return nil, fmt.Errorf("rclone %s: %w", args[0], fs.ErrNotExist)
+		}
+		return nil, fmt.Errorf("rclone %s failed: %w: %s", args[0], err, msg)
+	}
+	return stdout.Bytes(), nil
+}
+
+func (b *RcloneBackend) path(name string) string {
+	return b.remote + "/" + name
+}
+
+// Save uploads a file
+func (b *RcloneBackend) Save(ctx context.Context, name string, data []byte) error {
+	_, err := b.run(ctx, bytes.NewReader(data), "rcat", b.path(name))
+	return err
+}
+
+// Load downloads a file
+func (b *RcloneBackend) Load(ctx context.Context, name string) ([]byte, error) {
+	return b.run(ctx, nil, "cat", b.path(name))
+}
+
+// LoadRange downloads part of a file
+func (b *RcloneBackend) LoadRange(ctx context.Context, name string, offset, length int64) ([]byte, error) {
+	data, err := b.run(ctx, nil, "cat", "--offset", fmt.Sprint(offset), "--count", fmt.Sprint(length), b.path(name))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != length {
+		return nil, fmt.Errorf("short read of %s: %d of %d bytes", name, len(data), length)
+	}
+	return data, nil
+}
+
+// List returns the files below dir
+func (b *RcloneBackend) List(ctx context.Context, dir string) ([]string, error) {
+	out, err := b.run(ctx, nil, "lsf", "-R", "--files-only", b.path(dir))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var names []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			names = append(names, path.Join(dir, line))
+		}
+	}
+	return names, nil
+}
+
+// Remove deletes a file
+func (b *RcloneBackend) Remove(ctx context.Context, name string) error {
+	if _, err := b.run(ctx, nil, "deletefile", b.path(name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,353 @@
+package repo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	nosync "nithronos/backend/nosd/pkg/sync"
+)
+
+// NodeType is the kind of a tree entry
+type NodeType string
+
+// Node types
+const (
+	NodeFile    NodeType = "file"
+	NodeDir     NodeType = "dir"
+	NodeSymlink NodeType = "symlink"
+)
+
+// Node is a file, directory or symlink in a snapshot
+type Node struct {
+	Name       string      `json:"name"`
+	Type       NodeType    `json:"type"`
+	Mode       fs.FileMode `json:"mode"`
+	ModTime    time.Time   `json:"mtime"`
+	UID        uint32      `json:"uid,omitempty"`
+	GID        uint32      `json:"gid,omitempty"`
+	Size       int64       `json:"size,omitempty"`
+	Content    []string    `json:"content,omitempty"`     // data blobs of a file, in order
+	Subtree    string      `json:"subtree,omitempty"`     // tree blob of a directory
+	LinkTarget string      `json:"link_target,omitempty"` // target of a symlink
+}
+
+// tree is a directory listing, sorted by name
+type tree struct {
+	Nodes []*Node `json:"nodes"`
+}
+
+func (t *tree) find(name string) *Node {
+	i := sort.Search(len(t.Nodes), func(i int) bool { return t.Nodes[i].Name >= name })
+	if i < len(t.Nodes) && t.Nodes[i].Name == name {
+		return t.Nodes[i]
+	}
+	return nil
+}
+
+// loadTree reads a tree blob
+func (r *Repository) loadTree(ctx context.Context, id string) (*tree, error) {
+	data, err := r.loadBlob(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	var t tree
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, fmt.Errorf("invalid tree %s: %w", id, err)
+	}
+	return &t, nil
+}
+
+// BackupOptions control a backup
+type BackupOptions struct {
+	// Source names what is backed up, e.g. the subvolume. Snapshots of the
+	// same source form one history for incremental runs and retention;
+	// it defaults to the directory.
+	Source string
+	// SourceSnapshot is the local snapshot the directory belongs to
+	SourceSnapshot string
+	Tags           []string
+	// Parent is the snapshot to compare with. Files whose size and
+	// modification time are unchanged are not read again. It defaults to
+	// the latest snapshot of the source.
+	Parent string
+	// Progress is called after each file
+	Progress func(BackupProgress)
+	// Warn is called for files that cannot be backed up; the backup goes on
+	Warn func(path string, err error)
+}
+
+// BackupProgress reports how far a backup got
+type BackupProgress struct {
+	Files int    `json:"files"`
+	Bytes int64  `json:"bytes"`
+	Path  string `json:"path"`
+}
+
+// BackupStats summarizes a backup
+type BackupStats struct {
+	Files        int   `json:"files"`
+	Dirs         int   `json:"dirs"`
+	Bytes        int64 `json:"bytes"`         // size of all files
+	ChangedFiles int   `json:"changed_files"` // files read since the parent
+	NewBlobs     int   `json:"new_blobs"`
+	AddedBytes   int64 `json:"added_bytes"` // stored after dedup and compression
+	Skipped      int   `json:"skipped"`
+}
+
+// errSkip marks a file or directory that could not be read; the backup
+// skips it and goes on
+type errSkip struct{ err error }
+
+func (e errSkip) Error() string { return e.err.Error() }
+
+type archiver struct {
+	r     *Repository
+	opts  BackupOptions
+	stats BackupStats
+}
+
+// Backup stores the directory tree at dir as a new snapshot. Unchanged
+// content is not stored again, so each run only adds what changed.
+func (r *Repository) Backup(ctx context.Context, dir string, opts BackupOptions) (*Snapshot, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	if opts.Source == "" {
+		opts.Source = dir
+	}
+	unlock, err := r.lock(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	host, _ := os.Hostname()
+	var parentTree *tree
+	parent, err := r.findParent(ctx, host, opts)
+	if err != nil {
+		return nil, err
+	}
+	if parent != nil {
+		if parentTree, err = r.loadTree(ctx, parent.Tree); err != nil {
+			return nil, fmt.Errorf("failed to load parent snapshot %s: %w", parent.ID, err)
+		}
+	}
+
+	a := &archiver{r: r, opts: opts}
+	root, err := a.archiveDir(ctx, dir, "", parentTree)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.flush(ctx); err != nil {
+		return nil, err
+	}
+
+	snap := &Snapshot{
+		ID:             newID(),
+		Time:           time.Now().UTC(),
+		Host:           host,
+		Source:         opts.Source,
+		SourceSnapshot: opts.SourceSnapshot,
+		Tags:           opts.Tags,
+		Tree:           root,
+		Stats:          a.stats,
+	}
+	if parent != nil {
+		snap.Parent = parent.ID
+	}
+	if err := r.saveJSON(ctx, "snapshots/"+snap.ID, snap); err != nil {
+		return nil, fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	return snap, nil
+}
+
+// findParent returns the snapshot unchanged files are taken from
+func (r *Repository) findParent(ctx context.Context, host string, opts BackupOptions) (*Snapshot, error) {
+	if opts.Parent != "" {
+		return r.LoadSnapshot(ctx, opts.Parent)
+	}
+	list, err := r.Snapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range list {
+		if s.Source == opts.Source && s.Host == host {
+			return s, nil
+		}
+	}
+	return nil, nil
+}
+
+func (a *archiver) warn(rel string, err error) {
+	a.stats.Skipped++
+	if a.opts.Warn != nil {
+		a.opts.Warn(rel, err)
+	}
+}
+
+// archiveDir stores a directory and everything below it and returns its
+// tree blob
+func (a *archiver) archiveDir(ctx context.Context, dir, rel string, parent *tree) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", errSkip{err}
+	}
+	t := &tree{Nodes: make([]*Node, 0, len(entries))}
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		p := filepath.Join(dir, e.Name())
+		relPath := path.Join(rel, e.Name())
+		info, err := e.Info()
+		if err != nil {
+			a.warn(relPath, err)
+			continue
+		}
+		node := &Node{
+			Name:    e.Name(),
+			Mode:    info.Mode(),
+			ModTime: info.ModTime().UTC(),
+		}
+		if uid, gid, ok := fileOwner(info); ok {
+			node.UID, node.GID = uid, gid
+		}
+		var prev *Node
+		if parent != nil {
+			prev = parent.find(e.Name())
+		}
+
+		switch {
+		case info.Mode().IsRegular():
+			node.Type = NodeFile
+			node.Size = info.Size()
+			if err := a.archiveFile(ctx, p, node, prev); err != nil {
+				var skip errSkip
+				if errors.As(err, &skip) {
+					a.warn(relPath, skip.err)
+					continue
+				}
+				return "", err
+			}
+			a.stats.Files++
+			a.stats.Bytes += node.Size
+			if a.opts.Progress != nil {
+				a.opts.Progress(BackupProgress{Files: a.stats.Files, Bytes: a.stats.Bytes, Path: relPath})
+			}
+
+		case info.IsDir():
+			node.Type = NodeDir
+			var prevTree *tree
+			if prev != nil && prev.Type == NodeDir {
+				if prevTree, err = a.r.loadTree(ctx, prev.Subtree); err != nil {
+					prevTree = nil
+				}
+			}
+			sub, err := a.archiveDir(ctx, p, relPath, prevTree)
+			if err != nil {
+				var skip errSkip
+				if errors.As(err, &skip) {
+					a.warn(relPath, skip.err)
+					continue
+				}
+				return "", err
+			}
+			node.Subtree = sub
+			a.stats.Dirs++
+
+		case info.Mode()&fs.ModeSymlink != 0:
+			node.Type = NodeSymlink
+			target, err := os.Readlink(p)
+			if err != nil {
+				a.warn(relPath, err)
+				continue
+			}
+			node.LinkTarget = target
+
+		default:
+			a.warn(relPath, fmt.Errorf("skipped special file (%s)", info.Mode().Type()))
+			continue
+		}
+		t.Nodes = append(t.Nodes, node)
+	}
+	return a.saveTree(ctx, t)
+}
+
+func (a *archiver) saveTree(ctx context.Context, t *tree) (string, error) {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+	id, added, err := a.r.saveBlob(ctx, BlobTree, data)
+	if err != nil {
+		return "", err
+	}
+	if added > 0 {
+		a.stats.NewBlobs++
+		a.stats.AddedBytes += added
+	}
+	return id, nil
+}
+
+// archiveFile stores a file's content, reusing the parent's when the file
+// is unchanged
+func (a *archiver) archiveFile(ctx context.Context, p string, node, prev *Node) error {
+	if prev != nil && prev.Type == NodeFile && prev.Size == node.Size && prev.ModTime.Equal(node.ModTime) && a.haveAll(prev.Content) {
+		node.Content = prev.Content
+		return nil
+	}
+	a.stats.ChangedFiles++
+
+	f, err := os.Open(p)
+	if err != nil {
+		return errSkip{err}
+	}
+	defer f.Close()
+	chunker := nosync.NewChunker(f, a.r.cfg.ChunkAvgSize)
+	content := []string{}
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errSkip{err}
+		}
+		id, added, err := a.r.saveBlob(ctx, BlobData, chunk.Data)
+		if err != nil {
+			return err
+		}
+		if added > 0 {
+			a.stats.NewBlobs++
+			a.stats.AddedBytes += added
+		}
+		content = append(content, id)
+	}
+	node.Content = content
+	return nil
+}
+
+func (a *archiver) haveAll(ids []string) bool {
+	for _, id := range ids {
+		if !a.r.hasBlob(id) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,181 @@
+package repo
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+)
+
+// CheckResult reports the problems check found
+type CheckResult struct {
+	Snapshots int      `json:"snapshots"`
+	Packs     int      `json:"packs"`
+	Blobs     int      `json:"blobs"`
+	ReadData  bool     `json:"read_data"`
+	Errors    []string `json:"errors"`
+	Warnings  []string `json:"warnings"`
+}
+
+// OK reports whether the repository is intact
+func (c *CheckResult) OK() bool {
+	return len(c.Errors) == 0
+}
+
+func (c *CheckResult) errorf(format string, args ...interface{}) {
+	c.Errors = append(c.Errors, fmt.Sprintf(format, args...))
+}
+
+// Check verifies that the indexes load, every pack they name exists and
+// every snapshot's trees and file contents are present. With readData it
+// also reads every pack and authenticates each blob, which finds silent
+// corruption at the cost of downloading the whole repository.
+func (r *Repository) Check(ctx context.Context, readData bool) (*CheckResult, error) {
+	unlock, err := r.lock(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	res := &CheckResult{ReadData: readData, Errors: []string{}, Warnings: []string{}}
+	if err := r.loadIndex(ctx); err != nil {
+		res.errorf("%v", err)
+		return res, nil
+	}
+	r.mu.Lock()
+	packs := make(map[string][]packBlob, len(r.packs))
+	for id, blobs := range r.packs {
+		packs[id] = blobs
+	}
+	res.Packs = len(packs)
+	res.Blobs = len(r.index)
+	r.mu.Unlock()
+
+	// Packs named by the index must exist; packs no index names are left
+	// over from an interrupted backup and freed by prune
+	names, err := r.be.List(ctx, "data")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list packs: %w", err)
+	}
+	stored := make(map[string]bool, len(names))
+	for _, name := range names {
+		id := path.Base(name)
+		stored[id] = true
+		if _, ok := packs[id]; !ok {
+			res.Warnings = append(res.Warnings, fmt.Sprintf("pack %s is not indexed", id))
+		}
+	}
+	for id := range packs {
+		if !stored[id] {
+			res.errorf("pack %s is missing", id)
+		}
+	}
+
+	// Every snapshot must be complete
+	snaps, err := r.Snapshots(ctx)
+	if err != nil {
+		res.errorf("%v", err)
+		return res, nil
+	}
+	res.Snapshots = len(snaps)
+	seen := make(map[string]bool)
+	for _, s := range snaps {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		r.checkTree(ctx, res, s.ID, "", s.Tree, seen)
+	}
+
+	if readData {
+		for id, blobs := range packs {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			if stored[id] {
+				r.checkPack(ctx, res, id, blobs)
+			}
+		}
+	}
+	return res, nil
+}
+
+// checkTree verifies a tree and everything below it once
+func (r *Repository) checkTree(ctx context.Context, res *CheckResult, snapID, dir, id string, seen map[string]bool) {
+	if seen[id] {
+		return
+	}
+	seen[id] = true
+	t, err := r.loadTree(ctx, id)
+	if err != nil {
+		res.errorf("snapshot %s: %s: %v", snapID, dir, err)
+		return
+	}
+	for _, n := range t.Nodes {
+		p := path.Join(dir, n.Name)
+		switch n.Type {
+		case NodeDir:
+			r.checkTree(ctx, res, snapID, p, n.Subtree, seen)
+		case NodeFile:
+			for _, blob := range n.Content {
+				if !r.hasBlob(blob) {
+					res.errorf("snapshot %s: %s: blob %s is missing", snapID, p, blob)
+					break
+				}
+			}
+		}
+	}
+}
+
+// checkPack reads a pack and authenticates its content
+func (r *Repository) checkPack(ctx context.Context, res *CheckResult, id string, indexed []packBlob) {
+	data, err := r.be.Load(ctx, packName(id))
+	if err != nil {
+		res.errorf("pack %s: %v", id, err)
+		return
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != id {
+		res.errorf("pack %s: content does not match its ID", id)
+		return
+	}
+	header, err := r.packHeader(data)
+	if err != nil {
+		res.errorf("pack %s: %v", id, err)
+		return
+	}
+	if len(header) != len(indexed) {
+		res.errorf("pack %s: holds %d blobs, the index lists %d", id, len(header), len(indexed))
+	}
+	for _, b := range header {
+		if b.Offset < 0 || b.Offset+b.Length > int64(len(data)) {
+			res.errorf("pack %s: blob %s is out of bounds", id, b.ID)
+			continue
+		}
+		if _, err := r.openBlob(b.ID, data[b.Offset:b.Offset+b.Length]); err != nil {
+			res.errorf("pack %s: %v", id, err)
+		}
+	}
+}
+
+// packHeader reads the list of blobs at the end of a pack
+func (r *Repository) packHeader(data []byte) ([]packBlob, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("pack is truncated")
+	}
+	n := int(binary.LittleEndian.Uint32(data[len(data)-4:]))
+	if n > len(data)-4 {
+		return nil, fmt.Errorf("pack header is truncated")
+	}
+	plain, err := open(r.key.Encrypt, data[len(data)-4-n:len(data)-4])
+	if err != nil {
+		return nil, fmt.Errorf("pack header: %w", err)
+	}
+	var blobs []packBlob
+	if err := json.Unmarshal(plain, &blobs); err != nil {
+		return nil, fmt.Errorf("invalid pack header: %w", err)
+	}
+	return blobs, nil
+}
@@ -0,0 +1,143 @@
+package repo
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// ErrWrongPassword is returned when the password does not open the
+// repository key
+var ErrWrongPassword = errors.New("wrong repository password")
+
+// errAuth is returned for content that fails authentication: it was
+// corrupted or tampered with
+var errAuth = errors.New("content failed authentication")
+
+// kdfParams are the Argon2id parameters the password key is derived with
+type kdfParams struct {
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"` // KiB
+	Threads uint8  `json:"threads"`
+	Salt    []byte `json:"salt"`
+}
+
+func defaultKDF() (kdfParams, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return kdfParams{}, err
+	}
+	return kdfParams{Time: 3, Memory: 64 * 1024, Threads: 4, Salt: salt}, nil
+}
+
+func (p kdfParams) derive(password string) []byte {
+	return argon2.IDKey([]byte(password), p.Salt, p.Time, p.Memory, p.Threads, chacha20poly1305.KeySize)
+}
+
+// masterKey encrypts the repository content and keys the blob IDs. The
+// repository config holds it sealed with the password key.
+type masterKey struct {
+	Encrypt []byte `json:"encrypt"`
+	MAC     []byte `json:"mac"`
+}
+
+func newMasterKey() (*masterKey, error) {
+	k := &masterKey{Encrypt: make([]byte, chacha20poly1305.KeySize), MAC: make([]byte, 32)}
+	if _, err := rand.Read(k.Encrypt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(k.MAC); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// seal encrypts and authenticates data with XChaCha20-Poly1305; the random
+// nonce is prepended
+func seal(key, data []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err := rand.Read(out); err != nil {
+		return nil, err
+	}
+	return aead.Seal(out, out, data, nil), nil
+}
+
+// open reverses seal
+func open(key, data []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize()+aead.Overhead() {
+		return nil, errAuth
+	}
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, errAuth
+	}
+	return plain, nil
+}
+
+// blobID names content by a keyed hash, so the repository does not reveal
+// whether it holds a known file
+func (k *masterKey) blobID(data []byte) string {
+	mac := hmac.New(sha256.New, k.MAC)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Compression markers at the start of each blob's plaintext
+const (
+	compressNone  byte = 0
+	compressFlate byte = 1
+)
+
+// compress deflates data unless that does not make it smaller
+func compress(data []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(compressFlate)
+	w, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	w.Write(data)
+	w.Close()
+	if buf.Len() < len(data)+1 {
+		return buf.Bytes()
+	}
+	out := make([]byte, 1+len(data))
+	out[0] = compressNone
+	copy(out[1:], data)
+	return out
+}
+
+func decompress(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty blob")
+	}
+	switch data[0] {
+	case compressNone:
+		return data[1:], nil
+	case compressFlate:
+		return io.ReadAll(flate.NewReader(bytes.NewReader(data[1:])))
+	default:
+		return nil, fmt.Errorf("unknown compression %d", data[0])
+	}
+}
+
+// newID returns a random ID for snapshots, indexes and locks
+func newID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
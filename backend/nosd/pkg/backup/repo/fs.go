@@ -0,0 +1,244 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// List returns the entries of a directory in a snapshot. dir is
+// slash-separated and relative to the snapshot root; "" or "." is the root.
+func (r *Repository) List(ctx context.Context, snapshotID, dir string) ([]*Node, error) {
+	snap, err := r.LoadSnapshot(ctx, snapshotID)
+	if err != nil {
+		return nil, err
+	}
+	node, err := r.lookup(ctx, snap.Tree, dir)
+	if err != nil {
+		return nil, err
+	}
+	if node.Type != NodeDir {
+		return nil, fmt.Errorf("%s: not a directory", dir)
+	}
+	t, err := r.loadTree(ctx, node.Subtree)
+	if err != nil {
+		return nil, err
+	}
+	return t.Nodes, nil
+}
+
+// lookup walks from a root tree to the node at name
+func (r *Repository) lookup(ctx context.Context, root, name string) (*Node, error) {
+	name = strings.Trim(path.Clean("/"+name), "/")
+	node := &Node{Name: ".", Type: NodeDir, Mode: fs.ModeDir | 0o755, Subtree: root}
+	if name == "" {
+		return node, nil
+	}
+	for _, part := range strings.Split(name, "/") {
+		if node.Type != NodeDir {
+			return nil, fs.ErrNotExist
+		}
+		t, err := r.loadTree(ctx, node.Subtree)
+		if err != nil {
+			return nil, err
+		}
+		if node = t.find(part); node == nil {
+			return nil, fs.ErrNotExist
+		}
+	}
+	return node, nil
+}
+
+// FS returns a read-only file system of a snapshot. It is how snapshots are
+// mounted: serve it with http.FS, walk it with fs.WalkDir or copy files out
+// of it. File contents are read from the repository on demand.
+func (r *Repository) FS(ctx context.Context, snapshotID string) (fs.FS, *Snapshot, error) {
+	snap, err := r.LoadSnapshot(ctx, snapshotID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &snapshotFS{r: r, ctx: ctx, root: snap.Tree, time: snap.Time}, snap, nil
+}
+
+type snapshotFS struct {
+	r    *Repository
+	ctx  context.Context
+	root string
+	time time.Time
+}
+
+// Open implements fs.FS
+func (s *snapshotFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	node, err := s.r.lookup(s.ctx, s.root, name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if name == "." {
+		node.ModTime = s.time
+	}
+	switch node.Type {
+	case NodeDir:
+		t, err := s.r.loadTree(s.ctx, node.Subtree)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return &dirFile{node: node, entries: t.Nodes}, nil
+	case NodeFile:
+		return newFileReader(s.ctx, s.r, node)
+	default:
+		return &dirFile{node: node}, nil
+	}
+}
+
+// nodeInfo adapts a node to fs.FileInfo and fs.DirEntry
+type nodeInfo struct{ n *Node }
+
+func (i nodeInfo) Name() string               { return i.n.Name }
+func (i nodeInfo) Size() int64                { return i.n.Size }
+func (i nodeInfo) Mode() fs.FileMode          { return i.n.Mode }
+func (i nodeInfo) ModTime() time.Time         { return i.n.ModTime }
+func (i nodeInfo) IsDir() bool                { return i.n.Type == NodeDir }
+func (i nodeInfo) Sys() interface{}           { return i.n }
+func (i nodeInfo) Type() fs.FileMode          { return i.n.Mode.Type() }
+func (i nodeInfo) Info() (fs.FileInfo, error) { return i, nil }
+
+// dirFile is an open directory or symlink
+type dirFile struct {
+	node    *Node
+	entries []*Node
+	pos     int
+}
+
+func (d *dirFile) Stat() (fs.FileInfo, error) { return nodeInfo{d.node}, nil }
+func (d *dirFile) Close() error               { return nil }
+
+func (d *dirFile) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.node.Name, Err: errors.New("is a directory")}
+}
+
+// ReadDir implements fs.ReadDirFile
+func (d *dirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.pos:]
+	if n > 0 {
+		if len(rest) == 0 {
+			return nil, io.EOF
+		}
+		if n < len(rest) {
+			rest = rest[:n]
+		}
+	}
+	out := make([]fs.DirEntry, len(rest))
+	for i, e := range rest {
+		out[i] = nodeInfo{e}
+	}
+	d.pos += len(rest)
+	return out, nil
+}
+
+// fileReader reads a file's blobs on demand. It implements io.Seeker and
+// io.ReaderAt, so it can be served with range requests.
+type fileReader struct {
+	ctx     context.Context
+	r       *Repository
+	node    *Node
+	offsets []int64 // start of each blob in the file
+	pos     int64
+
+	mu     sync.Mutex
+	cached int // index of the blob in buf, -1 for none
+	buf    []byte
+}
+
+func newFileReader(ctx context.Context, r *Repository, node *Node) (*fileReader, error) {
+	f := &fileReader{ctx: ctx, r: r, node: node, cached: -1, offsets: make([]int64, len(node.Content))}
+	var off int64
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, id := range node.Content {
+		loc, ok := r.index[id]
+		if !ok {
+			return nil, &fs.PathError{Op: "open", Path: node.Name, Err: fmt.Errorf("%w: %s", ErrBlobNotFound, id)}
+		}
+		f.offsets[i] = off
+		off += loc.RawLength
+	}
+	return f, nil
+}
+
+func (f *fileReader) Stat() (fs.FileInfo, error) { return nodeInfo{f.node}, nil }
+func (f *fileReader) Close() error               { return nil }
+
+func (f *fileReader) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+// Seek implements io.Seeker
+func (f *fileReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.node.Size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+// ReadAt implements io.ReaderAt
+func (f *fileReader) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		if off >= f.node.Size {
+			return n, io.EOF
+		}
+		i := sort.Search(len(f.offsets), func(i int) bool { return f.offsets[i] > off }) - 1
+		if i < 0 {
+			return n, io.EOF
+		}
+		data, err := f.blob(i)
+		if err != nil {
+			return n, err
+		}
+		rel := off - f.offsets[i]
+		if rel >= int64(len(data)) {
+			return n, io.EOF
+		}
+		c := copy(p[n:], data[rel:])
+		n += c
+		off += int64(c)
+	}
+	return n, nil
+}
+
+// blob returns the content of a blob of the file, keeping the last one
+func (f *fileReader) blob(i int) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.cached == i {
+		return f.buf, nil
+	}
+	data, err := f.r.loadBlob(f.ctx, f.node.Content[i])
+	if err != nil {
+		return nil, err
+	}
+	f.cached, f.buf = i, data
+	return data, nil
+}
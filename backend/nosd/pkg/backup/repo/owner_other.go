@@ -0,0 +1,10 @@
+//go:build !unix
+
+package repo
+
+import "io/fs"
+
+// fileOwner is only known on Unix systems
+func fileOwner(info fs.FileInfo) (uid, gid uint32, ok bool) {
+	return 0, 0, false
+}
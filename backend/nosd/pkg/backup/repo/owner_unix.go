@@ -0,0 +1,17 @@
+//go:build unix
+
+package repo
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// fileOwner returns the owner of a file
+func fileOwner(info fs.FileInfo) (uid, gid uint32, ok bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return st.Uid, st.Gid, true
+}
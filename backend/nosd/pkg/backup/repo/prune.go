@@ -0,0 +1,260 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"time"
+)
+
+// KeepPolicy selects the snapshots of each source that retention keeps.
+// Last keeps the newest snapshots; the others keep the newest snapshot of
+// each of that many days, weeks, months and years. Snapshots matching any
+// rule are kept. A zero policy keeps everything.
+type KeepPolicy struct {
+	Last    int `json:"last"`
+	Daily   int `json:"daily"`
+	Weekly  int `json:"weekly"`
+	Monthly int `json:"monthly"`
+	Yearly  int `json:"yearly"`
+}
+
+func (p KeepPolicy) empty() bool {
+	return p.Last <= 0 && p.Daily <= 0 && p.Weekly <= 0 && p.Monthly <= 0 && p.Yearly <= 0
+}
+
+// Forget removes the snapshots the policy does not keep and returns them.
+// Snapshots are grouped by host and source, so each history keeps its own.
+// Their data is freed by the next Prune.
+func (r *Repository) Forget(ctx context.Context, policy KeepPolicy) ([]*Snapshot, error) {
+	if policy.empty() {
+		return nil, nil
+	}
+	snaps, err := r.Snapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+	groups := make(map[string][]*Snapshot)
+	for _, s := range snaps {
+		key := s.Host + "\x00" + s.Source
+		groups[key] = append(groups[key], s)
+	}
+
+	var removed []*Snapshot
+	for _, group := range groups {
+		keep := selectKept(group, policy)
+		for _, s := range group {
+			if keep[s.ID] {
+				continue
+			}
+			if err := r.be.Remove(ctx, "snapshots/"+s.ID); err != nil {
+				return removed, fmt.Errorf("failed to remove snapshot %s: %w", s.ID, err)
+			}
+			removed = append(removed, s)
+		}
+	}
+	return removed, nil
+}
+
+// selectKept applies a policy to the snapshots of one source, newest first
+func selectKept(snaps []*Snapshot, p KeepPolicy) map[string]bool {
+	keep := make(map[string]bool)
+	for i := 0; i < p.Last && i < len(snaps); i++ {
+		keep[snaps[i].ID] = true
+	}
+	bucket := func(n int, key func(time.Time) string) {
+		seen := make(map[string]bool)
+		for _, s := range snaps {
+			if len(seen) >= n {
+				return
+			}
+			k := key(s.Time.Local())
+			if !seen[k] {
+				seen[k] = true
+				keep[s.ID] = true
+			}
+		}
+	}
+	bucket(p.Daily, func(t time.Time) string { return t.Format("2006-01-02") })
+	bucket(p.Weekly, func(t time.Time) string {
+		y, w := t.ISOWeek()
+		return fmt.Sprintf("%d-%d", y, w)
+	})
+	bucket(p.Monthly, func(t time.Time) string { return t.Format("2006-01") })
+	bucket(p.Yearly, func(t time.Time) string { return t.Format("2006") })
+	return keep
+}
+
+// PruneResult reports what a prune freed
+type PruneResult struct {
+	PacksRemoved   int   `json:"packs_removed"`
+	PacksRewritten int   `json:"packs_rewritten"`
+	BlobsRemoved   int   `json:"blobs_removed"`
+	BytesFreed     int64 `json:"bytes_freed"`
+}
+
+// Prune frees the data no snapshot references. Packs holding only unused
+// blobs are deleted; packs holding some are rewritten without them. It
+// needs the repository to itself.
+func (r *Repository) Prune(ctx context.Context) (*PruneResult, error) {
+	unlock, err := r.lock(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if err := r.loadIndex(ctx); err != nil {
+		return nil, err
+	}
+
+	// Mark what the snapshots use
+	snaps, err := r.Snapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+	used := make(map[string]bool)
+	for _, s := range snaps {
+		if err := r.markUsed(ctx, s.Tree, used); err != nil {
+			return nil, fmt.Errorf("snapshot %s: %w", s.ID, err)
+		}
+	}
+
+	// Sort packs into kept, rewritten and removed
+	res := &PruneResult{}
+	r.mu.Lock()
+	oldIndexes := r.indexFiles
+	var drop, rewrite []string
+	for id, blobs := range r.packs {
+		unused := 0
+		for _, b := range blobs {
+			if !used[b.ID] {
+				unused++
+				res.BlobsRemoved++
+				res.BytesFreed += b.Length
+			}
+		}
+		switch {
+		case unused == len(blobs):
+			drop = append(drop, id)
+		case unused > 0:
+			drop = append(drop, id)
+			rewrite = append(rewrite, id)
+		}
+	}
+	dropped := make(map[string][]packBlob, len(drop))
+	for _, id := range drop {
+		dropped[id] = r.packs[id]
+		delete(r.packs, id)
+	}
+	r.index = make(map[string]blobLocation)
+	for id, blobs := range r.packs {
+		for _, b := range blobs {
+			r.index[b.ID] = blobLocation{pack: id, packBlob: b}
+		}
+	}
+	r.mu.Unlock()
+	sort.Strings(rewrite)
+
+	// Copy the used blobs of partly used packs into new packs
+	for _, id := range rewrite {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		data, err := r.be.Load(ctx, packName(id))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read pack %s: %w", id, err)
+		}
+		for _, b := range dropped[id] {
+			if !used[b.ID] || r.hasBlob(b.ID) {
+				continue
+			}
+			if b.Offset+b.Length > int64(len(data)) {
+				return nil, fmt.Errorf("pack %s: blob %s is out of bounds", id, b.ID)
+			}
+			plain, err := r.openBlob(b.ID, data[b.Offset:b.Offset+b.Length])
+			if err != nil {
+				return nil, fmt.Errorf("pack %s: %w", id, err)
+			}
+			if _, _, err := r.saveBlob(ctx, b.Type, plain); err != nil {
+				return nil, err
+			}
+		}
+		res.PacksRewritten++
+	}
+	if err := r.flushPack(ctx); err != nil {
+		return nil, err
+	}
+
+	// Replace all indexes with one, then delete what it no longer names
+	r.mu.Lock()
+	full := indexFile{Packs: make([]indexPack, 0, len(r.packs))}
+	for id, blobs := range r.packs {
+		full.Packs = append(full.Packs, indexPack{ID: id, Blobs: blobs})
+	}
+	r.newPacks = nil
+	r.mu.Unlock()
+	name := "index/" + newID()
+	if err := r.saveJSON(ctx, name, full); err != nil {
+		return nil, fmt.Errorf("failed to write index: %w", err)
+	}
+	r.mu.Lock()
+	r.indexFiles = []string{name}
+	r.mu.Unlock()
+	for _, old := range oldIndexes {
+		if err := r.be.Remove(ctx, old); err != nil {
+			return nil, fmt.Errorf("failed to remove index %s: %w", old, err)
+		}
+	}
+	for _, id := range drop {
+		if err := r.be.Remove(ctx, packName(id)); err != nil {
+			return nil, fmt.Errorf("failed to remove pack %s: %w", id, err)
+		}
+	}
+	res.PacksRemoved = len(drop) - len(rewrite)
+
+	// Packs no index names were left by interrupted backups
+	names, err := r.be.List(ctx, "data")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list packs: %w", err)
+	}
+	r.mu.Lock()
+	var orphans []string
+	for _, name := range names {
+		if _, ok := r.packs[path.Base(name)]; !ok {
+			orphans = append(orphans, name)
+		}
+	}
+	r.mu.Unlock()
+	for _, name := range orphans {
+		if err := r.be.Remove(ctx, name); err != nil {
+			return nil, fmt.Errorf("failed to remove pack %s: %w", name, err)
+		}
+		res.PacksRemoved++
+	}
+	return res, nil
+}
+
+// markUsed adds a tree and all blobs below it to used
+func (r *Repository) markUsed(ctx context.Context, id string, used map[string]bool) error {
+	if used[id] {
+		return nil
+	}
+	used[id] = true
+	t, err := r.loadTree(ctx, id)
+	if err != nil {
+		return err
+	}
+	for _, n := range t.Nodes {
+		switch n.Type {
+		case NodeDir:
+			if err := r.markUsed(ctx, n.Subtree, used); err != nil {
+				return err
+			}
+		case NodeFile:
+			for _, b := range n.Content {
+				used[b] = true
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,531 @@
+// Package repo implements the NithronOS backup repository: a deduplicating,
+// compressed and encrypted store of file trees. Files are split into
+// content-defined chunks, each stored once as a blob named by a keyed hash.
+// Blobs are compressed, sealed with XChaCha20-Poly1305 and collected into
+// pack files; indexes map blobs to packs and snapshot manifests point at the
+// tree of each backup. Every file in the repository is written once, so it
+// works on plain directories and object stores alike.
+//
+// Layout:
+//
+//	config              repository ID, parameters and the sealed master key
+//	data/<xx>/<pack>    packs, named by the SHA-256 of their content
+//	index/<id>          which blobs each pack holds
+//	snapshots/<id>      snapshot manifests
+//	locks/<id>          locks of running operations
+package repo
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Errors returned by repository operations
+var (
+	ErrNotInitialized   = errors.New("repository is not initialized")
+	ErrExists           = errors.New("repository already exists")
+	ErrLocked           = errors.New("repository is locked by another operation")
+	ErrSnapshotNotFound = errors.New("snapshot not found")
+	ErrBlobNotFound     = errors.New("blob not found")
+)
+
+const (
+	formatVersion = 1
+
+	// DefaultChunkAvgSize is the average chunk size of new repositories
+	DefaultChunkAvgSize = 1 << 20
+
+	// packSize is the size a pack is flushed at
+	packSize = 16 << 20
+
+	// Locks are refreshed while held and ignored once stale, so a crashed
+	// operation does not lock the repository forever
+	lockRefresh = 5 * time.Minute
+	lockStale   = 30 * time.Minute
+)
+
+// BlobType tells file content from directory listings
+type BlobType string
+
+// Blob types
+const (
+	BlobData BlobType = "data"
+	BlobTree BlobType = "tree"
+)
+
+// config is the plaintext head of a repository
+type config struct {
+	Version      int       `json:"version"`
+	ID           string    `json:"id"`
+	ChunkAvgSize int64     `json:"chunk_avg_size"`
+	KDF          kdfParams `json:"kdf"`
+	Key          []byte    `json:"key"` // master key sealed with the password key
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// packBlob is a blob's entry in a pack header and an index
+type packBlob struct {
+	ID        string   `json:"id"`
+	Type      BlobType `json:"type"`
+	Offset    int64    `json:"offset"`
+	Length    int64    `json:"length"`     // sealed length in the pack
+	RawLength int64    `json:"raw_length"` // plaintext length
+}
+
+type indexPack struct {
+	ID    string     `json:"id"`
+	Blobs []packBlob `json:"blobs"`
+}
+
+type indexFile struct {
+	Packs []indexPack `json:"packs"`
+}
+
+type blobLocation struct {
+	pack string
+	packBlob
+}
+
+// Repository is an open backup repository
+type Repository struct {
+	be  Backend
+	cfg config
+	key *masterKey
+
+	mu         sync.Mutex
+	index      map[string]blobLocation
+	packs      map[string][]packBlob // pack ID -> blobs
+	indexFiles []string
+
+	// Pack being filled and packs written since the last index file
+	pending     bytes.Buffer
+	pendingBlob []packBlob
+	pendingIDs  map[string]bool
+	newPacks    []indexPack
+}
+
+// Init creates a repository on an empty backend
+func Init(ctx context.Context, be Backend, password string) (*Repository, error) {
+	if password == "" {
+		return nil, fmt.Errorf("a repository password is required")
+	}
+	if _, err := be.Load(ctx, "config"); err == nil {
+		return nil, ErrExists
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to access repository: %w", err)
+	}
+
+	key, err := newMasterKey()
+	if err != nil {
+		return nil, err
+	}
+	kdf, err := defaultKDF()
+	if err != nil {
+		return nil, err
+	}
+	keyJSON, _ := json.Marshal(key)
+	sealed, err := seal(kdf.derive(password), keyJSON)
+	if err != nil {
+		return nil, err
+	}
+	cfg := config{
+		Version:      formatVersion,
+		ID:           newID(),
+		ChunkAvgSize: DefaultChunkAvgSize,
+		KDF:          kdf,
+		Key:          sealed,
+		CreatedAt:    time.Now().UTC(),
+	}
+	data, _ := json.MarshalIndent(cfg, "", "  ")
+	if err := be.Save(ctx, "config", data); err != nil {
+		return nil, fmt.Errorf("failed to write repository config: %w", err)
+	}
+	return newRepository(be, cfg, key), nil
+}
+
+// Open opens an existing repository and loads its index
+func Open(ctx context.Context, be Backend, password string) (*Repository, error) {
+	data, err := be.Load(ctx, "config")
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrNotInitialized
+		}
+		return nil, fmt.Errorf("failed to read repository config: %w", err)
+	}
+	var cfg config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("invalid repository config: %w", err)
+	}
+	if cfg.Version != formatVersion {
+		return nil, fmt.Errorf("unsupported repository version %d", cfg.Version)
+	}
+	keyJSON, err := open(cfg.KDF.derive(password), cfg.Key)
+	if err != nil {
+		return nil, ErrWrongPassword
+	}
+	var key masterKey
+	if err := json.Unmarshal(keyJSON, &key); err != nil {
+		return nil, fmt.Errorf("invalid repository key: %w", err)
+	}
+
+	r := newRepository(be, cfg, &key)
+	if err := r.loadIndex(ctx); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func newRepository(be Backend, cfg config, key *masterKey) *Repository {
+	return &Repository{
+		be:         be,
+		cfg:        cfg,
+		key:        key,
+		index:      make(map[string]blobLocation),
+		packs:      make(map[string][]packBlob),
+		pendingIDs: make(map[string]bool),
+	}
+}
+
+// ID returns the repository ID
+func (r *Repository) ID() string {
+	return r.cfg.ID
+}
+
+// loadIndex reads all index files
+func (r *Repository) loadIndex(ctx context.Context) error {
+	names, err := r.be.List(ctx, "index")
+	if err != nil {
+		return fmt.Errorf("failed to list indexes: %w", err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.index = make(map[string]blobLocation)
+	r.packs = make(map[string][]packBlob)
+	r.indexFiles = nil
+	for _, name := range names {
+		var idx indexFile
+		if err := r.loadJSON(ctx, name, &idx); err != nil {
+			return fmt.Errorf("failed to load index %s: %w", name, err)
+		}
+		for _, p := range idx.Packs {
+			r.addPackLocked(p)
+		}
+		r.indexFiles = append(r.indexFiles, name)
+	}
+	// Packs written since the last index file are not listed yet
+	for _, p := range r.newPacks {
+		r.addPackLocked(p)
+	}
+	return nil
+}
+
+func (r *Repository) addPackLocked(p indexPack) {
+	r.packs[p.ID] = p.Blobs
+	for _, b := range p.Blobs {
+		r.index[b.ID] = blobLocation{pack: p.ID, packBlob: b}
+	}
+}
+
+// saveJSON seals and writes a JSON file
+func (r *Repository) saveJSON(ctx context.Context, name string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	sealed, err := seal(r.key.Encrypt, compress(data))
+	if err != nil {
+		return err
+	}
+	return r.be.Save(ctx, name, sealed)
+}
+
+// loadJSON reads and opens a file written by saveJSON
+func (r *Repository) loadJSON(ctx context.Context, name string, v interface{}) error {
+	data, err := r.be.Load(ctx, name)
+	if err != nil {
+		return err
+	}
+	plain, err := open(r.key.Encrypt, data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	if plain, err = decompress(plain); err != nil {
+		return err
+	}
+	return json.Unmarshal(plain, v)
+}
+
+// hasBlob reports whether a blob is stored or about to be
+func (r *Repository) hasBlob(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.index[id]
+	return ok || r.pendingIDs[id]
+}
+
+// saveBlob stores a blob unless the repository already has it. It returns
+// the blob ID and the number of bytes added to the repository.
+func (r *Repository) saveBlob(ctx context.Context, typ BlobType, data []byte) (string, int64, error) {
+	id := r.key.blobID(data)
+	if r.hasBlob(id) {
+		return id, 0, nil
+	}
+	sealed, err := seal(r.key.Encrypt, compress(data))
+	if err != nil {
+		return "", 0, err
+	}
+
+	r.mu.Lock()
+	r.pendingBlob = append(r.pendingBlob, packBlob{
+		ID:        id,
+		Type:      typ,
+		Offset:    int64(r.pending.Len()),
+		Length:    int64(len(sealed)),
+		RawLength: int64(len(data)),
+	})
+	r.pendingIDs[id] = true
+	r.pending.Write(sealed)
+	full := r.pending.Len() >= packSize
+	r.mu.Unlock()
+
+	if full {
+		if err := r.flushPack(ctx); err != nil {
+			return "", 0, err
+		}
+	}
+	return id, int64(len(sealed)), nil
+}
+
+// flushPack writes the pack being filled: the sealed blobs, then the sealed
+// header listing them and the header length
+func (r *Repository) flushPack(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.pendingBlob) == 0 {
+		return nil
+	}
+	header, _ := json.Marshal(r.pendingBlob)
+	sealed, err := seal(r.key.Encrypt, header)
+	if err != nil {
+		return err
+	}
+	r.pending.Write(sealed)
+	var trailer [4]byte
+	binary.LittleEndian.PutUint32(trailer[:], uint32(len(sealed)))
+	r.pending.Write(trailer[:])
+
+	sum := sha256.Sum256(r.pending.Bytes())
+	id := hex.EncodeToString(sum[:])
+	if err := r.be.Save(ctx, packName(id), r.pending.Bytes()); err != nil {
+		return fmt.Errorf("failed to write pack: %w", err)
+	}
+	p := indexPack{ID: id, Blobs: r.pendingBlob}
+	r.addPackLocked(p)
+	r.newPacks = append(r.newPacks, p)
+	r.pending.Reset()
+	r.pendingBlob = nil
+	r.pendingIDs = make(map[string]bool)
+	return nil
+}
+
+// flush writes the pending pack and an index of the packs written since the
+// last flush. Blobs are only referenced by snapshots after this.
+func (r *Repository) flush(ctx context.Context) error {
+	if err := r.flushPack(ctx); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	packs := r.newPacks
+	r.mu.Unlock()
+	if len(packs) == 0 {
+		return nil
+	}
+	name := "index/" + newID()
+	if err := r.saveJSON(ctx, name, indexFile{Packs: packs}); err != nil {
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+	r.mu.Lock()
+	r.newPacks = nil
+	r.indexFiles = append(r.indexFiles, name)
+	r.mu.Unlock()
+	return nil
+}
+
+func packName(id string) string {
+	return "data/" + id[:2] + "/" + id
+}
+
+// loadBlob reads, opens and verifies a blob
+func (r *Repository) loadBlob(ctx context.Context, id string) ([]byte, error) {
+	r.mu.Lock()
+	loc, ok := r.index[id]
+	r.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrBlobNotFound, id)
+	}
+	data, err := r.be.LoadRange(ctx, packName(loc.pack), loc.Offset, loc.Length)
+	if err != nil {
+		return nil, err
+	}
+	return r.openBlob(id, data)
+}
+
+// openBlob decrypts a sealed blob and checks it is the one asked for
+func (r *Repository) openBlob(id string, sealed []byte) ([]byte, error) {
+	plain, err := open(r.key.Encrypt, sealed)
+	if err != nil {
+		return nil, fmt.Errorf("blob %s: %w", id, err)
+	}
+	if plain, err = decompress(plain); err != nil {
+		return nil, fmt.Errorf("blob %s: %w", id, err)
+	}
+	if r.key.blobID(plain) != id {
+		return nil, fmt.Errorf("blob %s: content does not match its ID", id)
+	}
+	return plain, nil
+}
+
+// lockInfo is the content of a lock file
+type lockInfo struct {
+	Host      string    `json:"host"`
+	PID       int       `json:"pid"`
+	Exclusive bool      `json:"exclusive"`
+	Time      time.Time `json:"time"`
+}
+
+// lock takes a repository lock. Backups share the repository; prune needs
+// it to itself. The returned function releases the lock.
+func (r *Repository) lock(ctx context.Context, exclusive bool) (func(), error) {
+	names, err := r.be.List(ctx, "locks")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list locks: %w", err)
+	}
+	for _, name := range names {
+		var l lockInfo
+		if err := r.loadJSON(ctx, name, &l); err != nil {
+			continue
+		}
+		if time.Since(l.Time) > lockStale {
+			if exclusive {
+				_ = r.be.Remove(ctx, name)
+			}
+			continue
+		}
+		if exclusive || l.Exclusive {
+			return nil, fmt.Errorf("%w (%s, pid %d, since %s)", ErrLocked, l.Host, l.PID, l.Time.Format(time.RFC3339))
+		}
+	}
+
+	host, _ := os.Hostname()
+	name := "locks/" + newID()
+	info := lockInfo{Host: host, PID: os.Getpid(), Exclusive: exclusive, Time: time.Now().UTC()}
+	if err := r.saveJSON(ctx, name, info); err != nil {
+		return nil, fmt.Errorf("failed to write lock: %w", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(lockRefresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				info.Time = time.Now().UTC()
+				_ = r.saveJSON(context.Background(), name, info)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		_ = r.be.Remove(context.Background(), name)
+	}, nil
+}
+
+// Snapshot is the manifest of one backup
+type Snapshot struct {
+	ID             string      `json:"id"`
+	Time           time.Time   `json:"time"`
+	Host           string      `json:"host"`
+	Source         string      `json:"source"`                    // what was backed up, e.g. a subvolume
+	SourceSnapshot string      `json:"source_snapshot,omitempty"` // local snapshot it was taken from
+	Tags           []string    `json:"tags,omitempty"`
+	Tree           string      `json:"tree"`             // root tree blob
+	Parent         string      `json:"parent,omitempty"` // snapshot unchanged files were taken from
+	Stats          BackupStats `json:"stats"`
+}
+
+// Snapshots returns the snapshots in the repository, newest first
+func (r *Repository) Snapshots(ctx context.Context) ([]*Snapshot, error) {
+	names, err := r.be.List(ctx, "snapshots")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+	list := make([]*Snapshot, 0, len(names))
+	for _, name := range names {
+		var s Snapshot
+		if err := r.loadJSON(ctx, name, &s); err != nil {
+			return nil, fmt.Errorf("failed to load snapshot %s: %w", name, err)
+		}
+		list = append(list, &s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Time.After(list[j].Time) })
+	return list, nil
+}
+
+// LoadSnapshot returns a snapshot by ID or unique ID prefix
+func (r *Repository) LoadSnapshot(ctx context.Context, id string) (*Snapshot, error) {
+	if id == "" {
+		return nil, ErrSnapshotNotFound
+	}
+	var s Snapshot
+	err := r.loadJSON(ctx, "snapshots/"+id, &s)
+	if err == nil {
+		return &s, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	names, err := r.be.List(ctx, "snapshots")
+	if err != nil {
+		return nil, err
+	}
+	match := ""
+	for _, name := range names {
+		if strings.HasPrefix(strings.TrimPrefix(name, "snapshots/"), id) {
+			if match != "" {
+				return nil, fmt.Errorf("snapshot ID prefix %q is ambiguous", id)
+			}
+			match = name
+		}
+	}
+	if match == "" {
+		return nil, ErrSnapshotNotFound
+	}
+	if err := r.loadJSON(ctx, match, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// RemoveSnapshot deletes a snapshot manifest. Its data stays until the
+// next prune.
+func (r *Repository) RemoveSnapshot(ctx context.Context, id string) error {
+	s, err := r.LoadSnapshot(ctx, id)
+	if err != nil {
+		return err
+	}
+	return r.be.Remove(ctx, "snapshots/"+s.ID)
+}
@@ -0,0 +1,248 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func randomData(seed int64, n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+func TestRepositoryBackupIncremental(t *testing.T) {
+	ctx := context.Background()
+	src := t.TempDir()
+	be := NewLocalBackend(t.TempDir())
+
+	r, err := Init(ctx, be, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Init(ctx, be, "other"); !errors.Is(err, ErrExists) {
+		t.Fatalf("second init: %v", err)
+	}
+	if _, err := Open(ctx, be, "wrong"); !errors.Is(err, ErrWrongPassword) {
+		t.Fatalf("open with wrong password: %v", err)
+	}
+
+	big := randomData(1, 3<<20)
+	writeFile(t, filepath.Join(src, "video.bin"), big)
+	writeFile(t, filepath.Join(src, "docs", "notes.txt"), bytes.Repeat([]byte("meeting notes\n"), 1000))
+	if err := os.Symlink("docs/notes.txt", filepath.Join(src, "latest")); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := r.Backup(ctx, src, BackupOptions{Source: "@home"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Stats.Files != 2 || first.Stats.Dirs != 1 || first.Stats.AddedBytes == 0 {
+		t.Errorf("first backup stats = %+v", first.Stats)
+	}
+
+	// Nothing changed: nothing is read or stored again
+	r, err = Open(ctx, be, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := r.Backup(ctx, src, BackupOptions{Source: "@home"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Parent != first.ID || second.Stats.ChangedFiles != 0 || second.Stats.AddedBytes != 0 {
+		t.Errorf("unchanged backup = parent %s, stats %+v", second.Parent, second.Stats)
+	}
+
+	// A small change in a large file only stores the chunks around it
+	changed := append([]byte{}, big...)
+	copy(changed[1<<20:], []byte("a few changed bytes"))
+	writeFile(t, filepath.Join(src, "video.bin"), changed)
+	third, err := r.Backup(ctx, src, BackupOptions{Source: "@home"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third.Stats.ChangedFiles != 1 || third.Stats.AddedBytes == 0 || third.Stats.AddedBytes > int64(len(big))/2 {
+		t.Errorf("edited backup stats = %+v", third.Stats)
+	}
+
+	// Each snapshot reads back as it was
+	for _, tc := range []struct {
+		snap *Snapshot
+		want []byte
+	}{{first, big}, {third, changed}} {
+		fsys, _, err := r.FS(ctx, tc.snap.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := fs.ReadFile(fsys, "video.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, tc.want) {
+			t.Errorf("snapshot %s: video.bin differs", tc.snap.ID)
+		}
+	}
+	nodes, err := r.List(ctx, third.ID[:8], "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 3 || nodes[1].Name != "latest" || nodes[1].LinkTarget != "docs/notes.txt" {
+		t.Errorf("root listing = %+v", nodes)
+	}
+
+	// Reading at an offset crosses chunk boundaries
+	fsys, _, _ := r.FS(ctx, third.ID)
+	f, err := fsys.Open("video.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	if _, err := f.(io.ReaderAt).ReadAt(buf, 1<<20-50); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, changed[1<<20-50:1<<20+50]) {
+		t.Error("ReadAt returned the wrong bytes")
+	}
+
+	res, err := r.Check(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.OK() || res.Snapshots != 3 {
+		t.Errorf("check = %+v", res)
+	}
+}
+
+func TestRepositoryCheckFindsCorruption(t *testing.T) {
+	ctx := context.Background()
+	src := t.TempDir()
+	dir := t.TempDir()
+	be := NewLocalBackend(dir)
+	r, err := Init(ctx, be, "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(src, "a.bin"), randomData(2, 1<<20))
+	if _, err := r.Backup(ctx, src, BackupOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	packs, _ := be.List(ctx, "data")
+	if len(packs) != 1 {
+		t.Fatalf("%d packs", len(packs))
+	}
+	p := filepath.Join(dir, filepath.FromSlash(packs[0]))
+	data, _ := os.ReadFile(p)
+	data[10] ^= 0xff
+	if err := os.WriteFile(p, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := r.Check(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.OK() {
+		t.Errorf("structure check failed: %v", res.Errors)
+	}
+	res, err = r.Check(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.OK() {
+		t.Error("data check missed a corrupted pack")
+	}
+
+	if err := os.Remove(p); err != nil {
+		t.Fatal(err)
+	}
+	if res, _ = r.Check(ctx, false); res.OK() {
+		t.Error("check missed a missing pack")
+	}
+}
+
+func TestRepositoryForgetPrune(t *testing.T) {
+	ctx := context.Background()
+	src := t.TempDir()
+	be := NewLocalBackend(t.TempDir())
+	r, err := Init(ctx, be, "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keep := randomData(3, 512<<10)
+	writeFile(t, filepath.Join(src, "keep.bin"), keep)
+	writeFile(t, filepath.Join(src, "gone.bin"), randomData(4, 2<<20))
+	old, err := r.Backup(ctx, src, BackupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(src, "gone.bin")); err != nil {
+		t.Fatal(err)
+	}
+	current, err := r.Backup(ctx, src, BackupOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := r.Forget(ctx, KeepPolicy{Last: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0].ID != old.ID {
+		t.Fatalf("forgot %+v", removed)
+	}
+	unlock, err := r.lock(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Prune(ctx); !errors.Is(err, ErrLocked) {
+		t.Errorf("prune during a backup: %v", err)
+	}
+	unlock()
+
+	res, err := r.Prune(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.BytesFreed < 2<<20 || res.PacksRewritten != 1 {
+		t.Errorf("prune = %+v", res)
+	}
+
+	r, err = Open(ctx, be, "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if check, err := r.Check(ctx, true); err != nil || !check.OK() {
+		t.Fatalf("check after prune: %v %+v", err, check)
+	}
+	fsys, _, err := r.FS(ctx, current.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := fs.ReadFile(fsys, "keep.bin"); err != nil || !bytes.Equal(got, keep) {
+		t.Errorf("kept file after prune: %v", err)
+	}
+	if _, _, err := r.FS(ctx, old.ID); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Errorf("forgotten snapshot: %v", err)
+	}
+}
@@ -0,0 +1,302 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"nithronos/backend/nosd/pkg/backup/repo"
+)
+
+// Repository destinations ("repo") store snapshots in a deduplicating,
+// encrypted repository (see package repo) on a local path or an rclone
+// remote. Each replication adds only the chunks that changed.
+
+// StoreRepoPassword stores the password of a repository destination. It
+// must be set before the repository is first used; a repository keeps the
+// password it was created with.
+func (r *Replicator) StoreRepoPassword(destID string, password string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	dest, ok := r.destinations[destID]
+	if !ok {
+		return fmt.Errorf("destination not found: %s", destID)
+	}
+	if dest.Type != "repo" {
+		return fmt.Errorf("destination is not a repository")
+	}
+	if password == "" {
+		return fmt.Errorf("repository password is required")
+	}
+
+	if dest.PasswordRef == "" {
+		dest.PasswordRef = fmt.Sprintf("%s.repo", dest.ID)
+		dest.UpdatedAt = time.Now()
+	}
+	if err := os.WriteFile(filepath.Join(r.keysDir, dest.PasswordRef), []byte(password), 0600); err != nil {
+		return fmt.Errorf("failed to write repository password: %w", err)
+	}
+
+	return r.saveStateLocked()
+}
+
+// RepositorySnapshots lists the snapshots stored in a repository
+// destination, newest first
+func (r *Replicator) RepositorySnapshots(ctx context.Context, destID string) ([]*repo.Snapshot, error) {
+	rp, err := r.openRepositoryByID(ctx, destID)
+	if err != nil {
+		return nil, err
+	}
+	return rp.Snapshots(ctx)
+}
+
+// ListRepository lists a directory of a repository snapshot
+func (r *Replicator) ListRepository(ctx context.Context, destID string, snapshotID string, dir string) ([]*repo.Node, error) {
+	rp, err := r.openRepositoryByID(ctx, destID)
+	if err != nil {
+		return nil, err
+	}
+	return rp.List(ctx, snapshotID, dir)
+}
+
+// RepositoryFS mounts a repository snapshot as a read-only file system
+func (r *Replicator) RepositoryFS(ctx context.Context, destID string, snapshotID string) (fs.FS, *repo.Snapshot, error) {
+	rp, err := r.openRepositoryByID(ctx, destID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rp.FS(ctx, snapshotID)
+}
+
+// ForgetRepositorySnapshot removes a snapshot from a repository. Its data is
+// freed by the next prune.
+func (r *Replicator) ForgetRepositorySnapshot(ctx context.Context, destID string, snapshotID string) error {
+	rp, err := r.openRepositoryByID(ctx, destID)
+	if err != nil {
+		return err
+	}
+	return rp.RemoveSnapshot(ctx, snapshotID)
+}
+
+// CheckRepository starts a job that verifies a repository destination. With
+// readData every pack is downloaded and authenticated.
+func (r *Replicator) CheckRepository(destID string, readData bool) (*BackupJob, error) {
+	return r.startRepoJob(destID, "check", func(ctx context.Context, job *BackupJob, rp *repo.Repository) error {
+		res, err := rp.Check(ctx, readData)
+		if err != nil {
+			return err
+		}
+		for _, w := range res.Warnings {
+			r.jobManager.AddLogEntry(job.ID, "warn", w)
+		}
+		for _, e := range res.Errors {
+			r.jobManager.AddLogEntry(job.ID, "error", e)
+		}
+		r.jobManager.AddLogEntry(job.ID, "info", fmt.Sprintf("Checked %d snapshots, %d packs, %d blobs", res.Snapshots, res.Packs, res.Blobs))
+		if !res.OK() {
+			return fmt.Errorf("repository check found %d errors", len(res.Errors))
+		}
+		return nil
+	})
+}
+
+// PruneRepository starts a job that applies the destination's retention and
+// frees the data no snapshot references
+func (r *Replicator) PruneRepository(destID string) (*BackupJob, error) {
+	return r.startRepoJob(destID, "prune", func(ctx context.Context, job *BackupJob, rp *repo.Repository) error {
+		dest, err := r.repoDestination(destID)
+		if err != nil {
+			return err
+		}
+		if dest.Retention != nil {
+			if err := r.forgetRepo(ctx, job, rp, *dest.Retention); err != nil {
+				return err
+			}
+		}
+		return r.pruneRepo(ctx, job, rp)
+	})
+}
+
+// Private methods
+
+func (r *Replicator) testRepoDestination(dest *Destination) error {
+	if dest.Path == "" {
+		if _, err := exec.LookPath("rclone"); err != nil {
+			return fmt.Errorf("rclone not found: %w", err)
+		}
+	}
+
+	// Opening proves the password and creating an empty repository proves
+	// the location is writable
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	_, err := r.openRepository(ctx, dest, true)
+	return err
+}
+
+func (r *Replicator) repoBackend(dest *Destination) repo.Backend {
+	if dest.Path != "" {
+		return repo.NewLocalBackend(dest.Path)
+	}
+	return repo.NewRcloneBackend(dest.RemoteName, dest.RemotePath, dest.BandwidthLimit)
+}
+
+// openRepository opens the repository of a destination, creating it if
+// create is set and the location holds none
+func (r *Replicator) openRepository(ctx context.Context, dest *Destination, create bool) (*repo.Repository, error) {
+	if dest.PasswordRef == "" {
+		return nil, fmt.Errorf("repository password is not set")
+	}
+	password, err := os.ReadFile(filepath.Join(r.keysDir, dest.PasswordRef))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read repository password: %w", err)
+	}
+
+	be := r.repoBackend(dest)
+	rp, err := repo.Open(ctx, be, string(password))
+	if errors.Is(err, repo.ErrNotInitialized) && create {
+		if dest.Path != "" {
+			if err := os.MkdirAll(dest.Path, 0700); err != nil {
+				return nil, fmt.Errorf("cannot access repository path: %w", err)
+			}
+		}
+		rp, err = repo.Init(ctx, be, string(password))
+		if err == nil {
+			r.logger.Info().Str("destination", dest.ID).Str("repo", rp.ID()).Msg("Initialized backup repository")
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	changed := dest.RepoID != rp.ID()
+	dest.RepoID = rp.ID()
+	// dest may be a copy carrying a schedule target's retention
+	if stored, ok := r.destinations[dest.ID]; ok {
+		stored.RepoID = rp.ID()
+	}
+	r.mu.Unlock()
+	if changed {
+		_ = r.saveState()
+	}
+	return rp, nil
+}
+
+func (r *Replicator) openRepositoryByID(ctx context.Context, destID string) (*repo.Repository, error) {
+	dest, err := r.repoDestination(destID)
+	if err != nil {
+		return nil, err
+	}
+	return r.openRepository(ctx, dest, false)
+}
+
+func (r *Replicator) repoDestination(destID string) (*Destination, error) {
+	return r.destinationOfType(destID, "repo")
+}
+
+// startRepoJob runs a maintenance job against a repository destination
+func (r *Replicator) startRepoJob(destID string, jobType string, run func(ctx context.Context, job *BackupJob, rp *repo.Repository) error) (*BackupJob, error) {
+	dest, err := r.repoDestination(destID)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.startDestinationJob(dest, jobType, func(ctx context.Context, job *BackupJob) error {
+		rp, err := r.openRepository(ctx, dest, false)
+		if err != nil {
+			return err
+		}
+		return run(ctx, job, rp)
+	}), nil
+}
+
+func (r *Replicator) replicateRepo(job *BackupJob, dest *Destination, snapshot *Snapshot) error {
+	if snapshot == nil {
+		return fmt.Errorf("snapshot not found: %s", job.SnapshotID)
+	}
+
+	ctx, cancel := r.jobContext(job.ID)
+	defer cancel()
+
+	rp, err := r.openRepository(ctx, dest, true)
+	if err != nil {
+		return fmt.Errorf("failed to open repository: %w", err)
+	}
+
+	mountPoint, unmount, err := mountSnapshot(job.ID, snapshot.Path)
+	if err != nil {
+		return err
+	}
+	defer unmount()
+
+	var lastUpdate time.Time
+	stored, err := rp.Backup(ctx, mountPoint, repo.BackupOptions{
+		Source:         snapshot.Subvolume,
+		SourceSnapshot: snapshot.ID,
+		Tags:           snapshot.Tags,
+		Progress: func(p repo.BackupProgress) {
+			if time.Since(lastUpdate) < time.Second {
+				return
+			}
+			lastUpdate = time.Now()
+			progress := 0
+			if snapshot.SizeBytes > 0 {
+				progress = int(min(p.Bytes*100/snapshot.SizeBytes, 99))
+			}
+			r.jobManager.UpdateProgress(job.ID, progress, snapshot.SizeBytes, p.Bytes)
+		},
+		Warn: func(path string, err error) {
+			r.jobManager.AddLogEntry(job.ID, "warn", fmt.Sprintf("Skipped %s: %v", path, err))
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("repository backup failed: %w", err)
+	}
+	r.jobManager.AddLogEntry(job.ID, "info", fmt.Sprintf("Stored repository snapshot %s: %d files, %d changed, %d bytes added",
+		stored.ID, stored.Stats.Files, stored.Stats.ChangedFiles, stored.Stats.AddedBytes))
+
+	// Retention failures leave extra snapshots behind but the backup itself
+	// succeeded
+	if dest.Retention != nil {
+		if err := r.forgetRepo(ctx, job, rp, *dest.Retention); err != nil {
+			r.jobManager.AddLogEntry(job.ID, "error", fmt.Sprintf("Repository retention failed: %v", err))
+		} else if err := r.pruneRepo(ctx, job, rp); err != nil {
+			r.jobManager.AddLogEntry(job.ID, "error", fmt.Sprintf("Repository prune failed: %v", err))
+		}
+	}
+
+	return nil
+}
+
+// forgetRepo removes the snapshots a retention policy does not keep
+func (r *Replicator) forgetRepo(ctx context.Context, job *BackupJob, rp *repo.Repository, retention RetentionPolicy) error {
+	removed, err := rp.Forget(ctx, repo.KeepPolicy{
+		Last:    retention.MinKeep,
+		Daily:   retention.Days,
+		Weekly:  retention.Weeks,
+		Monthly: retention.Months,
+		Yearly:  retention.Years,
+	})
+	if err != nil {
+		return err
+	}
+	r.jobManager.AddLogEntry(job.ID, "info", fmt.Sprintf("Retention removed %d repository snapshots", len(removed)))
+	return nil
+}
+
+func (r *Replicator) pruneRepo(ctx context.Context, job *BackupJob, rp *repo.Repository) error {
+	res, err := rp.Prune(ctx)
+	if err != nil {
+		return err
+	}
+	r.jobManager.AddLogEntry(job.ID, "info", fmt.Sprintf("Pruned %d packs (%d rewritten), freed %d bytes",
+		res.PacksRemoved, res.PacksRewritten, res.BytesFreed))
+	return nil
+}
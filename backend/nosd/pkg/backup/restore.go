@@ -1,8 +1,8 @@
 package backup
 
 import (
+	"context"
 	"fmt"
-	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
@@ -19,6 +19,11 @@ type Restorer struct {
 	jobManager  *JobManager
 	scheduler   *Scheduler
 	replicator  *Replicator
+	catalog     *Catalog
+	puller      *Puller
+	
+	// mount mounts a local snapshot read-only; tests replace it
+	mount func(jobID string, snapshotPath string) (string, func(), error)
 }
 
 // NewRestorer creates a new restorer
@@ -204,12 +209,19 @@ func (r *Restorer) ListRestorePoints() ([]RestorePoint, error) {
 	// Add local snapshots
 	snapshots := r.scheduler.ListSnapshots()
 	for _, snap := range snapshots {
+		source := "local"
+		if r.puller != nil {
+			// Snapshots of pulled clients are named after the client
+			if src := r.puller.SourceForSubvolume(snap.Subvolume); src != nil {
+				source = src.Name
+			}
+		}
 		points = append(points, RestorePoint{
 			ID:        snap.ID,
 			Type:      "local",
 			Subvolume: snap.Subvolume,
 			Timestamp: snap.CreatedAt,
-			Source:    "local",
+			Source:    source,
 			Path:      snap.Path,
 		})
 	}
@@ -221,6 +233,47 @@ func (r *Restorer) ListRestorePoints() ([]RestorePoint, error) {
 			continue
 		}
 		
+		// Repositories list their snapshots
+		if dest.Type == "repo" {
+			snaps, err := r.replicator.RepositorySnapshots(context.Background(), dest.ID)
+			if err != nil {
+				r.logger.Warn().Err(err).Str("destination", dest.ID).Msg("Failed to list repository snapshots")
+				continue
+			}
+			for _, snap := range snaps {
+				points = append(points, RestorePoint{
+					ID:            snap.ID,
+					Type:          "repo",
+					Subvolume:     snap.Source,
+					Timestamp:     snap.Time,
+					Source:        dest.Name,
+					DestinationID: dest.ID,
+				})
+			}
+			continue
+		}
+		
+		// S3 buckets list their backup sets
+		if dest.Type == "s3" {
+			sets, err := r.replicator.S3BackupSets(context.Background(), dest.ID)
+			if err != nil {
+				r.logger.Warn().Err(err).Str("destination", dest.ID).Msg("Failed to list S3 backup sets")
+				continue
+			}
+			for _, set := range sets {
+				points = append(points, RestorePoint{
+					ID:            set.SnapshotID,
+					Type:          "s3",
+					Subvolume:     set.Subvolume,
+					Timestamp:     set.CreatedAt,
+					Source:        dest.Name,
+					Path:          set.Key,
+					DestinationID: dest.ID,
+				})
+			}
+			continue
+		}
+		
 		// For each destination, we would list available snapshots
 		// This would require querying the remote destination
 		// For now, we'll add a placeholder
@@ -242,6 +295,11 @@ func (r *Restorer) runRestore(job *BackupJob, plan *RestorePlan) {
 	job.State = JobStateRunning
 	r.jobManager.UpdateJob(job)
 	
+	// A files restore copies out of the snapshot mounted by its mount action
+	var mountPoint string
+	unmount := func() {}
+	defer func() { unmount() }()
+	
 	// Execute each action
 	for i, action := range plan.Actions {
 		// Update progress
@@ -263,11 +321,12 @@ func (r *Restorer) runRestore(job *BackupJob, plan *RestorePlan) {
 		case "rollback":
 			err = r.rollbackSubvolume(plan, action.Target)
 		case "mount":
-			err = r.mountSnapshot(action.Target)
+			mountPoint, unmount, err = r.mountSnapshot(job.ID, action.Target)
 		case "copy":
-			err = r.copyFiles(plan, action.Target)
+			err = r.copyFiles(mountPoint, action.Target)
 		case "unmount":
-			err = r.unmountSnapshot(action.Target)
+			unmount()
+			unmount = func() {}
 		default:
 			err = fmt.Errorf("unknown action type: %s", action.Type)
 		}
@@ -329,7 +388,12 @@ func (r *Restorer) getAffectedServices(targetPath string) []string {
 func (r *Restorer) createSafetySnapshot(targetPath string) error {
 	// Generate snapshot name
 	timestamp := time.Now().Format("20060102-150405")
-	snapshotPath := fmt.Sprintf("@snapshots/restore-safety/%s-%s", filepath.Base(targetPath), timestamp)
+	name := fmt.Sprintf("%s-%s", filepath.Base(targetPath), timestamp)
+	snapshotPath := fmt.Sprintf("@snapshots/restore-safety/%s", name)
+	if filepath.IsAbs(targetPath) {
+		// Next to the target, snapshots can't leave their filesystem
+		snapshotPath = filepath.Join(filepath.Dir(targetPath), ".snapshots", "restore-safety", name)
+	}
 	
 	// Create snapshot via agent
 	return r.agentClient.CreateSnapshot(targetPath, snapshotPath, true)
@@ -406,44 +470,38 @@ func (r *Restorer) rollbackSubvolume(plan *RestorePlan, targetPath string) error
 	}
 }
 
-func (r *Restorer) mountSnapshot(snapshotPath string) error {
-	// Create mount point
-	mountPoint := fmt.Sprintf("/tmp/restore-mount-%s", uuid.New().String())
-	if err := os.MkdirAll(mountPoint, 0755); err != nil {
-		return err
+func (r *Restorer) mountSnapshot(jobID string, snapshotPath string) (string, func(), error) {
+	mount := r.mount
+	if mount == nil {
+		mount = mountSnapshot
 	}
-	
-	// Mount snapshot read-only
-	return exec.Command("mount", "-o", "ro,subvol="+snapshotPath, "/dev/mapper/nos-root", mountPoint).Run()
+	mountPoint, unmount, err := mount(jobID, snapshotPath)
+	if err != nil {
+		return "", func() {}, err
+	}
+	return mountPoint, unmount, nil
 }
 
-func (r *Restorer) copyFiles(plan *RestorePlan, targetPath string) error {
-	// Get mount point from previous mount action
-	mountPoint := "/tmp/restore-mount-*"
+func (r *Restorer) copyFiles(mountPoint string, targetPath string) error {
+	if mountPoint == "" {
+		return fmt.Errorf("snapshot is not mounted")
+	}
 	
 	// Use rsync to copy files preserving attributes
-	cmd := exec.Command("rsync", "-avHAX", "--progress", mountPoint+"/", targetPath+"/")
-	return cmd.Run()
-}
-
-func (r *Restorer) unmountSnapshot(snapshotPath string) error {
-	// Find and unmount
-	mountPoint := "/tmp/restore-mount-*"
-	cmd := exec.Command("umount", mountPoint)
-	if err := cmd.Run(); err != nil {
-		return err
+	cmd := exec.Command("rsync", "-aHAX", mountPoint+"/", targetPath+"/")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("rsync failed: %v: %s", err, strings.TrimSpace(string(out)))
 	}
-	
-	// Clean up mount point
-	return os.RemoveAll(mountPoint)
+	return nil
 }
 
 // RestorePoint represents an available restore point
 type RestorePoint struct {
 	ID        string    `json:"id"`
-	Type      string    `json:"type"`      // "local", "ssh", "rclone"
+	Type      string    `json:"type"`      // "local", "ssh", "rclone", "repo", "s3"
 	Subvolume string    `json:"subvolume"`
 	Timestamp time.Time `json:"timestamp"`
 	Source    string    `json:"source"` // Source name (local, destination name)
 	Path      string    `json:"path"`
+	DestinationID string `json:"destination_id,omitempty"`
 }
@@ -0,0 +1,351 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"nithronos/backend/nosd/pkg/backup/repo"
+)
+
+// Selective restore copies chosen files and folders out of a restore point,
+// keeping their path below the point's root, to the location they were
+// backed up from or to another directory.
+
+// Conflict policies of a file restore
+const (
+	ConflictSkip      = "skip"      // keep the existing file
+	ConflictOverwrite = "overwrite" // replace the existing file
+	ConflictRename    = "rename"    // restore next to it as name.restored.ext
+)
+
+// FileRestoreRequest selects what to restore from a restore point
+type FileRestoreRequest struct {
+	Point PointRef `json:"point"`
+	// Paths are files or directories inside the point
+	Paths []string `json:"paths"`
+	// TargetPath defaults to the original location of the point's
+	// subvolume, or the client for snapshots of a pull source
+	TargetPath string `json:"target_path,omitempty"`
+	Conflict   string `json:"conflict"`
+}
+
+// FileRestoreStats counts what a file restore did
+type FileRestoreStats struct {
+	Restored int   `json:"restored"`
+	Skipped  int   `json:"skipped"`
+	Renamed  int   `json:"renamed"`
+	Bytes    int64 `json:"bytes"`
+}
+
+// RestoreFiles restores files and folders of a restore point in the
+// background
+func (r *Restorer) RestoreFiles(req FileRestoreRequest) (*BackupJob, error) {
+	if req.Point.Type != "local" && req.Point.Type != "repo" {
+		return nil, fmt.Errorf("files can't be restored from restore points of type %s", req.Point.Type)
+	}
+	if req.Conflict == "" {
+		req.Conflict = ConflictSkip
+	}
+	if req.Conflict != ConflictSkip && req.Conflict != ConflictOverwrite && req.Conflict != ConflictRename {
+		return nil, fmt.Errorf("invalid conflict policy: %s", req.Conflict)
+	}
+	if len(req.Paths) == 0 {
+		return nil, fmt.Errorf("at least one path is required")
+	}
+	paths := make([]string, 0, len(req.Paths))
+	for _, p := range req.Paths {
+		clean, err := cleanRestorePath(p)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, clean)
+	}
+	if req.TargetPath != "" && !filepath.IsAbs(req.TargetPath) {
+		return nil, fmt.Errorf("target path must be absolute")
+	}
+
+	job := &BackupJob{
+		ID:            uuid.New().String(),
+		Type:          "restore",
+		State:         JobStatePending,
+		SourceType:    req.Point.Type,
+		SnapshotID:    req.Point.ID,
+		DestinationID: req.Point.DestinationID,
+		RestoreType:   "files",
+		RestorePath:   req.TargetPath,
+		StartedAt:     time.Now(),
+	}
+	r.jobManager.AddJob(job)
+
+	go r.runFileRestore(job, req, paths)
+	return job, nil
+}
+
+func (r *Restorer) runFileRestore(job *BackupJob, req FileRestoreRequest, paths []string) {
+	job.State = JobStateRunning
+	r.jobManager.UpdateJob(job)
+
+	stats, err := r.restoreFiles(context.Background(), job, req, paths)
+	now := time.Now()
+	job.FinishedAt = &now
+	if err != nil {
+		job.State = JobStateFailed
+		job.Error = err.Error()
+		r.jobManager.AddLogEntry(job.ID, "error", job.Error)
+		r.jobManager.UpdateJob(job)
+		return
+	}
+	job.State = JobStateSucceeded
+	job.Progress = 100
+	r.jobManager.AddLogEntry(job.ID, "info", fmt.Sprintf("Restored %d files (%d bytes) to %s, %d skipped, %d renamed",
+		stats.Restored, stats.Bytes, job.RestorePath, stats.Skipped, stats.Renamed))
+	r.jobManager.UpdateJob(job)
+}
+
+func (r *Restorer) restoreFiles(ctx context.Context, job *BackupJob, req FileRestoreRequest, paths []string) (*FileRestoreStats, error) {
+	fsys, root, meta, closer, err := r.pointFS(ctx, req.Point, job.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer closer()
+
+	target := req.TargetPath
+	if target == "" && r.puller != nil {
+		if src := r.puller.SourceForSubvolume(meta.Subvolume); src != nil {
+			if root == "" {
+				return nil, fmt.Errorf("files of %s can only be restored to the client from local snapshots, choose a target path", src.Name)
+			}
+			job.RestorePath = fmt.Sprintf("%s@%s:/", src.User, src.Host)
+			r.jobManager.UpdateJob(job)
+			return r.puller.PushFiles(ctx, job, src, root, paths, req.Conflict)
+		}
+	}
+	if target == "" {
+		target = originalPath(meta.Subvolume)
+		if target == "" {
+			return nil, fmt.Errorf("original location of %s is unknown, choose a target path", meta.Subvolume)
+		}
+		job.RestorePath = target
+		r.jobManager.UpdateJob(job)
+	}
+
+	// The catalog, when present, sizes the restore for progress reporting
+	var total int64
+	if r.catalog != nil {
+		if index, err := r.catalog.load(req.Point); err == nil {
+			for _, entry := range index.Entries {
+				for _, p := range paths {
+					if p == "." || entry.Path == p || strings.HasPrefix(entry.Path, p+"/") {
+						total += entry.Size
+						break
+					}
+				}
+			}
+		}
+	}
+
+	c := &fileCopier{
+		fsys:     fsys,
+		root:     root,
+		conflict: req.Conflict,
+		stats:    &FileRestoreStats{},
+		log: func(level, msg string) {
+			r.jobManager.AddLogEntry(job.ID, level, msg)
+		},
+		progress: func(done int64) {
+			if total > 0 {
+				r.jobManager.UpdateProgress(job.ID, int(min(done*100/total, 99)), total, done)
+			}
+		},
+	}
+	for _, p := range paths {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		info, err := c.lstat(p)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+		dst := target
+		if p != "." {
+			dst = filepath.Join(target, filepath.FromSlash(p))
+			if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+				return nil, err
+			}
+		}
+		if err := c.copy(p, info, dst); err != nil {
+			return nil, err
+		}
+	}
+	return c.stats, nil
+}
+
+// fileCopier copies entries of a restore point to disk
+type fileCopier struct {
+	fsys     fs.FS
+	root     string
+	conflict string
+	stats    *FileRestoreStats
+	log      func(level, msg string)
+	progress func(done int64)
+}
+
+func (c *fileCopier) copy(name string, info fs.FileInfo, dst string) error {
+	existing, err := os.Lstat(dst)
+	exists := err == nil
+	// Directories are merged unless a file is in the way
+	if exists && !(info.IsDir() && existing.IsDir()) {
+		switch c.conflict {
+		case ConflictSkip:
+			c.stats.Skipped++
+			c.log("info", fmt.Sprintf("Skipped %s: already exists", dst))
+			return nil
+		case ConflictOverwrite:
+			if err := os.RemoveAll(dst); err != nil {
+				return err
+			}
+		case ConflictRename:
+			dst = renamedPath(dst)
+			c.stats.Renamed++
+			c.log("info", fmt.Sprintf("Restoring %s as %s", name, dst))
+		}
+	}
+
+	switch {
+	case info.IsDir():
+		if err := os.MkdirAll(dst, info.Mode().Perm()|0700); err != nil {
+			return err
+		}
+		entries, err := fs.ReadDir(c.fsys, name)
+		if err != nil {
+			c.log("warn", fmt.Sprintf("Skipped %s: %v", name, err))
+			return nil
+		}
+		for _, entry := range entries {
+			child, err := entry.Info()
+			if err != nil {
+				c.log("warn", fmt.Sprintf("Skipped %s: %v", path.Join(name, entry.Name()), err))
+				continue
+			}
+			if err := c.copy(path.Join(name, entry.Name()), child, filepath.Join(dst, entry.Name())); err != nil {
+				return err
+			}
+		}
+		_ = os.Chmod(dst, info.Mode().Perm())
+		_ = os.Chtimes(dst, info.ModTime(), info.ModTime())
+
+	case info.Mode()&fs.ModeSymlink != 0:
+		target, err := c.linkTarget(name, info)
+		if err != nil {
+			c.log("warn", fmt.Sprintf("Skipped %s: %v", name, err))
+			return nil
+		}
+		if err := os.Symlink(target, dst); err != nil {
+			return err
+		}
+		c.stats.Restored++
+
+	case info.Mode().IsRegular():
+		if err := c.copyFile(name, info, dst); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		c.stats.Restored++
+		c.stats.Bytes += info.Size()
+		c.progress(c.stats.Bytes)
+
+	default:
+		c.log("warn", fmt.Sprintf("Skipped %s: special file", name))
+	}
+	return nil
+}
+
+// copyFile writes a file next to its destination first so an interrupted
+// restore never leaves a truncated file behind
+func (c *fileCopier) copyFile(name string, info fs.FileInfo, dst string) error {
+	src, err := c.fsys.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := filepath.Join(filepath.Dir(dst), ".restore-"+uuid.New().String())
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, src)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chtimes(tmp, info.ModTime(), info.ModTime())
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// lstat stats an entry without following a symlink on local disk
+func (c *fileCopier) lstat(name string) (fs.FileInfo, error) {
+	if c.root != "" {
+		return os.Lstat(filepath.Join(c.root, filepath.FromSlash(name)))
+	}
+	return fs.Stat(c.fsys, name)
+}
+
+func (c *fileCopier) linkTarget(name string, info fs.FileInfo) (string, error) {
+	if node, ok := info.Sys().(*repo.Node); ok {
+		return node.LinkTarget, nil
+	}
+	if c.root != "" {
+		return os.Readlink(filepath.Join(c.root, filepath.FromSlash(name)))
+	}
+	return "", fmt.Errorf("symlink target unknown")
+}
+
+// renamedPath finds a free name next to p: report.pdf becomes
+// report.restored.pdf, then report.restored-2.pdf
+func renamedPath(p string) string {
+	ext := filepath.Ext(p)
+	base := strings.TrimSuffix(p, ext)
+	if ext == p || strings.HasSuffix(base, string(filepath.Separator)) {
+		base, ext = p, ""
+	}
+	for i := 1; ; i++ {
+		candidate := base + ".restored" + ext
+		if i > 1 {
+			candidate = fmt.Sprintf("%s.restored-%d%s", base, i, ext)
+		}
+		if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+	}
+}
+
+// originalPath maps a subvolume to where it is mounted. Absolute subvolumes
+// are their own location; the flat layout mounts @ at / and @name at /name.
+func originalPath(subvolume string) string {
+	switch {
+	case filepath.IsAbs(subvolume):
+		return filepath.Clean(subvolume)
+	case subvolume == "@":
+		return "/"
+	case strings.HasPrefix(subvolume, "@") && !strings.Contains(subvolume, "/"):
+		return "/" + strings.TrimPrefix(subvolume, "@")
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,445 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"nithronos/backend/nosd/pkg/backup/s3"
+)
+
+// S3 destinations ("s3") store btrfs send streams in an S3-compatible
+// bucket. Each replication uploads one backup set under
+// <prefix>/<subvolume>/<snapshot ID>/: the stream, full or incremental to a
+// parent set, and a manifest written once the stream is complete. Sets
+// without a manifest are unfinished uploads.
+
+const (
+	s3StreamName   = "stream.btrfs"
+	s3ManifestName = "manifest.json"
+
+	// Unfinished sets older than this are removed by retention
+	s3OrphanAge = 24 * time.Hour
+)
+
+// S3BackupSet is a snapshot stored in a bucket
+type S3BackupSet struct {
+	SnapshotID string    `json:"snapshot_id"`
+	Subvolume  string    `json:"subvolume"`
+	Parent     string    `json:"parent,omitempty"` // set the stream is incremental to
+	CreatedAt  time.Time `json:"created_at"`       // when the snapshot was taken
+	UploadedAt time.Time `json:"uploaded_at"`
+	Size       int64     `json:"size"`
+	SHA256     string    `json:"sha256,omitempty"` // of the stream
+	Key        string    `json:"key"`              // key prefix of the set
+}
+
+// StoreS3Credentials stores the access key of an S3 destination. The
+// secret key is kept in the keys directory, not in the destination.
+func (r *Replicator) StoreS3Credentials(destID string, accessKeyID string, secretKey string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	dest, ok := r.destinations[destID]
+	if !ok {
+		return fmt.Errorf("destination not found: %s", destID)
+	}
+	if dest.Type != "s3" {
+		return fmt.Errorf("destination is not S3 type")
+	}
+	if accessKeyID == "" || secretKey == "" {
+		return fmt.Errorf("access key ID and secret access key are required")
+	}
+
+	if dest.CredentialsRef == "" {
+		dest.CredentialsRef = fmt.Sprintf("%s.s3", dest.ID)
+	}
+	if err := os.WriteFile(filepath.Join(r.keysDir, dest.CredentialsRef), []byte(secretKey), 0600); err != nil {
+		return fmt.Errorf("failed to write S3 credentials: %w", err)
+	}
+	dest.AccessKeyID = accessKeyID
+	dest.UpdatedAt = time.Now()
+
+	return r.saveStateLocked()
+}
+
+// S3BackupSets lists the complete backup sets in an S3 destination, newest
+// first
+func (r *Replicator) S3BackupSets(ctx context.Context, destID string) ([]*S3BackupSet, error) {
+	dest, err := r.destinationOfType(destID, "s3")
+	if err != nil {
+		return nil, err
+	}
+	client, err := r.s3Client(dest)
+	if err != nil {
+		return nil, err
+	}
+	sets, _, err := listS3Sets(ctx, client, dest)
+	return sets, err
+}
+
+// DeleteS3BackupSet removes a backup set. Sets other sets are incremental
+// to cannot be removed.
+func (r *Replicator) DeleteS3BackupSet(ctx context.Context, destID string, snapshotID string) error {
+	dest, err := r.destinationOfType(destID, "s3")
+	if err != nil {
+		return err
+	}
+	client, err := r.s3Client(dest)
+	if err != nil {
+		return err
+	}
+	sets, objects, err := listS3Sets(ctx, client, dest)
+	if err != nil {
+		return err
+	}
+
+	var target *S3BackupSet
+	for _, set := range sets {
+		if set.SnapshotID == snapshotID {
+			target = set
+		}
+	}
+	if target == nil {
+		return fmt.Errorf("backup set not found: %s", snapshotID)
+	}
+	for _, set := range sets {
+		if set.Parent == snapshotID && set.Subvolume == target.Subvolume {
+			return fmt.Errorf("backup set %s is the parent of %s", snapshotID, set.SnapshotID)
+		}
+	}
+	return deleteS3Set(ctx, client, target.Key, objects)
+}
+
+// PruneS3 starts a job that applies the destination's retention
+func (r *Replicator) PruneS3(destID string) (*BackupJob, error) {
+	dest, err := r.destinationOfType(destID, "s3")
+	if err != nil {
+		return nil, err
+	}
+	if dest.Retention == nil {
+		return nil, fmt.Errorf("destination has no retention policy")
+	}
+
+	return r.startDestinationJob(dest, "prune", func(ctx context.Context, job *BackupJob) error {
+		client, err := r.s3Client(dest)
+		if err != nil {
+			return err
+		}
+		return r.expireS3Sets(ctx, job, client, dest)
+	}), nil
+}
+
+// Private methods
+
+func (r *Replicator) s3Client(dest *Destination) (*s3.Client, error) {
+	if dest.AccessKeyID == "" || dest.CredentialsRef == "" {
+		return nil, fmt.Errorf("S3 credentials are not set")
+	}
+	secret, err := os.ReadFile(filepath.Join(r.keysDir, dest.CredentialsRef))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read S3 credentials: %w", err)
+	}
+	return s3.New(s3.Config{
+		Endpoint:     dest.Endpoint,
+		Region:       dest.Region,
+		Bucket:       dest.Bucket,
+		AccessKey:    dest.AccessKeyID,
+		SecretKey:    strings.TrimSpace(string(secret)),
+		PathStyle:    dest.PathStyle,
+		StorageClass: dest.StorageClass,
+	})
+}
+
+// s3Key joins key parts below the destination's prefix
+func s3Key(dest *Destination, parts ...string) string {
+	if prefix := strings.Trim(dest.Prefix, "/"); prefix != "" {
+		parts = append([]string{prefix}, parts...)
+	}
+	return strings.Join(parts, "/")
+}
+
+// testS3Destination writes, reads back and deletes a probe object
+func (r *Replicator) testS3Destination(dest *Destination) error {
+	client, err := r.s3Client(dest)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	key := s3Key(dest, ".nos-probe-"+uuid.New().String())
+	probe := make([]byte, 1024)
+	if _, err := rand.Read(probe); err != nil {
+		return err
+	}
+	if err := client.Put(ctx, key, probe); err != nil {
+		return fmt.Errorf("write probe failed: %w", err)
+	}
+
+	readErr := func() error {
+		rc, err := client.Get(ctx, key)
+		if err != nil {
+			return fmt.Errorf("read probe failed: %w", err)
+		}
+		defer rc.Close()
+		got, err := io.ReadAll(rc)
+		if err != nil {
+			return fmt.Errorf("read probe failed: %w", err)
+		}
+		if !bytes.Equal(got, probe) {
+			return fmt.Errorf("read probe returned different content")
+		}
+		return nil
+	}()
+
+	if err := client.Delete(ctx, key); err != nil {
+		return fmt.Errorf("delete probe failed: %w", err)
+	}
+	return readErr
+}
+
+func (r *Replicator) replicateS3(job *BackupJob, dest *Destination, snapshot *Snapshot, baseSnapshotID string) error {
+	if snapshot == nil {
+		return fmt.Errorf("snapshot not found: %s", job.SnapshotID)
+	}
+
+	ctx, cancel := r.jobContext(job.ID)
+	defer cancel()
+
+	client, err := r.s3Client(dest)
+	if err != nil {
+		return err
+	}
+
+	// An incremental stream is only restorable if its parent set is there
+	sendArgs := []string{"send"}
+	parent := ""
+	if baseSnapshotID != "" && r.scheduler != nil {
+		base, err := r.scheduler.GetSnapshot(baseSnapshotID)
+		if err == nil {
+			rc, err := client.Get(ctx, s3Key(dest, base.Subvolume, base.ID, s3ManifestName))
+			if err == nil {
+				rc.Close()
+				sendArgs = append(sendArgs, "-p", base.Path)
+				parent = base.ID
+			}
+		}
+	}
+	if baseSnapshotID != "" && parent == "" {
+		r.jobManager.AddLogEntry(job.ID, "warn", fmt.Sprintf("Parent %s is not in the bucket, sending a full stream", baseSnapshotID))
+	}
+	job.Incremental = parent != ""
+	job.BaseSnapshot = parent
+	sendArgs = append(sendArgs, snapshot.Path)
+
+	setKey := s3Key(dest, snapshot.Subvolume, snapshot.ID)
+	streamKey := setKey + "/" + s3StreamName
+
+	sendCmd := exec.CommandContext(ctx, "btrfs", sendArgs...)
+	var stderr bytes.Buffer
+	sendCmd.Stderr = &stderr
+	stdout, err := sendCmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to create pipe: %w", err)
+	}
+	if err := sendCmd.Start(); err != nil {
+		return fmt.Errorf("failed to start btrfs send: %w", err)
+	}
+
+	src := s3.Throttle(ctx, stdout, int64(dest.BandwidthLimit)*1024)
+	src = &progressReader{r: src, report: func(n int64) {
+		progress := 0
+		if snapshot.SizeBytes > 0 {
+			progress = int(min(n*100/snapshot.SizeBytes, 99))
+		}
+		r.jobManager.UpdateProgress(job.ID, progress, snapshot.SizeBytes, n)
+	}}
+	hash := sha256.New()
+	src = io.TeeReader(src, hash)
+	size, uploadErr := client.Upload(ctx, streamKey, src, s3.UploadOptions{Concurrency: dest.Concurrency})
+	if uploadErr != nil {
+		_ = sendCmd.Process.Kill()
+	}
+	waitErr := sendCmd.Wait()
+	if uploadErr != nil {
+		return fmt.Errorf("upload failed: %w", uploadErr)
+	}
+	if waitErr != nil {
+		// The stream is truncated
+		_ = client.Delete(context.Background(), streamKey)
+		return fmt.Errorf("btrfs send failed: %w: %s", waitErr, strings.TrimSpace(stderr.String()))
+	}
+
+	manifest, _ := json.MarshalIndent(&S3BackupSet{
+		SnapshotID: snapshot.ID,
+		Subvolume:  snapshot.Subvolume,
+		Parent:     parent,
+		CreatedAt:  snapshot.CreatedAt,
+		UploadedAt: time.Now().UTC(),
+		Size:       size,
+		SHA256:     hex.EncodeToString(hash.Sum(nil)),
+		Key:        setKey,
+	}, "", "  ")
+	if err := client.Put(ctx, setKey+"/"+s3ManifestName, manifest); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	r.jobManager.AddLogEntry(job.ID, "info", fmt.Sprintf("Uploaded %d bytes to s3://%s/%s", size, client.Bucket(), setKey))
+
+	// Retention failures leave extra sets behind but the upload succeeded
+	if dest.Retention != nil {
+		if err := r.expireS3Sets(ctx, job, client, dest); err != nil {
+			r.jobManager.AddLogEntry(job.ID, "error", fmt.Sprintf("S3 retention failed: %v", err))
+		}
+	}
+
+	return nil
+}
+
+// listS3Sets reads the manifests below the destination's prefix. It also
+// returns all objects found.
+func listS3Sets(ctx context.Context, client *s3.Client, dest *Destination) ([]*S3BackupSet, []s3.Object, error) {
+	prefix := s3Key(dest)
+	if prefix != "" {
+		prefix += "/"
+	}
+	objects, err := client.List(ctx, prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var sets []*S3BackupSet
+	for _, obj := range objects {
+		if !strings.HasSuffix(obj.Key, "/"+s3ManifestName) {
+			continue
+		}
+		rc, err := client.Get(ctx, obj.Key)
+		if err != nil {
+			return nil, nil, err
+		}
+		var set S3BackupSet
+		err = json.NewDecoder(rc).Decode(&set)
+		rc.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid manifest %s: %w", obj.Key, err)
+		}
+		set.Key = strings.TrimSuffix(obj.Key, "/"+s3ManifestName)
+		sets = append(sets, &set)
+	}
+	sort.Slice(sets, func(i, j int) bool { return sets[i].CreatedAt.After(sets[j].CreatedAt) })
+	return sets, objects, nil
+}
+
+// deleteS3Set removes a set's manifest, then the rest of it, so a partly
+// deleted set looks unfinished rather than complete
+func deleteS3Set(ctx context.Context, client *s3.Client, setKey string, objects []s3.Object) error {
+	if err := client.Delete(ctx, setKey+"/"+s3ManifestName); err != nil {
+		return err
+	}
+	for _, obj := range objects {
+		if strings.HasPrefix(obj.Key, setKey+"/") && !strings.HasSuffix(obj.Key, "/"+s3ManifestName) {
+			if err := client.Delete(ctx, obj.Key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// expireS3Sets deletes the sets the retention policy does not keep, per
+// subvolume. Parents of kept incremental sets are kept too.
+func (r *Replicator) expireS3Sets(ctx context.Context, job *BackupJob, client *s3.Client, dest *Destination) error {
+	retention := *dest.Retention
+	if retention == (RetentionPolicy{}) {
+		return nil
+	}
+	sets, objects, err := listS3Sets(ctx, client, dest)
+	if err != nil {
+		return err
+	}
+
+	bySubvolume := make(map[string][]*S3BackupSet)
+	for _, set := range sets {
+		bySubvolume[set.Subvolume] = append(bySubvolume[set.Subvolume], set)
+	}
+	removed := 0
+	for _, group := range bySubvolume {
+		byID := make(map[string]*S3BackupSet, len(group))
+		snapshots := make([]*Snapshot, len(group))
+		for i, set := range group {
+			byID[set.SnapshotID] = set
+			snapshots[i] = &Snapshot{ID: set.SnapshotID, Subvolume: set.Subvolume, CreatedAt: set.CreatedAt}
+		}
+		keep := make(map[string]bool)
+		for _, snap := range selectGFSSnapshots(snapshots, retention) {
+			for id := snap.ID; id != "" && !keep[id]; {
+				keep[id] = true
+				if set, ok := byID[id]; ok {
+					id = set.Parent
+				} else {
+					id = ""
+				}
+			}
+		}
+		for _, set := range group {
+			if keep[set.SnapshotID] {
+				continue
+			}
+			if err := deleteS3Set(ctx, client, set.Key, objects); err != nil {
+				return fmt.Errorf("failed to delete backup set %s: %w", set.SnapshotID, err)
+			}
+			removed++
+		}
+	}
+
+	// Streams of uploads that never finished
+	complete := make(map[string]bool, len(sets))
+	for _, set := range sets {
+		complete[set.Key] = true
+	}
+	orphans := 0
+	for _, obj := range objects {
+		setKey, ok := strings.CutSuffix(obj.Key, "/"+s3StreamName)
+		if !ok || complete[setKey] || time.Since(obj.LastModified) < s3OrphanAge {
+			continue
+		}
+		if err := client.Delete(ctx, obj.Key); err != nil {
+			return err
+		}
+		orphans++
+	}
+
+	r.jobManager.AddLogEntry(job.ID, "info", fmt.Sprintf("Retention removed %d backup sets and %d unfinished uploads", removed, orphans))
+	return nil
+}
+
+// progressReader reports the bytes read at most once a second
+type progressReader struct {
+	r      io.Reader
+	n      int64
+	last   time.Time
+	report func(int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.n += int64(n)
+	if time.Since(p.last) >= time.Second {
+		p.last = time.Now()
+		p.report(p.n)
+	}
+	return n, err
+}
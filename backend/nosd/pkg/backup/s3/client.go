@@ -0,0 +1,328 @@
+// Package s3 is a small client for S3-compatible object storage such as AWS
+// S3, MinIO, Backblaze B2 or Wasabi. It signs requests with AWS Signature
+// Version 4 and covers what backups need: put, get, list, delete and
+// multipart uploads.
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNotFound matches errors for missing keys and buckets
+var ErrNotFound = errors.New("not found")
+
+// emptyHash is the SHA-256 of an empty payload
+const emptyHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// Config describes a bucket and how to reach it
+type Config struct {
+	// Endpoint is the service URL, e.g. https://s3.eu-central-1.amazonaws.com
+	// or http://127.0.0.1:9000. It defaults to AWS in Region.
+	Endpoint string
+	// Region defaults to us-east-1, which MinIO accepts as well
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// PathStyle addresses the bucket in the path (endpoint/bucket/key)
+	// instead of the host name (bucket.endpoint/key). MinIO needs it.
+	PathStyle bool
+	// StorageClass is set on uploaded objects, e.g. STANDARD_IA or GLACIER_IR
+	StorageClass string
+	HTTPClient   *http.Client
+}
+
+// Client talks to one bucket
+type Client struct {
+	cfg      Config
+	endpoint *url.URL
+	http     *http.Client
+	now      func() time.Time
+}
+
+// Object is an entry of a listing
+type Object struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+	ETag         string    `json:"etag"`
+}
+
+// Error is an error response from the service
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+	Resource   string
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3: %s: HTTP %d", e.Resource, e.StatusCode)
+	}
+	return fmt.Sprintf("s3: %s: %s: %s", e.Resource, e.Code, e.Message)
+}
+
+// Is makes missing keys and buckets match ErrNotFound
+func (e *Error) Is(target error) bool {
+	return target == ErrNotFound && (e.StatusCode == http.StatusNotFound || e.Code == "NoSuchKey" || e.Code == "NoSuchBucket")
+}
+
+// New returns a client for the bucket in cfg
+func New(cfg Config) (*Client, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("bucket is required")
+	}
+	if cfg.AccessKey == "" || cfg.SecretKey == "" {
+		return nil, fmt.Errorf("access key and secret key are required")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", cfg.Region)
+	}
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid endpoint %q", cfg.Endpoint)
+	}
+	httpClient := cfg.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 30 * time.Minute}
+	}
+	return &Client{cfg: cfg, endpoint: u, http: httpClient, now: time.Now}, nil
+}
+
+// Bucket returns the bucket name
+func (c *Client) Bucket() string {
+	return c.cfg.Bucket
+}
+
+// objectURL builds the URL of a key, or of the bucket for ""
+func (c *Client) objectURL(key string, query url.Values) *url.URL {
+	u := *c.endpoint
+	base := strings.TrimSuffix(u.Path, "/")
+	p := "/" + key
+	if c.cfg.PathStyle {
+		p = "/" + c.cfg.Bucket + p
+	} else {
+		u.Host = c.cfg.Bucket + "." + u.Host
+	}
+	u.Path = base + p
+	u.RawPath = uriEncode(base, false) + uriEncode(p, false)
+	u.RawQuery = canonicalQuery(query)
+	return &u
+}
+
+// do signs and sends a request; non-2xx responses become *Error
+func (c *Client) do(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.objectURL(key, query).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	payloadHash := emptyHash
+	if body != nil {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(body)), nil }
+		req.ContentLength = int64(len(body))
+	}
+	c.sign(req, payloadHash, c.now())
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		return nil, parseError(resp, key)
+	}
+	return resp, nil
+}
+
+func parseError(resp *http.Response, key string) error {
+	e := &Error{StatusCode: resp.StatusCode, Resource: key}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	var body struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if xml.Unmarshal(data, &body) == nil {
+		e.Code, e.Message = body.Code, body.Message
+	}
+	return e
+}
+
+// Put stores an object in one request
+func (c *Client) Put(ctx context.Context, key string, data []byte) error {
+	resp, err := c.do(ctx, http.MethodPut, key, nil, c.uploadHeader(), data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Get returns the content of an object
+func (c *Client) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Delete removes an object. Deleting a missing key is not an error.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	resp, err := c.do(ctx, http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			var e *Error
+			if errors.As(err, &e) && e.Code == "NoSuchBucket" {
+				return err
+			}
+			return nil
+		}
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// List returns all objects whose key starts with prefix, in key order
+func (c *Client) List(ctx context.Context, prefix string) ([]Object, error) {
+	var objects []Object
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		resp, err := c.do(ctx, http.MethodGet, "", q, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				Size         int64     `xml:"Size"`
+				LastModified time.Time `xml:"LastModified"`
+				ETag         string    `xml:"ETag"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3: invalid listing: %w", err)
+		}
+		for _, o := range result.Contents {
+			objects = append(objects, Object{Key: o.Key, Size: o.Size, LastModified: o.LastModified, ETag: strings.Trim(o.ETag, `"`)})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+func (c *Client) uploadHeader() http.Header {
+	h := http.Header{}
+	if c.cfg.StorageClass != "" {
+		h.Set("X-Amz-Storage-Class", c.cfg.StorageClass)
+	}
+	return h
+}
+
+// Multipart uploads
+
+func (c *Client) createMultipart(ctx context.Context, key string) (string, error) {
+	resp, err := c.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, c.uploadHeader(), nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil || result.UploadID == "" {
+		return "", fmt.Errorf("s3: invalid multipart upload response")
+	}
+	return result.UploadID, nil
+}
+
+func (c *Client) uploadPart(ctx context.Context, key, uploadID string, n int, data []byte) (string, error) {
+	q := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {uploadID}}
+	resp, err := c.do(ctx, http.MethodPut, key, q, nil, data)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		return "", fmt.Errorf("s3: part %d has no ETag", n)
+	}
+	return etag, nil
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (c *Client) completeMultipart(ctx context.Context, key, uploadID string, parts []completedPart) error {
+	sort.Slice(parts, func(i, j int) bool { return parts[i].PartNumber < parts[j].PartNumber })
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, nil, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Completion can fail after the 200 status was sent
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	var result struct {
+		XMLName xml.Name
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if xml.Unmarshal(data, &result) == nil && result.XMLName.Local == "Error" {
+		return &Error{StatusCode: resp.StatusCode, Code: result.Code, Message: result.Message, Resource: key}
+	}
+	return nil
+}
+
+func (c *Client) abortMultipart(ctx context.Context, key, uploadID string) error {
+	resp, err := c.do(ctx, http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
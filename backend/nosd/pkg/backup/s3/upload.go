@@ -0,0 +1,199 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultPartSize is the size of the first multipart parts. Later parts
+	// grow so that streams of any size fit in the 10000 parts S3 allows.
+	DefaultPartSize = 16 << 20
+	maxPartSize     = 5 << 30
+	maxParts        = 10000
+)
+
+// UploadOptions control Upload
+type UploadOptions struct {
+	// PartSize is the size of the first parts; it defaults to
+	// DefaultPartSize. S3 rejects parts below 5 MiB except the last.
+	PartSize int
+	// Concurrency is the number of parts uploaded at once, 1 by default.
+	// Each holds a part in memory.
+	Concurrency int
+}
+
+// Upload stores a stream of unknown length. Streams smaller than one part
+// are stored with a single request; larger ones with a multipart upload
+// that is aborted if anything fails. It returns the number of bytes stored.
+func (c *Client) Upload(ctx context.Context, key string, r io.Reader, opts UploadOptions) (int64, error) {
+	if opts.PartSize <= 0 {
+		opts.PartSize = DefaultPartSize
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 1
+	}
+
+	first, last, err := readPart(r, opts.PartSize)
+	if err != nil {
+		return 0, err
+	}
+	if last {
+		return int64(len(first)), c.Put(ctx, key, first)
+	}
+
+	uploadID, err := c.createMultipart(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type part struct {
+		n    int
+		data []byte
+	}
+	var (
+		mu        sync.Mutex
+		completed []completedPart
+		firstErr  error
+		wg        sync.WaitGroup
+	)
+	fail := func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		mu.Unlock()
+		cancel()
+	}
+	parts := make(chan part)
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range parts {
+				etag, err := c.uploadPart(ctx, key, uploadID, p.n, p.data)
+				if err != nil {
+					fail(fmt.Errorf("part %d: %w", p.n, err))
+					continue
+				}
+				mu.Lock()
+				completed = append(completed, completedPart{PartNumber: p.n, ETag: etag})
+				mu.Unlock()
+			}
+		}()
+	}
+
+	var total int64
+	data := first
+	for n := 1; ; n++ {
+		select {
+		case parts <- part{n: n, data: data}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		total += int64(len(data))
+		if last {
+			break
+		}
+		if n == maxParts {
+			fail(fmt.Errorf("stream exceeds %d parts", maxParts))
+			break
+		}
+		data, last, err = readPart(r, partSize(opts.PartSize, n+1))
+		if err != nil {
+			fail(err)
+			break
+		}
+		if len(data) == 0 {
+			break
+		}
+	}
+	close(parts)
+	wg.Wait()
+
+	if firstErr == nil && ctx.Err() != nil {
+		firstErr = ctx.Err()
+	}
+	if firstErr == nil {
+		firstErr = c.completeMultipart(ctx, key, uploadID, completed)
+	}
+	if firstErr != nil {
+		abortCtx, abortCancel := context.WithTimeout(context.Background(), time.Minute)
+		defer abortCancel()
+		_ = c.abortMultipart(abortCtx, key, uploadID)
+		return 0, firstErr
+	}
+	return total, nil
+}
+
+// partSize grows the part size every 2000 parts
+func partSize(base, n int) int {
+	size := base << ((n - 1) / 2000)
+	if size > maxPartSize {
+		size = maxPartSize
+	}
+	return size
+}
+
+// readPart reads up to size bytes; last reports the end of the stream
+func readPart(r io.Reader, size int) ([]byte, bool, error) {
+	buf := make([]byte, size)
+	n, err := io.ReadFull(r, buf)
+	switch {
+	case err == nil:
+		return buf, false, nil
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return buf[:n], true, nil
+	default:
+		return nil, false, err
+	}
+}
+
+// Throttle limits reads from r to bytesPerSec on average. Reading the
+// source of an upload slowly limits the upload's bandwidth.
+func Throttle(ctx context.Context, r io.Reader, bytesPerSec int64) io.Reader {
+	if bytesPerSec <= 0 {
+		return r
+	}
+	return &throttledReader{ctx: ctx, r: r, rate: bytesPerSec}
+}
+
+type throttledReader struct {
+	ctx   context.Context
+	r     io.Reader
+	rate  int64
+	start time.Time
+	read  int64
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if t.start.IsZero() {
+		t.start = time.Now()
+	}
+	// Read at most a quarter second's worth at once so the rate stays even
+	if max := int(t.rate / 4); max > 0 && len(p) > max {
+		p = p[:max]
+	}
+	n, err := t.r.Read(p)
+	t.read += int64(n)
+	due := time.Duration(float64(t.read) / float64(t.rate) * float64(time.Second))
+	if wait := due - time.Since(t.start); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-t.ctx.Done():
+			return n, t.ctx.Err()
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,140 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// memoryBucket is a minimal path-style S3 bucket named "nas"
+type memoryBucket struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (b *memoryBucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	key := strings.TrimPrefix(r.URL.Path, "/nas/")
+	switch r.Method {
+	case http.MethodPut:
+		b.objects[key], _ = io.ReadAll(r.Body)
+	case http.MethodDelete:
+		delete(b.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet:
+		if r.URL.Query().Get("list-type") == "2" {
+			var keys []string
+			for k := range b.objects {
+				if strings.HasPrefix(k, r.URL.Query().Get("prefix")) {
+					keys = append(keys, k)
+				}
+			}
+			sort.Strings(keys)
+			fmt.Fprint(w, "<ListBucketResult>")
+			for _, k := range keys {
+				fmt.Fprintf(w, "<Contents><Key>%s</Key><Size>%d</Size><LastModified>2024-01-02T03:04:05Z</LastModified></Contents>", k, len(b.objects[k]))
+			}
+			fmt.Fprint(w, "</ListBucketResult>")
+			return
+		}
+		data, ok := b.objects[key]
+		if !ok {
+			http.Error(w, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(data)
+	}
+}
+
+func newS3Replicator(t *testing.T, bucket *memoryBucket) (*Replicator, *Destination) {
+	t.Helper()
+	srv := httptest.NewServer(bucket)
+	t.Cleanup(srv.Close)
+	dir := t.TempDir()
+	r := NewReplicator(zerolog.Nop(), filepath.Join(dir, "destinations.json"), filepath.Join(dir, "keys"), NewJobManager(zerolog.Nop()))
+	if err := r.Start(); err != nil {
+		t.Fatal(err)
+	}
+	dest := &Destination{Name: "offsite", Type: "s3", Enabled: true, Endpoint: srv.URL, Bucket: "nas", Prefix: "/nos/", PathStyle: true}
+	if err := r.CreateDestination(dest); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.StoreS3Credentials(dest.ID, "nos", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	return r, dest
+}
+
+func TestS3DestinationProbe(t *testing.T) {
+	bucket := &memoryBucket{objects: map[string][]byte{}}
+	r, dest := newS3Replicator(t, bucket)
+
+	if err := r.TestDestination(dest.ID); err != nil {
+		t.Fatal(err)
+	}
+	if dest.LastTestStatus != "success" || len(bucket.objects) != 0 {
+		t.Errorf("status %q, %d objects left", dest.LastTestStatus, len(bucket.objects))
+	}
+}
+
+func TestS3RetentionKeepsParents(t *testing.T) {
+	bucket := &memoryBucket{objects: map[string][]byte{}}
+	r, dest := newS3Replicator(t, bucket)
+
+	// Sets of @home, newest first: today is incremental to 3 days ago,
+	// which is incremental to 4 days ago
+	now := time.Now()
+	parents := map[string]string{"d0": "d3", "d3": "d4"}
+	for i, id := range []string{"d0", "d1", "d2", "d3", "d4"} {
+		set := S3BackupSet{SnapshotID: id, Subvolume: "@home", Parent: parents[id], CreatedAt: now.Add(-time.Duration(i) * 24 * time.Hour)}
+		manifest, _ := json.Marshal(set)
+		bucket.objects["nos/@home/"+id+"/"+s3ManifestName] = manifest
+		bucket.objects["nos/@home/"+id+"/"+s3StreamName] = []byte("stream")
+	}
+	bucket.objects["nos/@home/unfinished/"+s3StreamName] = []byte("partial")
+
+	dest.Retention = &RetentionPolicy{Days: 2}
+	client, err := r.s3Client(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := &BackupJob{ID: "prune", Type: "prune"}
+	r.jobManager.AddJob(job)
+	if err := r.expireS3Sets(context.Background(), job, client, dest); err != nil {
+		t.Fatal(err)
+	}
+
+	sets, err := r.S3BackupSets(context.Background(), dest.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kept []string
+	for _, set := range sets {
+		kept = append(kept, set.SnapshotID)
+	}
+	if strings.Join(kept, ",") != "d0,d1,d3,d4" {
+		t.Errorf("kept %v, want d0,d1,d3,d4", kept)
+	}
+	if _, ok := bucket.objects["nos/@home/d2/"+s3StreamName]; ok {
+		t.Error("stream of an expired set was kept")
+	}
+	if _, ok := bucket.objects["nos/@home/unfinished/"+s3StreamName]; ok {
+		t.Error("old unfinished upload was kept")
+	}
+
+	if err := r.DeleteS3BackupSet(context.Background(), dest.ID, "d3"); err == nil {
+		t.Error("deleted the parent of an incremental set")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
 	"sort"
 	"sync"
 	"time"
@@ -12,6 +13,9 @@ import (
 	"github.com/google/uuid"
 	"github.com/robfig/cron/v3"
 	"github.com/rs/zerolog"
+
+	"nithronos/backend/nosd/pkg/appsdk"
+	"nithronos/backend/nosd/pkg/jobs"
 )
 
 // Scheduler manages backup schedules and retention
@@ -25,6 +29,11 @@ type Scheduler struct {
 	mu          sync.RWMutex
 	agentClient AgentClient
 	jobManager  *JobManager
+	guard       SnapshotGuard
+	replicator  *Replicator
+	notifier    FailureNotifier
+
+	quiesceSource QuiesceSource
 }
 
 // AgentClient interface for privileged operations
@@ -32,18 +41,35 @@ type AgentClient interface {
 	CreateSnapshot(subvolume string, path string, readOnly bool) error
 	DeleteSnapshot(path string) error
 	GetSnapshotInfo(path string) (*SnapshotInfo, error)
-	ExecuteHook(command string) error
+	// ExecuteHook runs a schedule hook with sh -c and returns its
+	// combined output; it is killed at the deadline of ctx
+	ExecuteHook(ctx context.Context, command string) ([]byte, error)
+	// ExecuteAppHook runs one command of an app's quiesce hook against
+	// the app's compose project
+	ExecuteAppHook(ctx context.Context, appID string, cmd appsdk.ComposeCommand) ([]byte, error)
 }
 
 // SnapshotInfo contains snapshot details from agent
 type SnapshotInfo struct {
 	Path      string
 	Subvolume string
+	UUID      string
 	SizeBytes int64
 	ReadOnly  bool
 	CreatedAt time.Time
 }
 
+// snapshotPathFor names a snapshot of subvol. Subvolumes at the top level
+// of the system volume ("@home") are snapshotted below @snapshots; those
+// on pools, named by absolute path, below .snapshots next to them, since
+// a snapshot can't leave its filesystem.
+func snapshotPathFor(subvol string, name string) string {
+	if filepath.IsAbs(subvol) {
+		return filepath.Join(filepath.Dir(subvol), ".snapshots", filepath.Base(subvol), name)
+	}
+	return fmt.Sprintf("@snapshots/%s/%s", subvol, name)
+}
+
 // NewScheduler creates a new backup scheduler
 func NewScheduler(logger zerolog.Logger, stateFile string, agentClient AgentClient) *Scheduler {
 	return &Scheduler{
@@ -51,13 +77,29 @@ func NewScheduler(logger zerolog.Logger, stateFile string, agentClient AgentClie
 		stateFile:   stateFile,
 		schedules:   make(map[string]*Schedule),
 		snapshots:   make(map[string][]*Snapshot),
-		cron:        cron.New(cron.WithSeconds()),
+		cron:        cron.New(), // schedules use standard five-field expressions
 		cronEntries: make(map[string]cron.EntryID),
 		agentClient: agentClient,
 		jobManager:  NewJobManager(logger),
 	}
 }
 
+// UseSnapshotGuard keeps retention from deleting snapshots the guard
+// protects
+func (s *Scheduler) UseSnapshotGuard(guard SnapshotGuard) {
+	s.guard = guard
+}
+
+// UseJobEngine keeps the backup jobs in engine so they survive restarts
+func (s *Scheduler) UseJobEngine(engine *jobs.Engine) {
+	s.jobManager.UseEngine(engine)
+}
+
+// UseNotifier reports scheduled backups that fail to the notifier
+func (s *Scheduler) UseNotifier(notifier FailureNotifier) {
+	s.notifier = notifier
+}
+
 // Start begins the scheduler
 func (s *Scheduler) Start(ctx context.Context) error {
 	s.logger.Info().Msg("Starting backup scheduler")
@@ -134,7 +176,7 @@ func (s *Scheduler) CreateSchedule(schedule *Schedule) error {
 	}
 
 	// Save state
-	if err := s.saveState(); err != nil {
+	if err := s.saveStateLocked(); err != nil {
 		return fmt.Errorf("failed to save state: %w", err)
 	}
 
@@ -183,7 +225,7 @@ func (s *Scheduler) UpdateSchedule(id string, update *Schedule) error {
 	}
 
 	// Save state
-	if err := s.saveState(); err != nil {
+	if err := s.saveStateLocked(); err != nil {
 		return fmt.Errorf("failed to save state: %w", err)
 	}
 
@@ -210,7 +252,7 @@ func (s *Scheduler) DeleteSchedule(id string) error {
 	delete(s.schedules, id)
 
 	// Save state
-	if err := s.saveState(); err != nil {
+	if err := s.saveStateLocked(); err != nil {
 		return fmt.Errorf("failed to save state: %w", err)
 	}
 
@@ -300,7 +342,7 @@ func (s *Scheduler) DeleteSnapshot(id string) error {
 	s.removeSnapshot(snapshot)
 
 	// Save state
-	if err := s.saveState(); err != nil {
+	if err := s.saveStateLocked(); err != nil {
 		return fmt.Errorf("failed to save state: %w", err)
 	}
 
@@ -326,6 +368,47 @@ func (s *Scheduler) ListSnapshots() []*Snapshot {
 	return snapshots
 }
 
+// GetSnapshot returns a snapshot by ID
+func (s *Scheduler) GetSnapshot(id string) (*Snapshot, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, subvolSnapshots := range s.snapshots {
+		for _, snap := range subvolSnapshots {
+			if snap.ID == id {
+				return snap, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("snapshot not found: %s", id)
+}
+
+// snapshotUUID returns the btrfs UUID of snap, asking the agent when it
+// wasn't known as the snapshot was taken. "" means it is still unknown,
+// and copies of the snapshot can't be recognized by it.
+func (s *Scheduler) snapshotUUID(snap *Snapshot) string {
+	s.mu.RLock()
+	known := snap.UUID
+	s.mu.RUnlock()
+	if known != "" {
+		return known
+	}
+
+	info, err := s.agentClient.GetSnapshotInfo(snap.Path)
+	if err != nil || info.UUID == "" {
+		s.logger.Warn().Err(err).Str("path", snap.Path).Msg("Failed to look up snapshot UUID")
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snap.UUID = info.UUID
+	if err := s.saveStateLocked(); err != nil {
+		s.logger.Error().Err(err).Msg("Failed to save snapshot state")
+	}
+	return info.UUID
+}
+
 // GetJobManager returns the job manager
 func (s *Scheduler) GetJobManager() *JobManager {
 	return s.jobManager
@@ -386,45 +469,72 @@ func (s *Scheduler) validateSchedule(schedule *Schedule) error {
 	}
 
 	// Validate frequency
-	switch schedule.Frequency.Type {
+	if err := validateFrequency(schedule.Frequency); err != nil {
+		return err
+	}
+
+	// Validate retention
+	if schedule.Retention.MinKeep < 0 {
+		return fmt.Errorf("min_keep cannot be negative")
+	}
+
+	return s.validateTargets(schedule.Targets)
+}
+
+// validateFrequency checks the frequency of a schedule or source
+func validateFrequency(freq ScheduleFrequency) error {
+	switch freq.Type {
 	case "cron":
-		if schedule.Frequency.Cron == "" {
+		if freq.Cron == "" {
 			return fmt.Errorf("cron expression is required")
 		}
 		// Validate cron expression
-		if _, err := cron.ParseStandard(schedule.Frequency.Cron); err != nil {
+		if _, err := cron.ParseStandard(freq.Cron); err != nil {
 			return fmt.Errorf("invalid cron expression: %w", err)
 		}
 	case "hourly", "daily", "weekly", "monthly":
 		// These are valid
 	default:
-		return fmt.Errorf("invalid frequency type: %s", schedule.Frequency.Type)
-	}
-
-	// Validate retention
-	if schedule.Retention.MinKeep < 0 {
-		return fmt.Errorf("min_keep cannot be negative")
+		return fmt.Errorf("invalid frequency type: %s", freq.Type)
 	}
-
 	return nil
 }
 
-func (s *Scheduler) scheduleJob(schedule *Schedule) error {
-	// Build cron expression
-	var cronExpr string
-	switch schedule.Frequency.Type {
+// frequencyCron returns the cron expression of a frequency
+func frequencyCron(freq ScheduleFrequency) (string, error) {
+	switch freq.Type {
 	case "cron":
-		cronExpr = schedule.Frequency.Cron
+		return freq.Cron, nil
 	case "hourly":
-		cronExpr = fmt.Sprintf("%d * * * *", schedule.Frequency.Minute)
+		return fmt.Sprintf("%d * * * *", freq.Minute), nil
 	case "daily":
-		cronExpr = fmt.Sprintf("%d %d * * *", schedule.Frequency.Minute, schedule.Frequency.Hour)
+		return fmt.Sprintf("%d %d * * *", freq.Minute, freq.Hour), nil
 	case "weekly":
-		cronExpr = fmt.Sprintf("%d %d * * %d", schedule.Frequency.Minute, schedule.Frequency.Hour, schedule.Frequency.Weekday)
+		return fmt.Sprintf("%d %d * * %d", freq.Minute, freq.Hour, freq.Weekday), nil
 	case "monthly":
-		cronExpr = fmt.Sprintf("%d %d %d * *", schedule.Frequency.Minute, schedule.Frequency.Hour, schedule.Frequency.Day)
+		return fmt.Sprintf("%d %d %d * *", freq.Minute, freq.Hour, freq.Day), nil
 	default:
-		return fmt.Errorf("unsupported frequency type: %s", schedule.Frequency.Type)
+		return "", fmt.Errorf("unsupported frequency type: %s", freq.Type)
+	}
+}
+
+// nextRun returns when a frequency fires next
+func nextRun(freq ScheduleFrequency) time.Time {
+	if cronExpr, err := frequencyCron(freq); err == nil {
+		if sched, err := cron.ParseStandard(cronExpr); err == nil {
+			return sched.Next(time.Now())
+		}
+	}
+
+	// Fallback to 1 hour from now
+	return time.Now().Add(time.Hour)
+}
+
+func (s *Scheduler) scheduleJob(schedule *Schedule) error {
+	// Build cron expression
+	cronExpr, err := frequencyCron(schedule.Frequency)
+	if err != nil {
+		return err
 	}
 
 	// Add cron job
@@ -440,28 +550,7 @@ func (s *Scheduler) scheduleJob(schedule *Schedule) error {
 }
 
 func (s *Scheduler) calculateNextRun(schedule *Schedule) time.Time {
-	// Parse cron expression based on frequency
-	var cronExpr string
-	switch schedule.Frequency.Type {
-	case "cron":
-		cronExpr = schedule.Frequency.Cron
-	case "hourly":
-		cronExpr = fmt.Sprintf("%d * * * *", schedule.Frequency.Minute)
-	case "daily":
-		cronExpr = fmt.Sprintf("%d %d * * *", schedule.Frequency.Minute, schedule.Frequency.Hour)
-	case "weekly":
-		cronExpr = fmt.Sprintf("%d %d * * %d", schedule.Frequency.Minute, schedule.Frequency.Hour, schedule.Frequency.Weekday)
-	case "monthly":
-		cronExpr = fmt.Sprintf("%d %d %d * *", schedule.Frequency.Minute, schedule.Frequency.Hour, schedule.Frequency.Day)
-	}
-
-	// Parse and calculate next run
-	if sched, err := cron.ParseStandard(cronExpr); err == nil {
-		return sched.Next(time.Now())
-	}
-
-	// Fallback to 1 hour from now
-	return time.Now().Add(time.Hour)
+	return nextRun(schedule.Frequency)
 }
 
 func (s *Scheduler) runScheduledBackup(scheduleID string) {
@@ -486,11 +575,22 @@ func (s *Scheduler) runScheduledBackup(scheduleID string) {
 		StartedAt:  time.Now(),
 	}
 
+	// Schedules with targets run as a pipeline under a parent job
+	var parent *BackupJob
+	if len(schedule.Targets) > 0 && s.replicator != nil {
+		parent = s.startPipeline(schedule, job)
+	}
+
 	// Add to job manager
 	s.jobManager.AddJob(job)
 
 	// Run backup
-	s.runSnapshotJob(job, schedule.Subvolumes, "", schedule)
+	snapshots := s.runSnapshotJob(job, schedule.Subvolumes, "", schedule)
+	if parent != nil {
+		s.runPipeline(parent, job, schedule, snapshots)
+	} else if job.State == JobStateFailed {
+		s.notifyFailure(job, schedule, job.Error)
+	}
 
 	// Update schedule
 	s.mu.Lock()
@@ -504,25 +604,24 @@ func (s *Scheduler) runScheduledBackup(scheduleID string) {
 	_ = s.saveState()
 }
 
-func (s *Scheduler) runSnapshotJob(job *BackupJob, subvolumes []string, tag string, schedule *Schedule) {
+// runSnapshotJob creates the snapshots of a job and returns them
+func (s *Scheduler) runSnapshotJob(job *BackupJob, subvolumes []string, tag string, schedule *Schedule) []*Snapshot {
 	// Update job state
 	job.State = JobStateRunning
 	s.jobManager.UpdateJob(job)
 
-	// Run pre-hooks if specified
-	if schedule != nil && len(schedule.PreHooks) > 0 {
-		for _, hook := range schedule.PreHooks {
-			s.logger.Info().Str("hook", hook).Msg("Running pre-hook")
-			if err := s.agentClient.ExecuteHook(hook); err != nil {
-				s.logger.Error().Err(err).Str("hook", hook).Msg("Pre-hook failed")
-				job.State = JobStateFailed
-				job.Error = fmt.Sprintf("pre-hook failed: %v", err)
-				now := time.Now()
-				job.FinishedAt = &now
-				s.jobManager.UpdateJob(job)
-				return
-			}
-		}
+	// Quiesce the apps covered by the snapshots; they resume however the
+	// job ends
+	resume, err := s.quiesce(job, subvolumes, schedule)
+	defer resume()
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Quiesce failed")
+		job.State = JobStateFailed
+		job.Error = err.Error()
+		now := time.Now()
+		job.FinishedAt = &now
+		s.jobManager.UpdateJob(job)
+		return nil
 	}
 
 	// Create snapshots
@@ -534,7 +633,7 @@ func (s *Scheduler) runSnapshotJob(job *BackupJob, subvolumes []string, tag stri
 			timestamp = fmt.Sprintf("%s-%s", timestamp, tag)
 		}
 
-		snapshotPath := fmt.Sprintf("@snapshots/%s/%s", subvol, timestamp)
+		snapshotPath := snapshotPathFor(subvol, timestamp)
 
 		// Create snapshot via agent
 		if err := s.agentClient.CreateSnapshot(subvol, snapshotPath, true); err != nil {
@@ -544,7 +643,7 @@ func (s *Scheduler) runSnapshotJob(job *BackupJob, subvolumes []string, tag stri
 			now := time.Now()
 			job.FinishedAt = &now
 			s.jobManager.UpdateJob(job)
-			return
+			return createdSnapshots
 		}
 
 		// Get snapshot info
@@ -564,6 +663,7 @@ func (s *Scheduler) runSnapshotJob(job *BackupJob, subvolumes []string, tag stri
 			ID:        uuid.New().String(),
 			Subvolume: subvol,
 			Path:      snapshotPath,
+			UUID:      info.UUID,
 			CreatedAt: info.CreatedAt,
 			SizeBytes: info.SizeBytes,
 			ReadOnly:  true,
@@ -590,16 +690,8 @@ func (s *Scheduler) runSnapshotJob(job *BackupJob, subvolumes []string, tag stri
 		s.jobManager.UpdateJob(job)
 	}
 
-	// Run post-hooks if specified
-	if schedule != nil && len(schedule.PostHooks) > 0 {
-		for _, hook := range schedule.PostHooks {
-			s.logger.Info().Str("hook", hook).Msg("Running post-hook")
-			if err := s.agentClient.ExecuteHook(hook); err != nil {
-				s.logger.Error().Err(err).Str("hook", hook).Msg("Post-hook failed")
-				// Don't fail the job for post-hook failures
-			}
-		}
-	}
+	// Resume the apps before the slower retention work
+	resume()
 
 	// Apply retention if this was a scheduled backup
 	if schedule != nil {
@@ -617,9 +709,16 @@ func (s *Scheduler) runSnapshotJob(job *BackupJob, subvolumes []string, tag stri
 	_ = s.saveState()
 
 	s.logger.Info().Int("count", len(createdSnapshots)).Msg("Snapshots created successfully")
+	return createdSnapshots
 }
 
 func (s *Scheduler) applyRetention(schedule *Schedule) {
+	// Asked before locking, the guard may look up snapshots
+	var protected map[string]string
+	if s.guard != nil {
+		protected = s.guard.ProtectedSnapshots()
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -642,7 +741,7 @@ func (s *Scheduler) applyRetention(schedule *Schedule) {
 		})
 
 		// Apply GFS retention
-		toKeep := s.selectGFSSnapshots(scheduleSnapshots, retention)
+		toKeep := selectGFSSnapshots(scheduleSnapshots, retention)
 
 		// Delete snapshots not in toKeep
 		for _, snap := range scheduleSnapshots {
@@ -654,6 +753,11 @@ func (s *Scheduler) applyRetention(schedule *Schedule) {
 				}
 			}
 
+			if reason, ok := protected[snap.ID]; !keep && ok {
+				s.logger.Info().Str("id", snap.ID).Str("reason", reason).Msg("Keeping snapshot past retention")
+				continue
+			}
+
 			if !keep {
 				s.logger.Info().Str("id", snap.ID).Str("path", snap.Path).Msg("Deleting snapshot per retention policy")
 				if err := s.agentClient.DeleteSnapshot(snap.Path); err != nil {
@@ -666,7 +770,9 @@ func (s *Scheduler) applyRetention(schedule *Schedule) {
 	}
 }
 
-func (s *Scheduler) selectGFSSnapshots(snapshots []*Snapshot, retention RetentionPolicy) []*Snapshot {
+// selectGFSSnapshots returns the snapshots a retention policy keeps; the
+// snapshots are sorted newest first
+func selectGFSSnapshots(snapshots []*Snapshot, retention RetentionPolicy) []*Snapshot {
 	if len(snapshots) == 0 {
 		return snapshots
 	}
@@ -820,6 +926,12 @@ func (s *Scheduler) loadState() error {
 
 func (s *Scheduler) saveState() error {
 	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.saveStateLocked()
+}
+
+// saveStateLocked writes the state; the caller holds s.mu
+func (s *Scheduler) saveStateLocked() error {
 	state := struct {
 		Schedules map[string]*Schedule   `json:"schedules"`
 		Snapshots map[string][]*Snapshot `json:"snapshots"`
@@ -827,7 +939,6 @@ func (s *Scheduler) saveState() error {
 		Schedules: s.schedules,
 		Snapshots: s.snapshots,
 	}
-	s.mu.RUnlock()
 
 	data, err := json.MarshalIndent(state, "", "  ")
 	if err != nil {
@@ -0,0 +1,800 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/robfig/cron/v3"
+	"github.com/rs/zerolog"
+
+	"nithronos/backend/nosd/pkg/jobs"
+)
+
+// Client pull backups. A source is a Linux machine NithronOS backs up by
+// pulling its files over SSH with rsync into a subvolume of its own. Every
+// pull that completes is followed by a snapshot of the subvolume, pruned
+// with the source's retention policy, so the snapshots are ordinary restore
+// points. Files restored from them without a target path go back to the
+// client.
+
+// DefaultSourceRoot holds the subvolumes of sources. A pull mirrors the
+// client with rsync --delete, so a source only ever writes to a subvolume
+// below it that its own first pull created.
+const DefaultSourceRoot = "/srv/backups"
+
+// rsyncVanished is rsync's exit code for files that disappeared while the
+// transfer ran; the rest of the transfer is complete
+const rsyncVanished = 24
+
+// Puller manages sources and runs their pulls
+type Puller struct {
+	logger      zerolog.Logger
+	sources     map[string]*Source
+	stateFile   string
+	keysDir     string
+	mu          sync.RWMutex
+	jobManager  *JobManager
+	scheduler   *Scheduler
+	cronEntries map[string]cron.EntryID
+	running     map[string]string // job IDs of pulls in progress by source ID
+
+	// root holds the subvolumes of all sources; tests replace it
+	root string
+	// command builds the rsync and btrfs commands; tests replace it
+	command func(ctx context.Context, name string, args ...string) *exec.Cmd
+}
+
+// NewPuller creates a puller; its pulls are scheduled, snapshotted and
+// pruned by the scheduler
+func NewPuller(logger zerolog.Logger, stateFile string, keysDir string, scheduler *Scheduler) *Puller {
+	return &Puller{
+		logger:      logger.With().Str("component", "backup-puller").Logger(),
+		sources:     make(map[string]*Source),
+		stateFile:   stateFile,
+		keysDir:     keysDir,
+		jobManager:  scheduler.GetJobManager(),
+		scheduler:   scheduler,
+		cronEntries: make(map[string]cron.EntryID),
+		running:     make(map[string]string),
+		root:        DefaultSourceRoot,
+		command:     exec.CommandContext,
+	}
+}
+
+// Start loads the sources and schedules their pulls
+func (p *Puller) Start() error {
+	if err := os.MkdirAll(p.keysDir, 0700); err != nil {
+		return fmt.Errorf("failed to create keys directory: %w", err)
+	}
+	if err := p.loadState(); err != nil {
+		p.logger.Warn().Err(err).Msg("Failed to load source state")
+	}
+
+	// Pulls cut off by a restart run again; rsync skips what already arrived
+	p.jobManager.Engine().OnResume(backupJobPrefix+"pull", p.resumePull)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, src := range p.sources {
+		if src.Enabled {
+			if err := p.scheduleSourceLocked(src); err != nil {
+				p.logger.Error().Err(err).Str("source", src.ID).Msg("Failed to schedule source")
+			}
+		}
+	}
+	return nil
+}
+
+// Stop unschedules the pulls and saves the state
+func (p *Puller) Stop() error {
+	p.mu.Lock()
+	for id, entryID := range p.cronEntries {
+		p.scheduler.cron.Remove(entryID)
+		delete(p.cronEntries, id)
+	}
+	p.mu.Unlock()
+	return p.saveState()
+}
+
+// CreateSource creates a new source
+func (p *Puller) CreateSource(src *Source) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if src.ID == "" {
+		src.ID = uuid.New().String()
+	}
+	now := time.Now()
+	src.CreatedAt = now
+	src.UpdatedAt = now
+	if src.Port == 0 {
+		src.Port = 22
+	}
+	if src.Subvolume == "" {
+		src.Subvolume = filepath.Join(p.root, sourceSlug(src))
+	}
+	src.KeyRef, src.SubvolumeUUID = "", ""
+	src.LastRun, src.LastStatus, src.LastError = nil, "", ""
+
+	if err := p.validateSourceLocked(src); err != nil {
+		return fmt.Errorf("invalid source: %w", err)
+	}
+	// The first pull creates the subvolume; rsync --delete would empty
+	// whatever is there already
+	if _, err := os.Lstat(src.Subvolume); err == nil {
+		return fmt.Errorf("invalid source: %s already exists, choose a new subvolume", src.Subvolume)
+	}
+	next := nextRun(src.Frequency)
+	src.NextRun = &next
+	p.sources[src.ID] = src
+
+	if src.Enabled {
+		if err := p.scheduleSourceLocked(src); err != nil {
+			return fmt.Errorf("failed to schedule source: %w", err)
+		}
+	}
+	if err := p.saveStateLocked(); err != nil {
+		return fmt.Errorf("failed to save state: %w", err)
+	}
+
+	p.logger.Info().Str("id", src.ID).Str("name", src.Name).Msg("Created backup source")
+	return nil
+}
+
+// UpdateSource updates a source. Its subvolume can't change, the snapshots
+// taken so far belong to it.
+func (p *Puller) UpdateSource(id string, update *Source) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	existing, ok := p.sources[id]
+	if !ok {
+		return fmt.Errorf("source not found: %s", id)
+	}
+
+	// Preserve immutable fields
+	update.ID = existing.ID
+	update.CreatedAt = existing.CreatedAt
+	update.UpdatedAt = time.Now()
+	update.Subvolume = existing.Subvolume
+	update.SubvolumeUUID = existing.SubvolumeUUID
+	update.KeyRef = existing.KeyRef
+	update.LastRun = existing.LastRun
+	update.LastStatus = existing.LastStatus
+	update.LastError = existing.LastError
+	if update.Port == 0 {
+		update.Port = 22
+	}
+
+	if err := p.validateSourceLocked(update); err != nil {
+		return fmt.Errorf("invalid source: %w", err)
+	}
+
+	if entryID, ok := p.cronEntries[id]; ok {
+		p.scheduler.cron.Remove(entryID)
+		delete(p.cronEntries, id)
+	}
+	next := nextRun(update.Frequency)
+	update.NextRun = &next
+	p.sources[id] = update
+	if update.Enabled {
+		if err := p.scheduleSourceLocked(update); err != nil {
+			return fmt.Errorf("failed to schedule source: %w", err)
+		}
+	}
+
+	if err := p.saveStateLocked(); err != nil {
+		return fmt.Errorf("failed to save state: %w", err)
+	}
+	p.logger.Info().Str("id", id).Msg("Updated backup source")
+	return nil
+}
+
+// DeleteSource deletes a source and its SSH key. The subvolume and its
+// snapshots are kept.
+func (p *Puller) DeleteSource(id string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	src, ok := p.sources[id]
+	if !ok {
+		return fmt.Errorf("source not found: %s", id)
+	}
+	if _, ok := p.running[id]; ok {
+		return fmt.Errorf("source %s is being pulled", src.Name)
+	}
+	if entryID, ok := p.cronEntries[id]; ok {
+		p.scheduler.cron.Remove(entryID)
+		delete(p.cronEntries, id)
+	}
+	if src.KeyRef != "" {
+		if err := os.Remove(filepath.Join(p.keysDir, src.KeyRef)); err != nil && !os.IsNotExist(err) {
+			p.logger.Warn().Err(err).Str("source", id).Msg("Failed to delete SSH key")
+		}
+	}
+	delete(p.sources, id)
+
+	if err := p.saveStateLocked(); err != nil {
+		return fmt.Errorf("failed to save state: %w", err)
+	}
+	p.logger.Info().Str("id", id).Msg("Deleted backup source")
+	return nil
+}
+
+// GetSource returns a source by ID
+func (p *Puller) GetSource(id string) (*Source, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	src, ok := p.sources[id]
+	if !ok {
+		return nil, fmt.Errorf("source not found: %s", id)
+	}
+	return src, nil
+}
+
+// ListSources returns all sources sorted by name
+func (p *Puller) ListSources() []*Source {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	sources := make([]*Source, 0, len(p.sources))
+	for _, src := range p.sources {
+		sources = append(sources, src)
+	}
+	sort.Slice(sources, func(i, j int) bool { return sources[i].Name < sources[j].Name })
+	return sources
+}
+
+// StoreSSHKey stores the private key used to log in to a source
+func (p *Puller) StoreSSHKey(id string, keyContent string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	src, ok := p.sources[id]
+	if !ok {
+		return fmt.Errorf("source not found: %s", id)
+	}
+	if src.KeyRef == "" {
+		src.KeyRef = fmt.Sprintf("source-%s.key", src.ID)
+		src.UpdatedAt = time.Now()
+	}
+	if err := os.WriteFile(filepath.Join(p.keysDir, src.KeyRef), []byte(keyContent), 0600); err != nil {
+		return fmt.Errorf("failed to write SSH key: %w", err)
+	}
+	return p.saveStateLocked()
+}
+
+// TestSource checks that the client is reachable and has rsync
+func (p *Puller) TestSource(id string) error {
+	src, err := p.GetSource(id)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	out, err := p.command(ctx, "ssh", p.sshArgs(src, "rsync --version")...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("SSH connection failed: %w\nOutput: %s", err, lastLine(string(out)))
+	}
+	return nil
+}
+
+// RunSource pulls a source now
+func (p *Puller) RunSource(id string) (*BackupJob, error) {
+	src, err := p.GetSource(id)
+	if err != nil {
+		return nil, err
+	}
+	job, err := p.startPull(src)
+	if err != nil {
+		return nil, err
+	}
+	go p.runPull(job, src)
+	return job, nil
+}
+
+func (p *Puller) resumePull(interrupted *jobs.Job) (string, error) {
+	var job BackupJob
+	if err := interrupted.Decode(&job); err != nil {
+		return "", err
+	}
+	resumed, err := p.RunSource(job.SourceID)
+	if err != nil {
+		return "", err
+	}
+	return resumed.ID, nil
+}
+
+// UsePuller sends files restored from snapshots of a source without a
+// target path back to the client
+func (r *Restorer) UsePuller(puller *Puller) {
+	r.puller = puller
+}
+
+// SourceForSubvolume returns the source whose files a subvolume holds
+func (p *Puller) SourceForSubvolume(subvolume string) *Source {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, src := range p.sources {
+		if src.Subvolume == subvolume {
+			return src
+		}
+	}
+	return nil
+}
+
+func (p *Puller) validateSourceLocked(src *Source) error {
+	if src.Name == "" {
+		return fmt.Errorf("source name is required")
+	}
+	if src.Host == "" {
+		return fmt.Errorf("SSH host is required")
+	}
+	if src.User == "" {
+		return fmt.Errorf("SSH user is required")
+	}
+	if strings.HasPrefix(src.Host, "-") || strings.HasPrefix(src.User, "-") || strings.ContainsAny(src.Host+src.User, " @:") {
+		return fmt.Errorf("invalid SSH host or user")
+	}
+	if src.Port < 1 || src.Port > 65535 {
+		return fmt.Errorf("invalid SSH port: %d", src.Port)
+	}
+	if len(src.Paths) == 0 {
+		return fmt.Errorf("at least one path is required")
+	}
+	for _, path := range src.Paths {
+		if !filepath.IsAbs(path) {
+			return fmt.Errorf("paths must be absolute: %s", path)
+		}
+	}
+	if filepath.Clean(src.Subvolume) != src.Subvolume || !strings.HasPrefix(src.Subvolume, p.root+"/") {
+		return fmt.Errorf("subvolume must be a clean path below %s", p.root)
+	}
+	for _, other := range p.sources {
+		if other.ID != src.ID && other.Subvolume == src.Subvolume {
+			return fmt.Errorf("subvolume %s is used by source %s", src.Subvolume, other.Name)
+		}
+	}
+	if src.Retention.MinKeep < 0 {
+		return fmt.Errorf("min_keep cannot be negative")
+	}
+	if src.BandwidthLimit < 0 {
+		return fmt.Errorf("bandwidth limit cannot be negative")
+	}
+	return validateFrequency(src.Frequency)
+}
+
+// scheduleSourceLocked adds the cron entry of a source; the caller holds
+// p.mu
+func (p *Puller) scheduleSourceLocked(src *Source) error {
+	cronExpr, err := frequencyCron(src.Frequency)
+	if err != nil {
+		return err
+	}
+	id := src.ID
+	entryID, err := p.scheduler.cron.AddFunc(cronExpr, func() {
+		p.runScheduledPull(id)
+	})
+	if err != nil {
+		return err
+	}
+	p.cronEntries[id] = entryID
+	return nil
+}
+
+func (p *Puller) runScheduledPull(id string) {
+	src, err := p.GetSource(id)
+	if err != nil {
+		p.logger.Error().Str("source_id", id).Msg("Source not found")
+		return
+	}
+	job, err := p.startPull(src)
+	if err != nil {
+		p.logger.Warn().Err(err).Str("source", src.Name).Msg("Skipping scheduled pull")
+		return
+	}
+	p.runPull(job, src)
+}
+
+// startPull registers the job of a pull unless one is running
+func (p *Puller) startPull(src *Source) (*BackupJob, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if jobID, ok := p.running[src.ID]; ok {
+		return nil, fmt.Errorf("source %s is already being pulled by job %s", src.Name, jobID)
+	}
+	job := &BackupJob{
+		ID:         uuid.New().String(),
+		Type:       "pull",
+		State:      JobStatePending,
+		SourceID:   src.ID,
+		Subvolumes: []string{src.Subvolume},
+		StartedAt:  time.Now(),
+	}
+	p.running[src.ID] = job.ID
+	p.jobManager.AddJob(job)
+	return job, nil
+}
+
+// runPull pulls a source and snapshots its subvolume. The snapshot job is
+// a child of the pull job.
+func (p *Puller) runPull(job *BackupJob, src *Source) {
+	defer func() {
+		p.mu.Lock()
+		delete(p.running, src.ID)
+		p.mu.Unlock()
+	}()
+
+	job.State = JobStateRunning
+	p.jobManager.UpdateJob(job)
+	p.logger.Info().Str("source", src.Name).Msg("Pulling source")
+
+	ctx, cancel := p.jobManager.JobContext(job.ID)
+	defer cancel()
+	err := p.pull(ctx, job, src)
+
+	schedule := src.schedule()
+	if err == nil {
+		snapshotJob := &BackupJob{
+			ID:         uuid.New().String(),
+			Type:       "snapshot",
+			State:      JobStatePending,
+			ScheduleID: src.ID,
+			Subvolumes: []string{src.Subvolume},
+			ParentID:   job.ID,
+			StartedAt:  time.Now(),
+		}
+		job.ChildIDs = append(job.ChildIDs, snapshotJob.ID)
+		p.jobManager.AddJob(snapshotJob)
+		p.scheduler.runSnapshotJob(snapshotJob, snapshotJob.Subvolumes, "", schedule)
+		if snapshotJob.State == JobStateFailed {
+			err = fmt.Errorf("snapshot failed: %s", snapshotJob.Error)
+		}
+	}
+
+	now := time.Now()
+	job.FinishedAt = &now
+	switch {
+	case err != nil && job.State == JobStateCanceled:
+		p.jobManager.AddLogEntry(job.ID, "warn", "Job canceled")
+	case err != nil:
+		job.State = JobStateFailed
+		job.Error = err.Error()
+		p.jobManager.AddLogEntry(job.ID, "error", job.Error)
+		p.scheduler.notifyFailure(job, schedule, job.Error)
+	default:
+		job.State = JobStateSucceeded
+		job.Progress = 100
+	}
+	p.jobManager.UpdateJob(job)
+
+	p.mu.Lock()
+	if current, ok := p.sources[src.ID]; ok {
+		current.LastRun = &now
+		current.LastStatus = string(job.State)
+		current.LastError = job.Error
+		next := nextRun(current.Frequency)
+		current.NextRun = &next
+	}
+	if err := p.saveStateLocked(); err != nil {
+		p.logger.Error().Err(err).Msg("Failed to save source state")
+	}
+	p.mu.Unlock()
+}
+
+// schedule is the schedule the snapshots of a source are taken and pruned
+// under; the snapshots carry the source's ID as their schedule ID
+func (src *Source) schedule() *Schedule {
+	return &Schedule{
+		ID:         src.ID,
+		Name:       src.Name,
+		Enabled:    src.Enabled,
+		Subvolumes: []string{src.Subvolume},
+		Frequency:  src.Frequency,
+		Retention:  src.Retention,
+	}
+}
+
+// pull copies the source's paths into its subvolume
+func (p *Puller) pull(ctx context.Context, job *BackupJob, src *Source) error {
+	if err := p.ensureSubvolume(ctx, src); err != nil {
+		return err
+	}
+	p.jobManager.AddLogEntry(job.ID, "info", fmt.Sprintf("Pulling %s from %s@%s into %s", strings.Join(src.Paths, ", "), src.User, src.Host, src.Subvolume))
+
+	args := p.pullArgs(src)
+	err := p.rsync(ctx, job, args)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == rsyncVanished {
+		p.jobManager.AddLogEntry(job.ID, "warn", "Some files vanished during the transfer")
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("rsync failed: %w", err)
+	}
+	p.jobManager.AddLogEntry(job.ID, "info", fmt.Sprintf("Pulled %d bytes", job.BytesDone))
+	return nil
+}
+
+// pullArgs returns the rsync arguments of a pull. Paths keep their full
+// path below the subvolume, so /etc/hosts lands at <subvolume>/etc/hosts.
+func (p *Puller) pullArgs(src *Source) []string {
+	args := []string{
+		"-aHAX", "--numeric-ids", "--relative", "--one-file-system",
+		"--delete", "--delete-excluded", "--partial",
+		"--info=progress2", "--no-inc-recursive",
+		"-e", strings.Join(append([]string{"ssh"}, p.sshOptions(src)...), " "),
+	}
+	if src.Sudo {
+		args = append(args, "--rsync-path=sudo rsync")
+	}
+	if src.BandwidthLimit > 0 {
+		args = append(args, fmt.Sprintf("--bwlimit=%d", src.BandwidthLimit))
+	}
+	for _, pattern := range src.Excludes {
+		args = append(args, "--exclude="+pattern)
+	}
+	for _, path := range src.Paths {
+		args = append(args, fmt.Sprintf("%s@%s:%s", src.User, src.Host, path))
+	}
+	return append(args, strings.TrimSuffix(src.Subvolume, "/")+"/")
+}
+
+// rsyncProgress matches the totals rsync --info=progress2 prints
+var rsyncProgress = regexp.MustCompile(`^\s*([\d,]+)\s+(\d+)%`)
+
+// rsync runs rsync, turning its progress output into job progress and
+// keeping the end of its error output for the job log
+func (p *Puller) rsync(ctx context.Context, job *BackupJob, args []string) error {
+	cmd := p.command(ctx, "rsync", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Split(scanProgressLines)
+	for scanner.Scan() {
+		m := rsyncProgress.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+		done, _ := strconv.ParseInt(strings.ReplaceAll(m[1], ",", ""), 10, 64)
+		percent, _ := strconv.Atoi(m[2])
+		p.jobManager.UpdateProgress(job.ID, min(percent, 99), 0, done)
+	}
+	_, _ = io.Copy(io.Discard, stdout)
+
+	if err := cmd.Wait(); err != nil {
+		if msg := lastLine(stderr.String()); msg != "" {
+			p.jobManager.AddLogEntry(job.ID, "error", msg)
+		}
+		return err
+	}
+	return nil
+}
+
+// scanProgressLines splits rsync output at carriage returns as well as
+// newlines; progress2 rewrites its line with \r
+func scanProgressLines(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// ensureSubvolume creates the subvolume of a source on its first pull and
+// records its UUID. Later pulls only write to the subvolume with that
+// UUID, never to a directory or subvolume that took its place.
+func (p *Puller) ensureSubvolume(ctx context.Context, src *Source) error {
+	path := src.Subvolume
+	p.mu.RLock()
+	recorded, pulled := src.SubvolumeUUID, src.LastRun != nil
+	p.mu.RUnlock()
+
+	if _, err := os.Lstat(path); err == nil {
+		uuid, err := p.subvolumeUUID(ctx, path)
+		if err != nil {
+			return fmt.Errorf("%s is not a btrfs subvolume, refusing to pull into it", path)
+		}
+		// Sources that pulled before UUIDs were recorded adopt theirs
+		if recorded == "" && pulled {
+			return p.recordSubvolume(src, uuid)
+		}
+		if uuid != recorded {
+			return fmt.Errorf("%s was not created by this source, refusing to pull into it", path)
+		}
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if out, err := p.command(ctx, "btrfs", "subvolume", "create", path).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to create subvolume %s: %v: %s", path, err, lastLine(string(out)))
+	}
+	uuid, err := p.subvolumeUUID(ctx, path)
+	if err != nil {
+		return err
+	}
+	return p.recordSubvolume(src, uuid)
+}
+
+// subvolumeUUID returns the UUID `btrfs subvolume show` reports for path
+func (p *Puller) subvolumeUUID(ctx context.Context, path string) (string, error) {
+	out, err := p.command(ctx, "btrfs", "subvolume", "show", path).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("btrfs subvolume show %s: %v: %s", path, err, lastLine(string(out)))
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if ok && key == "UUID" && strings.TrimSpace(value) != "-" && strings.TrimSpace(value) != "" {
+			return strings.TrimSpace(value), nil
+		}
+	}
+	return "", fmt.Errorf("btrfs subvolume show %s reported no UUID", path)
+}
+
+func (p *Puller) recordSubvolume(src *Source, uuid string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	src.SubvolumeUUID = uuid
+	if current, ok := p.sources[src.ID]; ok {
+		current.SubvolumeUUID = uuid
+	}
+	return p.saveStateLocked()
+}
+
+// PushFiles copies files of a mounted snapshot of a source back to the
+// client. Paths are relative to the mount point and keep their location;
+// existing files are skipped or overwritten.
+func (p *Puller) PushFiles(ctx context.Context, job *BackupJob, src *Source, root string, paths []string, conflict string) (*FileRestoreStats, error) {
+	if conflict == ConflictRename {
+		return nil, fmt.Errorf("the rename conflict policy is not supported when restoring to %s, choose a target path", src.Name)
+	}
+	args := []string{
+		"-aHAX", "--numeric-ids", "--relative", "--stats",
+		"-e", strings.Join(append([]string{"ssh"}, p.sshOptions(src)...), " "),
+	}
+	if src.Sudo {
+		args = append(args, "--rsync-path=sudo rsync")
+	}
+	if conflict == ConflictSkip {
+		args = append(args, "--ignore-existing")
+	}
+	for _, path := range paths {
+		// The /./ marks where the path kept on the client starts
+		args = append(args, strings.TrimSuffix(root, "/")+"/./"+path)
+	}
+	args = append(args, fmt.Sprintf("%s@%s:/", src.User, src.Host))
+
+	p.jobManager.AddLogEntry(job.ID, "info", fmt.Sprintf("Restoring %s to %s@%s", strings.Join(paths, ", "), src.User, src.Host))
+	out, err := p.command(ctx, "rsync", args...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("rsync failed: %v: %s", err, lastLine(string(out)))
+	}
+	return parseRsyncStats(string(out)), nil
+}
+
+// parseRsyncStats reads the transfer counts rsync --stats prints
+func parseRsyncStats(out string) *FileRestoreStats {
+	stats := &FileRestoreStats{}
+	number := func(s string) int64 {
+		fields := strings.Fields(s)
+		if len(fields) == 0 {
+			return 0
+		}
+		n, _ := strconv.ParseInt(strings.ReplaceAll(fields[0], ",", ""), 10, 64)
+		return n
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if v, ok := strings.CutPrefix(line, "Number of regular files transferred:"); ok {
+			stats.Restored = int(number(v))
+		} else if v, ok := strings.CutPrefix(line, "Total transferred file size:"); ok {
+			stats.Bytes = number(v)
+		}
+	}
+	return stats
+}
+
+// sshOptions returns the ssh options of a source
+func (p *Puller) sshOptions(src *Source) []string {
+	args := []string{
+		"-o", "ConnectTimeout=10",
+		"-o", "StrictHostKeyChecking=accept-new",
+		"-o", "UserKnownHostsFile=/var/lib/nos/backup/known_hosts",
+		"-o", "BatchMode=yes",
+		"-p", strconv.Itoa(src.Port),
+	}
+	if src.KeyRef != "" {
+		args = append(args, "-i", filepath.Join(p.keysDir, src.KeyRef))
+	}
+	return args
+}
+
+func (p *Puller) sshArgs(src *Source, command string) []string {
+	return append(p.sshOptions(src), fmt.Sprintf("%s@%s", src.User, src.Host), command)
+}
+
+// sourceSlug turns a source's name into the name of its subvolume
+func sourceSlug(src *Source) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(src.Name) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			b.WriteRune(r)
+		case b.Len() > 0 && !strings.HasSuffix(b.String(), "-"):
+			b.WriteRune('-')
+		}
+	}
+	slug := strings.Trim(b.String(), "-.")
+	if slug == "" {
+		return src.ID
+	}
+	return slug
+}
+
+func (p *Puller) loadState() error {
+	data, err := os.ReadFile(p.stateFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var state struct {
+		Sources map[string]*Source `json:"sources"`
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if state.Sources != nil {
+		p.sources = state.Sources
+	}
+	return nil
+}
+
+func (p *Puller) saveState() error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.saveStateLocked()
+}
+
+// saveStateLocked writes the state; the caller holds p.mu
+func (p *Puller) saveStateLocked() error {
+	data, err := json.MarshalIndent(struct {
+		Sources map[string]*Source `json:"sources"`
+	}{Sources: p.sources}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpFile := p.stateFile + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, p.stateFile)
+}
@@ -0,0 +1,325 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"nithronos/backend/nosd/pkg/jobs"
+)
+
+// fakeCommands stands in for rsync and btrfs: every call is recorded,
+// rsync runs script, btrfs subvolume create makes a directory and btrfs
+// subvolume show reports the UUIDs in subvolumes
+type fakeCommands struct {
+	mu         sync.Mutex
+	calls      [][]string
+	script     string
+	subvolumes map[string]string
+}
+
+func (f *fakeCommands) command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, append([]string{name}, args...))
+	if name == "btrfs" {
+		path := args[len(args)-1]
+		if args[1] == "show" {
+			uuid, ok := f.subvolumes[path]
+			if !ok {
+				return exec.CommandContext(ctx, "sh", "-c", "echo 'ERROR: Not a Btrfs subvolume' >&2; exit 1")
+			}
+			return exec.CommandContext(ctx, "printf", "%s\n\tUUID: \t\t%s\n", path, uuid)
+		}
+		if f.subvolumes == nil {
+			f.subvolumes = map[string]string{}
+		}
+		f.subvolumes[path] = fmt.Sprintf("uuid-%d", len(f.subvolumes)+1)
+		return exec.CommandContext(ctx, "mkdir", path)
+	}
+	return exec.CommandContext(ctx, "sh", "-c", f.script)
+}
+
+func (f *fakeCommands) last() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[len(f.calls)-1]
+}
+
+func newTestPuller(t *testing.T) (*Puller, *Source, *fakeCommands, *fakeSnapshotAgent) {
+	t.Helper()
+	dir := t.TempDir()
+	agent := &fakeSnapshotAgent{}
+	s := NewScheduler(zerolog.Nop(), filepath.Join(dir, "schedules.json"), agent)
+	p := NewPuller(zerolog.Nop(), filepath.Join(dir, "sources.json"), filepath.Join(dir, "keys"), s)
+	fake := &fakeCommands{}
+	p.command = fake.command
+	p.root = dir
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = p.Stop() })
+
+	src := &Source{
+		Name:      "Web Server 1",
+		Host:      "web1.lan",
+		User:      "backup",
+		Sudo:      true,
+		Paths:     []string{"/etc", "/var/www"},
+		Excludes:  []string{"*.tmp", "/var/www/cache"},
+		Subvolume: filepath.Join(dir, "web1"),
+		Frequency: ScheduleFrequency{Type: "daily", Hour: 1},
+		Retention: RetentionPolicy{MinKeep: 1},
+	}
+	if err := p.CreateSource(src); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.StoreSSHKey(src.ID, "key"); err != nil {
+		t.Fatal(err)
+	}
+	return p, src, fake, agent
+}
+
+func runTestPull(t *testing.T, p *Puller, src *Source) *BackupJob {
+	t.Helper()
+	job, err := p.startPull(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.runPull(job, src)
+	return job
+}
+
+func TestSourcePullSnapshotsAndPrunes(t *testing.T) {
+	p, src, fake, agent := newTestPuller(t)
+	fake.script = `printf '      1,000  40%%  1.00MB/s    0:00:01\r      2,500 100%%  1.00MB/s    0:00:02 (xfr#2, to-chk=0/4)\n'`
+
+	job := runTestPull(t, p, src)
+	if job.State != JobStateSucceeded || job.BytesDone != 2500 {
+		t.Fatalf("job %+v", job)
+	}
+	args := strings.Join(fake.last(), " ")
+	for _, want := range []string{
+		"rsync -aHAX", "--relative", "--delete",
+		"--rsync-path=sudo rsync", "--exclude=*.tmp", "--exclude=/var/www/cache",
+		"-i " + filepath.Join(p.keysDir, src.KeyRef),
+		"backup@web1.lan:/etc backup@web1.lan:/var/www " + src.Subvolume + "/",
+	} {
+		if !strings.Contains(args, want) {
+			t.Errorf("rsync call %q lacks %q", args, want)
+		}
+	}
+
+	if fake.calls[0][0] != "btrfs" {
+		t.Errorf("first pull didn't create the subvolume: %q", fake.calls[0])
+	}
+	if len(job.ChildIDs) != 1 {
+		t.Fatalf("children %v", job.ChildIDs)
+	}
+	snapshots := p.scheduler.ListSnapshots()
+	if len(snapshots) != 1 || snapshots[0].Subvolume != src.Subvolume || snapshots[0].ScheduleID != src.ID {
+		t.Fatalf("snapshots %+v", snapshots)
+	}
+
+	// The second run's snapshot replaces the first under min_keep 1
+	runTestPull(t, p, src)
+	if got := len(p.scheduler.ListSnapshots()); got != 1 || len(agent.deleted) != 1 {
+		t.Fatalf("%d snapshots after retention, deleted %v", got, agent.deleted)
+	}
+	if stored, _ := p.GetSource(src.ID); stored.LastStatus != string(JobStateSucceeded) || stored.LastRun == nil {
+		t.Fatalf("source %+v", stored)
+	}
+}
+
+func TestSourcePullFailures(t *testing.T) {
+	p, src, fake, _ := newTestPuller(t)
+	notifier := &recordingNotifier{}
+	p.scheduler.UseNotifier(notifier)
+
+	// Files that vanished mid-transfer don't fail the run
+	fake.script = "exit 24"
+	if job := runTestPull(t, p, src); job.State != JobStateSucceeded {
+		t.Fatalf("vanished files: %+v", job)
+	}
+
+	fake.script = "echo 'rsync: connection unexpectedly closed' >&2; exit 12"
+	job := runTestPull(t, p, src)
+	if job.State != JobStateFailed || len(job.ChildIDs) != 0 {
+		t.Fatalf("failed pull %+v", job)
+	}
+	if len(p.scheduler.ListSnapshots()) != 1 {
+		t.Error("failed pull was snapshotted")
+	}
+	if len(notifier.messages) != 1 || !strings.Contains(notifier.messages[0], "rsync failed") {
+		t.Fatalf("notifications %q", notifier.messages)
+	}
+	stored, _ := p.GetSource(src.ID)
+	if stored.LastStatus != string(JobStateFailed) || stored.LastError == "" {
+		t.Fatalf("source %+v", stored)
+	}
+}
+
+func TestSourcePullsOnlyIntoItsSubvolume(t *testing.T) {
+	p, src, fake, _ := newTestPuller(t)
+	fake.script = "true"
+
+	if job := runTestPull(t, p, src); job.State != JobStateSucceeded {
+		t.Fatalf("first pull %+v", job)
+	}
+	if stored, _ := p.GetSource(src.ID); stored.SubvolumeUUID != "uuid-1" {
+		t.Fatalf("subvolume UUID %q", stored.SubvolumeUUID)
+	}
+
+	// A plain directory or another subvolume in its place is never synced
+	for name, replace := range map[string]func(){
+		"directory": func() { delete(fake.subvolumes, src.Subvolume) },
+		"subvolume": func() { fake.subvolumes[src.Subvolume] = "uuid-other" },
+	} {
+		replace()
+		calls := len(fake.calls)
+		job := runTestPull(t, p, src)
+		if job.State != JobStateFailed || !strings.Contains(job.Error, "refusing to pull") {
+			t.Errorf("%s: job %+v", name, job)
+		}
+		for _, call := range fake.calls[calls:] {
+			if call[0] == "rsync" {
+				t.Errorf("%s: rsync ran: %q", name, call)
+			}
+		}
+	}
+}
+
+func TestInterruptedPullResumes(t *testing.T) {
+	p, src, fake, _ := newTestPuller(t)
+	dir := t.TempDir()
+	engine := jobs.New(zerolog.Nop(), dir)
+	if err := engine.Start(); err != nil {
+		t.Fatal(err)
+	}
+	p.scheduler.UseJobEngine(engine)
+
+	// nosd stops in the middle of a pull
+	job, err := p.startPull(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.State = JobStateRunning
+	p.jobManager.UpdateJob(job)
+	p.jobManager.AddLogEntry(job.ID, "info", "Pulling 2 paths")
+	engine.Stop()
+	delete(p.running, src.ID)
+
+	restarted := jobs.New(zerolog.Nop(), dir)
+	if err := restarted.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Stop()
+	p.scheduler.UseJobEngine(restarted)
+	interrupted, ok := p.jobManager.GetJob(job.ID)
+	if !ok || interrupted.State != JobStateInterrupted || len(interrupted.LogEntries) != 2 {
+		t.Fatalf("job after restart %+v", interrupted)
+	}
+
+	fake.script = "true"
+	restarted.OnResume(backupJobPrefix+"pull", p.resumePull)
+	stored, _ := restarted.Get(job.ID)
+	if stored.ResumedBy == "" {
+		t.Fatalf("pull not resumed: %+v", stored)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if mirror, _ := restarted.Get(stored.ResumedBy); mirror != nil && mirror.State == jobs.StateSucceeded {
+			if resumed, _ := p.jobManager.GetJob(stored.ResumedBy); resumed.SourceID != src.ID {
+				t.Fatalf("resumed job %+v", resumed)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("resumed pull never finished")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSourceValidation(t *testing.T) {
+	p, src, _, _ := newTestPuller(t)
+
+	other := &Source{Name: "Laptop", Host: "laptop", User: "root", Paths: []string{"/home"}, Frequency: ScheduleFrequency{Type: "daily"}}
+	if err := p.CreateSource(other); err != nil {
+		t.Fatal(err)
+	}
+	if other.Subvolume != filepath.Join(p.root, "laptop") || other.Port != 22 {
+		t.Fatalf("defaults %+v", other)
+	}
+	existing := filepath.Join(p.root, "existing")
+	if err := os.Mkdir(existing, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, bad := range map[string]Source{
+		"relative path":   {Name: "a", Host: "a", User: "u", Paths: []string{"etc"}, Frequency: ScheduleFrequency{Type: "daily"}},
+		"no paths":        {Name: "b", Host: "b", User: "u", Frequency: ScheduleFrequency{Type: "daily"}},
+		"option host":     {Name: "c", Host: "-oProxyCommand=x", User: "u", Paths: []string{"/"}, Frequency: ScheduleFrequency{Type: "daily"}},
+		"taken subvolume": {Name: "d", Host: "d", User: "u", Paths: []string{"/"}, Subvolume: src.Subvolume, Frequency: ScheduleFrequency{Type: "daily"}},
+		"outside root":    {Name: "f", Host: "f", User: "u", Paths: []string{"/"}, Subvolume: "/home", Frequency: ScheduleFrequency{Type: "daily"}},
+		"root itself":     {Name: "g", Host: "g", User: "u", Paths: []string{"/"}, Subvolume: p.root, Frequency: ScheduleFrequency{Type: "daily"}},
+		"escaping root":   {Name: "h", Host: "h", User: "u", Paths: []string{"/"}, Subvolume: p.root + "/../etc", Frequency: ScheduleFrequency{Type: "daily"}},
+		"existing dir":    {Name: "i", Host: "i", User: "u", Paths: []string{"/"}, Subvolume: existing, Frequency: ScheduleFrequency{Type: "daily"}},
+		"bad frequency":   {Name: "e", Host: "e", User: "u", Paths: []string{"/"}, Frequency: ScheduleFrequency{Type: "sometimes"}},
+	} {
+		bad := bad
+		if err := p.CreateSource(&bad); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+
+	// The subvolume can't move under existing snapshots
+	update := *src
+	update.Subvolume = "/srv/elsewhere"
+	if err := p.UpdateSource(src.ID, &update); err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := p.GetSource(src.ID); stored.Subvolume != src.Subvolume || stored.KeyRef == "" {
+		t.Fatalf("updated source %+v", stored)
+	}
+}
+
+func TestRestoreFilesToSource(t *testing.T) {
+	p, src, fake, _ := newTestPuller(t)
+	r, _ := newCatalogRestorer(t, src.Subvolume)
+	r.UsePuller(p)
+
+	fake.script = `printf 'Number of regular files transferred: 2\nTotal transferred file size: 35 bytes\n'`
+	job := &BackupJob{ID: "restore-client", Type: "restore"}
+	r.jobManager.AddJob(job)
+	stats, err := r.restoreFiles(context.Background(), job, FileRestoreRequest{Point: PointRef{Type: "local", ID: "snap"}, Conflict: ConflictSkip}, []string{"docs"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Restored != 2 || stats.Bytes != 35 || job.RestorePath != "backup@web1.lan:/" {
+		t.Fatalf("stats %+v, restored to %q", stats, job.RestorePath)
+	}
+	root, _, _ := r.mount("", "")
+	args := strings.Join(fake.last(), " ")
+	if !strings.Contains(args, "--ignore-existing") || !strings.HasSuffix(args, root+"/./docs backup@web1.lan:/") {
+		t.Fatalf("rsync call %q", args)
+	}
+
+	_, err = r.restoreFiles(context.Background(), job, FileRestoreRequest{Point: PointRef{Type: "local", ID: "snap"}, Conflict: ConflictRename}, []string{"docs"})
+	if err == nil {
+		t.Error("renamed files on the client")
+	}
+
+	points, _ := r.ListRestorePoints()
+	if len(points) == 0 || points[0].Source != src.Name {
+		t.Fatalf("restore points %+v", points)
+	}
+}
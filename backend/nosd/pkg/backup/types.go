@@ -33,17 +33,25 @@ type Schedule struct {
 	Retention   RetentionPolicy   `json:"retention"`
 	PreHooks    []string          `json:"pre_hooks,omitempty"`
 	PostHooks   []string          `json:"post_hooks,omitempty"`
+	Targets     []ScheduleTarget  `json:"targets,omitempty"` // Destinations each run replicates to
 	LastRun     *time.Time        `json:"last_run,omitempty"`
 	NextRun     *time.Time        `json:"next_run,omitempty"`
 	CreatedAt   time.Time         `json:"created_at"`
 	UpdatedAt   time.Time         `json:"updated_at"`
 }
 
+// ScheduleTarget is a destination a schedule replicates its snapshots to
+type ScheduleTarget struct {
+	DestinationID string           `json:"destination_id"`
+	Retention     *RetentionPolicy `json:"retention,omitempty"` // Overrides the destination's; repo, s3 and nos only
+}
+
 // Snapshot represents a Btrfs snapshot
 type Snapshot struct {
 	ID         string    `json:"id"`
 	Subvolume  string    `json:"subvolume"`
 	Path       string    `json:"path"`
+	UUID       string    `json:"uuid,omitempty"` // btrfs UUID; copies received elsewhere carry it as their received UUID
 	CreatedAt  time.Time `json:"created_at"`
 	SizeBytes  int64     `json:"size_bytes,omitempty"`
 	ScheduleID string    `json:"schedule_id,omitempty"`
@@ -56,7 +64,7 @@ type Snapshot struct {
 type Destination struct {
 	ID              string            `json:"id"`
 	Name            string            `json:"name"`
-	Type            string            `json:"type"` // "ssh", "rclone", "local"
+	Type            string            `json:"type"` // "ssh", "rclone", "local", "repo", "s3", "nos"
 	Enabled         bool              `json:"enabled"`
 	
 	// SSH specific
@@ -70,10 +78,34 @@ type Destination struct {
 	RemoteName      string            `json:"remote_name,omitempty"`
 	RemotePath      string            `json:"remote_path,omitempty"`
 	
+	// Repository specific: a local Path or an rclone RemoteName and
+	// RemotePath hold the repository
+	PasswordRef     string            `json:"password_ref,omitempty"`
+	RepoID          string            `json:"repo_id,omitempty"`
+	
+	// S3 specific; the secret key is stored separately under CredentialsRef
+	Endpoint        string            `json:"endpoint,omitempty"`
+	Bucket          string            `json:"bucket,omitempty"`
+	Region          string            `json:"region,omitempty"`
+	Prefix          string            `json:"prefix,omitempty"`
+	StorageClass    string            `json:"storage_class,omitempty"`
+	PathStyle       bool              `json:"path_style,omitempty"`
+	AccessKeyID     string            `json:"access_key_id,omitempty"`
+	CredentialsRef  string            `json:"credentials_ref,omitempty"`
+	
+	// NithronOS peer specific: Endpoint is the peer's URL and
+	// CredentialsRef holds the token issued when pairing
+	PeerID          string            `json:"peer_id,omitempty"`
+	PeerName        string            `json:"peer_name,omitempty"`
+	PeerFingerprint string            `json:"peer_fingerprint,omitempty"` // SHA-256 of the peer's TLS certificate
+	
 	// Common options
 	BandwidthLimit  int               `json:"bandwidth_limit,omitempty"` // KB/s
 	Concurrency     int               `json:"concurrency,omitempty"`
 	RetryCount      int               `json:"retry_count,omitempty"`
+	Retention       *RetentionPolicy  `json:"retention,omitempty"` // repo, s3 and nos only
+	Verify          *VerifyPolicy     `json:"verify,omitempty"`
+	Health          *DestinationHealth `json:"health,omitempty"` // set by verification
 	
 	LastTest        *time.Time        `json:"last_test,omitempty"`
 	LastTestStatus  string            `json:"last_test_status,omitempty"`
@@ -81,17 +113,59 @@ type Destination struct {
 	UpdatedAt       time.Time         `json:"updated_at"`
 }
 
+// Source is a client machine whose files are pulled into a subvolume
+type Source struct {
+	ID              string            `json:"id"`
+	Name            string            `json:"name"`
+	Enabled         bool              `json:"enabled"`
+	
+	// SSH access to the client
+	Host            string            `json:"host"`
+	Port            int               `json:"port,omitempty"`
+	User            string            `json:"user"`
+	KeyRef          string            `json:"key_ref,omitempty"`
+	Sudo            bool              `json:"sudo,omitempty"` // run rsync on the client with sudo
+	
+	// What to back up: absolute paths on the client and rsync exclude
+	// patterns
+	Paths           []string          `json:"paths"`
+	Excludes        []string          `json:"excludes,omitempty"`
+	
+	// Subvolume the files land in, snapshotted after every run. It is
+	// created by the first pull; SubvolumeUUID identifies it from then on.
+	Subvolume       string            `json:"subvolume,omitempty"`
+	SubvolumeUUID   string            `json:"subvolume_uuid,omitempty"`
+	Frequency       ScheduleFrequency `json:"frequency"`
+	Retention       RetentionPolicy   `json:"retention"`
+	BandwidthLimit  int               `json:"bandwidth_limit,omitempty"` // KB/s
+	
+	LastRun         *time.Time        `json:"last_run,omitempty"`
+	LastStatus      string            `json:"last_status,omitempty"` // "succeeded" or "failed"
+	LastError       string            `json:"last_error,omitempty"`
+	NextRun         *time.Time        `json:"next_run,omitempty"`
+	CreatedAt       time.Time         `json:"created_at"`
+	UpdatedAt       time.Time         `json:"updated_at"`
+}
+
 // BackupJob represents a backup/replication job
 type BackupJob struct {
 	ID            string            `json:"id"`
-	Type          string            `json:"type"` // "snapshot", "replicate", "restore"
+	Type          string            `json:"type"` // "backup", "snapshot", "replicate", "restore", "check", "prune", "resync", "index", "verify", "pull"
 	State         JobState          `json:"state"`
 	Progress      int               `json:"progress"` // 0-100
 	
+	// A scheduled backup with targets is a "backup" job whose children
+	// are its snapshot and replicate jobs
+	ParentID      string            `json:"parent_id,omitempty"`
+	ChildIDs      []string          `json:"child_ids,omitempty"`
+	
 	// For snapshot jobs
 	ScheduleID    string            `json:"schedule_id,omitempty"`
 	Subvolumes    []string          `json:"subvolumes,omitempty"`
 	
+	// For pull jobs
+	SourceID      string            `json:"source_id,omitempty"`
+	
 	// For replication jobs
 	DestinationID string            `json:"destination_id,omitempty"`
 	SnapshotID    string            `json:"snapshot_id,omitempty"`
@@ -123,6 +197,7 @@ const (
 	JobStateSucceeded JobState = "succeeded"
 	JobStateFailed    JobState = "failed"
 	JobStateCanceled  JobState = "canceled"
+	JobStateInterrupted JobState = "interrupted" // was running when nosd stopped
 )
 
 // LogEntry represents a job log entry
@@ -0,0 +1,891 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Verification proves a destination can be restored from. A "sample"
+// verify reads back the newest copy of every subvolume, a "full" verify
+// reads back everything, and a "drill" restores the newest copy into a
+// scratch subvolume, compares it with the local snapshot it was taken
+// from and removes it again. Every result updates the destination's health;
+// failures go to the verify notifier.
+
+// Verify modes
+const (
+	VerifySample = "sample"
+	VerifyFull   = "full"
+	VerifyDrill  = "drill"
+)
+
+// Destination health states
+const (
+	HealthUnknown = "unknown"
+	HealthHealthy = "healthy"
+	HealthFailing = "failing"
+)
+
+// DefaultDrillPath is where restore drills land unless the destination's
+// verify policy names another place; it should be on the btrfs pool
+const DefaultDrillPath = "/var/lib/nos/backup/drill"
+
+// verifyCheckInterval is how often scheduled verifications are looked for
+const verifyCheckInterval = 10 * time.Minute
+
+// VerifyPolicy schedules verification of a destination
+type VerifyPolicy struct {
+	Mode          string `json:"mode"`           // "sample", "full" or "drill"
+	IntervalHours int    `json:"interval_hours"` // 0 only verifies on demand
+	DrillPath     string `json:"drill_path,omitempty"`
+}
+
+// DestinationHealth is the outcome of a destination's verifications
+type DestinationHealth struct {
+	Status       string     `json:"status"` // "unknown", "healthy" or "failing"
+	LastVerified *time.Time `json:"last_verified,omitempty"`
+	LastSuccess  *time.Time `json:"last_success,omitempty"`
+	LastMode     string     `json:"last_mode,omitempty"`
+	LastJobID    string     `json:"last_job_id,omitempty"`
+	Message      string     `json:"message,omitempty"`
+	Failures     int        `json:"consecutive_failures"`
+}
+
+// VerifyNotifier is told about destinations that failed verification
+type VerifyNotifier interface {
+	VerifyFailed(dest *Destination, job *BackupJob, message string)
+}
+
+// UseNotifier reports failed verifications
+func (r *Replicator) UseNotifier(notifier VerifyNotifier) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.notifier = notifier
+}
+
+// DestinationHealth returns the health of a destination
+func (r *Replicator) DestinationHealth(destID string) (*DestinationHealth, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	dest, ok := r.destinations[destID]
+	if !ok {
+		return nil, fmt.Errorf("destination not found: %s", destID)
+	}
+	if dest.Health == nil {
+		return &DestinationHealth{Status: HealthUnknown}, nil
+	}
+	health := *dest.Health
+	return &health, nil
+}
+
+// Verify starts a verification of a destination
+func (r *Replicator) Verify(destID string, mode string) (*BackupJob, error) {
+	r.mu.RLock()
+	dest, ok := r.destinations[destID]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("destination not found: %s", destID)
+	}
+	if mode == "" {
+		mode = VerifySample
+	}
+	if err := validateVerifyMode(dest.Type, mode); err != nil {
+		return nil, err
+	}
+	if r.verifying(destID) {
+		return nil, fmt.Errorf("destination %s is already being verified", dest.Name)
+	}
+
+	return r.startDestinationJob(dest, "verify", func(ctx context.Context, job *BackupJob) error {
+		r.jobManager.AddLogEntry(job.ID, "info", fmt.Sprintf("Starting %s verification of %s", mode, dest.Name))
+		err := r.verify(ctx, job, dest, mode)
+		if job.State != JobStateCanceled {
+			r.recordVerify(dest.ID, job, mode, err)
+		}
+		return err
+	}), nil
+}
+
+func validateVerifyMode(destType string, mode string) error {
+	switch mode {
+	case VerifySample, VerifyFull:
+		return nil
+	case VerifyDrill:
+		if destType == "rclone" || destType == "nos" {
+			return fmt.Errorf("restore drills are not supported for %s destinations", destType)
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid verify mode: %s", mode)
+	}
+}
+
+func validateVerifyPolicy(dest *Destination) error {
+	if dest.Verify == nil {
+		return nil
+	}
+	if dest.Verify.IntervalHours < 0 {
+		return fmt.Errorf("verify interval cannot be negative")
+	}
+	if dest.Verify.DrillPath != "" && !filepath.IsAbs(dest.Verify.DrillPath) {
+		return fmt.Errorf("drill path must be absolute")
+	}
+	mode := dest.Verify.Mode
+	if mode == "" {
+		mode = VerifySample
+	}
+	return validateVerifyMode(dest.Type, mode)
+}
+
+// verifying reports whether a verification of the destination is running
+func (r *Replicator) verifying(destID string) bool {
+	for _, job := range r.jobManager.ListJobs() {
+		if job.Type == "verify" && job.DestinationID == destID && (job.State == JobStatePending || job.State == JobStateRunning) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Replicator) recordVerify(destID string, job *BackupJob, mode string, verifyErr error) {
+	r.mu.Lock()
+	dest, ok := r.destinations[destID]
+	if !ok {
+		r.mu.Unlock()
+		return
+	}
+	health := dest.Health
+	if health == nil {
+		health = &DestinationHealth{}
+		dest.Health = health
+	}
+	now := time.Now()
+	health.LastVerified = &now
+	health.LastMode = mode
+	health.LastJobID = job.ID
+	if verifyErr != nil {
+		health.Status = HealthFailing
+		health.Message = verifyErr.Error()
+		health.Failures++
+	} else {
+		health.Status = HealthHealthy
+		health.Message = ""
+		health.LastSuccess = &now
+		health.Failures = 0
+	}
+	if err := r.saveStateLocked(); err != nil {
+		r.logger.Error().Err(err).Msg("Failed to save replication state")
+	}
+	notifier := r.notifier
+	copied := *dest
+	r.mu.Unlock()
+
+	if verifyErr != nil {
+		r.logger.Error().Err(verifyErr).Str("destination", copied.Name).Str("mode", mode).Msg("Backup verification failed")
+		if notifier != nil {
+			notifier.VerifyFailed(&copied, job, verifyErr.Error())
+		}
+	}
+}
+
+// dueVerifications returns the destinations whose verify interval passed
+func (r *Replicator) dueVerifications(now time.Time) []*Destination {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var due []*Destination
+	for _, dest := range r.destinations {
+		if !dest.Enabled || dest.Verify == nil || dest.Verify.IntervalHours <= 0 {
+			continue
+		}
+		interval := time.Duration(dest.Verify.IntervalHours) * time.Hour
+		if dest.Health != nil && dest.Health.LastVerified != nil && now.Sub(*dest.Health.LastVerified) < interval {
+			continue
+		}
+		due = append(due, dest)
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].Name < due[j].Name })
+	return due
+}
+
+// verifyLoop starts the verifications that are due until the replicator
+// stops
+func (r *Replicator) verifyLoop() {
+	ticker := time.NewTicker(verifyCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case now := <-ticker.C:
+			for _, dest := range r.dueVerifications(now) {
+				if r.verifying(dest.ID) {
+					continue
+				}
+				if _, err := r.Verify(dest.ID, dest.Verify.Mode); err != nil {
+					r.logger.Warn().Err(err).Str("destination", dest.Name).Msg("Failed to start scheduled verification")
+				}
+			}
+		}
+	}
+}
+
+func (r *Replicator) verify(ctx context.Context, job *BackupJob, dest *Destination, mode string) error {
+	if mode == VerifyDrill {
+		return r.drill(ctx, job, dest)
+	}
+	switch dest.Type {
+	case "repo":
+		return r.verifyRepo(ctx, job, dest, mode)
+	case "s3":
+		return r.verifyS3(ctx, job, dest, mode)
+	case "local", "ssh":
+		return r.verifyBtrfs(ctx, job, dest, mode)
+	case "rclone":
+		return r.verifyRclone(ctx, job, dest, mode)
+	case "nos":
+		return r.verifyPeer(ctx, job, dest)
+	default:
+		return fmt.Errorf("cannot verify destinations of type %s", dest.Type)
+	}
+}
+
+// verifyRepo checks a repository; a full verify also reads and
+// authenticates every pack
+func (r *Replicator) verifyRepo(ctx context.Context, job *BackupJob, dest *Destination, mode string) error {
+	rp, err := r.openRepository(ctx, dest, false)
+	if err != nil {
+		return err
+	}
+	res, err := rp.Check(ctx, mode == VerifyFull)
+	if err != nil {
+		return err
+	}
+	for _, w := range res.Warnings {
+		r.jobManager.AddLogEntry(job.ID, "warn", w)
+	}
+	for _, e := range res.Errors {
+		r.jobManager.AddLogEntry(job.ID, "error", e)
+	}
+	r.jobManager.AddLogEntry(job.ID, "info", fmt.Sprintf("Checked %d snapshots, %d packs, %d blobs", res.Snapshots, res.Packs, res.Blobs))
+	if !res.OK() {
+		return fmt.Errorf("repository check found %d errors", len(res.Errors))
+	}
+	if res.Snapshots == 0 {
+		return fmt.Errorf("repository holds no snapshots")
+	}
+	return nil
+}
+
+// verifyS3 downloads backup sets and compares them with their manifests.
+// The streams are also parsed with btrfs receive --dump where btrfs is
+// installed.
+func (r *Replicator) verifyS3(ctx context.Context, job *BackupJob, dest *Destination, mode string) error {
+	client, err := r.s3Client(dest)
+	if err != nil {
+		return err
+	}
+	sets, _, err := listS3Sets(ctx, client, dest)
+	if err != nil {
+		return err
+	}
+	if mode == VerifySample {
+		sets = newestPerSubvolume(sets, func(set *S3BackupSet) string { return set.Subvolume })
+	}
+	if len(sets) == 0 {
+		return fmt.Errorf("bucket holds no backup sets")
+	}
+
+	var failures []string
+	for i, set := range sets {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		rc, err := client.Get(ctx, set.Key+"/"+s3StreamName)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", set.SnapshotID, err))
+			continue
+		}
+		hash := sha256.New()
+		counter := &countingWriter{}
+		parsed, err := checkStream(ctx, io.TeeReader(rc, io.MultiWriter(hash, counter)))
+		rc.Close()
+		switch {
+		case err != nil:
+			failures = append(failures, fmt.Sprintf("%s: %v", set.SnapshotID, err))
+		case set.Size > 0 && counter.n != set.Size:
+			failures = append(failures, fmt.Sprintf("%s: stream is %d bytes, manifest says %d", set.SnapshotID, counter.n, set.Size))
+		case set.SHA256 != "" && hex.EncodeToString(hash.Sum(nil)) != set.SHA256:
+			failures = append(failures, fmt.Sprintf("%s: checksum mismatch", set.SnapshotID))
+		default:
+			how := "size"
+			if set.SHA256 != "" {
+				how = "checksum"
+			}
+			if parsed {
+				how += " and stream"
+			}
+			r.jobManager.AddLogEntry(job.ID, "info", fmt.Sprintf("Verified %s of %s (%s, %d bytes)", how, set.SnapshotID, set.Subvolume, counter.n))
+		}
+		r.jobManager.UpdateProgress(job.ID, (i+1)*100/len(sets), 0, 0)
+	}
+	return verifyFailures(job, r.jobManager, failures, len(sets))
+}
+
+// verifyBtrfs sends replicas back out of a local or SSH destination and
+// parses the streams, which reads every extent of them
+func (r *Replicator) verifyBtrfs(ctx context.Context, job *BackupJob, dest *Destination, mode string) error {
+	replicas := r.remoteReplicas(dest)
+	if mode == VerifySample {
+		replicas = newestPerSubvolume(replicas, func(rs *ReplicatedSnapshot) string { return rs.Subvolume })
+	}
+	if len(replicas) == 0 {
+		return fmt.Errorf("no replicated snapshots to verify")
+	}
+
+	var failures []string
+	for i, rs := range replicas {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		remote := joinRemote(dest.Path, rs.Name)
+		cmd := r.remoteSend(ctx, dest, remote)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		stdout, err := cmd.StdoutPipe()
+		if err == nil {
+			err = cmd.Start()
+		}
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", remote, err))
+			continue
+		}
+		counter := &countingWriter{}
+		_, dumpErr := checkStream(ctx, io.TeeReader(stdout, counter))
+		if dumpErr != nil {
+			_ = cmd.Process.Kill()
+		}
+		waitErr := cmd.Wait()
+		switch {
+		case waitErr != nil:
+			failures = append(failures, fmt.Sprintf("%s: btrfs send failed: %v: %s", remote, waitErr, strings.TrimSpace(stderr.String())))
+		case dumpErr != nil:
+			failures = append(failures, fmt.Sprintf("%s: %v", remote, dumpErr))
+		default:
+			r.jobManager.AddLogEntry(job.ID, "info", fmt.Sprintf("Verified %s (%s, %d bytes)", remote, rs.Subvolume, counter.n))
+		}
+		r.jobManager.UpdateProgress(job.ID, (i+1)*100/len(replicas), 0, 0)
+	}
+	return verifyFailures(job, r.jobManager, failures, len(replicas))
+}
+
+// verifyRclone compares local snapshots with their copies using rclone
+// check; a full verify downloads the copies instead of comparing hashes
+func (r *Replicator) verifyRclone(ctx context.Context, job *BackupJob, dest *Destination, mode string) error {
+	if r.scheduler == nil {
+		return fmt.Errorf("no local snapshots to compare with")
+	}
+	remoteRoot := fmt.Sprintf("%s:%s", dest.RemoteName, dest.RemotePath)
+	out, err := exec.CommandContext(ctx, "rclone", "lsf", "--dirs-only", remoteRoot).Output()
+	if err != nil {
+		return fmt.Errorf("rclone lsf failed: %w", err)
+	}
+	remote := make(map[string]bool)
+	for _, line := range strings.Split(string(out), "\n") {
+		if name := strings.TrimSuffix(strings.TrimSpace(line), "/"); name != "" {
+			remote[name] = true
+		}
+	}
+	var snapshots []*Snapshot
+	for _, snap := range r.scheduler.ListSnapshots() {
+		if remote[filepath.Base(snap.Path)] {
+			snapshots = append(snapshots, snap)
+		}
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].CreatedAt.After(snapshots[j].CreatedAt) })
+	if mode == VerifySample {
+		snapshots = newestPerSubvolume(snapshots, func(s *Snapshot) string { return s.Subvolume })
+	}
+	if len(snapshots) == 0 {
+		return fmt.Errorf("no copies of local snapshots found on %s", remoteRoot)
+	}
+
+	var failures []string
+	for i, snap := range snapshots {
+		mountPoint, unmount, err := r.mountLocal(job.ID, snap.Path)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", snap.ID, err))
+			continue
+		}
+		args := []string{"check", mountPoint, remoteRoot + "/" + filepath.Base(snap.Path), "--one-way"}
+		if mode == VerifyFull {
+			args = append(args, "--download")
+		}
+		out, err := exec.CommandContext(ctx, "rclone", args...).CombinedOutput()
+		unmount()
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", snap.ID, lastLine(string(out))))
+		} else {
+			r.jobManager.AddLogEntry(job.ID, "info", fmt.Sprintf("Verified %s (%s)", filepath.Base(snap.Path), snap.Subvolume))
+		}
+		r.jobManager.UpdateProgress(job.ID, (i+1)*100/len(snapshots), 0, 0)
+	}
+	return verifyFailures(job, r.jobManager, failures, len(snapshots))
+}
+
+// verifyPeer checks that a peer still holds the replicas recorded for it.
+// The peer stores them as subvolumes it alone can read back.
+func (r *Replicator) verifyPeer(ctx context.Context, job *BackupJob, dest *Destination) error {
+	present, err := r.remotePresence(ctx, dest)
+	if err != nil {
+		return err
+	}
+	replicas, _ := r.ReplicatedSnapshots(dest.ID)
+	if len(replicas) == 0 {
+		return fmt.Errorf("no replicated snapshots to verify")
+	}
+	var failures []string
+	for _, rs := range replicas {
+		if !present(rs.SnapshotID, rs.UUID) {
+			failures = append(failures, fmt.Sprintf("%s: missing on the peer", rs.SnapshotID))
+		}
+	}
+	r.jobManager.AddLogEntry(job.ID, "info", "Checked that the peer holds every replica; their contents are not read")
+	return verifyFailures(job, r.jobManager, failures, len(replicas))
+}
+
+// drill restores the newest copy on a destination into a scratch
+// subvolume and compares it with the local snapshot it came from
+func (r *Replicator) drill(ctx context.Context, job *BackupJob, dest *Destination) error {
+	base := DefaultDrillPath
+	if dest.Verify != nil && dest.Verify.DrillPath != "" {
+		base = dest.Verify.DrillPath
+	}
+	scratch, cleanup, err := createScratch(base, job.ID)
+	if err != nil {
+		return fmt.Errorf("failed to create scratch subvolume: %w", err)
+	}
+	defer cleanup()
+	r.jobManager.AddLogEntry(job.ID, "info", fmt.Sprintf("Restoring into %s", scratch))
+
+	started := time.Now()
+	var restored, snapshotID string
+	switch dest.Type {
+	case "repo":
+		restored, snapshotID, err = r.drillRepo(ctx, job, dest, scratch)
+	case "s3":
+		restored, snapshotID, err = r.drillS3(ctx, job, dest, scratch)
+	case "local", "ssh":
+		restored, snapshotID, err = r.drillBtrfs(ctx, job, dest, scratch)
+	default:
+		err = fmt.Errorf("restore drills are not supported for %s destinations", dest.Type)
+	}
+	if err != nil {
+		return fmt.Errorf("restore failed: %w", err)
+	}
+
+	got, err := treeDigest(restored)
+	if err != nil {
+		return fmt.Errorf("failed to hash the restored data: %w", err)
+	}
+	r.jobManager.AddLogEntry(job.ID, "info", fmt.Sprintf("Restored %d entries in %s", len(got), time.Since(started).Round(time.Second)))
+
+	// The local snapshot may have been pruned since; the restore alone
+	// then has to do as proof
+	var local *Snapshot
+	if r.scheduler != nil && snapshotID != "" {
+		local, _ = r.scheduler.GetSnapshot(snapshotID)
+	}
+	if local == nil {
+		r.jobManager.AddLogEntry(job.ID, "warn", "The local snapshot is gone, the restored data was not compared")
+		return nil
+	}
+	mountPoint, unmount, err := r.mountLocal(job.ID+"-local", local.Path)
+	if err != nil {
+		return err
+	}
+	defer unmount()
+	want, err := treeDigest(mountPoint)
+	if err != nil {
+		return fmt.Errorf("failed to hash the local snapshot: %w", err)
+	}
+	if diffs := diffDigests(want, got); len(diffs) > 0 {
+		for _, d := range diffs {
+			r.jobManager.AddLogEntry(job.ID, "error", d)
+		}
+		return fmt.Errorf("restored data differs from snapshot %s", local.ID)
+	}
+	r.jobManager.AddLogEntry(job.ID, "info", fmt.Sprintf("Restored data matches snapshot %s of %s", local.ID, local.Subvolume))
+	return nil
+}
+
+func (r *Replicator) drillRepo(ctx context.Context, job *BackupJob, dest *Destination, scratch string) (string, string, error) {
+	rp, err := r.openRepository(ctx, dest, false)
+	if err != nil {
+		return "", "", err
+	}
+	snaps, err := rp.Snapshots(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	if len(snaps) == 0 {
+		return "", "", fmt.Errorf("repository holds no snapshots")
+	}
+	fsys, snap, err := rp.FS(ctx, snaps[0].ID)
+	if err != nil {
+		return "", "", err
+	}
+	r.jobManager.AddLogEntry(job.ID, "info", fmt.Sprintf("Restoring repository snapshot %s of %s", snap.ID, snap.Source))
+	root, err := fs.Stat(fsys, ".")
+	if err != nil {
+		return "", "", err
+	}
+	c := &fileCopier{
+		fsys:     fsys,
+		conflict: ConflictOverwrite,
+		stats:    &FileRestoreStats{},
+		log:      func(level, msg string) { r.jobManager.AddLogEntry(job.ID, level, msg) },
+		progress: func(int64) {},
+	}
+	restored := filepath.Join(scratch, "restore")
+	if err := c.copy(".", root, restored); err != nil {
+		return "", "", err
+	}
+	return restored, snap.SourceSnapshot, nil
+}
+
+// drillS3 receives the newest set with the chain of sets it is
+// incremental to
+func (r *Replicator) drillS3(ctx context.Context, job *BackupJob, dest *Destination, scratch string) (string, string, error) {
+	client, err := r.s3Client(dest)
+	if err != nil {
+		return "", "", err
+	}
+	sets, _, err := listS3Sets(ctx, client, dest)
+	if err != nil {
+		return "", "", err
+	}
+	if len(sets) == 0 {
+		return "", "", fmt.Errorf("bucket holds no backup sets")
+	}
+	byID := make(map[string]*S3BackupSet)
+	for _, set := range sets {
+		byID[set.SnapshotID] = set
+	}
+	chain := []*S3BackupSet{sets[0]}
+	for set := sets[0]; set.Parent != ""; {
+		parent, ok := byID[set.Parent]
+		if !ok {
+			return "", "", fmt.Errorf("parent %s of %s is missing", set.Parent, set.SnapshotID)
+		}
+		chain = append([]*S3BackupSet{parent}, chain...)
+		set = parent
+	}
+
+	var restored string
+	for _, set := range chain {
+		r.jobManager.AddLogEntry(job.ID, "info", fmt.Sprintf("Receiving %s (%s)", set.SnapshotID, set.Subvolume))
+		rc, err := client.Get(ctx, set.Key+"/"+s3StreamName)
+		if err != nil {
+			return "", "", err
+		}
+		restored, err = receiveInto(ctx, rc, scratch)
+		rc.Close()
+		if err != nil {
+			return "", "", err
+		}
+	}
+	return restored, sets[0].SnapshotID, nil
+}
+
+// drillBtrfs sends the newest replica back from a local or SSH destination
+func (r *Replicator) drillBtrfs(ctx context.Context, job *BackupJob, dest *Destination, scratch string) (string, string, error) {
+	replicas := r.remoteReplicas(dest)
+	if len(replicas) == 0 {
+		return "", "", fmt.Errorf("no replicated snapshots to restore")
+	}
+	rs := replicas[0]
+	remote := joinRemote(dest.Path, rs.Name)
+	r.jobManager.AddLogEntry(job.ID, "info", fmt.Sprintf("Receiving %s", remote))
+
+	cmd := r.remoteSend(ctx, dest, remote)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", "", err
+	}
+	if err := cmd.Start(); err != nil {
+		return "", "", err
+	}
+	restored, recvErr := receiveInto(ctx, stdout, scratch)
+	if recvErr != nil {
+		_ = cmd.Process.Kill()
+	}
+	if err := cmd.Wait(); err != nil {
+		return "", "", fmt.Errorf("btrfs send failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if recvErr != nil {
+		return "", "", recvErr
+	}
+	return restored, rs.SnapshotID, nil
+}
+
+// remoteReplicas lists the recorded replicas of a btrfs destination whose
+// name on the destination is known, newest first
+func (r *Replicator) remoteReplicas(dest *Destination) []*ReplicatedSnapshot {
+	r.mu.RLock()
+	recorded := append([]*ReplicatedSnapshot(nil), r.replicated[dest.ID]...)
+	r.mu.RUnlock()
+
+	var replicas []*ReplicatedSnapshot
+	for _, rs := range recorded {
+		copied := *rs
+		if copied.Name == "" && r.scheduler != nil {
+			// Recorded before names were; the local snapshot still has it
+			if snap, err := r.scheduler.GetSnapshot(rs.SnapshotID); err == nil {
+				copied.Name = filepath.Base(snap.Path)
+			}
+		}
+		if copied.Name != "" {
+			replicas = append(replicas, &copied)
+		}
+	}
+	sort.Slice(replicas, func(i, j int) bool { return replicas[i].CreatedAt.After(replicas[j].CreatedAt) })
+	return replicas
+}
+
+// remoteSend returns a command writing a full send stream of a subvolume
+// on a local or SSH destination to its stdout
+func (r *Replicator) remoteSend(ctx context.Context, dest *Destination, path string) *exec.Cmd {
+	if dest.Type == "local" {
+		return exec.CommandContext(ctx, "btrfs", "send", "-q", path)
+	}
+	return exec.CommandContext(ctx, "ssh", r.sshArgs(dest, fmt.Sprintf("btrfs send -q %s", shellQuote(path)))...)
+}
+
+// sshArgs returns the arguments running a command on an SSH destination
+func (r *Replicator) sshArgs(dest *Destination, command string) []string {
+	args := []string{
+		"-o", "ConnectTimeout=10",
+		"-o", "StrictHostKeyChecking=accept-new",
+		"-o", "UserKnownHostsFile=/var/lib/nos/backup/known_hosts",
+		"-o", "BatchMode=yes",
+		"-p", fmt.Sprintf("%d", dest.Port),
+	}
+	if dest.KeyRef != "" {
+		args = append(args, "-i", filepath.Join(r.keysDir, dest.KeyRef))
+	}
+	return append(args, fmt.Sprintf("%s@%s", dest.User, dest.Host), command)
+}
+
+// mountLocal mounts a local snapshot read-only; tests replace r.mount
+func (r *Replicator) mountLocal(jobID string, snapshotPath string) (string, func(), error) {
+	if r.mount != nil {
+		return r.mount(jobID, snapshotPath)
+	}
+	return mountSnapshot(jobID, snapshotPath)
+}
+
+// checkStream parses a send stream with btrfs receive --dump, which fails
+// on a truncated or corrupt stream. Without btrfs the stream is only read;
+// parsed reports which happened.
+func checkStream(ctx context.Context, src io.Reader) (parsed bool, err error) {
+	if _, err := exec.LookPath("btrfs"); err != nil {
+		_, err = io.Copy(io.Discard, src)
+		return false, err
+	}
+	cmd := exec.CommandContext(ctx, "btrfs", "receive", "--dump")
+	cmd.Stdin = src
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return true, fmt.Errorf("stream is not valid: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return true, nil
+}
+
+// receiveInto receives a send stream below dir and returns the path of the
+// subvolume it created
+func receiveInto(ctx context.Context, src io.Reader, dir string) (string, error) {
+	before := make(map[string]bool)
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		before[e.Name()] = true
+	}
+	cmd := exec.CommandContext(ctx, "btrfs", "receive", dir)
+	cmd.Stdin = src
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("btrfs receive failed: %v: %s", err, lastLine(string(out)))
+	}
+	entries, _ = os.ReadDir(dir)
+	for _, e := range entries {
+		if !before[e.Name()] {
+			return filepath.Join(dir, e.Name()), nil
+		}
+	}
+	return "", fmt.Errorf("btrfs receive created no subvolume")
+}
+
+// createScratch creates the scratch subvolume of a drill, or a directory
+// where the drill path is not on btrfs. cleanup deletes it with everything
+// received into it.
+func createScratch(base string, jobID string) (string, func(), error) {
+	if err := os.MkdirAll(base, 0700); err != nil {
+		return "", nil, err
+	}
+	scratch := filepath.Join(base, "drill-"+jobID)
+	if err := exec.Command("btrfs", "subvolume", "create", scratch).Run(); err != nil {
+		if err := os.Mkdir(scratch, 0700); err != nil {
+			return "", nil, err
+		}
+	}
+	return scratch, func() {
+		entries, _ := os.ReadDir(scratch)
+		for _, e := range entries {
+			p := filepath.Join(scratch, e.Name())
+			// Received subvolumes are read-only and need btrfs to go away
+			if exec.Command("btrfs", "subvolume", "delete", p).Run() != nil {
+				_ = os.RemoveAll(p)
+			}
+		}
+		if exec.Command("btrfs", "subvolume", "delete", scratch).Run() != nil {
+			_ = os.RemoveAll(scratch)
+		}
+	}, nil
+}
+
+// treeDigest maps every path below root to its type, size and content hash
+func treeDigest(root string) (map[string]string, error) {
+	digest := make(map[string]string)
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, p)
+		if rel == "." {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		switch {
+		case d.IsDir():
+			digest[rel] = "dir"
+		case d.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			digest[rel] = "symlink " + target
+		case d.Type().IsRegular():
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			h := sha256.New()
+			n, err := io.Copy(h, f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+			digest[rel] = fmt.Sprintf("file %d %x", n, h.Sum(nil))
+		default:
+			digest[rel] = "other"
+		}
+		return nil
+	})
+	return digest, err
+}
+
+// diffDigests describes the first differences between two trees
+func diffDigests(want, got map[string]string) []string {
+	var diffs []string
+	var paths []string
+	for p := range want {
+		paths = append(paths, p)
+	}
+	for p := range got {
+		if _, ok := want[p]; !ok {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		w, inWant := want[p]
+		g, inGot := got[p]
+		switch {
+		case !inGot:
+			diffs = append(diffs, fmt.Sprintf("%s: missing from the restore", p))
+		case !inWant:
+			diffs = append(diffs, fmt.Sprintf("%s: not in the snapshot", p))
+		case w != g:
+			diffs = append(diffs, fmt.Sprintf("%s: content differs", p))
+		}
+		if len(diffs) == 10 {
+			diffs = append(diffs, "...")
+			break
+		}
+	}
+	return diffs
+}
+
+func verifyFailures(job *BackupJob, jm *JobManager, failures []string, checked int) error {
+	for _, f := range failures {
+		jm.AddLogEntry(job.ID, "error", f)
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%d of %d copies failed verification: %s", len(failures), checked, failures[0])
+	}
+	jm.AddLogEntry(job.ID, "info", fmt.Sprintf("Verified %d copies", checked))
+	return nil
+}
+
+// newestPerSubvolume keeps the first item of every subvolume of a list
+// sorted newest first
+func newestPerSubvolume[T any](items []T, subvolume func(T) string) []T {
+	seen := make(map[string]bool)
+	var kept []T
+	for _, item := range items {
+		if sv := subvolume(item); !seen[sv] {
+			seen[sv] = true
+			kept = append(kept, item)
+		}
+	}
+	return kept
+}
+
+type countingWriter struct{ n int64 }
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+func joinRemote(dir, name string) string {
+	return strings.TrimSuffix(dir, "/") + "/" + name
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func lastLine(out string) string {
+	var last string
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			last = line
+		}
+	}
+	return last
+}
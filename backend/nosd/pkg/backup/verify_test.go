@@ -0,0 +1,193 @@
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"nithronos/backend/nosd/pkg/backup/repo"
+)
+
+type verifyRecorder struct {
+	failed []string
+}
+
+func (n *verifyRecorder) VerifyFailed(dest *Destination, job *BackupJob, message string) {
+	n.failed = append(n.failed, dest.Name+": "+message)
+}
+
+// runVerify runs a verification the way Verify does, without the goroutine
+func runVerify(t *testing.T, r *Replicator, dest *Destination, mode string) error {
+	t.Helper()
+	job := &BackupJob{ID: "verify-" + mode + "-" + time.Now().Format("150405.000000000"), Type: "verify", DestinationID: dest.ID}
+	r.jobManager.AddJob(job)
+	err := r.verify(context.Background(), job, dest, mode)
+	r.recordVerify(dest.ID, job, mode, err)
+	return err
+}
+
+// newRepoVerifier returns a replicator with a repository destination
+// holding one backup of the tree the local snapshot "snap" mounts as
+func newRepoVerifier(t *testing.T) (*Replicator, *Destination, string) {
+	t.Helper()
+	restorer, _ := newCatalogRestorer(t, "/srv/data")
+	r := restorer.replicator
+	src, _, _ := restorer.mount("", "")
+	r.mount = restorer.mount
+	r.UseScheduler(restorer.scheduler)
+
+	dest := &Destination{
+		Name: "repo", Type: "repo", Enabled: true, Path: filepath.Join(t.TempDir(), "repo"),
+		Verify: &VerifyPolicy{Mode: VerifyDrill, DrillPath: filepath.Join(t.TempDir(), "drill")},
+	}
+	if err := r.CreateDestination(dest); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.StoreRepoPassword(dest.ID, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	rp, err := r.openRepository(context.Background(), dest, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rp.Backup(context.Background(), src, repo.BackupOptions{Source: "/srv/data", SourceSnapshot: "snap"}); err != nil {
+		t.Fatal(err)
+	}
+	return r, dest, src
+}
+
+func TestVerifyRepositoryHealth(t *testing.T) {
+	r, dest, _ := newRepoVerifier(t)
+	notifier := &verifyRecorder{}
+	r.UseNotifier(notifier)
+
+	health, _ := r.DestinationHealth(dest.ID)
+	if health.Status != HealthUnknown {
+		t.Fatalf("initial health %+v", health)
+	}
+	for _, mode := range []string{VerifySample, VerifyFull} {
+		if err := runVerify(t, r, dest, mode); err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+	}
+	health, _ = r.DestinationHealth(dest.ID)
+	if health.Status != HealthHealthy || health.LastMode != VerifyFull || health.LastSuccess == nil {
+		t.Fatalf("health %+v", health)
+	}
+
+	// Damage every pack; only reading the data notices
+	packs, _ := filepath.Glob(filepath.Join(dest.Path, "data", "*", "*"))
+	if len(packs) == 0 {
+		t.Fatal("no packs in the repository")
+	}
+	for _, p := range packs {
+		data, _ := os.ReadFile(p)
+		data[len(data)/2] ^= 0xff
+		if err := os.WriteFile(p, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := runVerify(t, r, dest, VerifyFull); err == nil {
+		t.Fatal("full verify passed a damaged repository")
+	}
+	if err := runVerify(t, r, dest, VerifyFull); err == nil {
+		t.Fatal("second full verify passed")
+	}
+	health, _ = r.DestinationHealth(dest.ID)
+	if health.Status != HealthFailing || health.Failures != 2 || health.LastSuccess == nil {
+		t.Fatalf("health after damage %+v", health)
+	}
+	if len(notifier.failed) != 2 || !strings.HasPrefix(notifier.failed[0], "repo: ") {
+		t.Fatalf("notifications %q", notifier.failed)
+	}
+
+	// Health survives an edit of the destination
+	update := *dest
+	update.Verify = &VerifyPolicy{Mode: VerifySample, IntervalHours: 24}
+	if err := r.UpdateDestination(dest.ID, &update); err != nil {
+		t.Fatal(err)
+	}
+	if health, _ := r.DestinationHealth(dest.ID); health.Status != HealthFailing {
+		t.Fatalf("health after update %+v", health)
+	}
+	update.Verify = &VerifyPolicy{Mode: "weekly"}
+	if err := r.UpdateDestination(dest.ID, &update); err == nil {
+		t.Error("accepted an unknown verify mode")
+	}
+}
+
+func TestRestoreDrill(t *testing.T) {
+	r, dest, src := newRepoVerifier(t)
+
+	if err := runVerify(t, r, dest, VerifyDrill); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(dest.Verify.DrillPath); len(entries) != 0 {
+		t.Fatalf("drill left %d entries behind", len(entries))
+	}
+
+	// The local snapshot no longer matches what was backed up
+	if err := os.WriteFile(filepath.Join(src, "docs", "notes.txt"), []byte("forget the milk"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := runVerify(t, r, dest, VerifyDrill)
+	if err == nil || !strings.Contains(err.Error(), "differs") {
+		t.Fatalf("drill of a changed snapshot: %v", err)
+	}
+	health, _ := r.DestinationHealth(dest.ID)
+	if health.Status != HealthFailing || health.LastMode != VerifyDrill {
+		t.Fatalf("health %+v", health)
+	}
+	job, _ := r.jobManager.GetJob(health.LastJobID)
+	var logged bool
+	for _, entry := range job.LogEntries {
+		logged = logged || entry.Message == "docs/notes.txt: content differs"
+	}
+	if !logged {
+		t.Errorf("difference not logged: %+v", job.LogEntries)
+	}
+}
+
+func TestVerifyS3Checksums(t *testing.T) {
+	if _, err := exec.LookPath("btrfs"); err == nil {
+		t.Skip("btrfs would reject the fake streams")
+	}
+	bucket := &memoryBucket{objects: map[string][]byte{}}
+	r, dest := newS3Replicator(t, bucket)
+
+	now := time.Now()
+	for i, id := range []string{"new", "old"} {
+		stream := []byte("stream of " + id)
+		sum := sha256.Sum256(stream)
+		set := S3BackupSet{SnapshotID: id, Subvolume: "@home", CreatedAt: now.Add(-time.Duration(i) * time.Hour), Size: int64(len(stream)), SHA256: hex.EncodeToString(sum[:]), Key: "nos/@home/" + id}
+		manifest, _ := json.Marshal(set)
+		bucket.objects["nos/@home/"+id+"/"+s3ManifestName] = manifest
+		bucket.objects["nos/@home/"+id+"/"+s3StreamName] = stream
+	}
+	// Same size, different bytes
+	bucket.objects["nos/@home/old/"+s3StreamName] = []byte("stream of OLD")
+
+	if err := runVerify(t, r, dest, VerifySample); err != nil {
+		t.Fatalf("sample verify read the old set: %v", err)
+	}
+	err := runVerify(t, r, dest, VerifyFull)
+	if err == nil || !strings.Contains(err.Error(), "old: checksum mismatch") {
+		t.Fatalf("full verify: %v", err)
+	}
+	if err := validateVerifyMode("s3", VerifyDrill); err != nil {
+		t.Errorf("drills of s3 destinations: %v", err)
+	}
+	if err := validateVerifyMode("rclone", VerifyDrill); err == nil {
+		t.Error("accepted a drill of an rclone destination")
+	}
+	if _, err := r.Verify(dest.ID, "quick"); err == nil {
+		t.Error("accepted an unknown mode")
+	}
+}
@@ -0,0 +1,858 @@
+package jobs
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+
+	"nithronos/backend/nosd/internal/fsatomic"
+)
+
+const (
+	// DefaultRetention is how long finished jobs are kept
+	DefaultRetention = 30 * 24 * time.Hour
+
+	// Progress-only updates are written to disk at most this often
+	progressSaveInterval = time.Second
+
+	// Log entries kept in memory per job; the log file keeps them all
+	memoryLogEntries = 1000
+
+	subscriberBuffer = 256
+)
+
+// ErrNotFound is returned for unknown job IDs
+var ErrNotFound = errors.New("job not found")
+
+// RunFunc does the work of a submitted job. The context is canceled when
+// the job is.
+type RunFunc func(ctx context.Context, job *Job) error
+
+// Engine tracks every background job of nosd. Jobs are written to dir as
+// they change, so the history survives restarts; jobs that were running
+// when nosd stopped come back as interrupted, and resumable ones are
+// handed to the resume function registered for their type.
+type Engine struct {
+	logger zerolog.Logger
+	dir    string // empty keeps jobs in memory only
+
+	// Retention is how long finished jobs are kept
+	Retention time.Duration
+
+	mu        sync.Mutex
+	jobs      map[string]*Job
+	logs      map[string][]LogEntry
+	logSeq    map[string]int
+	saved     map[string]time.Time
+	contexts  map[string]context.Context
+	cancels   map[string]context.CancelFunc
+	resources map[string]*resource
+	limits    map[string]int
+	resumers  map[string]ResumeFunc
+	subs      map[int]*subscriber
+	nextSub   int
+	started   bool
+	stop      chan struct{}
+	stopOnce  sync.Once
+
+	// Changes made under mu wait here for flush, which writes them to
+	// dir after mu is released; ioMu keeps the writes in order
+	ioMu        sync.Mutex
+	dirty       map[string]bool
+	pendingLogs map[string][]LogEntry
+	deleted     []string
+}
+
+// resource is a named semaphore; changed is closed and replaced whenever
+// a holder leaves
+type resource struct {
+	holders []string
+	changed chan struct{}
+}
+
+type subscriber struct {
+	jobID string
+	ch    chan Event
+}
+
+// New creates an engine persisting jobs in dir
+func New(logger zerolog.Logger, dir string) *Engine {
+	return &Engine{
+		logger:    logger.With().Str("component", "jobs").Logger(),
+		dir:       dir,
+		Retention: DefaultRetention,
+		jobs:      make(map[string]*Job),
+		logs:      make(map[string][]LogEntry),
+		logSeq:    make(map[string]int),
+		saved:     make(map[string]time.Time),
+		contexts:  make(map[string]context.Context),
+		cancels:   make(map[string]context.CancelFunc),
+		resources: make(map[string]*resource),
+		limits:    make(map[string]int),
+		resumers:  make(map[string]ResumeFunc),
+		subs:      make(map[int]*subscriber),
+		stop:      make(chan struct{}),
+
+		dirty:       make(map[string]bool),
+		pendingLogs: make(map[string][]LogEntry),
+	}
+}
+
+// Start loads persisted jobs, marks the ones that were still running as
+// interrupted and resumes those that can be
+func (e *Engine) Start() error {
+	e.mu.Lock()
+	if e.started {
+		e.mu.Unlock()
+		return nil
+	}
+	e.started = true
+	e.mu.Unlock()
+
+	loaded, logSeq, err := e.load()
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	for id, job := range loaded {
+		if _, ok := e.jobs[id]; !ok {
+			e.jobs[id] = job
+			e.logSeq[id] = logSeq[id]
+		}
+	}
+	now := time.Now()
+	for _, job := range e.jobs {
+		if job.State.Done() {
+			continue
+		}
+		job.State = StateInterrupted
+		job.Error = "interrupted by restart"
+		job.FinishedAt = &now
+		job.UpdatedAt = now
+		e.saveLocked(job)
+		e.appendLogLocked(job.ID, LogEntry{Level: "warn", Message: "Interrupted by restart"})
+		e.logger.Warn().Str("id", job.ID).Str("type", job.Type).Msg("Job interrupted by restart")
+	}
+	e.mu.Unlock()
+	e.flush()
+
+	e.resumeInterrupted("")
+	go e.pruneLoop()
+	return nil
+}
+
+// Stop ends the engine's background work. Running jobs are left alone;
+// the next Start marks them interrupted.
+func (e *Engine) Stop() {
+	e.stopOnce.Do(func() { close(e.stop) })
+}
+
+// SetLimit allows n jobs at a time on a resource; the default is one
+func (e *Engine) SetLimit(resource string, n int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.limits[resource] = n
+}
+
+// OnResume registers the function that resumes interrupted resumable jobs
+// of a type. Jobs interrupted before the registration are resumed at once.
+func (e *Engine) OnResume(jobType string, fn ResumeFunc) {
+	e.mu.Lock()
+	e.resumers[jobType] = fn
+	started := e.started
+	e.mu.Unlock()
+
+	if started {
+		e.resumeInterrupted(jobType)
+	}
+}
+
+func (e *Engine) resumeInterrupted(jobType string) {
+	e.mu.Lock()
+	var pending []*Job
+	for _, job := range e.jobs {
+		if job.State != StateInterrupted || !job.Resumable || job.ResumedBy != "" {
+			continue
+		}
+		if jobType != "" && job.Type != jobType {
+			continue
+		}
+		if _, ok := e.resumers[job.Type]; ok {
+			pending = append(pending, job.clone())
+		}
+	}
+	e.mu.Unlock()
+
+	sort.Slice(pending, func(i, j int) bool { return pending[i].CreatedAt.Before(pending[j].CreatedAt) })
+	for _, job := range pending {
+		e.mu.Lock()
+		fn := e.resumers[job.Type]
+		e.mu.Unlock()
+
+		resumedBy, err := fn(job)
+		if err != nil {
+			e.Log(job.ID, LogEntry{Level: "error", Message: fmt.Sprintf("Resume failed: %v", err)})
+			e.logger.Error().Err(err).Str("id", job.ID).Msg("Failed to resume job")
+			continue
+		}
+		_, _ = e.Update(job.ID, func(j *Job) { j.ResumedBy = resumedBy })
+		e.Log(job.ID, LogEntry{Level: "info", Message: "Resumed as job " + resumedBy})
+		e.logger.Info().Str("id", job.ID).Str("resumed_by", resumedBy).Msg("Job resumed")
+	}
+}
+
+// Create records a new job driven by its caller
+func (e *Engine) Create(job *Job) (*Job, error) {
+	e.mu.Lock()
+	defer e.flush()
+	defer e.mu.Unlock()
+
+	if job.ID == "" {
+		job.ID = uuid.New().String()
+	}
+	if _, ok := e.jobs[job.ID]; ok {
+		return nil, fmt.Errorf("job %s already exists", job.ID)
+	}
+	if job.Type == "" {
+		return nil, fmt.Errorf("job type is required")
+	}
+	now := time.Now()
+	stored := job.clone()
+	if stored.State == "" {
+		stored.State = StatePending
+	}
+	if stored.CreatedAt.IsZero() {
+		stored.CreatedAt = now
+	}
+	stored.UpdatedAt = now
+	e.jobs[stored.ID] = stored
+	e.contexts[stored.ID], e.cancels[stored.ID] = context.WithCancel(context.Background())
+
+	if parent, ok := e.jobs[stored.ParentID]; ok && !contains(parent.ChildIDs, stored.ID) {
+		parent.ChildIDs = append(parent.ChildIDs, stored.ID)
+		parent.UpdatedAt = now
+		e.saveLocked(parent)
+		e.publishLocked(Event{Type: "job", JobID: parent.ID, Job: parent.clone()})
+	}
+	e.saveLocked(stored)
+	e.publishLocked(Event{Type: "job", JobID: stored.ID, Job: stored.clone()})
+	return stored.clone(), nil
+}
+
+// Submit records a job and runs it in the background once its resource
+// is free
+func (e *Engine) Submit(job *Job, run RunFunc) (*Job, error) {
+	created, err := e.Create(job)
+	if err != nil {
+		return nil, err
+	}
+	go e.run(created.ID, run)
+	return created, nil
+}
+
+func (e *Engine) run(id string, run RunFunc) {
+	ctx := e.Context(id)
+	job, ok := e.Get(id)
+	if !ok {
+		return
+	}
+	if job.Resource != "" {
+		if holder := e.Holder(job.Resource); holder != "" {
+			e.Log(id, LogEntry{Level: "info", Message: fmt.Sprintf("Waiting for %s (held by job %s)", job.Resource, holder)})
+		}
+		if err := e.Acquire(ctx, job.Resource, id); err != nil {
+			e.Finish(id, err)
+			return
+		}
+		defer e.Release(job.Resource, id)
+	}
+
+	job, err := e.Update(id, func(j *Job) { j.State = StateRunning })
+	if err != nil || job.State != StateRunning {
+		return
+	}
+	e.Finish(id, run(ctx, job))
+}
+
+// Update applies fn to a job and stores the result
+func (e *Engine) Update(id string, fn func(*Job)) (*Job, error) {
+	e.mu.Lock()
+	defer e.flush()
+	defer e.mu.Unlock()
+
+	job, ok := e.jobs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	wasDone := job.State.Done()
+	fn(job)
+	job.ID = id
+	now := time.Now()
+	job.UpdatedAt = now
+	if job.State == StateRunning && job.StartedAt == nil {
+		job.StartedAt = &now
+	}
+	if job.State.Done() && !wasDone {
+		if job.FinishedAt == nil {
+			job.FinishedAt = &now
+		}
+		e.finishedLocked(job)
+	}
+	e.saveLocked(job)
+	e.publishLocked(Event{Type: "job", JobID: id, Job: job.clone()})
+	return job.clone(), nil
+}
+
+// Progress records how far a job is; the change reaches disk at most once
+// a second
+func (e *Engine) Progress(id string, progress float64, message string) {
+	e.mu.Lock()
+	defer e.flush()
+	defer e.mu.Unlock()
+
+	job, ok := e.jobs[id]
+	if !ok {
+		return
+	}
+	job.Progress = progress
+	if message != "" {
+		job.Message = message
+	}
+	job.UpdatedAt = time.Now()
+	if time.Since(e.saved[id]) >= progressSaveInterval || progress >= 100 {
+		e.saveLocked(job)
+	}
+	e.publishLocked(Event{Type: "job", JobID: id, Job: job.clone()})
+}
+
+// Finish ends a job: it succeeded when err is nil, was canceled when its
+// context was and failed otherwise
+func (e *Engine) Finish(id string, err error) {
+	_, _ = e.Update(id, func(job *Job) {
+		if job.State.Done() {
+			return
+		}
+		switch {
+		case err == nil:
+			job.State = StateSucceeded
+			job.Progress = 100
+		case errors.Is(err, context.Canceled):
+			job.State = StateCanceled
+		default:
+			job.State = StateFailed
+			job.Error = err.Error()
+		}
+	})
+}
+
+// Cancel cancels a job and its unfinished children
+func (e *Engine) Cancel(id string) error {
+	e.mu.Lock()
+	defer e.flush()
+	defer e.mu.Unlock()
+
+	job, ok := e.jobs[id]
+	if !ok {
+		return ErrNotFound
+	}
+	e.cancelLocked(job)
+	return nil
+}
+
+func (e *Engine) cancelLocked(job *Job) {
+	if !job.State.Done() {
+		now := time.Now()
+		job.State = StateCanceled
+		job.FinishedAt = &now
+		job.UpdatedAt = now
+		e.finishedLocked(job)
+		e.saveLocked(job)
+		e.appendLogLocked(job.ID, LogEntry{Level: "warn", Message: "Canceled"})
+		e.publishLocked(Event{Type: "job", JobID: job.ID, Job: job.clone()})
+		e.logger.Info().Str("id", job.ID).Msg("Job canceled")
+	}
+	for _, childID := range job.ChildIDs {
+		if child, ok := e.jobs[childID]; ok {
+			e.cancelLocked(child)
+		}
+	}
+}
+
+// finishedLocked releases what a finished job holds: its context and its
+// resource
+func (e *Engine) finishedLocked(job *Job) {
+	if cancel, ok := e.cancels[job.ID]; ok {
+		cancel()
+	}
+	if job.Resource != "" {
+		e.releaseLocked(job.Resource, job.ID)
+	}
+}
+
+// Context returns a context canceled when the job is canceled or finishes
+func (e *Engine) Context(id string) context.Context {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if ctx, ok := e.contexts[id]; ok {
+		return ctx
+	}
+	// Jobs loaded from disk are finished; their work is over
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return ctx
+}
+
+// Get returns a copy of a job
+func (e *Engine) Get(id string) (*Job, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	job, ok := e.jobs[id]
+	if !ok {
+		return nil, false
+	}
+	return job.clone(), true
+}
+
+// List returns copies of the matching jobs, newest first
+func (e *Engine) List(f Filter) []*Job {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	out := []*Job{}
+	for _, job := range e.jobs {
+		if f.matches(job) {
+			out = append(out, job.clone())
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	if f.Limit > 0 && f.Limit < len(out) {
+		out = out[:f.Limit]
+	}
+	return out
+}
+
+func (f Filter) matches(job *Job) bool {
+	if f.Type != "" {
+		if strings.HasSuffix(f.Type, ".") {
+			if !strings.HasPrefix(job.Type, f.Type) {
+				return false
+			}
+		} else if job.Type != f.Type {
+			return false
+		}
+	}
+	if f.State != "" && job.State != f.State {
+		return false
+	}
+	if f.ParentID != "" && job.ParentID != f.ParentID {
+		return false
+	}
+	if f.Resource != "" && job.Resource != f.Resource {
+		return false
+	}
+	return true
+}
+
+// Remove forgets a finished job and deletes its files
+func (e *Engine) Remove(id string) error {
+	e.mu.Lock()
+	defer e.flush()
+	defer e.mu.Unlock()
+
+	job, ok := e.jobs[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if !job.State.Done() {
+		return fmt.Errorf("job %s is %s", id, job.State)
+	}
+	e.removeLocked(id)
+	return nil
+}
+
+func (e *Engine) removeLocked(id string) {
+	if cancel, ok := e.cancels[id]; ok {
+		cancel()
+	}
+	delete(e.jobs, id)
+	delete(e.logs, id)
+	delete(e.logSeq, id)
+	delete(e.saved, id)
+	delete(e.contexts, id)
+	delete(e.cancels, id)
+	delete(e.dirty, id)
+	delete(e.pendingLogs, id)
+	if e.dir != "" {
+		e.deleted = append(e.deleted, id)
+	}
+}
+
+// Prune removes finished jobs older than maxAge that match; a nil match
+// matches every job
+func (e *Engine) Prune(maxAge time.Duration, match func(*Job) bool) int {
+	e.mu.Lock()
+	defer e.flush()
+	defer e.mu.Unlock()
+
+	removed := 0
+	for id, job := range e.jobs {
+		if !job.State.Done() || job.FinishedAt == nil || time.Since(*job.FinishedAt) <= maxAge {
+			continue
+		}
+		if match != nil && !match(job) {
+			continue
+		}
+		e.removeLocked(id)
+		removed++
+	}
+	if removed > 0 {
+		e.logger.Info().Int("count", removed).Msg("Pruned old jobs")
+	}
+	return removed
+}
+
+func (e *Engine) pruneLoop() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		e.Prune(e.Retention, nil)
+		select {
+		case <-e.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Log appends an entry to a job's log
+func (e *Engine) Log(id string, entry LogEntry) {
+	e.mu.Lock()
+	defer e.flush()
+	defer e.mu.Unlock()
+
+	if _, ok := e.jobs[id]; !ok {
+		return
+	}
+	e.appendLogLocked(id, entry)
+}
+
+func (e *Engine) appendLogLocked(id string, entry LogEntry) {
+	entry.Seq = e.logSeq[id]
+	e.logSeq[id]++
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	if entry.Level == "" {
+		entry.Level = "info"
+	}
+
+	logs := append(e.logs[id], entry)
+	if len(logs) > memoryLogEntries {
+		logs = logs[len(logs)-memoryLogEntries:]
+	}
+	e.logs[id] = logs
+
+	if e.dir != "" {
+		e.pendingLogs[id] = append(e.pendingLogs[id], entry)
+	}
+	e.publishLocked(Event{Type: "log", JobID: id, Log: &entry})
+}
+
+// Logs returns up to max log entries starting at cursor and the cursor
+// following them
+func (e *Engine) Logs(id string, cursor, max int) ([]LogEntry, int) {
+	e.mu.Lock()
+	memory := append([]LogEntry(nil), e.logs[id]...)
+	e.mu.Unlock()
+
+	out := []LogEntry{}
+	if len(memory) > 0 && memory[0].Seq <= cursor {
+		for _, entry := range memory {
+			if entry.Seq >= cursor && (max <= 0 || len(out) < max) {
+				out = append(out, entry)
+			}
+		}
+	} else if e.dir != "" {
+		// Older entries only live in the log file
+		f, err := os.Open(e.logPath(id))
+		if err != nil {
+			return out, cursor
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var entry LogEntry
+			if json.Unmarshal(scanner.Bytes(), &entry) != nil || entry.Seq < cursor {
+				continue
+			}
+			out = append(out, entry)
+			if max > 0 && len(out) >= max {
+				break
+			}
+		}
+	}
+	if len(out) > 0 {
+		cursor = out[len(out)-1].Seq + 1
+	}
+	return out, cursor
+}
+
+// Subscribe streams the events of one job, or of all jobs when id is
+// empty. Events are dropped for subscribers that fall behind.
+func (e *Engine) Subscribe(id string) (<-chan Event, func()) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	sub := &subscriber{jobID: id, ch: make(chan Event, subscriberBuffer)}
+	key := e.nextSub
+	e.nextSub++
+	e.subs[key] = sub
+
+	return sub.ch, func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if _, ok := e.subs[key]; ok {
+			delete(e.subs, key)
+			close(sub.ch)
+		}
+	}
+}
+
+func (e *Engine) publishLocked(ev Event) {
+	for _, sub := range e.subs {
+		if sub.jobID != "" && sub.jobID != ev.JobID {
+			continue
+		}
+		select {
+		case sub.ch <- ev:
+		default:
+		}
+	}
+}
+
+// Acquire waits until the job may work on the resource
+func (e *Engine) Acquire(ctx context.Context, name string, jobID string) error {
+	for {
+		e.mu.Lock()
+		res := e.resourceLocked(name)
+		if contains(res.holders, jobID) || len(res.holders) < e.limitLocked(name) {
+			if !contains(res.holders, jobID) {
+				res.holders = append(res.holders, jobID)
+			}
+			e.mu.Unlock()
+			return nil
+		}
+		changed := res.changed
+		e.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// TryAcquire takes the resource for the job if it's free; otherwise it
+// returns a job holding it
+func (e *Engine) TryAcquire(name string, jobID string) (string, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	res := e.resourceLocked(name)
+	if contains(res.holders, jobID) {
+		return "", true
+	}
+	if len(res.holders) >= e.limitLocked(name) {
+		return res.holders[0], false
+	}
+	res.holders = append(res.holders, jobID)
+	return "", true
+}
+
+// Release gives the job's hold on the resource back
+func (e *Engine) Release(name string, jobID string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.releaseLocked(name, jobID)
+}
+
+func (e *Engine) releaseLocked(name string, jobID string) {
+	res, ok := e.resources[name]
+	if !ok {
+		return
+	}
+	for i, holder := range res.holders {
+		if holder == jobID {
+			res.holders = append(res.holders[:i], res.holders[i+1:]...)
+			close(res.changed)
+			res.changed = make(chan struct{})
+			break
+		}
+	}
+	if len(res.holders) == 0 {
+		delete(e.resources, name)
+	}
+}
+
+// Holder returns a job holding the resource, if any
+func (e *Engine) Holder(name string) string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if res, ok := e.resources[name]; ok && len(res.holders) > 0 {
+		return res.holders[0]
+	}
+	return ""
+}
+
+func (e *Engine) resourceLocked(name string) *resource {
+	res, ok := e.resources[name]
+	if !ok {
+		res = &resource{changed: make(chan struct{})}
+		e.resources[name] = res
+	}
+	return res
+}
+
+func (e *Engine) limitLocked(name string) int {
+	if n, ok := e.limits[name]; ok && n > 0 {
+		return n
+	}
+	return 1
+}
+
+// Persistence
+
+func (e *Engine) jobPath(id string) string { return filepath.Join(e.dir, id+".json") }
+func (e *Engine) logPath(id string) string { return filepath.Join(e.dir, id+".log") }
+
+// saveLocked marks a job for the next flush
+func (e *Engine) saveLocked(job *Job) {
+	e.saved[job.ID] = time.Now()
+	if e.dir != "" {
+		e.dirty[job.ID] = true
+	}
+}
+
+// flush writes the jobs, log entries and removals queued under mu. It
+// runs after mu is released so disk I/O never holds up other callers.
+func (e *Engine) flush() {
+	if e.dir == "" {
+		return
+	}
+	e.ioMu.Lock()
+	defer e.ioMu.Unlock()
+
+	e.mu.Lock()
+	jobs := make([]*Job, 0, len(e.dirty))
+	for id := range e.dirty {
+		if job, ok := e.jobs[id]; ok {
+			jobs = append(jobs, job.clone())
+		}
+	}
+	logs, deleted := e.pendingLogs, e.deleted
+	e.dirty = make(map[string]bool)
+	e.pendingLogs = make(map[string][]LogEntry)
+	e.deleted = nil
+	e.mu.Unlock()
+
+	for _, job := range jobs {
+		if err := fsatomic.SaveJSON(context.Background(), e.jobPath(job.ID), job, 0o600); err != nil {
+			e.logger.Warn().Err(err).Str("id", job.ID).Msg("Failed to save job")
+		}
+	}
+	for id, entries := range logs {
+		var buf []byte
+		for _, entry := range entries {
+			line, _ := json.Marshal(entry)
+			buf = append(append(buf, line...), '\n')
+		}
+		f, err := os.OpenFile(e.logPath(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err == nil {
+			_, err = f.Write(buf)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}
+		if err != nil {
+			e.logger.Warn().Err(err).Str("id", id).Msg("Failed to write job log")
+		}
+	}
+	for _, id := range deleted {
+		_ = os.Remove(e.jobPath(id))
+		_ = os.Remove(e.logPath(id))
+	}
+}
+
+// load reads the persisted jobs and how many log entries each has
+func (e *Engine) load() (map[string]*Job, map[string]int, error) {
+	loaded := make(map[string]*Job)
+	logSeq := make(map[string]int)
+	if e.dir == "" {
+		return loaded, logSeq, nil
+	}
+	if err := os.MkdirAll(e.dir, 0o750); err != nil {
+		return nil, nil, fmt.Errorf("failed to create jobs directory: %w", err)
+	}
+	paths, err := filepath.Glob(filepath.Join(e.dir, "*.json"))
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, path := range paths {
+		var job Job
+		if ok, err := fsatomic.LoadJSON(path, &job); !ok || err != nil || job.ID == "" {
+			e.logger.Warn().Err(err).Str("path", path).Msg("Skipping unreadable job")
+			continue
+		}
+		loaded[job.ID] = &job
+		logSeq[job.ID] = e.countLogEntries(job.ID)
+	}
+	return loaded, logSeq, nil
+}
+
+func (e *Engine) countLogEntries(id string) int {
+	f, err := os.Open(e.logPath(id))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	var last LogEntry
+	count := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if json.Unmarshal(scanner.Bytes(), &last) == nil {
+			count = last.Seq + 1
+		}
+	}
+	return count
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,199 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func waitState(t *testing.T, e *Engine, id string, want State) *Job {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if job, ok := e.Get(id); ok && job.State == want {
+			return job
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	job, _ := e.Get(id)
+	t.Fatalf("job %s never became %s: %+v", id, want, job)
+	return nil
+}
+
+func TestEngineSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	e := New(zerolog.Nop(), dir)
+	if err := e.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	done, _ := e.Create(&Job{Type: "pool.tx"})
+	e.Log(done.ID, LogEntry{Level: "info", Step: "s1", Message: "created"})
+	e.Finish(done.ID, nil)
+	running, _ := e.Create(&Job{Type: "backup.pull", Resumable: true, Details: map[string]any{"source": "web1"}})
+	_, _ = e.Update(running.ID, func(j *Job) { j.State = StateRunning })
+	e.Log(running.ID, LogEntry{Message: "pulling"})
+	other, _ := e.Create(&Job{Type: "balance"})
+	e.Stop()
+
+	restarted := New(zerolog.Nop(), dir)
+	var resumed []string
+	restarted.OnResume("backup.pull", func(job *Job) (string, error) {
+		resumed = append(resumed, job.Details["source"].(string))
+		next, err := restarted.Create(&Job{Type: job.Type, Resumable: true})
+		if err != nil {
+			return "", err
+		}
+		return next.ID, nil
+	})
+	if err := restarted.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Stop()
+
+	if job, _ := restarted.Get(done.ID); job.State != StateSucceeded || job.Progress != 100 {
+		t.Fatalf("finished job %+v", job)
+	}
+	entries, next := restarted.Logs(done.ID, 0, 0)
+	if len(entries) != 1 || entries[0].Step != "s1" || next != 1 {
+		t.Fatalf("log %+v, cursor %d", entries, next)
+	}
+
+	if job, _ := restarted.Get(other.ID); job.State != StateInterrupted || job.ResumedBy != "" {
+		t.Fatalf("pending job %+v", job)
+	}
+	job, _ := restarted.Get(running.ID)
+	if job.State != StateInterrupted || job.ResumedBy == "" || len(resumed) != 1 || resumed[0] != "web1" {
+		t.Fatalf("running job %+v, resumed %v", job, resumed)
+	}
+	// The log carries on numbering after the restart
+	entries, _ = restarted.Logs(running.ID, 0, 0)
+	if len(entries) != 3 || entries[1].Seq != 1 || entries[1].Message != "Interrupted by restart" {
+		t.Fatalf("log after restart %+v", entries)
+	}
+	if ctx := restarted.Context(running.ID); ctx.Err() == nil {
+		t.Error("interrupted job has a live context")
+	}
+
+	if err := restarted.Remove(done.ID); err != nil {
+		t.Fatal(err)
+	}
+	for _, ext := range []string{".json", ".log"} {
+		if _, err := os.Stat(filepath.Join(dir, done.ID+ext)); !os.IsNotExist(err) {
+			t.Errorf("%s%s left behind: %v", done.ID, ext, err)
+		}
+	}
+}
+
+func TestEngineCancelsChildren(t *testing.T) {
+	e := New(zerolog.Nop(), "")
+	parent, _ := e.Create(&Job{Type: "backup.backup"})
+	child, err := e.Submit(&Job{Type: "backup.replicate", ParentID: parent.ID}, func(ctx context.Context, job *Job) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, e, child.ID, StateRunning)
+	if job, _ := e.Get(parent.ID); len(job.ChildIDs) != 1 || job.ChildIDs[0] != child.ID {
+		t.Fatalf("parent %+v", job)
+	}
+
+	if err := e.Cancel(parent.ID); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, e, child.ID, StateCanceled)
+	if err := e.Context(parent.ID).Err(); !errors.Is(err, context.Canceled) {
+		t.Errorf("parent context: %v", err)
+	}
+	if err := e.Cancel("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("cancel of an unknown job: %v", err)
+	}
+}
+
+func TestEngineResourceLimit(t *testing.T) {
+	e := New(zerolog.Nop(), "")
+	release := make(chan struct{})
+	run := func(ctx context.Context, job *Job) error {
+		<-release
+		return nil
+	}
+
+	first, _ := e.Submit(&Job{Type: "pool.balance", Resource: "pool:/mnt/a"}, run)
+	waitState(t, e, first.ID, StateRunning)
+	second, _ := e.Submit(&Job{Type: "pool.scrub", Resource: "pool:/mnt/a"}, run)
+	other, _ := e.Submit(&Job{Type: "pool.scrub", Resource: "pool:/mnt/b"}, run)
+	waitState(t, e, other.ID, StateRunning)
+
+	time.Sleep(20 * time.Millisecond)
+	if job, _ := e.Get(second.ID); job.State != StatePending {
+		t.Fatalf("second job on the pool is %s", job.State)
+	}
+	if holder, ok := e.TryAcquire("pool:/mnt/a", "handler"); ok || holder != first.ID {
+		t.Fatalf("TryAcquire on a busy pool: %q %v", holder, ok)
+	}
+	entries, _ := e.Logs(second.ID, 0, 0)
+	if len(entries) != 1 || entries[0].Message != "Waiting for pool:/mnt/a (held by job "+first.ID+")" {
+		t.Fatalf("waiting job log %+v", entries)
+	}
+
+	close(release)
+	waitState(t, e, second.ID, StateSucceeded)
+	if holder := e.Holder("pool:/mnt/a"); holder != "" {
+		t.Errorf("pool still held by %s", holder)
+	}
+
+	// A raised limit lets two run together
+	e.SetLimit("pool:/mnt/c", 2)
+	for _, id := range []string{"x", "y"} {
+		if _, ok := e.TryAcquire("pool:/mnt/c", id); !ok {
+			t.Fatalf("%s refused under a limit of 2", id)
+		}
+	}
+	if _, ok := e.TryAcquire("pool:/mnt/c", "z"); ok {
+		t.Fatal("third holder accepted")
+	}
+}
+
+func TestEngineSubscribe(t *testing.T) {
+	e := New(zerolog.Nop(), "")
+	job, _ := e.Create(&Job{Type: "balance"})
+	events, unsubscribe := e.Subscribe(job.ID)
+	defer unsubscribe()
+	other, _ := e.Create(&Job{Type: "scrub"})
+
+	e.Progress(job.ID, 40, "balancing")
+	e.Log(job.ID, LogEntry{Level: "info", Message: "chunk 4 of 10", Fields: map[string]any{"chunk": 4}})
+	e.Log(other.ID, LogEntry{Message: "not mine"})
+	e.Finish(job.ID, errors.New("device gone"))
+
+	var got []Event
+	for len(got) < 3 {
+		select {
+		case ev := <-events:
+			got = append(got, ev)
+		case <-time.After(time.Second):
+			t.Fatalf("events %+v", got)
+		}
+	}
+	if got[0].Type != "job" || got[0].Job.Progress != 40 || got[0].Job.Message != "balancing" {
+		t.Errorf("progress event %+v", got[0])
+	}
+	if got[1].Type != "log" || got[1].Log.Fields["chunk"] != 4 {
+		t.Errorf("log event %+v", got[1])
+	}
+	if got[2].Job.State != StateFailed || got[2].Job.Error != "device gone" || got[2].Job.FinishedAt == nil {
+		t.Errorf("final event %+v", got[2].Job)
+	}
+
+	list := e.List(Filter{Type: "balance"})
+	if len(list) != 1 || list[0].ID != job.ID {
+		t.Fatalf("filtered list %+v", list)
+	}
+}
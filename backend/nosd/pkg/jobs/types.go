@@ -0,0 +1,122 @@
+package jobs
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// State is the lifecycle state of a job
+type State string
+
+const (
+	StatePending     State = "pending"
+	StateRunning     State = "running"
+	StateSucceeded   State = "succeeded"
+	StateFailed      State = "failed"
+	StateCanceled    State = "canceled"
+	StateInterrupted State = "interrupted" // was running when nosd stopped
+)
+
+// Done reports whether the state is final
+func (s State) Done() bool {
+	switch s {
+	case StateSucceeded, StateFailed, StateCanceled, StateInterrupted:
+		return true
+	}
+	return false
+}
+
+// Job is one unit of background work. Type names the subsystem and the
+// operation ("backup.replicate", "pool.tx", "balance"); the subsystem
+// keeps its own typed state in Payload.
+type Job struct {
+	ID       string  `json:"id"`
+	Type     string  `json:"type"`
+	State    State   `json:"state"`
+	Progress float64 `json:"progress"` // 0-100
+	Message  string  `json:"message,omitempty"`
+	Error    string  `json:"error,omitempty"`
+
+	// Resource the job works on, e.g. "pool:/mnt/data"; jobs on the same
+	// resource run one at a time unless the engine allows more
+	Resource string `json:"resource,omitempty"`
+
+	ParentID string   `json:"parent_id,omitempty"`
+	ChildIDs []string `json:"child_ids,omitempty"`
+
+	// A resumable job interrupted by a restart is handed to the resume
+	// function registered for its type, which starts it again as ResumedBy
+	Resumable bool   `json:"resumable,omitempty"`
+	ResumedBy string `json:"resumed_by,omitempty"`
+
+	Details map[string]any  `json:"details,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+// Decode unmarshals the job's payload into v
+func (j *Job) Decode(v any) error {
+	if len(j.Payload) == 0 {
+		return nil
+	}
+	return json.Unmarshal(j.Payload, v)
+}
+
+// SetPayload stores v as the job's payload
+func (j *Job) SetPayload(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	j.Payload = data
+	return nil
+}
+
+func (j *Job) clone() *Job {
+	c := *j
+	c.ChildIDs = append([]string(nil), j.ChildIDs...)
+	if j.Details != nil {
+		c.Details = make(map[string]any, len(j.Details))
+		for k, v := range j.Details {
+			c.Details[k] = v
+		}
+	}
+	c.Payload = append(json.RawMessage(nil), j.Payload...)
+	return &c
+}
+
+// LogEntry is one structured line of a job's log
+type LogEntry struct {
+	Seq     int            `json:"seq"`
+	Time    time.Time      `json:"time"`
+	Level   string         `json:"level"` // "info", "warn", "error"
+	Step    string         `json:"step,omitempty"`
+	Message string         `json:"message"`
+	Fields  map[string]any `json:"fields,omitempty"`
+}
+
+// Event is sent to subscribers when a job changes or logs
+type Event struct {
+	Type string    `json:"type"` // "job" or "log"
+	Job  *Job      `json:"job,omitempty"`
+	Log  *LogEntry `json:"log,omitempty"`
+	// JobID is set on every event, including log events
+	JobID string `json:"job_id"`
+}
+
+// Filter selects jobs in List
+type Filter struct {
+	Type     string // exact type, or a prefix ending in "."
+	State    State
+	ParentID string
+	Resource string
+	Limit    int
+}
+
+// ResumeFunc starts an interrupted job again and returns the ID of the
+// job that carries on its work
+type ResumeFunc func(job *Job) (string, error)
@@ -168,6 +168,28 @@ func (hm *HTTPSManager) TestConfiguration() error {
 	}
 }
 
+// SiteTLS returns the tls directive for a site served next to the main
+// one, such as an app on its own subdomain or port, so it gets its
+// certificate the same way, along with the configured domain
+func (hm *HTTPSManager) SiteTLS() (string, string) {
+	hm.mu.RLock()
+	defer hm.mu.RUnlock()
+
+	config := hm.config
+	if config == nil {
+		config, _ = hm.loadConfig()
+	}
+	switch config.Mode {
+	case HTTPSModeHTTP01:
+		// Caddy gets the certificate on its own
+		return "", config.Domain
+	case HTTPSModeDNS01:
+		return fmt.Sprintf("tls {\n\t\tdns %s\n\t}", config.DNSProvider), config.Domain
+	default:
+		return "tls internal", config.Domain
+	}
+}
+
 // Private methods
 
 func (hm *HTTPSManager) loadConfig() (*HTTPSConfig, error) {
@@ -303,6 +325,9 @@ func (hm *HTTPSManager) generateCaddyConfig(config *HTTPSConfig) (string, error)
 	# Include additional configurations
 	import /etc/caddy/Caddyfile.d/*.caddy
 }
+
+# Apps on their own subdomain or port
+import /etc/caddy/sites.d/*.caddy
 `
 
 	t, err := template.New("caddyfile").Parse(tmpl)
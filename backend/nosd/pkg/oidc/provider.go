@@ -0,0 +1,607 @@
+// Package oidc is the OpenID Connect provider nosd runs for installed
+// apps, so their users sign in with their NithronOS account. It speaks
+// the authorization code flow, with PKCE, to clients registered per app.
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"nithronos/backend/nosd/internal/fsatomic"
+)
+
+const (
+	// CodeTTL is how long an authorization code can be redeemed
+	CodeTTL = time.Minute
+
+	// TokenTTL is the lifetime of access and ID tokens
+	TokenTTL = time.Hour
+
+	clientsFile = "clients.json"
+	keyFile     = "signing-key.pem"
+)
+
+// SupportedScopes are the scopes clients may ask for
+var SupportedScopes = []string{"openid", "profile", "email", "groups"}
+
+// Claims released by each scope besides openid
+var scopeClaims = map[string][]string{
+	"profile": {"preferred_username", "name"},
+	"email":   {"email", "email_verified"},
+	"groups":  {"groups"},
+}
+
+// ErrClientNotFound is returned for unknown client IDs and apps without a
+// client
+var ErrClientNotFound = errors.New("client not found")
+
+// Error is an OAuth 2.0 error, as returned to the client
+type Error struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *Error) Error() string {
+	if e.Description == "" {
+		return e.Code
+	}
+	return e.Code + ": " + e.Description
+}
+
+func oauthError(code, format string, args ...any) *Error {
+	return &Error{Code: code, Description: fmt.Sprintf(format, args...)}
+}
+
+// UserInfoFunc returns the claims about a user, such as
+// preferred_username and groups; scopes decide which are released
+type UserInfoFunc func(userID string) (map[string]any, error)
+
+// Client is an app registered to sign users in
+type Client struct {
+	ID           string    `json:"id"`
+	AppID        string    `json:"app_id"`
+	Name         string    `json:"name"`
+	SecretHash   string    `json:"secret_hash"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	Scopes       []string  `json:"scopes"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// AuthRequest is an authorization request, as the client sent it
+type AuthRequest struct {
+	ClientID            string
+	RedirectURI         string
+	ResponseType        string
+	Scope               string
+	Nonce               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+}
+
+// TokenRequest redeems an authorization code
+type TokenRequest struct {
+	GrantType    string
+	ClientID     string
+	ClientSecret string
+	Code         string
+	RedirectURI  string
+	CodeVerifier string
+}
+
+// TokenResponse is the token endpoint's answer
+type TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	IDToken     string `json:"id_token"`
+	Scope       string `json:"scope"`
+}
+
+// grant is what an authorization code or access token stands for
+type grant struct {
+	clientID    string
+	redirectURI string
+	userID      string
+	scopes      []string
+	nonce       string
+	challenge   string
+	authTime    time.Time
+	expires     time.Time
+}
+
+// Provider keeps the registered clients and the signing key in dir.
+// Codes and access tokens live in memory only; apps sign in again after
+// a restart.
+type Provider struct {
+	dir      string
+	userInfo UserInfoFunc
+
+	mu      sync.Mutex
+	clients map[string]*Client // by client ID
+	key     *rsa.PrivateKey
+	keyID   string
+	codes   map[string]*grant
+	tokens  map[string]*grant
+}
+
+// NewProvider loads the clients registered in dir. The signing key is
+// made on first use.
+func NewProvider(dir string, userInfo UserInfoFunc) (*Provider, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create OIDC directory: %w", err)
+	}
+	p := &Provider{
+		dir:      dir,
+		userInfo: userInfo,
+		clients:  map[string]*Client{},
+		codes:    map[string]*grant{},
+		tokens:   map[string]*grant{},
+	}
+	var clients []*Client
+	if _, err := fsatomic.LoadJSON(filepath.Join(dir, clientsFile), &clients); err != nil {
+		return nil, fmt.Errorf("failed to load OIDC clients: %w", err)
+	}
+	for _, c := range clients {
+		p.clients[c.ID] = c
+	}
+	return p, nil
+}
+
+// RegisterClient registers an app, replacing any client it had, and
+// returns the client ID and secret. The secret is only kept hashed.
+func (p *Provider) RegisterClient(appID, name string, redirectURIs, scopes []string) (string, string, error) {
+	for _, scope := range scopes {
+		if !slices.Contains(SupportedScopes, scope) {
+			return "", "", fmt.Errorf("unsupported scope: %s", scope)
+		}
+	}
+	secret, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for id, c := range p.clients {
+		if c.AppID == appID {
+			delete(p.clients, id)
+		}
+	}
+	c := &Client{
+		ID:           "app-" + appID,
+		AppID:        appID,
+		Name:         name,
+		SecretHash:   hashSecret(secret),
+		RedirectURIs: redirectURIs,
+		Scopes:       scopes,
+		CreatedAt:    time.Now().UTC(),
+	}
+	p.clients[c.ID] = c
+	if err := p.saveLocked(); err != nil {
+		delete(p.clients, c.ID)
+		return "", "", err
+	}
+	return c.ID, secret, nil
+}
+
+// SetRedirectURIs changes where an app's client may be sent back to, as
+// when the app moves to another URL
+func (p *Provider) SetRedirectURIs(appID string, redirectURIs []string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c := p.clientForAppLocked(appID)
+	if c == nil {
+		return ErrClientNotFound
+	}
+	old := c.RedirectURIs
+	c.RedirectURIs = redirectURIs
+	if err := p.saveLocked(); err != nil {
+		c.RedirectURIs = old
+		return err
+	}
+	return nil
+}
+
+// RemoveClient unregisters an app and revokes its tokens
+func (p *Provider) RemoveClient(appID string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c := p.clientForAppLocked(appID)
+	if c == nil {
+		return nil
+	}
+	delete(p.clients, c.ID)
+	for k, g := range p.codes {
+		if g.clientID == c.ID {
+			delete(p.codes, k)
+		}
+	}
+	for k, g := range p.tokens {
+		if g.clientID == c.ID {
+			delete(p.tokens, k)
+		}
+	}
+	return p.saveLocked()
+}
+
+// CheckRedirect tells whether redirectURI is registered for the client.
+// Until it is, errors must be shown to the user rather than redirected.
+func (p *Provider) CheckRedirect(clientID, redirectURI string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c, ok := p.clients[clientID]
+	if !ok {
+		return oauthError("invalid_client", "unknown client")
+	}
+	if !slices.Contains(c.RedirectURIs, redirectURI) {
+		return oauthError("invalid_request", "redirect_uri is not registered")
+	}
+	return nil
+}
+
+// Authorize issues a code for a signed-in user. The redirect URI must
+// have passed CheckRedirect.
+func (p *Provider) Authorize(req AuthRequest, userID string, authTime time.Time) (string, error) {
+	if err := p.CheckRedirect(req.ClientID, req.RedirectURI); err != nil {
+		return "", err
+	}
+	if req.ResponseType != "code" {
+		return "", oauthError("unsupported_response_type", "only the code flow is supported")
+	}
+	switch req.CodeChallengeMethod {
+	case "":
+		if req.CodeChallenge != "" {
+			// RFC 7636 defaults to plain, which we don't take
+			return "", oauthError("invalid_request", "code_challenge_method must be S256")
+		}
+	case "S256":
+		if req.CodeChallenge == "" {
+			return "", oauthError("invalid_request", "code_challenge is missing")
+		}
+	default:
+		return "", oauthError("invalid_request", "code_challenge_method must be S256")
+	}
+
+	code, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c, ok := p.clients[req.ClientID]
+	if !ok {
+		return "", oauthError("invalid_client", "unknown client")
+	}
+	scopes := grantedScopes(req.Scope, c.Scopes)
+	if !slices.Contains(scopes, "openid") {
+		return "", oauthError("invalid_scope", "the openid scope is required")
+	}
+	p.pruneLocked()
+	p.codes[code] = &grant{
+		clientID:    req.ClientID,
+		redirectURI: req.RedirectURI,
+		userID:      userID,
+		scopes:      scopes,
+		nonce:       req.Nonce,
+		challenge:   req.CodeChallenge,
+		authTime:    authTime,
+		expires:     time.Now().Add(CodeTTL),
+	}
+	return code, nil
+}
+
+// Exchange redeems a code for an access token and an ID token issued by
+// issuer. Each code is good once.
+func (p *Provider) Exchange(req TokenRequest, issuer string) (*TokenResponse, error) {
+	if req.GrantType != "authorization_code" {
+		return nil, oauthError("unsupported_grant_type", "only authorization_code is supported")
+	}
+
+	p.mu.Lock()
+	c, ok := p.clients[req.ClientID]
+	if !ok || subtle.ConstantTimeCompare([]byte(c.SecretHash), []byte(hashSecret(req.ClientSecret))) != 1 {
+		p.mu.Unlock()
+		return nil, oauthError("invalid_client", "client authentication failed")
+	}
+	g, ok := p.codes[req.Code]
+	delete(p.codes, req.Code)
+	p.mu.Unlock()
+
+	if !ok || g.clientID != req.ClientID || time.Now().After(g.expires) {
+		return nil, oauthError("invalid_grant", "invalid or expired code")
+	}
+	if g.redirectURI != req.RedirectURI {
+		return nil, oauthError("invalid_grant", "redirect_uri doesn't match")
+	}
+	if g.challenge != "" {
+		sum := sha256.Sum256([]byte(req.CodeVerifier))
+		if base64.RawURLEncoding.EncodeToString(sum[:]) != g.challenge {
+			return nil, oauthError("invalid_grant", "code_verifier doesn't match")
+		}
+	}
+
+	claims, err := p.claims(g)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	claims["iss"] = issuer
+	claims["aud"] = g.clientID
+	claims["azp"] = g.clientID
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(TokenTTL).Unix()
+	claims["auth_time"] = g.authTime.Unix()
+	if g.nonce != "" {
+		claims["nonce"] = g.nonce
+	}
+	idToken, err := p.sign(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	access, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	token := *g
+	token.expires = now.Add(TokenTTL)
+	p.mu.Lock()
+	p.tokens[access] = &token
+	p.mu.Unlock()
+
+	return &TokenResponse{
+		AccessToken: access,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(TokenTTL.Seconds()),
+		IDToken:     idToken,
+		Scope:       strings.Join(g.scopes, " "),
+	}, nil
+}
+
+// UserInfo returns the claims an access token was granted
+func (p *Provider) UserInfo(accessToken string) (map[string]any, error) {
+	p.mu.Lock()
+	g, ok := p.tokens[accessToken]
+	p.mu.Unlock()
+	if !ok || time.Now().After(g.expires) {
+		return nil, oauthError("invalid_token", "invalid or expired access token")
+	}
+	return p.claims(g)
+}
+
+// Discovery is the provider's openid-configuration under issuer
+func (p *Provider) Discovery(issuer string) map[string]any {
+	claims := []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce"}
+	for _, scope := range SupportedScopes {
+		claims = append(claims, scopeClaims[scope]...)
+	}
+	return map[string]any{
+		"issuer":                                issuer,
+		"authorization_endpoint":                issuer + "/authorize",
+		"token_endpoint":                        issuer + "/token",
+		"userinfo_endpoint":                     issuer + "/userinfo",
+		"jwks_uri":                              issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"scopes_supported":                      SupportedScopes,
+		"claims_supported":                      claims,
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	}
+}
+
+// JWKS is the public half of the signing key, as a JSON Web Key Set
+func (p *Provider) JWKS() (map[string]any, error) {
+	key, kid, err := p.signingKey()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{"keys": []map[string]any{{
+		"kty": "RSA",
+		"use": "sig",
+		"alg": "RS256",
+		"kid": kid,
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}}}, nil
+}
+
+// claims are the user's claims released by the grant's scopes
+func (p *Provider) claims(g *grant) (map[string]any, error) {
+	out := map[string]any{"sub": g.userID}
+	if p.userInfo == nil {
+		return out, nil
+	}
+	info, err := p.userInfo(g.userID)
+	if err != nil {
+		return nil, oauthError("invalid_grant", "user not found")
+	}
+	for _, scope := range g.scopes {
+		for _, claim := range scopeClaims[scope] {
+			if v, ok := info[claim]; ok {
+				out[claim] = v
+			}
+		}
+	}
+	return out, nil
+}
+
+// sign makes an RS256 JWT of the claims
+func (p *Provider) sign(claims map[string]any) (string, error) {
+	key, kid, err := p.signingKey()
+	if err != nil {
+		return "", err
+	}
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": kid})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// signingKey loads the signing key, making one the first time. Reading
+// or making the key happens outside p.mu, which token requests share.
+func (p *Provider) signingKey() (*rsa.PrivateKey, string, error) {
+	p.mu.Lock()
+	key, kid := p.key, p.keyID
+	p.mu.Unlock()
+	if key != nil {
+		return key, kid, nil
+	}
+
+	key, err := loadOrCreateKey(filepath.Join(p.dir, keyFile))
+	if err != nil {
+		return nil, "", err
+	}
+	pub, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	sum := sha256.Sum256(pub)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.key == nil {
+		p.key, p.keyID = key, base64.RawURLEncoding.EncodeToString(sum[:12])
+	}
+	return p.key, p.keyID, nil
+}
+
+// loadOrCreateKey reads the key at path, or makes and saves one. A key
+// saved meanwhile by another caller wins over the one made here.
+func loadOrCreateKey(path string) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		key, saveErr := createKey(path)
+		if saveErr == nil {
+			return key, nil
+		}
+		if !os.IsExist(saveErr) {
+			return nil, fmt.Errorf("failed to save OIDC signing key: %w", saveErr)
+		}
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("invalid OIDC signing key")
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OIDC signing key: %w", err)
+	}
+	return key, nil
+}
+
+// createKey makes a key and saves it at path, failing with an error
+// satisfying os.IsExist if a key is there already
+func createKey(path string) (*rsa.PrivateKey, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), keyFile+".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Unlike a rename, a link doesn't replace a key already saved
+	if err := os.Link(tmp.Name(), path); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (p *Provider) clientForAppLocked(appID string) *Client {
+	for _, c := range p.clients {
+		if c.AppID == appID {
+			return c
+		}
+	}
+	return nil
+}
+
+func (p *Provider) saveLocked() error {
+	clients := make([]*Client, 0, len(p.clients))
+	for _, c := range p.clients {
+		clients = append(clients, c)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ID < clients[j].ID })
+	return fsatomic.SaveJSON(context.Background(), filepath.Join(p.dir, clientsFile), clients, 0600)
+}
+
+// pruneLocked drops expired codes and tokens
+func (p *Provider) pruneLocked() {
+	now := time.Now()
+	for k, g := range p.codes {
+		if now.After(g.expires) {
+			delete(p.codes, k)
+		}
+	}
+	for k, g := range p.tokens {
+		if now.After(g.expires) {
+			delete(p.tokens, k)
+		}
+	}
+}
+
+// grantedScopes are the requested scopes the client may have, openid
+// always among them
+func grantedScopes(requested string, allowed []string) []string {
+	var out []string
+	for _, scope := range strings.Fields(requested) {
+		if (scope == "openid" || slices.Contains(allowed, scope)) && !slices.Contains(out, scope) {
+			out = append(out, scope)
+		}
+	}
+	return out
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,230 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const issuer = "https://nas.lan/api/v1/oidc"
+
+func newTestProvider(t *testing.T, dir string) *Provider {
+	t.Helper()
+	p, err := NewProvider(dir, func(uid string) (map[string]any, error) {
+		if uid != "u1" {
+			return nil, errors.New("no such user")
+		}
+		return map[string]any{"preferred_username": "alice", "name": "alice", "groups": []string{"admin"}}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func oauthCode(err error) string {
+	var oe *Error
+	if errors.As(err, &oe) {
+		return oe.Code
+	}
+	return ""
+}
+
+// verifyIDToken checks the token's signature against the JWKS and
+// returns its claims
+func verifyIDToken(t *testing.T, p *Provider, token string) map[string]any {
+	t.Helper()
+	jwks, err := p.JWKS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwk := jwks["keys"].([]map[string]any)[0]
+	n, _ := base64.RawURLEncoding.DecodeString(jwk["n"].(string))
+	e, _ := base64.RawURLEncoding.DecodeString(jwk["e"].(string))
+	pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("malformed token %q", token)
+	}
+	sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig); err != nil {
+		t.Fatalf("signature: %v", err)
+	}
+	var header map[string]string
+	raw, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	if err := json.Unmarshal(raw, &header); err != nil || header["kid"] != jwk["kid"] || header["alg"] != "RS256" {
+		t.Fatalf("header %v", header)
+	}
+	var claims map[string]any
+	raw, _ = base64.RawURLEncoding.DecodeString(parts[1])
+	if err := json.Unmarshal(raw, &claims); err != nil {
+		t.Fatal(err)
+	}
+	return claims
+}
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	dir := t.TempDir()
+	p := newTestProvider(t, dir)
+	redirect := "https://notes.nas.lan/auth/callback"
+	clientID, secret, err := p.RegisterClient("notes", "Notes", []string{redirect}, []string{"profile"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.CheckRedirect(clientID, "https://evil.example/cb"); err == nil {
+		t.Fatal("unregistered redirect_uri accepted")
+	}
+	verifier := "a-long-enough-code-verifier-for-pkce-0123456789"
+	sum := sha256.Sum256([]byte(verifier))
+	req := AuthRequest{
+		ClientID:            clientID,
+		RedirectURI:         redirect,
+		ResponseType:        "code",
+		Scope:               "openid profile groups",
+		Nonce:               "n-1",
+		CodeChallenge:       base64.RawURLEncoding.EncodeToString(sum[:]),
+		CodeChallengeMethod: "S256",
+	}
+	plain := req
+	plain.CodeChallengeMethod = ""
+	if _, err := p.Authorize(plain, "u1", time.Now()); oauthCode(err) != "invalid_request" {
+		t.Fatalf("plain PKCE: %v", err)
+	}
+	noOpenID := req
+	noOpenID.Scope = "profile"
+	if _, err := p.Authorize(noOpenID, "u1", time.Now()); oauthCode(err) != "invalid_scope" {
+		t.Fatalf("without openid: %v", err)
+	}
+
+	code, err := p.Authorize(req, "u1", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchange := TokenRequest{
+		GrantType:    "authorization_code",
+		ClientID:     clientID,
+		ClientSecret: secret,
+		Code:         code,
+		RedirectURI:  redirect,
+		CodeVerifier: "wrong",
+	}
+	if _, err := p.Exchange(exchange, issuer); oauthCode(err) != "invalid_grant" {
+		t.Fatalf("wrong verifier: %v", err)
+	}
+	// The failed attempt used the code up
+	code, _ = p.Authorize(req, "u1", time.Now())
+	exchange.Code, exchange.CodeVerifier = code, verifier
+
+	bad := exchange
+	bad.ClientSecret = "nope"
+	if _, err := p.Exchange(bad, issuer); oauthCode(err) != "invalid_client" {
+		t.Fatalf("wrong secret: %v", err)
+	}
+	resp, err := p.Exchange(exchange, issuer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Exchange(exchange, issuer); oauthCode(err) != "invalid_grant" {
+		t.Fatalf("code redeemed twice: %v", err)
+	}
+
+	// groups wasn't registered for the client, so it isn't granted
+	if resp.Scope != "openid profile" {
+		t.Errorf("scope = %q", resp.Scope)
+	}
+	claims := verifyIDToken(t, p, resp.IDToken)
+	if claims["iss"] != issuer || claims["aud"] != clientID || claims["sub"] != "u1" ||
+		claims["nonce"] != "n-1" || claims["preferred_username"] != "alice" || claims["groups"] != nil {
+		t.Errorf("id token claims %v", claims)
+	}
+	info, err := p.UserInfo(resp.AccessToken)
+	if err != nil || info["sub"] != "u1" || info["name"] != "alice" {
+		t.Fatalf("userinfo %v, %v", info, err)
+	}
+
+	// Clients and the key survive a restart; tokens don't
+	again := newTestProvider(t, dir)
+	if err := again.CheckRedirect(clientID, redirect); err != nil {
+		t.Fatalf("client lost: %v", err)
+	}
+	if claims := verifyIDToken(t, again, resp.IDToken); claims["sub"] != "u1" {
+		t.Fatal("signing key changed")
+	}
+
+	if err := p.RemoveClient("notes"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.UserInfo(resp.AccessToken); oauthCode(err) != "invalid_token" {
+		t.Fatalf("token of removed client: %v", err)
+	}
+}
+
+func TestRegisterClientReplaces(t *testing.T) {
+	p := newTestProvider(t, t.TempDir())
+	if _, _, err := p.RegisterClient("notes", "Notes", []string{"https://a/cb"}, []string{"address"}); err == nil {
+		t.Fatal("unsupported scope accepted")
+	}
+	id, first, err := p.RegisterClient("notes", "Notes", []string{"https://a/cb"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, second, err := p.RegisterClient("notes", "Notes", []string{"https://a/cb"}, nil)
+	if err != nil || first == second {
+		t.Fatalf("secret not rotated: %v", err)
+	}
+	if err := p.SetRedirectURIs("notes", []string{"https://b/cb"}); err != nil {
+		t.Fatal(err)
+	}
+	if p.CheckRedirect(id, "https://a/cb") == nil || p.CheckRedirect(id, "https://b/cb") != nil {
+		t.Fatal("redirect URIs not replaced")
+	}
+	if err := p.SetRedirectURIs("other", nil); !errors.Is(err, ErrClientNotFound) {
+		t.Fatalf("unknown app: %v", err)
+	}
+}
+
+func TestSigningKeyMadeOnce(t *testing.T) {
+	dir := t.TempDir()
+	providers := []*Provider{newTestProvider(t, dir), newTestProvider(t, dir)}
+	kids := make(chan string, 8)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(kids); i++ {
+		wg.Add(1)
+		go func(p *Provider) {
+			defer wg.Done()
+			_, kid, err := p.signingKey()
+			if err != nil {
+				t.Error(err)
+			}
+			kids <- kid
+		}(providers[i%2])
+	}
+	wg.Wait()
+	close(kids)
+	first := <-kids
+	for kid := range kids {
+		if kid != first {
+			t.Fatalf("keys %s and %s", first, kid)
+		}
+	}
+
+	// A restart loads the saved key
+	if _, kid, err := newTestProvider(t, dir).signingKey(); err != nil || kid != first {
+		t.Fatalf("reloaded %s: %v", kid, err)
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(dir, keyFile+".tmp-*")); len(leftovers) > 0 {
+		t.Errorf("temporary keys left: %v", leftovers)
+	}
+}
@@ -0,0 +1,311 @@
+package sync
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// btrfsCommand builds a btrfs invocation; replaced in tests
+var btrfsCommand = func(ctx context.Context, args ...string) *exec.Cmd {
+	return exec.CommandContext(ctx, "btrfs", args...)
+}
+
+// IsBtrfsSubvolume reports whether path is the root of a btrfs subvolume
+// and the btrfs tools are available.
+func IsBtrfsSubvolume(path string) bool {
+	if _, err := exec.LookPath("btrfs"); err != nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return btrfsCommand(ctx, "subvolume", "show", path).Run() == nil
+}
+
+// btrfsGeneration returns the current transid marker of a subvolume. It only
+// moves when something in the subvolume changed, so it is a cheap way to
+// skip snapshotting idle shares.
+func btrfsGeneration(ctx context.Context, path string) (uint64, error) {
+	out, err := btrfsCommand(ctx, "subvolume", "find-new", path, "9999999999").Output()
+	if err != nil {
+		return 0, fmt.Errorf("btrfs find-new failed: %w", err)
+	}
+	const marker = "transid marker was "
+	for _, line := range strings.Split(string(out), "\n") {
+		if i := strings.Index(line, marker); i >= 0 {
+			return strconv.ParseUint(strings.TrimSpace(line[i+len(marker):]), 10, 64)
+		}
+	}
+	return 0, fmt.Errorf("unexpected btrfs find-new output")
+}
+
+// btrfsWatcher detects changes in a share that is a btrfs subvolume by
+// periodically taking a read-only snapshot and diffing it against the
+// previous one with `btrfs send --no-data`. Unlike inotify this needs no
+// per-directory watches and sees renames as renames.
+type btrfsWatcher struct {
+	mgr       *JournalManager
+	shareID   string
+	sharePath string
+	snapDir   string
+
+	mu         sync.Mutex
+	current    string // path of the latest snapshot
+	generation uint64
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newBtrfsWatcher(m *JournalManager, shareID, sharePath string) (*btrfsWatcher, error) {
+	snapDir := m.config.SnapshotDir
+	if snapDir == "" {
+		snapDir = filepath.Join(filepath.Dir(filepath.Clean(sharePath)), ".snapshots", "nos-sync")
+	}
+	w := &btrfsWatcher{
+		mgr:       m,
+		shareID:   shareID,
+		sharePath: sharePath,
+		snapDir:   filepath.Join(snapDir, shareID),
+		done:      make(chan struct{}),
+	}
+	if err := os.MkdirAll(w.snapDir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create snapshot directory: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// Snapshots left from a previous run are stale; the reconcile that
+	// follows covers anything that happened while nosd was down.
+	w.removeStale(ctx)
+
+	gen, err := btrfsGeneration(ctx, sharePath)
+	if err != nil {
+		return nil, err
+	}
+	snap, err := w.snapshot(ctx, gen)
+	if err != nil {
+		return nil, err
+	}
+	w.current, w.generation = snap, gen
+
+	w.wg.Add(1)
+	go w.run()
+	return w, nil
+}
+
+func (w *btrfsWatcher) run() {
+	defer w.wg.Done()
+	interval := w.mgr.config.BtrfsPollInterval
+	delay := interval
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	failing := false
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-timer.C:
+		}
+		err := w.poll()
+		if err == nil {
+			if failing {
+				w.mgr.logger.Info().Str("share_id", w.shareID).Msg("Btrfs change detection recovered")
+				failing = false
+			}
+		} else {
+			// Each failure falls back to a reconcile, which walks the whole
+			// share, so retries back off
+			if !failing {
+				w.mgr.logger.Warn().Err(err).Str("share_id", w.shareID).
+					Msg("Btrfs change detection failed, reconciling until it recovers")
+				failing = true
+			}
+			if err := w.mgr.Reconcile(w.shareID, w.sharePath); err != nil {
+				w.mgr.logger.Warn().Err(err).Str("share_id", w.shareID).Msg("Reconcile failed")
+			}
+		}
+		delay = nextBtrfsPoll(delay, interval, err != nil)
+		timer.Reset(delay)
+	}
+}
+
+// maxBtrfsPollBackoff caps how long a failing share waits between polls
+const maxBtrfsPollBackoff = 30 * time.Minute
+
+// nextBtrfsPoll returns the delay before the next poll: the interval after
+// a success, and twice the last delay after a failure
+func nextBtrfsPoll(last, interval time.Duration, failed bool) time.Duration {
+	if !failed {
+		return interval
+	}
+	return min(2*last, max(interval, maxBtrfsPollBackoff))
+}
+
+// poll snapshots the share if it changed and journals the difference
+func (w *btrfsWatcher) poll() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	go func() {
+		select {
+		case <-w.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	gen, err := btrfsGeneration(ctx, w.sharePath)
+	if err != nil {
+		return err
+	}
+	if gen == w.generation {
+		return nil
+	}
+
+	next, err := w.snapshot(ctx, gen)
+	if err != nil {
+		return err
+	}
+	changes, err := w.diff(ctx, w.current, next)
+	if err != nil {
+		w.deleteSnapshot(next)
+		return err
+	}
+
+	if len(changes) > 0 {
+		changes, err = w.expandRenames(changes)
+		if err == nil {
+			err = w.mgr.Record(w.shareID, w.sharePath, "", changes...)
+		}
+		if err != nil {
+			w.deleteSnapshot(next)
+			return err
+		}
+	}
+
+	w.deleteSnapshot(w.current)
+	w.current, w.generation = next, gen
+	return nil
+}
+
+// snapshot creates a read-only snapshot of the share for generation gen
+func (w *btrfsWatcher) snapshot(ctx context.Context, gen uint64) (string, error) {
+	path := filepath.Join(w.snapDir, strconv.FormatUint(gen, 10))
+	if _, err := os.Stat(path); err == nil {
+		w.deleteSnapshot(path)
+	}
+	if out, err := btrfsCommand(ctx, "subvolume", "snapshot", "-r", w.sharePath, path).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("btrfs snapshot failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return path, nil
+}
+
+// diff streams the metadata-only delta between two snapshots
+func (w *btrfsWatcher) diff(ctx context.Context, parent, snap string) ([]FileChange, error) {
+	cmd := btrfsCommand(ctx, "send", "--no-data", "-q", "-p", parent, snap)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("btrfs send failed: %w", err)
+	}
+
+	changes, parseErr := ParseSendStreamChanges(bufio.NewReader(stdout), func(p string) (FileChange, bool) {
+		c, ok := w.mgr.tracker.Describe(snap, p)
+		if !ok || c.Type == ChangeTypeDelete {
+			return FileChange{}, false
+		}
+		return c, true
+	})
+	if parseErr != nil {
+		// Drain so the child does not block on a full pipe
+		_, _ = io.Copy(io.Discard, stdout)
+	}
+	if err := cmd.Wait(); err != nil {
+		return nil, fmt.Errorf("btrfs send failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if parseErr != nil {
+		return nil, parseErr
+	}
+
+	// Deletes of excluded paths are never in the journal and are dropped by
+	// it; renames out of or into excluded paths degrade to a delete/create.
+	out := changes[:0]
+	for _, c := range changes {
+		if c.Type == ChangeTypeRename && w.mgr.tracker.isExcludedPath(c.OldPath) {
+			c.Type = ChangeTypeCreate
+			c.OldPath = ""
+		}
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+// expandRenames adds a rename entry for every recorded descendant of a
+// renamed directory, as RecordRename does for WebDAV moves.
+func (w *btrfsWatcher) expandRenames(changes []FileChange) ([]FileChange, error) {
+	j, err := w.mgr.Open(w.shareID, w.sharePath)
+	if err != nil {
+		return nil, err
+	}
+	var out []FileChange
+	for _, c := range changes {
+		out = append(out, c)
+		if c.Type == ChangeTypeRename && c.IsDir {
+			out = append(out, descendantRenames(j, c.OldPath, c.Path)...)
+		}
+	}
+	return out, nil
+}
+
+// removeStale deletes snapshots left behind by an earlier run
+func (w *btrfsWatcher) removeStale(ctx context.Context) {
+	entries, err := os.ReadDir(w.snapDir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			w.deleteSnapshotCtx(ctx, filepath.Join(w.snapDir, e.Name()))
+		}
+	}
+}
+
+func (w *btrfsWatcher) deleteSnapshot(path string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	w.deleteSnapshotCtx(ctx, path)
+}
+
+func (w *btrfsWatcher) deleteSnapshotCtx(ctx context.Context, path string) {
+	if out, err := btrfsCommand(ctx, "subvolume", "delete", path).CombinedOutput(); err != nil {
+		w.mgr.logger.Warn().Err(err).Str("path", path).Str("output", strings.TrimSpace(string(out))).
+			Msg("Failed to delete sync snapshot")
+	}
+}
+
+func (w *btrfsWatcher) stop() {
+	close(w.done)
+	w.wg.Wait()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.current != "" {
+		w.deleteSnapshot(w.current)
+		w.current = ""
+	}
+}
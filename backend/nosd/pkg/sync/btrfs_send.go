@@ -0,0 +1,355 @@
+package sync
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Btrfs send stream constants (see fs/btrfs/send.h in the kernel)
+const (
+	sendStreamMagic = "btrfs-stream\x00"
+
+	sendCmdSubvol       = 1
+	sendCmdSnapshot     = 2
+	sendCmdMkfile       = 3
+	sendCmdMkdir        = 4
+	sendCmdMknod        = 5
+	sendCmdMkfifo       = 6
+	sendCmdMksock       = 7
+	sendCmdSymlink      = 8
+	sendCmdRename       = 9
+	sendCmdLink         = 10
+	sendCmdUnlink       = 11
+	sendCmdRmdir        = 12
+	sendCmdWrite        = 15
+	sendCmdClone        = 16
+	sendCmdTruncate     = 17
+	sendCmdChmod        = 18
+	sendCmdChown        = 19
+	sendCmdUtimes       = 20
+	sendCmdEnd          = 21
+	sendCmdUpdateExtent = 22
+	sendCmdFallocate    = 23
+	sendCmdEncodedWrite = 25
+
+	sendAttrPath     = 15
+	sendAttrPathTo   = 16
+	sendAttrPathLink = 17
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// sendStreamCRC is the checksum send streams carry: the kernel's
+// crc32c(0, ...), seeded with 0 and without the final inversion that
+// crc32.Checksum applies
+func sendStreamCRC(p []byte) uint32 {
+	return ^crc32.Update(^uint32(0), crc32c, p)
+}
+
+// sendCommand is one decoded command from a send stream
+type sendCommand struct {
+	cmd   uint16
+	attrs map[uint16][]byte
+}
+
+func (c sendCommand) path(attr uint16) string {
+	return string(c.attrs[attr])
+}
+
+// readSendStream decodes a btrfs send stream and calls fn for each command
+func readSendStream(r io.Reader, fn func(sendCommand) error) error {
+	br := bufio.NewReaderSize(r, 256*1024)
+
+	hdr := make([]byte, len(sendStreamMagic)+4)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return fmt.Errorf("failed to read send stream header: %w", err)
+	}
+	if string(hdr[:len(sendStreamMagic)]) != sendStreamMagic {
+		return fmt.Errorf("not a btrfs send stream")
+	}
+	if v := binary.LittleEndian.Uint32(hdr[len(sendStreamMagic):]); v < 1 || v > 3 {
+		return fmt.Errorf("unsupported send stream version %d", v)
+	}
+
+	cmdHdr := make([]byte, 10)
+	for {
+		if _, err := io.ReadFull(br, cmdHdr); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("truncated send stream: %w", err)
+		}
+		length := binary.LittleEndian.Uint32(cmdHdr[0:4])
+		cmd := binary.LittleEndian.Uint16(cmdHdr[4:6])
+		crc := binary.LittleEndian.Uint32(cmdHdr[6:10])
+
+		body := make([]byte, length)
+		if _, err := io.ReadFull(br, body); err != nil {
+			return fmt.Errorf("truncated send stream: %w", err)
+		}
+
+		// The checksum covers the header (with a zeroed crc field) and body
+		check := make([]byte, 0, 10+len(body))
+		check = append(check, cmdHdr[:6]...)
+		check = append(check, 0, 0, 0, 0)
+		check = append(check, body...)
+		if sendStreamCRC(check) != crc {
+			return fmt.Errorf("send stream checksum mismatch")
+		}
+
+		c := sendCommand{cmd: cmd, attrs: make(map[uint16][]byte)}
+		for len(body) >= 4 {
+			typ := binary.LittleEndian.Uint16(body[0:2])
+			l := int(binary.LittleEndian.Uint16(body[2:4]))
+			if 4+l > len(body) {
+				// Encoded/v2 data payloads run to the end of the command
+				l = len(body) - 4
+			}
+			c.attrs[typ] = body[4 : 4+l]
+			body = body[4+l:]
+		}
+
+		if cmd == sendCmdEnd {
+			if err := fn(c); err != nil {
+				return err
+			}
+			// Multiple streams may be concatenated; keep reading
+			if _, err := br.Peek(1); err != nil {
+				return nil
+			}
+			if b, _ := br.Peek(len(sendStreamMagic)); bytes.Equal(b, []byte(sendStreamMagic)) {
+				if _, err := io.ReadFull(br, hdr); err != nil {
+					return fmt.Errorf("failed to read send stream header: %w", err)
+				}
+			}
+			continue
+		}
+		if err := fn(c); err != nil {
+			return err
+		}
+	}
+}
+
+// sendDiff accumulates the effect of an incremental send stream. The stream
+// describes how to turn the parent snapshot into the new one, creating new
+// inodes under temporary orphan names and renaming them into place, so paths
+// are tracked by their origin in the parent snapshot.
+type sendDiff struct {
+	// origin maps a current path to the path it had in the parent snapshot,
+	// or "" for inodes that did not exist there.
+	origin   map[string]string
+	isDir    map[string]bool
+	modified map[string]bool // current path -> content or metadata changed
+	deleted  map[string]bool // parent-snapshot paths that are gone
+}
+
+func newSendDiff() *sendDiff {
+	return &sendDiff{
+		origin:   make(map[string]string),
+		isDir:    make(map[string]bool),
+		modified: make(map[string]bool),
+		deleted:  make(map[string]bool),
+	}
+}
+
+// originOf returns the parent-snapshot path of p and whether p is tracked
+func (d *sendDiff) originOf(p string) (string, bool) {
+	if o, ok := d.origin[p]; ok {
+		return o, true
+	}
+	// A path below a renamed or new directory inherits its origin
+	for dir := path.Dir(p); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if o, ok := d.origin[dir]; ok {
+			if o == "" {
+				return "", true
+			}
+			return o + strings.TrimPrefix(p, dir), false
+		}
+	}
+	return p, false
+}
+
+func (d *sendDiff) apply(c sendCommand) {
+	switch c.cmd {
+	case sendCmdMkfile, sendCmdMkdir, sendCmdMknod, sendCmdMkfifo, sendCmdMksock, sendCmdSymlink:
+		p := c.path(sendAttrPath)
+		d.origin[p] = ""
+		d.isDir[p] = c.cmd == sendCmdMkdir
+		if c.cmd != sendCmdMkdir {
+			d.modified[p] = true
+		}
+
+	case sendCmdLink:
+		p := c.path(sendAttrPath)
+		d.origin[p] = ""
+		d.modified[p] = true
+
+	case sendCmdRename:
+		from, to := c.path(sendAttrPath), c.path(sendAttrPathTo)
+		o, _ := d.originOf(from)
+		d.move(from, to)
+		d.origin[to] = o
+
+	case sendCmdUnlink, sendCmdRmdir:
+		p := c.path(sendAttrPath)
+		if o, _ := d.originOf(p); o != "" {
+			d.deleted[o] = true
+		}
+		d.forget(p)
+
+	case sendCmdWrite, sendCmdClone, sendCmdTruncate, sendCmdUpdateExtent,
+		sendCmdFallocate, sendCmdEncodedWrite:
+		d.modified[c.path(sendAttrPath)] = true
+
+	case sendCmdChmod, sendCmdChown, sendCmdUtimes:
+		// Directory timestamps change with every child; only files count
+		p := c.path(sendAttrPath)
+		if p != "" && c.cmd != sendCmdUtimes {
+			d.modified[p] = true
+		}
+	}
+}
+
+// move re-keys from and everything tracked below it to to
+func (d *sendDiff) move(from, to string) {
+	rekey := func(m map[string]bool) {
+		for p, v := range m {
+			if p == from || strings.HasPrefix(p, from+"/") {
+				delete(m, p)
+				m[to+strings.TrimPrefix(p, from)] = v
+			}
+		}
+	}
+	for p, o := range d.origin {
+		if p == from || strings.HasPrefix(p, from+"/") {
+			delete(d.origin, p)
+			d.origin[to+strings.TrimPrefix(p, from)] = o
+		}
+	}
+	rekey(d.isDir)
+	rekey(d.modified)
+}
+
+// forget drops a removed path from the tracking maps
+func (d *sendDiff) forget(p string) {
+	delete(d.origin, p)
+	delete(d.isDir, p)
+	delete(d.modified, p)
+}
+
+// isOrphan reports whether p is a temporary name assigned by btrfs send
+// ("o<ino>-<gen>-<n>" at the top level)
+func isOrphan(p string) bool {
+	if strings.Contains(p, "/") || len(p) < 2 || p[0] != 'o' {
+		return false
+	}
+	return strings.Count(p, "-") == 2
+}
+
+// changes converts the accumulated diff into journal changes. Paths are
+// share-relative; stat fills in size, mtime and hash for a path in the new
+// snapshot and reports false if the path should be skipped.
+func (d *sendDiff) changes(stat func(p string) (FileChange, bool)) []FileChange {
+	var out []FileChange
+
+	renamed := make(map[string]bool)
+	for p, o := range d.origin {
+		if isOrphan(p) {
+			continue
+		}
+		c, ok := stat(p)
+		if !ok {
+			continue
+		}
+		switch {
+		case o == "":
+			c.Type = ChangeTypeCreate
+		case o != p:
+			c.Type = ChangeTypeRename
+			c.OldPath = o
+			renamed[p] = true
+			// A rename over an existing path replaced it
+			delete(d.deleted, p)
+		default:
+			continue
+		}
+		out = append(out, c)
+	}
+
+	for p := range d.modified {
+		if isOrphan(p) {
+			continue
+		}
+		if o, ok := d.origin[p]; ok && (o == "" || renamed[p]) {
+			// Already reported as a create or rename with current metadata
+			continue
+		}
+		c, ok := stat(p)
+		if !ok || c.IsDir {
+			continue
+		}
+		c.Type = ChangeTypeModify
+		out = append(out, c)
+	}
+
+	for o := range d.deleted {
+		if _, stillThere := d.origin[o]; stillThere {
+			continue
+		}
+		out = append(out, FileChange{Path: o, Type: ChangeTypeDelete})
+	}
+
+	// Creates and renames parents-first, then modifications, deletions
+	// deepest-first so directories empty before they go.
+	rank := func(t FileChangeType) int {
+		switch t {
+		case ChangeTypeCreate, ChangeTypeRename:
+			return 0
+		case ChangeTypeModify:
+			return 1
+		default:
+			return 2
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		ri, rj := rank(out[i].Type), rank(out[j].Type)
+		if ri != rj {
+			return ri < rj
+		}
+		di, dj := strings.Count(out[i].Path, "/"), strings.Count(out[j].Path, "/")
+		if di != dj {
+			if ri == 2 {
+				return di > dj
+			}
+			return di < dj
+		}
+		return out[i].Path < out[j].Path
+	})
+	return out
+}
+
+// ParseSendStreamChanges decodes an incremental `btrfs send --no-data` stream
+// into file changes. stat is called for every surviving path with its
+// share-relative name and should return its current metadata.
+func ParseSendStreamChanges(r io.Reader, stat func(p string) (FileChange, bool)) ([]FileChange, error) {
+	d := newSendDiff()
+	err := readSendStream(r, func(c sendCommand) error {
+		if c.cmd == sendCmdSubvol {
+			return fmt.Errorf("send stream is not incremental")
+		}
+		d.apply(c)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return d.changes(stat), nil
+}
@@ -0,0 +1,197 @@
+package sync
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"testing"
+	"time"
+)
+
+// sendStreamBuilder writes a synthetic btrfs send stream
+type sendStreamBuilder struct {
+	buf bytes.Buffer
+}
+
+func newSendStreamBuilder() *sendStreamBuilder {
+	b := &sendStreamBuilder{}
+	b.buf.WriteString(sendStreamMagic)
+	binary.Write(&b.buf, binary.LittleEndian, uint32(1))
+	return b
+}
+
+// kernelCRC32c is the kernel's bitwise crc32c, kept apart from the table
+// based one the parser uses
+func kernelCRC32c(crc uint32, p []byte) uint32 {
+	for _, b := range p {
+		crc ^= uint32(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0x82f63b78
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+func (b *sendStreamBuilder) cmd(cmd uint16, attrs ...interface{}) *sendStreamBuilder {
+	var body bytes.Buffer
+	for i := 0; i+1 < len(attrs); i += 2 {
+		val := []byte(attrs[i+1].(string))
+		binary.Write(&body, binary.LittleEndian, uint16(attrs[i].(int)))
+		binary.Write(&body, binary.LittleEndian, uint16(len(val)))
+		body.Write(val)
+	}
+	hdr := make([]byte, 10)
+	binary.LittleEndian.PutUint32(hdr[0:4], uint32(body.Len()))
+	binary.LittleEndian.PutUint16(hdr[4:6], cmd)
+	crc := kernelCRC32c(0, append(append([]byte{}, hdr...), body.Bytes()...))
+	binary.LittleEndian.PutUint32(hdr[6:10], crc)
+	b.buf.Write(hdr)
+	b.buf.Write(body.Bytes())
+	return b
+}
+
+func TestParseSendStreamChanges(t *testing.T) {
+	stream := newSendStreamBuilder().
+		cmd(sendCmdSnapshot, sendAttrPath, "cur").
+		// New file created under an orphan name and moved into place
+		cmd(sendCmdMkfile, sendAttrPath, "o257-12-0").
+		cmd(sendCmdRename, sendAttrPath, "o257-12-0", sendAttrPathTo, "new.txt").
+		cmd(sendCmdWrite, sendAttrPath, "new.txt").
+		cmd(sendCmdRename, sendAttrPath, "old.txt", sendAttrPathTo, "renamed.txt").
+		cmd(sendCmdUnlink, sendAttrPath, "gone.txt").
+		cmd(sendCmdRename, sendAttrPath, "olddir", sendAttrPathTo, "newdir").
+		cmd(sendCmdWrite, sendAttrPath, "newdir/child.txt").
+		cmd(sendCmdUpdateExtent, sendAttrPath, "docs/a.txt").
+		cmd(sendCmdUtimes, sendAttrPath, "docs").
+		cmd(sendCmdEnd).buf
+
+	stat := func(p string) (FileChange, bool) {
+		return FileChange{Path: p, IsDir: p == "newdir" || p == "docs", Hash: "h-" + p}, true
+	}
+	changes, err := ParseSendStreamChanges(&stream, stat)
+	if err != nil {
+		t.Fatalf("ParseSendStreamChanges failed: %v", err)
+	}
+
+	got := make(map[string]FileChange)
+	for _, c := range changes {
+		got[c.Path] = c
+	}
+	expect := map[string]struct {
+		typ     FileChangeType
+		oldPath string
+	}{
+		"new.txt":          {ChangeTypeCreate, ""},
+		"renamed.txt":      {ChangeTypeRename, "old.txt"},
+		"newdir":           {ChangeTypeRename, "olddir"},
+		"newdir/child.txt": {ChangeTypeModify, ""},
+		"docs/a.txt":       {ChangeTypeModify, ""},
+		"gone.txt":         {ChangeTypeDelete, ""},
+	}
+	if len(changes) != len(expect) {
+		t.Fatalf("expected %d changes, got %+v", len(expect), changes)
+	}
+	for p, want := range expect {
+		c, ok := got[p]
+		if !ok {
+			t.Errorf("missing change for %s", p)
+			continue
+		}
+		if c.Type != want.typ || c.OldPath != want.oldPath {
+			t.Errorf("%s: got %s (old %q), want %s (old %q)", p, c.Type, c.OldPath, want.typ, want.oldPath)
+		}
+	}
+	if last := changes[len(changes)-1]; last.Type != ChangeTypeDelete {
+		t.Errorf("deletes should come last, got %+v", last)
+	}
+}
+
+func TestSendStreamCRC(t *testing.T) {
+	// The standard CRC-32C check value is the raw crc seeded and
+	// finished with all ones
+	if got := ^kernelCRC32c(^uint32(0), []byte("123456789")); got != 0xe3069283 {
+		t.Fatalf("check value %#x", got)
+	}
+	for _, p := range [][]byte{nil, []byte("btrfs"), bytes.Repeat([]byte{0xa5}, 1000)} {
+		if got, want := sendStreamCRC(p), kernelCRC32c(0, p); got != want {
+			t.Errorf("crc of %d bytes: %#x, want %#x", len(p), got, want)
+		}
+	}
+}
+
+// testdata/incremental-v1.stream is a version 1 incremental stream laid
+// out the way btrfs send writes one, with uuid, transid, inode, offset,
+// ownership, mode and timestamp attributes the parser has to skip
+func TestParseSendStreamFixture(t *testing.T) {
+	f, err := os.Open("testdata/incremental-v1.stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	changes, err := ParseSendStreamChanges(f, func(p string) (FileChange, bool) {
+		return FileChange{Path: p, IsDir: p == "docs"}, true
+	})
+	if err != nil {
+		t.Fatalf("ParseSendStreamChanges failed: %v", err)
+	}
+	got := make(map[string]FileChange)
+	for _, c := range changes {
+		got[c.Path] = c
+	}
+	expect := map[string]struct {
+		typ     FileChangeType
+		oldPath string
+	}{
+		"docs/new.txt":   {ChangeTypeCreate, ""},
+		"docs/notes.txt": {ChangeTypeRename, "notes.txt"},
+		"old.log":        {ChangeTypeDelete, ""},
+	}
+	if len(changes) != len(expect) {
+		t.Fatalf("expected %d changes, got %+v", len(expect), changes)
+	}
+	for p, want := range expect {
+		if c, ok := got[p]; !ok || c.Type != want.typ || c.OldPath != want.oldPath {
+			t.Errorf("%s: got %+v, want %s (old %q)", p, c, want.typ, want.oldPath)
+		}
+	}
+}
+
+func TestParseSendStreamRejectsCorruptStream(t *testing.T) {
+	b := newSendStreamBuilder().cmd(sendCmdUnlink, sendAttrPath, "a.txt")
+	raw := b.buf.Bytes()
+	raw[len(raw)-1] ^= 0xff
+
+	if _, err := ParseSendStreamChanges(bytes.NewReader(raw), nil); err == nil {
+		t.Error("expected checksum error")
+	}
+	if _, err := ParseSendStreamChanges(bytes.NewReader([]byte("not a stream at all")), nil); err == nil {
+		t.Error("expected header error")
+	}
+
+	full := newSendStreamBuilder().cmd(sendCmdSubvol, sendAttrPath, "cur").cmd(sendCmdEnd).buf
+	if _, err := ParseSendStreamChanges(&full, nil); err == nil {
+		t.Error("expected error for non-incremental stream")
+	}
+}
+
+func TestBtrfsPollBackoff(t *testing.T) {
+	interval := 10 * time.Second
+	delay := interval
+	for i := 0; i < 20; i++ {
+		delay = nextBtrfsPoll(delay, interval, true)
+	}
+	if delay != maxBtrfsPollBackoff {
+		t.Errorf("backoff after repeated failures = %s", delay)
+	}
+	if got := nextBtrfsPoll(interval, interval, true); got != 2*interval {
+		t.Errorf("first backoff = %s", got)
+	}
+	if got := nextBtrfsPoll(delay, interval, false); got != interval {
+		t.Errorf("delay after recovery = %s", got)
+	}
+}
@@ -0,0 +1,158 @@
+package sync
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"math/bits"
+)
+
+// Chunking modes for BlockHashRequest.Mode
+const (
+	ChunkModeFixed = "fixed" // fixed-size blocks (default)
+	ChunkModeCDC   = "cdc"   // content-defined chunks (FastCDC)
+)
+
+// Content-defined chunk sizes. The request's block size is the average chunk
+// size; chunks are between a quarter and four times that.
+const (
+	DefaultChunkAvgSize = 64 * 1024
+	MinChunkAvgSize     = 16 * 1024
+	MaxChunkAvgSize     = 1024 * 1024
+)
+
+// NormalizeChunkAvgSize clamps a requested average chunk size to the allowed
+// range and rounds it down to a power of two
+func NormalizeChunkAvgSize(avg int64) int64 {
+	if avg <= 0 {
+		avg = DefaultChunkAvgSize
+	}
+	if avg < MinChunkAvgSize {
+		avg = MinChunkAvgSize
+	}
+	if avg > MaxChunkAvgSize {
+		avg = MaxChunkAvgSize
+	}
+	return int64(1) << (bits.Len64(uint64(avg)) - 1)
+}
+
+// ChunkBounds returns the minimum and maximum chunk size for an average size
+func ChunkBounds(avg int64) (min, max int64) {
+	return avg / 4, avg * 4
+}
+
+// gearTable maps each byte to a pseudo-random value. It is derived from a
+// fixed seed shared with the sync clients so both sides cut at the same
+// boundaries.
+var gearTable = func() [256]uint64 {
+	var t [256]uint64
+	for i := range t {
+		sum := sha256.Sum256([]byte{'n', 'o', 's', '-', 'g', 'e', 'a', 'r', byte(i)})
+		t[i] = binary.LittleEndian.Uint64(sum[:8])
+	}
+	return t
+}()
+
+// Chunk is one content-defined chunk of a stream
+type Chunk struct {
+	Offset int64
+	Data   []byte // valid until the next call to Next
+}
+
+// Chunker splits a stream into content-defined chunks using FastCDC with
+// normalized chunking
+type Chunker struct {
+	r             io.Reader
+	min, avg, max int
+	maskS, maskL  uint64
+
+	buf    []byte
+	start  int
+	end    int
+	offset int64
+	eof    bool
+}
+
+// NewChunker returns a chunker for the given average chunk size
+func NewChunker(r io.Reader, avg int64) *Chunker {
+	avg = NormalizeChunkAvgSize(avg)
+	min, max := ChunkBounds(avg)
+	b := bits.Len64(uint64(avg)) - 1
+	return &Chunker{
+		r:     r,
+		min:   int(min),
+		avg:   int(avg),
+		max:   int(max),
+		maskS: ^uint64(0) << (64 - (b + 2)),
+		maskL: ^uint64(0) << (64 - (b - 2)),
+		buf:   make([]byte, 2*max),
+	}
+}
+
+// Next returns the next chunk, or io.EOF after the last one
+func (c *Chunker) Next() (Chunk, error) {
+	if err := c.fill(); err != nil {
+		return Chunk{}, err
+	}
+	if c.start == c.end {
+		return Chunk{}, io.EOF
+	}
+	n := c.cut(c.buf[c.start:c.end])
+	chunk := Chunk{Offset: c.offset, Data: c.buf[c.start : c.start+n]}
+	c.start += n
+	c.offset += int64(n)
+	return chunk, nil
+}
+
+// fill tops the buffer up to at least max bytes unless the stream ends first
+func (c *Chunker) fill() error {
+	if c.eof || c.end-c.start >= c.max {
+		return nil
+	}
+	copy(c.buf, c.buf[c.start:c.end])
+	c.end -= c.start
+	c.start = 0
+	for c.end < len(c.buf) && !c.eof {
+		n, err := c.r.Read(c.buf[c.end:])
+		c.end += n
+		if err == io.EOF {
+			c.eof = true
+		} else if err != nil {
+			return err
+		}
+		if c.end >= c.max {
+			break
+		}
+	}
+	return nil
+}
+
+// cut returns the length of the first chunk in data
+func (c *Chunker) cut(data []byte) int {
+	n := len(data)
+	if n <= c.min {
+		return n
+	}
+	if n > c.max {
+		n = c.max
+	}
+	normal := c.avg
+	if normal > n {
+		normal = n
+	}
+	var fp uint64
+	i := c.min
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
@@ -2,9 +2,7 @@ package sync
 
 import (
 	"crypto/sha256"
-	"encoding/base64"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
 	"io"
 	"io/fs"
@@ -26,6 +24,16 @@ type ChangeTracker struct {
 	// Configuration
 	excludePatterns []string
 	maxFileSize     int64
+	decoder         ContentDecoder
+}
+
+// ContentDecoder presents files that are stored transformed on disk, such as
+// shares encrypted at rest, as the content sync clients see
+type ContentDecoder interface {
+	// Size returns the logical size of f, which is diskSize bytes on disk
+	Size(f *os.File, diskSize int64) (int64, error)
+	// Reader returns a reader over the logical content of f
+	Reader(f *os.File, diskSize int64) (io.Reader, error)
 }
 
 // ChangeTrackerConfig holds configuration for the change tracker
@@ -49,6 +57,10 @@ func DefaultChangeTrackerConfig() ChangeTrackerConfig {
 			"*.bak",
 			".sync",
 			".nithronos",
+			".nos-assemble-*", // manifest uploads being assembled
+			".nos-upload-*",   // upload sessions in progress
+			".nos-versions",   // version history
+			".nos-trash",      // deleted files
 		},
 		MaxFileSize: MaxFileSize,
 	}
@@ -63,51 +75,15 @@ func NewChangeTracker(logger zerolog.Logger, config ChangeTrackerConfig) *Change
 	}
 }
 
-// Cursor represents a sync cursor containing the last known state
-type Cursor struct {
-	Timestamp   time.Time `json:"timestamp"`
-	FileHashes  map[string]string `json:"file_hashes"` // path -> hash
-	LastScanned time.Time `json:"last_scanned"`
-}
-
-// EncodeCursor encodes a cursor to a string
-func EncodeCursor(c *Cursor) string {
-	if c == nil {
-		return ""
-	}
-	b, err := json.Marshal(c)
-	if err != nil {
-		return ""
-	}
-	return base64.URLEncoding.EncodeToString(b)
-}
-
-// DecodeCursor decodes a cursor from a string
-func DecodeCursor(s string) (*Cursor, error) {
-	if s == "" {
-		return nil, nil
-	}
-	b, err := base64.URLEncoding.DecodeString(s)
-	if err != nil {
-		return nil, fmt.Errorf("invalid cursor encoding: %w", err)
-	}
-	var c Cursor
-	if err := json.Unmarshal(b, &c); err != nil {
-		return nil, fmt.Errorf("invalid cursor format: %w", err)
-	}
-	return &c, nil
-}
-
-// GetChanges returns file changes since the given cursor
-func (ct *ChangeTracker) GetChanges(sharePath, cursorStr string, limit int) (*ChangesResponse, error) {
+// Reconcile walks sharePath and returns the changes needed to bring known (the
+// last recorded state of each path, keyed by slash-separated relative path) up
+// to date with the filesystem. Files whose size and modification time match
+// the recorded state keep their recorded hash instead of being re-read, so a
+// reconcile of an unchanged share only costs a directory walk.
+func (ct *ChangeTracker) Reconcile(sharePath string, known map[string]FileChange) ([]FileChange, error) {
 	ct.mu.RLock()
 	defer ct.mu.RUnlock()
-	
-	if limit <= 0 || limit > MaxChangesPerRequest {
-		limit = MaxChangesPerRequest
-	}
-	
-	// Validate share path exists
+
 	info, err := os.Stat(sharePath)
 	if err != nil {
 		return nil, fmt.Errorf("share path not accessible: %w", err)
@@ -115,189 +91,208 @@ func (ct *ChangeTracker) GetChanges(sharePath, cursorStr string, limit int) (*Ch
 	if !info.IsDir() {
 		return nil, fmt.Errorf("share path is not a directory")
 	}
-	
-	// Decode cursor
-	cursor, err := DecodeCursor(cursorStr)
-	if err != nil {
-		return nil, err
-	}
-	
-	// If no cursor, return all files
-	if cursor == nil {
-		cursor = &Cursor{
-			Timestamp:  time.Time{},
-			FileHashes: make(map[string]string),
+
+	var changes []FileChange
+	seen := make(map[string]bool, len(known))
+
+	err = filepath.WalkDir(sharePath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			ct.logger.Warn().Err(err).Str("path", path).Msg("Failed to scan path")
+			return nil
 		}
-	}
-	
-	// Scan directory for changes
-	currentFiles := make(map[string]FileMetadata)
-	err = ct.scanDirectory(sharePath, "", currentFiles)
+
+		relPath, err := filepath.Rel(sharePath, path)
+		if err != nil || relPath == "." {
+			return nil
+		}
+		relPath = filepath.ToSlash(relPath)
+
+		if ct.shouldExclude(d.Name(), relPath) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		prev, existed := known[relPath]
+		if d.IsDir() {
+			seen[relPath] = true
+			if !existed || !prev.IsDir {
+				fi, err := d.Info()
+				if err != nil {
+					return nil
+				}
+				changes = append(changes, FileChange{
+					Path:  relPath,
+					Type:  ChangeTypeCreate,
+					MTime: fi.ModTime(),
+					IsDir: true,
+				})
+			}
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil || !fi.Mode().IsRegular() || fi.Size() > ct.maxFileSize {
+			return nil
+		}
+		seen[relPath] = true
+
+		// The logical size costs an open with a content decoder, so plain
+		// files that match on disk size skip it
+		size := fi.Size()
+		unchanged := existed && !prev.IsDir && prev.MTime.Equal(fi.ModTime())
+		if !unchanged || prev.Size != size {
+			size = ct.logicalSize(path, size)
+		}
+		if unchanged && prev.Size == size {
+			return nil
+		}
+
+		hash, err := ct.computeFileHash(path)
+		if err != nil {
+			ct.logger.Warn().Err(err).Str("path", relPath).Msg("Failed to compute file hash")
+			return nil
+		}
+		changeType := ChangeTypeCreate
+		if existed {
+			changeType = ChangeTypeModify
+		}
+		changes = append(changes, FileChange{
+			Path:  relPath,
+			Type:  changeType,
+			Size:  size,
+			MTime: fi.ModTime(),
+			Hash:  hash,
+		})
+		return nil
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to scan directory: %w", err)
 	}
-	
-	// Compute changes
-	changes := ct.computeChanges(cursor.FileHashes, currentFiles)
-	
-	// Sort changes by modification time
-	sort.Slice(changes, func(i, j int) bool {
-		return changes[i].MTime.Before(changes[j].MTime)
+
+	// Anything recorded but no longer on disk was deleted
+	for path, prev := range known {
+		if !seen[path] {
+			changes = append(changes, FileChange{
+				Path:  path,
+				Type:  ChangeTypeDelete,
+				MTime: time.Now(),
+				IsDir: prev.IsDir,
+			})
+		}
+	}
+
+	// Parents before children, deletions last
+	sort.SliceStable(changes, func(i, j int) bool {
+		di, dj := changes[i].Type == ChangeTypeDelete, changes[j].Type == ChangeTypeDelete
+		if di != dj {
+			return !di
+		}
+		return changes[i].Path < changes[j].Path
 	})
-	
-	// Limit results
-	hasMore := len(changes) > limit
-	if hasMore {
-		changes = changes[:limit]
+
+	return changes, nil
+}
+
+// Describe stats a single share-relative path and returns the change that
+// records its current state, or a delete if it no longer exists. The bool
+// result is false when the path is excluded from sync.
+func (ct *ChangeTracker) Describe(sharePath, relPath string) (FileChange, bool) {
+	ct.mu.RLock()
+	defer ct.mu.RUnlock()
+
+	relPath = filepath.ToSlash(filepath.Clean(relPath))
+	if ct.isExcludedLocked(relPath) {
+		return FileChange{}, false
 	}
-	
-	// Create new cursor with current state
-	newFileHashes := make(map[string]string, len(currentFiles))
-	for path, meta := range currentFiles {
-		newFileHashes[path] = meta.Hash
+
+	fullPath := filepath.Join(sharePath, filepath.FromSlash(relPath))
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return FileChange{Path: relPath, Type: ChangeTypeDelete, MTime: time.Now()}, true
 	}
-	newCursor := &Cursor{
-		Timestamp:   time.Now(),
-		FileHashes:  newFileHashes,
-		LastScanned: time.Now(),
+	if info.IsDir() {
+		return FileChange{Path: relPath, Type: ChangeTypeModify, MTime: info.ModTime(), IsDir: true}, true
+	}
+	if !info.Mode().IsRegular() || info.Size() > ct.maxFileSize {
+		return FileChange{}, false
 	}
-	
-	return &ChangesResponse{
-		Changes: changes,
-		Cursor:  EncodeCursor(newCursor),
-		HasMore: hasMore,
-	}, nil
-}
 
-// scanDirectory recursively scans a directory for files
-func (ct *ChangeTracker) scanDirectory(basePath, relativePath string, files map[string]FileMetadata) error {
-	currentPath := basePath
-	if relativePath != "" {
-		currentPath = filepath.Join(basePath, relativePath)
+	change := FileChange{
+		Path:  relPath,
+		Type:  ChangeTypeModify,
+		Size:  ct.logicalSize(fullPath, info.Size()),
+		MTime: info.ModTime(),
 	}
-	
-	entries, err := os.ReadDir(currentPath)
-	if err != nil {
-		return err
+	if hash, err := ct.computeFileHash(fullPath); err == nil {
+		change.Hash = hash
 	}
-	
-	for _, entry := range entries {
-		name := entry.Name()
-		relPath := name
-		if relativePath != "" {
-			relPath = filepath.Join(relativePath, name)
-		}
-		
-		// Check exclusions
-		if ct.shouldExclude(name, relPath) {
-			continue
-		}
-		
-		fullPath := filepath.Join(basePath, relPath)
-		info, err := entry.Info()
-		if err != nil {
-			ct.logger.Warn().Err(err).Str("path", relPath).Msg("Failed to get file info")
-			continue
-		}
-		
-		if entry.IsDir() {
-			// Add directory entry
-			files[relPath] = FileMetadata{
-				Path:  relPath,
-				IsDir: true,
-				MTime: info.ModTime(),
-				Mode:  uint32(info.Mode()),
-			}
-			// Recurse into directory
-			if err := ct.scanDirectory(basePath, relPath, files); err != nil {
-				ct.logger.Warn().Err(err).Str("path", relPath).Msg("Failed to scan subdirectory")
-			}
-		} else if info.Mode().IsRegular() {
-			// Skip files that are too large
-			if info.Size() > ct.maxFileSize {
-				ct.logger.Debug().
-					Str("path", relPath).
-					Int64("size", info.Size()).
-					Int64("max", ct.maxFileSize).
-					Msg("Skipping file (too large)")
-				continue
-			}
-			
-			// Compute file hash
-			hash, err := ct.computeFileHash(fullPath)
-			if err != nil {
-				ct.logger.Warn().Err(err).Str("path", relPath).Msg("Failed to compute file hash")
-				continue
-			}
-			
-			files[relPath] = FileMetadata{
-				Path:  relPath,
-				Size:  info.Size(),
-				MTime: info.ModTime(),
-				Hash:  hash,
-				IsDir: false,
-				Mode:  uint32(info.Mode()),
-			}
+	return change, true
+}
+
+// isExcludedPath reports whether a share-relative path or any of its parents
+// is excluded from sync
+func (ct *ChangeTracker) isExcludedPath(relPath string) bool {
+	ct.mu.RLock()
+	defer ct.mu.RUnlock()
+	return ct.isExcludedLocked(filepath.ToSlash(filepath.Clean(relPath)))
+}
+
+func (ct *ChangeTracker) isExcludedLocked(relPath string) bool {
+	for _, part := range strings.Split(relPath, "/") {
+		if ct.shouldExclude(part, relPath) {
+			return true
 		}
 	}
-	
-	return nil
+	return false
 }
 
-// computeChanges computes the differences between old and new file states
-func (ct *ChangeTracker) computeChanges(oldHashes map[string]string, currentFiles map[string]FileMetadata) []FileChange {
-	var changes []FileChange
-	
-	// Check for new and modified files
-	for path, meta := range currentFiles {
-		oldHash, existed := oldHashes[path]
-		if !existed {
-			// New file
-			changes = append(changes, FileChange{
-				Path:  path,
-				Type:  ChangeTypeCreate,
-				Size:  meta.Size,
-				MTime: meta.MTime,
-				Hash:  meta.Hash,
-				IsDir: meta.IsDir,
-			})
-		} else if oldHash != meta.Hash {
-			// Modified file
-			changes = append(changes, FileChange{
-				Path:  path,
-				Type:  ChangeTypeModify,
-				Size:  meta.Size,
-				MTime: meta.MTime,
-				Hash:  meta.Hash,
-				IsDir: meta.IsDir,
-			})
-		}
+// SetContentDecoder sets the decoder used to size and hash files stored
+// transformed on disk
+func (ct *ChangeTracker) SetContentDecoder(d ContentDecoder) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	ct.decoder = d
+}
+
+// logicalSize returns the size clients see for a file of diskSize bytes
+func (ct *ChangeTracker) logicalSize(path string, diskSize int64) int64 {
+	if ct.decoder == nil {
+		return diskSize
 	}
-	
-	// Check for deleted files
-	for path := range oldHashes {
-		if _, exists := currentFiles[path]; !exists {
-			changes = append(changes, FileChange{
-				Path:  path,
-				Type:  ChangeTypeDelete,
-				MTime: time.Now(),
-			})
-		}
+	f, err := os.Open(path)
+	if err != nil {
+		return diskSize
 	}
-	
-	return changes
+	defer f.Close()
+	if size, err := ct.decoder.Size(f, diskSize); err == nil {
+		return size
+	}
+	return diskSize
 }
 
-// computeFileHash computes the SHA-256 hash of a file
+// computeFileHash computes the SHA-256 hash of a file's logical content
 func (ct *ChangeTracker) computeFileHash(path string) (string, error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return "", err
 	}
 	defer f.Close()
+
+	var r io.Reader = f
+	if ct.decoder != nil {
+		info, err := f.Stat()
+		if err != nil {
+			return "", err
+		}
+		if r, err = ct.decoder.Reader(f, info.Size()); err != nil {
+			return "", err
+		}
+	}
 	
 	h := sha256.New()
-	if _, err := io.Copy(h, f); err != nil {
+	if _, err := io.Copy(h, r); err != nil {
 		return "", err
 	}
 	
@@ -368,7 +363,7 @@ func (ct *ChangeTracker) GetFileMetadata(sharePath, filePath string) (*FileMetad
 	
 	meta := &FileMetadata{
 		Path:  filePath,
-		Size:  info.Size(),
+		Size:  ct.logicalSize(fullPath, info.Size()),
 		MTime: info.ModTime(),
 		IsDir: info.IsDir(),
 		Mode:  uint32(info.Mode()),
@@ -435,7 +430,7 @@ func (ct *ChangeTracker) WalkShare(sharePath string) ([]FileMetadata, error) {
 		}
 		
 		if !d.IsDir() {
-			meta.Size = info.Size()
+			meta.Size = ct.logicalSize(path, info.Size())
 			if info.Size() <= ct.maxFileSize {
 				hash, err := ct.computeFileHash(path)
 				if err == nil {
@@ -0,0 +1,427 @@
+package sync
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"nithronos/backend/nosd/internal/fsatomic"
+)
+
+// DefaultChunkTTL is how long uploaded chunks are kept for manifests that
+// have not been committed yet
+const DefaultChunkTTL = 24 * time.Hour
+
+var (
+	// ErrChunkHashMismatch is returned when uploaded data does not match its hash
+	ErrChunkHashMismatch = errors.New("chunk data does not match its hash")
+	// ErrChunkTooLarge is returned for chunks above the largest chunk size
+	ErrChunkTooLarge = errors.New("chunk is too large")
+)
+
+// ChunkLocation is where a chunk can be read from an existing share file.
+// It is only trusted while the file still has the recorded size and
+// modification time, and the data is verified again when it is used.
+type ChunkLocation struct {
+	ShareID  string    `json:"share_id"`
+	Path     string    `json:"path"`
+	Offset   int64     `json:"offset"`
+	Size     int64     `json:"size"`
+	FileSize int64     `json:"file_size"`
+	ModTime  time.Time `json:"mod_time"`
+}
+
+// chunkBlob is a chunk uploaded by a client
+type chunkBlob struct {
+	Size       int64     `json:"size"`
+	Owners     []string  `json:"owners"` // users that uploaded it
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
+// chunkIndexFile is the on-disk structure of the chunk index
+type chunkIndexFile struct {
+	Version   int                        `json:"version"`
+	Locations map[string][]ChunkLocation `json:"locations"`
+	Blobs     map[string]*chunkBlob      `json:"blobs"`
+}
+
+// ChunkStore lets clients upload each distinct chunk once. It indexes the
+// chunks of share files it has hashed or assembled, and keeps chunks that
+// clients upload until a manifest turns them into a file.
+//
+// Chunks are only offered to users that could read them anyway: a location
+// counts for shares the user can access, an uploaded chunk for the users that
+// uploaded it. Knowing a hash is not enough to obtain the data.
+type ChunkStore struct {
+	dir       string
+	indexPath string
+	ttl       time.Duration
+	shareRoot func(shareID string) (string, bool)
+
+	mu         sync.Mutex
+	locations  map[string][]ChunkLocation // chunk hash -> locations
+	files      map[string][]string        // shareID \x00 path -> chunk hashes
+	blobs      map[string]*chunkBlob
+	lastExpiry time.Time
+}
+
+// NewChunkStore opens the chunk store in dir. shareRoot resolves a share ID to
+// the directory holding its files.
+func NewChunkStore(dir string, shareRoot func(shareID string) (string, bool)) (*ChunkStore, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "blobs"), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create chunk directory: %w", err)
+	}
+	s := &ChunkStore{
+		dir:       dir,
+		indexPath: filepath.Join(dir, "index.json"),
+		ttl:       DefaultChunkTTL,
+		shareRoot: shareRoot,
+		locations: make(map[string][]ChunkLocation),
+		files:     make(map[string][]string),
+		blobs:     make(map[string]*chunkBlob),
+	}
+
+	var f chunkIndexFile
+	ok, err := fsatomic.LoadJSON(s.indexPath, &f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load chunk index: %w", err)
+	}
+	if ok {
+		if f.Blobs != nil {
+			s.blobs = f.Blobs
+		}
+		for hash, locs := range f.Locations {
+			s.locations[hash] = locs
+			for _, loc := range locs {
+				key := fileKey(loc.ShareID, loc.Path)
+				s.files[key] = append(s.files[key], hash)
+			}
+		}
+	}
+	return s, nil
+}
+
+func fileKey(shareID, path string) string {
+	return shareID + "\x00" + path
+}
+
+// blobPath returns where an uploaded chunk is stored
+func (s *ChunkStore) blobPath(hash string) string {
+	return filepath.Join(s.dir, "blobs", hash[:2], hash)
+}
+
+// validChunkHash reports whether h looks like a hex SHA-256
+func validChunkHash(h string) bool {
+	if len(h) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(h)
+	return err == nil
+}
+
+// saveLocked writes the index; s.mu must be held
+func (s *ChunkStore) saveLocked() error {
+	return fsatomic.WithLock(s.indexPath, func() error {
+		return fsatomic.SaveJSON(context.TODO(), s.indexPath, chunkIndexFile{
+			Version:   1,
+			Locations: s.locations,
+			Blobs:     s.blobs,
+		}, 0o600)
+	})
+}
+
+// IndexFile records the chunks of a share file, replacing what was known
+// about that path
+func (s *ChunkStore) IndexFile(shareID, relPath string, info os.FileInfo, blocks []BlockHash) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.dropFileLocked(shareID, relPath)
+	key := fileKey(shareID, relPath)
+	for _, b := range blocks {
+		s.locations[b.Hash] = append(s.locations[b.Hash], ChunkLocation{
+			ShareID:  shareID,
+			Path:     relPath,
+			Offset:   b.Offset,
+			Size:     b.Size,
+			FileSize: info.Size(),
+			ModTime:  info.ModTime(),
+		})
+		s.files[key] = append(s.files[key], b.Hash)
+	}
+	return s.saveLocked()
+}
+
+// ForgetFile drops the indexed chunks of a share file
+func (s *ChunkStore) ForgetFile(shareID, relPath string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.files[fileKey(shareID, relPath)]; !ok {
+		return nil
+	}
+	s.dropFileLocked(shareID, relPath)
+	return s.saveLocked()
+}
+
+func (s *ChunkStore) dropFileLocked(shareID, relPath string) {
+	key := fileKey(shareID, relPath)
+	for _, hash := range s.files[key] {
+		locs := s.locations[hash][:0]
+		for _, loc := range s.locations[hash] {
+			if loc.ShareID != shareID || loc.Path != relPath {
+				locs = append(locs, loc)
+			}
+		}
+		if len(locs) == 0 {
+			delete(s.locations, hash)
+		} else {
+			s.locations[hash] = locs
+		}
+	}
+	delete(s.files, key)
+}
+
+// Missing returns the hashes, in request order and without duplicates, that
+// the user would have to upload
+func (s *ChunkStore) Missing(userID string, canUse func(shareID string) bool, hashes []string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	missing := []string{}
+	seen := make(map[string]bool, len(hashes))
+	for _, h := range hashes {
+		if seen[h] {
+			continue
+		}
+		seen[h] = true
+		if !s.availableLocked(userID, canUse, h) {
+			missing = append(missing, h)
+		}
+	}
+	return missing
+}
+
+// availableLocked reports whether a chunk is available to a user
+func (s *ChunkStore) availableLocked(userID string, canUse func(string) bool, hash string) bool {
+	if blob, ok := s.blobs[hash]; ok && hasOwner(blob, userID) {
+		return true
+	}
+	for _, loc := range s.locations[hash] {
+		if canUse(loc.ShareID) && s.locationCurrent(loc) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasOwner(blob *chunkBlob, userID string) bool {
+	for _, o := range blob.Owners {
+		if o == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// locationCurrent checks that the file behind a location is unchanged
+func (s *ChunkStore) locationCurrent(loc ChunkLocation) bool {
+	root, ok := s.shareRoot(loc.ShareID)
+	if !ok {
+		return false
+	}
+	info, err := os.Stat(filepath.Join(root, loc.Path))
+	return err == nil && info.Size() == loc.FileSize && info.ModTime().Equal(loc.ModTime)
+}
+
+// PutChunk stores a chunk uploaded by a user after checking it against hash
+func (s *ChunkStore) PutChunk(userID, hash string, r io.Reader, maxSize int64) error {
+	if !validChunkHash(hash) {
+		return ErrChunkHashMismatch
+	}
+	s.expire()
+
+	s.mu.Lock()
+	if blob, ok := s.blobs[hash]; ok {
+		if !hasOwner(blob, userID) {
+			// The uploader has just proven it holds the data
+			defer s.mu.Unlock()
+			if err := verifyChunkReader(r, hash, maxSize); err != nil {
+				return err
+			}
+			blob.Owners = append(blob.Owners, userID)
+			return s.saveLocked()
+		}
+		s.mu.Unlock()
+		_, err := io.Copy(io.Discard, io.LimitReader(r, maxSize+1))
+		return err
+	}
+	s.mu.Unlock()
+
+	path := s.blobPath(hash)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), io.LimitReader(r, maxSize+1))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if n > maxSize {
+		return ErrChunkTooLarge
+	}
+	if hex.EncodeToString(h.Sum(nil)) != hash {
+		return ErrChunkHashMismatch
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if blob, ok := s.blobs[hash]; ok {
+		if !hasOwner(blob, userID) {
+			blob.Owners = append(blob.Owners, userID)
+		}
+	} else {
+		s.blobs[hash] = &chunkBlob{Size: n, Owners: []string{userID}, UploadedAt: time.Now().UTC()}
+	}
+	return s.saveLocked()
+}
+
+// verifyChunkReader reads a chunk and checks it against hash
+func verifyChunkReader(r io.Reader, hash string, maxSize int64) error {
+	h := sha256.New()
+	n, err := io.Copy(h, io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return err
+	}
+	if n > maxSize {
+		return ErrChunkTooLarge
+	}
+	if hex.EncodeToString(h.Sum(nil)) != hash {
+		return ErrChunkHashMismatch
+	}
+	return nil
+}
+
+// Assemble writes the file described by chunks to w. If chunks are not
+// available to the user, nothing is written and they are returned.
+func (s *ChunkStore) Assemble(userID string, canUse func(shareID string) bool, chunks []ManifestChunk, w io.Writer) ([]string, error) {
+	hashes := make([]string, len(chunks))
+	for i, c := range chunks {
+		hashes[i] = c.Hash
+	}
+	if missing := s.Missing(userID, canUse, hashes); len(missing) > 0 {
+		return missing, nil
+	}
+
+	for _, c := range chunks {
+		data, err := s.readChunk(userID, canUse, c.Hash)
+		if err != nil {
+			return nil, err
+		}
+		if data == nil {
+			// A source changed since Missing was checked
+			return []string{c.Hash}, nil
+		}
+		if int64(len(data)) != c.Size {
+			return nil, fmt.Errorf("chunk %s is %d bytes, manifest says %d", c.Hash, len(data), c.Size)
+		}
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// readChunk returns a chunk's data from an upload or a share file, verified
+// against its hash, or nil if no source has it any more
+func (s *ChunkStore) readChunk(userID string, canUse func(string) bool, hash string) ([]byte, error) {
+	s.mu.Lock()
+	blob := s.blobs[hash]
+	useBlob := blob != nil && hasOwner(blob, userID)
+	locs := append([]ChunkLocation(nil), s.locations[hash]...)
+	s.mu.Unlock()
+
+	if useBlob {
+		if data, err := os.ReadFile(s.blobPath(hash)); err == nil && chunkMatches(data, hash) {
+			return data, nil
+		}
+	}
+	for _, loc := range locs {
+		if !canUse(loc.ShareID) {
+			continue
+		}
+		root, ok := s.shareRoot(loc.ShareID)
+		if !ok {
+			continue
+		}
+		data, err := readAt(filepath.Join(root, loc.Path), loc.Offset, loc.Size)
+		if err == nil && chunkMatches(data, hash) {
+			return data, nil
+		}
+	}
+	return nil, nil
+}
+
+func chunkMatches(data []byte, hash string) bool {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]) == hash
+}
+
+func readAt(path string, offset, size int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data := make([]byte, size)
+	if _, err := f.ReadAt(data, offset); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// expire removes uploaded chunks older than the TTL, at most once an hour
+func (s *ChunkStore) expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if now.Sub(s.lastExpiry) < time.Hour {
+		return
+	}
+	s.lastExpiry = now
+
+	var expired []string
+	for hash, blob := range s.blobs {
+		if now.Sub(blob.UploadedAt) > s.ttl {
+			expired = append(expired, hash)
+		}
+	}
+	if len(expired) == 0 {
+		return
+	}
+	sort.Strings(expired)
+	for _, hash := range expired {
+		os.Remove(s.blobPath(hash))
+		delete(s.blobs, hash)
+	}
+	_ = s.saveLocked()
+}
@@ -0,0 +1,125 @@
+package sync
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChunkerInsertionKeepsChunks(t *testing.T) {
+	data := make([]byte, 2<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	before, err := ComputeChunkHashesFromReader(bytes.NewReader(data), DefaultChunkAvgSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edited := append(append(append([]byte{}, data[:700000]...), []byte("inserted bytes")...), data[700000:]...)
+	after, err := ComputeChunkHashesFromReader(bytes.NewReader(edited), DefaultChunkAvgSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	known := make(map[string]bool)
+	for _, b := range before.Blocks {
+		known[b.Hash] = true
+		if b.Size > before.MaxSize {
+			t.Fatalf("chunk of %d bytes exceeds max %d", b.Size, before.MaxSize)
+		}
+	}
+	changed := 0
+	for _, b := range after.Blocks {
+		if !known[b.Hash] {
+			changed++
+		}
+	}
+	if changed > 2 {
+		t.Errorf("insertion changed %d of %d chunks, want at most 2", changed, len(after.Blocks))
+	}
+}
+
+func TestChunkStoreAssemble(t *testing.T) {
+	shareDir := t.TempDir()
+	roots := map[string]string{"s1": shareDir}
+	s, err := NewChunkStore(t.TempDir(), func(id string) (string, bool) {
+		root, ok := roots[id]
+		return root, ok
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := func(string) bool { return true }
+	none := func(string) bool { return false }
+
+	// An existing share file provides its chunks once indexed
+	existing := []byte("hello, chunk store")
+	if err := os.WriteFile(filepath.Join(shareDir, "a.txt"), existing, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	info, _ := os.Stat(filepath.Join(shareDir, "a.txt"))
+	h1 := hashOf(existing)
+	if err := s.IndexFile("s1", "a.txt", info, []BlockHash{{Offset: 0, Size: int64(len(existing)), Hash: h1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	uploaded := []byte("new data")
+	h2 := hashOf(uploaded)
+	if got := s.Missing("u1", all, []string{h1, h2, h2}); len(got) != 1 || got[0] != h2 {
+		t.Fatalf("missing = %v, want [%s]", got, h2)
+	}
+	if got := s.Missing("u1", none, []string{h1}); len(got) != 1 {
+		t.Errorf("chunk of an inaccessible share offered: %v", got)
+	}
+
+	if err := s.PutChunk("u1", h2, bytes.NewReader([]byte("other data")), 1024); !errors.Is(err, ErrChunkHashMismatch) {
+		t.Errorf("mismatched chunk accepted: %v", err)
+	}
+	if err := s.PutChunk("u1", h2, bytes.NewReader(uploaded), 4); !errors.Is(err, ErrChunkTooLarge) {
+		t.Errorf("oversized chunk accepted: %v", err)
+	}
+	if err := s.PutChunk("u1", h2, bytes.NewReader(uploaded), 1024); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Missing("u2", all, []string{h2}); len(got) != 1 {
+		t.Errorf("chunk uploaded by another user offered: %v", got)
+	}
+
+	chunks := []ManifestChunk{{Hash: h1, Size: int64(len(existing))}, {Hash: h2, Size: int64(len(uploaded))}}
+	var out bytes.Buffer
+	missing, err := s.Assemble("u1", all, chunks, &out)
+	if err != nil || len(missing) > 0 {
+		t.Fatalf("assemble: missing %v, err %v", missing, err)
+	}
+	if want := string(existing) + string(uploaded); out.String() != want {
+		t.Errorf("assembled %q, want %q", out.String(), want)
+	}
+
+	// A changed source file no longer provides its chunks
+	if err := os.WriteFile(filepath.Join(shareDir, "a.txt"), []byte("rewritten"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	missing, err = s.Assemble("u1", all, chunks, &out)
+	if err != nil || len(missing) != 1 || missing[0] != h1 || out.Len() != 0 {
+		t.Errorf("assemble after change: missing %v, err %v, wrote %d bytes", missing, err, out.Len())
+	}
+
+	// The index survives a restart
+	s2, err := NewChunkStore(s.dir, s.shareRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s2.Missing("u1", all, []string{h2}); len(got) != 0 {
+		t.Errorf("uploaded chunk lost on reload: %v", got)
+	}
+}
+
+func hashOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
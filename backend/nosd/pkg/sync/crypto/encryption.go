@@ -105,6 +105,7 @@ type KeyManager struct {
 	masterKey   []byte
 	deviceKeys  map[string]*KeyPair
 	shareKeys   map[string][]byte
+	keysByID    map[string][]byte // KeyID -> share key, including rotated keys
 	mu          sync.RWMutex
 }
 
@@ -114,6 +115,7 @@ func NewKeyManager(dataDir string) (*KeyManager, error) {
 		dataDir:    dataDir,
 		deviceKeys: make(map[string]*KeyPair),
 		shareKeys:  make(map[string][]byte),
+		keysByID:   make(map[string][]byte),
 	}
 
 	// Create keys directory
@@ -219,7 +221,10 @@ func (km *KeyManager) InitializeMasterKey(password string) error {
 func (km *KeyManager) GenerateShareKey(shareID string) ([]byte, error) {
 	km.mu.Lock()
 	defer km.mu.Unlock()
+	return km.generateShareKeyLocked(shareID)
+}
 
+func (km *KeyManager) generateShareKeyLocked(shareID string) ([]byte, error) {
 	if km.masterKey == nil {
 		return nil, errors.New("master key not initialized")
 	}
@@ -246,10 +251,11 @@ func (km *KeyManager) GenerateShareKey(shareID string) ([]byte, error) {
 		CreatedAt:     time.Now(),
 		Metadata: map[string]string{
 			"share_id": shareID,
+			"key_id":   KeyID(shareKey),
 		},
 	}
 
-	shareKeyPath := filepath.Join(km.dataDir, "keys", fmt.Sprintf("share_%s.key", shareID))
+	shareKeyPath := km.shareKeyPath(shareID, "")
 	data, err := json.Marshal(shareKeyData)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal share key: %w", err)
@@ -260,6 +266,7 @@ func (km *KeyManager) GenerateShareKey(shareID string) ([]byte, error) {
 	}
 
 	km.shareKeys[shareID] = shareKey
+	km.keysByID[KeyID(shareKey)] = shareKey
 	return shareKey, nil
 }
 
@@ -267,7 +274,10 @@ func (km *KeyManager) GenerateShareKey(shareID string) ([]byte, error) {
 func (km *KeyManager) GetShareKey(shareID string) ([]byte, error) {
 	km.mu.Lock()
 	defer km.mu.Unlock()
+	return km.getShareKeyLocked(shareID)
+}
 
+func (km *KeyManager) getShareKeyLocked(shareID string) ([]byte, error) {
 	// Check cache
 	if key, ok := km.shareKeys[shareID]; ok {
 		return key, nil
@@ -278,8 +288,18 @@ func (km *KeyManager) GetShareKey(shareID string) ([]byte, error) {
 	}
 
 	// Load from disk
-	shareKeyPath := filepath.Join(km.dataDir, "keys", fmt.Sprintf("share_%s.key", shareID))
-	data, err := os.ReadFile(shareKeyPath)
+	shareKey, err := km.loadShareKeyLocked(km.shareKeyPath(shareID, ""))
+	if err != nil {
+		return nil, err
+	}
+
+	km.shareKeys[shareID] = shareKey
+	return shareKey, nil
+}
+
+// loadShareKeyLocked reads and unwraps a share key file
+func (km *KeyManager) loadShareKeyLocked(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("share key not found: %w", err)
 	}
@@ -295,10 +315,89 @@ func (km *KeyManager) GetShareKey(shareID string) ([]byte, error) {
 		return nil, fmt.Errorf("failed to decrypt share key: %w", err)
 	}
 
-	km.shareKeys[shareID] = shareKey
+	km.keysByID[KeyID(shareKey)] = shareKey
 	return shareKey, nil
 }
 
+// shareKeyPath returns the key file of a share's current key, or of a
+// rotated key when keyID is set
+func (km *KeyManager) shareKeyPath(shareID, keyID string) string {
+	if keyID == "" {
+		return filepath.Join(km.dataDir, "keys", fmt.Sprintf("share_%s.key", shareID))
+	}
+	return filepath.Join(km.dataDir, "keys", fmt.Sprintf("share_%s.%s.key", shareID, keyID))
+}
+
+// KeyByID returns the share key with the given KeyID, searching rotated keys
+// that have not been retired yet
+func (km *KeyManager) KeyByID(keyID string) ([]byte, error) {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	if key, ok := km.keysByID[keyID]; ok {
+		return key, nil
+	}
+	if km.masterKey == nil {
+		return nil, errors.New("master key not initialized")
+	}
+
+	paths, err := filepath.Glob(filepath.Join(km.dataDir, "keys", "share_*.key"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		if _, err := km.loadShareKeyLocked(path); err != nil {
+			continue
+		}
+		if key, ok := km.keysByID[keyID]; ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("share key %s not found", keyID)
+}
+
+// RotateShareKey replaces a share's key with a new one. The old key stays
+// available through KeyByID until RetireShareKey is called, so files can be
+// re-encrypted in the background. It returns the old key's ID.
+func (km *KeyManager) RotateShareKey(shareID string) (string, error) {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	oldKey, err := km.getShareKeyLocked(shareID)
+	if err != nil {
+		return "", err
+	}
+	oldID := KeyID(oldKey)
+
+	current := km.shareKeyPath(shareID, "")
+	retired := km.shareKeyPath(shareID, oldID)
+	if err := os.Rename(current, retired); err != nil {
+		return "", fmt.Errorf("failed to keep old share key: %w", err)
+	}
+	delete(km.shareKeys, shareID)
+	if _, err := km.generateShareKeyLocked(shareID); err != nil {
+		_ = os.Rename(retired, current)
+		km.shareKeys[shareID] = oldKey
+		return "", err
+	}
+	return oldID, nil
+}
+
+// RetireShareKey deletes a rotated share key once no file uses it anymore
+func (km *KeyManager) RetireShareKey(shareID, keyID string) error {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	if current, ok := km.shareKeys[shareID]; ok && KeyID(current) == keyID {
+		return errors.New("cannot retire the current share key")
+	}
+	if err := os.Remove(km.shareKeyPath(shareID, keyID)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove share key: %w", err)
+	}
+	delete(km.keysByID, keyID)
+	return nil
+}
+
 // GenerateDeviceKeyPair generates a new ECDH key pair for a device
 func (km *KeyManager) GenerateDeviceKeyPair(deviceID string) (*KeyPair, error) {
 	km.mu.Lock()
@@ -0,0 +1,396 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Seekable stream format used for files stored encrypted at rest:
+//
+//	header: magic(8) chunk_size(4) key_id(8) nonce_prefix(16) wrap_nonce(24) wrapped_file_key(48)
+//	chunks: XChaCha20-Poly1305(file_key, nonce_prefix || be64(index), chunk, aad=final flag)
+//
+// Every chunk but the last holds exactly StreamChunkSize plaintext bytes, so
+// any plaintext offset maps to a chunk without reading the file, and the
+// plaintext size follows from the ciphertext size alone. The final flag in
+// each chunk's associated data makes truncation at a chunk boundary fail
+// authentication.
+const (
+	// StreamMagic identifies a file in the seekable encrypted format
+	StreamMagic = "NOSENC02"
+
+	// StreamChunkSize is the plaintext size of each encrypted chunk (64KB)
+	StreamChunkSize = 64 * 1024
+
+	// StreamHeaderSize is the size of the fixed stream header
+	StreamHeaderSize = 108
+
+	streamKeyIDSize   = 8
+	streamPrefixSize  = 16
+	streamTagSize     = chacha20poly1305.Overhead
+	streamSealedChunk = StreamChunkSize + streamTagSize
+	streamPrefixEnd   = 8 + 4 + streamKeyIDSize + streamPrefixSize
+)
+
+var (
+	// ErrNotEncrypted is returned when data is not in the encrypted stream format
+	ErrNotEncrypted = errors.New("not an encrypted stream")
+
+	// ErrCorruptStream is returned when an encrypted stream fails authentication
+	ErrCorruptStream = errors.New("encrypted stream is corrupt or truncated")
+)
+
+// KeyID returns the identifier recorded in stream headers for a share key
+func KeyID(key []byte) string {
+	return hex.EncodeToString(keyIDBytes(key))
+}
+
+func keyIDBytes(key []byte) []byte {
+	sum := sha256.Sum256(key)
+	return sum[:streamKeyIDSize]
+}
+
+// EncryptedSize returns the on-disk size of a plaintext of the given size
+func EncryptedSize(plainSize int64) int64 {
+	chunks := (plainSize + StreamChunkSize - 1) / StreamChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return StreamHeaderSize + plainSize + chunks*streamTagSize
+}
+
+// PlaintextSize returns the plaintext size of an encrypted stream from its
+// on-disk size
+func PlaintextSize(cipherSize int64) (int64, error) {
+	body := cipherSize - StreamHeaderSize
+	if body < streamTagSize {
+		return 0, ErrCorruptStream
+	}
+	full, rem := body/streamSealedChunk, body%streamSealedChunk
+	if rem == 0 {
+		return full * StreamChunkSize, nil
+	}
+	if rem < streamTagSize {
+		return 0, ErrCorruptStream
+	}
+	return full*StreamChunkSize + rem - streamTagSize, nil
+}
+
+// IsEncryptedStream reports whether r starts with an encrypted stream header
+func IsEncryptedStream(r io.ReaderAt) bool {
+	magic := make([]byte, len(StreamMagic))
+	if _, err := r.ReadAt(magic, 0); err != nil {
+		return false
+	}
+	return string(magic) == StreamMagic
+}
+
+// StreamKeyID returns the ID of the share key an encrypted stream was written with
+func StreamKeyID(r io.ReaderAt) (string, error) {
+	hdr, err := readStreamHeader(r)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hdr[12:20]), nil
+}
+
+func readStreamHeader(r io.ReaderAt) ([]byte, error) {
+	hdr := make([]byte, StreamHeaderSize)
+	if _, err := r.ReadAt(hdr, 0); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, ErrNotEncrypted
+		}
+		return nil, err
+	}
+	if string(hdr[:8]) != StreamMagic {
+		return nil, ErrNotEncrypted
+	}
+	if binary.BigEndian.Uint32(hdr[8:12]) != StreamChunkSize {
+		return nil, fmt.Errorf("unsupported chunk size %d", binary.BigEndian.Uint32(hdr[8:12]))
+	}
+	return hdr, nil
+}
+
+// chunkNonce derives the nonce of chunk index from the stream's nonce prefix
+func chunkNonce(prefix []byte, index uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint64(nonce[streamPrefixSize:], index)
+	return nonce
+}
+
+func chunkAAD(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// EncryptWriter encrypts a plaintext stream into the seekable format. Close
+// must be called to write the final chunk; it does not close the underlying
+// writer.
+type EncryptWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	prefix []byte
+	buf    []byte
+	out    []byte
+	index  uint64
+	n      int64
+	closed bool
+	err    error
+}
+
+// NewEncryptWriter writes a stream header for the share's current key to w
+// and returns a writer that encrypts everything written to it
+func (fe *FileEncryptor) NewEncryptWriter(shareID string, w io.Writer) (*EncryptWriter, error) {
+	shareKey, err := fe.keyManager.GetShareKey(shareID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get share key: %w", err)
+	}
+
+	fileKey := make([]byte, KeySize)
+	if _, err := rand.Read(fileKey); err != nil {
+		return nil, fmt.Errorf("failed to generate file key: %w", err)
+	}
+
+	hdr := make([]byte, streamPrefixEnd, StreamHeaderSize)
+	copy(hdr, StreamMagic)
+	binary.BigEndian.PutUint32(hdr[8:12], StreamChunkSize)
+	copy(hdr[12:20], keyIDBytes(shareKey))
+	if _, err := rand.Read(hdr[20:streamPrefixEnd]); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	// Wrap the file key with the share key, binding the header fields
+	wrap, err := chacha20poly1305.NewX(shareKey)
+	if err != nil {
+		return nil, err
+	}
+	wrapNonce := make([]byte, chacha20poly1305.NonceSizeX)
+	if _, err := rand.Read(wrapNonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	hdr = append(hdr, wrapNonce...)
+	hdr = wrap.Seal(hdr, wrapNonce, fileKey, hdr[:streamPrefixEnd])
+
+	aead, err := chacha20poly1305.NewX(fileKey)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(hdr); err != nil {
+		return nil, err
+	}
+
+	return &EncryptWriter{
+		w:      w,
+		aead:   aead,
+		prefix: bytes.Clone(hdr[20:streamPrefixEnd]),
+		buf:    make([]byte, 0, StreamChunkSize),
+		out:    make([]byte, 0, streamSealedChunk),
+	}, nil
+}
+
+// Write encrypts p. A chunk is only sealed once data beyond it arrives, so
+// the last chunk can be marked final on Close.
+func (ew *EncryptWriter) Write(p []byte) (int, error) {
+	if ew.closed {
+		return 0, errors.New("write to closed encrypt writer")
+	}
+	if ew.err != nil {
+		return 0, ew.err
+	}
+	written := 0
+	for len(p) > 0 {
+		if len(ew.buf) == StreamChunkSize {
+			if err := ew.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(ew.buf[len(ew.buf):cap(ew.buf)], p)
+		ew.buf = ew.buf[:len(ew.buf)+n]
+		p = p[n:]
+		written += n
+		ew.n += int64(n)
+	}
+	return written, nil
+}
+
+// Written returns the number of plaintext bytes written so far
+func (ew *EncryptWriter) Written() int64 {
+	return ew.n
+}
+
+// Close seals the final chunk
+func (ew *EncryptWriter) Close() error {
+	if ew.closed {
+		return ew.err
+	}
+	ew.closed = true
+	if ew.err != nil {
+		return ew.err
+	}
+	return ew.seal(true)
+}
+
+func (ew *EncryptWriter) seal(final bool) error {
+	ew.out = ew.aead.Seal(ew.out[:0], chunkNonce(ew.prefix, ew.index), ew.buf, chunkAAD(final))
+	if _, err := ew.w.Write(ew.out); err != nil {
+		ew.err = err
+		return err
+	}
+	ew.index++
+	ew.buf = ew.buf[:0]
+	return nil
+}
+
+// DecryptReader provides random access to the plaintext of an encrypted
+// stream, decrypting one chunk at a time. It is not safe for concurrent use.
+type DecryptReader struct {
+	r      io.ReaderAt
+	aead   cipher.AEAD
+	prefix []byte
+	size   int64
+	chunks int64
+	cipher int64
+	off    int64
+
+	cached int64
+	buf    []byte
+	raw    []byte
+}
+
+// NewDecryptReader opens an encrypted stream of cipherSize bytes read from r.
+// The key is found by the ID in the header, so files written with a share
+// key that has since been rotated remain readable until it is retired.
+func (fe *FileEncryptor) NewDecryptReader(r io.ReaderAt, cipherSize int64) (*DecryptReader, error) {
+	hdr, err := readStreamHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	size, err := PlaintextSize(cipherSize)
+	if err != nil {
+		return nil, err
+	}
+
+	shareKey, err := fe.keyManager.KeyByID(hex.EncodeToString(hdr[12:20]))
+	if err != nil {
+		return nil, err
+	}
+	wrap, err := chacha20poly1305.NewX(shareKey)
+	if err != nil {
+		return nil, err
+	}
+	wrapNonce := hdr[streamPrefixEnd : streamPrefixEnd+chacha20poly1305.NonceSizeX]
+	fileKey, err := wrap.Open(nil, wrapNonce, hdr[streamPrefixEnd+chacha20poly1305.NonceSizeX:], hdr[:streamPrefixEnd])
+	if err != nil {
+		return nil, ErrCorruptStream
+	}
+	aead, err := chacha20poly1305.NewX(fileKey)
+	if err != nil {
+		return nil, err
+	}
+
+	body := cipherSize - StreamHeaderSize
+	return &DecryptReader{
+		r:      r,
+		aead:   aead,
+		prefix: bytes.Clone(hdr[20:streamPrefixEnd]),
+		size:   size,
+		chunks: (body + streamSealedChunk - 1) / streamSealedChunk,
+		cipher: cipherSize,
+		cached: -1,
+		raw:    make([]byte, streamSealedChunk),
+	}, nil
+}
+
+// Size returns the plaintext size
+func (dr *DecryptReader) Size() int64 {
+	return dr.size
+}
+
+// ReadAt reads plaintext at offset off
+func (dr *DecryptReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	n := 0
+	for n < len(p) {
+		if off >= dr.size {
+			return n, io.EOF
+		}
+		index := off / StreamChunkSize
+		if err := dr.load(index); err != nil {
+			return n, err
+		}
+		c := copy(p[n:], dr.buf[off-index*StreamChunkSize:])
+		n += c
+		off += int64(c)
+	}
+	return n, nil
+}
+
+// Read reads plaintext from the current offset
+func (dr *DecryptReader) Read(p []byte) (int, error) {
+	n, err := dr.ReadAt(p, dr.off)
+	dr.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek sets the plaintext offset for the next Read
+func (dr *DecryptReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += dr.off
+	case io.SeekEnd:
+		offset += dr.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	dr.off = offset
+	return offset, nil
+}
+
+// load decrypts chunk index into the cache
+func (dr *DecryptReader) load(index int64) error {
+	if dr.cached == index {
+		return nil
+	}
+	start := StreamHeaderSize + index*streamSealedChunk
+	end := start + streamSealedChunk
+	if end > dr.cipher {
+		end = dr.cipher
+	}
+	raw := dr.raw[:end-start]
+	if n, err := dr.r.ReadAt(raw, start); n < len(raw) {
+		if err == nil || errors.Is(err, io.EOF) {
+			err = ErrCorruptStream
+		}
+		return err
+	}
+	final := index == dr.chunks-1
+	plain, err := dr.aead.Open(dr.buf[:0], chunkNonce(dr.prefix, uint64(index)), raw, chunkAAD(final))
+	if err != nil {
+		dr.cached = -1
+		return ErrCorruptStream
+	}
+	dr.buf = plain
+	dr.cached = index
+	return nil
+}
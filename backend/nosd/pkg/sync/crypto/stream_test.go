@@ -0,0 +1,196 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+func newTestEncryptor(t *testing.T) (*FileEncryptor, *KeyManager) {
+	t.Helper()
+	km, err := NewKeyManager(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := km.InitializeMasterKey("correct horse battery"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := km.GenerateShareKey("s1"); err != nil {
+		t.Fatal(err)
+	}
+	return NewFileEncryptor(km, AlgorithmXChaCha20Poly), km
+}
+
+func encryptBytes(t *testing.T, fe *FileEncryptor, plain []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	ew, err := fe.NewEncryptWriter("s1", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Odd write sizes exercise chunk boundaries
+	for p := plain; len(p) > 0; {
+		n := 7919
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err := ew.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err := ew.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	fe, _ := newTestEncryptor(t)
+
+	for _, size := range []int{0, 1, StreamChunkSize - 1, StreamChunkSize, StreamChunkSize + 1, 3*StreamChunkSize + 123} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+
+		ct := encryptBytes(t, fe, plain)
+		if int64(len(ct)) != EncryptedSize(int64(size)) {
+			t.Errorf("size %d: ciphertext is %d bytes, EncryptedSize says %d", size, len(ct), EncryptedSize(int64(size)))
+		}
+		if got, err := PlaintextSize(int64(len(ct))); err != nil || got != int64(size) {
+			t.Errorf("size %d: PlaintextSize = %d, %v", size, got, err)
+		}
+		if !IsEncryptedStream(bytes.NewReader(ct)) {
+			t.Errorf("size %d: stream not recognised", size)
+		}
+
+		dr, err := fe.NewDecryptReader(bytes.NewReader(ct), int64(len(ct)))
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		got, err := io.ReadAll(dr)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("size %d: round trip mismatch", size)
+		}
+	}
+}
+
+func TestStreamRandomAccess(t *testing.T) {
+	fe, _ := newTestEncryptor(t)
+	plain := make([]byte, 5*StreamChunkSize+777)
+	rand.Read(plain)
+	ct := encryptBytes(t, fe, plain)
+
+	dr, err := fe.NewDecryptReader(bytes.NewReader(ct), int64(len(ct)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A range spanning a chunk boundary, as an HTTP Range request would
+	off := int64(2*StreamChunkSize - 100)
+	if _, err := dr.Seek(off, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 300)
+	if _, err := io.ReadFull(dr, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, plain[off:off+300]) {
+		t.Error("seek+read returned wrong bytes")
+	}
+
+	end, err := dr.Seek(0, io.SeekEnd)
+	if err != nil || end != int64(len(plain)) {
+		t.Errorf("Seek end = %d, %v", end, err)
+	}
+
+	tail := make([]byte, 1000)
+	n, err := dr.ReadAt(tail, int64(len(plain)-500))
+	if n != 500 || err != io.EOF {
+		t.Errorf("ReadAt past end = %d, %v", n, err)
+	}
+	if !bytes.Equal(tail[:n], plain[len(plain)-500:]) {
+		t.Error("ReadAt returned wrong bytes")
+	}
+}
+
+func TestStreamDetectsTampering(t *testing.T) {
+	fe, _ := newTestEncryptor(t)
+	plain := make([]byte, 2*StreamChunkSize+10)
+	rand.Read(plain)
+	ct := encryptBytes(t, fe, plain)
+
+	// Dropping the final chunk leaves a valid-looking size
+	truncated := ct[:StreamHeaderSize+2*streamSealedChunk]
+	dr, err := fe.NewDecryptReader(bytes.NewReader(truncated), int64(len(truncated)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(dr); !errors.Is(err, ErrCorruptStream) {
+		t.Errorf("truncation not detected: %v", err)
+	}
+
+	flipped := bytes.Clone(ct)
+	flipped[StreamHeaderSize+streamSealedChunk+5] ^= 1
+	dr, err = fe.NewDecryptReader(bytes.NewReader(flipped), int64(len(flipped)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dr.ReadAt(make([]byte, 10), StreamChunkSize); !errors.Is(err, ErrCorruptStream) {
+		t.Errorf("bit flip not detected: %v", err)
+	}
+
+	if _, err := fe.NewDecryptReader(bytes.NewReader([]byte("plain text")), 10); !errors.Is(err, ErrNotEncrypted) {
+		t.Errorf("plaintext accepted: %v", err)
+	}
+}
+
+func TestStreamKeyRotation(t *testing.T) {
+	fe, km := newTestEncryptor(t)
+	plain := []byte("written before rotation")
+	ct := encryptBytes(t, fe, plain)
+	oldID, err := StreamKeyID(bytes.NewReader(ct))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotatedID, err := km.RotateShareKey("s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotatedID != oldID {
+		t.Errorf("RotateShareKey returned %s, stream uses %s", rotatedID, oldID)
+	}
+	newCT := encryptBytes(t, fe, plain)
+	if id, _ := StreamKeyID(bytes.NewReader(newCT)); id == oldID {
+		t.Error("new writes still use the old key")
+	}
+
+	// Old files stay readable, also from a fresh key manager, until retired
+	km2, err := NewKeyManager(km.dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := km2.InitializeMasterKey("correct horse battery"); err != nil {
+		t.Fatal(err)
+	}
+	fe2 := NewFileEncryptor(km2, AlgorithmXChaCha20Poly)
+	dr, err := fe2.NewDecryptReader(bytes.NewReader(ct), int64(len(ct)))
+	if err != nil {
+		t.Fatalf("old stream unreadable after rotation: %v", err)
+	}
+	if got, _ := io.ReadAll(dr); !bytes.Equal(got, plain) {
+		t.Error("old stream decrypted wrongly")
+	}
+
+	if err := km2.RetireShareKey("s1", oldID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fe2.NewDecryptReader(bytes.NewReader(ct), int64(len(ct))); err == nil {
+		t.Error("retired key still usable")
+	}
+}
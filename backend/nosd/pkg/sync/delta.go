@@ -92,6 +92,57 @@ func (ds *DeltaSync) ComputeBlockHashes(filePath string) (*BlockHashResponse, er
 		Size:      fileSize,
 		Hash:      fileHash,
 		BlockSize: ds.blockSize,
+		Mode:      ChunkModeFixed,
+		Blocks:    blocks,
+	}, nil
+}
+
+// ComputeChunkHashes splits a file into content-defined chunks of the given
+// average size and hashes them. Unlike fixed blocks, an insertion only
+// changes the chunks around it.
+func (ds *DeltaSync) ComputeChunkHashes(filePath string, avgSize int64) (*BlockHashResponse, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer f.Close()
+	return ComputeChunkHashesFromReader(f, avgSize)
+}
+
+// ComputeChunkHashesFromReader is ComputeChunkHashes for a stream
+func ComputeChunkHashesFromReader(r io.Reader, avgSize int64) (*BlockHashResponse, error) {
+	avgSize = NormalizeChunkAvgSize(avgSize)
+	minSize, maxSize := ChunkBounds(avgSize)
+
+	fullHash := sha256.New()
+	chunker := NewChunker(io.TeeReader(r, fullHash), avgSize)
+	var blocks []BlockHash
+	var size int64
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read chunk: %w", err)
+		}
+		strongHash := sha256.Sum256(chunk.Data)
+		blocks = append(blocks, BlockHash{
+			Offset: chunk.Offset,
+			Size:   int64(len(chunk.Data)),
+			Hash:   hex.EncodeToString(strongHash[:]),
+			Weak:   adler32.Checksum(chunk.Data),
+		})
+		size += int64(len(chunk.Data))
+	}
+
+	return &BlockHashResponse{
+		Size:      size,
+		Hash:      hex.EncodeToString(fullHash.Sum(nil)),
+		BlockSize: avgSize,
+		Mode:      ChunkModeCDC,
+		MinSize:   minSize,
+		MaxSize:   maxSize,
 		Blocks:    blocks,
 	}, nil
 }
@@ -29,6 +29,19 @@ type DeviceManager struct {
 	maxDevicesPerUser int
 	deviceTokenTTL    time.Duration
 	refreshTokenTTL   time.Duration
+	maxDeletes        int
+	deleteWindow      time.Duration
+	
+	// Mass-delete breaker: recent deletes per device
+	deletesMu sync.Mutex
+	deletes   map[string][]deleteMark
+	onPause   func(device *DeviceToken)
+}
+
+// deleteMark is a number of files a device deleted at a time
+type deleteMark struct {
+	at    time.Time
+	files int
 }
 
 // DeviceManagerConfig holds configuration for the device manager
@@ -36,14 +49,26 @@ type DeviceManagerConfig struct {
 	MaxDevicesPerUser int
 	DeviceTokenTTL    time.Duration
 	RefreshTokenTTL   time.Duration
+	// A device deleting more than MaxDeletes files within DeleteWindow is
+	// paused until an admin resumes it (0 = no limit)
+	MaxDeletes   int
+	DeleteWindow time.Duration
 }
 
+// Default mass-delete breaker
+const (
+	DefaultMaxDeletes   = 500
+	DefaultDeleteWindow = 5 * time.Minute
+)
+
 // DefaultDeviceManagerConfig returns the default configuration
 func DefaultDeviceManagerConfig() DeviceManagerConfig {
 	return DeviceManagerConfig{
 		MaxDevicesPerUser: 20,
 		DeviceTokenTTL:    DeviceTokenTTL,
 		RefreshTokenTTL:   RefreshTokenTTL,
+		MaxDeletes:        DefaultMaxDeletes,
+		DeleteWindow:      DefaultDeleteWindow,
 	}
 }
 
@@ -56,6 +81,9 @@ func NewDeviceManager(store *Store, logger zerolog.Logger, config DeviceManagerC
 		maxDevicesPerUser: config.MaxDevicesPerUser,
 		deviceTokenTTL:    config.DeviceTokenTTL,
 		refreshTokenTTL:   config.RefreshTokenTTL,
+		maxDeletes:        config.MaxDeletes,
+		deleteWindow:      config.DeleteWindow,
+		deletes:           make(map[string][]deleteMark),
 	}
 	
 	// Populate token cache from stored devices
@@ -436,6 +464,110 @@ func (dm *DeviceManager) RecordSync(deviceID string, bytesTransferred int64) err
 	return dm.store.UpdateDeviceStats(deviceID, bytesTransferred)
 }
 
+// OnPause registers fn to be called when the breaker pauses a device
+func (dm *DeviceManager) OnPause(fn func(device *DeviceToken)) {
+	dm.deletesMu.Lock()
+	defer dm.deletesMu.Unlock()
+	dm.onPause = fn
+}
+
+// RecordDeletes counts files a device deleted. A device that deletes more
+// than the configured number of files within the window is paused; it
+// reports whether the device is paused now.
+func (dm *DeviceManager) RecordDeletes(deviceID string, files int) bool {
+	if deviceID == "" || dm.maxDeletes <= 0 {
+		return false
+	}
+	now := time.Now()
+	dm.deletesMu.Lock()
+	marks := append(dm.deletes[deviceID], deleteMark{at: now, files: files})
+	total := 0
+	kept := marks[:0]
+	for _, m := range marks {
+		if now.Sub(m.at) <= dm.deleteWindow {
+			kept = append(kept, m)
+			total += m.files
+		}
+	}
+	dm.deletes[deviceID] = kept
+	onPause := dm.onPause
+	dm.deletesMu.Unlock()
+
+	if total <= dm.maxDeletes {
+		return false
+	}
+	device, ok := dm.store.GetDevice(deviceID)
+	if !ok {
+		return false
+	}
+	if device.Paused != nil {
+		return true
+	}
+	device.Paused = &DevicePause{
+		PausedAt:      now.UTC(),
+		Reason:        fmt.Sprintf("deleted %d files within %s", total, dm.deleteWindow),
+		Deletes:       total,
+		WindowSeconds: int(dm.deleteWindow.Seconds()),
+	}
+	if err := dm.store.SaveDevice(device); err != nil {
+		dm.logger.Error().Err(err).Str("device_id", deviceID).Msg("Failed to pause device")
+	}
+	dm.logger.Warn().
+		Str("device_id", deviceID).
+		Str("user_id", device.UserID).
+		Int("deletes", total).
+		Msg("Paused sync device after mass delete")
+	if onPause != nil {
+		onPause(device)
+	}
+	return true
+}
+
+// PauseOf returns why a device is paused, nil if it is not
+func (dm *DeviceManager) PauseOf(deviceID string) *DevicePause {
+	device, ok := dm.store.GetDevice(deviceID)
+	if !ok {
+		return nil
+	}
+	return device.Paused
+}
+
+// PausedDevices returns the devices the breaker paused
+func (dm *DeviceManager) PausedDevices() []*DeviceToken {
+	paused := []*DeviceToken{}
+	for _, d := range dm.store.ListDevices() {
+		if d.Paused != nil {
+			paused = append(paused, d)
+		}
+	}
+	return paused
+}
+
+// ResumeDevice lets a paused device change files again once an admin
+// confirmed its deletes
+func (dm *DeviceManager) ResumeDevice(deviceID string) (*DeviceToken, error) {
+	device, ok := dm.store.GetDevice(deviceID)
+	if !ok || device.RevokedAt != nil {
+		return nil, fmt.Errorf("device not found")
+	}
+	if device.Paused == nil {
+		return nil, fmt.Errorf("device is not paused")
+	}
+	pause := device.Paused
+	device.Paused = nil
+	if err := dm.store.SaveDevice(device); err != nil {
+		return nil, err
+	}
+	dm.deletesMu.Lock()
+	delete(dm.deletes, deviceID)
+	dm.deletesMu.Unlock()
+
+	// Report the pause that was lifted without touching the stored device
+	resumed := *device
+	resumed.Paused = pause
+	return &resumed, nil
+}
+
 // Token generation helpers
 
 func (dm *DeviceManager) generateDeviceToken() string {
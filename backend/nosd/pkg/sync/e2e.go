@@ -0,0 +1,325 @@
+package sync
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"nithronos/backend/nosd/internal/fsatomic"
+)
+
+// End-to-end encrypted shares are encrypted by the sync clients. Each share
+// has a symmetric key that only clients know; the server stores it wrapped
+// (sealed) to the X25519 public key of every device allowed to read the
+// share. Revoking a device drops its wraps and marks its shares for
+// rotation, so the next client that syncs them wraps a fresh key to the
+// remaining devices.
+
+var (
+	// ErrE2EInvalidKey is returned for a malformed device public key
+	ErrE2EInvalidKey = errors.New("invalid X25519 public key")
+	// ErrE2ENotEnrolled is returned when a device has no public key on file
+	ErrE2ENotEnrolled = errors.New("device is not enrolled for end-to-end encryption")
+	// ErrE2ENotKeyHolder is returned when a device changes the keys of a
+	// share whose key it cannot read itself
+	ErrE2ENotKeyHolder = errors.New("device does not hold the share key")
+	// ErrE2EVersionConflict is returned when a key upload is not based on the
+	// share's current key version
+	ErrE2EVersionConflict = errors.New("share key version conflict")
+	// ErrE2EMissingWraps is returned when a new key version is not wrapped
+	// for every device that may read the share
+	ErrE2EMissingWraps = errors.New("new share key must be wrapped for every active device")
+)
+
+// E2EDeviceKey is a device's public key for end-to-end encrypted shares
+type E2EDeviceKey struct {
+	DeviceID    string    `json:"device_id"`
+	UserID      string    `json:"user_id"`
+	PublicKey   []byte    `json:"public_key"` // raw X25519 public key
+	Fingerprint string    `json:"fingerprint"`
+	EnrolledAt  time.Time `json:"enrolled_at"`
+}
+
+// WrappedShareKey is a share key sealed to one device's public key with an
+// ephemeral X25519 key. The server cannot open it.
+type WrappedShareKey struct {
+	EphemeralPublic []byte    `json:"ephemeral_public"`
+	Nonce           []byte    `json:"nonce"`
+	Ciphertext      []byte    `json:"ciphertext"`
+	WrappedBy       string    `json:"wrapped_by,omitempty"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// E2EShareKeys holds every key version of an end-to-end encrypted share
+type E2EShareKeys struct {
+	ShareID         string `json:"share_id"`
+	CurrentVersion  int    `json:"current_version"`
+	RotationPending bool   `json:"rotation_pending"`
+	// Versions maps key version -> device ID -> wrapped key. Old versions are
+	// kept so files written under them stay readable.
+	Versions  map[int]map[string]*WrappedShareKey `json:"versions"`
+	UpdatedAt time.Time                           `json:"updated_at"`
+}
+
+// e2eFile is the on-disk structure of the E2E key store
+type e2eFile struct {
+	Version int                      `json:"version"`
+	Devices map[string]*E2EDeviceKey `json:"devices"`
+	Shares  map[string]*E2EShareKeys `json:"shares"`
+}
+
+// E2EStore persists device public keys and wrapped share keys
+type E2EStore struct {
+	path string
+
+	mu      sync.RWMutex
+	devices map[string]*E2EDeviceKey
+	shares  map[string]*E2EShareKeys
+}
+
+// NewE2EStore opens the E2E key store in basePath
+func NewE2EStore(basePath string) (*E2EStore, error) {
+	s := &E2EStore{
+		path:    filepath.Join(basePath, "e2e_keys.json"),
+		devices: make(map[string]*E2EDeviceKey),
+		shares:  make(map[string]*E2EShareKeys),
+	}
+	var f e2eFile
+	ok, err := fsatomic.LoadJSON(s.path, &f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load e2e keys: %w", err)
+	}
+	if ok {
+		if f.Devices != nil {
+			s.devices = f.Devices
+		}
+		if f.Shares != nil {
+			s.shares = f.Shares
+		}
+	}
+	return s, nil
+}
+
+// saveLocked writes the store to disk; s.mu must be held
+func (s *E2EStore) saveLocked() error {
+	return fsatomic.WithLock(s.path, func() error {
+		return fsatomic.SaveJSON(context.TODO(), s.path, e2eFile{
+			Version: 1,
+			Devices: s.devices,
+			Shares:  s.shares,
+		}, 0o600)
+	})
+}
+
+// KeyFingerprint returns a short, human-comparable fingerprint of a public key
+func KeyFingerprint(publicKey []byte) string {
+	sum := sha256.Sum256(publicKey)
+	return hex.EncodeToString(sum[:8])
+}
+
+// EnrollDevice stores a device's public key. Re-enrolling with a different
+// key drops the device's wraps, which the new key cannot open.
+func (s *E2EStore) EnrollDevice(deviceID, userID string, publicKey []byte) (*E2EDeviceKey, error) {
+	if _, err := ecdh.X25519().NewPublicKey(publicKey); err != nil {
+		return nil, ErrE2EInvalidKey
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.devices[deviceID]; ok {
+		if string(existing.PublicKey) == string(publicKey) {
+			dk := *existing
+			return &dk, nil
+		}
+		s.dropWrapsLocked(deviceID)
+	}
+
+	dk := &E2EDeviceKey{
+		DeviceID:    deviceID,
+		UserID:      userID,
+		PublicKey:   publicKey,
+		Fingerprint: KeyFingerprint(publicKey),
+		EnrolledAt:  time.Now().UTC(),
+	}
+	s.devices[deviceID] = dk
+	if err := s.saveLocked(); err != nil {
+		return nil, err
+	}
+	out := *dk
+	return &out, nil
+}
+
+// DeviceKey returns a device's enrolled public key
+func (s *E2EStore) DeviceKey(deviceID string) (*E2EDeviceKey, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	dk, ok := s.devices[deviceID]
+	if !ok {
+		return nil, false
+	}
+	out := *dk
+	return &out, true
+}
+
+// ListDeviceKeys returns all enrolled devices, sorted by device ID
+func (s *E2EStore) ListDeviceKeys() []E2EDeviceKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]E2EDeviceKey, 0, len(s.devices))
+	for _, dk := range s.devices {
+		out = append(out, *dk)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].DeviceID < out[j].DeviceID })
+	return out
+}
+
+// ShareKeys returns a copy of a share's key versions, or nil if no key has
+// been uploaded yet
+func (s *E2EStore) ShareKeys(shareID string) *E2EShareKeys {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sk, ok := s.shares[shareID]
+	if !ok {
+		return nil
+	}
+	out := *sk
+	out.Versions = make(map[int]map[string]*WrappedShareKey, len(sk.Versions))
+	for v, wraps := range sk.Versions {
+		m := make(map[string]*WrappedShareKey, len(wraps))
+		for id, w := range wraps {
+			m[id] = w
+		}
+		out.Versions[v] = m
+	}
+	return &out
+}
+
+// PutWraps stores wrapped keys uploaded by a device. A version one above the
+// current one starts a new key (the first upload initialises the share) and
+// must be wrapped for every device in active. Uploads for an existing version
+// add wraps for devices that lack them, and only a device holding that
+// version may make them. Wraps for devices outside active are ignored.
+func (s *E2EStore) PutWraps(shareID, uploader string, version int, wraps map[string]*WrappedShareKey, active []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.devices[uploader]; !ok {
+		return ErrE2ENotEnrolled
+	}
+	isActive := make(map[string]bool, len(active))
+	for _, id := range active {
+		isActive[id] = true
+	}
+	if !isActive[uploader] {
+		return ErrE2ENotKeyHolder
+	}
+
+	sk, ok := s.shares[shareID]
+	if !ok {
+		sk = &E2EShareKeys{ShareID: shareID, Versions: make(map[int]map[string]*WrappedShareKey)}
+	}
+
+	now := time.Now().UTC()
+	switch {
+	case version == sk.CurrentVersion+1:
+		// A new key must be readable by everyone who may sync the share, and
+		// only an existing key holder may replace the key
+		if sk.CurrentVersion > 0 && sk.Versions[sk.CurrentVersion][uploader] == nil {
+			return ErrE2ENotKeyHolder
+		}
+		for _, id := range active {
+			if wraps[id] == nil {
+				return fmt.Errorf("%w: %s", ErrE2EMissingWraps, id)
+			}
+		}
+		set := make(map[string]*WrappedShareKey, len(active))
+		for _, id := range active {
+			set[id] = stampWrap(wraps[id], uploader, now)
+		}
+		sk.Versions[version] = set
+		sk.CurrentVersion = version
+		sk.RotationPending = false
+
+	case version >= 1 && version <= sk.CurrentVersion:
+		set := sk.Versions[version]
+		if set == nil || set[uploader] == nil {
+			return ErrE2ENotKeyHolder
+		}
+		for id, w := range wraps {
+			if isActive[id] && set[id] == nil && w != nil {
+				set[id] = stampWrap(w, uploader, now)
+			}
+		}
+
+	default:
+		return ErrE2EVersionConflict
+	}
+
+	sk.UpdatedAt = now
+	s.shares[shareID] = sk
+	return s.saveLocked()
+}
+
+// stampWrap copies a wrap and records who made it
+func stampWrap(w *WrappedShareKey, uploader string, now time.Time) *WrappedShareKey {
+	out := *w
+	out.WrappedBy = uploader
+	out.CreatedAt = now
+	return &out
+}
+
+// RevokeDevice forgets a device's public key and wraps. Every share it could
+// read is marked for rotation; the affected share IDs are returned.
+func (s *E2EStore) RevokeDevice(deviceID string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, enrolled := s.devices[deviceID]
+	delete(s.devices, deviceID)
+	affected := s.dropWrapsLocked(deviceID)
+	for _, shareID := range affected {
+		s.shares[shareID].RotationPending = true
+	}
+	if !enrolled && len(affected) == 0 {
+		return nil, nil
+	}
+	return affected, s.saveLocked()
+}
+
+// DeleteShare forgets all keys of a share
+func (s *E2EStore) DeleteShare(shareID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.shares[shareID]; !ok {
+		return nil
+	}
+	delete(s.shares, shareID)
+	return s.saveLocked()
+}
+
+// dropWrapsLocked removes a device's wraps and returns the shares it had any in
+func (s *E2EStore) dropWrapsLocked(deviceID string) []string {
+	var affected []string
+	for shareID, sk := range s.shares {
+		had := false
+		for _, wraps := range sk.Versions {
+			if _, ok := wraps[deviceID]; ok {
+				delete(wraps, deviceID)
+				had = true
+			}
+		}
+		if had {
+			affected = append(affected, shareID)
+		}
+	}
+	sort.Strings(affected)
+	return affected
+}
@@ -0,0 +1,93 @@
+package sync
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+func enrollTestDevice(t *testing.T, s *E2EStore, deviceID string) {
+	t.Helper()
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.EnrollDevice(deviceID, "u1", priv.PublicKey().Bytes()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testWraps(ids ...string) map[string]*WrappedShareKey {
+	m := make(map[string]*WrappedShareKey)
+	for _, id := range ids {
+		m[id] = &WrappedShareKey{Ciphertext: []byte("sealed for " + id)}
+	}
+	return m
+}
+
+func TestE2EStoreKeyLifecycle(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewE2EStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.EnrollDevice("d0", "u1", []byte("short")); !errors.Is(err, ErrE2EInvalidKey) {
+		t.Errorf("bad key accepted: %v", err)
+	}
+	for _, id := range []string{"d1", "d2", "d3"} {
+		enrollTestDevice(t, s, id)
+	}
+
+	// The first key must be wrapped for every active device
+	if err := s.PutWraps("s1", "d1", 1, testWraps("d1"), []string{"d1", "d2"}); !errors.Is(err, ErrE2EMissingWraps) {
+		t.Errorf("partial initial key accepted: %v", err)
+	}
+	if err := s.PutWraps("s1", "d1", 1, testWraps("d1", "d2"), []string{"d1", "d2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// d3 gains access later and is granted the key by a holder, not by itself
+	active := []string{"d1", "d2", "d3"}
+	if err := s.PutWraps("s1", "d3", 1, testWraps("d3"), active); !errors.Is(err, ErrE2ENotKeyHolder) {
+		t.Errorf("self-grant accepted: %v", err)
+	}
+	if err := s.PutWraps("s1", "d2", 1, testWraps("d3"), active); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutWraps("s1", "d1", 3, testWraps(active...), active); !errors.Is(err, ErrE2EVersionConflict) {
+		t.Errorf("skipped version accepted: %v", err)
+	}
+
+	// Revoking d2 marks the share for rotation, which excludes it
+	affected, err := s.RevokeDevice("d2")
+	if err != nil || len(affected) != 1 || affected[0] != "s1" {
+		t.Fatalf("RevokeDevice = %v, %v", affected, err)
+	}
+	if sk := s.ShareKeys("s1"); !sk.RotationPending || sk.Versions[1]["d2"] != nil {
+		t.Fatal("revoked device keeps its wrap or no rotation pending")
+	}
+	active = []string{"d1", "d3"}
+	if err := s.PutWraps("s1", "d2", 2, testWraps(active...), active); !errors.Is(err, ErrE2ENotEnrolled) {
+		t.Errorf("revoked device rotated the key: %v", err)
+	}
+	if err := s.PutWraps("s1", "d3", 2, testWraps(active...), active); err != nil {
+		t.Fatal(err)
+	}
+
+	// State survives a reload
+	s2, err := NewE2EStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sk := s2.ShareKeys("s1")
+	if sk == nil || sk.CurrentVersion != 2 || sk.RotationPending {
+		t.Fatalf("reloaded keys = %+v", sk)
+	}
+	if len(sk.Versions[2]) != 2 || sk.Versions[2]["d3"].WrappedBy != "d3" || sk.Versions[1]["d1"] == nil {
+		t.Errorf("reloaded versions = %+v", sk.Versions)
+	}
+	if _, ok := s2.DeviceKey("d2"); ok {
+		t.Error("revoked device key survived reload")
+	}
+}
@@ -0,0 +1,557 @@
+package sync
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"nithronos/backend/nosd/internal/fsatomic"
+)
+
+// ErrCursorExpired is returned when a cursor can no longer be served from the
+// journal (it belongs to a different journal epoch or predates the compaction
+// horizon). Clients must discard it and resync from an empty cursor.
+var ErrCursorExpired = errors.New("cursor expired")
+
+// DefaultTombstoneTTL is how long delete records are kept in the journal
+// before compaction may drop them.
+const DefaultTombstoneTTL = 30 * 24 * time.Hour
+
+// JournalEntry is a single sequenced record in a share's change journal
+type JournalEntry struct {
+	Seq        uint64     `json:"seq"`
+	Change     FileChange `json:"change"`
+	DeviceID   string     `json:"device_id,omitempty"` // Originating sync device, empty for local changes
+	RecordedAt time.Time  `json:"recorded_at"`
+}
+
+// journalMeta is the on-disk metadata for a change journal
+type journalMeta struct {
+	Version int       `json:"version"`
+	Epoch   string    `json:"epoch"`
+	Horizon uint64    `json:"horizon"` // Oldest sequence a cursor may reference
+	Created time.Time `json:"created"`
+}
+
+// Cursor identifies a position in a share's change journal
+type Cursor struct {
+	Epoch string
+	Seq   uint64
+}
+
+// EncodeCursor encodes a cursor to a compact string of the form "epoch.seq"
+func EncodeCursor(c *Cursor) string {
+	if c == nil {
+		return ""
+	}
+	return c.Epoch + "." + strconv.FormatUint(c.Seq, 10)
+}
+
+// DecodeCursor decodes a cursor from a string
+func DecodeCursor(s string) (*Cursor, error) {
+	if s == "" {
+		return nil, nil
+	}
+	i := strings.LastIndexByte(s, '.')
+	if i <= 0 || i == len(s)-1 {
+		return nil, fmt.Errorf("invalid cursor format")
+	}
+	seq, err := strconv.ParseUint(s[i+1:], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor sequence: %w", err)
+	}
+	return &Cursor{Epoch: s[:i], Seq: seq}, nil
+}
+
+// ChangeJournal is a persistent, append-only log of file changes for a single
+// share. Every change gets a monotonically increasing sequence number, so a
+// cursor only needs to carry the last sequence a client has seen.
+type ChangeJournal struct {
+	shareID  string
+	dir      string
+	logPath  string
+	metaPath string
+
+	mu      sync.RWMutex
+	meta    journalMeta
+	entries []JournalEntry    // Ordered by Seq
+	latest  map[string]uint64 // path -> seq of the newest entry for that path
+	lastSeq uint64
+	log     *os.File
+}
+
+// OpenChangeJournal opens (or creates) the change journal stored in dir
+func OpenChangeJournal(shareID, dir string) (*ChangeJournal, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create journal directory: %w", err)
+	}
+
+	j := &ChangeJournal{
+		shareID:  shareID,
+		dir:      dir,
+		logPath:  filepath.Join(dir, "journal.log"),
+		metaPath: filepath.Join(dir, "meta.json"),
+		latest:   make(map[string]uint64),
+	}
+
+	ok, err := fsatomic.LoadJSON(j.metaPath, &j.meta)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load journal metadata: %w", err)
+	}
+	if !ok {
+		// A fresh journal starts a new epoch; any log left behind without
+		// metadata cannot be trusted to match previously issued cursors.
+		_ = os.Remove(j.logPath)
+		j.meta = journalMeta{Version: 1, Epoch: newJournalEpoch(), Created: time.Now()}
+		if err := j.saveMeta(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := j.load(); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(j.logPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open journal log: %w", err)
+	}
+	j.log = f
+
+	return j, nil
+}
+
+func newJournalEpoch() string {
+	return strings.ReplaceAll(uuid.New().String(), "-", "")[:12]
+}
+
+// load replays the journal log into memory
+func (j *ChangeJournal) load() error {
+	f, err := os.Open(j.logPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read journal log: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// A torn final write is expected after a crash; stop replaying there.
+			break
+		}
+		if e.Seq <= j.lastSeq {
+			continue
+		}
+		j.apply(e)
+	}
+	return scanner.Err()
+}
+
+// apply adds an entry to the in-memory index. Caller must hold j.mu.
+func (j *ChangeJournal) apply(e JournalEntry) {
+	j.entries = append(j.entries, e)
+	j.latest[e.Change.Path] = e.Seq
+	if e.Change.Type == ChangeTypeRename && e.Change.OldPath != "" {
+		j.latest[e.Change.OldPath] = e.Seq
+	}
+	j.lastSeq = e.Seq
+}
+
+func (j *ChangeJournal) saveMeta() error {
+	return fsatomic.WithLock(j.metaPath, func() error {
+		return fsatomic.SaveJSON(context.TODO(), j.metaPath, j.meta, 0o600)
+	})
+}
+
+// Epoch returns the journal epoch embedded in every cursor it issues
+func (j *ChangeJournal) Epoch() string {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	return j.meta.Epoch
+}
+
+// LastSeq returns the sequence number of the newest entry
+func (j *ChangeJournal) LastSeq() uint64 {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	return j.lastSeq
+}
+
+// Cursor returns a cursor pointing at the current end of the journal
+func (j *ChangeJournal) Cursor() string {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	return EncodeCursor(&Cursor{Epoch: j.meta.Epoch, Seq: j.lastSeq})
+}
+
+// Record appends changes to the journal and returns the sequence number of
+// the last entry written. Changes that do not alter the recorded state of a
+// path (e.g. the same upload observed via WebDAV and inotify) are dropped.
+func (j *ChangeJournal) Record(deviceID string, changes ...FileChange) (uint64, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.log == nil {
+		return j.lastSeq, fmt.Errorf("journal closed")
+	}
+
+	var buf []byte
+	now := time.Now()
+	for _, c := range changes {
+		c.Path = normalizeJournalPath(c.Path)
+		c.OldPath = normalizeJournalPath(c.OldPath)
+		if c.Path == "" || j.isRedundant(c) {
+			continue
+		}
+		if c.Type == ChangeTypeCreate || c.Type == ChangeTypeModify {
+			// Callers may not know whether a path is new; the journal does.
+			c.Type = ChangeTypeModify
+			if prev, ok := j.current(c.Path); !ok || prev.Type == ChangeTypeDelete {
+				c.Type = ChangeTypeCreate
+			}
+		}
+
+		e := JournalEntry{
+			Seq:        j.lastSeq + 1,
+			Change:     c,
+			DeviceID:   deviceID,
+			RecordedAt: now,
+		}
+		line, err := json.Marshal(e)
+		if err != nil {
+			return j.lastSeq, err
+		}
+		buf = append(buf, line...)
+		buf = append(buf, '\n')
+		j.apply(e)
+	}
+
+	if len(buf) == 0 {
+		return j.lastSeq, nil
+	}
+	if _, err := j.log.Write(buf); err != nil {
+		return j.lastSeq, fmt.Errorf("failed to append to journal: %w", err)
+	}
+	if err := j.log.Sync(); err != nil {
+		return j.lastSeq, fmt.Errorf("failed to sync journal: %w", err)
+	}
+	return j.lastSeq, nil
+}
+
+// isRedundant reports whether c matches the state already recorded for its path.
+// Caller must hold j.mu.
+func (j *ChangeJournal) isRedundant(c FileChange) bool {
+	prev, ok := j.current(c.Path)
+	if c.Type == ChangeTypeRename {
+		// The same move reported twice (e.g. by WebDAV and a btrfs diff)
+		return ok && prev.Type == ChangeTypeRename && prev.OldPath == c.OldPath &&
+			prev.IsDir == c.IsDir && prev.Hash == c.Hash
+	}
+	if !ok {
+		return c.Type == ChangeTypeDelete
+	}
+	if c.Type == ChangeTypeDelete {
+		return prev.Type == ChangeTypeDelete
+	}
+	if prev.Type == ChangeTypeDelete {
+		return false
+	}
+	if prev.IsDir && c.IsDir {
+		// Directory mtimes move with their children; only existence matters.
+		return true
+	}
+	return prev.IsDir == c.IsDir &&
+		prev.Size == c.Size &&
+		prev.Hash == c.Hash &&
+		prev.MTime.Equal(c.MTime)
+}
+
+// current returns the newest recorded change that describes path itself.
+// Caller must hold j.mu.
+func (j *ChangeJournal) current(path string) (FileChange, bool) {
+	seq, ok := j.latest[path]
+	if !ok {
+		return FileChange{}, false
+	}
+	e, ok := j.entryAt(seq)
+	if !ok {
+		return FileChange{}, false
+	}
+	if e.Change.Path != path {
+		// path was the source of a rename, so it no longer exists
+		return FileChange{Path: path, Type: ChangeTypeDelete}, true
+	}
+	return e.Change, true
+}
+
+// entryAt finds the entry with the given sequence. Caller must hold j.mu.
+func (j *ChangeJournal) entryAt(seq uint64) (JournalEntry, bool) {
+	i := sort.Search(len(j.entries), func(i int) bool { return j.entries[i].Seq >= seq })
+	if i < len(j.entries) && j.entries[i].Seq == seq {
+		return j.entries[i], true
+	}
+	return JournalEntry{}, false
+}
+
+// isLive reports whether e is still the newest entry for its path. A rename
+// stays live while it is the newest entry for its old path, so clients still
+// learn the old path is gone after the new one changed again.
+// Caller must hold j.mu.
+func (j *ChangeJournal) isLive(e JournalEntry) bool {
+	if j.latest[e.Change.Path] == e.Seq {
+		return true
+	}
+	return e.Change.Type == ChangeTypeRename && e.Change.OldPath != "" &&
+		j.latest[e.Change.OldPath] == e.Seq
+}
+
+// Since returns up to limit live entries with a sequence greater than seq,
+// together with the sequence the next page should start after and whether
+// more entries remain. Superseded entries are skipped, so a client only ever
+// sees the newest change for each path (and the renames that moved a path
+// away).
+func (j *ChangeJournal) Since(seq uint64, limit int) ([]JournalEntry, uint64, bool, error) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+
+	if seq > 0 && seq < j.meta.Horizon {
+		return nil, seq, false, ErrCursorExpired
+	}
+	if seq > j.lastSeq {
+		return nil, seq, false, ErrCursorExpired
+	}
+
+	start := sort.Search(len(j.entries), func(i int) bool { return j.entries[i].Seq > seq })
+	next := seq
+	var out []JournalEntry
+	for i := start; i < len(j.entries); i++ {
+		e := j.entries[i]
+		if !j.isLive(e) {
+			continue
+		}
+		if len(out) == limit {
+			return out, next, true, nil
+		}
+		out = append(out, e)
+		next = e.Seq
+	}
+	// Nothing live remains after the last returned entry, so the cursor can
+	// jump straight to the end of the journal.
+	return out, j.lastSeq, false, nil
+}
+
+// Changes resolves cursorStr against the journal and returns the next page of
+// changes, never more than limit. Remaining changes are left for the next
+// call, which the response signals through HasMore.
+func (j *ChangeJournal) Changes(cursorStr string, limit int) (*ChangesResponse, error) {
+	if limit <= 0 || limit > MaxChangesPerRequest {
+		limit = MaxChangesPerRequest
+	}
+
+	var seq uint64
+	if cursorStr != "" {
+		cursor, err := DecodeCursor(cursorStr)
+		if err != nil {
+			// Cursors issued before the journal existed are not decodable;
+			// treat them like any other stale cursor.
+			return nil, ErrCursorExpired
+		}
+		if cursor.Epoch != j.Epoch() {
+			return nil, ErrCursorExpired
+		}
+		seq = cursor.Seq
+	}
+
+	entries, next, hasMore, err := j.Since(seq, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make([]FileChange, 0, len(entries))
+	for _, e := range entries {
+		changes = append(changes, e.Change)
+	}
+
+	return &ChangesResponse{
+		Changes: changes,
+		Cursor:  EncodeCursor(&Cursor{Epoch: j.Epoch(), Seq: next}),
+		HasMore: hasMore,
+	}, nil
+}
+
+// Snapshot returns the newest recorded state of every path that currently
+// exists according to the journal.
+func (j *ChangeJournal) Snapshot() map[string]FileChange {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+
+	state := make(map[string]FileChange, len(j.latest))
+	for path := range j.latest {
+		if c, ok := j.current(path); ok && c.Type != ChangeTypeDelete {
+			state[path] = c
+		}
+	}
+	return state
+}
+
+// Descendants returns the newest recorded state of every existing path below
+// dir (not including dir itself).
+func (j *ChangeJournal) Descendants(dir string) map[string]FileChange {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+
+	prefix := normalizeJournalPath(dir) + "/"
+	state := make(map[string]FileChange)
+	for path := range j.latest {
+		if !strings.HasPrefix(path, prefix) {
+			continue
+		}
+		if c, ok := j.current(path); ok && c.Type != ChangeTypeDelete {
+			state[path] = c
+		}
+	}
+	return state
+}
+
+// Paths returns the number of distinct paths the journal tracks
+func (j *ChangeJournal) Paths() int {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	return len(j.latest)
+}
+
+// Len returns the number of entries held by the journal, including
+// superseded ones that have not been compacted yet.
+func (j *ChangeJournal) Len() int {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	return len(j.entries)
+}
+
+// Compact rewrites the journal keeping only live entries. Delete tombstones
+// older than tombstoneTTL are dropped and the horizon advances past them, so
+// cursors older than that must resync from scratch.
+func (j *ChangeJournal) Compact(tombstoneTTL time.Duration) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.log == nil {
+		return fmt.Errorf("journal closed")
+	}
+
+	cutoff := time.Now().Add(-tombstoneTTL)
+	horizon := j.meta.Horizon
+	kept := make([]JournalEntry, 0, len(j.latest))
+	for _, e := range j.entries {
+		if !j.isLive(e) {
+			continue
+		}
+		if e.Change.Type == ChangeTypeDelete && e.RecordedAt.Before(cutoff) {
+			if e.Seq >= horizon {
+				horizon = e.Seq + 1
+			}
+			continue
+		}
+		kept = append(kept, e)
+	}
+
+	tmp := j.logPath + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, e := range kept {
+		line, err := json.Marshal(e)
+		if err != nil {
+			_ = f.Close()
+			_ = os.Remove(tmp)
+			return err
+		}
+		_, _ = w.Write(line)
+		_ = w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+	_ = f.Close()
+
+	// Persist the horizon before swapping logs so a crash in between can only
+	// expire cursors early, never serve a cursor whose history is gone.
+	if horizon != j.meta.Horizon {
+		j.meta.Horizon = horizon
+		if err := j.saveMeta(); err != nil {
+			_ = os.Remove(tmp)
+			return err
+		}
+	}
+	if err := os.Rename(tmp, j.logPath); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	_ = fsatomic.FsyncDir(j.dir)
+
+	_ = j.log.Close()
+	lf, err := os.OpenFile(j.logPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		j.log = nil
+		return err
+	}
+	j.log = lf
+
+	j.entries = kept
+	j.latest = make(map[string]uint64, len(kept))
+	for _, e := range kept {
+		j.latest[e.Change.Path] = e.Seq
+		if e.Change.Type == ChangeTypeRename && e.Change.OldPath != "" {
+			// As in apply, the source of a rename stays recorded as gone
+			j.latest[e.Change.OldPath] = e.Seq
+		}
+	}
+	return nil
+}
+
+// Close closes the journal log
+func (j *ChangeJournal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.log == nil {
+		return nil
+	}
+	err := j.log.Close()
+	j.log = nil
+	return err
+}
+
+// normalizeJournalPath converts a share-relative path to the slash-separated
+// form used in journal entries.
+func normalizeJournalPath(p string) string {
+	if p == "" {
+		return ""
+	}
+	p = filepath.ToSlash(filepath.Clean("/" + p))
+	return strings.TrimPrefix(p, "/")
+}
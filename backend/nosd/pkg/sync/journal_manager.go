@@ -0,0 +1,606 @@
+package sync
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog"
+)
+
+// JournalManagerConfig holds configuration for the journal manager
+type JournalManagerConfig struct {
+	// DebounceTime is how long a path must be quiet before a watcher event
+	// is turned into a journal entry (coalesces bursts of writes).
+	DebounceTime time.Duration
+	// CompactThreshold triggers a compaction once the journal holds this many
+	// times more entries than live paths.
+	CompactThreshold int
+	// TombstoneTTL is how long delete records are kept
+	TombstoneTTL time.Duration
+	// ChangeSource selects how filesystem changes are detected: "inotify",
+	// "btrfs" (snapshot diffs, share must be a subvolume) or "auto".
+	ChangeSource string
+	// BtrfsPollInterval is how often btrfs shares are checked for changes
+	BtrfsPollInterval time.Duration
+	// SnapshotDir holds the btrfs change-detection snapshots. Defaults to
+	// .snapshots/nos-sync next to the share, which must be on the same
+	// filesystem.
+	SnapshotDir string
+}
+
+// Change sources for JournalManagerConfig.ChangeSource
+const (
+	ChangeSourceAuto    = "auto"
+	ChangeSourceInotify = "inotify"
+	ChangeSourceBtrfs   = "btrfs"
+)
+
+// DefaultJournalManagerConfig returns the default configuration
+func DefaultJournalManagerConfig() JournalManagerConfig {
+	return JournalManagerConfig{
+		DebounceTime:      time.Second,
+		CompactThreshold:  2,
+		TombstoneTTL:      DefaultTombstoneTTL,
+		ChangeSource:      ChangeSourceAuto,
+		BtrfsPollInterval: 10 * time.Second,
+	}
+}
+
+// JournalManager owns the change journals of all sync shares. A journal is
+// opened on first use, reconciled against the filesystem to pick up anything
+// that changed while nosd was not running, and then kept current by a change
+// source (inotify, or btrfs snapshot diffs for subvolume shares) plus writes
+// reported by the WebDAV layer.
+type JournalManager struct {
+	baseDir string
+	tracker *ChangeTracker
+	config  JournalManagerConfig
+	logger  zerolog.Logger
+
+	mu       sync.Mutex
+	journals map[string]*ChangeJournal
+	watchers map[string]changeSource
+	onRecord []func(shareID, cursor string)
+	// shareMu serializes opening and reconciling a share, which walk the
+	// share and so don't hold mu
+	shareMu map[string]*sync.Mutex
+}
+
+// NewJournalManager creates a new journal manager storing journals under baseDir
+func NewJournalManager(baseDir string, tracker *ChangeTracker, logger zerolog.Logger, config JournalManagerConfig) (*JournalManager, error) {
+	if err := os.MkdirAll(baseDir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create journal directory: %w", err)
+	}
+	if config.DebounceTime <= 0 {
+		config.DebounceTime = time.Second
+	}
+	if config.CompactThreshold < 2 {
+		config.CompactThreshold = 2
+	}
+	if config.BtrfsPollInterval <= 0 {
+		config.BtrfsPollInterval = 10 * time.Second
+	}
+	switch config.ChangeSource {
+	case "":
+		config.ChangeSource = ChangeSourceAuto
+	case ChangeSourceAuto, ChangeSourceInotify, ChangeSourceBtrfs:
+	default:
+		return nil, fmt.Errorf("unknown change source %q", config.ChangeSource)
+	}
+	return &JournalManager{
+		baseDir:  baseDir,
+		tracker:  tracker,
+		config:   config,
+		logger:   logger.With().Str("component", "change-journal").Logger(),
+		journals: make(map[string]*ChangeJournal),
+		watchers: make(map[string]changeSource),
+		shareMu:  make(map[string]*sync.Mutex),
+	}, nil
+}
+
+// OnRecord registers a callback invoked with the new cursor after entries are
+// appended to a share's journal.
+func (m *JournalManager) OnRecord(fn func(shareID, cursor string)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onRecord = append(m.onRecord, fn)
+}
+
+// Open returns the journal for a share, creating and reconciling it if needed
+func (m *JournalManager) Open(shareID, sharePath string) (*ChangeJournal, error) {
+	if shareID == "" || strings.ContainsAny(shareID, `/\`) || shareID == "." || shareID == ".." {
+		return nil, fmt.Errorf("invalid share id")
+	}
+
+	if j, ok := m.journal(shareID); ok {
+		return j, nil
+	}
+
+	lock := m.shareLock(shareID)
+	lock.Lock()
+	if j, ok := m.journal(shareID); ok {
+		lock.Unlock()
+		return j, nil
+	}
+
+	j, err := OpenChangeJournal(shareID, filepath.Join(m.baseDir, shareID))
+	if err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+
+	// Start watching before reconciling so nothing slips through in between;
+	// anything seen by both is deduplicated by the journal.
+	w := m.startChangeSource(shareID, sharePath)
+
+	if err := m.reconcile(j, shareID, sharePath); err != nil {
+		lock.Unlock()
+		// Sources call back into Open, so stop them unlocked
+		if w != nil {
+			w.stop()
+		}
+		_ = j.Close()
+		return nil, err
+	}
+
+	m.mu.Lock()
+	m.journals[shareID] = j
+	if w != nil {
+		m.watchers[shareID] = w
+	}
+	m.mu.Unlock()
+	lock.Unlock()
+	return j, nil
+}
+
+// journal returns the open journal of a share
+func (m *JournalManager) journal(shareID string) (*ChangeJournal, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.journals[shareID]
+	return j, ok
+}
+
+// shareLock returns the lock serializing opens and reconciles of a share
+func (m *JournalManager) shareLock(shareID string) *sync.Mutex {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	lock, ok := m.shareMu[shareID]
+	if !ok {
+		lock = new(sync.Mutex)
+		m.shareMu[shareID] = lock
+	}
+	return lock
+}
+
+// changeSource feeds filesystem changes for one share into its journal
+type changeSource interface {
+	stop()
+}
+
+// startChangeSource starts the configured change source for a share, or
+// returns nil if none is available. Caller must hold the share's lock.
+func (m *JournalManager) startChangeSource(shareID, sharePath string) changeSource {
+	log := m.logger.With().Str("share_id", shareID).Logger()
+
+	useBtrfs := m.config.ChangeSource == ChangeSourceBtrfs ||
+		(m.config.ChangeSource == ChangeSourceAuto && IsBtrfsSubvolume(sharePath))
+	if useBtrfs {
+		w, err := newBtrfsWatcher(m, shareID, sharePath)
+		if err == nil {
+			log.Info().Msg("Detecting changes with btrfs snapshots")
+			return w
+		}
+		log.Warn().Err(err).Msg("Btrfs change detection unavailable, falling back to inotify")
+	}
+
+	w, err := newJournalWatcher(m, shareID, sharePath)
+	if err != nil {
+		log.Warn().Err(err).
+			Msg("Filesystem watcher unavailable, journal will only see WebDAV writes and reconciles")
+		return nil
+	}
+	return w
+}
+
+// reconcile brings a journal up to date with the filesystem. Caller must
+// hold the share's lock.
+func (m *JournalManager) reconcile(j *ChangeJournal, shareID, sharePath string) error {
+	start := time.Now()
+	changes, err := m.tracker.Reconcile(sharePath, j.Snapshot())
+	if err != nil {
+		return fmt.Errorf("failed to reconcile journal: %w", err)
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	seq, err := j.Record("", changes...)
+	if err != nil {
+		return err
+	}
+	m.logger.Info().
+		Str("share_id", shareID).
+		Int("changes", len(changes)).
+		Uint64("seq", seq).
+		Dur("took", time.Since(start)).
+		Msg("Journal reconciled with filesystem")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.notifyLocked(shareID, j, seq)
+	return nil
+}
+
+// Reconcile rescans a share and records any differences from its journal.
+// It is the fallback for changes the watcher could not observe.
+func (m *JournalManager) Reconcile(shareID, sharePath string) error {
+	j, err := m.Open(shareID, sharePath)
+	if err != nil {
+		return err
+	}
+	lock := m.shareLock(shareID)
+	lock.Lock()
+	defer lock.Unlock()
+	return m.reconcile(j, shareID, sharePath)
+}
+
+// GetChanges returns the next page of changes for a share after cursor
+func (m *JournalManager) GetChanges(shareID, sharePath, cursor string, limit int) (*ChangesResponse, error) {
+	j, err := m.Open(shareID, sharePath)
+	if err != nil {
+		return nil, err
+	}
+	return j.Changes(cursor, limit)
+}
+
+// Record appends changes reported by a sync device (e.g. a WebDAV upload)
+func (m *JournalManager) Record(shareID, sharePath, deviceID string, changes ...FileChange) error {
+	j, err := m.Open(shareID, sharePath)
+	if err != nil {
+		return err
+	}
+	before := j.LastSeq()
+	seq, err := j.Record(deviceID, changes...)
+	if err != nil {
+		return err
+	}
+	if seq != before {
+		m.afterRecord(shareID, j, seq)
+	}
+	return nil
+}
+
+// RecordPath stats a share-relative path and records its current state
+func (m *JournalManager) RecordPath(shareID, sharePath, deviceID, relPath string) error {
+	change, ok := m.tracker.Describe(sharePath, relPath)
+	if !ok {
+		return nil
+	}
+	return m.Record(shareID, sharePath, deviceID, change)
+}
+
+// RecordTree records relPath and, for directories, everything below it.
+// Used when a whole subtree appears at once (directory moved or copied in).
+func (m *JournalManager) RecordTree(shareID, sharePath, deviceID, relPath string) error {
+	root := filepath.Join(sharePath, filepath.FromSlash(relPath))
+	var changes []FileChange
+	_ = filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(sharePath, path)
+		if err != nil {
+			return nil
+		}
+		change, ok := m.tracker.Describe(sharePath, rel)
+		if !ok {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		changes = append(changes, change)
+		return nil
+	})
+	if len(changes) == 0 {
+		return nil
+	}
+	return m.Record(shareID, sharePath, deviceID, changes...)
+}
+
+// RecordRemoval records a deleted path and all recorded paths beneath it
+func (m *JournalManager) RecordRemoval(shareID, sharePath, deviceID, relPath string) error {
+	j, err := m.Open(shareID, sharePath)
+	if err != nil {
+		return err
+	}
+	relPath = normalizeJournalPath(relPath)
+	var changes []FileChange
+	now := time.Now()
+	for path, c := range j.Descendants(relPath) {
+		changes = append(changes, FileChange{Path: path, Type: ChangeTypeDelete, MTime: now, IsDir: c.IsDir})
+	}
+	// Children before their parent
+	sortChangesByDepth(changes, true)
+	changes = append(changes, FileChange{Path: relPath, Type: ChangeTypeDelete, MTime: now})
+	return m.Record(shareID, sharePath, deviceID, changes...)
+}
+
+// RecordRename records a rename of oldPath to newPath. For directories a
+// rename entry is written for every recorded descendant too, so clients that
+// never saw the parent still learn where each file went.
+func (m *JournalManager) RecordRename(shareID, sharePath, deviceID, oldPath, newPath string) error {
+	j, err := m.Open(shareID, sharePath)
+	if err != nil {
+		return err
+	}
+	change, ok := m.tracker.Describe(sharePath, newPath)
+	if !ok || change.Type == ChangeTypeDelete {
+		// Moved out of sync scope (or already gone)
+		return m.RecordRemoval(shareID, sharePath, deviceID, oldPath)
+	}
+	oldPath = normalizeJournalPath(oldPath)
+	change.Type = ChangeTypeRename
+	change.OldPath = oldPath
+	changes := []FileChange{change}
+
+	if change.IsDir {
+		changes = append(changes, descendantRenames(j, oldPath, change.Path)...)
+	}
+	return m.Record(shareID, sharePath, deviceID, changes...)
+}
+
+// descendantRenames returns rename entries moving every recorded path below
+// oldDir to the same place below newDir, parents first
+func descendantRenames(j *ChangeJournal, oldDir, newDir string) []FileChange {
+	prefix := oldDir + "/"
+	var children []FileChange
+	for path, c := range j.Descendants(oldDir) {
+		c.OldPath = path
+		c.Path = newDir + "/" + strings.TrimPrefix(path, prefix)
+		c.Type = ChangeTypeRename
+		children = append(children, c)
+	}
+	sortChangesByDepth(children, false)
+	return children
+}
+
+// afterRecord runs post-append housekeeping and notifies listeners
+func (m *JournalManager) afterRecord(shareID string, j *ChangeJournal, seq uint64) {
+	if j.Len() > m.config.CompactThreshold*(j.Paths()+1024) {
+		if err := j.Compact(m.config.TombstoneTTL); err != nil {
+			m.logger.Warn().Err(err).Str("share_id", shareID).Msg("Journal compaction failed")
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.notifyLocked(shareID, j, seq)
+}
+
+// notifyLocked invokes OnRecord callbacks. Caller must hold m.mu.
+func (m *JournalManager) notifyLocked(shareID string, j *ChangeJournal, seq uint64) {
+	cursor := EncodeCursor(&Cursor{Epoch: j.Epoch(), Seq: seq})
+	for _, fn := range m.onRecord {
+		go fn(shareID, cursor)
+	}
+}
+
+// CompactAll compacts every open journal
+func (m *JournalManager) CompactAll() {
+	m.mu.Lock()
+	journals := make(map[string]*ChangeJournal, len(m.journals))
+	for id, j := range m.journals {
+		journals[id] = j
+	}
+	m.mu.Unlock()
+
+	for id, j := range journals {
+		if err := j.Compact(m.config.TombstoneTTL); err != nil {
+			m.logger.Warn().Err(err).Str("share_id", id).Msg("Journal compaction failed")
+		}
+	}
+}
+
+// Close stops all change sources and closes all journals
+func (m *JournalManager) Close() error {
+	m.mu.Lock()
+	watchers := m.watchers
+	m.watchers = make(map[string]changeSource)
+	m.mu.Unlock()
+
+	// Sources call back into the manager, so stop them unlocked
+	for _, w := range watchers {
+		w.stop()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var firstErr error
+	for id, j := range m.journals {
+		if err := j.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(m.journals, id)
+	}
+	return firstErr
+}
+
+// sortChangesByDepth orders changes by path depth (deepest first when
+// deepestFirst is set), then lexically.
+func sortChangesByDepth(changes []FileChange, deepestFirst bool) {
+	sort.Slice(changes, func(i, j int) bool {
+		di, dj := strings.Count(changes[i].Path, "/"), strings.Count(changes[j].Path, "/")
+		if di != dj {
+			return (di > dj) == deepestFirst
+		}
+		return changes[i].Path < changes[j].Path
+	})
+}
+
+// journalWatcher feeds filesystem events for one share into its journal
+type journalWatcher struct {
+	mgr       *JournalManager
+	shareID   string
+	sharePath string
+	watcher   *fsnotify.Watcher
+
+	mu      sync.Mutex
+	pending map[string]*time.Timer
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func newJournalWatcher(m *JournalManager, shareID, sharePath string) (*journalWatcher, error) {
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	w := &journalWatcher{
+		mgr:       m,
+		shareID:   shareID,
+		sharePath: sharePath,
+		watcher:   fw,
+		pending:   make(map[string]*time.Timer),
+		done:      make(chan struct{}),
+	}
+	if err := w.addRecursive(sharePath); err != nil {
+		_ = fw.Close()
+		return nil, err
+	}
+	w.wg.Add(1)
+	go w.run()
+	return w, nil
+}
+
+// addRecursive adds watches for a directory and all subdirectories
+func (w *journalWatcher) addRecursive(root string) error {
+	return filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			return nil
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if path != root {
+			if rel, err := filepath.Rel(w.sharePath, path); err == nil &&
+				w.mgr.tracker.shouldExclude(d.Name(), filepath.ToSlash(rel)) {
+				return filepath.SkipDir
+			}
+		}
+		if err := w.watcher.Add(path); err != nil {
+			// Usually fs.inotify.max_user_watches; the periodic reconcile covers the gap
+			w.mgr.logger.Warn().Err(err).Str("path", path).Msg("Failed to watch directory")
+		}
+		return nil
+	})
+}
+
+func (w *journalWatcher) run() {
+	defer w.wg.Done()
+	for {
+		select {
+		case <-w.done:
+			return
+		case ev, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			w.handle(ev)
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			w.mgr.logger.Warn().Err(err).Str("share_id", w.shareID).Msg("Journal watcher error")
+			if err == fsnotify.ErrEventOverflow {
+				// Events were lost; fall back to a full reconcile
+				go func() {
+					if err := w.mgr.Reconcile(w.shareID, w.sharePath); err != nil {
+						w.mgr.logger.Warn().Err(err).Str("share_id", w.shareID).Msg("Reconcile after overflow failed")
+					}
+				}()
+			}
+		}
+	}
+}
+
+func (w *journalWatcher) handle(ev fsnotify.Event) {
+	rel, err := filepath.Rel(w.sharePath, ev.Name)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return
+	}
+	rel = filepath.ToSlash(rel)
+
+	switch {
+	case ev.Has(fsnotify.Remove), ev.Has(fsnotify.Rename):
+		// fsnotify does not pair rename halves; the old name is recorded as
+		// removed and the new name arrives as a Create.
+		w.cancel(rel)
+		if err := w.mgr.RecordRemoval(w.shareID, w.sharePath, "", rel); err != nil {
+			w.mgr.logger.Warn().Err(err).Str("path", rel).Msg("Failed to journal removal")
+		}
+	case ev.Has(fsnotify.Create):
+		if info, err := os.Stat(ev.Name); err == nil && info.IsDir() {
+			_ = w.addRecursive(ev.Name)
+			w.cancel(rel)
+			if err := w.mgr.RecordTree(w.shareID, w.sharePath, "", rel); err != nil {
+				w.mgr.logger.Warn().Err(err).Str("path", rel).Msg("Failed to journal directory")
+			}
+			return
+		}
+		w.schedule(rel)
+	case ev.Has(fsnotify.Write), ev.Has(fsnotify.Chmod):
+		w.schedule(rel)
+	}
+}
+
+// schedule records rel once it has been quiet for the debounce period
+func (w *journalWatcher) schedule(rel string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if t, ok := w.pending[rel]; ok {
+		t.Reset(w.mgr.config.DebounceTime)
+		return
+	}
+	w.pending[rel] = time.AfterFunc(w.mgr.config.DebounceTime, func() {
+		w.mu.Lock()
+		delete(w.pending, rel)
+		w.mu.Unlock()
+		select {
+		case <-w.done:
+			return
+		default:
+		}
+		if err := w.mgr.RecordPath(w.shareID, w.sharePath, "", rel); err != nil {
+			w.mgr.logger.Warn().Err(err).Str("path", rel).Msg("Failed to journal change")
+		}
+	})
+}
+
+func (w *journalWatcher) cancel(rel string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if t, ok := w.pending[rel]; ok {
+		t.Stop()
+		delete(w.pending, rel)
+	}
+}
+
+func (w *journalWatcher) stop() {
+	close(w.done)
+	_ = w.watcher.Close()
+	w.wg.Wait()
+	w.mu.Lock()
+	for rel, t := range w.pending {
+		t.Stop()
+		delete(w.pending, rel)
+	}
+	w.mu.Unlock()
+}
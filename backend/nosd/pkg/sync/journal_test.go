@@ -0,0 +1,281 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestJournalPagingDoesNotDropChanges(t *testing.T) {
+	j, err := OpenChangeJournal("share1", t.TempDir())
+	if err != nil {
+		t.Fatalf("OpenChangeJournal failed: %v", err)
+	}
+	defer j.Close()
+
+	var changes []FileChange
+	for i := 0; i < 25; i++ {
+		changes = append(changes, FileChange{Path: fmt.Sprintf("file%02d.txt", i), Type: ChangeTypeCreate, Size: int64(i), Hash: "h"})
+	}
+	if _, err := j.Record("", changes...); err != nil {
+		t.Fatalf("Record failed: %v", err)
+	}
+
+	seen := make(map[string]bool)
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatal("paging did not terminate")
+		}
+		resp, err := j.Changes(cursor, 10)
+		if err != nil {
+			t.Fatalf("Changes failed: %v", err)
+		}
+		if len(resp.Changes) > 10 {
+			t.Fatalf("page exceeded limit: %d", len(resp.Changes))
+		}
+		for _, c := range resp.Changes {
+			seen[c.Path] = true
+		}
+		cursor = resp.Cursor
+		if !resp.HasMore {
+			break
+		}
+	}
+	if len(seen) != 25 {
+		t.Errorf("expected 25 changes across pages, got %d", len(seen))
+	}
+
+	resp, err := j.Changes(cursor, 10)
+	if err != nil {
+		t.Fatalf("Changes failed: %v", err)
+	}
+	if len(resp.Changes) != 0 || resp.HasMore {
+		t.Errorf("expected no further changes, got %d (has_more=%v)", len(resp.Changes), resp.HasMore)
+	}
+}
+
+func TestJournalSkipsSupersededAndRedundant(t *testing.T) {
+	j, err := OpenChangeJournal("share1", t.TempDir())
+	if err != nil {
+		t.Fatalf("OpenChangeJournal failed: %v", err)
+	}
+	defer j.Close()
+
+	mtime := time.Now().Truncate(time.Second)
+	a := FileChange{Path: "a.txt", Type: ChangeTypeModify, Size: 1, Hash: "h1", MTime: mtime}
+	j.Record("dev1", a)
+	// Same state observed again (e.g. inotify after a WebDAV PUT)
+	seq, _ := j.Record("", a)
+	if seq != 1 {
+		t.Errorf("redundant change was journaled, last seq = %d", seq)
+	}
+
+	a.Size, a.Hash = 2, "h2"
+	j.Record("dev1", a)
+
+	resp, err := j.Changes("", 100)
+	if err != nil {
+		t.Fatalf("Changes failed: %v", err)
+	}
+	if len(resp.Changes) != 1 {
+		t.Fatalf("expected only the newest change for a.txt, got %d", len(resp.Changes))
+	}
+	if resp.Changes[0].Hash != "h2" || resp.Changes[0].Type != ChangeTypeModify {
+		t.Errorf("unexpected change: %+v", resp.Changes[0])
+	}
+
+	// Deleting something never journaled is a no-op
+	seq, _ = j.Record("", FileChange{Path: "ghost.txt", Type: ChangeTypeDelete})
+	if seq != 2 {
+		t.Errorf("delete of unknown path was journaled, last seq = %d", seq)
+	}
+}
+
+func TestJournalPersistsAcrossReopen(t *testing.T) {
+	dir := t.TempDir()
+	j, err := OpenChangeJournal("share1", dir)
+	if err != nil {
+		t.Fatalf("OpenChangeJournal failed: %v", err)
+	}
+	j.Record("", FileChange{Path: "a.txt", Type: ChangeTypeCreate, Hash: "h1"})
+	j.Record("", FileChange{Path: "b.txt", Type: ChangeTypeCreate, Hash: "h2"})
+	cursor := j.Cursor()
+	j.Close()
+
+	j, err = OpenChangeJournal("share1", dir)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer j.Close()
+
+	if j.LastSeq() != 2 {
+		t.Errorf("LastSeq after reopen = %d, want 2", j.LastSeq())
+	}
+	seq, _ := j.Record("", FileChange{Path: "c.txt", Type: ChangeTypeCreate, Hash: "h3"})
+	if seq != 3 {
+		t.Errorf("sequence not monotonic after reopen: %d", seq)
+	}
+
+	resp, err := j.Changes(cursor, 100)
+	if err != nil {
+		t.Fatalf("Changes failed: %v", err)
+	}
+	if len(resp.Changes) != 1 || resp.Changes[0].Path != "c.txt" {
+		t.Errorf("expected only c.txt after cursor, got %+v", resp.Changes)
+	}
+
+	if _, err := j.Changes("otherepoch.1", 100); !errors.Is(err, ErrCursorExpired) {
+		t.Errorf("foreign epoch should expire, got %v", err)
+	}
+}
+
+func TestJournalCompactionHorizon(t *testing.T) {
+	j, err := OpenChangeJournal("share1", t.TempDir())
+	if err != nil {
+		t.Fatalf("OpenChangeJournal failed: %v", err)
+	}
+	defer j.Close()
+
+	j.Record("", FileChange{Path: "a.txt", Type: ChangeTypeCreate, Hash: "h1"})
+	old := j.Cursor()
+	j.Record("", FileChange{Path: "a.txt", Type: ChangeTypeDelete})
+	j.Record("", FileChange{Path: "b.txt", Type: ChangeTypeCreate, Hash: "h2"})
+
+	if err := j.Compact(0); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	if j.Len() != 1 {
+		t.Errorf("expected 1 entry after compaction, got %d", j.Len())
+	}
+	if _, err := j.Changes(old, 100); !errors.Is(err, ErrCursorExpired) {
+		t.Errorf("cursor before dropped tombstone should expire, got %v", err)
+	}
+	resp, err := j.Changes("", 100)
+	if err != nil || len(resp.Changes) != 1 || resp.Changes[0].Path != "b.txt" {
+		t.Errorf("full listing after compaction = %+v, %v", resp, err)
+	}
+}
+
+func TestJournalCompactionKeepsRenameSource(t *testing.T) {
+	dir := t.TempDir()
+	j, err := OpenChangeJournal("share1", dir)
+	if err != nil {
+		t.Fatalf("OpenChangeJournal failed: %v", err)
+	}
+	j.Record("", FileChange{Path: "a.txt", Type: ChangeTypeCreate, Hash: "h1"})
+	j.Record("", FileChange{Path: "b.txt", Type: ChangeTypeRename, OldPath: "a.txt", Hash: "h1"})
+
+	if err := j.Compact(time.Hour); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	if j.Paths() != 2 {
+		t.Errorf("expected the rename source to stay tracked, got %d paths", j.Paths())
+	}
+	resp, err := j.Changes("", 100)
+	if err != nil || len(resp.Changes) != 1 || resp.Changes[0].OldPath != "a.txt" {
+		t.Errorf("listing after compaction = %+v, %v", resp, err)
+	}
+	if seq, _ := j.Record("", FileChange{Path: "b.txt", Type: ChangeTypeRename, OldPath: "a.txt", Hash: "h1"}); seq != 2 {
+		t.Errorf("repeated rename recorded again at %d", seq)
+	}
+	j.Close()
+
+	// Compaction leaves the same state a replay of the log builds
+	j, err = OpenChangeJournal("share1", dir)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer j.Close()
+	if j.Paths() != 2 {
+		t.Errorf("expected 2 paths after reopen, got %d", j.Paths())
+	}
+}
+
+func TestJournalRenameThenChange(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		after FileChange
+	}{
+		{"modify", FileChange{Path: "b.txt", Type: ChangeTypeModify, Hash: "h2"}},
+		{"delete", FileChange{Path: "b.txt", Type: ChangeTypeDelete}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			j, err := OpenChangeJournal("share1", t.TempDir())
+			if err != nil {
+				t.Fatalf("OpenChangeJournal failed: %v", err)
+			}
+			defer j.Close()
+
+			j.Record("", FileChange{Path: "a.txt", Type: ChangeTypeCreate, Hash: "h1"})
+			cursor := j.Cursor()
+			j.Record("", FileChange{Path: "b.txt", Type: ChangeTypeRename, OldPath: "a.txt", Hash: "h1"})
+			j.Record("", tc.after)
+
+			// The rename must survive compaction too
+			if err := j.Compact(time.Hour); err != nil {
+				t.Fatalf("Compact failed: %v", err)
+			}
+			resp, err := j.Changes(cursor, 100)
+			if err != nil {
+				t.Fatalf("Changes failed: %v", err)
+			}
+			if len(resp.Changes) != 2 ||
+				resp.Changes[0].Type != ChangeTypeRename || resp.Changes[0].OldPath != "a.txt" ||
+				resp.Changes[1].Path != "b.txt" || resp.Changes[1].Type != tc.after.Type {
+				t.Errorf("changes after cursor = %+v", resp.Changes)
+			}
+		})
+	}
+}
+
+func TestJournalManagerReconcileAndRename(t *testing.T) {
+	share := t.TempDir()
+	os.MkdirAll(filepath.Join(share, "docs"), 0o755)
+	os.WriteFile(filepath.Join(share, "docs", "a.txt"), []byte("hello"), 0o644)
+
+	ct := NewChangeTracker(zerolog.Nop(), DefaultChangeTrackerConfig())
+	m, err := NewJournalManager(t.TempDir(), ct, zerolog.Nop(), DefaultJournalManagerConfig())
+	if err != nil {
+		t.Fatalf("NewJournalManager failed: %v", err)
+	}
+	defer m.Close()
+
+	resp, err := m.GetChanges("share1", share, "", 100)
+	if err != nil {
+		t.Fatalf("GetChanges failed: %v", err)
+	}
+	if len(resp.Changes) != 2 {
+		t.Fatalf("expected docs and docs/a.txt from initial reconcile, got %+v", resp.Changes)
+	}
+	cursor := resp.Cursor
+
+	if err := os.Rename(filepath.Join(share, "docs"), filepath.Join(share, "papers")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.RecordRename("share1", share, "dev1", "docs", "papers"); err != nil {
+		t.Fatalf("RecordRename failed: %v", err)
+	}
+
+	resp, err = m.GetChanges("share1", share, cursor, 100)
+	if err != nil {
+		t.Fatalf("GetChanges failed: %v", err)
+	}
+	renames := 0
+	for _, c := range resp.Changes {
+		if c.Type == ChangeTypeRename {
+			renames++
+		}
+		if c.Path == "papers/a.txt" && c.OldPath != "docs/a.txt" {
+			t.Errorf("child rename missing old path: %+v", c)
+		}
+	}
+	if renames != 2 {
+		t.Errorf("expected 2 rename entries, got %+v", resp.Changes)
+	}
+}
@@ -35,6 +35,9 @@ const (
 	MsgTypeFileLock    MessageType = "file.lock"
 	MsgTypeFileUnlock  MessageType = "file.unlock"
 
+	// Sync messages
+	MsgTypeShareChanged MessageType = "share.changed"
+
 	// Cursor messages
 	MsgTypeCursorMove   MessageType = "cursor.move"
 	MsgTypeCursorSelect MessageType = "cursor.select"
@@ -53,6 +56,17 @@ const (
 	MsgTypeError MessageType = "error"
 )
 
+// ShareChannel returns the channel on which changes to a share are announced
+func ShareChannel(shareID string) string {
+	return "share:" + shareID
+}
+
+// ShareChangedPayload is the payload of a share.changed message
+type ShareChangedPayload struct {
+	ShareID string `json:"share_id"`
+	Cursor  string `json:"cursor"`
+}
+
 // Message represents a real-time message
 type Message struct {
 	ID        string          `json:"id"`
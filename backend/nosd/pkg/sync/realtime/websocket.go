@@ -33,6 +33,9 @@ type WebSocketHandler struct {
 	hub      *Hub
 	upgrader websocket.Upgrader
 	logger   zerolog.Logger
+
+	// authorizeChannel decides whether a client may subscribe to a channel
+	authorizeChannel func(client *Client, channel string) bool
 }
 
 // NewWebSocketHandler creates a new WebSocket handler
@@ -51,6 +54,11 @@ func NewWebSocketHandler(hub *Hub, logger zerolog.Logger) *WebSocketHandler {
 	}
 }
 
+// SetChannelAuthorizer installs a check run before every subscription
+func (h *WebSocketHandler) SetChannelAuthorizer(fn func(client *Client, channel string) bool) {
+	h.authorizeChannel = fn
+}
+
 // ServeHTTP handles WebSocket upgrade requests
 func (h *WebSocketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Extract authentication from headers (set by middleware)
@@ -252,6 +260,11 @@ func (h *WebSocketHandler) handleSubscribe(client *Client, msg *Message) {
 		return
 	}
 
+	if h.authorizeChannel != nil && !h.authorizeChannel(client, payload.Channel) {
+		h.sendError(client, ErrUnauthorized.Error())
+		return
+	}
+
 	if err := h.hub.Subscribe(client.ID, payload.Channel); err != nil {
 		h.sendError(client, err.Error())
 		return
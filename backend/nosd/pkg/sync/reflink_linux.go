@@ -0,0 +1,15 @@
+//go:build linux
+
+package sync
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// reflink makes dst share src's extents (FICLONE). It fails on filesystems
+// without copy-on-write support.
+func reflink(dst, src *os.File) error {
+	return unix.IoctlFileClone(int(dst.Fd()), int(src.Fd()))
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package sync
+
+import (
+	"errors"
+	"os"
+)
+
+// reflink is only available on Linux; callers fall back to copying
+func reflink(dst, src *os.File) error {
+	return errors.New("reflink not supported")
+}
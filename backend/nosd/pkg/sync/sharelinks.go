@@ -0,0 +1,345 @@
+package sync
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"nithronos/backend/nosd/internal/auth/hash"
+	"nithronos/backend/nosd/internal/fsatomic"
+)
+
+// Share link lifetimes
+const (
+	// ShareLinkGrantTTL is how long an unlocked password link stays unlocked
+	ShareLinkGrantTTL = time.Hour
+	// shareLinkRetention is how long expired links stay listed before they
+	// are dropped
+	shareLinkRetention = 30 * 24 * time.Hour
+)
+
+// Share link errors
+var (
+	ErrLinkNotFound  = errors.New("share link not found")
+	ErrLinkExpired   = errors.New("share link expired")
+	ErrLinkExhausted = errors.New("share link download limit reached")
+	ErrLinkPassword  = errors.New("share link password required")
+)
+
+// ShareLink is a public link to a file or folder of a sync share. Anyone
+// with its token can use it, without an account.
+type ShareLink struct {
+	ID           string     `json:"id"`
+	Token        string     `json:"token"`
+	ShareID      string     `json:"share_id"`
+	Path         string     `json:"path"` // share-relative, "" for the share root
+	IsDir        bool       `json:"is_dir"`
+	FileDrop     bool       `json:"file_drop"` // upload-only: visitors can add files but not see any
+	PasswordHash string     `json:"password_hash,omitempty"`
+	HasPassword  bool       `json:"has_password"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	MaxDownloads int        `json:"max_downloads,omitempty"` // 0 = unlimited
+	Downloads    int        `json:"downloads"`
+	Uploads      int        `json:"uploads"`
+	CreatedBy    string     `json:"created_by"`
+	DeviceID     string     `json:"device_id,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	LastAccessAt *time.Time `json:"last_access_at,omitempty"`
+}
+
+// Expired reports whether the link's expiry has passed
+func (l *ShareLink) Expired(now time.Time) bool {
+	return l.ExpiresAt != nil && !now.Before(*l.ExpiresAt)
+}
+
+// Exhausted reports whether the link has used up its downloads
+func (l *ShareLink) Exhausted() bool {
+	return l.MaxDownloads > 0 && l.Downloads >= l.MaxDownloads
+}
+
+// ShareLinkStore keeps public share links. Password grants handed out on
+// unlock are kept in memory only; visitors unlock again after a restart.
+type ShareLinkStore struct {
+	path string
+
+	mu      sync.Mutex
+	links   map[string]*ShareLink
+	byToken map[string]string // token -> link ID
+	grants  map[string]linkGrant
+}
+
+type linkGrant struct {
+	linkID  string
+	expires time.Time
+}
+
+// NewShareLinkStore opens the share links kept in dir
+func NewShareLinkStore(dir string) (*ShareLinkStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create share link directory: %w", err)
+	}
+	s := &ShareLinkStore{
+		path:    filepath.Join(dir, "links.json"),
+		links:   make(map[string]*ShareLink),
+		byToken: make(map[string]string),
+		grants:  make(map[string]linkGrant),
+	}
+	if _, err := fsatomic.LoadJSON(s.path, &s.links); err != nil {
+		return nil, fmt.Errorf("failed to load share links: %w", err)
+	}
+	if s.links == nil {
+		s.links = make(map[string]*ShareLink)
+	}
+	for id, l := range s.links {
+		s.byToken[l.Token] = id
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pruneLocked(time.Now()) {
+		_ = s.saveLocked()
+	}
+	return s, nil
+}
+
+func (s *ShareLinkStore) saveLocked() error {
+	return fsatomic.WithLock(s.path, func() error {
+		return fsatomic.SaveJSON(context.TODO(), s.path, s.links, 0o600)
+	})
+}
+
+// publicLink returns a copy of a link without its password hash
+func publicLink(l *ShareLink) *ShareLink {
+	cp := *l
+	cp.PasswordHash = ""
+	return &cp
+}
+
+// newLinkToken returns a random URL-safe token
+func newLinkToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Create stores a new link, filling in its ID, token and creation time. An
+// empty password leaves the link open.
+func (s *ShareLinkStore) Create(link ShareLink, password string) (*ShareLink, error) {
+	token, err := newLinkToken()
+	if err != nil {
+		return nil, err
+	}
+	link.ID = uuid.New().String()
+	link.Token = token
+	link.CreatedAt = time.Now().UTC()
+	link.Downloads, link.Uploads = 0, 0
+	link.LastAccessAt = nil
+	link.PasswordHash = ""
+	link.HasPassword = password != ""
+	if link.HasPassword {
+		if link.PasswordHash, err = hash.HashPassword(password); err != nil {
+			return nil, err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.links[link.ID] = &link
+	s.byToken[link.Token] = link.ID
+	if err := s.saveLocked(); err != nil {
+		delete(s.links, link.ID)
+		delete(s.byToken, link.Token)
+		return nil, err
+	}
+	return publicLink(&link), nil
+}
+
+// Get returns a link by ID
+func (s *ShareLinkStore) Get(id string) (*ShareLink, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.links[id]
+	if !ok {
+		return nil, ErrLinkNotFound
+	}
+	return publicLink(l), nil
+}
+
+// List returns the links matching filter (all links if nil), newest first
+func (s *ShareLinkStore) List(filter func(*ShareLink) bool) []*ShareLink {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pruneLocked(time.Now()) {
+		_ = s.saveLocked()
+	}
+	list := []*ShareLink{}
+	for _, l := range s.links {
+		if filter == nil || filter(l) {
+			list = append(list, publicLink(l))
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	return list
+}
+
+// Delete removes a link; it stops working immediately
+func (s *ShareLinkStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.links[id]
+	if !ok {
+		return ErrLinkNotFound
+	}
+	s.removeLocked(l)
+	return s.saveLocked()
+}
+
+func (s *ShareLinkStore) removeLocked(l *ShareLink) {
+	delete(s.links, l.ID)
+	delete(s.byToken, l.Token)
+	for g, grant := range s.grants {
+		if grant.linkID == l.ID {
+			delete(s.grants, g)
+		}
+	}
+}
+
+// Resolve returns the usable link for a token. The link is returned along
+// with ErrLinkExpired or ErrLinkExhausted once it can no longer be used.
+func (s *ShareLinkStore) Resolve(token string) (*ShareLink, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, ok := s.byToken[token]
+	if !ok {
+		return nil, ErrLinkNotFound
+	}
+	l := s.links[id]
+	switch {
+	case l.Expired(time.Now()):
+		return publicLink(l), ErrLinkExpired
+	case !l.FileDrop && l.Exhausted():
+		return publicLink(l), ErrLinkExhausted
+	}
+	return publicLink(l), nil
+}
+
+// Unlock checks a link's password and returns a grant that unlocks the
+// link for ShareLinkGrantTTL
+func (s *ShareLinkStore) Unlock(id, password string) (string, error) {
+	s.mu.Lock()
+	l, ok := s.links[id]
+	if !ok {
+		s.mu.Unlock()
+		return "", ErrLinkNotFound
+	}
+	phc := l.PasswordHash
+	s.mu.Unlock()
+
+	// Verify outside the lock; Argon2 is deliberately slow
+	if phc != "" && !hash.VerifyPassword(phc, password) {
+		return "", ErrLinkPassword
+	}
+	grant, err := newLinkToken()
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for g, lg := range s.grants {
+		if now.After(lg.expires) {
+			delete(s.grants, g)
+		}
+	}
+	s.grants[grant] = linkGrant{linkID: id, expires: now.Add(ShareLinkGrantTTL)}
+	return grant, nil
+}
+
+// Unlocked reports whether a visitor may use a link: it has no password or
+// grant was handed out for it by Unlock
+func (s *ShareLinkStore) Unlocked(id, grant string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.links[id]
+	if !ok {
+		return false
+	}
+	if !l.HasPassword {
+		return true
+	}
+	g, ok := s.grants[grant]
+	return ok && g.linkID == id && time.Now().Before(g.expires)
+}
+
+// CountDownload records a download, failing once the link's download limit
+// is reached
+func (s *ShareLinkStore) CountDownload(id string) (*ShareLink, error) {
+	return s.count(id, func(l *ShareLink) error {
+		if l.Exhausted() {
+			return ErrLinkExhausted
+		}
+		l.Downloads++
+		return nil
+	})
+}
+
+// CountUpload records a file dropped through the link
+func (s *ShareLinkStore) CountUpload(id string) (*ShareLink, error) {
+	return s.count(id, func(l *ShareLink) error {
+		l.Uploads++
+		return nil
+	})
+}
+
+// Touch records an access that does not count against the link's limits
+func (s *ShareLinkStore) Touch(id string) {
+	_, _ = s.count(id, func(*ShareLink) error { return nil })
+}
+
+func (s *ShareLinkStore) count(id string, fn func(*ShareLink) error) (*ShareLink, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.links[id]
+	if !ok {
+		return nil, ErrLinkNotFound
+	}
+	now := time.Now().UTC()
+	if l.Expired(now) {
+		return publicLink(l), ErrLinkExpired
+	}
+	prev := *l
+	if err := fn(l); err != nil {
+		return publicLink(l), err
+	}
+	l.LastAccessAt = &now
+	if err := s.saveLocked(); err != nil {
+		*l = prev
+		return nil, err
+	}
+	return publicLink(l), nil
+}
+
+// pruneLocked drops links that expired longer than shareLinkRetention ago.
+// It reports whether anything was dropped.
+func (s *ShareLinkStore) pruneLocked(now time.Time) bool {
+	changed := false
+	for _, l := range s.links {
+		if l.ExpiresAt != nil && now.Sub(*l.ExpiresAt) > shareLinkRetention {
+			s.removeLocked(l)
+			changed = true
+		}
+	}
+	return changed
+}
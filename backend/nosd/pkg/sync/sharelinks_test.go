@@ -0,0 +1,82 @@
+package sync
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestShareLinkStoreLimits(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewShareLinkStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := s.Create(ShareLink{ShareID: "s1", Path: "doc.txt", MaxDownloads: 2, CreatedBy: "u1"}, "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Token == "" || l.PasswordHash != "" || !l.HasPassword {
+		t.Fatalf("created link: %+v", l)
+	}
+
+	// Password links stay locked until unlocked with the right password
+	if s.Unlocked(l.ID, "") {
+		t.Error("password link unlocked without a grant")
+	}
+	if _, err := s.Unlock(l.ID, "wrong"); !errors.Is(err, ErrLinkPassword) {
+		t.Errorf("unlock with wrong password: %v", err)
+	}
+	grant, err := s.Unlock(l.ID, "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Unlocked(l.ID, grant) {
+		t.Error("grant does not unlock the link")
+	}
+
+	// Downloads stop at the limit, also after a restart
+	for i := 0; i < 2; i++ {
+		if _, err := s.CountDownload(l.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err = NewShareLinkStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CountDownload(l.ID); !errors.Is(err, ErrLinkExhausted) {
+		t.Errorf("download past the limit: %v", err)
+	}
+	if _, err := s.Resolve(l.Token); !errors.Is(err, ErrLinkExhausted) {
+		t.Errorf("resolve of used-up link: %v", err)
+	}
+	if s.Unlocked(l.ID, grant) {
+		t.Error("grant survived a restart")
+	}
+
+	// Expired links are refused, then dropped after the retention period
+	past := time.Now().Add(-time.Minute)
+	expired, err := s.Create(ShareLink{ShareID: "s1", ExpiresAt: &past}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Resolve(expired.Token); !errors.Is(err, ErrLinkExpired) {
+		t.Errorf("resolve of expired link: %v", err)
+	}
+	longAgo := time.Now().Add(-shareLinkRetention - time.Hour)
+	if _, err := s.Create(ShareLink{ShareID: "s1", ExpiresAt: &longAgo}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s.List(nil)); n != 2 {
+		t.Errorf("listed %d links, want 2", n)
+	}
+
+	if err := s.Delete(l.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Resolve(l.Token); !errors.Is(err, ErrLinkNotFound) {
+		t.Errorf("resolve of deleted link: %v", err)
+	}
+}
@@ -169,6 +169,21 @@ func (s *Store) ListDevicesByUser(userID string) []*DeviceToken {
 	return devices
 }
 
+// ListDevices returns all devices that are not revoked
+func (s *Store) ListDevices() []*DeviceToken {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var devices []*DeviceToken
+	for _, device := range s.devices {
+		if device.RevokedAt == nil {
+			copy := *device
+			devices = append(devices, &copy)
+		}
+	}
+	return devices
+}
+
 // DeleteDevice removes a device (soft delete by setting RevokedAt)
 func (s *Store) DeleteDevice(deviceID string) error {
 	s.mu.Lock()
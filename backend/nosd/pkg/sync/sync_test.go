@@ -98,15 +98,11 @@ func TestDefaultDeviceScopes(t *testing.T) {
 }
 
 func TestCursorEncodeDecode(t *testing.T) {
-	original := &Cursor{
-		Timestamp:   time.Now(),
-		FileHashes:  map[string]string{"file1.txt": "abc123", "file2.txt": "def456"},
-		LastScanned: time.Now(),
-	}
+	original := &Cursor{Epoch: "a1b2c3d4e5f6", Seq: 421337}
 
 	encoded := EncodeCursor(original)
-	if encoded == "" {
-		t.Fatal("EncodeCursor returned empty string")
+	if encoded != "a1b2c3d4e5f6.421337" {
+		t.Fatalf("EncodeCursor = %q, want compact epoch.seq form", encoded)
 	}
 
 	decoded, err := DecodeCursor(encoded)
@@ -114,14 +110,11 @@ func TestCursorEncodeDecode(t *testing.T) {
 		t.Fatalf("DecodeCursor failed: %v", err)
 	}
 
-	if len(decoded.FileHashes) != len(original.FileHashes) {
-		t.Errorf("FileHashes length mismatch: got %d, want %d", len(decoded.FileHashes), len(original.FileHashes))
+	if decoded.Epoch != original.Epoch {
+		t.Errorf("Epoch mismatch: got %v, want %v", decoded.Epoch, original.Epoch)
 	}
-
-	for path, hash := range original.FileHashes {
-		if decoded.FileHashes[path] != hash {
-			t.Errorf("FileHash mismatch for %s: got %v, want %v", path, decoded.FileHashes[path], hash)
-		}
+	if decoded.Seq != original.Seq {
+		t.Errorf("Seq mismatch: got %v, want %v", decoded.Seq, original.Seq)
 	}
 }
 
@@ -184,6 +177,11 @@ func TestChangeTrackerExcludePatterns(t *testing.T) {
 		{"Thumbs.db", "Thumbs.db", "Thumbs.db", true},
 		{"git dir", ".git", ".git", true},
 		{"swap file", "file.swp", "file.swp", true},
+		{"manifest being assembled", ".nos-assemble-123", "dir/.nos-assemble-123", true},
+		{"upload session", ".nos-upload-123", "dir/.nos-upload-123", true},
+		{"version history", ".nos-versions", ".nos-versions", true},
+		{"trash", ".nos-trash", ".nos-trash", true},
+		{"user file with the server prefix", ".nos-notes", ".nos-notes", false},
 		{"normal file", "document.pdf", "document.pdf", false},
 		{"nested normal", "report.docx", "folder/report.docx", false},
 	}
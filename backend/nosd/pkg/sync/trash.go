@@ -0,0 +1,337 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"nithronos/backend/nosd/internal/fsatomic"
+)
+
+// TrashDir is the hidden directory in a share root that holds deleted files
+// until they expire, are restored or purged. Moving them there is a rename,
+// so deleting costs no copy.
+const TrashDir = ".nos-trash"
+
+// DefaultTrashRetention is how long deleted files are kept in shares
+// without their own policy
+const DefaultTrashRetention = 30 * 24 * time.Hour
+
+// ErrTrashItemNotFound is returned for unknown, restored or purged items
+var ErrTrashItemNotFound = errors.New("trash item not found")
+
+// TrashPolicy is the trash setting of a share. Items older than Retention
+// are purged; zero keeps them until purged by hand.
+type TrashPolicy struct {
+	Enabled   bool
+	Retention time.Duration
+}
+
+// DefaultTrashPolicy returns the policy of shares that have not set one
+func DefaultTrashPolicy() TrashPolicy {
+	return TrashPolicy{Enabled: true, Retention: DefaultTrashRetention}
+}
+
+// TrashItem is a deleted file or folder of a share
+type TrashItem struct {
+	ID        string    `json:"id"`
+	ShareID   string    `json:"share_id"`
+	Path      string    `json:"path"` // original share-relative path
+	IsDir     bool      `json:"is_dir"`
+	Size      int64     `json:"size"`  // bytes on disk
+	Files     int       `json:"files"` // files deleted with it, 1 for a file
+	DeletedAt time.Time `json:"deleted_at"`
+	DeviceID  string    `json:"device_id,omitempty"` // device that deleted it
+}
+
+// TrashStore moves deleted share files into the share's trash directory and
+// keeps an index of what is there
+type TrashStore struct {
+	indexPath string
+	shareRoot func(shareID string) (string, bool)
+	policy    func(shareID string) TrashPolicy
+
+	mu    sync.Mutex
+	items map[string]*TrashItem
+}
+
+// NewTrashStore opens the trash index in dir. shareRoot resolves a share ID
+// to the directory holding its files and policy returns its trash setting.
+func NewTrashStore(dir string, shareRoot func(shareID string) (string, bool), policy func(shareID string) TrashPolicy) (*TrashStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create trash directory: %w", err)
+	}
+	s := &TrashStore{
+		indexPath: filepath.Join(dir, "trash.json"),
+		shareRoot: shareRoot,
+		policy:    policy,
+		items:     make(map[string]*TrashItem),
+	}
+	if _, err := fsatomic.LoadJSON(s.indexPath, &s.items); err != nil {
+		return nil, fmt.Errorf("failed to load trash index: %w", err)
+	}
+	if s.items == nil {
+		s.items = make(map[string]*TrashItem)
+	}
+	if err := s.Expire(); err != nil {
+		return nil, err
+	}
+	go s.expireRoutine()
+	return s, nil
+}
+
+func (s *TrashStore) saveLocked() error {
+	return fsatomic.WithLock(s.indexPath, func() error {
+		return fsatomic.SaveJSON(context.TODO(), s.indexPath, s.items, 0o600)
+	})
+}
+
+// blobPath returns where an item's content is kept
+func (s *TrashStore) blobPath(item *TrashItem) (string, bool) {
+	root, ok := s.shareRoot(item.ShareID)
+	if !ok {
+		return "", false
+	}
+	return filepath.Join(root, TrashDir, item.ID), true
+}
+
+// Enabled reports whether deletes in a share go to its trash
+func (s *TrashStore) Enabled(shareID string) bool {
+	return s.policy(shareID).Enabled
+}
+
+// Trash moves a share file or folder into the trash. It returns
+// os.ErrNotExist if there is nothing at relPath.
+func (s *TrashStore) Trash(shareID, relPath, deviceID string) (*TrashItem, error) {
+	relPath = strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(relPath)), "/")
+	if relPath == "" || IsServerPath(relPath) {
+		return nil, os.ErrPermission
+	}
+	root, ok := s.shareRoot(shareID)
+	if !ok {
+		return nil, ErrTrashItemNotFound
+	}
+	src := filepath.Join(root, filepath.FromSlash(relPath))
+	info, err := os.Lstat(src)
+	if err != nil {
+		return nil, err
+	}
+
+	item := &TrashItem{
+		ID:        uuid.New().String(),
+		ShareID:   shareID,
+		Path:      relPath,
+		IsDir:     info.IsDir(),
+		DeletedAt: time.Now().UTC(),
+		DeviceID:  deviceID,
+	}
+	item.Files, item.Size = CountTree(src)
+	dst := filepath.Join(root, TrashDir, item.ID)
+	if err := os.MkdirAll(filepath.Dir(dst), 0o700); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(src, dst); err != nil {
+		return nil, fmt.Errorf("failed to move %s to trash: %w", relPath, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.items[item.ID] = item
+	if err := s.saveLocked(); err != nil {
+		delete(s.items, item.ID)
+		if rerr := os.Rename(dst, src); rerr != nil {
+			return nil, fmt.Errorf("%w (deleted content left in %s: %v)", err, dst, rerr)
+		}
+		return nil, err
+	}
+	cp := *item
+	return &cp, nil
+}
+
+// List returns the items in a share's trash, newest first
+func (s *TrashStore) List(shareID string) []*TrashItem {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := []*TrashItem{}
+	for _, item := range s.items {
+		if item.ShareID == shareID {
+			cp := *item
+			list = append(list, &cp)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].DeletedAt.After(list[j].DeletedAt) })
+	return list
+}
+
+// Get returns an item in a share's trash
+func (s *TrashStore) Get(shareID, id string) (*TrashItem, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, ok := s.items[id]
+	if !ok || item.ShareID != shareID {
+		return nil, ErrTrashItemNotFound
+	}
+	cp := *item
+	return &cp, nil
+}
+
+// Restore moves an item back to its original path. If something new took
+// that path since, the item is restored next to it under a numbered name.
+// It returns the path the item was restored to.
+func (s *TrashStore) Restore(shareID, id string) (*TrashItem, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, ok := s.items[id]
+	if !ok || item.ShareID != shareID {
+		return nil, "", ErrTrashItemNotFound
+	}
+	blob, ok := s.blobPath(item)
+	if !ok {
+		return nil, "", ErrTrashItemNotFound
+	}
+	root, _ := s.shareRoot(shareID)
+
+	target := item.Path
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(filepath.Join(root, filepath.FromSlash(target))); os.IsNotExist(err) {
+			break
+		}
+		if i > 100 {
+			return nil, "", fmt.Errorf("no free name to restore %s", item.Path)
+		}
+		ext := path.Ext(item.Path)
+		target = fmt.Sprintf("%s (restored %d)%s", strings.TrimSuffix(item.Path, ext), i, ext)
+	}
+	dst := filepath.Join(root, filepath.FromSlash(target))
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return nil, "", err
+	}
+	if err := os.Rename(blob, dst); err != nil {
+		if os.IsNotExist(err) {
+			delete(s.items, id)
+			_ = s.saveLocked()
+			return nil, "", ErrTrashItemNotFound
+		}
+		return nil, "", err
+	}
+	delete(s.items, id)
+	if err := s.saveLocked(); err != nil {
+		return nil, "", err
+	}
+	return item, target, nil
+}
+
+// Purge permanently deletes an item
+func (s *TrashStore) Purge(shareID, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, ok := s.items[id]
+	if !ok || item.ShareID != shareID {
+		return ErrTrashItemNotFound
+	}
+	if err := s.removeLocked(item); err != nil {
+		return err
+	}
+	return s.saveLocked()
+}
+
+// Empty permanently deletes everything in a share's trash and returns the
+// number of items purged
+func (s *TrashStore) Empty(shareID string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, item := range s.items {
+		if item.ShareID != shareID {
+			continue
+		}
+		if err := s.removeLocked(item); err != nil {
+			_ = s.saveLocked()
+			return n, err
+		}
+		n++
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	return n, s.saveLocked()
+}
+
+// Expire purges items past their share's retention and forgets those of
+// removed shares
+func (s *TrashStore) Expire() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	changed := false
+	for _, item := range s.items {
+		if _, ok := s.shareRoot(item.ShareID); !ok {
+			delete(s.items, item.ID)
+			changed = true
+			continue
+		}
+		p := s.policy(item.ShareID)
+		if p.Retention > 0 && now.Sub(item.DeletedAt) > p.Retention {
+			if err := s.removeLocked(item); err != nil {
+				continue
+			}
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return s.saveLocked()
+}
+
+func (s *TrashStore) removeLocked(item *TrashItem) error {
+	if blob, ok := s.blobPath(item); ok {
+		if err := os.RemoveAll(blob); err != nil {
+			return err
+		}
+	}
+	delete(s.items, item.ID)
+	return nil
+}
+
+// expireRoutine purges expired items hourly
+func (s *TrashStore) expireRoutine() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for range ticker.C {
+		_ = s.Expire()
+	}
+}
+
+// CountTree returns the number of files below a path (1 for a file) and
+// their size
+func CountTree(p string) (files int, size int64) {
+	_ = filepath.WalkDir(p, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		files++
+		if info, err := d.Info(); err == nil {
+			size += info.Size()
+		}
+		return nil
+	})
+	return files, size
+}
+
+// IsServerPath reports whether a share-relative path lies in a directory
+// the server keeps for itself (versions, trash)
+func IsServerPath(relPath string) bool {
+	first := strings.SplitN(strings.TrimPrefix(filepath.ToSlash(relPath), "/"), "/", 2)[0]
+	return first == VersionsDir || first == TrashDir
+}
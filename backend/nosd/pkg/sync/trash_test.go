@@ -0,0 +1,177 @@
+package sync
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestTrashStoreTrashRestore(t *testing.T) {
+	shareDir := t.TempDir()
+	root := func(id string) (string, bool) { return shareDir, id == "s1" }
+	s, err := NewTrashStore(t.TempDir(), root, func(string) TrashPolicy { return DefaultTrashPolicy() })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(shareDir, "photos", "2024"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"photos/a.jpg", "photos/2024/b.jpg", "notes.txt"} {
+		if err := os.WriteFile(filepath.Join(shareDir, filepath.FromSlash(name)), []byte("data"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir, err := s.Trash("s1", "photos", "d1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dir.IsDir || dir.Files != 2 || dir.Size != 8 || dir.DeviceID != "d1" {
+		t.Errorf("trashed folder = %+v", dir)
+	}
+	if _, err := os.Stat(filepath.Join(shareDir, "photos")); !os.IsNotExist(err) {
+		t.Errorf("trashed folder still in place: %v", err)
+	}
+	if _, err := s.Trash("s1", "photos", "d1"); !os.IsNotExist(err) {
+		t.Errorf("trashing a missing path: %v", err)
+	}
+	if _, err := s.Trash("s1", TrashDir+"/x", "d1"); err == nil {
+		t.Error("trash directory was trashed")
+	}
+
+	// A new file took the old name, so the restore lands next to it
+	if err := os.WriteFile(filepath.Join(shareDir, "photos"), []byte("new"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, restored, err := s.Restore("s1", dir.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored != "photos (restored 1)" {
+		t.Errorf("restored to %q", restored)
+	}
+	if _, err := os.Stat(filepath.Join(shareDir, restored, "2024", "b.jpg")); err != nil {
+		t.Errorf("restored folder content: %v", err)
+	}
+	if _, _, err := s.Restore("s1", dir.ID); !errors.Is(err, ErrTrashItemNotFound) {
+		t.Errorf("second restore: %v", err)
+	}
+
+	// Purged items are gone for good
+	file, err := s.Trash("s1", "notes.txt", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("s2", file.ID); !errors.Is(err, ErrTrashItemNotFound) {
+		t.Errorf("item read through another share: %v", err)
+	}
+	if err := s.Purge("s1", file.ID); err != nil {
+		t.Fatal(err)
+	}
+	if list := s.List("s1"); len(list) != 0 {
+		t.Errorf("trash holds %d items after purge", len(list))
+	}
+	if _, err := os.Stat(filepath.Join(shareDir, TrashDir, file.ID)); !os.IsNotExist(err) {
+		t.Errorf("purged content still on disk: %v", err)
+	}
+}
+
+func TestTrashStoreExpire(t *testing.T) {
+	shareDir := t.TempDir()
+	root := func(id string) (string, bool) { return shareDir, id == "s1" }
+	policy := TrashPolicy{Enabled: true, Retention: time.Hour}
+	indexDir := t.TempDir()
+	s, err := NewTrashStore(indexDir, root, func(string) TrashPolicy { return policy })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"old.txt", "new.txt"} {
+		if err := os.WriteFile(filepath.Join(shareDir, name), []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old, err := s.Trash("s1", "old.txt", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Trash("s1", "new.txt", ""); err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	s.items[old.ID].DeletedAt = time.Now().Add(-2 * time.Hour)
+	s.mu.Unlock()
+
+	if err := s.Expire(); err != nil {
+		t.Fatal(err)
+	}
+	list := s.List("s1")
+	if len(list) != 1 || list[0].Path != "new.txt" {
+		t.Fatalf("after expiry: %+v", list)
+	}
+	if _, err := os.Stat(filepath.Join(shareDir, TrashDir, old.ID)); !os.IsNotExist(err) {
+		t.Errorf("expired content still on disk: %v", err)
+	}
+
+	// The index survives a restart
+	reopened, err := NewTrashStore(indexDir, root, func(string) TrashPolicy { return policy })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list := reopened.List("s1"); len(list) != 1 {
+		t.Errorf("reopened trash holds %d items", len(list))
+	}
+}
+
+func TestDeviceManagerMassDeleteBreaker(t *testing.T) {
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveDevice(&DeviceToken{ID: "d1", UserID: "u1", CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultDeviceManagerConfig()
+	cfg.MaxDeletes = 10
+	dm := NewDeviceManager(store, zerolog.Nop(), cfg)
+	var notified *DeviceToken
+	dm.OnPause(func(d *DeviceToken) { notified = d })
+
+	if dm.RecordDeletes("d1", 6) || dm.PauseOf("d1") != nil {
+		t.Fatal("device paused below the limit")
+	}
+	if !dm.RecordDeletes("d1", 5) {
+		t.Fatal("device not paused above the limit")
+	}
+	pause := dm.PauseOf("d1")
+	if pause == nil || pause.Deletes != 11 {
+		t.Fatalf("pause = %+v", pause)
+	}
+	if notified == nil || notified.ID != "d1" {
+		t.Errorf("pause not reported: %+v", notified)
+	}
+	if paused := dm.PausedDevices(); len(paused) != 1 {
+		t.Errorf("%d paused devices", len(paused))
+	}
+
+	resumed, err := dm.ResumeDevice("d1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed.Paused == nil {
+		t.Error("resume does not report the lifted pause")
+	}
+	if dm.PauseOf("d1") != nil {
+		t.Error("device still paused after resume")
+	}
+	// The window starts over after a resume
+	if dm.RecordDeletes("d1", 1) {
+		t.Error("device paused again by earlier deletes")
+	}
+	if _, err := dm.ResumeDevice("d1"); err == nil {
+		t.Error("resumed a device that is not paused")
+	}
+}
@@ -48,22 +48,35 @@ type DeviceToken struct {
 	// Statistics
 	SyncCount   int64 `json:"sync_count"`
 	BytesSynced int64 `json:"bytes_synced"`
+
+	// Set while the mass-delete breaker holds the device's changes
+	Paused *DevicePause `json:"paused,omitempty"`
+}
+
+// DevicePause records why a device was paused. A paused device can read
+// but not change share files until an admin resumes it.
+type DevicePause struct {
+	PausedAt      time.Time `json:"paused_at"`
+	Reason        string    `json:"reason"`
+	Deletes       int       `json:"deletes"`        // files deleted within the window
+	WindowSeconds int       `json:"window_seconds"` // breaker window
 }
 
 // DeviceTokenPublic is the public view of a device token (for API responses)
 type DeviceTokenPublic struct {
-	ID            string     `json:"id"`
-	DeviceName    string     `json:"device_name"`
-	DeviceType    DeviceType `json:"device_type"`
-	OSVersion     string     `json:"os_version,omitempty"`
-	ClientVersion string     `json:"client_version,omitempty"`
-	CreatedAt     time.Time  `json:"created_at"`
-	LastSyncAt    *time.Time `json:"last_sync_at,omitempty"`
-	LastSeenAt    *time.Time `json:"last_seen_at,omitempty"`
-	LastIP        string     `json:"last_ip,omitempty"`
-	SyncCount     int64      `json:"sync_count"`
-	BytesSynced   int64      `json:"bytes_synced"`
-	IsRevoked     bool       `json:"is_revoked"`
+	ID            string       `json:"id"`
+	DeviceName    string       `json:"device_name"`
+	DeviceType    DeviceType   `json:"device_type"`
+	OSVersion     string       `json:"os_version,omitempty"`
+	ClientVersion string       `json:"client_version,omitempty"`
+	CreatedAt     time.Time    `json:"created_at"`
+	LastSyncAt    *time.Time   `json:"last_sync_at,omitempty"`
+	LastSeenAt    *time.Time   `json:"last_seen_at,omitempty"`
+	LastIP        string       `json:"last_ip,omitempty"`
+	SyncCount     int64        `json:"sync_count"`
+	BytesSynced   int64        `json:"bytes_synced"`
+	IsRevoked     bool         `json:"is_revoked"`
+	Paused        *DevicePause `json:"paused,omitempty"`
 }
 
 // ToPublic converts a DeviceToken to its public representation
@@ -81,6 +94,7 @@ func (d *DeviceToken) ToPublic() DeviceTokenPublic {
 		SyncCount:     d.SyncCount,
 		BytesSynced:   d.BytesSynced,
 		IsRevoked:     d.RevokedAt != nil,
+		Paused:        d.Paused,
 	}
 }
 
@@ -95,6 +109,7 @@ type SyncShare struct {
 	MaxSyncSize     int64    `json:"max_sync_size,omitempty"`    // 0 = unlimited
 	ExcludePatterns []string `json:"exclude_patterns,omitempty"` // e.g., ["*.tmp", ".git"]
 	AllowedUsers    []string `json:"allowed_users,omitempty"`    // Empty = all share users
+	E2E             bool     `json:"e2e,omitempty"`              // Clients encrypt contents and names
 }
 
 // SyncConfig represents device-specific sync configuration
@@ -156,7 +171,8 @@ type BlockHash struct {
 // BlockHashRequest is the request for computing block hashes
 type BlockHashRequest struct {
 	Path      string `json:"path"`
-	BlockSize int64  `json:"block_size"` // Default: 4MB
+	BlockSize int64  `json:"block_size"`     // Default: 4MB, or the average chunk size in cdc mode
+	Mode      string `json:"mode,omitempty"` // "fixed" (default) or "cdc"
 }
 
 // BlockHashResponse is the response containing block hashes
@@ -165,9 +181,33 @@ type BlockHashResponse struct {
 	Size      int64       `json:"size"`
 	Hash      string      `json:"hash"` // Full file hash
 	BlockSize int64       `json:"block_size"`
+	Mode      string      `json:"mode"`
+	MinSize   int64       `json:"min_block_size,omitempty"` // cdc mode chunk bounds
+	MaxSize   int64       `json:"max_block_size,omitempty"`
 	Blocks    []BlockHash `json:"blocks"`
 }
 
+// ManifestChunk is one chunk of a file manifest
+type ManifestChunk struct {
+	Hash string `json:"hash"` // SHA-256 of the chunk
+	Size int64  `json:"size"`
+}
+
+// FileManifest describes a file as a list of chunks for a delta upload
+type FileManifest struct {
+	Path   string          `json:"path"`
+	Size   int64           `json:"size"`
+	Hash   string          `json:"hash"` // Full file hash
+	MTime  *time.Time      `json:"mtime,omitempty"`
+	Chunks []ManifestChunk `json:"chunks"`
+}
+
+// MissingChunksRequest asks which chunks must be uploaded for a share
+type MissingChunksRequest struct {
+	ShareID string   `json:"share_id"`
+	Hashes  []string `json:"hashes"`
+}
+
 // SyncState represents the sync state for a device and share
 type SyncState struct {
 	DeviceID   string               `json:"device_id"`
@@ -0,0 +1,392 @@
+package sync
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"nithronos/backend/nosd/internal/fsatomic"
+)
+
+// DefaultUploadTTL is how long an upload session survives without progress
+const DefaultUploadTTL = 24 * time.Hour
+
+// UploadStagingPrefix marks the file an upload session writes to. It sits
+// next to the target so finalizing is a rename; change detection ignores
+// it.
+const UploadStagingPrefix = ".nos-upload-"
+
+var (
+	// ErrUploadNotFound is returned for unknown, expired or foreign sessions
+	ErrUploadNotFound = errors.New("upload session not found")
+	// ErrUploadOffsetMismatch is returned when a chunk does not continue the upload
+	ErrUploadOffsetMismatch = errors.New("upload offset does not match")
+	// ErrUploadTooLarge is returned when a request carries more data than the
+	// upload's declared size or the per-request limit allows
+	ErrUploadTooLarge = errors.New("upload data exceeds the allowed size")
+	// ErrUploadIncomplete is returned when finalizing before all data arrived
+	ErrUploadIncomplete = errors.New("upload is incomplete")
+	// ErrUploadHashMismatch is returned when the uploaded file does not match its hash
+	ErrUploadHashMismatch = errors.New("uploaded file does not match its hash")
+	// ErrUploadBusy is returned while another request writes to the session
+	ErrUploadBusy = errors.New("upload session is busy")
+)
+
+// UploadSession is a resumable upload of one file into a share
+type UploadSession struct {
+	ID        string     `json:"id"`
+	ShareID   string     `json:"share_id"`
+	DeviceID  string     `json:"device_id"`
+	UserID    string     `json:"user_id"`
+	Path      string     `json:"path"`
+	Size      int64      `json:"size"`
+	Offset    int64      `json:"offset"`
+	Hash      string     `json:"hash,omitempty"` // expected SHA-256, checked on finalize
+	MTime     *time.Time `json:"mtime,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+}
+
+// UploadManager keeps resumable upload sessions. Received data is written to
+// a staging file in the target directory and only replaces the target once
+// the upload is finalized.
+type UploadManager struct {
+	path      string
+	ttl       time.Duration
+	shareRoot func(shareID string) (string, bool)
+
+	mu            sync.Mutex
+	sessions      map[string]*UploadSession
+	busy          map[string]bool
+	beforeReplace func(s *UploadSession)
+}
+
+// NewUploadManager loads the upload sessions persisted in dir
+func NewUploadManager(dir string, shareRoot func(shareID string) (string, bool)) (*UploadManager, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create upload directory: %w", err)
+	}
+	m := &UploadManager{
+		path:      filepath.Join(dir, "uploads.json"),
+		ttl:       DefaultUploadTTL,
+		shareRoot: shareRoot,
+		sessions:  make(map[string]*UploadSession),
+		busy:      make(map[string]bool),
+	}
+	if _, err := fsatomic.LoadJSON(m.path, &m.sessions); err != nil {
+		return nil, fmt.Errorf("failed to load upload sessions: %w", err)
+	}
+	if m.sessions == nil {
+		m.sessions = make(map[string]*UploadSession)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expireLocked(time.Now())
+	go m.expireRoutine()
+	return m, nil
+}
+
+// BeforeReplace registers fn to run before a finalized upload is moved over
+// its target, such as to keep the previous version
+func (m *UploadManager) BeforeReplace(fn func(s *UploadSession)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.beforeReplace = fn
+}
+
+func (m *UploadManager) saveLocked() error {
+	return fsatomic.WithLock(m.path, func() error {
+		return fsatomic.SaveJSON(context.TODO(), m.path, m.sessions, 0o600)
+	})
+}
+
+// stagingPath returns where a session's data is written
+func (m *UploadManager) stagingPath(s *UploadSession) (string, bool) {
+	root, ok := m.shareRoot(s.ShareID)
+	if !ok {
+		return "", false
+	}
+	dir := filepath.Dir(filepath.Join(root, filepath.FromSlash(s.Path)))
+	return filepath.Join(dir, UploadStagingPrefix+s.ID), true
+}
+
+// targetPath returns the file a session replaces
+func (m *UploadManager) targetPath(s *UploadSession) (string, bool) {
+	root, ok := m.shareRoot(s.ShareID)
+	if !ok {
+		return "", false
+	}
+	return filepath.Join(root, filepath.FromSlash(s.Path)), true
+}
+
+// Create starts an upload session. ShareID, DeviceID, UserID, Path and Size
+// must be set; Path is relative to the share.
+func (m *UploadManager) Create(s *UploadSession) (*UploadSession, error) {
+	now := time.Now().UTC()
+	s.ID = uuid.New().String()
+	s.Offset = 0
+	s.Hash = strings.ToLower(s.Hash)
+	s.CreatedAt = now
+	s.UpdatedAt = now
+	s.ExpiresAt = now.Add(m.ttl)
+
+	staging, ok := m.stagingPath(s)
+	if !ok {
+		return nil, ErrUploadNotFound
+	}
+	if err := os.MkdirAll(filepath.Dir(staging), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(staging, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expireLocked(now)
+	m.sessions[s.ID] = s
+	if err := m.saveLocked(); err != nil {
+		delete(m.sessions, s.ID)
+		os.Remove(staging)
+		return nil, err
+	}
+	cp := *s
+	return &cp, nil
+}
+
+// Get returns a session owned by the device
+func (m *UploadManager) Get(id, deviceID string) (*UploadSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	if !ok || s.DeviceID != deviceID || time.Now().After(s.ExpiresAt) {
+		return nil, ErrUploadNotFound
+	}
+	cp := *s
+	return &cp, nil
+}
+
+// List returns the device's sessions
+func (m *UploadManager) List(deviceID string) []*UploadSession {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	list := []*UploadSession{}
+	for _, s := range m.sessions {
+		if s.DeviceID == deviceID && now.Before(s.ExpiresAt) {
+			cp := *s
+			list = append(list, &cp)
+		}
+	}
+	return list
+}
+
+// acquire marks a session busy so only one request writes to it at a time
+func (m *UploadManager) acquire(id, deviceID string) (*UploadSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	if !ok || s.DeviceID != deviceID || time.Now().After(s.ExpiresAt) {
+		return nil, ErrUploadNotFound
+	}
+	if m.busy[id] {
+		return nil, ErrUploadBusy
+	}
+	m.busy[id] = true
+	return s, nil
+}
+
+func (m *UploadManager) release(id string) {
+	m.mu.Lock()
+	delete(m.busy, id)
+	m.mu.Unlock()
+}
+
+// Write appends data at offset, which must be the session's current offset.
+// Data received before a dropped connection is kept, so the client resumes
+// from the returned offset. At most maxChunk bytes are read.
+func (m *UploadManager) Write(id, deviceID string, offset int64, r io.Reader, maxChunk int64) (*UploadSession, error) {
+	s, err := m.acquire(id, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer m.release(id)
+
+	if offset != s.Offset {
+		cp := *s
+		return &cp, ErrUploadOffsetMismatch
+	}
+	staging, ok := m.stagingPath(s)
+	if !ok {
+		return nil, ErrUploadNotFound
+	}
+	f, err := os.OpenFile(staging, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	limit := s.Size - offset
+	if limit > maxChunk {
+		limit = maxChunk
+	}
+	n, copyErr := io.Copy(io.NewOffsetWriter(f, offset), io.LimitReader(r, limit))
+	if copyErr == nil && n == limit {
+		// The request must not carry more than the upload or one request may
+		var probe [1]byte
+		if k, _ := r.Read(probe[:]); k > 0 {
+			copyErr = ErrUploadTooLarge
+		}
+	}
+	if err := f.Sync(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if n > 0 {
+		now := time.Now().UTC()
+		s.Offset += n
+		s.UpdatedAt = now
+		s.ExpiresAt = now.Add(m.ttl)
+		if err := m.saveLocked(); err != nil && copyErr == nil {
+			copyErr = err
+		}
+	}
+	cp := *s
+	return &cp, copyErr
+}
+
+// Finalize checks a complete upload and moves it into place
+func (m *UploadManager) Finalize(id, deviceID string) (*UploadSession, error) {
+	s, err := m.acquire(id, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer m.release(id)
+
+	if s.Offset != s.Size {
+		cp := *s
+		return &cp, ErrUploadIncomplete
+	}
+	staging, ok := m.stagingPath(s)
+	target, ok2 := m.targetPath(s)
+	if !ok || !ok2 {
+		return nil, ErrUploadNotFound
+	}
+	// Drop bytes a dropped request may have left past the recorded offset
+	if err := os.Truncate(staging, s.Size); err != nil {
+		return nil, err
+	}
+	if s.Hash != "" {
+		sum, err := fileSHA256(staging)
+		if err != nil {
+			return nil, err
+		}
+		if sum != s.Hash {
+			cp := *s
+			return &cp, ErrUploadHashMismatch
+		}
+	}
+	if info, err := os.Stat(target); err == nil && info.IsDir() {
+		return nil, fmt.Errorf("%s is a directory", s.Path)
+	}
+	if s.MTime != nil {
+		os.Chtimes(staging, *s.MTime, *s.MTime)
+	}
+	m.mu.Lock()
+	beforeReplace := m.beforeReplace
+	m.mu.Unlock()
+	if beforeReplace != nil {
+		beforeReplace(s)
+	}
+	if err := os.Rename(staging, target); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, id)
+	cp := *s
+	return &cp, m.saveLocked()
+}
+
+// Abort cancels a session and removes its data
+func (m *UploadManager) Abort(id, deviceID string) error {
+	s, err := m.acquire(id, deviceID)
+	if err != nil {
+		return err
+	}
+	defer m.release(id)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.removeLocked(s)
+	return m.saveLocked()
+}
+
+func (m *UploadManager) removeLocked(s *UploadSession) {
+	if staging, ok := m.stagingPath(s); ok {
+		os.Remove(staging)
+	}
+	delete(m.sessions, s.ID)
+}
+
+// Expire drops the sessions that made no progress within the TTL together
+// with their staging files
+func (m *UploadManager) Expire() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expireLocked(time.Now())
+}
+
+// expireRoutine expires sessions hourly, so the staging files of abandoned
+// uploads don't wait for the next upload
+func (m *UploadManager) expireRoutine() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for range ticker.C {
+		m.Expire()
+	}
+}
+
+// expireLocked drops sessions that made no progress within the TTL
+func (m *UploadManager) expireLocked(now time.Time) {
+	changed := false
+	for id, s := range m.sessions {
+		if now.After(s.ExpiresAt) && !m.busy[id] {
+			m.removeLocked(s)
+			changed = true
+		}
+	}
+	if changed {
+		_ = m.saveLocked()
+	}
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
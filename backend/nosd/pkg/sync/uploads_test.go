@@ -0,0 +1,111 @@
+package sync
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// failingReader returns its data and then a read error, like a dropped connection
+type failingReader struct{ r io.Reader }
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection reset")
+	}
+	return n, err
+}
+
+func TestUploadSessionResume(t *testing.T) {
+	shareDir := t.TempDir()
+	stateDir := t.TempDir()
+	root := func(id string) (string, bool) { return shareDir, id == "s1" }
+
+	m, err := NewUploadManager(stateDir, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	s, err := m.Create(&UploadSession{ShareID: "s1", DeviceID: "d1", UserID: "u1", Path: "dir/video.bin", Size: int64(len(data)), Hash: hashOf(data)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The connection drops after 4000 bytes; what arrived is kept
+	got, err := m.Write(s.ID, "d1", 0, &failingReader{bytes.NewReader(data[:4000])}, 1<<20)
+	if err == nil || got.Offset != 4000 {
+		t.Fatalf("interrupted write: offset %v, err %v", got, err)
+	}
+	if _, err := m.Write(s.ID, "d1", 0, bytes.NewReader(data), 1<<20); !errors.Is(err, ErrUploadOffsetMismatch) {
+		t.Errorf("write at stale offset: %v", err)
+	}
+	if _, err := m.Get(s.ID, "d2"); !errors.Is(err, ErrUploadNotFound) {
+		t.Errorf("session visible to another device: %v", err)
+	}
+	if _, err := m.Finalize(s.ID, "d1"); !errors.Is(err, ErrUploadIncomplete) {
+		t.Errorf("finalized incomplete upload: %v", err)
+	}
+
+	// The session survives a restart and resumes at its offset
+	m, err = NewUploadManager(stateDir, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := m.Get(s.ID, "d1")
+	if err != nil || status.Offset != 4000 {
+		t.Fatalf("status after reload: %+v, %v", status, err)
+	}
+	if _, err := m.Write(s.ID, "d1", 4000, bytes.NewReader(append(data[4000:], 'x')), 1<<20); !errors.Is(err, ErrUploadTooLarge) {
+		t.Errorf("oversized write accepted: %v", err)
+	}
+	if _, err := m.Finalize(s.ID, "d1"); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(shareDir, "dir", "video.bin"))
+	if err != nil || !bytes.Equal(content, data) {
+		t.Fatalf("finalized file differs (err %v)", err)
+	}
+	if _, err := os.Stat(filepath.Join(shareDir, "dir", UploadStagingPrefix+s.ID)); !os.IsNotExist(err) {
+		t.Errorf("staging file left behind: %v", err)
+	}
+	if len(m.List("d1")) != 0 {
+		t.Error("finalized session still listed")
+	}
+}
+
+func TestUploadSessionExpiry(t *testing.T) {
+	shareDir := t.TempDir()
+	root := func(id string) (string, bool) { return shareDir, id == "s1" }
+
+	m, err := NewUploadManager(t.TempDir(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := m.Create(&UploadSession{ShareID: "s1", DeviceID: "d1", UserID: "u1", Path: "big.bin", Size: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	staging := filepath.Join(shareDir, UploadStagingPrefix+s.ID)
+
+	m.Expire()
+	if _, err := os.Stat(staging); err != nil {
+		t.Fatalf("live session swept: %v", err)
+	}
+
+	m.mu.Lock()
+	m.sessions[s.ID].ExpiresAt = time.Now().Add(-time.Minute)
+	m.mu.Unlock()
+	m.Expire()
+	if _, err := os.Stat(staging); !os.IsNotExist(err) {
+		t.Errorf("staging file of expired session left behind: %v", err)
+	}
+	if _, err := m.Get(s.ID, "d1"); !errors.Is(err, ErrUploadNotFound) {
+		t.Errorf("expired session still found: %v", err)
+	}
+}
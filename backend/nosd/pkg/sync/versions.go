@@ -0,0 +1,346 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"nithronos/backend/nosd/internal/fsatomic"
+)
+
+// VersionsDir is the hidden directory in a share root that holds previous
+// versions of its files. Keeping them on the share's filesystem lets copies
+// be reflinks; hidden files are ignored by change detection.
+const VersionsDir = ".nos-versions"
+
+// Default version retention for shares without their own policy
+const (
+	DefaultVersionsKept  = 10
+	DefaultVersionMaxAge = 30 * 24 * time.Hour
+)
+
+// Reasons a version was kept
+const (
+	VersionReasonOverwrite = "overwrite"
+	VersionReasonRestore   = "restore"
+)
+
+// ErrVersionNotFound is returned for unknown or pruned versions
+var ErrVersionNotFound = errors.New("version not found")
+
+// VersionPolicy is the version retention of a share. A version is pruned
+// once MaxVersions newer versions of its file exist or it is older than
+// MaxAge; zero disables either limit.
+type VersionPolicy struct {
+	Enabled     bool
+	MaxVersions int
+	MaxAge      time.Duration
+}
+
+// DefaultVersionPolicy returns the policy of shares that have not set one
+func DefaultVersionPolicy() VersionPolicy {
+	return VersionPolicy{
+		Enabled:     true,
+		MaxVersions: DefaultVersionsKept,
+		MaxAge:      DefaultVersionMaxAge,
+	}
+}
+
+// StoredVersion is a previous version of a share file. Its content is kept
+// as stored on disk, so versions of shares encrypted at rest stay encrypted.
+type StoredVersion struct {
+	ID        string    `json:"id"`
+	ShareID   string    `json:"share_id"`
+	Path      string    `json:"path"`
+	Size      int64     `json:"size"`     // size on disk
+	ModTime   time.Time `json:"mod_time"` // modification time of the version
+	CreatedAt time.Time `json:"created_at"`
+	DeviceID  string    `json:"device_id,omitempty"` // device whose change replaced it
+	Reason    string    `json:"reason"`
+}
+
+// VersionStore keeps previous versions of share files before they are
+// overwritten. Copies are reflinks where the filesystem supports them
+// (Btrfs, XFS), so a version only costs the blocks that changed since.
+type VersionStore struct {
+	indexPath string
+	shareRoot func(shareID string) (string, bool)
+	policy    func(shareID string) VersionPolicy
+
+	mu       sync.Mutex
+	versions map[string]*StoredVersion
+}
+
+// NewVersionStore opens the version index in dir. shareRoot resolves a share
+// ID to the directory holding its files and policy returns its retention.
+func NewVersionStore(dir string, shareRoot func(shareID string) (string, bool), policy func(shareID string) VersionPolicy) (*VersionStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create version directory: %w", err)
+	}
+	s := &VersionStore{
+		indexPath: filepath.Join(dir, "versions.json"),
+		shareRoot: shareRoot,
+		policy:    policy,
+		versions:  make(map[string]*StoredVersion),
+	}
+	if _, err := fsatomic.LoadJSON(s.indexPath, &s.versions); err != nil {
+		return nil, fmt.Errorf("failed to load version index: %w", err)
+	}
+	if s.versions == nil {
+		s.versions = make(map[string]*StoredVersion)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pruneLocked(time.Now()) {
+		_ = s.saveLocked()
+	}
+	return s, nil
+}
+
+func (s *VersionStore) saveLocked() error {
+	return fsatomic.WithLock(s.indexPath, func() error {
+		return fsatomic.SaveJSON(context.TODO(), s.indexPath, s.versions, 0o600)
+	})
+}
+
+// blobPath returns where a version's content is kept
+func (s *VersionStore) blobPath(v *StoredVersion) (string, bool) {
+	root, ok := s.shareRoot(v.ShareID)
+	if !ok {
+		return "", false
+	}
+	return filepath.Join(root, VersionsDir, v.ID), true
+}
+
+// Capture keeps the current content of a share file as a version before it
+// is replaced. It returns nil if there is nothing to keep: the file does not
+// exist, is not a regular file or versioning is disabled for the share.
+func (s *VersionStore) Capture(shareID, relPath, deviceID, reason string) (*StoredVersion, error) {
+	if !s.policy(shareID).Enabled || IsServerPath(relPath) {
+		return nil, nil
+	}
+	root, ok := s.shareRoot(shareID)
+	if !ok {
+		return nil, ErrVersionNotFound
+	}
+	src := filepath.Join(root, filepath.FromSlash(relPath))
+	info, err := os.Stat(src)
+	if err != nil || !info.Mode().IsRegular() {
+		return nil, nil
+	}
+
+	v := &StoredVersion{
+		ID:        uuid.New().String(),
+		ShareID:   shareID,
+		Path:      relPath,
+		Size:      info.Size(),
+		ModTime:   info.ModTime().UTC(),
+		CreatedAt: time.Now().UTC(),
+		DeviceID:  deviceID,
+		Reason:    reason,
+	}
+	dst := filepath.Join(root, VersionsDir, v.ID)
+	if err := os.MkdirAll(filepath.Dir(dst), 0o700); err != nil {
+		return nil, err
+	}
+	if err := cloneFile(src, dst); err != nil {
+		return nil, fmt.Errorf("failed to keep version of %s: %w", relPath, err)
+	}
+	os.Chtimes(dst, info.ModTime(), info.ModTime())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.versions[v.ID] = v
+	s.pruneLocked(time.Now())
+	if err := s.saveLocked(); err != nil {
+		delete(s.versions, v.ID)
+		os.Remove(dst)
+		return nil, err
+	}
+	cp := *v
+	return &cp, nil
+}
+
+// List returns the versions of a share file, newest first
+func (s *VersionStore) List(shareID, relPath string) []*StoredVersion {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pruneLocked(time.Now()) {
+		_ = s.saveLocked()
+	}
+	list := []*StoredVersion{}
+	for _, v := range s.versions {
+		if v.ShareID == shareID && v.Path == relPath {
+			cp := *v
+			list = append(list, &cp)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	return list
+}
+
+// Get returns a version of a file in the share
+func (s *VersionStore) Get(shareID, id string) (*StoredVersion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.versions[id]
+	if !ok || v.ShareID != shareID {
+		return nil, ErrVersionNotFound
+	}
+	cp := *v
+	return &cp, nil
+}
+
+// Open opens a version's content for reading
+func (s *VersionStore) Open(shareID, id string) (*StoredVersion, *os.File, error) {
+	v, err := s.Get(shareID, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	blob, ok := s.blobPath(v)
+	if !ok {
+		return nil, nil, ErrVersionNotFound
+	}
+	f, err := os.Open(blob)
+	if os.IsNotExist(err) {
+		return nil, nil, ErrVersionNotFound
+	}
+	return v, f, err
+}
+
+// Restore puts a version back in place of its file. The content it replaces
+// is kept as a version first, so a restore can be undone.
+func (s *VersionStore) Restore(shareID, id, deviceID string) (*StoredVersion, error) {
+	v, err := s.Get(shareID, id)
+	if err != nil {
+		return nil, err
+	}
+	blob, ok := s.blobPath(v)
+	if !ok {
+		return nil, ErrVersionNotFound
+	}
+	root, _ := s.shareRoot(shareID)
+	target := filepath.Join(root, filepath.FromSlash(v.Path))
+	if info, err := os.Stat(target); err == nil && info.IsDir() {
+		return nil, fmt.Errorf("%s is a directory", v.Path)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return nil, err
+	}
+
+	staging := filepath.Join(filepath.Dir(target), UploadStagingPrefix+v.ID)
+	if err := cloneFile(blob, staging); err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrVersionNotFound
+		}
+		return nil, err
+	}
+	if _, err := s.Capture(shareID, v.Path, deviceID, VersionReasonRestore); err != nil {
+		os.Remove(staging)
+		return nil, err
+	}
+	if err := os.Rename(staging, target); err != nil {
+		os.Remove(staging)
+		return nil, err
+	}
+	return v, nil
+}
+
+// Delete removes a version
+func (s *VersionStore) Delete(shareID, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.versions[id]
+	if !ok || v.ShareID != shareID {
+		return ErrVersionNotFound
+	}
+	s.removeLocked(v)
+	return s.saveLocked()
+}
+
+// Prune applies the retention policies of all shares
+func (s *VersionStore) Prune() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.pruneLocked(time.Now()) {
+		return nil
+	}
+	return s.saveLocked()
+}
+
+func (s *VersionStore) removeLocked(v *StoredVersion) {
+	if blob, ok := s.blobPath(v); ok {
+		os.Remove(blob)
+	}
+	delete(s.versions, v.ID)
+}
+
+// pruneLocked drops versions outside their share's retention and those of
+// removed shares. It reports whether anything was dropped.
+func (s *VersionStore) pruneLocked(now time.Time) bool {
+	byFile := make(map[string][]*StoredVersion)
+	policies := make(map[string]VersionPolicy)
+	changed := false
+	for _, v := range s.versions {
+		if _, ok := s.shareRoot(v.ShareID); !ok {
+			delete(s.versions, v.ID)
+			changed = true
+			continue
+		}
+		if _, ok := policies[v.ShareID]; !ok {
+			policies[v.ShareID] = s.policy(v.ShareID)
+		}
+		key := fileKey(v.ShareID, v.Path)
+		byFile[key] = append(byFile[key], v)
+	}
+
+	for _, list := range byFile {
+		p := policies[list[0].ShareID]
+		sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+		for i, v := range list {
+			if (p.MaxVersions > 0 && i >= p.MaxVersions) || (p.MaxAge > 0 && now.Sub(v.CreatedAt) > p.MaxAge) {
+				s.removeLocked(v)
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// cloneFile copies src to a new file dst, as a reflink where possible
+func cloneFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if err := reflink(out, in); err != nil {
+		_, err = io.Copy(out, in)
+		if err == nil {
+			err = out.Sync()
+		}
+		if err != nil {
+			out.Close()
+			os.Remove(dst)
+			return err
+		}
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package sync
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestVersionStoreCaptureRestore(t *testing.T) {
+	shareDir := t.TempDir()
+	root := func(id string) (string, bool) { return shareDir, id == "s1" }
+	policy := VersionPolicy{Enabled: true, MaxVersions: 2}
+
+	s, err := NewVersionStore(t.TempDir(), root, func(string) VersionPolicy { return policy })
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(shareDir, "doc.txt")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Nothing to keep before the file exists
+	if v, err := s.Capture("s1", "doc.txt", "d1", VersionReasonOverwrite); v != nil || err != nil {
+		t.Fatalf("capture of missing file: %v, %v", v, err)
+	}
+	for _, content := range []string{"one", "two", "three"} {
+		write(content)
+		if _, err := s.Capture("s1", "doc.txt", "d1", VersionReasonOverwrite); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	write("four")
+
+	// Only the two newest versions are kept
+	list := s.List("s1", "doc.txt")
+	if len(list) != 2 {
+		t.Fatalf("kept %d versions, want 2", len(list))
+	}
+	_, f, err := s.Open("s1", list[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := io.ReadAll(f)
+	f.Close()
+	if string(content) != "three" {
+		t.Errorf("newest version holds %q", content)
+	}
+	if _, _, err := s.Open("s2", list[0].ID); !errors.Is(err, ErrVersionNotFound) {
+		t.Errorf("version opened through another share: %v", err)
+	}
+
+	// Restoring keeps the replaced content as a version
+	if _, err := s.Restore("s1", list[1].ID, "d2"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(file); string(got) != "two" {
+		t.Errorf("restored file holds %q", got)
+	}
+	list = s.List("s1", "doc.txt")
+	if len(list) != 2 || list[0].Reason != VersionReasonRestore || list[0].Size != int64(len("four")) {
+		t.Fatalf("versions after restore: %+v", list)
+	}
+
+	// Age limits apply to existing versions
+	policy = VersionPolicy{Enabled: false, MaxAge: time.Millisecond}
+	time.Sleep(5 * time.Millisecond)
+	if err := s.Prune(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s.List("s1", "doc.txt")); n != 0 {
+		t.Errorf("%d versions survived their maximum age", n)
+	}
+	entries, _ := os.ReadDir(filepath.Join(shareDir, VersionsDir))
+	if len(entries) != 0 {
+		t.Errorf("%d version files left behind", len(entries))
+	}
+}
@@ -6,11 +6,14 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
 	gruntime "runtime"
+	"strings"
 
 	"github.com/rs/zerolog"
 	wailsruntime "github.com/wailsapp/wails/v2/pkg/runtime"
 
+	"nithronos/clients/sync-core/api"
 	"nithronos/clients/sync-core/config"
 	"nithronos/clients/sync-core/db"
 	"nithronos/clients/sync-core/engine"
@@ -359,6 +362,48 @@ func (a *App) SelectFolder() (string, error) {
 	})
 }
 
+// SelectSyncedFile opens a file selection dialog in the sync folder.
+func (a *App) SelectSyncedFile() (string, error) {
+	return wailsruntime.OpenFileDialog(a.ctx, wailsruntime.OpenDialogOptions{
+		Title:            "Select a File",
+		DefaultDirectory: a.cfg.SyncFolder,
+	})
+}
+
+// ListVersions returns the previous versions of a synced file.
+func (a *App) ListVersions(path string) ([]api.FileVersion, error) {
+	if a.engine == nil {
+		return nil, fmt.Errorf("sync is not configured")
+	}
+	return a.engine.ListVersions(path)
+}
+
+// RestoreVersion replaces a synced file with one of its previous versions.
+func (a *App) RestoreVersion(path, versionID string) error {
+	if a.engine == nil {
+		return fmt.Errorf("sync is not configured")
+	}
+	return a.engine.RestoreVersion(path, versionID)
+}
+
+// SaveVersionAs asks where to save a previous version of a synced file and
+// saves it there. It returns the chosen path, or "" if cancelled.
+func (a *App) SaveVersionAs(path, versionID string) (string, error) {
+	if a.engine == nil {
+		return "", fmt.Errorf("sync is not configured")
+	}
+	ext := filepath.Ext(path)
+	dst, err := wailsruntime.SaveFileDialog(a.ctx, wailsruntime.SaveDialogOptions{
+		Title:            "Save Previous Version",
+		DefaultDirectory: filepath.Dir(path),
+		DefaultFilename:  strings.TrimSuffix(filepath.Base(path), ext) + " (previous version)" + ext,
+	})
+	if err != nil || dst == "" {
+		return "", err
+	}
+	return dst, a.engine.SaveVersion(path, versionID, dst)
+}
+
 // Quit quits the application.
 func (a *App) Quit() {
 	if a.engine != nil {
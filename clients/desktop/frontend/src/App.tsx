@@ -14,6 +14,9 @@ import {
   Upload,
   Download,
   X,
+  History,
+  RotateCcw,
+  Save,
 } from 'lucide-react';
 
 // Wails runtime bindings
@@ -36,6 +39,10 @@ declare global {
           SelectFolder: () => Promise<string>;
           Quit: () => Promise<void>;
           GetSystemInfo: () => Promise<SystemInfo>;
+          SelectSyncedFile: () => Promise<string>;
+          ListVersions: (path: string) => Promise<FileVersion[]>;
+          RestoreVersion: (path: string, versionId: string) => Promise<void>;
+          SaveVersionAs: (path: string, versionId: string) => Promise<string>;
         };
       };
     };
@@ -117,7 +124,18 @@ interface SystemInfo {
   log_dir: string;
 }
 
-type View = 'main' | 'setup' | 'settings';
+interface FileVersion {
+  id: string;
+  share_id: string;
+  path: string;
+  size: number;
+  mod_time: string;
+  created_at: string;
+  device_id?: string;
+  reason: string;
+}
+
+type View = 'main' | 'setup' | 'settings' | 'versions';
 
 function App() {
   const [config, setConfig] = useState<Config | null>(null);
@@ -213,6 +231,9 @@ function App() {
             onUpdate={loadData}
           />
         )}
+        {view === 'versions' && (
+          <VersionsView key="versions" onBack={() => setView('main')} />
+        )}
         {view === 'main' && (
           <MainView
             key="main"
@@ -220,6 +241,7 @@ function App() {
             status={status!}
             activity={activity}
             onSettings={() => setView('settings')}
+            onVersions={() => setView('versions')}
           />
         )}
       </AnimatePresence>
@@ -353,11 +375,13 @@ function MainView({
   status,
   activity,
   onSettings,
+  onVersions,
 }: {
   config: Config;
   status: Status;
   activity: Activity[];
   onSettings: () => void;
+  onVersions: () => void;
 }) {
   const isConnected = status.is_connected;
   const isSyncing = status.state === 'syncing';
@@ -483,6 +507,12 @@ function MainView({
         >
           Open NithronOS <ExternalLink className="w-3 h-3" />
         </button>
+        <button
+          onClick={onVersions}
+          className="text-sm text-blue-500 hover:text-blue-600 flex items-center gap-1"
+        >
+          <History className="w-3 h-3" /> Previous Versions
+        </button>
         <span className="text-xs text-slate-400">NithronSync v1.0.0</span>
       </div>
     </motion.div>
@@ -619,6 +649,135 @@ function SettingsView({
   );
 }
 
+function VersionsView({ onBack }: { onBack: () => void }) {
+  const [file, setFile] = useState('');
+  const [versions, setVersions] = useState<FileVersion[]>([]);
+  const [busy, setBusy] = useState(false);
+  const [error, setError] = useState('');
+  const [notice, setNotice] = useState('');
+
+  const loadVersions = async (path: string) => {
+    setBusy(true);
+    setError('');
+    try {
+      setVersions((await window.go.app.App.ListVersions(path)) || []);
+    } catch (err) {
+      setVersions([]);
+      setError(String(err));
+    } finally {
+      setBusy(false);
+    }
+  };
+
+  const handleSelect = async () => {
+    const path = await window.go.app.App.SelectSyncedFile();
+    if (!path) return;
+    setFile(path);
+    setNotice('');
+    await loadVersions(path);
+  };
+
+  const handleRestore = async (version: FileVersion) => {
+    setBusy(true);
+    setError('');
+    try {
+      await window.go.app.App.RestoreVersion(file, version.id);
+      setNotice(`Restored the version from ${formatDate(version.mod_time)}`);
+      await loadVersions(file);
+    } catch (err) {
+      setError(String(err));
+      setBusy(false);
+    }
+  };
+
+  const handleSave = async (version: FileVersion) => {
+    setError('');
+    try {
+      const saved = await window.go.app.App.SaveVersionAs(file, version.id);
+      if (saved) setNotice(`Saved to ${saved}`);
+    } catch (err) {
+      setError(String(err));
+    }
+  };
+
+  return (
+    <motion.div
+      initial={{ opacity: 0, x: 20 }}
+      animate={{ opacity: 1, x: 0 }}
+      exit={{ opacity: 0, x: -20 }}
+      className="p-6"
+    >
+      <div className="flex items-center gap-3 mb-6">
+        <button
+          onClick={onBack}
+          className="p-2 hover:bg-slate-100 rounded-lg transition-colors"
+        >
+          ←
+        </button>
+        <h1 className="text-lg font-semibold text-slate-800">Previous Versions</h1>
+      </div>
+
+      <button
+        onClick={handleSelect}
+        className="w-full flex items-center justify-center gap-2 py-2 mb-4 bg-slate-100 hover:bg-slate-200 rounded-lg transition-colors"
+      >
+        <FolderOpen className="w-4 h-4" />
+        {file ? 'Choose Another File' : 'Choose a Synced File'}
+      </button>
+
+      {file && <p className="text-sm text-slate-600 truncate mb-2">{file}</p>}
+      {error && (
+        <div className="flex items-center gap-2 p-3 mb-3 bg-red-50 text-red-600 text-sm rounded-lg">
+          <AlertCircle className="w-4 h-4 flex-shrink-0" /> {error}
+        </div>
+      )}
+      {notice && (
+        <div className="flex items-center gap-2 p-3 mb-3 bg-green-50 text-green-600 text-sm rounded-lg">
+          <Check className="w-4 h-4 flex-shrink-0" /> {notice}
+        </div>
+      )}
+
+      {file && (
+        <div className="bg-white rounded-lg border border-slate-200 divide-y divide-slate-100 max-h-80 overflow-y-auto">
+          {busy ? (
+            <div className="p-4 flex justify-center">
+              <RefreshCw className="w-5 h-5 text-blue-500 animate-spin" />
+            </div>
+          ) : versions.length === 0 ? (
+            <div className="p-4 text-center text-slate-500 text-sm">No previous versions</div>
+          ) : (
+            versions.map((version) => (
+              <div key={version.id} className="p-3 flex items-center gap-3">
+                <div className="flex-1 min-w-0">
+                  <p className="text-sm text-slate-800">{formatDate(version.mod_time)}</p>
+                  <p className="text-xs text-slate-500">
+                    {formatBytes(version.size)} · replaced {formatTime(version.created_at)}
+                    {version.reason === 'restore' ? ' by a restore' : ''}
+                  </p>
+                </div>
+                <button
+                  onClick={() => handleSave(version)}
+                  title="Save a copy"
+                  className="p-2 hover:bg-slate-100 rounded-lg transition-colors"
+                >
+                  <Save className="w-4 h-4 text-slate-600" />
+                </button>
+                <button
+                  onClick={() => handleRestore(version)}
+                  title="Restore this version"
+                  className="p-2 hover:bg-blue-50 rounded-lg transition-colors"
+                >
+                  <RotateCcw className="w-4 h-4 text-blue-500" />
+                </button>
+              </div>
+            ))
+          )}
+        </div>
+      )}
+    </motion.div>
+  );
+}
+
 function StatCard({
   icon,
   label,
@@ -668,5 +827,9 @@ function formatTime(dateStr: string): string {
   return date.toLocaleDateString();
 }
 
+function formatDate(dateStr: string): string {
+  return new Date(dateStr).toLocaleString();
+}
+
 export default App;
 
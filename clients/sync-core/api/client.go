@@ -5,10 +5,12 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
 	"sync"
 	"time"
 
@@ -53,6 +55,23 @@ func (c *Client) SetTokenRefreshCallback(fn func(accessToken, refreshToken strin
 
 // request makes an authenticated HTTP request.
 func (c *Client) request(ctx context.Context, method, path string, body interface{}, result interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return fmt.Errorf("failed to marshal request body: %w", err)
+		}
+	}
+	return c.send(ctx, method, path, "application/json", data, result)
+}
+
+// send performs an API request with a raw body and decodes a JSON result.
+func (c *Client) send(ctx context.Context, method, path, contentType string, data []byte, result interface{}) error {
+	return c.sendWithHeaders(ctx, method, path, contentType, nil, data, result)
+}
+
+// sendWithHeaders is send with extra request headers.
+func (c *Client) sendWithHeaders(ctx context.Context, method, path, contentType string, headers map[string]string, data []byte, result interface{}) error {
 	c.mu.RLock()
 	baseURL := c.baseURL
 	c.mu.RUnlock()
@@ -64,11 +83,7 @@ func (c *Client) request(ctx context.Context, method, path string, body interfac
 	fullURL := baseURL + path
 
 	var bodyReader io.Reader
-	if body != nil {
-		data, err := json.Marshal(body)
-		if err != nil {
-			return fmt.Errorf("failed to marshal request body: %w", err)
-		}
+	if data != nil {
 		bodyReader = bytes.NewReader(data)
 	}
 
@@ -78,7 +93,10 @@ func (c *Client) request(ctx context.Context, method, path string, body interfac
 	}
 
 	// Set headers
-	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Type", contentType)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
 	req.Header.Set("User-Agent", "NithronSync/1.0.0")
 
 	// Add authorization
@@ -100,7 +118,7 @@ func (c *Client) request(ctx context.Context, method, path string, body interfac
 			return fmt.Errorf("authentication failed: %w", err)
 		}
 		// Retry with new token
-		return c.request(ctx, method, path, body, result)
+		return c.sendWithHeaders(ctx, method, path, contentType, headers, data, result)
 	}
 
 	// Read response body
@@ -111,11 +129,7 @@ func (c *Client) request(ctx context.Context, method, path string, body interfac
 
 	// Handle errors
 	if resp.StatusCode >= 400 {
-		var apiErr APIError
-		if err := json.Unmarshal(respBody, &apiErr); err != nil {
-			return fmt.Errorf("HTTP %d: %s", resp.StatusCode, string(respBody))
-		}
-		return &apiErr
+		return parseAPIError(resp.StatusCode, respBody)
 	}
 
 	// Parse result
@@ -190,13 +204,58 @@ func (c *Client) refreshToken(ctx context.Context) error {
 
 // APIError represents an API error response.
 type APIError struct {
-	Error   string `json:"error"`
+	Status  int    `json:"-"`
 	Code    string `json:"code"`
+	Message string `json:"message"`
 	Details any    `json:"details,omitempty"`
 }
 
 func (e *APIError) Error() string {
-	return fmt.Sprintf("%s: %s", e.Code, e.Error)
+	if e.Code == "" {
+		return fmt.Sprintf("HTTP %d: %s", e.Status, e.Message)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// parseAPIError decodes nosd's {"error": {"code", "message"}} error envelope.
+func parseAPIError(status int, body []byte) *APIError {
+	var envelope struct {
+		Error APIError `json:"error"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil || envelope.Error.Code == "" {
+		return &APIError{Status: status, Message: string(body)}
+	}
+	envelope.Error.Status = status
+	return &envelope.Error
+}
+
+// IsCursorExpired reports whether err means the server can no longer serve
+// changes after the given cursor and a full resync is required.
+func IsCursorExpired(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.Status == http.StatusGone
+}
+
+// IsNotFound reports whether the server answered 404.
+func IsNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.Status == http.StatusNotFound
+}
+
+// ErrorCode returns the nosd error code of err, if any.
+func ErrorCode(err error) string {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Code
+	}
+	return ""
+}
+
+// IsConflict reports whether the server rejected a request because it was
+// based on stale state (HTTP 409).
+func IsConflict(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.Status == http.StatusConflict
 }
 
 // Request/Response types
@@ -241,6 +300,7 @@ type SyncShare struct {
 	SyncEnabled  bool     `json:"sync_enabled"`
 	SyncMaxSize  int64    `json:"sync_max_size"`
 	SyncExclude  []string `json:"sync_exclude"`
+	E2E          bool     `json:"e2e"` // contents and names are encrypted by clients
 }
 
 // SyncConfig represents device sync configuration.
@@ -283,19 +343,44 @@ type FileMetadata struct {
 
 // BlockHash represents a block hash for delta sync.
 type BlockHash struct {
-	Index      int    `json:"index"`
+	Index      int    `json:"index,omitempty"`
 	Offset     int64  `json:"offset"`
 	Size       int    `json:"size"`
-	StrongHash string `json:"strong_hash"`
-	WeakHash   uint32 `json:"weak_hash"`
+	StrongHash string `json:"hash"`
+	WeakHash   uint32 `json:"weak"`
 }
 
+// Chunking modes of the block hash endpoint.
+const (
+	ChunkModeFixed = "fixed"
+	ChunkModeCDC   = "cdc"
+)
+
 // BlockHashResponse is the response from block hash endpoint.
 type BlockHashResponse struct {
-	Path      string      `json:"path"`
-	Size      int64       `json:"size"`
-	BlockSize int         `json:"block_size"`
-	Blocks    []BlockHash `json:"blocks"`
+	Path         string      `json:"path"`
+	Size         int64       `json:"size"`
+	Hash         string      `json:"hash"`
+	BlockSize    int         `json:"block_size"`
+	Mode         string      `json:"mode"`
+	MinBlockSize int         `json:"min_block_size,omitempty"`
+	MaxBlockSize int         `json:"max_block_size,omitempty"`
+	Blocks       []BlockHash `json:"blocks"`
+}
+
+// ManifestChunk is one chunk of a file manifest.
+type ManifestChunk struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// FileManifest describes a file as the list of its chunks.
+type FileManifest struct {
+	Path   string          `json:"path"`
+	Size   int64           `json:"size"`
+	Hash   string          `json:"hash"`
+	MTime  *time.Time      `json:"mtime,omitempty"`
+	Chunks []ManifestChunk `json:"chunks"`
 }
 
 // SyncState represents sync state for a share.
@@ -309,6 +394,35 @@ type SyncState struct {
 	PendingDownloads int    `json:"pending_downloads"`
 }
 
+// E2EWrap is a share key sealed to one device's public key.
+type E2EWrap struct {
+	EphemeralPublic []byte `json:"ephemeral_public"`
+	Nonce           []byte `json:"nonce"`
+	Ciphertext      []byte `json:"ciphertext"`
+}
+
+// E2EDevice is a device that may read an end-to-end encrypted share.
+type E2EDevice struct {
+	DeviceID    string `json:"device_id"`
+	UserID      string `json:"user_id"`
+	PublicKey   []byte `json:"public_key"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// E2EShareKeys is the key state of an end-to-end encrypted share as seen by
+// this device.
+type E2EShareKeys struct {
+	ShareID         string `json:"share_id"`
+	CurrentVersion  int    `json:"current_version"`
+	RotationPending bool   `json:"rotation_pending"`
+	Keys            []struct {
+		Version int      `json:"version"`
+		Wrap    *E2EWrap `json:"wrap"`
+	} `json:"keys"`
+	Devices []E2EDevice      `json:"devices"`
+	Missing map[string][]int `json:"missing"` // device ID -> key versions it lacks
+}
+
 // API Methods
 
 // ListShares returns all sync-enabled shares.
@@ -367,6 +481,206 @@ func (c *Client) GetBlockHashes(ctx context.Context, shareID, path string, block
 	return &resp, err
 }
 
+// GetChunkHashes returns the content-defined chunks of a remote file. Servers
+// without content-defined chunking answer with fixed blocks; check Mode.
+func (c *Client) GetChunkHashes(ctx context.Context, shareID, path string, avgSize int) (*BlockHashResponse, error) {
+	reqPath := fmt.Sprintf("/api/v1/sync/files/%s/hash", url.QueryEscape(shareID))
+
+	body := map[string]interface{}{
+		"path":       path,
+		"block_size": avgSize,
+		"mode":       ChunkModeCDC,
+	}
+
+	var resp BlockHashResponse
+	err := c.request(ctx, "POST", reqPath, body, &resp)
+	return &resp, err
+}
+
+// MissingChunks returns the chunk hashes the server needs uploaded before a
+// manifest using them can be committed to the share.
+func (c *Client) MissingChunks(ctx context.Context, shareID string, hashes []string) ([]string, error) {
+	body := map[string]interface{}{
+		"share_id": shareID,
+		"hashes":   hashes,
+	}
+
+	var resp struct {
+		Missing []string `json:"missing"`
+	}
+	err := c.request(ctx, "POST", "/api/v1/sync/chunks/missing", body, &resp)
+	return resp.Missing, err
+}
+
+// UploadChunk uploads one chunk; the server checks it against its hash.
+func (c *Client) UploadChunk(ctx context.Context, chunkHash string, data []byte) error {
+	path := "/api/v1/sync/chunks/" + url.PathEscape(chunkHash)
+	return c.send(ctx, "PUT", path, "application/octet-stream", data, nil)
+}
+
+// CommitManifest has the server assemble a file from its chunks.
+func (c *Client) CommitManifest(ctx context.Context, shareID string, m *FileManifest) error {
+	path := fmt.Sprintf("/api/v1/sync/files/%s/manifest", url.PathEscape(shareID))
+	return c.request(ctx, "POST", path, m, nil)
+}
+
+// MissingChunksFromError returns the chunks a manifest commit was rejected
+// for, or nil if err is not such a rejection.
+func MissingChunksFromError(err error) []string {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Code != "sync.chunks_missing" {
+		return nil
+	}
+	details, _ := apiErr.Details.(map[string]any)
+	list, _ := details["missing"].([]any)
+	missing := make([]string, 0, len(list))
+	for _, h := range list {
+		if s, ok := h.(string); ok {
+			missing = append(missing, s)
+		}
+	}
+	return missing
+}
+
+// UploadSession is a resumable upload on the server.
+type UploadSession struct {
+	ID        string    `json:"id"`
+	ShareID   string    `json:"share_id"`
+	Path      string    `json:"path"`
+	Size      int64     `json:"size"`
+	Offset    int64     `json:"offset"`
+	Hash      string    `json:"hash,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// CreateUpload starts a resumable upload of size bytes to path. The server
+// checks the finished file against hash (hex SHA-256) when it is set.
+func (c *Client) CreateUpload(ctx context.Context, shareID, path string, size int64, fileHash string, modTime *time.Time) (*UploadSession, error) {
+	body := map[string]interface{}{
+		"share_id": shareID,
+		"path":     path,
+		"size":     size,
+		"hash":     fileHash,
+	}
+	if modTime != nil {
+		body["mtime"] = modTime
+	}
+
+	var session UploadSession
+	err := c.request(ctx, "POST", "/api/v1/sync/uploads", body, &session)
+	return &session, err
+}
+
+// GetUpload returns the state of an upload session, including the offset
+// to resume from.
+func (c *Client) GetUpload(ctx context.Context, uploadID string) (*UploadSession, error) {
+	var session UploadSession
+	err := c.request(ctx, "GET", "/api/v1/sync/uploads/"+url.PathEscape(uploadID), nil, &session)
+	return &session, err
+}
+
+// WriteUpload sends data at offset, which must be the session's current
+// offset, and returns the updated session.
+func (c *Client) WriteUpload(ctx context.Context, uploadID string, offset int64, data []byte) (*UploadSession, error) {
+	path := "/api/v1/sync/uploads/" + url.PathEscape(uploadID)
+	headers := map[string]string{"Upload-Offset": strconv.FormatInt(offset, 10)}
+
+	var session UploadSession
+	err := c.sendWithHeaders(ctx, "PUT", path, "application/octet-stream", headers, data, &session)
+	return &session, err
+}
+
+// FinalizeUpload moves a complete upload into place.
+func (c *Client) FinalizeUpload(ctx context.Context, uploadID string) error {
+	return c.request(ctx, "POST", "/api/v1/sync/uploads/"+url.PathEscape(uploadID)+"/finalize", nil, nil)
+}
+
+// AbortUpload cancels an upload session.
+func (c *Client) AbortUpload(ctx context.Context, uploadID string) error {
+	return c.request(ctx, "DELETE", "/api/v1/sync/uploads/"+url.PathEscape(uploadID), nil, nil)
+}
+
+// FileVersion is a previous version of a file kept by the server.
+type FileVersion struct {
+	ID        string    `json:"id"`
+	ShareID   string    `json:"share_id"`
+	Path      string    `json:"path"`
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"mod_time"`
+	CreatedAt time.Time `json:"created_at"`
+	DeviceID  string    `json:"device_id,omitempty"`
+	Reason    string    `json:"reason"`
+}
+
+// ListVersions returns the previous versions of a file, newest first.
+func (c *Client) ListVersions(ctx context.Context, shareID, path string) ([]FileVersion, error) {
+	reqPath := fmt.Sprintf("/api/v1/sync/files/%s/versions?path=%s", url.PathEscape(shareID), url.QueryEscape(path))
+
+	var resp struct {
+		Versions []FileVersion `json:"versions"`
+	}
+	err := c.request(ctx, "GET", reqPath, nil, &resp)
+	return resp.Versions, err
+}
+
+// DownloadVersion writes the content of a previous version to w.
+func (c *Client) DownloadVersion(ctx context.Context, shareID, versionID string, w io.Writer) error {
+	path := fmt.Sprintf("/api/v1/sync/files/%s/versions/%s/download", url.PathEscape(shareID), url.PathEscape(versionID))
+	return c.download(ctx, path, w)
+}
+
+// RestoreVersion puts a previous version back in place of its file.
+func (c *Client) RestoreVersion(ctx context.Context, shareID, versionID string) (*FileVersion, error) {
+	path := fmt.Sprintf("/api/v1/sync/files/%s/versions/%s/restore", url.PathEscape(shareID), url.PathEscape(versionID))
+
+	var v FileVersion
+	err := c.request(ctx, "POST", path, nil, &v)
+	return &v, err
+}
+
+// download streams a response body to w. Unlike other requests it is not
+// bound by the client timeout, only by ctx.
+func (c *Client) download(ctx context.Context, path string, w io.Writer) error {
+	c.mu.RLock()
+	baseURL := c.baseURL
+	c.mu.RUnlock()
+	if baseURL == "" {
+		baseURL = c.cfg.GetServerURL()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", baseURL+path, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("User-Agent", "NithronSync/1.0.0")
+	if accessToken := c.cfg.GetAccessToken(); accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+
+	httpClient := *c.httpClient
+	httpClient.Timeout = 0
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		if err := c.refreshToken(ctx); err != nil {
+			return fmt.Errorf("authentication failed: %w", err)
+		}
+		return c.download(ctx, path, w)
+	}
+	if resp.StatusCode >= 400 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		return parseAPIError(resp.StatusCode, body)
+	}
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return fmt.Errorf("download failed: %w", err)
+	}
+	return nil
+}
+
 // GetSyncState returns the sync state for a share.
 func (c *Client) GetSyncState(ctx context.Context, shareID string) (*SyncState, error) {
 	path := fmt.Sprintf("/api/v1/sync/state/%s", url.QueryEscape(shareID))
@@ -388,6 +702,35 @@ func (c *Client) UpdateSyncState(ctx context.Context, shareID string, cursor, st
 	return c.request(ctx, "PUT", path, body, nil)
 }
 
+// EnrollE2EDevice registers this device's public key for end-to-end
+// encrypted shares.
+func (c *Client) EnrollE2EDevice(ctx context.Context, publicKey []byte) error {
+	body := map[string][]byte{"public_key": publicKey}
+	return c.request(ctx, "PUT", "/api/v1/sync/e2e/device-key", body, nil)
+}
+
+// GetE2EShareKeys returns the key state of an end-to-end encrypted share.
+func (c *Client) GetE2EShareKeys(ctx context.Context, shareID string) (*E2EShareKeys, error) {
+	path := fmt.Sprintf("/api/v1/sync/e2e/shares/%s/keys", url.PathEscape(shareID))
+
+	var keys E2EShareKeys
+	err := c.request(ctx, "GET", path, nil, &keys)
+	return &keys, err
+}
+
+// PutE2EShareKeys uploads wrapped keys for one key version. Version
+// current+1 rotates the share key; an existing version grants it to devices
+// that lack it.
+func (c *Client) PutE2EShareKeys(ctx context.Context, shareID string, version int, wraps map[string]*E2EWrap) error {
+	path := fmt.Sprintf("/api/v1/sync/e2e/shares/%s/keys", url.PathEscape(shareID))
+
+	body := map[string]interface{}{
+		"version": version,
+		"wraps":   wraps,
+	}
+	return c.request(ctx, "PUT", path, body, nil)
+}
+
 // HealthCheck checks if the server is reachable.
 func (c *Client) HealthCheck(ctx context.Context) error {
 	return c.request(ctx, "GET", "/api/v1/health", nil, nil)
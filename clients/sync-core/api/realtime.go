@@ -0,0 +1,209 @@
+// Package api provides the realtime notification client.
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// realtimeReadTimeout must exceed the server's ping period
+	realtimeReadTimeout = 90 * time.Second
+	realtimeWriteWait   = 10 * time.Second
+	realtimeMaxBackoff  = time.Minute
+)
+
+// ShareChange announces that a share has new changes up to Cursor.
+type ShareChange struct {
+	ShareID string `json:"share_id"`
+	Cursor  string `json:"cursor"`
+}
+
+// realtimeMessage mirrors the server's realtime message envelope.
+type realtimeMessage struct {
+	Type    string          `json:"type"`
+	Channel string          `json:"channel,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// RealtimeClient keeps a WebSocket open to the server's realtime hub and
+// reports share change notifications. It reconnects with backoff; callers
+// should fall back to polling while Connected is false.
+type RealtimeClient struct {
+	api       *Client
+	dialer    *websocket.Dialer
+	connected atomic.Bool
+	changes   chan ShareChange
+	onConnect func()
+	logger    zerolog.Logger
+}
+
+// NewRealtimeClient creates a realtime client using the API client's
+// credentials.
+func NewRealtimeClient(apiClient *Client, logger zerolog.Logger) *RealtimeClient {
+	return &RealtimeClient{
+		api: apiClient,
+		dialer: &websocket.Dialer{
+			Proxy:            http.ProxyFromEnvironment,
+			HandshakeTimeout: 15 * time.Second,
+		},
+		changes: make(chan ShareChange, 64),
+		logger:  logger.With().Str("component", "realtime").Logger(),
+	}
+}
+
+// Changes returns the channel on which share notifications are delivered.
+func (r *RealtimeClient) Changes() <-chan ShareChange {
+	return r.changes
+}
+
+// Connected reports whether the notification channel is currently live.
+func (r *RealtimeClient) Connected() bool {
+	return r.connected.Load()
+}
+
+// SetOnConnect sets a callback invoked after every (re)connect, once the
+// share subscriptions are in place. Notifications sent while disconnected
+// are lost, so this is where callers catch up.
+func (r *RealtimeClient) SetOnConnect(fn func()) {
+	r.onConnect = fn
+}
+
+// Run connects and subscribes to the given shares until ctx is cancelled.
+func (r *RealtimeClient) Run(ctx context.Context, shareIDs []string) {
+	backoff := time.Second
+	for ctx.Err() == nil {
+		start := time.Now()
+		err := r.session(ctx, shareIDs)
+		r.connected.Store(false)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(start) > realtimeMaxBackoff {
+			// The connection was healthy for a while; retry promptly
+			backoff = time.Second
+		}
+		r.logger.Debug().Err(err).Dur("retry_in", backoff).Msg("Realtime connection lost, polling until reconnected")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > realtimeMaxBackoff {
+			backoff = realtimeMaxBackoff
+		}
+	}
+}
+
+// session runs one connection until it fails.
+func (r *RealtimeClient) session(ctx context.Context, shareIDs []string) error {
+	wsURL, err := realtimeURL(r.api.cfg.GetServerURL())
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{}
+	header.Set("User-Agent", "NithronSync/1.0.0")
+	if token := r.api.cfg.GetAccessToken(); token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+
+	conn, resp, err := r.dialer.DialContext(ctx, wsURL, header)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			if rerr := r.api.refreshToken(ctx); rerr != nil {
+				return fmt.Errorf("authentication failed: %w", rerr)
+			}
+		}
+		return fmt.Errorf("realtime connect failed: %w", err)
+	}
+	defer conn.Close()
+
+	// Unblock the reader when the context ends
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	for _, id := range shareIDs {
+		payload, _ := json.Marshal(map[string]string{"channel": "share:" + id})
+		_ = conn.SetWriteDeadline(time.Now().Add(realtimeWriteWait))
+		if err := conn.WriteJSON(realtimeMessage{Type: "subscribe", Payload: payload}); err != nil {
+			return fmt.Errorf("subscribe failed: %w", err)
+		}
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(realtimeReadTimeout))
+	conn.SetPingHandler(func(data string) error {
+		_ = conn.SetReadDeadline(time.Now().Add(realtimeReadTimeout))
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(realtimeWriteWait))
+	})
+
+	r.connected.Store(true)
+	r.logger.Info().Int("shares", len(shareIDs)).Msg("Realtime notifications connected")
+	if r.onConnect != nil {
+		r.onConnect()
+	}
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(realtimeReadTimeout))
+
+		// The server may batch several messages into one frame
+		for _, line := range bytes.Split(data, []byte{'\n'}) {
+			var msg realtimeMessage
+			if len(line) == 0 || json.Unmarshal(line, &msg) != nil {
+				continue
+			}
+			if msg.Type != "share.changed" {
+				continue
+			}
+			var change ShareChange
+			if json.Unmarshal(msg.Payload, &change) != nil || change.ShareID == "" {
+				continue
+			}
+			select {
+			case r.changes <- change:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// realtimeURL converts the server URL to the realtime WebSocket endpoint.
+func realtimeURL(serverURL string) (string, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid server URL: %w", err)
+	}
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	case "http":
+		u.Scheme = "ws"
+	default:
+		return "", fmt.Errorf("unsupported server URL scheme %q", u.Scheme)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v1/sync/realtime/ws"
+	return u.String(), nil
+}
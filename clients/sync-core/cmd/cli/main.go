@@ -13,6 +13,7 @@ import (
 	"nithronos/clients/sync-core/api"
 	"nithronos/clients/sync-core/config"
 	"nithronos/clients/sync-core/db"
+	"nithronos/clients/sync-core/e2e"
 )
 
 var (
@@ -227,6 +228,13 @@ func cmdDevices() {
 	fmt.Println("Current Device")
 	fmt.Println("==============")
 	fmt.Printf("Device ID: %s\n", cfg.DeviceID)
+
+	// Compare with the fingerprint other devices log when granting share keys
+	if dir, err := config.GetConfigDir(); err == nil {
+		if key, err := e2e.LoadOrCreateDeviceKey(dir); err == nil {
+			fmt.Printf("E2E Key:   %s\n", key.Fingerprint())
+		}
+	}
 }
 
 func cmdActivity() {
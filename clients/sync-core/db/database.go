@@ -152,6 +152,18 @@ func (d *Database) migrate() error {
 	);
 
 	CREATE INDEX IF NOT EXISTS idx_activity_created ON activity_log(created_at DESC);
+
+	CREATE TABLE IF NOT EXISTS upload_sessions (
+		share_id TEXT NOT NULL,
+		path TEXT NOT NULL,
+		upload_id TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		content_hash TEXT NOT NULL,
+		uploaded INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY(share_id, path)
+	);
 	`
 
 	_, err := d.db.Exec(schema)
@@ -604,3 +616,83 @@ func (d *Database) PruneActivityLog(olderThan time.Duration) error {
 	return err
 }
 
+// UploadSession is an in-progress resumable upload.
+type UploadSession struct {
+	ShareID     string
+	Path        string
+	UploadID    string
+	Size        int64
+	ContentHash string // SHA-256 of the bytes being uploaded
+	Uploaded    int64  // bytes the server has confirmed
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// GetUploadSession returns the upload in progress for a file, or nil.
+func (d *Database) GetUploadSession(shareID, path string) (*UploadSession, error) {
+	query := `SELECT share_id, path, upload_id, size, content_hash, uploaded, created_at, updated_at
+			  FROM upload_sessions WHERE share_id = ? AND path = ?`
+
+	var u UploadSession
+	err := d.db.QueryRow(query, shareID, path).Scan(
+		&u.ShareID, &u.Path, &u.UploadID, &u.Size, &u.ContentHash,
+		&u.Uploaded, &u.CreatedAt, &u.UpdatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// SaveUploadSession records a new upload session for a file, replacing any
+// previous one.
+func (d *Database) SaveUploadSession(u *UploadSession) error {
+	query := `INSERT INTO upload_sessions (share_id, path, upload_id, size, content_hash, uploaded)
+			  VALUES (?, ?, ?, ?, ?, ?)
+			  ON CONFLICT(share_id, path) DO UPDATE SET
+			  upload_id = excluded.upload_id,
+			  size = excluded.size,
+			  content_hash = excluded.content_hash,
+			  uploaded = excluded.uploaded,
+			  created_at = CURRENT_TIMESTAMP,
+			  updated_at = CURRENT_TIMESTAMP`
+	_, err := d.db.Exec(query, u.ShareID, u.Path, u.UploadID, u.Size, u.ContentHash, u.Uploaded)
+	return err
+}
+
+// UpdateUploadProgress records how much of an upload the server confirmed.
+func (d *Database) UpdateUploadProgress(shareID, path string, uploaded int64) error {
+	_, err := d.db.Exec(`UPDATE upload_sessions SET uploaded = ?, updated_at = CURRENT_TIMESTAMP
+			  WHERE share_id = ? AND path = ?`, uploaded, shareID, path)
+	return err
+}
+
+// DeleteUploadSession forgets the upload session of a file.
+func (d *Database) DeleteUploadSession(shareID, path string) error {
+	_, err := d.db.Exec("DELETE FROM upload_sessions WHERE share_id = ? AND path = ?", shareID, path)
+	return err
+}
+
+// ListUploadSessions returns all uploads in progress.
+func (d *Database) ListUploadSessions() ([]UploadSession, error) {
+	rows, err := d.db.Query(`SELECT share_id, path, upload_id, size, content_hash, uploaded, created_at, updated_at
+			  FROM upload_sessions ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []UploadSession
+	for rows.Next() {
+		var u UploadSession
+		if err := rows.Scan(&u.ShareID, &u.Path, &u.UploadID, &u.Size, &u.ContentHash,
+			&u.Uploaded, &u.CreatedAt, &u.UpdatedAt); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, u)
+	}
+	return sessions, rows.Err()
+}
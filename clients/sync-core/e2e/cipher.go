@@ -0,0 +1,296 @@
+package e2e
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"nithronos/clients/sync-core/hash"
+)
+
+// File format: a header (magic and key version) followed by one record per
+// content-defined chunk (plaintext length, synthetic IV, ciphertext), a zero
+// length terminator and an HMAC over the header, every IV and the total
+// length.
+//
+// Chunks are encrypted deterministically: the IV is an HMAC of the chunk's
+// plaintext (SIV). An unchanged chunk therefore encrypts to the same bytes
+// every time, which keeps block-level delta sync working on the ciphertext
+// the server stores. The cost is that the server can tell when two chunks
+// are equal.
+const (
+	fileMagic      = "NSE2E001"
+	fileHeaderSize = len(fileMagic) + 4
+	sivSize        = 16
+	fileMACSize    = sha256.Size
+)
+
+var (
+	// ErrNotEncrypted is returned for data that is not an E2E file.
+	ErrNotEncrypted = errors.New("e2e: not an encrypted file")
+	// ErrCorrupt is returned when a file or name fails authentication.
+	ErrCorrupt = errors.New("e2e: ciphertext is corrupt or was tampered with")
+	// ErrUnknownVersion is returned when data was encrypted under a key
+	// version this device does not hold.
+	ErrUnknownVersion = errors.New("e2e: share key version not available")
+)
+
+// siv is a deterministic cipher: IV = HMAC(plaintext), AES-256-CTR.
+type siv struct {
+	block  cipher.Block
+	macKey []byte
+}
+
+func newSIV(shareKey []byte, shareID, purpose string) (*siv, error) {
+	encKey, err := hkdf.Key(sha256.New, shareKey, []byte(shareID), "nithronsync e2e "+purpose+" enc", 32)
+	if err != nil {
+		return nil, err
+	}
+	macKey, err := hkdf.Key(sha256.New, shareKey, []byte(shareID), "nithronsync e2e "+purpose+" mac", 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+	return &siv{block: block, macKey: macKey}, nil
+}
+
+func (s *siv) iv(plaintext []byte) []byte {
+	m := hmac.New(sha256.New, s.macKey)
+	m.Write(plaintext)
+	return m.Sum(nil)[:sivSize]
+}
+
+// seal appends IV || ciphertext to dst.
+func (s *siv) seal(dst, plaintext []byte) []byte {
+	iv := s.iv(plaintext)
+	dst = append(dst, iv...)
+	start := len(dst)
+	dst = append(dst, plaintext...)
+	cipher.NewCTR(s.block, iv).XORKeyStream(dst[start:], dst[start:])
+	return dst
+}
+
+// open decrypts ciphertext in place and checks it against its IV.
+func (s *siv) open(iv, ciphertext []byte) ([]byte, error) {
+	cipher.NewCTR(s.block, iv).XORKeyStream(ciphertext, ciphertext)
+	if !hmac.Equal(s.iv(ciphertext), iv) {
+		return nil, ErrCorrupt
+	}
+	return ciphertext, nil
+}
+
+// versionKeys are the keys derived from one share key version.
+type versionKeys struct {
+	chunks *siv
+	macKey []byte
+}
+
+// Keyring holds the share key versions this device can read. New files are
+// written under the current version; names always use the first version's
+// key so a path encrypts to the same remote name before and after a
+// rotation. Rotation therefore does not protect names: a revoked device that
+// kept version 1 can still decrypt every name, including those of files
+// created after it was revoked.
+type Keyring struct {
+	shareID  string
+	current  int
+	versions map[int]*versionKeys
+	names    *siv
+}
+
+// NewKeyring derives the keyring of a share from its plaintext key versions.
+func NewKeyring(shareID string, keys map[int][]byte, current int) (*Keyring, error) {
+	if keys[current] == nil {
+		return nil, ErrUnknownVersion
+	}
+	if keys[1] == nil {
+		return nil, fmt.Errorf("%w: names need key version 1", ErrUnknownVersion)
+	}
+	k := &Keyring{shareID: shareID, current: current, versions: make(map[int]*versionKeys, len(keys))}
+	for v, key := range keys {
+		chunks, err := newSIV(key, shareID, "chunk")
+		if err != nil {
+			return nil, err
+		}
+		macKey, err := hkdf.Key(sha256.New, key, []byte(shareID), "nithronsync e2e file mac", 32)
+		if err != nil {
+			return nil, err
+		}
+		k.versions[v] = &versionKeys{chunks: chunks, macKey: macKey}
+	}
+	names, err := newSIV(keys[1], shareID, "name")
+	if err != nil {
+		return nil, err
+	}
+	k.names = names
+	return k, nil
+}
+
+// Version returns the key version new files are encrypted with.
+func (k *Keyring) Version() int {
+	return k.current
+}
+
+// EncryptName encrypts a single path component.
+func (k *Keyring) EncryptName(name string) string {
+	return base64.RawURLEncoding.EncodeToString(k.names.seal(nil, []byte(name)))
+}
+
+// DecryptName decrypts a single path component.
+func (k *Keyring) DecryptName(encrypted string) (string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(encrypted)
+	if err != nil || len(raw) < sivSize {
+		return "", ErrCorrupt
+	}
+	name, err := k.names.open(raw[:sivSize], raw[sivSize:])
+	if err != nil {
+		return "", err
+	}
+	return string(name), nil
+}
+
+// EncryptPath encrypts every component of a slash-separated path.
+func (k *Keyring) EncryptPath(p string) string {
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		if part != "" {
+			parts[i] = k.EncryptName(part)
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// DecryptPath decrypts every component of a slash-separated path.
+func (k *Keyring) DecryptPath(p string) (string, error) {
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+		name, err := k.DecryptName(part)
+		if err != nil {
+			return "", err
+		}
+		parts[i] = name
+	}
+	return strings.Join(parts, "/"), nil
+}
+
+// EncryptFile encrypts src into dst under the current key version and
+// returns the number of plaintext bytes read.
+func (k *Keyring) EncryptFile(dst io.Writer, src io.Reader) (int64, error) {
+	vk := k.versions[k.current]
+	mac := hmac.New(sha256.New, vk.macKey)
+
+	header := make([]byte, fileHeaderSize)
+	copy(header, fileMagic)
+	binary.BigEndian.PutUint32(header[len(fileMagic):], uint32(k.current))
+	if _, err := dst.Write(header); err != nil {
+		return 0, err
+	}
+	mac.Write(header)
+
+	var total int64
+	var record []byte
+	chunker := hash.NewChunker(src)
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return total, err
+		}
+		record = binary.BigEndian.AppendUint32(record[:0], uint32(len(chunk.Data)))
+		record = vk.chunks.seal(record, chunk.Data)
+		if _, err := dst.Write(record); err != nil {
+			return total, err
+		}
+		mac.Write(record[4 : 4+sivSize])
+		total += int64(len(chunk.Data))
+	}
+
+	var terminator [4]byte
+	if _, err := dst.Write(terminator[:]); err != nil {
+		return total, err
+	}
+	mac.Write(binary.BigEndian.AppendUint64(nil, uint64(total)))
+	_, err := dst.Write(mac.Sum(nil))
+	return total, err
+}
+
+// DecryptFile decrypts src into dst and returns the number of plaintext
+// bytes written. dst receives plaintext before the whole file has been
+// authenticated, so callers must discard it when an error is returned.
+func (k *Keyring) DecryptFile(dst io.Writer, src io.Reader) (int64, error) {
+	r := bufio.NewReaderSize(src, 64*1024)
+
+	header := make([]byte, fileHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:len(fileMagic)]) != fileMagic {
+		return 0, ErrNotEncrypted
+	}
+	vk := k.versions[int(binary.BigEndian.Uint32(header[len(fileMagic):]))]
+	if vk == nil {
+		return 0, ErrUnknownVersion
+	}
+	mac := hmac.New(sha256.New, vk.macKey)
+	mac.Write(header)
+
+	var total int64
+	buf := make([]byte, hash.MaxChunkSize)
+	var lenBuf [4]byte
+	iv := make([]byte, sivSize)
+	for {
+		if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+			return total, ErrCorrupt
+		}
+		n := binary.BigEndian.Uint32(lenBuf[:])
+		if n == 0 {
+			break
+		}
+		if n > hash.MaxChunkSize {
+			return total, ErrCorrupt
+		}
+		if _, err := io.ReadFull(r, iv); err != nil {
+			return total, ErrCorrupt
+		}
+		ct := buf[:n]
+		if _, err := io.ReadFull(r, ct); err != nil {
+			return total, ErrCorrupt
+		}
+		plain, err := vk.chunks.open(iv, ct)
+		if err != nil {
+			return total, err
+		}
+		mac.Write(iv)
+		if _, err := dst.Write(plain); err != nil {
+			return total, err
+		}
+		total += int64(n)
+	}
+
+	tag := make([]byte, fileMACSize)
+	if _, err := io.ReadFull(r, tag); err != nil {
+		return total, ErrCorrupt
+	}
+	mac.Write(binary.BigEndian.AppendUint64(nil, uint64(total)))
+	if !hmac.Equal(mac.Sum(nil), tag) {
+		return total, ErrCorrupt
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		return total, ErrCorrupt
+	}
+	return total, nil
+}
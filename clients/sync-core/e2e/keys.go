@@ -0,0 +1,173 @@
+// Package e2e implements end-to-end encryption for NithronSync shares.
+//
+// Every device has an X25519 key pair whose private half never leaves it.
+// A share key is generated by the first device that syncs an end-to-end
+// encrypted share and is stored on the server only wrapped (sealed) to each
+// device's public key, so the server never sees file contents or names.
+package e2e
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// ShareKeySize is the size of a share key in bytes.
+const ShareKeySize = 32
+
+// ErrUnwrap is returned when a wrapped key cannot be opened with this
+// device's key.
+var ErrUnwrap = errors.New("e2e: cannot unwrap share key")
+
+// DeviceKey is this device's X25519 key pair.
+type DeviceKey struct {
+	private *ecdh.PrivateKey
+}
+
+// LoadOrCreateDeviceKey loads the device key from dir, generating and saving
+// a new one on first use.
+func LoadOrCreateDeviceKey(dir string) (*DeviceKey, error) {
+	path := filepath.Join(dir, "e2e_device.key")
+
+	data, err := os.ReadFile(path)
+	if err == nil {
+		priv, err := ecdh.X25519().NewPrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid device key %s: %w", path, err)
+		}
+		return &DeviceKey{private: priv}, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read device key: %w", err)
+	}
+
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate device key: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, priv.Bytes(), 0600); err != nil {
+		return nil, fmt.Errorf("failed to write device key: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return nil, fmt.Errorf("failed to write device key: %w", err)
+	}
+	return &DeviceKey{private: priv}, nil
+}
+
+// PublicKey returns the raw X25519 public key.
+func (k *DeviceKey) PublicKey() []byte {
+	return k.private.PublicKey().Bytes()
+}
+
+// Fingerprint returns the fingerprint the server shows for this device's key.
+func (k *DeviceKey) Fingerprint() string {
+	return Fingerprint(k.PublicKey())
+}
+
+// Fingerprint returns a short, human-comparable fingerprint of a public key.
+func Fingerprint(publicKey []byte) string {
+	sum := sha256.Sum256(publicKey)
+	return hex.EncodeToString(sum[:8])
+}
+
+// WrappedKey is a share key sealed to one device's public key.
+type WrappedKey struct {
+	EphemeralPublic []byte `json:"ephemeral_public"`
+	Nonce           []byte `json:"nonce"`
+	Ciphertext      []byte `json:"ciphertext"`
+}
+
+// NewShareKey generates a random share key.
+func NewShareKey() ([]byte, error) {
+	key := make([]byte, ShareKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// WrapShareKey seals a share key to a recipient device. The wrap is bound to
+// the share, key version and recipient, so the server cannot move it to
+// another slot.
+func WrapShareKey(shareKey, recipientPublic []byte, shareID string, version int, recipientID string) (*WrappedKey, error) {
+	recipient, err := ecdh.X25519().NewPublicKey(recipientPublic)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recipient key: %w", err)
+	}
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := eph.ECDH(recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	ephPublic := eph.PublicKey().Bytes()
+	aead, err := wrapAEAD(shared, ephPublic, recipientPublic, shareID, version, recipientID)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return &WrappedKey{
+		EphemeralPublic: ephPublic,
+		Nonce:           nonce,
+		Ciphertext:      aead.Seal(nil, nonce, shareKey, nil),
+	}, nil
+}
+
+// Unwrap opens a share key wrapped for this device.
+func (k *DeviceKey) Unwrap(w *WrappedKey, shareID string, version int, deviceID string) ([]byte, error) {
+	eph, err := ecdh.X25519().NewPublicKey(w.EphemeralPublic)
+	if err != nil {
+		return nil, ErrUnwrap
+	}
+	shared, err := k.private.ECDH(eph)
+	if err != nil {
+		return nil, ErrUnwrap
+	}
+	aead, err := wrapAEAD(shared, w.EphemeralPublic, k.PublicKey(), shareID, version, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	if len(w.Nonce) != aead.NonceSize() {
+		return nil, ErrUnwrap
+	}
+	key, err := aead.Open(nil, w.Nonce, w.Ciphertext, nil)
+	if err != nil || len(key) != ShareKeySize {
+		return nil, ErrUnwrap
+	}
+	return key, nil
+}
+
+// wrapAEAD derives the AES-256-GCM key sealing one wrap.
+func wrapAEAD(shared, ephPublic, recipientPublic []byte, shareID string, version int, recipientID string) (cipher.AEAD, error) {
+	salt := append(append([]byte{}, ephPublic...), recipientPublic...)
+	info := "nithronsync e2e wrap|" + shareID + "|" + strconv.Itoa(version) + "|" + recipientID
+	kek, err := hkdf.Key(sha256.New, shared, salt, info, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
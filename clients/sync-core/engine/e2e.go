@@ -0,0 +1,307 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"nithronos/clients/sync-core/api"
+	"nithronos/clients/sync-core/config"
+	"nithronos/clients/sync-core/e2e"
+	"nithronos/clients/sync-core/hash"
+)
+
+// e2eTempSuffix marks ciphertext staged next to a synced file. It ends in
+// .nstmp so the watcher ignores it.
+const e2eTempSuffix = ".nse2e.nstmp"
+
+// keyring returns the keyring of an end-to-end encrypted share, or nil for
+// a plain share.
+func (e *Engine) keyring(shareID string) *e2e.Keyring {
+	e.keyringsMu.RLock()
+	defer e.keyringsMu.RUnlock()
+	return e.keyrings[shareID]
+}
+
+// remotePath maps a local share path to the path stored on the server.
+func (e *Engine) remotePath(shareID, p string) string {
+	if kr := e.keyring(shareID); kr != nil {
+		return kr.EncryptPath(p)
+	}
+	return p
+}
+
+// plainChange decrypts the paths of a change on an end-to-end encrypted share.
+func (e *Engine) plainChange(shareID string, change api.FileChange) (api.FileChange, error) {
+	kr := e.keyring(shareID)
+	if kr == nil {
+		return change, nil
+	}
+	p, err := kr.DecryptPath(change.Path)
+	if err != nil {
+		return change, err
+	}
+	change.Path = p
+	if change.PreviousPath != "" {
+		if change.PreviousPath, err = kr.DecryptPath(change.PreviousPath); err != nil {
+			return change, err
+		}
+	}
+	return change, nil
+}
+
+// e2eDeviceKey loads this device's key and enrolls it with the server once
+// per run. Callers hold syncMu.
+func (e *Engine) e2eDeviceKey() (*e2e.DeviceKey, error) {
+	if e.deviceKey == nil {
+		dir, err := config.GetConfigDir()
+		if err != nil {
+			return nil, err
+		}
+		if e.deviceKey, err = e2e.LoadOrCreateDeviceKey(dir); err != nil {
+			return nil, err
+		}
+	}
+	if !e.e2eEnrolled {
+		if err := e.apiClient.EnrollE2EDevice(e.ctx, e.deviceKey.PublicKey()); err != nil {
+			return nil, fmt.Errorf("failed to enroll device key: %w", err)
+		}
+		e.e2eEnrolled = true
+		e.logger.Info().Str("fingerprint", e.deviceKey.Fingerprint()).Msg("Device enrolled for end-to-end encryption")
+	}
+	return e.deviceKey, nil
+}
+
+// refreshKeyring fetches the wrapped keys of an end-to-end encrypted share and
+// rebuilds its keyring. The first device to sync a new share creates its key,
+// a device holding the key replaces it when a device was revoked, and any
+// device holding a key version grants it to devices that lack it.
+func (e *Engine) refreshKeyring(shareID string) error {
+	dk, err := e.e2eDeviceKey()
+	if err != nil {
+		return err
+	}
+
+	var state *api.E2EShareKeys
+	var keys map[int][]byte
+	for attempt := 0; ; attempt++ {
+		if state, err = e.apiClient.GetE2EShareKeys(e.ctx, shareID); err != nil {
+			return err
+		}
+		keys = e.unwrapShareKeys(dk, shareID, state)
+
+		next := 0
+		if state.CurrentVersion == 0 {
+			next = 1
+		} else if state.RotationPending && keys[state.CurrentVersion] != nil {
+			next = state.CurrentVersion + 1
+		}
+		if next == 0 {
+			break
+		}
+
+		key, err := e.publishShareKey(shareID, next, state.Devices)
+		if api.IsConflict(err) && attempt == 0 {
+			continue // another device got there first
+		}
+		if err != nil {
+			return fmt.Errorf("failed to publish share key: %w", err)
+		}
+		keys[next] = key
+		state.CurrentVersion = next
+		e.logger.Info().Str("share_id", shareID).Int("version", next).Msg("Published new share key")
+		break
+	}
+
+	if keys[state.CurrentVersion] == nil || keys[1] == nil {
+		return fmt.Errorf("share key has not been granted to this device yet (key fingerprint %s)", dk.Fingerprint())
+	}
+
+	e.grantShareKeys(shareID, keys, state)
+
+	kr, err := e2e.NewKeyring(shareID, keys, state.CurrentVersion)
+	if err != nil {
+		return err
+	}
+	e.keyringsMu.Lock()
+	e.keyrings[shareID] = kr
+	e.keyringsMu.Unlock()
+	return nil
+}
+
+// unwrapShareKeys opens every key version wrapped for this device.
+func (e *Engine) unwrapShareKeys(dk *e2e.DeviceKey, shareID string, state *api.E2EShareKeys) map[int][]byte {
+	keys := make(map[int][]byte, len(state.Keys))
+	for _, k := range state.Keys {
+		if k.Wrap == nil {
+			continue
+		}
+		key, err := dk.Unwrap((*e2e.WrappedKey)(k.Wrap), shareID, k.Version, e.cfg.DeviceID)
+		if err != nil {
+			e.logger.Warn().Err(err).Str("share_id", shareID).Int("version", k.Version).Msg("Ignoring share key that does not open")
+			continue
+		}
+		keys[k.Version] = key
+	}
+	return keys
+}
+
+// publishShareKey creates a share key version wrapped for every device.
+func (e *Engine) publishShareKey(shareID string, version int, devices []api.E2EDevice) ([]byte, error) {
+	key, err := e2e.NewShareKey()
+	if err != nil {
+		return nil, err
+	}
+	wraps := make(map[string]*api.E2EWrap, len(devices))
+	for _, d := range devices {
+		w, err := e2e.WrapShareKey(key, d.PublicKey, shareID, version, d.DeviceID)
+		if err != nil {
+			return nil, fmt.Errorf("device %s: %w", d.DeviceID, err)
+		}
+		wraps[d.DeviceID] = (*api.E2EWrap)(w)
+	}
+	if err := e.apiClient.PutE2EShareKeys(e.ctx, shareID, version, wraps); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// grantShareKeys wraps the key versions this device holds for devices that
+// lack them. Devices are trusted as listed by the server; their fingerprints
+// are logged so users can compare them with the device list.
+func (e *Engine) grantShareKeys(shareID string, keys map[int][]byte, state *api.E2EShareKeys) {
+	pub := make(map[string]api.E2EDevice, len(state.Devices))
+	for _, d := range state.Devices {
+		pub[d.DeviceID] = d
+	}
+
+	grants := make(map[int]map[string]*api.E2EWrap)
+	for deviceID, versions := range state.Missing {
+		d, ok := pub[deviceID]
+		if !ok || deviceID == e.cfg.DeviceID {
+			continue
+		}
+		for _, v := range versions {
+			if keys[v] == nil {
+				continue
+			}
+			w, err := e2e.WrapShareKey(keys[v], d.PublicKey, shareID, v, deviceID)
+			if err != nil {
+				e.logger.Warn().Err(err).Str("device_id", deviceID).Msg("Cannot wrap share key for device")
+				break
+			}
+			if grants[v] == nil {
+				grants[v] = make(map[string]*api.E2EWrap)
+			}
+			grants[v][deviceID] = (*api.E2EWrap)(w)
+		}
+	}
+
+	for v, wraps := range grants {
+		if err := e.apiClient.PutE2EShareKeys(e.ctx, shareID, v, wraps); err != nil {
+			e.logger.Warn().Err(err).Str("share_id", shareID).Int("version", v).Msg("Failed to grant share key")
+			continue
+		}
+		for deviceID := range wraps {
+			e.logger.Info().
+				Str("share_id", shareID).
+				Str("device_id", deviceID).
+				Str("fingerprint", pub[deviceID].Fingerprint).
+				Int("version", v).
+				Msg("Granted share key to device")
+		}
+	}
+}
+
+// downloadEncrypted downloads and decrypts a file of an end-to-end encrypted
+// share. Re-encrypting the local copy reproduces the server's ciphertext for
+// every unchanged chunk, so large files still use block delta sync.
+func (e *Engine) downloadEncrypted(kr *e2e.Keyring, shareID, shareName, remotePath, localPath string) error {
+	remote := kr.EncryptPath(remotePath)
+	ctPath := localPath + e2eTempSuffix
+	defer os.Remove(ctPath)
+
+	delta := false
+	if info, err := os.Stat(localPath); err == nil && info.Size() > hash.DefaultBlockSize {
+		delta = encryptFile(kr, localPath, ctPath) == nil
+	}
+	var err error
+	if delta {
+		err = e.deltaDownload(shareID, shareName, remote, ctPath)
+	} else {
+		err = e.webdav.Download(e.ctx, shareID, remote, ctPath)
+	}
+	if err != nil {
+		e.database.LogActivity(shareID, remotePath, "download", "error", err.Error(), 0)
+		return err
+	}
+
+	size, err := decryptFile(kr, ctPath, localPath)
+	if err != nil {
+		e.database.LogActivity(shareID, remotePath, "download", "error", err.Error(), 0)
+		return fmt.Errorf("failed to decrypt %s: %w", remotePath, err)
+	}
+	e.downloadedBytes.Add(size)
+	e.database.LogActivity(shareID, remotePath, "download", "success", "", size)
+	return nil
+}
+
+// encryptFile writes the E2E ciphertext of src to dst.
+func encryptFile(kr *e2e.Keyring, src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := kr.EncryptFile(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return nil
+}
+
+// decryptFile replaces dst with the plaintext of the E2E file src, keeping
+// its modification time. dst is only touched once src authenticated.
+func decryptFile(kr *e2e.Keyring, src, dst string) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return 0, err
+	}
+	tmp := dst + ".nstmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	n, err := kr.DecryptFile(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		os.Chtimes(tmp, info.ModTime(), info.ModTime())
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	return n, nil
+}
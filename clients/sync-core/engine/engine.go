@@ -3,8 +3,8 @@ package engine
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -18,6 +18,7 @@ import (
 	"nithronos/clients/sync-core/api"
 	"nithronos/clients/sync-core/config"
 	"nithronos/clients/sync-core/db"
+	"nithronos/clients/sync-core/e2e"
 	"nithronos/clients/sync-core/hash"
 	"nithronos/clients/sync-core/watcher"
 )
@@ -58,6 +59,7 @@ type Engine struct {
 	cfg       *config.Config
 	apiClient *api.Client
 	webdav    *api.WebDAVClient
+	realtime  *api.RealtimeClient
 	database  *db.Database
 	watchers  map[string]*watcher.Watcher // shareID -> watcher
 	logger    zerolog.Logger
@@ -68,6 +70,17 @@ type Engine struct {
 	shares     []api.SyncShare
 	sharesMu   sync.RWMutex
 
+	// End-to-end encryption: this device's key and the keyrings of
+	// encrypted shares
+	deviceKey   *e2e.DeviceKey
+	e2eEnrolled bool
+	keyrings    map[string]*e2e.Keyring
+	keyringsMu  sync.RWMutex
+
+	// Shares with a sync waiting on syncMu (collapses repeated triggers)
+	pendingSync   map[string]bool
+	pendingSyncMu sync.Mutex
+
 	// Progress tracking
 	currentFile    atomic.Value
 	uploadedBytes  atomic.Int64
@@ -119,17 +132,22 @@ func New(cfg *config.Config, logger zerolog.Logger) (*Engine, error) {
 
 	ctx, cancel := context.WithCancel(context.Background())
 
+	apiClient := api.NewClient(cfg)
+
 	e := &Engine{
-		cfg:        cfg,
-		apiClient:  api.NewClient(cfg),
-		webdav:     api.NewWebDAVClient(cfg),
-		database:   database,
-		watchers:   make(map[string]*watcher.Watcher),
-		logger:     logger.With().Str("component", "sync-engine").Logger(),
-		ctx:        ctx,
-		cancel:     cancel,
-		pauseChan:  make(chan struct{}),
-		resumeChan: make(chan struct{}),
+		cfg:         cfg,
+		apiClient:   apiClient,
+		webdav:      api.NewWebDAVClient(cfg),
+		realtime:    api.NewRealtimeClient(apiClient, logger),
+		database:    database,
+		watchers:    make(map[string]*watcher.Watcher),
+		pendingSync: make(map[string]bool),
+		keyrings:    make(map[string]*e2e.Keyring),
+		logger:      logger.With().Str("component", "sync-engine").Logger(),
+		ctx:         ctx,
+		cancel:      cancel,
+		pauseChan:   make(chan struct{}),
+		resumeChan:  make(chan struct{}),
 	}
 
 	e.state.Store(int32(StateStopped))
@@ -218,9 +236,15 @@ func (e *Engine) Start() error {
 		go e.processWatcherEvents(share.ID, share.Name, w)
 	}
 
+	// Continue uploads interrupted by the last shutdown
+	e.resumePendingUploads()
+
 	// Start main sync loop
 	go e.syncLoop()
 
+	// Listen for server push notifications; polling covers any gaps
+	go e.realtimeLoop()
+
 	e.setState(StateIdle)
 	e.logger.Info().Int("shares", len(e.watchers)).Msg("Sync engine started")
 
@@ -277,11 +301,24 @@ func (e *Engine) SyncNow() {
 
 	for _, share := range shares {
 		if e.isShareEnabled(share.ID) {
-			go e.syncShare(share.ID, share.Name)
+			e.requestSync(share.ID, share.Name)
 		}
 	}
 }
 
+// requestSync schedules a share sync unless one is already waiting to run.
+func (e *Engine) requestSync(shareID, shareName string) {
+	e.pendingSyncMu.Lock()
+	if e.pendingSync[shareID] {
+		e.pendingSyncMu.Unlock()
+		return
+	}
+	e.pendingSync[shareID] = true
+	e.pendingSyncMu.Unlock()
+
+	go e.syncShare(shareID, shareName)
+}
+
 // GetState returns the current state.
 func (e *Engine) GetState() State {
 	return e.getState()
@@ -416,6 +453,7 @@ func (e *Engine) syncLoop() {
 
 	// Initial sync
 	e.SyncNow()
+	lastPoll := time.Now()
 
 	for {
 		select {
@@ -426,7 +464,13 @@ func (e *Engine) syncLoop() {
 			if e.getState() == StatePaused {
 				continue
 			}
+			// While push notifications are live only an occasional safety
+			// poll is needed
+			if e.realtime.Connected() && time.Since(lastPoll) < realtimeSafetyPoll {
+				continue
+			}
 			e.SyncNow()
+			lastPoll = time.Now()
 
 		case <-e.pauseChan:
 			// Wait for resume
@@ -435,10 +479,60 @@ func (e *Engine) syncLoop() {
 	}
 }
 
+// realtimeSafetyPoll is how often shares are polled while push notifications
+// are connected, in case a notification was missed.
+const realtimeSafetyPoll = 10 * time.Minute
+
+// realtimeLoop syncs shares as soon as the server reports changes.
+func (e *Engine) realtimeLoop() {
+	var shareIDs []string
+	e.sharesMu.RLock()
+	for _, share := range e.shares {
+		if e.isShareEnabled(share.ID) {
+			shareIDs = append(shareIDs, share.ID)
+		}
+	}
+	e.sharesMu.RUnlock()
+	if len(shareIDs) == 0 {
+		return
+	}
+
+	// Notifications sent while disconnected are lost; catch up on reconnect
+	first := true
+	e.realtime.SetOnConnect(func() {
+		if first {
+			first = false // syncLoop already did the initial sync
+			return
+		}
+		e.SyncNow()
+	})
+	go e.realtime.Run(e.ctx, shareIDs)
+
+	for {
+		select {
+		case <-e.ctx.Done():
+			return
+		case change := <-e.realtime.Changes():
+			if e.getState() == StatePaused {
+				continue
+			}
+			if cursor, _ := e.database.GetCursor(change.ShareID); cursor == change.Cursor {
+				continue
+			}
+			e.logger.Debug().Str("share_id", change.ShareID).Msg("Server reported share changes")
+			e.requestSync(change.ShareID, e.getShareName(change.ShareID))
+		}
+	}
+}
+
 func (e *Engine) syncShare(shareID, shareName string) {
 	e.syncMu.Lock()
 	defer e.syncMu.Unlock()
 
+	e.pendingSyncMu.Lock()
+	delete(e.pendingSync, shareID)
+	e.pendingSyncMu.Unlock()
+
 	if e.getState() == StatePaused || e.getState() == StateStopped {
 		return
 	}
@@ -452,29 +546,60 @@ func (e *Engine) syncShare(shareID, shareName string) {
 
 	e.logger.Debug().Str("share", shareName).Msg("Starting share sync")
 
+	// End-to-end encrypted shares can only be synced with their key
+	if share, ok := e.getShare(shareID); ok && share.E2E {
+		if err := e.refreshKeyring(shareID); err != nil {
+			if e.keyring(shareID) == nil {
+				e.logger.Error().Err(err).Str("share", shareName).Msg("End-to-end encrypted share is not readable")
+				return
+			}
+			e.logger.Warn().Err(err).Str("share", shareName).Msg("Failed to refresh share keys")
+		}
+	}
+
 	// Get current cursor
 	cursor, _ := e.database.GetCursor(shareID)
 
-	// Fetch remote changes
-	changes, err := e.apiClient.GetChanges(e.ctx, shareID, cursor, 1000)
-	if err != nil {
-		e.logger.Error().Err(err).Str("share", shareName).Msg("Failed to fetch changes")
-		return
-	}
+	// Fetch remote changes page by page until the server has nothing more
+	for {
+		changes, err := e.apiClient.GetChanges(e.ctx, shareID, cursor, 1000)
+		if api.IsCursorExpired(err) && cursor != "" {
+			// Server journal was reset or compacted past our position
+			e.logger.Warn().Str("share", shareName).Msg("Sync cursor expired, resyncing share")
+			cursor = ""
+			continue
+		}
+		if err != nil {
+			e.logger.Error().Err(err).Str("share", shareName).Msg("Failed to fetch changes")
+			return
+		}
 
-	// Process remote changes
-	for _, change := range changes.Changes {
-		if err := e.processRemoteChange(shareID, shareName, change); err != nil {
-			e.logger.Error().Err(err).
-				Str("share", shareName).
-				Str("path", change.Path).
-				Msg("Failed to process remote change")
+		// Process remote changes
+		for _, change := range changes.Changes {
+			change, err := e.plainChange(shareID, change)
+			if err != nil {
+				e.logger.Warn().Err(err).
+					Str("share", shareName).
+					Str("path", change.Path).
+					Msg("Skipping remote change that is not end-to-end encrypted")
+				continue
+			}
+			if err := e.processRemoteChange(shareID, shareName, change); err != nil {
+				e.logger.Error().Err(err).
+					Str("share", shareName).
+					Str("path", change.Path).
+					Msg("Failed to process remote change")
+			}
 		}
-	}
 
-	// Update cursor
-	if changes.Cursor != "" {
-		e.database.SetCursor(shareID, changes.Cursor)
+		// Update cursor
+		if changes.Cursor != "" {
+			cursor = changes.Cursor
+			e.database.SetCursor(shareID, cursor)
+		}
+		if !changes.HasMore || e.ctx.Err() != nil {
+			break
+		}
 	}
 
 	// Process pending local operations
@@ -553,6 +678,10 @@ func (e *Engine) processRemoteChange(shareID, shareName string, change api.FileC
 }
 
 func (e *Engine) downloadFile(shareID, shareName, remotePath, localPath string) error {
+	if kr := e.keyring(shareID); kr != nil {
+		return e.downloadEncrypted(kr, shareID, shareName, remotePath, localPath)
+	}
+
 	// Use delta sync for large files
 	if info, err := os.Stat(localPath); err == nil && info.Size() > hash.DefaultBlockSize {
 		return e.deltaDownload(shareID, shareName, remotePath, localPath)
@@ -576,37 +705,45 @@ func (e *Engine) downloadFile(shareID, shareName, remotePath, localPath string)
 }
 
 func (e *Engine) deltaDownload(shareID, shareName, remotePath, localPath string) error {
-	// Get remote block hashes
-	remoteHashes, err := e.apiClient.GetBlockHashes(e.ctx, shareID, remotePath, hash.DefaultBlockSize)
+	// Get remote chunk hashes
+	remoteHashes, err := e.apiClient.GetChunkHashes(e.ctx, shareID, remotePath, hash.AvgChunkSize)
 	if err != nil {
 		// Fall back to regular download
 		return e.webdav.Download(e.ctx, shareID, remotePath, localPath)
 	}
 
-	// Compute delta plan
-	localHashes, err := hash.ComputeBlockHashes(localPath, hash.DefaultBlockSize)
-	if err != nil {
-		return e.webdav.Download(e.ctx, shareID, remotePath, localPath)
-	}
-
-	// Find blocks that need to be downloaded
-	neededBlocks := make([]int, 0)
-	remoteBlockMap := make(map[string]api.BlockHash)
-	for i, rb := range remoteHashes.Blocks {
-		remoteBlockMap[rb.StrongHash] = rb
-		found := false
-		for _, lb := range localHashes.Blocks {
-			if lb.StrongHash == rb.StrongHash {
-				found = true
-				break
-			}
+	// Chunk the local copy the same way; servers without content-defined
+	// chunking return fixed-size blocks
+	var localBlocks []hash.BlockHash
+	if remoteHashes.Mode == api.ChunkModeCDC {
+		localChunks, err := hash.ComputeChunkHashes(localPath, remoteHashes.MinBlockSize, remoteHashes.BlockSize, remoteHashes.MaxBlockSize)
+		if err != nil {
+			return e.webdav.Download(e.ctx, shareID, remotePath, localPath)
 		}
-		if !found {
-			neededBlocks = append(neededBlocks, i)
+		if localChunks.FileHash == remoteHashes.Hash {
+			// Files are identical
+			return nil
 		}
+		localBlocks = localChunks.Chunks
+	} else {
+		localHashes, err := hash.ComputeBlockHashes(localPath, remoteHashes.BlockSize)
+		if err != nil {
+			return e.webdav.Download(e.ctx, shareID, remotePath, localPath)
+		}
+		localBlocks = localHashes.Blocks
 	}
 
-	if len(neededBlocks) == 0 {
+	localBlockMap := make(map[string]hash.BlockHash, len(localBlocks))
+	for _, lb := range localBlocks {
+		localBlockMap[lb.StrongHash] = lb
+	}
+	needed := 0
+	for _, rb := range remoteHashes.Blocks {
+		if _, ok := localBlockMap[rb.StrongHash]; !ok {
+			needed++
+		}
+	}
+	if needed == 0 && len(remoteHashes.Blocks) == len(localBlocks) {
 		// Files are identical
 		return nil
 	}
@@ -621,32 +758,39 @@ func (e *Engine) deltaDownload(shareID, shareName, remotePath, localPath string)
 
 	localFile, err := os.Open(localPath)
 	if err != nil {
+		f.Close()
 		os.Remove(tmpPath)
 		return e.webdav.Download(e.ctx, shareID, remotePath, localPath)
 	}
 	defer localFile.Close()
 
-	// Build the new file from local blocks and downloaded blocks
-	for i, rb := range remoteHashes.Blocks {
+	// Build the new file from local blocks and downloaded ranges; runs of
+	// missing blocks are fetched with one range request
+	blocks := remoteHashes.Blocks
+	for i := 0; i < len(blocks); {
 		var blockData []byte
 
-		// Check if we have this block locally
-		found := false
-		for _, lb := range localHashes.Blocks {
-			if lb.StrongHash == rb.StrongHash {
-				// Read from local file
-				blockData = make([]byte, lb.Size)
-				localFile.Seek(lb.Offset, io.SeekStart)
-				localFile.Read(blockData)
-				found = true
-				break
+		if lb, ok := localBlockMap[blocks[i].StrongHash]; ok {
+			// Read from local file
+			blockData = make([]byte, lb.Size)
+			if _, err := localFile.ReadAt(blockData, lb.Offset); err != nil {
+				f.Close()
+				os.Remove(tmpPath)
+				return e.webdav.Download(e.ctx, shareID, remotePath, localPath)
 			}
-		}
-
-		if !found {
-			// Download this block
-			blockData, err = e.webdav.DownloadRange(e.ctx, shareID, remotePath, rb.Offset, int64(rb.Size))
+			i++
+		} else {
+			start := blocks[i].Offset
+			length := int64(0)
+			for ; i < len(blocks); i++ {
+				if _, ok := localBlockMap[blocks[i].StrongHash]; ok {
+					break
+				}
+				length += int64(blocks[i].Size)
+			}
+			blockData, err = e.webdav.DownloadRange(e.ctx, shareID, remotePath, start, length)
 			if err != nil {
+				f.Close()
 				os.Remove(tmpPath)
 				return e.webdav.Download(e.ctx, shareID, remotePath, localPath)
 			}
@@ -654,11 +798,10 @@ func (e *Engine) deltaDownload(shareID, shareName, remotePath, localPath string)
 		}
 
 		if _, err := f.Write(blockData); err != nil {
+			f.Close()
 			os.Remove(tmpPath)
 			return err
 		}
-
-		_ = i // Used for tracking progress
 	}
 
 	f.Close()
@@ -707,7 +850,7 @@ func (e *Engine) processOperation(ctx context.Context, shareID, shareName string
 		return e.uploadFile(ctx, shareID, shareName, op.Path, localPath, op.RetryCount)
 
 	case "delete_remote":
-		if err := e.webdav.Delete(ctx, shareID, op.Path); err != nil {
+		if err := e.webdav.Delete(ctx, shareID, e.remotePath(shareID, op.Path)); err != nil {
 			e.logger.Error().Err(err).Str("path", op.Path).Msg("Failed to delete remote file")
 			// Requeue if not permanent failure
 			if op.RetryCount < e.cfg.RetryAttempts {
@@ -719,7 +862,7 @@ func (e *Engine) processOperation(ctx context.Context, shareID, shareName string
 		e.database.LogActivity(shareID, op.Path, "delete_remote", "success", "", 0)
 
 	case "mkdir":
-		if err := e.webdav.MkdirAll(ctx, shareID, op.Path); err != nil {
+		if err := e.webdav.MkdirAll(ctx, shareID, e.remotePath(shareID, op.Path)); err != nil {
 			return err
 		}
 	}
@@ -738,33 +881,70 @@ func (e *Engine) uploadFile(ctx context.Context, shareID, shareName, remotePath,
 	}
 
 	if info.IsDir() {
-		return e.webdav.MkdirAll(ctx, shareID, remotePath)
+		return e.webdav.MkdirAll(ctx, shareID, e.remotePath(shareID, remotePath))
 	}
 
 	e.currentFile.Store(remotePath)
 	defer e.currentFile.Store("")
 
-	// Use delta sync for large files if remote exists
-	if info.Size() > hash.DefaultBlockSize {
-		if exists, _ := e.webdav.Exists(ctx, shareID, remotePath); exists {
-			if err := e.deltaUpload(ctx, shareID, remotePath, localPath); err == nil {
-				return nil
-			}
-			// Fall through to regular upload on error
+	// End-to-end encrypted shares only ever receive ciphertext
+	uploadPath, uploadTarget := localPath, remotePath
+	if kr := e.keyring(shareID); kr != nil {
+		uploadPath, uploadTarget = localPath+e2eTempSuffix, kr.EncryptPath(remotePath)
+		if err := encryptFile(kr, localPath, uploadPath); err != nil {
+			e.database.LogActivity(shareID, remotePath, "upload", "error", err.Error(), 0)
+			return err
 		}
+		defer os.Remove(uploadPath)
 	}
 
-	// Regular upload
-	if err := e.webdav.Upload(ctx, shareID, localPath, remotePath); err != nil {
-		e.database.LogActivity(shareID, remotePath, "upload", "error", err.Error(), 0)
-		
+	var modTime *time.Time
+	if uploadPath == localPath {
+		mt := info.ModTime()
+		modTime = &mt
+	}
+	requeue := func(err error) {
 		if retryCount < e.cfg.RetryAttempts {
 			e.database.RequeueOperation(shareID, remotePath, "upload", err.Error(), retryCount+1, time.Duration(e.cfg.RetryDelaySecs)*time.Second)
 		}
-		return err
 	}
 
-	e.uploadedBytes.Add(info.Size())
+	// Large files are sent as a manifest of chunks so only chunks the
+	// server does not already have cross the wire
+	sent, done := info.Size(), false
+	if info.Size() > hash.MaxChunkSize {
+		n, err := e.deltaUpload(ctx, shareID, uploadTarget, uploadPath, modTime)
+		if err == nil {
+			sent, done = n, true
+		} else {
+			// Fall through to a whole-file upload on error
+			e.logger.Debug().Err(err).Str("path", remotePath).Msg("Delta upload not used, uploading whole file")
+		}
+	}
+
+	// Whole large files go through a resumable upload session so an
+	// interrupted transfer continues where it stopped
+	if !done && info.Size() > resumableUploadThreshold {
+		n, err := e.resumableUpload(ctx, shareID, remotePath, uploadTarget, uploadPath, modTime)
+		if err == nil {
+			sent, done = n, true
+		} else if !errors.Is(err, errResumableUnsupported) {
+			e.database.LogActivity(shareID, remotePath, "upload", "error", err.Error(), n)
+			requeue(err)
+			return err
+		}
+	}
+
+	// Regular upload
+	if !done {
+		if err := e.webdav.Upload(ctx, shareID, uploadPath, uploadTarget); err != nil {
+			e.database.LogActivity(shareID, remotePath, "upload", "error", err.Error(), 0)
+			requeue(err)
+			return err
+		}
+	}
+
+	e.uploadedBytes.Add(sent)
 	e.pendingUploads.Add(-1)
 
 	// Update database
@@ -785,32 +965,120 @@ func (e *Engine) uploadFile(ctx context.Context, shareID, shareName, remotePath,
 	return nil
 }
 
-func (e *Engine) deltaUpload(ctx context.Context, shareID, remotePath, localPath string) error {
-	// Get remote block hashes
-	remoteHashes, err := e.apiClient.GetBlockHashes(ctx, shareID, remotePath, hash.DefaultBlockSize)
+// deltaUpload sends a file as a manifest of content-defined chunks. Only the
+// chunks the server cannot find in the user's shares or earlier uploads are
+// sent; it returns how many bytes that was.
+func (e *Engine) deltaUpload(ctx context.Context, shareID, remotePath, localPath string, modTime *time.Time) (int64, error) {
+	local, err := hash.ComputeChunkHashes(localPath, hash.MinChunkSize, hash.AvgChunkSize, hash.MaxChunkSize)
 	if err != nil {
-		return err
+		return 0, err
+	}
+
+	// Hashing the current remote copy lets the server reuse its chunks
+	if exists, _ := e.webdav.Exists(ctx, shareID, remotePath); exists {
+		remote, err := e.apiClient.GetChunkHashes(ctx, shareID, remotePath, hash.AvgChunkSize)
+		if err != nil {
+			return 0, err
+		}
+		if remote.Hash == local.FileHash {
+			return 0, nil
+		}
 	}
 
-	// Compute delta plan
-	plan, err := hash.ComputeDeltaPlan(localPath, &hash.BlockHashes{
-		BlockSize: remoteHashes.BlockSize,
-		FileSize:  remoteHashes.Size,
-		Blocks:    convertAPIBlockHashes(remoteHashes.Blocks),
-	}, hash.DefaultBlockSize)
+	manifest := &api.FileManifest{
+		Path:   remotePath,
+		Size:   local.FileSize,
+		Hash:   local.FileHash,
+		MTime:  modTime,
+		Chunks: make([]api.ManifestChunk, len(local.Chunks)),
+	}
+	hashes := make([]string, len(local.Chunks))
+	for i, c := range local.Chunks {
+		manifest.Chunks[i] = api.ManifestChunk{Hash: c.StrongHash, Size: int64(c.Size)}
+		hashes[i] = c.StrongHash
+	}
+
+	missing, err := e.apiClient.MissingChunks(ctx, shareID, hashes)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	if local.FileSize > resumableUploadThreshold && missingBytes(local.Chunks, missing)*2 > local.FileSize {
+		// Mostly new data travels better in a resumable upload
+		return 0, errDeltaNotWorthwhile
+	}
+
+	var sent int64
+	for attempt := 0; ; attempt++ {
+		n, err := e.uploadChunks(ctx, localPath, local.Chunks, missing)
+		sent += n
+		if err != nil {
+			return sent, err
+		}
+		err = e.apiClient.CommitManifest(ctx, shareID, manifest)
+		// A file the server meant to copy a chunk from may have changed
+		// meanwhile; upload what it lacks and try once more
+		if missing = api.MissingChunksFromError(err); missing != nil && attempt == 0 {
+			continue
+		}
+		return sent, err
 	}
+}
+
+// errDeltaNotWorthwhile means the server lacks most of a file's chunks.
+var errDeltaNotWorthwhile = errors.New("delta savings too small")
 
-	// If delta savings are minimal, do full upload
-	if float64(plan.SavedBytes)/float64(plan.TotalBytes) < 0.2 {
-		return fmt.Errorf("delta savings too small")
+// missingBytes sums the sizes of the distinct missing chunks.
+func missingBytes(chunks []hash.BlockHash, missing []string) int64 {
+	need := make(map[string]bool, len(missing))
+	for _, h := range missing {
+		need[h] = true
 	}
+	var n int64
+	for _, c := range chunks {
+		if need[c.StrongHash] {
+			n += int64(c.Size)
+			delete(need, c.StrongHash)
+		}
+	}
+	return n
+}
 
-	// For simplicity, we'll do a full upload for now
-	// A full delta upload implementation would send only the changed blocks
-	// and have the server reconstruct the file
-	return fmt.Errorf("delta upload requires server-side support")
+// uploadChunks uploads the chunks of a local file the server is missing.
+func (e *Engine) uploadChunks(ctx context.Context, localPath string, chunks []hash.BlockHash, missing []string) (int64, error) {
+	if len(missing) == 0 {
+		return 0, nil
+	}
+	need := make(map[string]bool, len(missing))
+	for _, h := range missing {
+		need[h] = true
+	}
+
+	f, err := os.Open(localPath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var sent int64
+	for _, c := range chunks {
+		if !need[c.StrongHash] {
+			continue
+		}
+		delete(need, c.StrongHash)
+
+		data := make([]byte, c.Size)
+		if _, err := f.ReadAt(data, c.Offset); err != nil {
+			return sent, err
+		}
+		if hash.BytesHash(data) != c.StrongHash {
+			return sent, fmt.Errorf("%s changed during upload", localPath)
+		}
+		if err := e.apiClient.UploadChunk(ctx, c.StrongHash, data); err != nil {
+			return sent, err
+		}
+		sent += int64(c.Size)
+	}
+	return sent, nil
 }
 
 func (e *Engine) handleConflict(shareID, path string, localModTime time.Time, localHash string, remote api.FileChange) {
@@ -868,29 +1136,27 @@ func (e *Engine) handleConflict(shareID, path string, localModTime time.Time, lo
 	}
 }
 
-func (e *Engine) getShareName(shareID string) string {
+func (e *Engine) getShare(shareID string) (api.SyncShare, bool) {
 	e.sharesMu.RLock()
 	defer e.sharesMu.RUnlock()
-	
+
 	for _, share := range e.shares {
 		if share.ID == shareID {
-			return share.Name
+			return share, true
 		}
 	}
-	return shareID
+	return api.SyncShare{}, false
 }
 
-func convertAPIBlockHashes(blocks []api.BlockHash) []hash.BlockHash {
-	result := make([]hash.BlockHash, len(blocks))
-	for i, b := range blocks {
-		result[i] = hash.BlockHash{
-			Index:      b.Index,
-			Offset:     b.Offset,
-			Size:       b.Size,
-			StrongHash: b.StrongHash,
-			WeakHash:   b.WeakHash,
+func (e *Engine) getShareName(shareID string) string {
+	e.sharesMu.RLock()
+	defer e.sharesMu.RUnlock()
+	
+	for _, share := range e.shares {
+		if share.ID == shareID {
+			return share.Name
 		}
 	}
-	return result
+	return shareID
 }
 
@@ -0,0 +1,171 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"nithronos/clients/sync-core/api"
+	"nithronos/clients/sync-core/db"
+	"nithronos/clients/sync-core/hash"
+)
+
+const (
+	// resumableUploadThreshold is the size above which files are uploaded
+	// through a resumable upload session.
+	resumableUploadThreshold = 16 * 1024 * 1024
+
+	// resumableChunkSize is how much data one upload request carries.
+	resumableChunkSize = 8 * 1024 * 1024
+)
+
+// errResumableUnsupported means the server or share cannot take resumable
+// uploads and the file should be sent over WebDAV instead.
+var errResumableUnsupported = errors.New("resumable uploads not supported")
+
+// resumableUpload uploads a file through an upload session on the server.
+// The session is recorded in the local database, so an upload interrupted
+// by a network drop or a restart continues from the last offset the server
+// confirmed. dbPath is the share path the session is recorded under and
+// target the path on the server. It returns how many bytes were sent.
+func (e *Engine) resumableUpload(ctx context.Context, shareID, dbPath, target, uploadPath string, modTime *time.Time) (int64, error) {
+	f, err := os.Open(uploadPath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+	contentHash, err := hash.ReaderHash(f)
+	if err != nil {
+		return 0, err
+	}
+
+	uploadID, offset, err := e.uploadSession(ctx, shareID, dbPath, target, size, contentHash, modTime)
+	if err != nil {
+		return 0, err
+	}
+
+	var sent int64
+	buf := make([]byte, resumableChunkSize)
+	for offset < size {
+		n := int64(len(buf))
+		if size-offset < n {
+			n = size - offset
+		}
+		if _, err := f.ReadAt(buf[:n], offset); err != nil && err != io.EOF {
+			return sent, err
+		}
+
+		session, err := e.apiClient.WriteUpload(ctx, uploadID, offset, buf[:n])
+		if api.ErrorCode(err) == "sync.upload_offset_mismatch" {
+			// An earlier request reached the server after all; continue
+			// from the offset it has
+			if session, err = e.apiClient.GetUpload(ctx, uploadID); err == nil && session.Offset == offset {
+				err = fmt.Errorf("upload %s is stuck at offset %d", uploadID, offset)
+			}
+		}
+		if err != nil {
+			// The session stays recorded; the retry resumes it
+			return sent, err
+		}
+		if session.Offset > offset {
+			sent += session.Offset - offset
+		}
+		offset = session.Offset
+		if err := e.database.UpdateUploadProgress(shareID, dbPath, offset); err != nil {
+			e.logger.Warn().Err(err).Str("path", dbPath).Msg("Failed to record upload progress")
+		}
+	}
+
+	if err := e.apiClient.FinalizeUpload(ctx, uploadID); err != nil {
+		if api.ErrorCode(err) == "sync.hash_mismatch" || api.IsNotFound(err) {
+			// Start over with a new session next time
+			e.database.DeleteUploadSession(shareID, dbPath)
+		}
+		return sent, err
+	}
+	e.database.DeleteUploadSession(shareID, dbPath)
+	return sent, nil
+}
+
+// uploadSession returns the session to upload a file with and the offset to
+// continue from, resuming the recorded session while it still matches the
+// file and the server still has it.
+func (e *Engine) uploadSession(ctx context.Context, shareID, dbPath, target string, size int64, contentHash string, modTime *time.Time) (string, int64, error) {
+	recorded, err := e.database.GetUploadSession(shareID, dbPath)
+	if err != nil {
+		return "", 0, err
+	}
+	if recorded != nil {
+		if recorded.ContentHash == contentHash && recorded.Size == size {
+			session, err := e.apiClient.GetUpload(ctx, recorded.UploadID)
+			if err == nil {
+				e.logger.Info().
+					Str("path", dbPath).
+					Int64("offset", session.Offset).
+					Int64("size", size).
+					Msg("Resuming upload")
+				return session.ID, session.Offset, nil
+			}
+			if !api.IsNotFound(err) {
+				return "", 0, err
+			}
+			// The session expired on the server
+		} else {
+			// The file changed since; its partial upload is useless
+			if err := e.apiClient.AbortUpload(ctx, recorded.UploadID); err != nil && !api.IsNotFound(err) {
+				e.logger.Debug().Err(err).Str("upload_id", recorded.UploadID).Msg("Failed to abort stale upload")
+			}
+		}
+		e.database.DeleteUploadSession(shareID, dbPath)
+	}
+
+	session, err := e.apiClient.CreateUpload(ctx, shareID, target, size, contentHash, modTime)
+	if err != nil {
+		if api.IsNotFound(err) || api.ErrorCode(err) == "sync.share_encrypted" {
+			return "", 0, fmt.Errorf("%w: %v", errResumableUnsupported, err)
+		}
+		return "", 0, err
+	}
+	if err := e.database.SaveUploadSession(&db.UploadSession{
+		ShareID:     shareID,
+		Path:        dbPath,
+		UploadID:    session.ID,
+		Size:        size,
+		ContentHash: contentHash,
+	}); err != nil {
+		e.logger.Warn().Err(err).Str("path", dbPath).Msg("Failed to record upload session")
+	}
+	return session.ID, 0, nil
+}
+
+// resumePendingUploads queues the uploads that were in progress when the
+// engine last stopped.
+func (e *Engine) resumePendingUploads() {
+	sessions, err := e.database.ListUploadSessions()
+	if err != nil {
+		e.logger.Error().Err(err).Msg("Failed to list pending uploads")
+		return
+	}
+	for _, s := range sessions {
+		if !e.isShareEnabled(s.ShareID) {
+			continue
+		}
+		if err := e.database.EnqueueOperation(s.ShareID, s.Path, "upload", 1); err != nil {
+			e.logger.Warn().Err(err).Str("path", s.Path).Msg("Failed to queue pending upload")
+			continue
+		}
+		e.logger.Info().
+			Str("path", s.Path).
+			Int64("uploaded", s.Uploaded).
+			Int64("size", s.Size).
+			Msg("Queued interrupted upload")
+	}
+}
@@ -0,0 +1,115 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"nithronos/clients/sync-core/api"
+)
+
+// resolveFile maps a file in the sync folder to its share and the path of
+// the file within the share.
+func (e *Engine) resolveFile(localPath string) (api.SyncShare, string, error) {
+	abs, err := filepath.Abs(localPath)
+	if err != nil {
+		return api.SyncShare{}, "", err
+	}
+
+	e.sharesMu.RLock()
+	shares := e.shares
+	e.sharesMu.RUnlock()
+
+	for _, share := range shares {
+		root := filepath.Join(e.cfg.SyncFolder, share.Name)
+		rel, err := filepath.Rel(root, abs)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		return share, filepath.ToSlash(rel), nil
+	}
+	return api.SyncShare{}, "", fmt.Errorf("%s is not in a synced share", localPath)
+}
+
+// versionFile resolves a local file for version requests and returns the
+// path the server knows it by.
+func (e *Engine) versionFile(localPath string) (api.SyncShare, string, string, error) {
+	share, relPath, err := e.resolveFile(localPath)
+	if err != nil {
+		return share, "", "", err
+	}
+	if share.E2E && e.keyring(share.ID) == nil {
+		return share, "", "", fmt.Errorf("keys of share %s are not available yet", share.Name)
+	}
+	return share, relPath, e.remotePath(share.ID, relPath), nil
+}
+
+// ListVersions returns the previous versions the server keeps of a file in
+// the sync folder, newest first.
+func (e *Engine) ListVersions(localPath string) ([]api.FileVersion, error) {
+	share, relPath, remote, err := e.versionFile(localPath)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := e.apiClient.ListVersions(e.ctx, share.ID, remote)
+	if err != nil {
+		return nil, err
+	}
+	for i := range versions {
+		versions[i].Path = relPath
+	}
+	return versions, nil
+}
+
+// RestoreVersion puts a previous version of a file back on the server. The
+// restored content then syncs down like any other change; the content it
+// replaced becomes a version itself.
+func (e *Engine) RestoreVersion(localPath, versionID string) error {
+	share, relPath, _, err := e.versionFile(localPath)
+	if err != nil {
+		return err
+	}
+	if _, err := e.apiClient.RestoreVersion(e.ctx, share.ID, versionID); err != nil {
+		e.database.LogActivity(share.ID, relPath, "restore_version", "error", err.Error(), 0)
+		return err
+	}
+	e.database.LogActivity(share.ID, relPath, "restore_version", "success", "", 0)
+	e.logger.Info().Str("share", share.Name).Str("path", relPath).Str("version", versionID).Msg("Restored previous version")
+
+	if e.getState() != StateStopped && e.getState() != StatePaused {
+		e.requestSync(share.ID, share.Name)
+	}
+	return nil
+}
+
+// SaveVersion writes a previous version of a file to dst, leaving the synced
+// file untouched.
+func (e *Engine) SaveVersion(localPath, versionID, dst string) error {
+	share, _, _, err := e.versionFile(localPath)
+	if err != nil {
+		return err
+	}
+
+	tmp := dst + e2eTempSuffix
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	err = e.apiClient.DownloadVersion(e.ctx, share.ID, versionID, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	if kr := e.keyring(share.ID); kr != nil {
+		if _, err := decryptFile(kr, tmp, dst); err != nil {
+			return fmt.Errorf("failed to decrypt version: %w", err)
+		}
+		return nil
+	}
+	return os.Rename(tmp, dst)
+}
@@ -0,0 +1,185 @@
+package hash
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/adler32"
+	"io"
+	"math/bits"
+	"os"
+)
+
+// Content-defined chunk size defaults. Boundaries depend only on the bytes
+// around them, so an insertion changes the chunks it touches and the ones
+// after it stay the same.
+const (
+	MinChunkSize = 16 * 1024
+	AvgChunkSize = 64 * 1024
+	MaxChunkSize = 256 * 1024
+)
+
+// gearTable maps each byte to a pseudo-random 64-bit value. It is derived
+// from a fixed seed so every client finds the same boundaries.
+var gearTable = func() [256]uint64 {
+	var t [256]uint64
+	for i := range t {
+		sum := sha256.Sum256([]byte{'n', 'o', 's', '-', 'g', 'e', 'a', 'r', byte(i)})
+		t[i] = binary.LittleEndian.Uint64(sum[:8])
+	}
+	return t
+}()
+
+// Chunk is one content-defined chunk of a stream.
+type Chunk struct {
+	Offset int64
+	Data   []byte // valid until the next call to Next
+}
+
+// Chunker splits a stream into content-defined chunks using FastCDC.
+type Chunker struct {
+	r        io.Reader
+	min, max int
+	maskS    uint64 // stricter mask used before the average size
+	maskL    uint64 // looser mask used after it
+	avg      int
+
+	buf    []byte
+	start  int
+	end    int
+	offset int64
+	eof    bool
+}
+
+// NewChunker returns a chunker with the default sizes.
+func NewChunker(r io.Reader) *Chunker {
+	return NewChunkerSize(r, MinChunkSize, AvgChunkSize, MaxChunkSize)
+}
+
+// NewChunkerSize returns a chunker with custom sizes; avg should be a power
+// of two between min and max.
+func NewChunkerSize(r io.Reader, min, avg, max int) *Chunker {
+	b := bits.Len(uint(avg)) - 1
+	return &Chunker{
+		r:     r,
+		min:   min,
+		avg:   avg,
+		max:   max,
+		maskS: ^uint64(0) << (64 - (b + 2)),
+		maskL: ^uint64(0) << (64 - (b - 2)),
+		buf:   make([]byte, 2*max),
+	}
+}
+
+// Next returns the next chunk, or io.EOF after the last one.
+func (c *Chunker) Next() (Chunk, error) {
+	if err := c.fill(); err != nil {
+		return Chunk{}, err
+	}
+	if c.start == c.end {
+		return Chunk{}, io.EOF
+	}
+
+	n := c.cut(c.buf[c.start:c.end])
+	chunk := Chunk{Offset: c.offset, Data: c.buf[c.start : c.start+n]}
+	c.start += n
+	c.offset += int64(n)
+	return chunk, nil
+}
+
+// fill tops the buffer up to at least max bytes unless the stream ends first.
+func (c *Chunker) fill() error {
+	if c.eof || c.end-c.start >= c.max {
+		return nil
+	}
+	// Move the unread tail to the front; the previous chunk is no longer
+	// referenced by the caller
+	copy(c.buf, c.buf[c.start:c.end])
+	c.end -= c.start
+	c.start = 0
+
+	for c.end < len(c.buf) && !c.eof {
+		n, err := c.r.Read(c.buf[c.end:])
+		c.end += n
+		if err == io.EOF {
+			c.eof = true
+		} else if err != nil {
+			return err
+		}
+		if c.end >= c.max {
+			break
+		}
+	}
+	return nil
+}
+
+// cut returns the length of the first chunk in data.
+func (c *Chunker) cut(data []byte) int {
+	n := len(data)
+	if n <= c.min {
+		return n
+	}
+	if n > c.max {
+		n = c.max
+	}
+	normal := c.avg
+	if normal > n {
+		normal = n
+	}
+
+	var fp uint64
+	i := c.min
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// FileChunks lists the content-defined chunks of a file.
+type FileChunks struct {
+	FileSize int64
+	FileHash string // SHA-256 of the whole file
+	Chunks   []BlockHash
+}
+
+// ComputeChunkHashes splits a file into content-defined chunks and hashes
+// each of them and the whole file.
+func ComputeChunkHashes(path string, min, avg, max int) (*FileChunks, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	full := sha256.New()
+	chunker := NewChunkerSize(io.TeeReader(f, full), min, avg, max)
+	result := &FileChunks{}
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		result.Chunks = append(result.Chunks, BlockHash{
+			Index:      len(result.Chunks),
+			Offset:     chunk.Offset,
+			Size:       len(chunk.Data),
+			StrongHash: BytesHash(chunk.Data),
+			WeakHash:   adler32.Checksum(chunk.Data),
+		})
+		result.FileSize += int64(len(chunk.Data))
+	}
+	result.FileHash = hex.EncodeToString(full.Sum(nil))
+	return result, nil
+}
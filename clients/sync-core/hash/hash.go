@@ -225,8 +225,7 @@ func ComputeDeltaPlanFromReader(r io.Reader, localSize int64, remoteBlocks *Bloc
 		return plan, nil
 	}
 
-	// Use rolling hash to find matching blocks
-	rolling := NewRollingHash(blockSize)
+	// Match full blocks by weak (Adler-32) then strong hash
 	matchedRanges := make(map[int]bool) // Track matched remote blocks
 	var pendingData []byte
 	pos := 0
@@ -1,9 +1,13 @@
 import http from '@/lib/nos-client';
 import type {
   Catalog,
+  CatalogSourceStatus,
   CatalogEntry,
   InstalledApp,
   InstallRequest,
+  Exposure,
+  UpdatePolicy,
+  UpdateStatus,
   UpgradeRequest,
   RollbackRequest,
   LogStreamOptions,
@@ -40,6 +44,12 @@ export const appsApi = {
   deleteApp: (id: string, keepData = false) =>
     http.del<{ message: string }>(`/v1/apps/${id}?keep_data=${keepData}`),
 
+  setExposure: (id: string, data: Exposure) =>
+    http.put<InstalledApp>(`/v1/apps/${id}/expose`, data),
+
+  setUpdatePolicy: (id: string, data: UpdatePolicy) =>
+    http.put<InstalledApp>(`/v1/apps/${id}/update-policy`, data),
+
   rollbackApp: (id: string, snapshotTs: string) =>
     http.post<{ message: string }>(`/v1/apps/${id}/rollback`, {
       snapshot_ts: snapshotTs,
@@ -54,7 +64,10 @@ export const appsApi = {
 
   // Admin operations
   syncCatalogs: () =>
-    http.post<{ message: string }>('/v1/apps/catalog/sync'),
+    http.post<{ message: string; sources?: CatalogSourceStatus[] }>('/v1/apps/catalog/sync'),
+
+  checkUpdates: () =>
+    http.post<{ message: string; updates: Record<string, UpdateStatus | null> }>('/v1/apps/updates/check'),
 
   // WebSocket for logs
   streamLogs: (id: string, options: LogStreamOptions = {}) => {
@@ -13,6 +13,13 @@ export interface CatalogEntry {
   health: HealthConfig;
   needs_privileged: boolean;
   notes?: string;
+  manifest?: Record<string, any>;
+  permissions?: Permission[];
+}
+
+export interface Permission {
+  id: string;
+  description: string;
 }
 
 export interface AppDefaults {
@@ -56,6 +63,17 @@ export interface Catalog {
   entries: CatalogEntry[];
   source?: string;
   updated_at: string;
+  sources?: CatalogSourceStatus[];
+}
+
+export interface CatalogSourceStatus {
+  name: string;
+  type: string;
+  url: string;
+  revision?: string;
+  entries: number;
+  synced_at: string;
+  error?: string;
 }
 
 export interface InstalledApp {
@@ -70,6 +88,54 @@ export interface InstalledApp {
   installed_at: string;
   updated_at: string;
   snapshots: AppSnapshot[];
+  mounts?: Record<string, string>;
+  permissions?: string[];
+  expose?: Exposure;
+  sso_client_id?: string;
+  update_policy?: UpdatePolicy;
+  update?: UpdateStatus;
+}
+
+export type UpdateMode = 'notify' | 'auto' | 'pin';
+
+export interface UpdatePolicy {
+  mode: UpdateMode;
+  window?: string;
+  grace_minutes?: number;
+}
+
+export interface ImageUpdate {
+  image: string;
+  current: string;
+  available: string;
+}
+
+export interface UpgradeAttempt {
+  at: string;
+  from_version: string;
+  to_version: string;
+  result: 'upgraded' | 'failed' | 'rolled_back';
+  message?: string;
+  snapshot?: string;
+}
+
+export interface UpdateStatus {
+  checked_at: string;
+  version?: string;
+  images?: ImageUpdate[];
+  error?: string;
+  notified?: boolean;
+  held?: boolean;
+  last_upgrade?: UpgradeAttempt;
+}
+
+export type ExposeMode = 'path' | 'subdomain' | 'port' | 'none';
+
+export interface Exposure {
+  mode: ExposeMode;
+  domain?: string;
+  port?: number;
+  require_login?: boolean;
 }
 
 export type AppStatus = 
@@ -107,11 +173,15 @@ export interface InstallRequest {
   id: string;
   version?: string;
   params?: Record<string, any>;
+  mounts?: Record<string, string>;
+  accepted_permissions?: string[];
+  expose?: Exposure;
 }
 
 export interface UpgradeRequest {
   version: string;
   params?: Record<string, any>;
+  accepted_permissions?: string[];
 }
 
 export interface RollbackRequest {
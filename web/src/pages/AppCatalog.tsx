@@ -104,13 +104,19 @@ export function AppCatalog() {
     mutationFn: async () => {
       setIsRefreshing(true);
       // Call sync API
-      await appsApi.syncCatalogs();
+      const result = await appsApi.syncCatalogs();
       // Wait a bit for sync to complete
       await new Promise(resolve => setTimeout(resolve, 2000));
+      return result;
     },
-    onSuccess: () => {
+    onSuccess: (result) => {
       queryClient.invalidateQueries({ queryKey: ['apps', 'catalog'] });
-      toast.success('Catalogs synced successfully');
+      const failed = (result?.sources || []).filter((s) => s.error);
+      if (failed.length > 0) {
+        toast.error(`Rejected catalog from ${failed.map((s) => s.name).join(', ')}`);
+      } else {
+        toast.success('Catalogs synced successfully');
+      }
       setIsRefreshing(false);
     },
     onError: (error) => {
@@ -121,6 +127,7 @@ export function AppCatalog() {
   });
 
   const installedApps = installedData?.items || [];
+  const failedSources = (catalog?.sources || []).filter((s) => s.error);
   const installedAppIds = new Set(installedApps.map((app: InstalledApp) => app.id));
 
   // Get unique categories
@@ -445,6 +452,20 @@ export function AppCatalog() {
         </Button>
       </div>
 
+      {/* Rejected catalog sources */}
+      {failedSources.length > 0 && (
+        <div className="p-4 rounded-lg border border-red-500/30 bg-red-500/10 space-y-1">
+          {failedSources.map((source) => (
+            <div key={source.name} className="flex items-start gap-2 text-sm">
+              <AlertCircle className="w-4 h-4 mt-0.5 text-red-500 flex-shrink-0" />
+              <span>
+                <span className="font-medium">{source.name}</span>: catalog not loaded ({source.error})
+              </span>
+            </div>
+          ))}
+        </div>
+      )}
+
       {/* Tabs */}
       <div className="flex items-center justify-between">
         <div className="flex gap-1 p-1 bg-muted rounded-lg">
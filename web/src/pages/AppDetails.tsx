@@ -27,7 +27,7 @@ import {
   HardDrive
 } from 'lucide-react';
 import { appsApi } from '../api/apps';
-import type { AppSnapshot, AppEvent, ContainerHealth, PortMapping } from '../api/apps.types';
+import type { AppSnapshot, AppEvent, ContainerHealth, PortMapping, UpdateMode, UpdatePolicy } from '../api/apps.types';
 import { cn } from '../lib/utils';
 import { toast } from '@/components/ui/toast';
 import { formatDistanceToNow } from 'date-fns';
@@ -40,6 +40,7 @@ export function AppDetails() {
   const [showDeleteConfirm, setShowDeleteConfirm] = useState(false);
   const [keepData, setKeepData] = useState(false);
   const [selectedSnapshot, setSelectedSnapshot] = useState<string | null>(null);
+  const [policyDraft, setPolicyDraft] = useState<UpdatePolicy | null>(null);
   const [logsFollowing] = useState(true);
   const [logsPaused, setLogsPaused] = useState(false);
   const logsEndRef = useRef<HTMLDivElement>(null);
@@ -102,6 +103,22 @@ export function AppDetails() {
     },
   });
 
+  const updatePolicyMutation = useMutation({
+    mutationFn: (policy: UpdatePolicy) => appsApi.setUpdatePolicy(id!, policy),
+    onSuccess: () => {
+      toast.success('Update policy saved');
+      queryClient.invalidateQueries({ queryKey: ['apps', id] });
+      setPolicyDraft(null);
+    },
+  });
+
+  const checkUpdatesMutation = useMutation({
+    mutationFn: () => appsApi.checkUpdates(),
+    onSuccess: () => {
+      queryClient.invalidateQueries({ queryKey: ['apps', id] });
+    },
+  });
+
   const healthCheckMutation = useMutation({
     mutationFn: () => appsApi.forceHealthCheck(id!),
     onSuccess: () => {
@@ -260,6 +277,18 @@ export function AppDetails() {
                   <Shield className="w-4 h-4" />
                   <span className="capitalize">{app.health?.status || 'unknown'}</span>
                 </div>
+                {app.sso_client_id && (
+                  <div className="flex items-center gap-1 text-blue-400" title={`OIDC client ${app.sso_client_id}`}>
+                    <Shield className="w-4 h-4" />
+                    <span>Sign in with NithronOS</span>
+                  </div>
+                )}
+                {(app.update?.version || (app.update?.images?.length ?? 0) > 0) && (
+                  <div className="flex items-center gap-1 text-yellow-400">
+                    <ArrowUp className="w-4 h-4" />
+                    <span>{app.update?.version ? `v${app.update.version} available` : 'New images available'}</span>
+                  </div>
+                )}
               </div>
               {app.urls?.length > 0 && (
                 <div className="flex items-center gap-2 mt-3">
@@ -523,6 +552,107 @@ export function AppDetails() {
               </div>
             </div>
             
+            {/* Updates */}
+            <div>
+              <div className="flex items-center justify-between mb-3">
+                <h3 className="font-medium">Updates</h3>
+                <button
+                  onClick={() => checkUpdatesMutation.mutate()}
+                  disabled={checkUpdatesMutation.isPending}
+                  className="btn btn-secondary btn-sm"
+                >
+                  {checkUpdatesMutation.isPending ? (
+                    <Loader2 className="w-4 h-4 mr-2 animate-spin" />
+                  ) : (
+                    <RotateCw className="w-4 h-4 mr-2" />
+                  )}
+                  Check now
+                </button>
+              </div>
+              <div className="bg-gray-700 rounded-lg p-4 space-y-3 text-sm">
+                {app.update ? (
+                  <div className="space-y-1">
+                    {app.update.version && <p>Version {app.update.version} is in the catalog.</p>}
+                    {app.update.images?.map((img) => (
+                      <p key={img.image} className="font-mono text-xs">
+                        {img.image}: {img.current.slice(0, 19)} → {img.available.slice(0, 19)}
+                      </p>
+                    ))}
+                    {!app.update.version && !app.update.images?.length && <p>Up to date.</p>}
+                    {app.update.held && (
+                      <p className="text-yellow-400">
+                        This update is held after a failed automatic upgrade; save the policy to retry it.
+                      </p>
+                    )}
+                    {app.update.last_upgrade && (
+                      <p className="text-gray-400">
+                        Last automatic upgrade to v{app.update.last_upgrade.to_version}{' '}
+                        {formatDistanceToNow(new Date(app.update.last_upgrade.at), { addSuffix: true })}:{' '}
+                        {app.update.last_upgrade.result.replace('_', ' ')}
+                        {app.update.last_upgrade.message && ` (${app.update.last_upgrade.message})`}
+                      </p>
+                    )}
+                    {app.update.error && <p className="text-red-400">{app.update.error}</p>}
+                    <p className="text-gray-400">
+                      Checked {formatDistanceToNow(new Date(app.update.checked_at), { addSuffix: true })}
+                    </p>
+                  </div>
+                ) : (
+                  <p className="text-gray-400">Not checked yet.</p>
+                )}
+
+                {(() => {
+                  const policy = policyDraft ?? app.update_policy ?? { mode: 'notify' as UpdateMode };
+                  return (
+                    <div className="space-y-3 pt-3 border-t border-gray-600">
+                      <select
+                        value={policy.mode}
+                        onChange={(e) => setPolicyDraft({ ...policy, mode: e.target.value as UpdateMode })}
+                        className="w-full px-3 py-2 bg-gray-800 border border-gray-600 rounded-lg focus:outline-none focus:border-blue-500"
+                      >
+                        <option value="notify">Notify me</option>
+                        <option value="auto">Upgrade automatically</option>
+                        <option value="pin">Pin this version</option>
+                      </select>
+                      {policy.mode === 'auto' && (
+                        <div className="grid grid-cols-2 gap-3">
+                          <label className="space-y-1">
+                            <span className="text-gray-400">Maintenance window</span>
+                            <input
+                              type="text"
+                              value={policy.window ?? ''}
+                              onChange={(e) => setPolicyDraft({ ...policy, window: e.target.value })}
+                              placeholder="03:00-05:00"
+                              className="w-full px-3 py-2 bg-gray-800 border border-gray-600 rounded-lg focus:outline-none focus:border-blue-500"
+                            />
+                          </label>
+                          <label className="space-y-1">
+                            <span className="text-gray-400">Grace period (minutes)</span>
+                            <input
+                              type="number"
+                              min={0}
+                              max={1440}
+                              value={policy.grace_minutes ?? ''}
+                              onChange={(e) => setPolicyDraft({ ...policy, grace_minutes: Number(e.target.value) || undefined })}
+                              placeholder="10"
+                              className="w-full px-3 py-2 bg-gray-800 border border-gray-600 rounded-lg focus:outline-none focus:border-blue-500"
+                            />
+                          </label>
+                        </div>
+                      )}
+                      <button
+                        onClick={() => updatePolicyMutation.mutate(policy)}
+                        disabled={updatePolicyMutation.isPending}
+                        className="btn btn-primary btn-sm"
+                      >
+                        Save policy
+                      </button>
+                    </div>
+                  );
+                })()}
+              </div>
+            </div>
+
             {/* Port Mappings */}
             {app.ports && app.ports.length > 0 && (
               <div>
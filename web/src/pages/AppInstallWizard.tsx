@@ -16,7 +16,7 @@ import {
   Info
 } from 'lucide-react';
 import { appsApi } from '../api/apps';
-import type { CatalogEntry, JsonSchemaProperty, PortMapping, VolumeMount } from '../api/apps.types';
+import type { CatalogEntry, Exposure, ExposeMode, JsonSchemaProperty, Permission, PortMapping, VolumeMount } from '../api/apps.types';
 import { cn } from '../lib/utils';
 import { toast } from '@/components/ui/toast';
 
@@ -35,6 +35,9 @@ export function AppInstallWizard() {
   const [formData, setFormData] = useState<FormData>({});
   const [formErrors, setFormErrors] = useState<FormErrors>({});
   const [showPasswords, setShowPasswords] = useState<Record<string, boolean>>({});
+  const [permissionsAccepted, setPermissionsAccepted] = useState(false);
+  // Unset leaves the exposure to the app's manifest
+  const [expose, setExpose] = useState<Exposure | null>(null);
 
   // Fetch catalog
   const { data: catalog } = useQuery({
@@ -135,7 +138,9 @@ export function AppInstallWizard() {
     mutationFn: (params: FormData) => 
       appsApi.installApp({
         id: id!,
-        params
+        params,
+        accepted_permissions: app?.permissions?.map((p: Permission) => p.id),
+        expose: expose ?? undefined
       }),
     onSuccess: () => {
       toast.success(`${app?.name} installed successfully!`);
@@ -499,6 +504,83 @@ export function AppInstallWizard() {
                 </div>
               </div>
               
+              <div className="bg-gray-700 rounded-lg p-4">
+                <h3 className="font-medium mb-3">Web Access</h3>
+                <div className="space-y-3 text-sm">
+                  <select
+                    value={expose?.mode ?? ''}
+                    onChange={(e) => {
+                      const mode = e.target.value as ExposeMode | '';
+                      setExpose(mode ? { mode, require_login: expose?.require_login ?? false } : null);
+                    }}
+                    className="w-full px-3 py-2 bg-gray-800 border border-gray-600 rounded-lg focus:outline-none focus:border-blue-500"
+                  >
+                    <option value="">App default</option>
+                    <option value="path">Path: /apps/{app.id}/</option>
+                    <option value="subdomain">Subdomain</option>
+                    <option value="port">Dedicated port</option>
+                    <option value="none">Not exposed</option>
+                  </select>
+                  {expose?.mode === 'subdomain' && (
+                    <input
+                      type="text"
+                      value={expose.domain ?? ''}
+                      onChange={(e) => setExpose({ ...expose, domain: e.target.value })}
+                      placeholder={`${app.id}.nas.lan`}
+                      className="w-full px-3 py-2 bg-gray-800 border border-gray-600 rounded-lg focus:outline-none focus:border-blue-500"
+                    />
+                  )}
+                  {expose?.mode === 'port' && (
+                    <input
+                      type="number"
+                      min={1024}
+                      max={65535}
+                      value={expose.port ?? ''}
+                      onChange={(e) => setExpose({ ...expose, port: Number(e.target.value) || undefined })}
+                      placeholder="8443"
+                      className="w-full px-3 py-2 bg-gray-800 border border-gray-600 rounded-lg focus:outline-none focus:border-blue-500"
+                    />
+                  )}
+                  {expose && expose.mode !== 'none' && (
+                    <label className="flex items-center gap-2">
+                      <input
+                        type="checkbox"
+                        checked={expose.require_login ?? false}
+                        onChange={(e) => setExpose({ ...expose, require_login: e.target.checked })}
+                      />
+                      <span>Require NithronOS login</span>
+                    </label>
+                  )}
+                </div>
+              </div>
+
+              {app.permissions && app.permissions.length > 0 && (
+                <div className="bg-red-900/20 border border-red-800 rounded-lg p-4">
+                  <div className="flex items-start gap-3">
+                    <Shield className="w-5 h-5 text-red-400 flex-shrink-0 mt-0.5" />
+                    <div className="text-sm">
+                      <p className="text-red-300 font-medium mb-1">Permissions</p>
+                      <p className="text-gray-400 mb-2">This app asks to:</p>
+                      <ul className="list-disc list-inside space-y-1 mb-3">
+                        {app.permissions.map((p: Permission) => (
+                          <li key={p.id}>
+                            {p.description} <code className="text-xs text-gray-400">{p.id}</code>
+                          </li>
+                        ))}
+                      </ul>
+                      <label className="flex items-center gap-2">
+                        <input
+                          type="checkbox"
+                          checked={permissionsAccepted}
+                          onChange={(e) => setPermissionsAccepted(e.target.checked)}
+                        />
+                        <span>I grant these permissions</span>
+                      </label>
+                    </div>
+                  </div>
+                </div>
+              )}
+
               <div className="bg-yellow-900/20 border border-yellow-800 rounded-lg p-4">
                 <div className="flex items-start gap-3">
                   <AlertCircle className="w-5 h-5 text-yellow-400 flex-shrink-0 mt-0.5" />
@@ -538,7 +620,7 @@ export function AppInstallWizard() {
         ) : (
           <button
             onClick={handleInstall}
-            disabled={installMutation.isPending}
+            disabled={installMutation.isPending || (!!app.permissions?.length && !permissionsAccepted)}
             className="btn btn-primary"
           >
             {installMutation.isPending ? (
@@ -39,8 +39,11 @@ export function Login() {
   // Check if backend is reachable
   const isBackendUnreachable = notice?.title.includes('Backend unreachable')
   
-  // Get return URL from location state
-  const returnTo = (location.state as any)?.returnTo || '/'
+  // Get return URL from location state, or ?next= when an app's login
+  // gate sent us here
+  const next = new URLSearchParams(location.search).get('next')
+  const safeNext = next && next.startsWith('/') && !next.startsWith('//') && !next.startsWith('/\\') ? next : null
+  const returnTo = (location.state as any)?.returnTo || safeNext || '/'
   
   const {
     register,
@@ -106,8 +109,13 @@ export function Login() {
       // Check session to update auth context
       await checkSession()
       
-      // Navigate to return URL or dashboard
-      navigate(returnTo, { replace: true })
+      // Navigate to return URL or dashboard; app routes are served by the
+      // proxy, not the SPA
+      if (returnTo.startsWith('/api/') || /^\/apps\/[^/]+\//.test(returnTo)) {
+        window.location.assign(returnTo)
+      } else {
+        navigate(returnTo, { replace: true })
+      }
     } catch (err) {
       if (err instanceof APIError) {
         // Check for TOTP requirement